@@ -11,6 +11,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 )
 
@@ -289,10 +290,30 @@ func (cs Constants) LDFlags() string {
 	return strings.Join(l, " ")
 }
 
+// minGoMinor is the minimal minor version of Go 1.x required to build restic.
+const minGoMinor = 9
+
+// goMinor returns the minor version of a Go 1.x release version such as
+// "go1.10.3". For other versions (e.g. development versions), false is
+// returned.
+func goMinor(ver string) (int, bool) {
+	if !strings.HasPrefix(ver, "go1.") {
+		return 0, false
+	}
+
+	minor := strings.SplitN(strings.TrimPrefix(ver, "go1."), ".", 2)[0]
+	n, err := strconv.Atoi(minor)
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
 func main() {
 	ver := runtime.Version()
-	if strings.HasPrefix(ver, "go1") && ver < "go1.7" {
-		fmt.Fprintf(os.Stderr, "Go version %s detected, restic requires at least Go 1.7\n", ver)
+	if minor, ok := goMinor(ver); ok && minor < minGoMinor {
+		fmt.Fprintf(os.Stderr, "Go version %s detected, restic requires at least Go 1.%d\n", ver, minGoMinor)
 		os.Exit(1)
 	}
 
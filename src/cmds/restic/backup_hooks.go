@@ -0,0 +1,300 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"restic/debug"
+	"restic/errors"
+	"restic/shell"
+)
+
+// runHook runs the command for the hook name (e.g. "pre-hook"). The command
+// is split into arguments like a shell does, env is added to the environment.
+func runHook(name, command string, env []string) error {
+	program, args, err := shell.SplitArgs(command)
+	if err != nil {
+		return errors.Fatalf("invalid --%s %q: %v", name, command, err)
+	}
+
+	debug.Log("run %v: %v %v", name, program, args)
+
+	cmd := exec.Command(program, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err = cmd.Run(); err != nil {
+		return errors.Fatalf("--%s %q failed: %v", name, command, err)
+	}
+
+	return nil
+}
+
+// freezeHook holds the commands which freeze and thaw a single path, e.g.
+// with fsfreeze or a script which quiesces an application.
+type freezeHook struct {
+	path, freeze, thaw string
+}
+
+// freezeHooks are run in the order in which the paths were given first, and
+// thawed in reverse order.
+type freezeHooks []*freezeHook
+
+// parseFreezeHooks parses the values of --freeze-hook and --thaw-hook, which
+// have the form "path=command".
+func parseFreezeHooks(freeze, thaw []string) (freezeHooks, error) {
+	var hooks freezeHooks
+	byPath := make(map[string]*freezeHook)
+
+	add := func(name string, specs []string, set func(*freezeHook, string)) error {
+		for _, spec := range specs {
+			data := strings.SplitN(spec, "=", 2)
+			if len(data) != 2 || data[0] == "" || data[1] == "" {
+				return errors.Fatalf("invalid value for --%s: %q, the format is PATH=COMMAND", name, spec)
+			}
+
+			path, err := filepath.Abs(data[0])
+			if err != nil {
+				return errors.Wrap(err, "Abs")
+			}
+
+			h, ok := byPath[path]
+			if !ok {
+				h = &freezeHook{path: path}
+				byPath[path] = h
+				hooks = append(hooks, h)
+			}
+			set(h, data[1])
+		}
+		return nil
+	}
+
+	if err := add("freeze-hook", freeze, func(h *freezeHook, cmd string) { h.freeze = cmd }); err != nil {
+		return nil, err
+	}
+	if err := add("thaw-hook", thaw, func(h *freezeHook, cmd string) { h.thaw = cmd }); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+// freeze runs the freeze commands one after the other and returns the hooks
+// which need to be thawed. When a command fails, the paths frozen before are
+// thawed again.
+func (hooks freezeHooks) freeze(env []string) (freezeHooks, error) {
+	var frozen freezeHooks
+	for _, h := range hooks {
+		if h.freeze != "" {
+			err := runHook("freeze-hook", h.freeze, append(env, "RESTIC_FREEZE_PATH="+h.path))
+			if err != nil {
+				if terr := frozen.thaw(env); terr != nil {
+					Warnf("%v\n", terr)
+				}
+				return nil, err
+			}
+		}
+		frozen = append(frozen, h)
+	}
+
+	return frozen, nil
+}
+
+// thaw runs the thaw commands in reverse order. All commands are run, the
+// first error is returned.
+func (hooks freezeHooks) thaw(env []string) error {
+	var firstErr error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		if h.thaw == "" {
+			continue
+		}
+
+		err := runHook("thaw-hook", h.thaw, append(env, "RESTIC_FREEZE_PATH="+h.path))
+		firstErr = firstError(firstErr, err)
+	}
+
+	return firstErr
+}
+
+// runWithHooks runs the pre hook, fn and the post hook. The post hook is
+// also run when the pre hook or fn failed or restic is interrupted, so that
+// it can clean up (e.g. remove a file system snapshot), the variable
+// RESTIC_BACKUP_STATUS tells it whether the backup was successful.
+//
+// The paths with freeze hooks are frozen before the pre hook runs, so that
+// all file system snapshots it creates are taken at the same instant, and
+// thawed right after it. Freeze hooks require a pre hook, so the paths are
+// never frozen during the backup itself.
+func runWithHooks(opts BackupOptions, args []string, fn func() error) error {
+	env := []string{"RESTIC_BACKUP_PATHS=" + strings.Join(args, string(os.PathListSeparator))}
+
+	hooks, err := parseFreezeHooks(opts.FreezeHooks, opts.ThawHooks)
+	if err != nil {
+		return err
+	}
+
+	if len(hooks) > 0 && opts.PreHook == "" {
+		return errors.Fatal("--freeze-hook and --thaw-hook require --pre-hook, the paths are only frozen while it runs")
+	}
+
+	frozen, err := hooks.freeze(env)
+
+	// the paths are thawed as well when restic is interrupted while the pre
+	// hook runs
+	var thawOnce sync.Once
+	thaw := func() (err error) {
+		thawOnce.Do(func() { err = frozen.thaw(env) })
+		return err
+	}
+	AddCleanupHandler(thaw)
+
+	// the cleanup handlers run in order, so the post hook runs after the
+	// paths have been thawed
+	var postOnce sync.Once
+	post := func(status string) (err error) {
+		postOnce.Do(func() {
+			err = runHook("post-hook", opts.PostHook, append(env, "RESTIC_BACKUP_STATUS="+status))
+		})
+		return err
+	}
+	if opts.PostHook != "" {
+		AddCleanupHandler(func() error {
+			return post("interrupted")
+		})
+	}
+
+	if err == nil && opts.PreHook != "" {
+		err = runHook("pre-hook", opts.PreHook, env)
+		err = firstError(err, thaw())
+	}
+
+	if err == nil {
+		err = fn()
+	}
+
+	if opts.PostHook == "" {
+		return err
+	}
+
+	status := "success"
+	if err != nil {
+		status = "failure"
+	}
+
+	herr := post(status)
+	if err != nil {
+		if herr != nil {
+			Warnf("%v\n", herr)
+		}
+		return err
+	}
+
+	return herr
+}
+
+// firstError returns err, or next if err is nil. If both are set, next is
+// printed as a warning.
+func firstError(err, next error) error {
+	if err == nil {
+		return next
+	}
+
+	if next != nil {
+		Warnf("%v\n", next)
+	}
+	return err
+}
+
+// pathMap maps original paths to the locations they are read from, e.g.
+// the mount point of a file system snapshot.
+type pathMap []struct {
+	original, source string
+}
+
+// parsePathMap parses the values of --read-from, which have the form
+// "original=source".
+func parsePathMap(specs []string) (pathMap, error) {
+	var m pathMap
+	for _, spec := range specs {
+		data := strings.SplitN(spec, "=", 2)
+		if len(data) != 2 || data[0] == "" || data[1] == "" {
+			return nil, errors.Fatalf("invalid value for --read-from: %q, the format is ORIGINAL=SOURCE", spec)
+		}
+
+		original, err := filepath.Abs(data[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "Abs")
+		}
+
+		source, err := filepath.Abs(data[1])
+		if err != nil {
+			return nil, errors.Wrap(err, "Abs")
+		}
+
+		m = append(m, struct{ original, source string }{original, source})
+	}
+
+	return m, nil
+}
+
+// replacePrefix returns p with the directory prefix replaced, or false if p
+// is not located in prefix.
+func replacePrefix(p, prefix, replacement string) (string, bool) {
+	if p == prefix {
+		return replacement, true
+	}
+
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+
+	if !strings.HasPrefix(p, prefix) {
+		return "", false
+	}
+
+	return filepath.Join(replacement, p[len(prefix):]), true
+}
+
+// toSource returns the path to read for the original path p. The longest
+// matching original path is used.
+func (m pathMap) toSource(p string) string {
+	result, length := p, -1
+	for _, e := range m {
+		if s, ok := replacePrefix(p, e.original, e.source); ok && len(e.original) > length {
+			result, length = s, len(e.original)
+		}
+	}
+	return result
+}
+
+// toOriginal returns the original path for the path p which is read.
+func (m pathMap) toOriginal(p string) string {
+	result, length := p, -1
+	for _, e := range m {
+		if s, ok := replacePrefix(p, e.source, e.original); ok && len(e.source) > length {
+			result, length = s, len(e.source)
+		}
+	}
+	return result
+}
+
+// sourceTargets returns the paths to read for the targets. Since the
+// snapshot stores the targets by their base names, the base name of a path
+// must not change.
+func (m pathMap) sourceTargets(targets []string) ([]string, error) {
+	sources := make([]string, 0, len(targets))
+	for _, target := range targets {
+		source := m.toSource(target)
+		if filepath.Base(source) != filepath.Base(target) {
+			return nil, errors.Fatalf("%v is read from %v, but the base names differ; mount the file system snapshot at a directory called %q",
+				target, source, filepath.Base(target))
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
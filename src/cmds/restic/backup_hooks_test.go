@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	. "restic/test"
+)
+
+func TestPathMap(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses unix paths")
+	}
+
+	m, err := parsePathMap([]string{"/home=/mnt/snap/home", "/home/user/data=/mnt/data"})
+	OK(t, err)
+
+	var tests = []struct {
+		original, source string
+	}{
+		{"/home", "/mnt/snap/home"},
+		{"/home/user", "/mnt/snap/home/user"},
+		{"/home/user/data/file", "/mnt/data/file"},
+		{"/homework", "/homework"},
+		{"/srv", "/srv"},
+	}
+
+	for _, test := range tests {
+		Equals(t, test.source, m.toSource(test.original))
+		Equals(t, test.original, m.toOriginal(test.source))
+	}
+
+	sources, err := m.sourceTargets([]string{"/home", "/srv"})
+	OK(t, err)
+	Equals(t, []string{"/mnt/snap/home", "/srv"}, sources)
+
+	m, err = parsePathMap([]string{"/home=/mnt/snap"})
+	OK(t, err)
+	_, err = m.sourceTargets([]string{"/home"})
+	Assert(t, err != nil, "no error for a source with a different base name")
+
+	for _, spec := range []string{"/home", "=/mnt", "/home="} {
+		_, err = parsePathMap([]string{spec})
+		Assert(t, err != nil, "no error for invalid value %q", spec)
+	}
+}
+
+func TestRunWithHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses sh")
+	}
+
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	logfile := filepath.Join(tempdir, "log")
+	hook := func(name string) string {
+		return `sh -c 'echo "` + name + ` $RESTIC_BACKUP_PATHS $RESTIC_BACKUP_STATUS" >> ` + logfile + `'`
+	}
+
+	readLog := func() []string {
+		buf, err := ioutil.ReadFile(logfile)
+		OK(t, err)
+		OK(t, ioutil.WriteFile(logfile, nil, 0600))
+		return strings.Split(strings.TrimSpace(string(buf)), "\n")
+	}
+
+	opts := BackupOptions{PreHook: hook("pre"), PostHook: hook("post")}
+	called := false
+	OK(t, runWithHooks(opts, []string{"/home", "/srv"}, func() error {
+		called = true
+		return nil
+	}))
+	Assert(t, called, "backup function was not called")
+	Equals(t, []string{"pre /home:/srv ", "post /home:/srv success"}, readLog())
+
+	// the post hook is registered as a cleanup handler, but only runs once
+	RunCleanupHandlers()
+	buf, err := ioutil.ReadFile(logfile)
+	OK(t, err)
+	Equals(t, 0, len(buf))
+
+	// when restic is interrupted, the post hook runs from the cleanup handler
+	OK(t, runWithHooks(opts, []string{"/home"}, func() error {
+		RunCleanupHandlers()
+		return nil
+	}))
+	Equals(t, []string{"pre /home ", "post /home interrupted"}, readLog())
+
+	// the post hook also runs if the backup fails
+	backupErr := errors.New("backup failed")
+	err = runWithHooks(opts, []string{"/home"}, func() error {
+		return backupErr
+	})
+	Equals(t, backupErr, err)
+	Equals(t, []string{"pre /home ", "post /home failure"}, readLog())
+
+	// the backup is not run if the pre hook fails
+	opts.PreHook = "false"
+	called = false
+	err = runWithHooks(opts, []string{"/home"}, func() error {
+		called = true
+		return nil
+	})
+	Assert(t, err != nil, "no error returned for a failing pre hook")
+	Assert(t, !called, "backup was run although the pre hook failed")
+	Equals(t, []string{"post /home failure"}, readLog())
+}
+
+func TestParseFreezeHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses unix paths")
+	}
+
+	hooks, err := parseFreezeHooks(
+		[]string{"/srv=fsfreeze -f /srv", "/home=fsfreeze -f /home"},
+		[]string{"/home=fsfreeze -u /home", "/var/lib/db=db-resume"})
+	OK(t, err)
+
+	Equals(t, 3, len(hooks))
+	Equals(t, freezeHook{"/srv", "fsfreeze -f /srv", ""}, *hooks[0])
+	Equals(t, freezeHook{"/home", "fsfreeze -f /home", "fsfreeze -u /home"}, *hooks[1])
+	Equals(t, freezeHook{"/var/lib/db", "", "db-resume"}, *hooks[2])
+
+	for _, spec := range []string{"/srv", "=true", "/srv="} {
+		_, err = parseFreezeHooks([]string{spec}, nil)
+		Assert(t, err != nil, "no error for invalid value %q", spec)
+	}
+}
+
+func TestRunWithFreezeHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses sh")
+	}
+
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	logfile := filepath.Join(tempdir, "log")
+	hook := func(name string) string {
+		return `sh -c 'echo "` + name + `${RESTIC_FREEZE_PATH:+ $RESTIC_FREEZE_PATH}" >> ` + logfile + `'`
+	}
+
+	readLog := func() []string {
+		buf, err := ioutil.ReadFile(logfile)
+		OK(t, err)
+		OK(t, ioutil.WriteFile(logfile, nil, 0600))
+		return strings.Split(strings.TrimSpace(string(buf)), "\n")
+	}
+
+	opts := BackupOptions{
+		FreezeHooks: []string{"/srv=" + hook("freeze"), "/home=" + hook("freeze")},
+		ThawHooks:   []string{"/srv=" + hook("thaw"), "/home=" + hook("thaw")},
+		PreHook:     hook("pre"),
+		PostHook:    hook("post"),
+	}
+
+	backup := func() error {
+		return runHook("test", hook("backup"), nil)
+	}
+
+	// all paths are frozen before the pre hook and thawed right after it
+	OK(t, runWithHooks(opts, []string{"/home", "/srv"}, backup))
+	Equals(t, []string{"freeze /srv", "freeze /home", "pre", "thaw /home", "thaw /srv", "backup", "post"}, readLog())
+
+	// the thaw hooks are also registered as a cleanup handler, but the paths
+	// are only thawed once
+	RunCleanupHandlers()
+	buf, err := ioutil.ReadFile(logfile)
+	OK(t, err)
+	Equals(t, 0, len(buf))
+
+	// freeze hooks require a pre hook, the paths are never frozen during
+	// the backup
+	opts.PreHook = ""
+	called := false
+	err = runWithHooks(opts, []string{"/home", "/srv"}, func() error {
+		called = true
+		return nil
+	})
+	Assert(t, err != nil, "no error returned for freeze hooks without a pre hook")
+	Assert(t, !called, "backup was run with freeze hooks but without a pre hook")
+	opts.PreHook = hook("pre")
+
+	// when freezing a path fails, the paths frozen before are thawed and the
+	// backup is not run
+	opts.FreezeHooks[1] = "/home=false"
+	called = false
+	err = runWithHooks(opts, []string{"/home", "/srv"}, func() error {
+		called = true
+		return nil
+	})
+	Assert(t, err != nil, "no error returned for a failing freeze hook")
+	Assert(t, !called, "backup was run although a freeze hook failed")
+	Equals(t, []string{"freeze /srv", "thaw /srv", "post"}, readLog())
+}
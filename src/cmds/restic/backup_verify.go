@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"restic"
+	"restic/debug"
+	"restic/errors"
+	"restic/repository"
+)
+
+// verifySnapshot re-reads the snapshot id from the backend and makes sure it
+// can be restored: all trees are loaded, and each blob referenced by the
+// snapshot must be listed in one of the index files stored in the repository
+// for a pack file which exists in the backend.
+func verifySnapshot(ctx context.Context, repo restic.Repository, id restic.ID) error {
+	sn, err := restic.LoadSnapshot(ctx, repo, id)
+	if err != nil {
+		return err
+	}
+
+	if sn.Tree == nil {
+		return errors.Errorf("snapshot %v has no tree", id.Str())
+	}
+
+	used := restic.NewBlobSet()
+	err = restic.FindUsedBlobs(ctx, repo, *sn.Tree, used, restic.NewBlobSet())
+	if err != nil {
+		return err
+	}
+
+	packs := restic.NewIDSet()
+	for packID := range repo.List(ctx, restic.DataFile) {
+		packs.Insert(packID)
+	}
+
+	available := restic.NewBlobSet()
+	for indexID := range repo.List(ctx, restic.IndexFile) {
+		idx, err := repository.LoadIndex(ctx, repo, indexID)
+		if err != nil {
+			return err
+		}
+
+		for pb := range idx.Each(nil) {
+			if packs.Has(pb.PackID) {
+				available.Insert(restic.BlobHandle{ID: pb.ID, Type: pb.Type})
+			}
+		}
+	}
+
+	for h := range used {
+		if !available.Has(h) {
+			return errors.Errorf("blob %v is not stored in the repository", h)
+		}
+	}
+
+	debug.Log("snapshot %v verified, %d blobs", id.Str(), len(used))
+	return nil
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"restic"
+	"runtime"
+	"sort"
 	"strings"
 	"time"
 
@@ -26,32 +30,71 @@ var cmdBackup = &cobra.Command{
 	Long: `
 The "backup" command creates a new snapshot and saves the files and directories
 given as the arguments.
+
+With --dry-run, the files are read and compared to the parent snapshot as
+usual, but nothing is written to the repository. Instead, the number and size
+of new or changed files and the estimated amount of data to upload are
+reported.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if backupOptions.Stdin && backupOptions.FilesFrom == "-" {
 			return errors.Fatal("cannot use both `--stdin` and `--files-from -`")
 		}
-
-		if backupOptions.Stdin {
-			return readBackupFromStdin(backupOptions, globalOptions, args)
+		if backupOptions.Stdin && backupOptions.SkipUnchanged {
+			return errors.Fatal("cannot use both `--stdin` and `--skip-if-unchanged`")
+		}
+		if backupOptions.Stdin && backupOptions.DryRun {
+			return errors.Fatal("cannot use both `--stdin` and `--dry-run`")
 		}
 
-		return runBackup(backupOptions, globalOptions, args)
+		return runWithMetrics("backup", globalOptions, func(gopts GlobalOptions) error {
+			return runWithHooks(backupOptions, args, func() error {
+				if backupOptions.Stdin {
+					return readBackupFromStdin(backupOptions, gopts, args)
+				}
+				return runBackup(backupOptions, gopts, args)
+			})
+		})
 	},
 }
 
 // BackupOptions bundles all options for the backup command.
 type BackupOptions struct {
-	Parent         string
-	Force          bool
-	Excludes       []string
-	ExcludeFiles   []string
-	ExcludeOtherFS bool
-	Stdin          bool
-	StdinFilename  string
-	Tags           []string
-	Hostname       string
-	FilesFrom      string
+	Parent             string
+	Force              bool
+	Excludes           []string
+	ExcludeFiles       []string
+	ExcludeOtherFS     bool
+	ExcludeIfPresent   []string
+	ExcludeCaches      bool
+	IgnoreFiles        []string
+	Stdin              bool
+	StdinFilename      string
+	Tags               []string
+	Hostname           string
+	FilesFrom          string
+	FilesFromNull      bool
+	ChangeJournal      bool
+	RelativePaths      bool
+	NewerThan          string
+	SkipUnchanged      bool
+	VerifySnapshot     bool
+	MtimeSkew          time.Duration
+	DryRun             bool
+	IgnoreInode        bool
+	IgnoreCtime        bool
+	NoXattrs           bool
+	TimeStamp          string
+	CheckpointInterval time.Duration
+	TimeLimit          time.Duration
+	ChangedFileRetries int
+	UseFsSnapshot      bool
+	PreHook            string
+	PostHook           string
+	FreezeHooks        []string
+	ThawHooks          []string
+	ReadFrom           []string
+	ReadConcurrency    int
 }
 
 var backupOptions BackupOptions
@@ -68,14 +111,39 @@ func init() {
 	f := cmdBackup.Flags()
 	f.StringVar(&backupOptions.Parent, "parent", "", "use this parent snapshot (default: last snapshot in the repo that has the same target files/directories)")
 	f.BoolVarP(&backupOptions.Force, "force", "f", false, `force re-reading the target files/directories (overrides the "parent" flag)`)
-	f.StringSliceVarP(&backupOptions.Excludes, "exclude", "e", nil, "exclude a `pattern` (can be specified multiple times)")
+	f.StringArrayVarP(&backupOptions.Excludes, "exclude", "e", nil, "exclude a `pattern`, commas outside of braces separate several patterns (can be specified multiple times)")
 	f.StringSliceVar(&backupOptions.ExcludeFiles, "exclude-file", nil, "read exclude patterns from a `file` (can be specified multiple times)")
-	f.BoolVarP(&backupOptions.ExcludeOtherFS, "one-file-system", "x", false, "exclude other file systems")
+	f.BoolVarP(&backupOptions.ExcludeOtherFS, "one-file-system", "x", false, "exclude other file systems, like tar --one-file-system (mount points are saved as empty directories)")
+	f.StringArrayVar(&backupOptions.ExcludeIfPresent, "exclude-if-present", nil, "exclude the contents of directories which contain `filename[:header]`, the file must start with header if given (can be specified multiple times)")
+	f.BoolVar(&backupOptions.ExcludeCaches, "exclude-caches", false, `exclude the contents of cache directories which are marked with a CACHEDIR.TAG file`)
+	f.StringArrayVar(&backupOptions.IgnoreFiles, "use-ignore-files", nil, "exclude files which match a pattern from a file called `filename` (e.g. .resticignore) in one of the directories above them (can be specified multiple times)")
 	f.BoolVar(&backupOptions.Stdin, "stdin", false, "read backup from stdin")
 	f.StringVar(&backupOptions.StdinFilename, "stdin-filename", "stdin", "file name to use when reading from stdin")
 	f.StringSliceVar(&backupOptions.Tags, "tag", nil, "add a `tag` for the new snapshot (can be specified multiple times)")
 	f.StringVar(&backupOptions.Hostname, "hostname", hostname, "set the `hostname` for the snapshot manually")
 	f.StringVar(&backupOptions.FilesFrom, "files-from", "", "read the files to backup from file (can be combined with file args)")
+	f.BoolVar(&backupOptions.FilesFromNull, "files-from-null", false, "the entries read with --files-from are terminated by a NUL byte instead of a newline (e.g. from find -print0)")
+	f.BoolVar(&backupOptions.ChangeJournal, "use-change-journal", false, "skip directories which the file system's change journal reports as unchanged since the parent snapshot (Windows and macOS only)")
+	f.BoolVar(&backupOptions.RelativePaths, "relative-paths", false, "record the paths as given instead of absolute paths, a trailing slash saves the contents of a directory instead of the directory itself")
+	f.StringVar(&backupOptions.NewerThan, "newer-than", "", "only include files modified or changed after `time`, or after the snapshot with this ID (use \"latest\" for the parent snapshot)")
+	f.BoolVar(&backupOptions.SkipUnchanged, "skip-if-unchanged", false, "do not create a new snapshot if nothing changed since the parent snapshot")
+	f.BoolVar(&backupOptions.VerifySnapshot, "require-snapshot-verify", false, "re-read the new snapshot from the repository and check that all data it references is stored before reporting success")
+	f.StringVar(&backupOptions.TimeStamp, "time", "", "record `time` as the time of the snapshot instead of the current time (e.g. \"2017-06-30 22:08:41\")")
+	f.DurationVar(&backupOptions.CheckpointInterval, "checkpoint-interval", 5*time.Minute, "save a checkpoint of the files saved so far every `duration`, an interrupted backup resumes from it (0 disables checkpoints)")
+	f.IntVar(&backupOptions.ChangedFileRetries, "changed-file-retries", 2, "read files which change while they are read up to `n` more times, before saving them marked as inconsistent")
+	f.DurationVar(&backupOptions.TimeLimit, "time-limit", 0, "stop reading new files after `duration` (e.g. 2h) and save the files backed up so far as a snapshot tagged 'partial', the next backup continues from it")
+	f.StringVar(&backupOptions.PreHook, "pre-hook", "", "run `command` before the backup, e.g. to create a file system snapshot; the backup is aborted if it fails")
+	f.StringVar(&backupOptions.PostHook, "post-hook", "", "run `command` after the backup, also if it failed (e.g. to remove a file system snapshot)")
+	f.StringArrayVar(&backupOptions.FreezeHooks, "freeze-hook", nil, "run `path=command` to freeze path (e.g. fsfreeze) before the pre hook, all paths are frozen at the same time (can be specified multiple times)")
+	f.StringArrayVar(&backupOptions.ThawHooks, "thaw-hook", nil, "run `path=command` to thaw path after the pre hook, requires --pre-hook (can be specified multiple times)")
+	f.StringArrayVar(&backupOptions.ReadFrom, "read-from", nil, "read the files below `original=source` from source (e.g. a file system snapshot) and record the original path (can be specified multiple times)")
+	f.IntVar(&backupOptions.ReadConcurrency, "read-concurrency", 0, "read `n` files in parallel (default: 2 if a target is on a rotating disk, 10 otherwise)")
+	f.DurationVar(&backupOptions.MtimeSkew, "mtime-skew", 0, "consider files unchanged if their timestamps differ from the parent snapshot by at most `duration`, e.g. 2s for network file systems")
+	f.BoolVarP(&backupOptions.DryRun, "dry-run", "n", false, "do not write anything to the repository, only report what would be uploaded")
+	f.BoolVar(&backupOptions.UseFsSnapshot, "use-fs-snapshot", false, "read the files from a Volume Shadow Copy of each volume, so that files which are opened exclusively by other programs can be saved (Windows only)")
+	f.BoolVar(&backupOptions.IgnoreInode, "ignore-inode", false, "do not read files again only because their inode changed since the parent snapshot")
+	f.BoolVar(&backupOptions.IgnoreCtime, "ignore-ctime", false, "do not read files again only because their change time (ctime) changed since the parent snapshot")
+	f.BoolVar(&backupOptions.NoXattrs, "no-xattrs", false, "do not save extended attributes")
 }
 
 func newScanProgress(gopts GlobalOptions) *restic.Progress {
@@ -156,6 +224,34 @@ func newArchiveProgress(gopts GlobalOptions, todo restic.Stat) *restic.Progress
 	return archiveProgress
 }
 
+// withBackupMetrics records the statistics of the backup as metrics when p
+// is done. If p is nil (e.g. in quiet mode), a silent progress is returned.
+func withBackupMetrics(gopts GlobalOptions, p *restic.Progress) *restic.Progress {
+	m := gopts.metrics
+	if m == nil {
+		return p
+	}
+
+	if p == nil {
+		p = restic.NewProgress()
+		p.OnUpdate = func(restic.Stat, time.Duration, bool) {}
+	}
+
+	onDone := p.OnDone
+	p.OnDone = func(s restic.Stat, d time.Duration, ticker bool) {
+		m.Set("backup_files", "Number of files processed by the backup.", float64(s.Files))
+		m.Set("backup_dirs", "Number of directories processed by the backup.", float64(s.Dirs))
+		m.Set("backup_bytes", "Number of bytes processed by the backup.", float64(s.Bytes))
+		m.Set("backup_errors", "Number of errors during the backup.", float64(s.Errors))
+
+		if onDone != nil {
+			onDone(s, d, ticker)
+		}
+	}
+
+	return p
+}
+
 func newArchiveStdinProgress(gopts GlobalOptions) *restic.Progress {
 	if gopts.Quiet {
 		return nil
@@ -219,6 +315,61 @@ func filterExisting(items []string) (result []string, err error) {
 	return
 }
 
+// relativeTargets returns the absolute paths to read for the arguments, and
+// the paths to record in the snapshot, which are the cleaned arguments. As with
+// rsync, an argument with a trailing slash denotes the contents of the
+// directory: the entries in it are read and stored at the top level of the
+// snapshot, the trailing slash is kept in the recorded path.
+func relativeTargets(args []string) (target, recorded []string, err error) {
+	for _, arg := range args {
+		contents := strings.HasSuffix(arg, "/") || strings.HasSuffix(arg, string(filepath.Separator))
+
+		p := filepath.Clean(arg)
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Abs")
+		}
+
+		fi, err := fs.Lstat(abs)
+		if err != nil && os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+
+		if !contents || err != nil || !fi.IsDir() {
+			target = append(target, abs)
+			recorded = append(recorded, p)
+			continue
+		}
+
+		f, err := fs.Open(abs)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Open")
+		}
+
+		names, err := f.Readdirnames(-1)
+		_ = f.Close()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Readdirnames")
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			target = append(target, filepath.Join(abs, name))
+		}
+
+		if !strings.HasSuffix(p, string(filepath.Separator)) {
+			p += string(filepath.Separator)
+		}
+		recorded = append(recorded, p)
+	}
+
+	if len(target) == 0 {
+		return nil, nil, errors.Fatal("all target directories/files do not exist")
+	}
+
+	return target, recorded, nil
+}
+
 // gatherDevices returns the set of unique device ids of the files and/or
 // directory paths listed in "items".
 func gatherDevices(items []string) (deviceMap map[string]uint64, err error) {
@@ -249,8 +400,17 @@ func readBackupFromStdin(opts BackupOptions, gopts GlobalOptions, args []string)
 		return errors.Fatal("filename for backup from stdin must not be empty")
 	}
 
-	if gopts.password == "" && gopts.PasswordFile == "" {
-		return errors.Fatal("unable to read password from stdin when data is to be read from stdin, use --password-file or $RESTIC_PASSWORD")
+	if strings.ContainsAny(opts.StdinFilename, `/\`) {
+		return errors.Fatalf("filename for backup from stdin must not contain a path separator: %q", opts.StdinFilename)
+	}
+
+	timeStamp, err := parseTimeStamp(opts.TimeStamp)
+	if err != nil {
+		return err
+	}
+
+	if !hasPasswordSource(gopts) {
+		return errors.Fatal("unable to read password from stdin when data is to be read from stdin, use --password-file, --password-command or $RESTIC_PASSWORD")
 	}
 
 	repo, err := OpenRepository(gopts)
@@ -269,26 +429,39 @@ func readBackupFromStdin(opts BackupOptions, gopts GlobalOptions, args []string)
 		return err
 	}
 
+	parentSnapshotID, err := findParentSnapshot(repo, opts, []string{opts.StdinFilename})
+	if err != nil {
+		return err
+	}
+
 	r := &archiver.Reader{
 		Repository: repo,
 		Tags:       opts.Tags,
 		Hostname:   opts.Hostname,
+		Time:       timeStamp,
+		Parent:     parentSnapshotID,
 	}
 
-	_, id, err := r.Archive(context.TODO(), opts.StdinFilename, os.Stdin, newArchiveStdinProgress(gopts))
+	_, id, err := r.Archive(context.TODO(), opts.StdinFilename, os.Stdin, withBackupMetrics(gopts, newArchiveStdinProgress(gopts)))
 	if err != nil {
 		return err
 	}
 
+	if opts.VerifySnapshot {
+		if err = verifySnapshot(gopts.ctx, repo, id); err != nil {
+			return errors.Fatalf("unable to verify snapshot %v: %v", id.Str(), err)
+		}
+	}
+
 	Verbosef("archived as %v\n", id.Str())
 	return nil
 }
 
-// readFromFile will read all lines from the given filename and write them to a
-// string array, if filename is empty readFromFile returns and empty string
-// array. If filename is a dash (-), readFromFile will read the lines from
-// the standard input.
-func readLinesFromFile(filename string) ([]string, error) {
+// readLinesFromFile returns the lines of the file, or of stdin if filename is
+// "-". The lines are used verbatim, including leading or trailing spaces, only
+// empty lines are ignored. If null is set, the entries are separated by NUL
+// bytes instead of newlines, so that file names may contain newlines.
+func readLinesFromFile(filename string, null bool) ([]string, error) {
 	if filename == "" {
 		return nil, nil
 	}
@@ -306,6 +479,9 @@ func readLinesFromFile(filename string) ([]string, error) {
 	var lines []string
 
 	scanner := bufio.NewScanner(r)
+	if null {
+		scanner.Split(scanNull)
+	}
 	for scanner.Scan() {
 		line := scanner.Text()
 		if line == "" {
@@ -321,12 +497,281 @@ func readLinesFromFile(filename string) ([]string, error) {
 	return lines, nil
 }
 
+// scanNull is a split function for a bufio.Scanner which returns the entries
+// terminated by a NUL byte, the last entry may be unterminated.
+func scanNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// newChangeDetector returns a change detector for the target paths, which
+// reports the changes since the parent snapshot was taken.
+func newChangeDetector(repo restic.Repository, parentID restic.ID, target []string) (archiver.ChangeDetector, error) {
+	parent, err := restic.LoadSnapshot(context.TODO(), repo, parentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return archiver.NewChangeDetector(target, parent.Time)
+}
+
+// selectionOptions returns the options besides the exclude patterns which
+// select the files to back up, they are recorded in the snapshot. A
+// directory can only be taken from the parent snapshot unread if it was
+// saved with the same options.
+func selectionOptions(opts BackupOptions) []string {
+	var selection []string
+	if opts.ExcludeOtherFS {
+		selection = append(selection, "one-file-system")
+	}
+	if opts.ExcludeCaches {
+		selection = append(selection, "exclude-caches")
+	}
+	for _, marker := range opts.ExcludeIfPresent {
+		selection = append(selection, "exclude-if-present="+marker)
+	}
+	for _, name := range opts.IgnoreFiles {
+		selection = append(selection, "use-ignore-files="+name)
+	}
+	if opts.FilesFrom != "" {
+		selection = append(selection, "files-from="+opts.FilesFrom)
+	}
+	return selection
+}
+
+// findNewerThanTime returns the reference time for --newer-than, which is
+// either given directly or taken from a snapshot. The string "latest" selects
+// the parent snapshot.
+func findNewerThanTime(repo restic.Repository, s string, parentSnapshotID *restic.ID) (time.Time, error) {
+	if t, err := parseTime(s); err == nil {
+		return t, nil
+	}
+
+	var id restic.ID
+	if s == "latest" {
+		if parentSnapshotID == nil {
+			return time.Time{}, errors.Fatal("--newer-than latest: no parent snapshot found")
+		}
+		id = *parentSnapshotID
+	} else {
+		var err error
+		id, err = restic.FindSnapshot(repo, s)
+		if err != nil {
+			return time.Time{}, errors.Fatalf("--newer-than: %q is neither a time nor a snapshot: %v", s, err)
+		}
+	}
+
+	sn, err := restic.LoadSnapshot(context.TODO(), repo, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return sn.Time, nil
+}
+
+// parseTimeStamp parses the value of --time. For an empty string, the zero
+// time is returned, which selects the current time.
+func parseTimeStamp(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := parseTime(s)
+	if err != nil {
+		return time.Time{}, errors.Fatalf("invalid value for --time: %q", s)
+	}
+
+	return t, nil
+}
+
+// findParentSnapshot returns the snapshot given with --parent, or the latest
+// snapshot of the paths. If --force is set or no snapshot is found, nil is
+// returned.
+func findParentSnapshot(repo restic.Repository, opts BackupOptions, paths []string) (*restic.ID, error) {
+	if opts.Force {
+		return nil, nil
+	}
+
+	if opts.Parent != "" {
+		id, err := restic.FindSnapshot(repo, opts.Parent)
+		if err != nil {
+			return nil, errors.Fatalf("invalid id %q: %v", opts.Parent, err)
+		}
+
+		return &id, nil
+	}
+
+	return findLatestParent(context.TODO(), repo, paths, opts.Tags, opts.Hostname)
+}
+
+// findLatestParent returns the latest snapshot with the paths, tags and
+// hostname like restic.FindLatestSnapshot, but only considers snapshots whose
+// tree belongs to the encryption domain of the current key. The data of other
+// domains can't be read or must not be referenced by the new snapshot. The
+// index must be loaded. If no snapshot is found, nil is returned.
+func findLatestParent(ctx context.Context, repo restic.Repository, paths, tags []string, hostname string) (*restic.ID, error) {
+	var (
+		latest   time.Time
+		latestID *restic.ID
+	)
+
+	err := restic.ForAllSnapshots(ctx, repo, func(id restic.ID, sn *restic.Snapshot, err error) error {
+		if err != nil {
+			return errors.Errorf("Error listing snapshot: %v", err)
+		}
+
+		if !sn.Time.After(latest) || (hostname != "" && hostname != sn.Hostname) || !sn.HasTags(tags) || !sn.HasPaths(paths) {
+			return nil
+		}
+
+		if sn.Tree == nil || !repo.Index().Has(*sn.Tree, restic.TreeBlob) {
+			debug.Log("snapshot %v is not in the encryption domain of the key", id.Str())
+			return nil
+		}
+
+		latest = sn.Time
+		latestID = &id
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return latestID, nil
+}
+
+// createShadowCopies creates a Volume Shadow Copy for each volume of the
+// target paths.
+func createShadowCopies(target []string) (fs.VSSSnapshots, error) {
+	volumes := fs.Volumes(target)
+	Verbosef("creating shadow copies of %v\n", strings.Join(volumes, ", "))
+
+	shadows, err := fs.NewVSSSnapshots(volumes)
+	if err != nil {
+		return nil, errors.Fatalf("%v", err)
+	}
+
+	for _, vol := range volumes {
+		debug.Log("reading %v from %v", vol, shadows[vol].DeviceObject)
+	}
+
+	return shadows, nil
+}
+
+// exitCodeTimeLimit is the exit code used when the backup stopped at the time
+// limit and saved a partial snapshot. It differs from exitCodePartialRestore,
+// so that scripts can tell the two apart.
+const exitCodeTimeLimit = 4
+
+// errTimeLimit is returned when the backup stopped at the time limit.
+type errTimeLimit struct{}
+
+func (e errTimeLimit) Error() string {
+	return "time limit reached, the next backup continues from the partial snapshot"
+}
+
+// ExitCode returns the exit code restic terminates with.
+func (e errTimeLimit) ExitCode() int {
+	return exitCodeTimeLimit
+}
+
+// hddReadConcurrency is the number of files read in parallel from rotating
+// disks, for which more parallel reads cause the disk to seek back and forth.
+const hddReadConcurrency = 2
+
+// readConcurrency returns the number of files to read in parallel, zero
+// selects the default of the archiver.
+func readConcurrency(opts BackupOptions, targets []string) int {
+	if opts.ReadConcurrency > 0 {
+		return opts.ReadConcurrency
+	}
+
+	for _, target := range targets {
+		rotational, err := isRotational(target)
+		if err != nil {
+			debug.Log("unable to detect the disk type for %v: %v", target, err)
+			continue
+		}
+
+		if rotational {
+			Verbosef("%v is located on a rotating disk, reading %d files in parallel\n", target, hddReadConcurrency)
+			return hddReadConcurrency
+		}
+	}
+
+	return 0
+}
+
 func runBackup(opts BackupOptions, gopts GlobalOptions, args []string) error {
-	if opts.FilesFrom == "-" && gopts.password == "" && gopts.PasswordFile == "" {
+	if opts.FilesFrom == "-" && !hasPasswordSource(gopts) {
 		return errors.Fatal("no password; either use `--password-file` option or put the password into the RESTIC_PASSWORD environment variable")
 	}
 
-	fromfile, err := readLinesFromFile(opts.FilesFrom)
+	if opts.MtimeSkew < 0 {
+		return errors.Fatal("--mtime-skew must not be negative")
+	}
+
+	if opts.DryRun && opts.VerifySnapshot {
+		return errors.Fatal("--dry-run cannot be combined with --require-snapshot-verify")
+	}
+
+	if opts.CheckpointInterval < 0 {
+		return errors.Fatal("--checkpoint-interval must not be negative")
+	}
+
+	if err := restic.CheckTags(opts.Tags); err != nil {
+		return errors.Fatalf("%v", err)
+	}
+
+	if opts.TimeLimit < 0 {
+		return errors.Fatal("--time-limit must not be negative")
+	}
+
+	if opts.ChangedFileRetries < 0 {
+		return errors.Fatal("--changed-file-retries must not be negative")
+	}
+
+	if opts.DryRun && opts.TimeLimit > 0 {
+		return errors.Fatal("--dry-run cannot be combined with --time-limit")
+	}
+
+	if opts.UseFsSnapshot {
+		if runtime.GOOS != "windows" {
+			return errors.Fatal("--use-fs-snapshot is only supported on Windows")
+		}
+		if opts.RelativePaths {
+			return errors.Fatal("--use-fs-snapshot cannot be combined with --relative-paths")
+		}
+		if len(opts.ReadFrom) > 0 {
+			return errors.Fatal("--use-fs-snapshot cannot be combined with --read-from")
+		}
+	}
+
+	if opts.ReadConcurrency < 0 {
+		return errors.Fatal("--read-concurrency must not be negative")
+	}
+
+	timeStamp, err := parseTimeStamp(opts.TimeStamp)
+	if err != nil {
+		return err
+	}
+
+	if opts.FilesFromNull && opts.FilesFrom == "" {
+		return errors.Fatal("--files-from-null requires --files-from")
+	}
+
+	fromfile, err := readLinesFromFile(opts.FilesFrom, opts.FilesFromNull)
 	if err != nil {
 		return err
 	}
@@ -339,17 +784,50 @@ func runBackup(opts BackupOptions, gopts GlobalOptions, args []string) error {
 		return errors.Fatal("wrong number of parameters")
 	}
 
+	readFrom, err := parsePathMap(opts.ReadFrom)
+	if err != nil {
+		return err
+	}
+
+	if len(readFrom) > 0 && opts.RelativePaths {
+		return errors.Fatal("--read-from cannot be used with --relative-paths")
+	}
+
+	var snapshotPaths []string
 	target := make([]string, 0, len(args))
-	for _, d := range args {
-		if a, err := filepath.Abs(d); err == nil {
-			d = a
+
+	if opts.RelativePaths {
+		target, snapshotPaths, err = relativeTargets(args)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, d := range args {
+			if a, err := filepath.Abs(d); err == nil {
+				d = a
+			}
+			target = append(target, d)
+		}
+
+		target, err = filterExisting(target)
+		if err != nil {
+			return err
+		}
+
+		// the snapshot records the original paths
+		if len(readFrom) > 0 {
+			snapshotPaths = target
+			target, err = readFrom.sourceTargets(target)
+			if err != nil {
+				return err
+			}
 		}
-		target = append(target, d)
 	}
 
-	target, err = filterExisting(target)
-	if err != nil {
-		return err
+	// snapshots are matched by the paths recorded in them
+	parentPaths := target
+	if snapshotPaths != nil {
+		parentPaths = snapshotPaths
 	}
 
 	// allowed devices
@@ -367,10 +845,13 @@ func runBackup(opts BackupOptions, gopts GlobalOptions, args []string) error {
 		return err
 	}
 
-	lock, err := lockRepo(repo)
-	defer unlockRepo(lock)
-	if err != nil {
-		return err
+	// a dry run must not write anything, not even a lock
+	if !opts.DryRun {
+		lock, err := lockRepo(repo)
+		defer unlockRepo(lock)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = repo.LoadIndex(context.TODO())
@@ -378,65 +859,89 @@ func runBackup(opts BackupOptions, gopts GlobalOptions, args []string) error {
 		return err
 	}
 
-	var parentSnapshotID *restic.ID
-
-	// Force using a parent
-	if !opts.Force && opts.Parent != "" {
-		id, err := restic.FindSnapshot(repo, opts.Parent)
-		if err != nil {
-			return errors.Fatalf("invalid id %q: %v", opts.Parent, err)
-		}
+	parentSnapshotID, err := findParentSnapshot(repo, opts, parentPaths)
+	if err != nil {
+		return err
+	}
 
-		parentSnapshotID = &id
+	if parentSnapshotID != nil {
+		Verbosef("using parent snapshot %v\n", parentSnapshotID.Str())
 	}
 
-	// Find last snapshot to set it as parent, if not already set
-	if !opts.Force && parentSnapshotID == nil {
-		id, err := restic.FindLatestSnapshot(context.TODO(), repo, target, opts.Tags, opts.Hostname)
-		if err == nil {
-			parentSnapshotID = &id
-		} else if err != restic.ErrNoSnapshotFound {
+	// the files are read from shadow copies of their volumes, but the
+	// snapshot records the original paths
+	var shadows fs.VSSSnapshots
+	if opts.UseFsSnapshot {
+		shadows, err = createShadowCopies(target)
+		if err != nil {
 			return err
 		}
-	}
+		defer func() {
+			if err := shadows.Delete(); err != nil {
+				Warnf("%v\n", err)
+			}
+		}()
+		AddCleanupHandler(shadows.Delete)
 
-	if parentSnapshotID != nil {
-		Verbosef("using parent snapshot %v\n", parentSnapshotID.Str())
+		snapshotPaths = target
+		target = make([]string, 0, len(snapshotPaths))
+		for _, p := range snapshotPaths {
+			target = append(target, shadows.Path(p))
+		}
 	}
 
 	Verbosef("scan %v\n", target)
 
+	opts.Excludes = splitPatternOptions(opts.Excludes)
+
 	// add patterns from file
 	if len(opts.ExcludeFiles) > 0 {
-		for _, filename := range opts.ExcludeFiles {
-			file, err := fs.Open(filename)
-			if err != nil {
-				Warnf("error reading exclude patterns: %v", err)
-				return nil
-			}
+		patterns, err := readPatternFiles(opts.ExcludeFiles)
+		if err != nil {
+			Warnf("error reading exclude patterns: %v", err)
+			return nil
+		}
+		opts.Excludes = append(opts.Excludes, patterns...)
+	}
 
-			scanner := bufio.NewScanner(file)
-			for scanner.Scan() {
-				line := strings.TrimSpace(scanner.Text())
+	excludes, err := parsePatterns("exclude", opts.Excludes)
+	if err != nil {
+		return err
+	}
 
-				// ignore empty lines
-				if line == "" {
-					continue
-				}
+	markers, err := parseMarkers(opts.ExcludeIfPresent, opts.ExcludeCaches)
+	if err != nil {
+		return err
+	}
 
-				// strip comments
-				if strings.HasPrefix(line, "#") {
-					continue
-				}
+	markerExcludes := newMarkerExcluder(markers, func(path string, err error) {
+		Warnf("unable to check marker file %v: %v\n", path, err)
+	})
 
-				line = os.ExpandEnv(line)
-				opts.Excludes = append(opts.Excludes, line)
-			}
-		}
+	ignoreFiles, err := parseIgnoreFileNames(opts.IgnoreFiles)
+	if err != nil {
+		return err
 	}
 
+	ignoreFileExcludes := newIgnoreFileExcluder(ignoreFiles, func(path string, err error) {
+		Warnf("unable to read ignore file %v: %v\n", path, err)
+	})
+
 	selectFilter := func(item string, fi os.FileInfo) bool {
-		matched, err := filter.List(opts.Excludes, item)
+		// patterns are always matched against absolute paths, so that
+		// anchored patterns work with --relative-paths
+		path := item
+		if shadows != nil {
+			path = shadows.OriginalPath(item)
+		}
+		if !filepath.IsAbs(path) {
+			if abs, err := filepath.Abs(path); err == nil {
+				path = abs
+			}
+		}
+		path = readFrom.toOriginal(path)
+
+		matched, err := filter.ListPatterns(excludes, path)
 		if err != nil {
 			Warnf("error for exclude pattern: %v", err)
 		}
@@ -446,6 +951,14 @@ func runBackup(opts BackupOptions, gopts GlobalOptions, args []string) error {
 			return false
 		}
 
+		if len(markers) > 0 && markerExcludes.Excluded(item) {
+			return false
+		}
+
+		if len(ignoreFiles) > 0 && ignoreFileExcludes.Excluded(item) {
+			return false
+		}
+
 		if !opts.ExcludeOtherFS || fi == nil {
 			return true
 		}
@@ -466,6 +979,13 @@ func runBackup(opts BackupOptions, gopts GlobalOptions, args []string) error {
 			}
 
 			if allowedID != id {
+				// mount points are saved as empty directories, so that they
+				// are recreated when the snapshot is restored
+				if fi.IsDir() && parentOnDevice(item, allowedID) {
+					debug.Log("path %q is a mount point, saving it without its contents", item)
+					return true
+				}
+
 				debug.Log("path %q on disallowed device %d", item, id)
 				return false
 			}
@@ -476,26 +996,147 @@ func runBackup(opts BackupOptions, gopts GlobalOptions, args []string) error {
 		panic(fmt.Sprintf("item %v, device id %v not found, allowedDevs: %v", item, id, allowedDevs))
 	}
 
-	stat, err := archiver.Scan(target, selectFilter, newScanProgress(gopts))
+	selection := selectionOptions(opts)
+	if opts.NewerThan != "" {
+		newerThan, err := findNewerThanTime(repo, opts.NewerThan, parentSnapshotID)
+		if err != nil {
+			return err
+		}
+		selection = append(selection, "newer-than="+newerThan.UTC().Format(time.RFC3339Nano))
+		Verbosef("only including files changed after %v\n", newerThan.Format(TimeFormat))
+
+		// directories are always included so that changed files within them
+		// are found
+		includeFilter := selectFilter
+		selectFilter = func(item string, fi os.FileInfo) bool {
+			if fi != nil && !fi.IsDir() && !restic.ChangedSince(fi, newerThan) {
+				debug.Log("path %q has not changed since %v", item, newerThan)
+				return false
+			}
+			return includeFilter(item, fi)
+		}
+	}
+
+	var detector archiver.ChangeDetector
+	if opts.ChangeJournal && parentSnapshotID != nil {
+		detector, err = newChangeDetector(repo, *parentSnapshotID, target)
+		if err != nil {
+			Warnf("unable to use the change journal, reading all files: %v\n", err)
+		}
+	}
+
+	scanFilter := selectFilter
+	if detector != nil {
+		// directories which have not changed are not read by the archiver
+		scanFilter = func(item string, fi os.FileInfo) bool {
+			if fi != nil && fi.IsDir() && detector.Unchanged(item) {
+				return false
+			}
+			return selectFilter(item, fi)
+		}
+	}
+
+	stat, err := archiver.Scan(target, scanFilter, newScanProgress(gopts))
 	if err != nil {
 		return err
 	}
 
 	arch := archiver.New(repo)
 	arch.Excludes = opts.Excludes
+	arch.Selection = selection
 	arch.SelectFilter = selectFilter
+	arch.ChangeDetector = detector
+	arch.SnapshotPaths = snapshotPaths
+	arch.SkipIfUnchanged = opts.SkipUnchanged
+	arch.Change = restic.ChangeOptions{
+		MtimeSkew:   opts.MtimeSkew,
+		IgnoreInode: opts.IgnoreInode,
+		IgnoreCtime: opts.IgnoreCtime,
+	}
+	arch.DryRun = opts.DryRun
+	arch.Metadata = restic.NodeOptions{SkipExtendedAttributes: opts.NoXattrs}
+	arch.Time = timeStamp
+	arch.CheckpointInterval = opts.CheckpointInterval
+	arch.TimeLimit = opts.TimeLimit
+	arch.ChangedFileRetries = opts.ChangedFileRetries
+	arch.ReadConcurrency = readConcurrency(opts, target)
 
 	arch.Warn = func(dir string, fi os.FileInfo, err error) {
 		// TODO: make ignoring errors configurable
-		Warnf("%s\rwarning for %s: %v\n", ClearLine(), dir, err)
+		Warnf("%swarning for %s: %v\n", ClearLine(), dir, err)
 	}
 
-	_, id, err := arch.Snapshot(context.TODO(), newArchiveProgress(gopts, stat), target, opts.Tags, opts.Hostname, parentSnapshotID)
+	p := withBackupMetrics(gopts, newArchiveProgress(gopts, stat))
+	_, id, err := arch.Snapshot(context.TODO(), p, target, opts.Tags, opts.Hostname, parentSnapshotID)
+	if err == nil && opts.DryRun {
+		return printDryRunStats(gopts, arch.DryRunStats())
+	}
+	if errors.Cause(err) == archiver.ErrTimeLimit {
+		Verbosef("time limit of %v reached, saved the files backed up so far as partial snapshot %s\n", opts.TimeLimit, id.Str())
+		gopts.metrics.Set("backup_time_limit_reached", "Whether the backup stopped at the time limit and saved a partial snapshot.", 1)
+		return errTimeLimit{}
+	}
+	if errors.Cause(err) == archiver.ErrUnchanged {
+		Verbosef("nothing changed since parent snapshot %s, no new snapshot created\n", id.Str())
+		gopts.metrics.Set("backup_skipped", "Whether the backup was skipped because nothing changed.", 1)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
 	Verbosef("snapshot %s saved\n", id.Str())
 
+	inconsistent := arch.InconsistentFiles()
+	gopts.metrics.Set("backup_inconsistent_files", "Number of files which changed while they were read.", float64(len(inconsistent)))
+	if len(inconsistent) > 0 {
+		Warnf("%d files changed while they were read, their content in the snapshot may be inconsistent\n", len(inconsistent))
+	}
+
+	if opts.VerifySnapshot {
+		if err = verifySnapshot(gopts.ctx, repo, id); err != nil {
+			return errors.Fatalf("unable to verify snapshot %v: %v", id.Str(), err)
+		}
+		Verbosef("snapshot %s verified\n", id.Str())
+	}
+
+	return printPruneSuggestion(gopts.ctx, gopts, repo)
+}
+
+// backupDryRunSummary is the JSON representation of the result of a dry run.
+type backupDryRunSummary struct {
+	ChangedFiles   uint64 `json:"changed_files"`
+	ChangedBytes   uint64 `json:"changed_bytes"`
+	UnchangedFiles uint64 `json:"unchanged_files"`
+	UnchangedBytes uint64 `json:"unchanged_bytes"`
+	DataBlobs      uint64 `json:"data_blobs"`
+	TreeBlobs      uint64 `json:"tree_blobs"`
+	UploadBytes    uint64 `json:"upload_bytes"`
+}
+
+// printDryRunStats reports what a backup would have uploaded.
+func printDryRunStats(gopts GlobalOptions, stats archiver.DryRunStats) error {
+	if gopts.JSON {
+		summary := backupDryRunSummary{
+			ChangedFiles:   stats.ChangedFiles,
+			ChangedBytes:   stats.ChangedBytes,
+			UnchangedFiles: stats.UnchangedFiles,
+			UnchangedBytes: stats.UnchangedBytes,
+			DataBlobs:      stats.DataBlobs,
+			TreeBlobs:      stats.TreeBlobs,
+			UploadBytes:    stats.UploadBytes,
+		}
+		if gopts.JSONSchema > 0 {
+			return printJSONEvent(gopts, "backup_dry_run", summary)
+		}
+		return json.NewEncoder(gopts.stdout).Encode(summary)
+	}
+
+	Printf("dry run, nothing has been saved:\n")
+	Printf("  new or changed files:  %d (%s)\n", stats.ChangedFiles, formatBytes(stats.ChangedBytes))
+	Printf("  unchanged files:       %d (%s)\n", stats.UnchangedFiles, formatBytes(stats.UnchangedBytes))
+	Printf("  new blobs:             %d data, %d tree\n", stats.DataBlobs, stats.TreeBlobs)
+	Printf("  estimated upload size: %s\n", formatBytes(stats.UploadBytes))
+
 	return nil
 }
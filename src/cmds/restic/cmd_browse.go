@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"restic"
+	"restic/errors"
+	"restic/repository"
+	"restic/shell"
+)
+
+var cmdBrowse = &cobra.Command{
+	Use:   "browse",
+	Short: "browse snapshots interactively",
+	Long: `
+The "browse" command starts an interactive shell which allows navigating the
+snapshots in the repository, marking files and directories and restoring or
+dumping the marked entries. It does not need FUSE, so it also works where
+"mount" is not available.
+
+The snapshots are shown as directories named after their short ID below "/",
+the special name "latest" selects the latest snapshot. The following commands
+are available:
+` + browseHelp + `
+Paths containing spaces must be enclosed in single or double quotes. Commands
+are read line by line from stdin, so the browser can also be scripted. It is a
+line based shell, not a full-screen interface.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runBrowse(globalOptions, os.Stdin)
+	},
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdBrowse)
+}
+
+// browser holds the state of an interactive browse session. Paths are
+// slash-separated and start with the short ID of a snapshot, e.g.
+// "/40dc1520/home/user".
+type browser struct {
+	ctx    context.Context
+	gopts  GlobalOptions
+	repo   *repository.Repository
+	cwd    string
+	marked map[string]struct{}
+	sns    map[string]*restic.Snapshot
+}
+
+func newBrowser(ctx context.Context, gopts GlobalOptions, repo *repository.Repository) *browser {
+	return &browser{
+		ctx:    ctx,
+		gopts:  gopts,
+		repo:   repo,
+		cwd:    "/",
+		marked: make(map[string]struct{}),
+		sns:    make(map[string]*restic.Snapshot),
+	}
+}
+
+// splitPath resolves p relative to the current directory and returns the
+// absolute path, the snapshot and the path within the snapshot. For "/", the
+// snapshot is nil.
+func (b *browser) splitPath(p string) (abs string, sn *restic.Snapshot, inner string, err error) {
+	if !path.IsAbs(p) {
+		p = path.Join(b.cwd, p)
+	}
+	p = path.Clean(p)
+	if p == "/" {
+		return p, nil, "", nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	id, err := findSnapshotID(b.ctx, b.repo, parts[0])
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	sn, ok := b.sns[id.Str()]
+	if !ok {
+		sn, err = restic.LoadSnapshot(b.ctx, b.repo, id)
+		if err != nil {
+			return "", nil, "", err
+		}
+		b.sns[id.Str()] = sn
+	}
+
+	inner = "/"
+	if len(parts) > 1 {
+		inner = "/" + parts[1]
+	}
+
+	return path.Join("/", id.Str(), inner), sn, inner, nil
+}
+
+// lookup returns the node at p. For the root of a snapshot, a directory node
+// for the snapshot's tree is returned.
+func (b *browser) lookup(p string) (abs string, sn *restic.Snapshot, node *restic.Node, err error) {
+	abs, sn, inner, err := b.splitPath(p)
+	if err != nil || sn == nil {
+		return abs, sn, nil, err
+	}
+
+	if inner == "/" {
+		return abs, sn, &restic.Node{Name: sn.ID().Str(), Type: "dir", Subtree: sn.Tree}, nil
+	}
+
+	node, err = restic.FindNode(b.ctx, b.repo, *sn.Tree, inner)
+	if err != nil {
+		return "", nil, nil, errors.Fatalf("%v: %v", p, err)
+	}
+
+	return abs, sn, node, nil
+}
+
+// printf writes the message to the configured stdout stream.
+func (b *browser) printf(format string, args ...interface{}) {
+	_, err := fmt.Fprintf(b.gopts.stdout, format, args...)
+	if err != nil {
+		Warnf("unable to write to stdout: %v\n", err)
+	}
+}
+
+// isMarked returns true if p or one of its parent directories is marked.
+func (b *browser) isMarked(p string) bool {
+	for ; p != "/"; p = path.Dir(p) {
+		if _, ok := b.marked[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *browser) ls(args []string) error {
+	if len(args) > 1 {
+		return errors.Fatal("usage: ls [path]")
+	}
+
+	p := "."
+	if len(args) == 1 {
+		p = args[0]
+	}
+
+	abs, sn, node, err := b.lookup(p)
+	if err != nil {
+		return err
+	}
+
+	if sn == nil {
+		list, err := restic.LoadAllSnapshots(b.ctx, b.repo)
+		if err != nil {
+			return err
+		}
+		sort.Sort(restic.Snapshots(list))
+		PrintSnapshots(b.gopts.stdout, list)
+		return nil
+	}
+
+	if node.Type != "dir" {
+		b.printf("%s\n", b.formatEntry(path.Dir(abs), node))
+		return nil
+	}
+
+	tree, err := b.repo.LoadTree(b.ctx, *node.Subtree)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range tree.Nodes {
+		b.printf("%s\n", b.formatEntry(abs, entry))
+	}
+
+	return nil
+}
+
+// formatEntry formats the entry in the directory dir like "ls --long" and
+// flags marked entries with a "*".
+func (b *browser) formatEntry(dir string, node *restic.Node) string {
+	flag := " "
+	if b.isMarked(path.Join(dir, node.Name)) {
+		flag = "*"
+	}
+
+	return flag + " " + formatNode("", node, true)
+}
+
+func (b *browser) cd(args []string) error {
+	if len(args) != 1 {
+		return errors.Fatal("usage: cd path")
+	}
+
+	abs, _, node, err := b.lookup(args[0])
+	if err != nil {
+		return err
+	}
+
+	if node != nil && node.Type != "dir" {
+		return errors.Fatalf("%v is not a directory", args[0])
+	}
+
+	b.cwd = abs
+	return nil
+}
+
+func (b *browser) mark(args []string) error {
+	if len(args) == 0 {
+		return errors.Fatal("usage: mark path ...")
+	}
+
+	for _, p := range args {
+		abs, sn, _, err := b.lookup(p)
+		if err != nil {
+			return err
+		}
+
+		if sn == nil {
+			return errors.Fatal("select a snapshot or a path within a snapshot to mark")
+		}
+
+		b.marked[abs] = struct{}{}
+	}
+
+	return nil
+}
+
+func (b *browser) unmark(args []string) error {
+	if len(args) == 0 {
+		return errors.Fatal("usage: unmark path ...")
+	}
+
+	for _, p := range args {
+		if p == "*" {
+			b.marked = make(map[string]struct{})
+			continue
+		}
+
+		abs, _, _, err := b.splitPath(p)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := b.marked[abs]; !ok {
+			return errors.Fatalf("%v is not marked", p)
+		}
+		delete(b.marked, abs)
+	}
+
+	return nil
+}
+
+// markedPaths returns the marked paths, sorted.
+func (b *browser) markedPaths() []string {
+	list := make([]string, 0, len(b.marked))
+	for p := range b.marked {
+		list = append(list, p)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// restore restores the marked entries to target. All marked entries must
+// belong to the same snapshot.
+func (b *browser) restore(args []string) error {
+	if len(args) != 1 {
+		return errors.Fatal("usage: restore target")
+	}
+
+	if len(b.marked) == 0 {
+		return errors.Fatal("nothing marked")
+	}
+
+	var (
+		sn    *restic.Snapshot
+		paths []string
+	)
+	for _, p := range b.markedPaths() {
+		_, s, inner, err := b.splitPath(p)
+		if err != nil {
+			return err
+		}
+
+		if sn != nil && !sn.ID().Equal(*s.ID()) {
+			return errors.Fatal("the marked entries belong to more than one snapshot, use dump instead")
+		}
+		sn = s
+		paths = append(paths, inner)
+	}
+
+	res, err := restic.NewRestorer(b.repo, *sn.ID())
+	if err != nil {
+		return err
+	}
+
+	res.Error = func(dir string, node *restic.Node, err error) error {
+		Warnf("ignoring error for %s: %s\n", dir, err)
+		return nil
+	}
+
+	// select the marked entries, everything below them and the directories
+	// which contain them
+	res.SelectFilter = func(item string, dstpath string, node *restic.Node) bool {
+		item = filepath.ToSlash(item)
+		for _, p := range paths {
+			if p == "/" || item == p || strings.HasPrefix(item, p+"/") || strings.HasPrefix(p, item+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	Verbosef("restoring %d marked entries of %s to %s\n", len(paths), res.Snapshot(), args[0])
+	return res.RestoreTo(b.ctx, args[0])
+}
+
+// dump writes the marked entries to a tar archive in the file named by args.
+func (b *browser) dump(args []string) error {
+	if len(args) != 1 {
+		return errors.Fatal("usage: dump file")
+	}
+
+	if len(b.marked) == 0 {
+		return errors.Fatal("nothing marked")
+	}
+
+	var targets []string
+	for _, p := range b.markedPaths() {
+		parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+		target := parts[0]
+		if len(parts) > 1 {
+			target += ":/" + parts[1]
+		}
+		targets = append(targets, target)
+	}
+
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = dumpTar(b.ctx, b.repo, targets, f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// run executes a single command line. Arguments containing spaces can be
+// enclosed in single or double quotes. It returns io.EOF when the browser
+// should be left.
+func (b *browser) run(line string) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+
+	cmd, args, err := shell.SplitArgs(line)
+	if err != nil {
+		return errors.Fatalf("%v", err)
+	}
+
+	switch cmd {
+	case "ls":
+		return b.ls(args)
+	case "cd":
+		return b.cd(args)
+	case "pwd":
+		b.printf("%s\n", b.cwd)
+	case "mark":
+		return b.mark(args)
+	case "unmark":
+		return b.unmark(args)
+	case "marked":
+		for _, p := range b.markedPaths() {
+			b.printf("%s\n", p)
+		}
+	case "restore":
+		return b.restore(args)
+	case "dump":
+		return b.dump(args)
+	case "help":
+		b.printf("%s\n", strings.TrimSpace(browseHelp))
+	case "quit", "exit":
+		return io.EOF
+	default:
+		return errors.Fatalf("unknown command %q, try \"help\"", cmd)
+	}
+
+	return nil
+}
+
+const browseHelp = `
+ls [path]          list the snapshots or the content of a directory
+cd path            change the current directory
+pwd                print the current directory
+mark path ...      mark files or directories
+unmark path ...    remove marks, "unmark *" removes all marks
+marked             list the marked entries
+restore target     restore the marked entries to the directory target
+dump file          write the marked entries to file as a tar archive
+help               print this list of commands
+quit               leave the browser
+`
+
+func runBrowse(gopts GlobalOptions, rd io.Reader) error {
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return err
+	}
+
+	if !gopts.NoLock {
+		lock, err := lockRepo(repo)
+		defer unlockRepo(lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := gopts.ctx
+	if err = repo.LoadIndex(ctx); err != nil {
+		return err
+	}
+
+	b := newBrowser(ctx, gopts, repo)
+	interactive := stdinIsTerminal()
+
+	sc := bufio.NewScanner(rd)
+	for {
+		if interactive {
+			b.printf("%s> ", b.cwd)
+		}
+
+		if !sc.Scan() {
+			break
+		}
+
+		err = b.run(sc.Text())
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if !interactive {
+				return err
+			}
+			Warnf("%v\n", err)
+		}
+	}
+
+	return sc.Err()
+}
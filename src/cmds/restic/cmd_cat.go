@@ -118,6 +118,10 @@ func runCat(gopts GlobalOptions, args []string) error {
 		fmt.Println(string(buf))
 		return nil
 	case "masterkey":
+		if repo.Key() == nil {
+			return errors.Fatalf("the key belongs to the encryption domain %q and does not contain the master key", repo.Domain())
+		}
+
 		buf, err := json.MarshalIndent(repo.Key(), "", "  ")
 		if err != nil {
 			return err
@@ -171,7 +175,7 @@ func runCat(gopts GlobalOptions, args []string) error {
 			}
 			blob := list[0]
 
-			buf := make([]byte, blob.Length)
+			buf := restic.NewBlobBuffer(int(blob.DataLength()))
 			n, err := repo.LoadBlob(context.TODO(), t, id, buf)
 			if err != nil {
 				return err
@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"math/rand"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -11,6 +16,7 @@ import (
 	"restic"
 	"restic/checker"
 	"restic/errors"
+	"restic/repository"
 )
 
 var cmdCheck = &cobra.Command{
@@ -19,16 +25,42 @@ var cmdCheck = &cobra.Command{
 	Long: `
 The "check" command tests the repository for errors and reports any errors it
 finds. It can also be used to read all data and therefore simulate a restore.
+
+The checks which are run can be selected with --level:
+
+  quick     the index is loaded and all packs referenced by it are present
+  standard  in addition, all snapshots, trees and blobs are consistent
+  deep      in addition, all data is read and its integrity verified
+
+With --read-data-subset n/t, the packs are split into t subsets and only the
+data of subset n is read. The subsets are derived from the pack IDs, so
+running the check for 1/t up to t/t reads all packs, e.g. one subset per
+night.
+
+With --repair, the intact blobs of packs which are found to be damaged while
+reading the data are copied to new packs, the damaged packs are removed and the
+index is rebuilt. Blobs which are lost afterwards are listed, they can only be
+restored by backing up the affected files again with --force.
+
+With --result-file, a JSON document describing the checks which have been run
+and their results is written, also when errors are found.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return runCheck(checkOptions, globalOptions, args)
+		return runWithMetrics("check", globalOptions, func(gopts GlobalOptions) error {
+			return runCheck(checkOptions, gopts, args)
+		})
 	},
 }
 
 // CheckOptions bundles all options for the 'check' command.
 type CheckOptions struct {
-	ReadData    bool
-	CheckUnused bool
+	ReadData        bool
+	ReadDataPercent uint
+	ReadDataSubset  string
+	CheckUnused     bool
+	Level           string
+	ResultFile      string
+	Repair          bool
 }
 
 var checkOptions CheckOptions
@@ -38,7 +70,12 @@ func init() {
 
 	f := cmdCheck.Flags()
 	f.BoolVar(&checkOptions.ReadData, "read-data", false, "read all data blobs")
+	f.UintVar(&checkOptions.ReadDataPercent, "read-data-percent", 0, "read the data blobs of a random selection of `percent` of the packs")
+	f.StringVar(&checkOptions.ReadDataSubset, "read-data-subset", "", "read the data blobs of the subset `n/t` of the packs")
 	f.BoolVar(&checkOptions.CheckUnused, "check-unused", false, "find unused blobs")
+	f.StringVar(&checkOptions.Level, "level", "", "run the checks of `level` (quick, standard or deep)")
+	f.StringVar(&checkOptions.ResultFile, "result-file", "", "write the result of the check as JSON to `file`")
+	f.BoolVar(&checkOptions.Repair, "repair", false, "salvage the intact blobs of damaged packs found while reading the data")
 }
 
 func newReadProgress(gopts GlobalOptions, todo restic.Stat) *restic.Progress {
@@ -71,11 +108,176 @@ func newReadProgress(gopts GlobalOptions, todo restic.Stat) *restic.Progress {
 	return readProgress
 }
 
+// The check levels, each one includes the checks of the previous one.
+const (
+	checkLevelQuick    = "quick"
+	checkLevelStandard = "standard"
+	checkLevelDeep     = "deep"
+)
+
+// checkGuarantees lists what a successful check of each level guarantees.
+var checkGuarantees = map[string][]string{
+	checkLevelQuick: {
+		"all index files can be decrypted and are consistent",
+		"all packs referenced by the index are present and no unreferenced packs exist",
+		"the blobs listed in the index for each pack do not overlap and lie within the pack",
+	},
+	checkLevelStandard: {
+		"all snapshots can be loaded and reference existing trees",
+		"all trees can be loaded and all blobs referenced by them are in the index",
+	},
+	checkLevelDeep: {
+		"all packs can be read, decrypted and match their IDs and the index",
+	},
+}
+
+// guarantees returns what a successful check of level guarantees, including
+// the guarantees of the lower levels.
+func guarantees(level string) []string {
+	var list []string
+	for _, l := range []string{checkLevelQuick, checkLevelStandard, checkLevelDeep} {
+		list = append(list, checkGuarantees[l]...)
+		if l == level {
+			break
+		}
+	}
+	return list
+}
+
+// applyLevel checks the level selected by the user and sets the options
+// implied by it.
+func (opts *CheckOptions) applyLevel() error {
+	switch opts.Level {
+	case "":
+		opts.Level = checkLevelStandard
+		if opts.ReadData || opts.ReadDataPercent >= 100 {
+			opts.Level = checkLevelDeep
+		}
+	case checkLevelQuick:
+		if opts.ReadData || opts.ReadDataPercent > 0 || opts.ReadDataSubset != "" || opts.CheckUnused {
+			return errors.Fatal("--level quick cannot be combined with --read-data, --read-data-percent, --read-data-subset or --check-unused")
+		}
+	case checkLevelStandard:
+		if opts.ReadData {
+			return errors.Fatal("--level standard cannot be combined with --read-data, use --level deep")
+		}
+	case checkLevelDeep:
+		if opts.ReadDataPercent > 0 || opts.ReadDataSubset != "" {
+			return errors.Fatal("--level deep reads all data and cannot be combined with --read-data-percent or --read-data-subset")
+		}
+		opts.ReadData = true
+	default:
+		return errors.Fatalf("invalid check level %q, use quick, standard or deep", opts.Level)
+	}
+
+	return nil
+}
+
+// checkResult is the machine-readable result of a check, written with
+// --result-file.
+type checkResult struct {
+	Level      string         `json:"level"`
+	Guarantees []string       `json:"guarantees"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	Checks     []*checkReport `json:"checks"`
+	Success    bool           `json:"success"`
+}
+
+// checkReport describes the result of a single step of the check.
+type checkReport struct {
+	Name            string   `json:"name"`
+	Status          string   `json:"status"`
+	ReadDataPercent uint     `json:"read_data_percent,omitempty"`
+	ReadDataSubset  string   `json:"read_data_subset,omitempty"`
+	Errors          []string `json:"errors,omitempty"`
+	ErrorCodes      []string `json:"error_codes,omitempty"`
+	RepairedPacks   []string `json:"repaired_packs,omitempty"`
+	DamagedBlobs    []string `json:"damaged_blobs,omitempty"`
+	LostBlobs       []string `json:"lost_blobs,omitempty"`
+}
+
+// newCheckResult returns a result for level, all steps are marked as skipped.
+func newCheckResult(level string) *checkResult {
+	res := &checkResult{
+		Level:      level,
+		Guarantees: guarantees(level),
+		Start:      time.Now(),
+	}
+
+	for _, name := range []string{"index", "packs", "structure", "unused", "read_data"} {
+		res.Checks = append(res.Checks, &checkReport{Name: name, Status: "skipped"})
+	}
+
+	return res
+}
+
+// report returns the report for the step name and marks it as run.
+func (res *checkResult) report(name string) *checkReport {
+	for _, r := range res.Checks {
+		if r.Name == name {
+			r.Status = "ok"
+			return r
+		}
+	}
+	panic("unknown check " + name)
+}
+
+// fail records the error err for the step r.
+func (r *checkReport) fail(err error) {
+	r.Status = "failed"
+	r.Errors = append(r.Errors, err.Error())
+	r.ErrorCodes = append(r.ErrorCodes, errors.Code(err))
+}
+
+// finish sets the end time and success of the check and returns err.
+func (res *checkResult) finish(err error) error {
+	res.End = time.Now()
+	res.Success = err == nil
+	return err
+}
+
+// writeCheckResult writes the result as JSON to filename.
+func writeCheckResult(filename string, res *checkResult) error {
+	buf, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "MarshalIndent")
+	}
+
+	return errors.Wrap(replaceFile(filename, append(buf, '\n')), "write result file")
+}
+
 func runCheck(opts CheckOptions, gopts GlobalOptions, args []string) error {
 	if len(args) != 0 {
 		return errors.Fatal("check has no arguments")
 	}
 
+	if err := opts.applyLevel(); err != nil {
+		return err
+	}
+
+	if opts.ReadDataSubset != "" {
+		if opts.ReadData || opts.ReadDataPercent > 0 {
+			return errors.Fatal("--read-data-subset cannot be combined with --read-data or --read-data-percent")
+		}
+
+		if _, err := parseReadDataSubset(opts.ReadDataSubset); err != nil {
+			return err
+		}
+	}
+
+	if opts.Repair {
+		if !opts.ReadData && opts.ReadDataPercent == 0 && opts.ReadDataSubset == "" {
+			return errors.Fatal("--repair needs --read-data, --read-data-percent, --read-data-subset or --level deep")
+		}
+
+		if gopts.NoLock {
+			return errors.Fatal("--repair cannot be combined with --no-lock")
+		}
+
+		gopts.operation = "modify"
+	}
+
 	repo, err := OpenRepository(gopts)
 	if err != nil {
 		return err
@@ -90,16 +292,111 @@ func runCheck(opts CheckOptions, gopts GlobalOptions, args []string) error {
 		}
 	}
 
+	return checkRepository(opts, gopts, repo)
+}
+
+// randomPacks returns a random selection of percent of the packs in the
+// repository, at least one pack is selected if the repository is not empty.
+func randomPacks(ctx context.Context, repo restic.Repository, percent uint) restic.IDSet {
+	var packs restic.IDs
+	for id := range repo.List(ctx, restic.DataFile) {
+		packs = append(packs, id)
+	}
+
+	n := (len(packs)*int(percent) + 99) / 100
+	if n > len(packs) {
+		n = len(packs)
+	}
+
+	selected := restic.NewIDSet()
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, i := range rnd.Perm(len(packs))[:n] {
+		selected.Insert(packs[i])
+	}
+
+	return selected
+}
+
+// readDataSubset selects the packs of subset n of t. A pack belongs to the
+// subset given by its ID, so all t subsets together contain each pack exactly
+// once and a pack stays in its subset when packs are added or removed.
+type readDataSubset struct {
+	n, t uint32
+}
+
+// parseReadDataSubset parses the value of --read-data-subset like "2/7".
+func parseReadDataSubset(s string) (readDataSubset, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) == 2 {
+		n, errN := strconv.ParseUint(parts[0], 10, 32)
+		t, errT := strconv.ParseUint(parts[1], 10, 32)
+		if errN == nil && errT == nil && n >= 1 && n <= t {
+			return readDataSubset{n: uint32(n), t: uint32(t)}, nil
+		}
+	}
+
+	return readDataSubset{}, errors.Fatalf("invalid value for --read-data-subset: %q, use n/t with 1 <= n <= t", s)
+}
+
+// has returns true if the pack belongs to the subset.
+func (s readDataSubset) has(id restic.ID) bool {
+	return binary.BigEndian.Uint32(id[:4])%s.t == s.n-1
+}
+
+// subsetPacks returns the packs in the repository which belong to the subset.
+func subsetPacks(ctx context.Context, repo restic.Repository, subset readDataSubset) restic.IDSet {
+	selected := restic.NewIDSet()
+	for id := range repo.List(ctx, restic.DataFile) {
+		if subset.has(id) {
+			selected.Insert(id)
+		}
+	}
+
+	return selected
+}
+
+func checkRepository(opts CheckOptions, gopts GlobalOptions, repo *repository.Repository) error {
+	if opts.Level == "" {
+		if err := opts.applyLevel(); err != nil {
+			return err
+		}
+	}
+
+	res := newCheckResult(opts.Level)
+	if opts.Repair {
+		res.Checks = append(res.Checks, &checkReport{Name: "repair", Status: "skipped"})
+	}
+	err := res.finish(runChecks(opts, gopts, repo, res))
+	recordOperation(gopts.ctx, repo, "check", err)
+
+	if opts.ResultFile != "" {
+		if e := writeCheckResult(opts.ResultFile, res); e != nil {
+			Warnf("unable to write the result: %v\n", e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+
+	return err
+}
+
+// runChecks runs the checks selected by opts and records them in res.
+func runChecks(opts CheckOptions, gopts GlobalOptions, repo *repository.Repository, res *checkResult) error {
 	chkr := checker.New(repo)
 
 	Verbosef("Load indexes\n")
+	report := res.report("index")
 	hints, errs := chkr.LoadIndex(context.TODO())
 
-	dupFound := false
+	dupFound, oldFound := false, false
 	for _, hint := range hints {
 		Printf("%v\n", hint)
-		if _, ok := hint.(checker.ErrDuplicatePacks); ok {
+		switch hint.(type) {
+		case checker.ErrDuplicatePacks:
 			dupFound = true
+		case checker.ErrOldIndexFormat:
+			oldFound = true
 		}
 	}
 
@@ -107,9 +404,14 @@ func runCheck(opts CheckOptions, gopts GlobalOptions, args []string) error {
 		Printf("\nrun `restic rebuild-index' to correct this\n")
 	}
 
+	if oldFound {
+		Printf("\nrun `restic migrate upgrade_repo_v2' to convert the index files to the current format\n")
+	}
+
 	if len(errs) > 0 {
 		for _, err := range errs {
 			Warnf("error: %v\n", err)
+			report.fail(err)
 		}
 		return errors.Fatal("LoadIndex returned errors")
 	}
@@ -118,47 +420,93 @@ func runCheck(opts CheckOptions, gopts GlobalOptions, args []string) error {
 	errChan := make(chan error)
 
 	Verbosef("Check all packs\n")
+	report = res.report("packs")
 	go chkr.Packs(context.TODO(), errChan)
 
 	for err := range errChan {
 		errorsFound = true
+		report.fail(err)
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 	}
 
-	Verbosef("Check snapshots, trees and blobs\n")
-	errChan = make(chan error)
-	go chkr.Structure(context.TODO(), errChan)
+	if opts.Level != checkLevelQuick {
+		Verbosef("Check snapshots, trees and blobs\n")
+		report = res.report("structure")
+		errChan = make(chan error)
+		go chkr.Structure(context.TODO(), errChan)
 
-	for err := range errChan {
-		errorsFound = true
-		if e, ok := err.(checker.TreeError); ok {
-			fmt.Fprintf(os.Stderr, "error for tree %v:\n", e.ID.Str())
-			for _, treeErr := range e.Errors {
-				fmt.Fprintf(os.Stderr, "  %v\n", treeErr)
+		for err := range errChan {
+			errorsFound = true
+			report.fail(err)
+			if e, ok := err.(checker.TreeError); ok {
+				fmt.Fprintf(os.Stderr, "error for tree %v:\n", e.ID.Str())
+				for _, treeErr := range e.Errors {
+					fmt.Fprintf(os.Stderr, "  %v\n", treeErr)
+				}
+			} else {
+				fmt.Fprintf(os.Stderr, "error: %v\n", err)
 			}
-		} else {
-			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		}
 	}
 
 	if opts.CheckUnused {
+		report = res.report("unused")
 		for _, id := range chkr.UnusedBlobs() {
 			Verbosef("unused blob %v\n", id.Str())
+			report.fail(errors.Errorf("unused blob %v", id))
 			errorsFound = true
 		}
 	}
 
-	if opts.ReadData {
-		Verbosef("Read all data\n")
-
-		p := newReadProgress(gopts, restic.Stat{Blobs: chkr.CountPacks()})
+	if opts.ReadData || opts.ReadDataPercent > 0 || opts.ReadDataSubset != "" {
 		errChan := make(chan error)
+		report = res.report("read_data")
+
+		switch {
+		case opts.ReadData || opts.ReadDataPercent >= 100:
+			Verbosef("Read all data\n")
+
+			p := newReadProgress(gopts, restic.Stat{Blobs: chkr.CountPacks()})
+			go chkr.ReadData(context.TODO(), p, errChan)
+		case opts.ReadDataSubset != "":
+			subset, err := parseReadDataSubset(opts.ReadDataSubset)
+			if err != nil {
+				return err
+			}
+
+			packs := subsetPacks(context.TODO(), repo, subset)
+			Verbosef("Read data of %d packs (subset %s)\n", len(packs), opts.ReadDataSubset)
+			report.ReadDataSubset = opts.ReadDataSubset
 
-		go chkr.ReadData(context.TODO(), p, errChan)
+			p := newReadProgress(gopts, restic.Stat{Blobs: uint64(len(packs))})
+			go chkr.ReadPacks(context.TODO(), packs, p, errChan)
+		default:
+			packs := randomPacks(context.TODO(), repo, opts.ReadDataPercent)
+			Verbosef("Read data of %d packs (%d%%)\n", len(packs), opts.ReadDataPercent)
+			report.ReadDataPercent = opts.ReadDataPercent
+
+			p := newReadProgress(gopts, restic.Stat{Blobs: uint64(len(packs))})
+			go chkr.ReadPacks(context.TODO(), packs, p, errChan)
+		}
 
+		damaged := restic.NewIDSet()
 		for err := range errChan {
 			errorsFound = true
+			report.fail(err)
 			fmt.Fprintf(os.Stderr, "%v\n", err)
+
+			if e, ok := err.(checker.PackError); ok && repairable(e) {
+				damaged.Insert(e.ID)
+			}
+		}
+
+		if opts.Repair && len(damaged) > 0 {
+			report = res.report("repair")
+			if err := repairPacks(gopts, repo, damaged, report); err != nil {
+				report.fail(err)
+				return err
+			}
+			return errors.Fatal("repository contained errors which have been repaired, run check again")
 		}
 	}
 
@@ -167,3 +515,76 @@ func runCheck(opts CheckOptions, gopts GlobalOptions, args []string) error {
 	}
 	return nil
 }
+
+// repairable returns true if err reports damaged data in a pack, which can be
+// repaired by salvaging the intact blobs of the pack.
+func repairable(err error) bool {
+	switch errors.Code(err) {
+	case errors.CodePackHashMismatch, errors.CodePackTruncated, errors.CodePackHeader, errors.CodeBlobCorrupted:
+		return true
+	}
+	return false
+}
+
+// repairPacks copies the intact blobs of the damaged packs to new packs,
+// removes the damaged packs and rebuilds the index. The damaged blobs are
+// recorded in report, those which are not stored in any other pack are lost.
+func repairPacks(gopts GlobalOptions, repo *repository.Repository, packs restic.IDSet, report *checkReport) error {
+	ctx := gopts.ctx
+
+	damaged := restic.NewBlobSet()
+	for _, id := range packs.List() {
+		Verbosef("salvage intact blobs of pack %v\n", id.Str())
+
+		blobs, err := repository.SalvagePack(ctx, repo, id)
+		if err != nil {
+			return err
+		}
+		damaged.Merge(blobs)
+	}
+
+	if err := repo.Flush(); err != nil {
+		return err
+	}
+
+	if err := repo.SaveIndex(ctx); err != nil {
+		return err
+	}
+
+	Verbosef("remove %d damaged packs\n", len(packs))
+	for _, id := range packs.List() {
+		h := restic.Handle{Type: restic.DataFile, Name: id.String()}
+		if err := repo.Backend().Remove(ctx, h); err != nil {
+			return err
+		}
+		report.RepairedPacks = append(report.RepairedPacks, id.String())
+	}
+
+	err := rebuildIndexProgress(ctx, repo, func(packs uint64) *restic.Progress {
+		return newProgressMax(!gopts.Quiet, packs, "packs")
+	})
+	if err != nil {
+		return err
+	}
+
+	repo.SetIndex(repository.NewMasterIndex())
+	if err = repo.LoadIndex(ctx); err != nil {
+		return err
+	}
+
+	for _, h := range damaged.List() {
+		report.DamagedBlobs = append(report.DamagedBlobs, h.ID.String())
+		if repo.Index().Has(h.ID, h.Type) {
+			continue
+		}
+
+		report.LostBlobs = append(report.LostBlobs, h.ID.String())
+		Warnf("%v blob %v is lost\n", h.Type, h.ID)
+	}
+
+	if len(report.LostBlobs) > 0 {
+		Warnf("\n%d blobs are lost, back up the affected files again with --force to store them again\n", len(report.LostBlobs))
+	}
+
+	return nil
+}
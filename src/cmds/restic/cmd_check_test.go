@@ -0,0 +1,54 @@
+package main
+
+import (
+	"restic"
+	"testing"
+)
+
+func TestParseReadDataSubset(t *testing.T) {
+	var tests = []struct {
+		s    string
+		want readDataSubset
+	}{
+		{"1/1", readDataSubset{1, 1}},
+		{"1/7", readDataSubset{1, 7}},
+		{"7/7", readDataSubset{7, 7}},
+	}
+
+	for _, test := range tests {
+		subset, err := parseReadDataSubset(test.s)
+		if err != nil {
+			t.Errorf("parsing %q failed: %v", test.s, err)
+			continue
+		}
+
+		if subset != test.want {
+			t.Errorf("parsing %q: want %v, got %v", test.s, test.want, subset)
+		}
+	}
+
+	for _, s := range []string{"", "1", "0/7", "8/7", "1/0", "-1/7", "1/7/2", "a/b"} {
+		if _, err := parseReadDataSubset(s); err == nil {
+			t.Errorf("no error for invalid value %q", s)
+		}
+	}
+}
+
+func TestReadDataSubsetPartition(t *testing.T) {
+	const subsets = 7
+
+	for i := 0; i < 1000; i++ {
+		id := restic.NewRandomID()
+
+		found := 0
+		for n := uint32(1); n <= subsets; n++ {
+			if (readDataSubset{n: n, t: subsets}).has(id) {
+				found++
+			}
+		}
+
+		if found != 1 {
+			t.Fatalf("pack %v is contained in %d subsets", id.Str(), found)
+		}
+	}
+}
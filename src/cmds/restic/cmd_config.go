@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"restic"
+	"strconv"
+	"strings"
+	"time"
+
+	"restic/errors"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdConfig = &cobra.Command{
+	Use:   "config [flags]",
+	Short: "show or modify the repository configuration",
+	Long: `
+The "config" command prints the configuration of the repository. When flags are
+given, the configuration is modified accordingly.
+
+The option --prune-max-unused configures when running "prune" is suggested
+after a backup. It accepts a percentage of the repository size (e.g. "10%") or
+an absolute size (e.g. "5G"), and can be specified twice to configure both
+thresholds. Use "off" to disable the suggestion.
+
+The options --maintain-read-data, --maintain-repack-below and
+--maintain-rebuild-index configure the policy for the "maintain" command. The
+first two accept a percentage, the last one a duration (e.g. "720h"). Use
+"off" to disable a task.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runConfig(configOptions, globalOptions, args)
+	},
+}
+
+// ConfigOptions collects all options for the config command.
+type ConfigOptions struct {
+	PruneMaxUnused []string
+
+	MaintainReadData     string
+	MaintainRepackBelow  string
+	MaintainRebuildIndex string
+}
+
+var configOptions ConfigOptions
+
+func init() {
+	cmdRoot.AddCommand(cmdConfig)
+
+	f := cmdConfig.Flags()
+	f.StringSliceVar(&configOptions.PruneMaxUnused, "prune-max-unused", nil, "suggest running prune when unused data exceeds `limit` (percentage or size, \"off\" to disable)")
+	f.StringVar(&configOptions.MaintainReadData, "maintain-read-data", "", "let maintain read and verify `percent` of the packs in each run (\"off\" to disable)")
+	f.StringVar(&configOptions.MaintainRepackBelow, "maintain-repack-below", "", "let maintain repack packs in which less than `percent` of the data is used (\"off\" to disable)")
+	f.StringVar(&configOptions.MaintainRebuildIndex, "maintain-rebuild-index", "", "let maintain rebuild the index when it is older than `duration` (\"off\" to disable)")
+}
+
+// parsePruneSuggestion parses the thresholds for the prune suggestion. It
+// returns nil if the suggestion is disabled.
+func parsePruneSuggestion(limits []string) (*restic.PruneSuggestion, error) {
+	s := &restic.PruneSuggestion{}
+	for _, limit := range limits {
+		limit = strings.TrimSpace(limit)
+		switch {
+		case limit == "off":
+			if len(limits) > 1 {
+				return nil, errors.Fatal("--prune-max-unused off cannot be combined with other limits")
+			}
+			return nil, nil
+		case strings.HasSuffix(limit, "%"):
+			p, err := strconv.ParseUint(strings.TrimSuffix(limit, "%"), 10, 32)
+			if err != nil || p == 0 || p > 100 {
+				return nil, errors.Fatalf("invalid percentage %q", limit)
+			}
+			s.MaxUnusedPercent = uint(p)
+		default:
+			size, err := parseSize(limit)
+			if err != nil {
+				return nil, err
+			}
+			if size == 0 {
+				return nil, errors.Fatalf("invalid size %q", limit)
+			}
+			s.MaxUnusedBytes = size
+		}
+	}
+
+	return s, nil
+}
+
+// parsePercent parses a percentage like "10%" (the percent sign is optional),
+// "off" is returned as zero.
+func parsePercent(s string) (uint, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" {
+		return 0, nil
+	}
+
+	p, err := strconv.ParseUint(strings.TrimSuffix(s, "%"), 10, 32)
+	if err != nil || p > 100 {
+		return 0, errors.Fatalf("invalid percentage %q", s)
+	}
+
+	return uint(p), nil
+}
+
+// updateMaintenancePolicy applies the options to a copy of the policy p,
+// which may be nil. It returns nil if all tasks are disabled.
+func updateMaintenancePolicy(opts ConfigOptions, p *restic.MaintenancePolicy) (*restic.MaintenancePolicy, error) {
+	policy := restic.MaintenancePolicy{}
+	if p != nil {
+		policy = *p
+	}
+
+	var err error
+	if opts.MaintainReadData != "" {
+		policy.ReadDataPercent, err = parsePercent(opts.MaintainReadData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MaintainRepackBelow != "" {
+		policy.RepackBelowPercent, err = parsePercent(opts.MaintainRepackBelow)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch strings.TrimSpace(opts.MaintainRebuildIndex) {
+	case "":
+	case "off":
+		policy.RebuildIndexAfter = 0
+	default:
+		policy.RebuildIndexAfter, err = time.ParseDuration(strings.TrimSpace(opts.MaintainRebuildIndex))
+		if err != nil || policy.RebuildIndexAfter < 0 {
+			return nil, errors.Fatalf("invalid duration %q", opts.MaintainRebuildIndex)
+		}
+	}
+
+	if !policy.Enabled() {
+		return nil, nil
+	}
+
+	return &policy, nil
+}
+
+func formatMaintenancePolicy(p *restic.MaintenancePolicy) string {
+	if !p.Enabled() {
+		return "disabled"
+	}
+
+	var tasks []string
+	if p.ReadDataPercent > 0 {
+		tasks = append(tasks, fmt.Sprintf("read %d%% of the data", p.ReadDataPercent))
+	}
+	if p.RepackBelowPercent > 0 {
+		tasks = append(tasks, fmt.Sprintf("repack packs below %d%% usage", p.RepackBelowPercent))
+	}
+	if p.RebuildIndexAfter > 0 {
+		tasks = append(tasks, fmt.Sprintf("rebuild index after %v", p.RebuildIndexAfter))
+	}
+
+	return strings.Join(tasks, ", ")
+}
+
+func formatPruneSuggestion(s *restic.PruneSuggestion) string {
+	if !s.Enabled() {
+		return "disabled"
+	}
+
+	var limits []string
+	if s.MaxUnusedPercent > 0 {
+		limits = append(limits, fmt.Sprintf("%d%%", s.MaxUnusedPercent))
+	}
+	if s.MaxUnusedBytes > 0 {
+		limits = append(limits, formatBytes(s.MaxUnusedBytes))
+	}
+
+	return "when unused data exceeds " + strings.Join(limits, " or ")
+}
+
+func runConfig(opts ConfigOptions, gopts GlobalOptions, args []string) error {
+	if len(args) > 0 {
+		return errors.Fatal("the config command does not take any arguments")
+	}
+
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return err
+	}
+
+	maintain := opts.MaintainReadData != "" || opts.MaintainRepackBelow != "" || opts.MaintainRebuildIndex != ""
+
+	if len(opts.PruneMaxUnused) > 0 || maintain {
+		cfg := repo.Config()
+
+		if len(opts.PruneMaxUnused) > 0 {
+			cfg.PruneSuggestion, err = parsePruneSuggestion(opts.PruneMaxUnused)
+			if err != nil {
+				return err
+			}
+		}
+
+		if maintain {
+			cfg.Maintenance, err = updateMaintenancePolicy(opts, cfg.Maintenance)
+			if err != nil {
+				return err
+			}
+		}
+
+		lock, err := lockRepoExclusive(repo)
+		defer unlockRepo(lock)
+		if err != nil {
+			return err
+		}
+
+		if err = repo.SaveConfig(gopts.ctx, cfg); err != nil {
+			return err
+		}
+
+		Verbosef("repository config saved\n")
+	}
+
+	cfg := repo.Config()
+	Printf("repository ID:       %v\n", cfg.ID)
+	Printf("version:             %v\n", cfg.Version)
+	Printf("chunker polynomial:  %v\n", cfg.ChunkerPolynomial)
+	Printf("prune suggestion:    %v\n", formatPruneSuggestion(cfg.PruneSuggestion))
+	Printf("maintenance:         %v\n", formatMaintenancePolicy(cfg.Maintenance))
+
+	return nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"restic"
+	"restic/errors"
+	"restic/repository"
+)
+
+var cmdDebug = &cobra.Command{
+	Use:   "debug [index-stats [index-ID ...]|index-diff old-index-ID new-index-ID]",
+	Short: "show information for troubleshooting the repository",
+	Long: `
+The "debug" command shows information about the internal data structures of
+the repository, which helps to find out why they behave unexpectedly.
+
+With "index-stats", statistics about all index files (or the ones given) are
+printed: the number of entries per blob type, the distribution of the blob
+sizes, how many entries are duplicates and how many index files have been
+superseded by others but still exist.
+
+With "index-diff", the entries of two index files (e.g. of two generations
+written by rebuild-index) are compared: the packs and blobs which only exist in
+one of them and the blobs which are stored in different packs.
+
+IDs of index files may be abbreviated. With --json, the result is printed as a
+JSON document, with --json=v1 as an event of type "index_stats" or
+"index_diff".
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runDebugCommand(globalOptions, args)
+	},
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdDebug)
+}
+
+func runDebugCommand(gopts GlobalOptions, args []string) error {
+	if len(args) == 0 {
+		return errors.Fatal("type not specified, use index-stats or index-diff")
+	}
+
+	switch args[0] {
+	case "index-stats":
+	case "index-diff":
+		if len(args) != 3 {
+			return errors.Fatal("index-diff needs the IDs of two index files")
+		}
+	default:
+		return errors.Fatalf("invalid type %q, use index-stats or index-diff", args[0])
+	}
+
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return err
+	}
+
+	if !gopts.NoLock {
+		lock, err := lockRepo(repo)
+		defer unlockRepo(lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ids restic.IDs
+	for _, s := range args[1:] {
+		id, err := findIndexID(repo, s)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	if args[0] == "index-diff" {
+		return debugIndexDiff(gopts, repo, ids[0], ids[1])
+	}
+
+	if len(ids) == 0 {
+		for id := range repo.List(gopts.ctx, restic.IndexFile) {
+			ids = append(ids, id)
+		}
+	}
+
+	return debugIndexStats(gopts, repo, ids)
+}
+
+// findIndexID returns the ID of the index file which starts with prefix.
+func findIndexID(repo *repository.Repository, prefix string) (restic.ID, error) {
+	name, err := restic.Find(repo.Backend(), restic.IndexFile, prefix)
+	if err != nil {
+		return restic.ID{}, errors.Fatalf("index %q: %v", prefix, err)
+	}
+
+	return restic.ParseID(name)
+}
+
+// indexBlobEntries returns all entries of an index.
+func indexBlobEntries(idx *repository.Index) []restic.PackedBlob {
+	done := make(chan struct{})
+	defer close(done)
+
+	var list []restic.PackedBlob
+	for pb := range idx.Each(done) {
+		list = append(list, pb)
+	}
+	return list
+}
+
+// blobSizeClasses are the upper bounds of the classes in the distribution of
+// the blob sizes printed by index-stats.
+var blobSizeClasses = []uint64{1 << 10, 16 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// indexSizeClass is the number of blobs with a size up to Max, the last class
+// has no upper bound.
+type indexSizeClass struct {
+	Max   uint64 `json:"max,omitempty"`
+	Blobs uint64 `json:"blobs"`
+}
+
+// indexTypeStats describes the entries for one blob type.
+type indexTypeStats struct {
+	Entries      uint64           `json:"entries"`
+	Blobs        uint64           `json:"blobs"`
+	Bytes        uint64           `json:"bytes"`
+	Distribution []indexSizeClass `json:"distribution"`
+}
+
+// indexStats is the result of index-stats.
+type indexStats struct {
+	IndexFiles      int                        `json:"index_files"`
+	IndexBytes      uint64                     `json:"index_bytes"`
+	Superseded      int                        `json:"superseded"`
+	Packs           int                        `json:"packs"`
+	Types           map[string]*indexTypeStats `json:"types"`
+	DuplicateBlobs  uint64                     `json:"duplicate_blobs"`
+	RepeatedEntries uint64                     `json:"repeated_entries"`
+}
+
+// debugIndexStats prints statistics about the index files ids.
+func debugIndexStats(gopts GlobalOptions, repo *repository.Repository, ids restic.IDs) error {
+	stats := indexStats{Types: make(map[string]*indexTypeStats)}
+
+	type packEntry struct {
+		h    restic.BlobHandle
+		pack restic.ID
+	}
+
+	packs := restic.NewIDSet()
+	blobs := make(map[restic.BlobHandle]restic.IDSet)
+	entries := make(map[packEntry]struct{})
+	superseded := restic.NewIDSet()
+	files := restic.NewIDSet()
+
+	for _, id := range ids {
+		idx, err := repository.LoadIndex(gopts.ctx, repo, id)
+		if err != nil {
+			return err
+		}
+
+		fi, err := repo.Backend().Stat(gopts.ctx, restic.Handle{Type: restic.IndexFile, Name: id.String()})
+		if err != nil {
+			return err
+		}
+
+		files.Insert(id)
+		stats.IndexFiles++
+		stats.IndexBytes += uint64(fi.Size)
+
+		for _, old := range idx.Supersedes() {
+			superseded.Insert(old)
+		}
+
+		for _, pb := range indexBlobEntries(idx) {
+			h := restic.BlobHandle{ID: pb.ID, Type: pb.Type}
+
+			ts := stats.Types[pb.Type.String()]
+			if ts == nil {
+				ts = &indexTypeStats{}
+				for _, max := range blobSizeClasses {
+					ts.Distribution = append(ts.Distribution, indexSizeClass{Max: max})
+				}
+				ts.Distribution = append(ts.Distribution, indexSizeClass{})
+				stats.Types[pb.Type.String()] = ts
+			}
+			ts.Entries++
+
+			e := packEntry{h, pb.PackID}
+			if _, ok := entries[e]; ok {
+				// the same entry in another index file
+				stats.RepeatedEntries++
+				continue
+			}
+			entries[e] = struct{}{}
+			packs.Insert(pb.PackID)
+
+			if blobs[h] == nil {
+				blobs[h] = restic.NewIDSet()
+				ts.Blobs++
+				ts.Bytes += uint64(pb.Length)
+
+				i := sort.Search(len(blobSizeClasses), func(i int) bool {
+					return uint64(pb.Length) <= blobSizeClasses[i]
+				})
+				ts.Distribution[i].Blobs++
+			} else {
+				// the blob is stored in another pack, too
+				stats.DuplicateBlobs++
+			}
+			blobs[h].Insert(pb.PackID)
+		}
+	}
+
+	stats.Packs = len(packs)
+	for id := range superseded {
+		if files.Has(id) {
+			stats.Superseded++
+		}
+	}
+
+	switch {
+	case gopts.JSONSchema > 0:
+		return printJSONEvent(gopts, "index_stats", stats)
+	case gopts.JSON:
+		return json.NewEncoder(gopts.stdout).Encode(stats)
+	}
+
+	Printf("index files:      %d (%s)\n", stats.IndexFiles, formatBytes(stats.IndexBytes))
+	if stats.Superseded > 0 {
+		Printf("  %d index files are superseded by others, run rebuild-index to remove them\n", stats.Superseded)
+	}
+	Printf("packs:            %d\n", stats.Packs)
+
+	var total uint64
+	for _, ts := range stats.Types {
+		total += ts.Entries
+	}
+
+	for _, tpe := range []restic.BlobType{restic.DataBlob, restic.TreeBlob} {
+		ts := stats.Types[tpe.String()]
+		if ts == nil {
+			continue
+		}
+
+		Printf("%v blobs:\n", tpe)
+		Printf("  entries:        %d\n", ts.Entries)
+		Printf("  blobs:          %d (%s)\n", ts.Blobs, formatBytes(ts.Bytes))
+		for _, class := range ts.Distribution {
+			label := "> " + formatBytes(blobSizeClasses[len(blobSizeClasses)-1])
+			if class.Max > 0 {
+				label = "<= " + formatBytes(class.Max)
+			}
+			Printf("    %-14s %d\n", label, class.Blobs)
+		}
+	}
+
+	Printf("duplicate blobs:  %d (%s of all entries, stored in more than one pack)\n",
+		stats.DuplicateBlobs, formatPercent(stats.DuplicateBlobs, total))
+	Printf("repeated entries: %d (%s of all entries, listed in more than one index file)\n",
+		stats.RepeatedEntries, formatPercent(stats.RepeatedEntries, total))
+
+	return nil
+}
+
+// indexDiff is the result of index-diff.
+type indexDiff struct {
+	Old          restic.ID  `json:"old"`
+	New          restic.ID  `json:"new"`
+	OldEntries   int        `json:"old_entries"`
+	NewEntries   int        `json:"new_entries"`
+	RemovedPacks restic.IDs `json:"removed_packs"`
+	AddedPacks   restic.IDs `json:"added_packs"`
+	RemovedBlobs int        `json:"removed_blobs"`
+	AddedBlobs   int        `json:"added_blobs"`
+	MovedBlobs   int        `json:"moved_blobs"`
+}
+
+// debugIndexDiff prints the differences between the index files oldID and
+// newID.
+func debugIndexDiff(gopts GlobalOptions, repo *repository.Repository, oldID, newID restic.ID) error {
+	load := func(id restic.ID) (map[restic.BlobHandle]restic.IDSet, restic.IDSet, int, error) {
+		idx, err := repository.LoadIndex(gopts.ctx, repo, id)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		entries := indexBlobEntries(idx)
+		blobs := make(map[restic.BlobHandle]restic.IDSet)
+		for _, pb := range entries {
+			h := restic.BlobHandle{ID: pb.ID, Type: pb.Type}
+			if blobs[h] == nil {
+				blobs[h] = restic.NewIDSet()
+			}
+			blobs[h].Insert(pb.PackID)
+		}
+
+		return blobs, idx.Packs(), len(entries), nil
+	}
+
+	oldBlobs, oldPacks, oldEntries, err := load(oldID)
+	if err != nil {
+		return err
+	}
+
+	newBlobs, newPacks, newEntries, err := load(newID)
+	if err != nil {
+		return err
+	}
+
+	diff := indexDiff{
+		Old:          oldID,
+		New:          newID,
+		OldEntries:   oldEntries,
+		NewEntries:   newEntries,
+		RemovedPacks: oldPacks.Sub(newPacks).List(),
+		AddedPacks:   newPacks.Sub(oldPacks).List(),
+	}
+	sort.Sort(diff.RemovedPacks)
+	sort.Sort(diff.AddedPacks)
+
+	for h, packs := range oldBlobs {
+		newPacks, ok := newBlobs[h]
+		if !ok {
+			diff.RemovedBlobs++
+			continue
+		}
+
+		if !packs.Equals(newPacks) {
+			diff.MovedBlobs++
+		}
+	}
+
+	for h := range newBlobs {
+		if _, ok := oldBlobs[h]; !ok {
+			diff.AddedBlobs++
+		}
+	}
+
+	switch {
+	case gopts.JSONSchema > 0:
+		return printJSONEvent(gopts, "index_diff", diff)
+	case gopts.JSON:
+		return json.NewEncoder(gopts.stdout).Encode(diff)
+	}
+
+	Printf("entries:       %d in %v, %d in %v\n", oldEntries, oldID.Str(), newEntries, newID.Str())
+	Printf("blobs:         %d removed, %d added, %d stored in other packs\n",
+		diff.RemovedBlobs, diff.AddedBlobs, diff.MovedBlobs)
+	Printf("packs:         %d removed, %d added\n", len(diff.RemovedPacks), len(diff.AddedPacks))
+
+	for _, id := range diff.RemovedPacks {
+		Printf("  - %v\n", id)
+	}
+	for _, id := range diff.AddedPacks {
+		Printf("  + %v\n", id)
+	}
+
+	return nil
+}
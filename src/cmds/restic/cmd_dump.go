@@ -13,25 +13,48 @@ import (
 
 	"restic"
 	"restic/errors"
-	"restic/pack"
+	"restic/limits"
 	"restic/repository"
 
 	"restic/worker"
 )
 
 var cmdDump = &cobra.Command{
-	Use:   "dump [indexes|snapshots|trees|all|packs]",
+	Use:   "dump [indexes|snapshots|trees|all|packs|file snapshot-ID path|tar snapshot-ID[:path] ...]",
 	Short: "dump data structures",
 	Long: `
 The "dump" command dumps data structures from the repository as JSON objects. It
-is used for debugging purposes only.`,
+is used for debugging purposes only.
+
+With "file", the contents of the file at the given path in the snapshot are
+written to stdout. The options --offset and --length select a byte range of the
+file, only the blobs which contain this range are loaded from the repository.
+The special snapshot-ID "latest" selects the latest snapshot.
+
+With "tar", a tar archive is written to stdout which contains the given paths
+(or the whole snapshot if no path is given) of one or more snapshots, e.g.
+"latest:/home/user/work 40dc1520:/srv". The entries are stored below a
+directory named after the snapshot. Files with identical content are only
+stored once, all other occurrences are written as hard links.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return runDump(globalOptions, args)
+		return runDump(dumpOptions, globalOptions, args)
 	},
 }
 
+// DumpOptions collects all options for the dump command.
+type DumpOptions struct {
+	Offset string
+	Length string
+}
+
+var dumpOptions DumpOptions
+
 func init() {
 	cmdRoot.AddCommand(cmdDump)
+
+	f := cmdDump.Flags()
+	f.StringVar(&dumpOptions.Offset, "offset", "0", "start dumping the file at `offset` (e.g. \"512k\")")
+	f.StringVar(&dumpOptions.Length, "length", "0", "dump at most `length` bytes of the file (0 means until the end)")
 }
 
 func prettyPrintJSON(wr io.Writer, item interface{}) error {
@@ -78,6 +101,8 @@ type Blob struct {
 	Length uint            `json:"length"`
 	ID     restic.ID       `json:"id"`
 	Offset uint            `json:"offset"`
+
+	UncompressedLength uint `json:"uncompressed_length,omitempty"`
 }
 
 func printPacks(repo *repository.Repository, wr io.Writer) error {
@@ -91,7 +116,7 @@ func printPacks(repo *repository.Repository, wr io.Writer) error {
 			return nil, err
 		}
 
-		blobs, err := pack.List(repo.Key(), restic.ReaderAt(repo.Backend(), h), blobInfo.Size)
+		blobs, err := repo.PackBlobs(restic.ReaderAt(repo.Backend(), h), blobInfo.Size)
 		if err != nil {
 			return nil, err
 		}
@@ -101,7 +126,7 @@ func printPacks(repo *repository.Repository, wr io.Writer) error {
 
 	jobCh := make(chan worker.Job)
 	resCh := make(chan worker.Job)
-	wp := worker.New(context.TODO(), dumpPackWorkers, f, jobCh, resCh)
+	wp := worker.New(context.TODO(), limits.Workers(dumpPackWorkers), f, jobCh, resCh)
 
 	go func() {
 		for name := range repo.Backend().List(context.TODO(), restic.DataFile) {
@@ -129,6 +154,8 @@ func printPacks(repo *repository.Repository, wr io.Writer) error {
 				Length: blob.Length,
 				ID:     blob.ID,
 				Offset: blob.Offset,
+
+				UncompressedLength: blob.UncompressedLength,
 			}
 		}
 
@@ -158,11 +185,81 @@ func dumpIndexes(repo restic.Repository) error {
 	return nil
 }
 
-func runDump(gopts GlobalOptions, args []string) error {
-	if len(args) != 1 {
+// findSnapshotID returns the ID of the snapshot s, "latest" selects the latest
+// snapshot.
+func findSnapshotID(ctx context.Context, repo restic.Repository, s string) (id restic.ID, err error) {
+	if s == "latest" {
+		id, err = restic.FindLatestSnapshot(ctx, repo, nil, nil, "")
+	} else {
+		id, err = restic.FindSnapshot(repo, s)
+	}
+	if err != nil {
+		return restic.ID{}, errors.Fatalf("invalid snapshot ID %q: %v", s, err)
+	}
+
+	return id, nil
+}
+
+// dumpFile writes the byte range selected in opts of the file at path in the
+// snapshot to wr.
+func dumpFile(ctx context.Context, opts DumpOptions, repo *repository.Repository, snapshotID, path string, wr io.Writer) error {
+	offset, err := parseSize(opts.Offset)
+	if err != nil {
+		return err
+	}
+
+	length, err := parseSize(opts.Length)
+	if err != nil {
+		return err
+	}
+
+	id, err := findSnapshotID(ctx, repo, snapshotID)
+	if err != nil {
+		return err
+	}
+
+	sn, err := restic.LoadSnapshot(ctx, repo, id)
+	if err != nil {
+		return err
+	}
+
+	node, err := restic.FindNode(ctx, repo, *sn.Tree, path)
+	if err != nil {
+		return errors.Fatalf("unable to find %v in snapshot %v: %v", path, id.Str(), err)
+	}
+
+	if node.Type != "file" {
+		return errors.Fatalf("%v is not a file", path)
+	}
+
+	if offset > node.Size {
+		return errors.Fatalf("offset %d is beyond the end of the file (%d bytes)", offset, node.Size)
+	}
+
+	return restic.DumpFileRange(ctx, repo, node.Content, offset, length, wr)
+}
+
+func runDump(opts DumpOptions, gopts GlobalOptions, args []string) error {
+	if len(args) == 0 {
 		return errors.Fatal("type not specified")
 	}
 
+	if args[0] == "file" && len(args) != 3 {
+		return errors.Fatal("dump file needs a snapshot ID and a path")
+	}
+
+	if args[0] == "tar" && len(args) < 2 {
+		return errors.Fatal("dump tar needs at least one snapshot ID")
+	}
+
+	if args[0] == "tar" && stdoutIsTerminal() && gopts.stdout == os.Stdout {
+		return errors.Fatal("refusing to write a tar archive to a terminal")
+	}
+
+	if args[0] != "file" && args[0] != "tar" && len(args) != 1 {
+		return errors.Fatal("too many arguments")
+	}
+
 	repo, err := OpenRepository(gopts)
 	if err != nil {
 		return err
@@ -190,6 +287,10 @@ func runDump(gopts GlobalOptions, args []string) error {
 		return debugPrintSnapshots(repo, os.Stdout)
 	case "packs":
 		return printPacks(repo, os.Stdout)
+	case "file":
+		return dumpFile(gopts.ctx, opts, repo, args[1], args[2], gopts.stdout)
+	case "tar":
+		return dumpTar(gopts.ctx, repo, args[1:], gopts.stdout)
 	case "all":
 		fmt.Printf("snapshots:\n")
 		err := debugPrintSnapshots(repo, os.Stdout)
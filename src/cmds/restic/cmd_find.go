@@ -85,20 +85,23 @@ func parseTime(str string) (time.Time, error) {
 }
 
 type statefulOutput struct {
-	ListLong bool
-	JSON     bool
-	inuse    bool
-	newsn    *restic.Snapshot
-	oldsn    *restic.Snapshot
-	hits     int
+	ListLong   bool
+	JSON       bool
+	JSONSchema uint
+	inuse      bool
+	newsn      *restic.Snapshot
+	oldsn      *restic.Snapshot
+	hits       int
+	totalHits  int
 }
 
 func (s *statefulOutput) PrintJSON(prefix string, node *restic.Node) {
 	type findNode restic.Node
-	b, err := json.Marshal(struct {
+	match := struct {
 		// Add these attributes
-		Path        string `json:"path,omitempty"`
-		Permissions string `json:"permissions,omitempty"`
+		Snapshot    *restic.ID `json:"snapshot,omitempty"`
+		Path        string     `json:"path,omitempty"`
+		Permissions string     `json:"permissions,omitempty"`
 
 		*findNode
 
@@ -113,7 +116,18 @@ func (s *statefulOutput) PrintJSON(prefix string, node *restic.Node) {
 		Path:        filepath.Join(prefix, node.Name),
 		Permissions: node.Mode.String(),
 		findNode:    (*findNode)(node),
-	})
+	}
+
+	s.totalHits++
+	if s.JSONSchema > 0 {
+		match.Snapshot = s.newsn.ID()
+		if err := printJSONEvent(globalOptions, "match", match); err != nil {
+			Warnf("Marshall failed: %v\n", err)
+		}
+		return
+	}
+
+	b, err := json.Marshal(match)
 	if err != nil {
 		Warnf("Marshall failed: %v\n", err)
 		return
@@ -157,6 +171,16 @@ func (s *statefulOutput) Print(prefix string, node *restic.Node) {
 }
 
 func (s *statefulOutput) Finish() {
+	if s.JSONSchema > 0 {
+		summary := struct {
+			Hits int `json:"hits"`
+		}{s.totalHits}
+		if err := printJSONEvent(globalOptions, "summary", summary); err != nil {
+			Warnf("Marshall failed: %v\n", err)
+		}
+		return
+	}
+
 	if s.JSON {
 		// do some finishing up
 		if s.oldsn != nil {
@@ -293,7 +317,7 @@ func runFind(opts FindOptions, gopts GlobalOptions, args []string) error {
 	f := &Finder{
 		repo:     repo,
 		pat:      pat,
-		out:      statefulOutput{ListLong: opts.ListLong, JSON: globalOptions.JSON},
+		out:      statefulOutput{ListLong: opts.ListLong, JSON: globalOptions.JSON, JSONSchema: globalOptions.JSONSchema},
 		notfound: restic.NewIDSet(),
 	}
 	for sn := range FindFilteredSnapshots(ctx, repo, opts.Host, opts.Tags, opts.Paths, opts.Snapshots) {
@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"restic"
+	"restic/debug"
+	"restic/errors"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -17,9 +20,23 @@ var cmdForget = &cobra.Command{
 The "forget" command removes snapshots according to a policy. Please note that
 this command really only deletes the snapshot object in the repository, which
 is a reference to data stored there. In order to remove this (now unreferenced)
-data after 'forget' was run successfully, see the 'prune' command. `,
+data after 'forget' was run successfully, see the 'prune' command.
+
+Snapshots marked with 'protect' are never removed, whatever the policy says.
+Checkpoints of backups which have not finished are not considered by the
+policy, they are removed when the backup finishes.
+
+With --grace, the snapshots are moved to the trash instead, from which they can
+be restored with 'restore-snapshot-file' until the grace period has passed.
+Until then, 'prune' keeps the data referenced by them.
+
+With --simulate, nothing is removed. Instead, the policy is applied to daily
+backups over the given period, showing how many snapshots would be kept and
+approximately how much data they reference. `,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return runForget(forgetOptions, globalOptions, args)
+		return runWithMetrics("forget", globalOptions, func(gopts GlobalOptions) error {
+			return runForget(forgetOptions, gopts, args)
+		})
 	},
 }
 
@@ -40,6 +57,8 @@ type ForgetOptions struct {
 	GroupByTags bool
 	DryRun      bool
 	Prune       bool
+	Grace       string
+	Simulate    string
 }
 
 var forgetOptions ForgetOptions
@@ -66,11 +85,57 @@ func init() {
 
 	f.BoolVarP(&forgetOptions.DryRun, "dry-run", "n", false, "do not delete anything, just print what would be done")
 	f.BoolVar(&forgetOptions.Prune, "prune", false, "automatically run the 'prune' command if snapshots have been removed")
+	f.StringVar(&forgetOptions.Grace, "grace", "", "move the snapshots to the trash, from which they can be restored for `duration` (e.g. 7d)")
+	f.StringVar(&forgetOptions.Simulate, "simulate", "", "do not remove anything, print which snapshots the policy keeps for daily backups over `duration` (e.g. 90d)")
 
 	f.SortFlags = false
 }
 
+// forgetSnapshot removes the snapshot, or moves it to the trash if grace is
+// positive.
+func forgetSnapshot(ctx context.Context, repo restic.Repository, id restic.ID, grace time.Duration) error {
+	if grace > 0 {
+		_, err := restic.TrashSnapshot(ctx, repo, id, grace)
+		return err
+	}
+
+	h := restic.Handle{Type: restic.SnapshotFile, Name: id.String()}
+	return repo.Backend().Remove(ctx, h)
+}
+
 func runForget(opts ForgetOptions, gopts GlobalOptions, args []string) error {
+	var grace time.Duration
+	if opts.Grace != "" {
+		var err error
+		if grace, err = parseDuration(opts.Grace); err != nil {
+			return err
+		}
+	}
+
+	policy := restic.ExpirePolicy{
+		Last:    opts.Last,
+		Hourly:  opts.Hourly,
+		Daily:   opts.Daily,
+		Weekly:  opts.Weekly,
+		Monthly: opts.Monthly,
+		Yearly:  opts.Yearly,
+		Tags:    opts.KeepTags,
+	}
+
+	if opts.Simulate != "" {
+		if len(args) > 0 {
+			return errors.Fatal("--simulate cannot be used with snapshot IDs")
+		}
+		if policy.Empty() {
+			return errors.Fatal("--simulate needs a policy")
+		}
+		period, err := parseDuration(opts.Simulate)
+		if err != nil {
+			return err
+		}
+		return runForgetSimulate(opts, gopts, policy, period)
+	}
+
 	repo, err := OpenRepository(gopts)
 	if err != nil {
 		return err
@@ -92,18 +157,29 @@ func runForget(opts ForgetOptions, gopts GlobalOptions, args []string) error {
 
 	ctx, cancel := context.WithCancel(gopts.ctx)
 	defer cancel()
+	removed, protected := 0, 0
 	for sn := range FindFilteredSnapshots(ctx, repo, opts.Host, opts.Tags, opts.Paths, args) {
 		if len(args) > 0 {
 			// When explicit snapshots args are given, remove them immediately.
-			if !opts.DryRun {
-				h := restic.Handle{Type: restic.SnapshotFile, Name: sn.ID().String()}
-				if err = repo.Backend().Remove(context.TODO(), h); err != nil {
+			if sn.Protected {
+				Warnf("snapshot %v is protected, not removing it\n", sn.ID().Str())
+				protected++
+			} else if !opts.DryRun {
+				if err = forgetSnapshot(context.TODO(), repo, *sn.ID(), grace); err != nil {
 					return err
 				}
-				Verbosef("removed snapshot %v\n", sn.ID().Str())
+				if grace > 0 {
+					Verbosef("moved snapshot %v to the trash\n", sn.ID().Str())
+				} else {
+					Verbosef("removed snapshot %v\n", sn.ID().Str())
+				}
+				removed++
 			} else {
 				Verbosef("would have removed snapshot %v\n", sn.ID().Str())
 			}
+		} else if sn.Checkpoint {
+			// checkpoints are removed when their backup has finished
+			debug.Log("ignoring checkpoint %v", sn.ID().Str())
 		} else {
 			var tags []string
 			if opts.GroupByTags {
@@ -119,25 +195,19 @@ func runForget(opts ForgetOptions, gopts GlobalOptions, args []string) error {
 		}
 	}
 	if len(args) > 0 {
+		gopts.metrics.Set("forget_snapshots_removed", "Number of snapshots removed by forget.", float64(removed))
+		if protected > 0 {
+			return errors.Fatalf("%d protected snapshots have not been removed, run unprotect first", protected)
+		}
 		return nil
 	}
 
-	policy := restic.ExpirePolicy{
-		Last:    opts.Last,
-		Hourly:  opts.Hourly,
-		Daily:   opts.Daily,
-		Weekly:  opts.Weekly,
-		Monthly: opts.Monthly,
-		Yearly:  opts.Yearly,
-		Tags:    opts.KeepTags,
-	}
-
 	if policy.Empty() {
 		Verbosef("no policy was specified, no snapshots will be removed\n")
 		return nil
 	}
 
-	removeSnapshots := 0
+	removeSnapshots, keepSnapshots := 0, 0
 	for k, snapshotGroup := range snapshotGroups {
 		var key key
 		if json.Unmarshal([]byte(k), &key) != nil {
@@ -163,11 +233,11 @@ func runForget(opts ForgetOptions, gopts GlobalOptions, args []string) error {
 		}
 
 		removeSnapshots += len(remove)
+		keepSnapshots += len(keep)
 
 		if !opts.DryRun {
 			for _, sn := range remove {
-				h := restic.Handle{Type: restic.SnapshotFile, Name: sn.ID().String()}
-				err = repo.Backend().Remove(context.TODO(), h)
+				err = forgetSnapshot(context.TODO(), repo, *sn.ID(), grace)
 				if err != nil {
 					return err
 				}
@@ -175,10 +245,16 @@ func runForget(opts ForgetOptions, gopts GlobalOptions, args []string) error {
 		}
 	}
 
+	gopts.metrics.Set("forget_snapshots_removed", "Number of snapshots removed by forget.", float64(removeSnapshots))
+	gopts.metrics.Set("forget_snapshots_kept", "Number of snapshots kept by forget.", float64(keepSnapshots))
+
 	if removeSnapshots > 0 && opts.Prune {
 		Verbosef("%d snapshots have been removed, running prune\n", removeSnapshots)
 		if !opts.DryRun {
-			return pruneRepository(gopts, repo)
+			if err = repo.LoadIndex(gopts.ctx); err != nil {
+				return err
+			}
+			return pruneRepository(pruneOptions, gopts, repo)
 		}
 	}
 
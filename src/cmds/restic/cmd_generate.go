@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"restic/errors"
+)
+
+var cmdGenerate = &cobra.Command{
+	Use:   "generate",
+	Short: "generate files for running restic",
+	Long: `
+The "generate" command creates files which run or support restic, e.g. units
+for systemd.
+`,
+}
+
+var cmdGenerateSystemd = &cobra.Command{
+	Use:   "systemd --profile name [flags]",
+	Short: "generate systemd units for a backup profile",
+	Long: `
+The "generate systemd" command creates a service and a timer unit from a backup
+profile. The profile is read from the file <name>.json in the profile
+directory, it contains the repository, the password file or command and the
+paths and options for "backup", e.g.:
+
+    {
+      "repository": "sftp:backup@example.com:/srv/restic",
+      "password_file": "/etc/restic/nightly.password",
+      "environment_file": "/etc/restic/nightly.env",
+      "paths": ["/etc", "/home", "/srv"],
+      "backup_args": ["--one-file-system", "--exclude-caches"],
+      "schedule": "*-*-* 02:00:00",
+      "randomized_delay": "30m",
+      "on_failure": "notify-admin@%n.service"
+    }
+
+The service runs the backup with hardening options of systemd: the file system
+is read-only except for the cache, a local repository and the directories
+listed in "read_write_paths". The password file is passed to the service with
+LoadCredential, so it only needs to be readable by root. When "user" is set,
+the backup runs as this user with the capability CAP_DAC_READ_SEARCH to read
+all files. The unit given as "on_failure" is started when the backup fails.
+
+The units are named restic-<name>.service and restic-<name>.timer. They are
+printed, or written to the directory given with --output-dir, e.g.:
+
+    restic generate systemd --profile nightly --output-dir /etc/systemd/system
+    systemctl daemon-reload
+    systemctl enable --now restic-nightly.timer
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runGenerateSystemd(generateSystemdOptions, args)
+	},
+}
+
+// GenerateSystemdOptions collects all options for the generate systemd
+// command.
+type GenerateSystemdOptions struct {
+	Profile    string
+	ProfileDir string
+	OutputDir  string
+	Binary     string
+}
+
+var generateSystemdOptions GenerateSystemdOptions
+
+func init() {
+	cmdRoot.AddCommand(cmdGenerate)
+	cmdGenerate.AddCommand(cmdGenerateSystemd)
+
+	f := cmdGenerateSystemd.Flags()
+	f.StringVar(&generateSystemdOptions.Profile, "profile", "", "generate the units for the profile `name`")
+	f.StringVar(&generateSystemdOptions.ProfileDir, "profile-dir", defaultProfileDir, "read profiles from `directory`")
+	f.StringVar(&generateSystemdOptions.OutputDir, "output-dir", "", "write the units to `directory` instead of printing them")
+	f.StringVar(&generateSystemdOptions.Binary, "binary", "", "run the restic binary at `path` (default: this binary)")
+}
+
+// resticBinary returns the absolute path of the running restic binary.
+func resticBinary() string {
+	path, err := exec.LookPath(os.Args[0])
+	if err == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err != nil {
+		return "/usr/bin/restic"
+	}
+	return path
+}
+
+func runGenerateSystemd(opts GenerateSystemdOptions, args []string) error {
+	if len(args) > 0 {
+		return errors.Fatal("the generate systemd command expects no arguments, only options")
+	}
+
+	if opts.Profile == "" {
+		return errors.Fatal("no profile given, use --profile")
+	}
+
+	p, err := loadProfile(opts.ProfileDir, opts.Profile)
+	if err != nil {
+		return err
+	}
+
+	binary := opts.Binary
+	if binary == "" {
+		binary = resticBinary()
+	}
+	if !filepath.IsAbs(binary) {
+		return errors.Fatalf("the path of the restic binary %q must be absolute", binary)
+	}
+
+	service, err := systemdService(p, binary)
+	if err != nil {
+		return err
+	}
+	timer := systemdTimer(p)
+
+	name := systemdUnitName(p)
+	if opts.OutputDir == "" {
+		Printf("# %v.service\n%v\n# %v.timer\n%v", name, service, name, timer)
+		return nil
+	}
+
+	for _, unit := range []struct {
+		filename, data string
+	}{
+		{name + ".service", service},
+		{name + ".timer", timer},
+	} {
+		filename := filepath.Join(opts.OutputDir, unit.filename)
+		if err := ioutil.WriteFile(filename, []byte(unit.data), 0644); err != nil {
+			return errors.Wrap(err, "WriteFile")
+		}
+		Verbosef("wrote %v\n", filename)
+	}
+
+	return nil
+}
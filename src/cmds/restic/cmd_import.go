@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"restic"
+	"restic/archiver"
+	"restic/debug"
+	"restic/errors"
+	"restic/fs"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdImport = &cobra.Command{
+	Use:   "import tar [file]",
+	Short: "create a snapshot from an archive",
+	Long: `
+The "import" command creates a new snapshot from the contents of an archive,
+without extracting it first. The only supported format is "tar"; the archive is
+read from the file given as the argument, or from stdin if no file (or "-") is
+given. Compressed archives must be decompressed beforehand, e.g. with
+"gzip -dc archive.tar.gz | restic import tar".
+
+The metadata stored in the tar headers (permissions, owner, timestamps,
+extended attributes, hard links) is kept. The files are stored in the snapshot
+as if they were located in the directory given with --path, so restoring the
+snapshot creates a directory named after the last component of the path.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runImport(importOptions, globalOptions, args)
+	},
+}
+
+// ImportOptions bundles all options for the import command.
+type ImportOptions struct {
+	Path     string
+	Tags     []string
+	Hostname string
+}
+
+var importOptions ImportOptions
+
+func init() {
+	cmdRoot.AddCommand(cmdImport)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		debug.Log("os.Hostname() returned err: %v", err)
+		hostname = ""
+	}
+
+	f := cmdImport.Flags()
+	f.StringVar(&importOptions.Path, "path", "/", "record this `path` in the snapshot, the files from the archive are stored below it")
+	f.StringSliceVar(&importOptions.Tags, "tag", nil, "add a `tag` for the new snapshot (can be specified multiple times)")
+	f.StringVar(&importOptions.Hostname, "hostname", hostname, "set the `hostname` for the snapshot manually")
+}
+
+func runImport(opts ImportOptions, gopts GlobalOptions, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.Fatal("wrong number of parameters")
+	}
+
+	if args[0] != "tar" {
+		return errors.Fatalf("unsupported archive format %q", args[0])
+	}
+
+	if opts.Path == "" {
+		return errors.Fatal("path for the imported files must not be empty")
+	}
+
+	if err := restic.CheckTags(opts.Tags); err != nil {
+		return errors.Fatalf("%v", err)
+	}
+
+	var rd io.Reader = os.Stdin
+	if len(args) == 2 && args[1] != "-" {
+		f, err := fs.Open(args[1])
+		if err != nil {
+			return errors.Fatalf("unable to open archive: %v", err)
+		}
+		defer f.Close()
+		rd = f
+	} else if !hasPasswordSource(gopts) {
+		return errors.Fatal("unable to read password from stdin when the archive is read from stdin, use --password-file, --password-command or $RESTIC_PASSWORD")
+	}
+
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockRepo(repo)
+	defer unlockRepo(lock)
+	if err != nil {
+		return err
+	}
+
+	err = repo.LoadIndex(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	imp := &archiver.TarImporter{
+		Repository: repo,
+		Tags:       opts.Tags,
+		Hostname:   opts.Hostname,
+		Path:       opts.Path,
+		Warn: func(name string, err error) {
+			Warnf("%sskipping %s: %v\n", ClearLine(), name, err)
+		},
+	}
+
+	_, id, err := imp.Import(context.TODO(), rd, newArchiveStdinProgress(gopts))
+	if err != nil {
+		return err
+	}
+
+	Verbosef("snapshot %s saved\n", id.Str())
+	return nil
+}
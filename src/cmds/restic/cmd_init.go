@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"restic"
+	"restic/compression"
+	"restic/crypto"
 	"restic/errors"
 	"restic/repository"
+	"strconv"
 
 	"github.com/spf13/cobra"
 )
@@ -13,21 +17,86 @@ var cmdInit = &cobra.Command{
 	Short: "initialize a new repository",
 	Long: `
 The "init" command initializes a new repository.
+
+By default, the repository uses the newest repository version. Older versions
+of restic may not be able to access it, use --repository-version 1 to create a
+repository which can still be used with them.
+
+The data is encrypted with AES-256 and authenticated with Poly1305-AES by
+default. On CPUs without hardware support for AES, "--cipher chacha20-poly1305"
+is considerably faster, it requires repository version 3. The cipher cannot be
+changed after the repository has been created.
+
+Repository version 6 compresses the blobs with zstd. "--compression auto"
+(the default) uses the fastest level, "--compression max" compresses better
+but is slower, "--compression off" stores all new blobs uncompressed.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return runInit(globalOptions, args)
+		return runInit(initOptions, globalOptions, args)
 	},
 }
 
+// InitOptions bundles all options for the 'init' command.
+type InitOptions struct {
+	RepositoryVersion string
+	Cipher            string
+	Compression       string
+}
+
+var initOptions InitOptions
+
 func init() {
 	cmdRoot.AddCommand(cmdInit)
+
+	f := cmdInit.Flags()
+	f.StringVar(&initOptions.RepositoryVersion, "repository-version", "latest", "repository format `version` to use (1, 2, 3 or \"latest\")")
+	f.StringVar(&initOptions.Cipher, "cipher", string(crypto.DefaultCipher), "`cipher` used to encrypt the data (aes256-poly1305 or chacha20-poly1305)")
+	f.StringVar(&initOptions.Compression, "compression", string(compression.DefaultMode), "compression `mode` for the blobs (auto, max or off), requires repository version 6")
+}
+
+// parseRepositoryVersion parses the argument given to --repository-version.
+func parseRepositoryVersion(s string) (uint, error) {
+	if s == "" || s == "latest" {
+		return restic.RepoVersion, nil
+	}
+
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || v < restic.MinRepoVersion || v > restic.MaxRepoVersion {
+		return 0, errors.Fatalf("invalid repository version %q, must be between %v and %v or \"latest\"",
+			s, restic.MinRepoVersion, restic.MaxRepoVersion)
+	}
+
+	return uint(v), nil
 }
 
-func runInit(gopts GlobalOptions, args []string) error {
+func runInit(opts InitOptions, gopts GlobalOptions, args []string) error {
 	if gopts.Repo == "" {
 		return errors.Fatal("Please specify repository location (-r)")
 	}
 
+	version, err := parseRepositoryVersion(opts.RepositoryVersion)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := crypto.ParseCipher(opts.Cipher)
+	if err != nil {
+		return errors.Fatalf("%v", err)
+	}
+
+	if cipher != crypto.DefaultCipher && version < 3 {
+		return errors.Fatalf("cipher %v requires repository version 3", cipher)
+	}
+
+	mode, err := compression.ParseMode(opts.Compression)
+	if err != nil {
+		return errors.Fatalf("%v", err)
+	}
+
+	if mode != compression.DefaultMode && version < 6 {
+		return errors.Fatalf("compression mode %v requires repository version 6", mode)
+	}
+
 	be, err := create(gopts.Repo, gopts.extended)
 	if err != nil {
 		return errors.Fatalf("create backend at %s failed: %v\n", gopts.Repo, err)
@@ -42,9 +111,9 @@ func runInit(gopts GlobalOptions, args []string) error {
 		}
 	}
 
-	s := repository.New(be)
+	s := repository.New(limitBackend(be, gopts))
 
-	err = s.Init(context.TODO(), gopts.password)
+	err = s.Init(context.TODO(), version, cipher, mode, gopts.password)
 	if err != nil {
 		return errors.Fatalf("create key in backend at %s failed: %v\n", gopts.Repo, err)
 	}
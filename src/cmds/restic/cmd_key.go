@@ -6,6 +6,7 @@ import (
 	"restic"
 	"restic/errors"
 	"restic/repository"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -15,20 +16,63 @@ var cmdKey = &cobra.Command{
 	Short: "manage keys (passwords)",
 	Long: `
 The "key" command manages keys (passwords) for accessing the repository.
+
+With "add --domain name", the new key belongs to an encryption domain: the
+data and trees saved with this key are encrypted with a separate data key of
+the domain, which keys of other domains can't decrypt. The key does not
+contain the master key, so it can't read the data of other domains or of keys
+without a domain. Keys with the master key can still read all domains. All
+domains share the key for the snapshots and the index, so a key of a domain
+can still list the paths, host names and tags of the snapshots of other
+domains, and remove or overwrite them. Adding a key for an existing domain
+requires the master key as well, keys added with a key of a domain belong to
+the same domain. Encryption domains require repository version 4, see the
+"migrate" command.
+
+With "add --label text", the new key gets a description, which "list" shows
+together with the key which was used to add it. With "add --allow", the key
+can only be used for the listed operations:
+
+  backup   save new snapshots ("backup", "import")
+  read     list, check and restore snapshots and data
+  modify   change or remove snapshots and data ("forget", "prune", "tag" ...)
+  key      manage keys
+
+For example, "key add --allow backup" creates a key for a client which should
+only save backups. A key which is restricted can only add keys which are
+restricted to the same or fewer operations, "passwd" keeps the label and the
+operations. The operations are checked by restic itself and not by the
+backend, so for protection against a compromised client, combine them with an
+append-only mode of the server.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return runKey(globalOptions, args)
+		return runKey(keyOptions, globalOptions, args)
 	},
 }
 
+// KeyOptions bundles all options for the key command.
+type KeyOptions struct {
+	Domain string
+	Label  string
+	Allow  []string
+}
+
+var keyOptions KeyOptions
+
 func init() {
 	cmdRoot.AddCommand(cmdKey)
+
+	f := cmdKey.Flags()
+	f.StringVar(&keyOptions.Domain, "domain", "", "add the key to the encryption domain `name` (add only)")
+	f.StringVar(&keyOptions.Label, "label", "", "set a description `text` for the key (add only)")
+	f.StringSliceVar(&keyOptions.Allow, "allow", nil, "only allow the `operation` with the key, can be specified multiple times (add only)")
 }
 
 func listKeys(ctx context.Context, s *repository.Repository) error {
 	tab := NewTable()
-	tab.Header = fmt.Sprintf(" %-10s  %-10s  %-10s  %s", "ID", "User", "Host", "Created")
-	tab.RowFormat = "%s%-10s  %-10s  %-10s  %s"
+	tab.Header = fmt.Sprintf(" %-10s  %-10s  %-10s  %-19s  %-10s  %-10s  %-18s  %s",
+		"ID", "User", "Host", "Created", "Created by", "Domain", "Allowed", "Label")
+	tab.RowFormat = "%s%-10s  %-10s  %-10s  %-19s  %-10s  %-10s  %-18s  %s"
 
 	for id := range s.List(ctx, restic.KeyFile) {
 		k, err := repository.LoadKey(ctx, s, id.String())
@@ -43,8 +87,20 @@ func listKeys(ctx context.Context, s *repository.Repository) error {
 		} else {
 			current = " "
 		}
+
+		createdBy := k.CreatedBy
+		if len(createdBy) > 8 {
+			createdBy = createdBy[:8]
+		}
+
+		allowed := "all"
+		if len(k.Operations) > 0 {
+			allowed = strings.Join(k.Operations, ",")
+		}
+
 		tab.Rows = append(tab.Rows, []interface{}{current, id.Str(),
-			k.Username, k.Hostname, k.Created.Format(TimeFormat)})
+			k.Username, k.Hostname, k.Created.Format(TimeFormat), createdBy,
+			k.Domain, allowed, k.Label})
 	}
 
 	return tab.Write(globalOptions.stdout)
@@ -63,13 +119,46 @@ func getNewPassword(gopts GlobalOptions) (string, error) {
 		"enter password again: ")
 }
 
-func addKey(gopts GlobalOptions, repo *repository.Repository) error {
+func addKey(opts KeyOptions, gopts GlobalOptions, repo *repository.Repository) error {
+	if opts.Domain != "" && repo.Key() == nil {
+		return errors.Fatalf("the current key belongs to the encryption domain %q, adding keys for a domain requires the master key", repo.Domain())
+	}
+
+	ops, err := parseKeyOperations(opts.Allow)
+	if err != nil {
+		return err
+	}
+
+	// a restricted key cannot add keys which are allowed more
+	if current := repo.KeyMetadata(); len(current.Operations) > 0 {
+		if len(ops) == 0 {
+			ops = current.Operations
+		}
+
+		for _, op := range ops {
+			if !current.Allows(op) {
+				return errors.Fatalf("the current key does not allow %q, unable to allow it for the new key", op)
+			}
+		}
+	}
+
 	pw, err := getNewPassword(gopts)
 	if err != nil {
 		return err
 	}
 
-	id, err := repository.AddKey(context.TODO(), repo, pw, repo.Key())
+	meta := repository.KeyMetadata{
+		Label:      opts.Label,
+		CreatedBy:  repo.KeyName(),
+		Operations: ops,
+	}
+
+	var id *repository.Key
+	if opts.Domain != "" {
+		id, err = repository.AddDomainKey(context.TODO(), repo, pw, opts.Domain, meta)
+	} else {
+		id, err = repository.AddKeyWithMetadata(context.TODO(), repo, pw, meta)
+	}
 	if err != nil {
 		return errors.Fatalf("creating new key failed: %v\n", err)
 	}
@@ -100,7 +189,7 @@ func changePassword(gopts GlobalOptions, repo *repository.Repository) error {
 		return err
 	}
 
-	id, err := repository.AddKey(context.TODO(), repo, pw, repo.Key())
+	id, err := repository.AddKeyWithMetadata(context.TODO(), repo, pw, repo.KeyMetadata())
 	if err != nil {
 		return errors.Fatalf("creating new key failed: %v\n", err)
 	}
@@ -116,11 +205,15 @@ func changePassword(gopts GlobalOptions, repo *repository.Repository) error {
 	return nil
 }
 
-func runKey(gopts GlobalOptions, args []string) error {
+func runKey(opts KeyOptions, gopts GlobalOptions, args []string) error {
 	if len(args) < 1 || (args[0] == "rm" && len(args) != 2) || (args[0] != "rm" && len(args) != 1) {
 		return errors.Fatal("wrong number of arguments")
 	}
 
+	if (opts.Domain != "" || opts.Label != "" || len(opts.Allow) > 0) && args[0] != "add" {
+		return errors.Fatal("--domain, --label and --allow can only be used with \"add\"")
+	}
+
 	ctx, cancel := context.WithCancel(gopts.ctx)
 	defer cancel()
 
@@ -145,7 +238,7 @@ func runKey(gopts GlobalOptions, args []string) error {
 			return err
 		}
 
-		return addKey(gopts, repo)
+		return addKey(opts, gopts, repo)
 	case "rm":
 		lock, err := lockRepoExclusive(repo)
 		defer unlockRepo(lock)
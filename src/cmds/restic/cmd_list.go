@@ -11,7 +11,7 @@ import (
 )
 
 var cmdList = &cobra.Command{
-	Use:   "list [blobs|packs|index|snapshots|keys|locks]",
+	Use:   "list [blobs|packs|index|snapshots|keys|locks|trash|intents|operations]",
 	Short: "list objects in the repository",
 	Long: `
 The "list" command allows listing objects in the repository based on type.
@@ -55,6 +55,12 @@ func runList(opts GlobalOptions, args []string) error {
 		t = restic.KeyFile
 	case "locks":
 		t = restic.LockFile
+	case "trash":
+		t = restic.TrashFile
+	case "intents":
+		t = restic.IntentFile
+	case "operations":
+		t = restic.OperationFile
 	case "blobs":
 		idx, err := index.Load(context.TODO(), repo, nil)
 		if err != nil {
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"restic"
+	"strings"
+
+	"restic/errors"
+	"restic/repository"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdLookupBlobs = &cobra.Command{
+	Use:   "lookup-blobs [flags] [ID...]",
+	Short: "check which blobs are already stored in the repository",
+	Long: `
+The "lookup-blobs" command checks which of the given blob IDs are already
+stored in the repository. This allows external tools to find out which data
+would be deduplicated before it is handed to restic.
+
+The IDs are taken from the arguments, or read from stdin (one per line) when
+no arguments are given. For each ID a line is printed which states whether the
+blob exists in the repository, or a JSON list with --json.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runLookupBlobs(lookupBlobsOptions, globalOptions, args)
+	},
+}
+
+// LookupBlobsOptions collects all options for the lookup-blobs command.
+type LookupBlobsOptions struct {
+	Type string
+}
+
+var lookupBlobsOptions LookupBlobsOptions
+
+func init() {
+	cmdRoot.AddCommand(cmdLookupBlobs)
+
+	f := cmdLookupBlobs.Flags()
+	f.StringVar(&lookupBlobsOptions.Type, "type", "data", "blob `type` to look up (data or tree)")
+}
+
+// lookupResult is printed for each ID in JSON mode.
+type lookupResult struct {
+	ID     restic.ID       `json:"id"`
+	Type   restic.BlobType `json:"type"`
+	Exists bool            `json:"exists"`
+}
+
+// readIDs parses one ID per line from rd, empty lines are ignored.
+func readIDs(rd io.Reader) (restic.IDs, error) {
+	var ids restic.IDs
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+
+		id, err := restic.ParseID(line)
+		if err != nil {
+			return nil, errors.Fatalf("invalid ID %q: %v", line, err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, errors.Wrap(sc.Err(), "Scan")
+}
+
+func runLookupBlobs(opts LookupBlobsOptions, gopts GlobalOptions, args []string) error {
+	var tpe restic.BlobType
+	switch opts.Type {
+	case "data":
+		tpe = restic.DataBlob
+	case "tree":
+		tpe = restic.TreeBlob
+	default:
+		return errors.Fatalf("invalid blob type %q", opts.Type)
+	}
+
+	var ids restic.IDs
+	if len(args) > 0 {
+		for _, arg := range args {
+			id, err := restic.ParseID(arg)
+			if err != nil {
+				return errors.Fatalf("invalid ID %q: %v", arg, err)
+			}
+			ids = append(ids, id)
+		}
+	} else {
+		var err error
+		ids, err = readIDs(os.Stdin)
+		if err != nil {
+			return err
+		}
+	}
+
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return err
+	}
+
+	if !gopts.NoLock {
+		lock, err := lockRepo(repo)
+		defer unlockRepo(lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = repo.LoadIndex(gopts.ctx); err != nil {
+		return err
+	}
+
+	query := restic.NewBlobSet()
+	for _, id := range ids {
+		query.Insert(restic.BlobHandle{ID: id, Type: tpe})
+	}
+
+	mi, ok := repo.Index().(*repository.MasterIndex)
+	if !ok {
+		return errors.New("unable to look up blobs in index")
+	}
+	existing := mi.FindExisting(query)
+
+	results := make([]lookupResult, 0, len(ids))
+	for _, id := range ids {
+		results = append(results, lookupResult{
+			ID:     id,
+			Type:   tpe,
+			Exists: existing.Has(restic.BlobHandle{ID: id, Type: tpe}),
+		})
+	}
+
+	if gopts.JSONSchema > 0 {
+		for _, res := range results {
+			if err = printJSONEvent(gopts, "blob", res); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if gopts.JSON {
+		return json.NewEncoder(gopts.stdout).Encode(results)
+	}
+
+	for _, res := range results {
+		status := "missing"
+		if res.Exists {
+			status = "exists"
+		}
+		Printf("%v %v\n", res.ID, status)
+	}
+
+	return nil
+}
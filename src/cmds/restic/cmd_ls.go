@@ -8,7 +8,7 @@ import (
 
 	"restic"
 	"restic/errors"
-	"restic/repository"
+	"restic/walk"
 )
 
 var cmdLs = &cobra.Command{
@@ -18,6 +18,11 @@ var cmdLs = &cobra.Command{
 The "ls" command allows listing files and directories in a snapshot.
 
 The special snapshot-ID "latest" can be used to list files and directories of the latest snapshot in the repository.
+
+With --long, the mode, owner (uid and gid), size, modification time and symlink
+targets are printed. With --print0, each entry is terminated by a NUL byte
+instead of a newline, so that file names containing newlines can be processed
+with e.g. "xargs -0".
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return runLs(lsOptions, globalOptions, args)
@@ -27,6 +32,7 @@ The special snapshot-ID "latest" can be used to list files and directories of th
 // LsOptions collects all options for the ls command.
 type LsOptions struct {
 	ListLong bool
+	Print0   bool
 	Host     string
 	Tags     []string
 	Paths    []string
@@ -38,24 +44,36 @@ func init() {
 	cmdRoot.AddCommand(cmdLs)
 
 	flags := cmdLs.Flags()
-	flags.BoolVarP(&lsOptions.ListLong, "long", "l", false, "use a long listing format showing size and mode")
+	flags.BoolVarP(&lsOptions.ListLong, "long", "l", false, "use a long listing format showing mode, owner, size, modification time and symlink targets")
+	flags.BoolVar(&lsOptions.Print0, "print0", false, "terminate each entry with a NUL byte instead of a newline")
 
 	flags.StringVarP(&lsOptions.Host, "host", "H", "", "only consider snapshots for this `host`, when no snapshot ID is given")
 	flags.StringSliceVar(&lsOptions.Tags, "tag", nil, "only consider snapshots which include this `tag`, when no snapshot ID is given")
 	flags.StringSliceVar(&lsOptions.Paths, "path", nil, "only consider snapshots which include this (absolute) `path`, when no snapshot ID is given")
 }
 
-func printTree(repo *repository.Repository, id *restic.ID, prefix string) error {
-	tree, err := repo.LoadTree(context.TODO(), *id)
+// lsPrefetchTrees is the number of trees kept in memory while listing.
+const lsPrefetchTrees = 1000
+
+func printTree(ctx context.Context, opts LsOptions, trees *walk.Prefetcher, id *restic.ID, prefix string) error {
+	tree, err := trees.LoadTree(ctx, *id)
 	if err != nil {
 		return err
 	}
 
+	// load the subdirectories in the background while this one is printed
+	trees.PrefetchSubtrees(tree)
+
+	terminator := "\n"
+	if opts.Print0 {
+		terminator = "\x00"
+	}
+
 	for _, entry := range tree.Nodes {
-		Printf("%s\n", formatNode(prefix, entry, lsOptions.ListLong))
+		Printf("%s%s", formatNode(prefix, entry, opts.ListLong), terminator)
 
 		if entry.Type == "dir" && entry.Subtree != nil {
-			if err = printTree(repo, entry.Subtree, filepath.Join(prefix, entry.Name)); err != nil {
+			if err = printTree(ctx, opts, trees, entry.Subtree, filepath.Join(prefix, entry.Name)); err != nil {
 				return err
 			}
 		}
@@ -80,10 +98,15 @@ func runLs(opts LsOptions, gopts GlobalOptions, args []string) error {
 
 	ctx, cancel := context.WithCancel(gopts.ctx)
 	defer cancel()
+
+	trees := walk.NewPrefetcher(ctx, repo, lsPrefetchTrees)
 	for sn := range FindFilteredSnapshots(ctx, repo, opts.Host, opts.Tags, opts.Paths, args) {
-		Verbosef("snapshot %s of %v at %s):\n", sn.ID().Str(), sn.Paths, sn.Time)
+		// the header would break parsing the NUL-separated output
+		if !opts.Print0 {
+			Verbosef("snapshot %s of %v at %s):\n", sn.ID().Str(), sn.Paths, sn.Time)
+		}
 
-		if err = printTree(repo, sn.Tree, string(filepath.Separator)); err != nil {
+		if err = printTree(ctx, opts, trees, sn.Tree, string(filepath.Separator)); err != nil {
 			return err
 		}
 	}
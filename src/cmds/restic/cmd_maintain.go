@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"os"
+	"restic"
+	"restic/errors"
+	"restic/repository"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdMaintain = &cobra.Command{
+	Use:   "maintain [flags]",
+	Short: "run the maintenance tasks which are due",
+	Long: `
+The "maintain" command runs the maintenance tasks configured in the repository
+(see "restic config"): Packs which are used less than the configured percentage
+are repacked, the index is rebuilt if it is older than the configured age, and
+afterwards the repository is checked while reading the configured percentage of
+the data. Tasks which are not due are skipped, so the command can be run
+regularly, e.g. from cron.
+
+With --window, the tasks are only run within the given time window, e.g.
+"sun 01:00-05:00" or "mon-fri 22:00-06:00", outside of it nothing is done. When
+many hosts share a repository server, --jitter delays the start by a duration
+up to the given maximum which is derived from the host name, so that the hosts
+do not all start at the same time.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runMaintain(maintainOptions, globalOptions, args)
+	},
+}
+
+// MaintainOptions collects all options for the maintain command.
+type MaintainOptions struct {
+	DeleteDelay time.Duration
+	Window      string
+	Jitter      time.Duration
+}
+
+var maintainOptions MaintainOptions
+
+func init() {
+	cmdRoot.AddCommand(cmdMaintain)
+
+	f := cmdMaintain.Flags()
+	f.DurationVar(&maintainOptions.DeleteDelay, "delete-delay", 0, "record unneeded packs and remove them in a later run after `duration` (see prune)")
+	f.StringVar(&maintainOptions.Window, "window", "", "only run the tasks within the time `window`, e.g. \"sun 01:00-05:00\"")
+	f.DurationVar(&maintainOptions.Jitter, "jitter", 0, "delay the start by up to `duration`, derived from the host name")
+}
+
+// countSparsePacks returns the number of packs in which less than percent of
+// the data is used by any snapshot. The index must be loaded already.
+func countSparsePacks(ctx context.Context, gopts GlobalOptions, repo *repository.Repository, percent uint) (int, error) {
+	mi, ok := repo.Index().(*repository.MasterIndex)
+	if !ok {
+		return 0, errors.New("unable to list blobs in index")
+	}
+
+	usedBlobs, err := findAllUsedBlobs(ctx, gopts, repo)
+	if err != nil {
+		return 0, err
+	}
+
+	type packUsage struct {
+		used, total uint64
+	}
+
+	packs := make(map[restic.ID]packUsage)
+	seen := make(map[restic.PackedBlob]struct{})
+	for _, idx := range mi.All() {
+		for pb := range idx.Each(nil) {
+			if _, ok := seen[pb]; ok {
+				continue
+			}
+			seen[pb] = struct{}{}
+
+			u := packs[pb.PackID]
+			u.total += uint64(pb.Length)
+			if usedBlobs.Has(restic.BlobHandle{ID: pb.ID, Type: pb.Type}) {
+				u.used += uint64(pb.Length)
+			}
+			packs[pb.PackID] = u
+		}
+	}
+
+	n := 0
+	for _, u := range packs {
+		if u.used*100 < u.total*uint64(percent) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func runMaintain(opts MaintainOptions, gopts GlobalOptions, args []string) error {
+	if len(args) > 0 {
+		return errors.Fatal("the maintain command does not take any arguments")
+	}
+
+	var window *timeWindow
+	if opts.Window != "" {
+		w, err := parseTimeWindow(opts.Window)
+		if err != nil {
+			return errors.Fatalf("invalid maintenance window: %v", err)
+		}
+		window = &w
+	}
+
+	if opts.Jitter > 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "Hostname")
+		}
+
+		d := hostJitter(hostname, opts.Jitter)
+		Verbosef("waiting %v before starting\n", d)
+		select {
+		case <-time.After(d):
+		case <-gopts.ctx.Done():
+			return gopts.ctx.Err()
+		}
+	}
+
+	if window != nil && !window.Contains(time.Now()) {
+		Verbosef("outside of the maintenance window %v, nothing to do\n", window)
+		return nil
+	}
+
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return err
+	}
+
+	cfg := repo.Config()
+	policy := cfg.Maintenance
+	if !policy.Enabled() {
+		return errors.Fatal("no maintenance policy configured, use `restic config` to set one")
+	}
+
+	lock, err := lockRepoExclusive(repo)
+	defer unlockRepo(lock)
+	if err != nil {
+		return err
+	}
+
+	ctx := gopts.ctx
+	if err = repo.LoadIndex(ctx); err != nil {
+		return err
+	}
+
+	rebuilt := false
+	if policy.RepackBelowPercent > 0 {
+		n, err := countSparsePacks(ctx, gopts, repo, policy.RepackBelowPercent)
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			Verbosef("%d packs are used less than %d%%, running prune\n", n, policy.RepackBelowPercent)
+			err = pruneRepository(PruneOptions{
+				DeleteBatchSize: 1000,
+				DeleteDelay:     opts.DeleteDelay,
+				RepackBelow:     policy.RepackBelowPercent,
+			}, gopts, repo)
+			if err != nil {
+				return err
+			}
+			rebuilt = true
+		} else {
+			Verbosef("no packs are used less than %d%%\n", policy.RepackBelowPercent)
+		}
+	}
+
+	now := time.Now()
+	if !rebuilt && policy.IndexRebuildDue(now) {
+		Verbosef("index was not rebuilt for %v, rebuilding\n", policy.RebuildIndexAfter)
+		if err = rebuildIndex(ctx, repo); err != nil {
+			return err
+		}
+		rebuilt = true
+	}
+
+	if rebuilt {
+		p := *policy
+		p.LastIndexRebuild = now
+		cfg.Maintenance = &p
+		if err = repo.SaveConfig(ctx, cfg); err != nil {
+			return err
+		}
+	}
+
+	return checkRepository(CheckOptions{ReadDataPercent: policy.ReadDataPercent}, gopts, repo)
+}
@@ -31,6 +31,7 @@ func init() {
 
 func checkMigrations(opts MigrateOptions, gopts GlobalOptions, repo restic.Repository) error {
 	ctx := gopts.ctx
+	Printf("repository version %v, the newest version is %v\n", repo.Config().Version, restic.MaxRepoVersion)
 	Printf("available migrations:\n")
 	for _, m := range migrations.All {
 		ok, err := m.Check(ctx, repo)
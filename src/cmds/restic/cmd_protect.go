@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"restic/errors"
+)
+
+var cmdProtect = &cobra.Command{
+	Use:   "protect [flags] [snapshot-ID ...]",
+	Short: "protect snapshots from being removed",
+	Long: `
+The "protect" command marks snapshots as protected. Protected snapshots are
+never removed by "forget", neither when given explicitly nor by a policy, so
+"prune" keeps all data they reference. Use "unprotect" to remove the mark.
+
+When no snapshot-ID is given, all snapshots matching the host, tag and path
+filter criteria are protected. At least one snapshot-ID or filter is required.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runProtect(protectOptions, globalOptions, args, true)
+	},
+}
+
+var cmdUnprotect = &cobra.Command{
+	Use:   "unprotect [flags] [snapshot-ID ...]",
+	Short: "allow protected snapshots to be removed again",
+	Long: `
+The "unprotect" command removes the mark set by "protect" from snapshots, so
+they can be removed by "forget" again. Unlike "protect", it can only be used
+with keys which allow all operations.
+
+When no snapshot-ID is given, all snapshots matching the host, tag and path
+filter criteria are unprotected. At least one snapshot-ID or filter is
+required.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runProtect(protectOptions, globalOptions, args, false)
+	},
+}
+
+// ProtectOptions bundles all options for the 'protect' and 'unprotect'
+// commands.
+type ProtectOptions struct {
+	Host  string
+	Paths []string
+	Tags  []string
+}
+
+var protectOptions ProtectOptions
+
+func init() {
+	for _, cmd := range []*cobra.Command{cmdProtect, cmdUnprotect} {
+		cmdRoot.AddCommand(cmd)
+
+		f := cmd.Flags()
+		f.StringVarP(&protectOptions.Host, "host", "H", "", "only consider snapshots for this `host`, when no snapshot ID is given")
+		f.StringSliceVar(&protectOptions.Tags, "tag", nil, "only consider snapshots which include this `tag`, when no snapshot-ID is given")
+		f.StringSliceVar(&protectOptions.Paths, "path", nil, "only consider snapshots which include this (absolute) `path`, when no snapshot-ID is given")
+	}
+}
+
+func runProtect(opts ProtectOptions, gopts GlobalOptions, args []string, protect bool) error {
+	if len(args) == 0 && opts.Host == "" && len(opts.Tags) == 0 && len(opts.Paths) == 0 {
+		return errors.Fatal("no snapshot-ID or filter given")
+	}
+
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return err
+	}
+
+	if !gopts.NoLock {
+		lock, err := lockRepoExclusive(repo)
+		defer unlockRepo(lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	changeCnt := 0
+	for sn := range FindFilteredSnapshots(gopts.ctx, repo, opts.Host, opts.Tags, opts.Paths, args) {
+		if sn.Protected == protect {
+			continue
+		}
+
+		sn.Protected = protect
+		id, err := replaceSnapshot(gopts.ctx, repo, sn)
+		if err != nil {
+			Warnf("unable to modify snapshot ID %q, ignoring: %v\n", sn.ID(), err)
+			continue
+		}
+		changeCnt++
+
+		if protect {
+			Verbosef("protected snapshot %v, new ID %v\n", sn.ID().Str(), id.Str())
+		} else {
+			Verbosef("unprotected snapshot %v, new ID %v\n", sn.ID().Str(), id.Str())
+		}
+	}
+
+	if changeCnt == 0 {
+		Verbosef("No snapshots were modified\n")
+	} else {
+		Verbosef("Modified %v snapshots\n", changeCnt)
+	}
+	return nil
+}
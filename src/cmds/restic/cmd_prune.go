@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"restic"
+	"restic/backend"
 	"restic/debug"
 	"restic/errors"
 	"restic/index"
@@ -18,14 +22,76 @@ var cmdPrune = &cobra.Command{
 	Long: `
 The "prune" command checks the repository and removes data that is not
 referenced and therefore not needed any more.
+
+With --dry-run, the repository is analyzed as usual and prune prints which
+packs would be deleted or rewritten and how much space would be freed, but
+nothing is modified.
+
+Packs which contain unused data are rewritten, which can cause a lot of
+traffic on remote backends. With --max-unused, only as many packs are
+rewritten as needed to bring the unused data below the limit, which is
+either a percentage of the repository size (e.g. "5%") or a size (e.g.
+"10G").
+
+With --max-repack-size, the packs which are rewritten in one run are limited
+to the given size (e.g. "50G"), the packs which free the most space are
+rewritten first. The remaining packs are rewritten by later runs, so a large
+prune can be split into several smaller ones.
+
+The progress of the repack is recorded in a file in the cache directory (or
+the directory for temporary files). An interrupted prune continues where it
+stopped when it is run again, unless snapshots have been added meanwhile.
+
+With --concurrent, prune only holds a non-exclusive lock while it analyzes the
+repository and rewrites packs, so backups can continue meanwhile. Unneeded
+packs are only recorded and removed by a later run once --delete-delay (24h
+by default) has passed. For the removal, the repository is locked exclusively
+for a short time; if that is not possible, the packs are removed later.
+
+With --json, a summary of the results is printed as JSON instead of the
+messages. With --json=v1, events are printed while prune runs: the packs in
+the repository ("prune_repository"), what will be deleted and rewritten
+("prune_plan"), the progress of each phase ("prune_progress") and the summary
+("prune_summary").
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return runPrune(globalOptions)
+		// the messages would be mixed with the JSON output
+		if globalOptions.JSON {
+			globalOptions.Quiet = true
+		}
+
+		return runWithMetrics("prune", globalOptions, func(gopts GlobalOptions) error {
+			return runPrune(pruneOptions, gopts)
+		})
 	},
 }
 
+// PruneOptions collects all options for the prune command.
+type PruneOptions struct {
+	DeleteBatchSize int
+	MaxDeleteRate   float64
+	DeleteDelay     time.Duration
+	RepackBelow     uint
+	MaxUnused       string
+	MaxRepackSize   string
+	DryRun          bool
+	Concurrent      bool
+}
+
+var pruneOptions PruneOptions
+
 func init() {
 	cmdRoot.AddCommand(cmdPrune)
+
+	f := cmdPrune.Flags()
+	f.IntVar(&pruneOptions.DeleteBatchSize, "delete-batch-size", 1000, "remove up to `n` files per request on backends which support it")
+	f.Float64Var(&pruneOptions.MaxDeleteRate, "max-delete-rate", 0, "remove at most `n` files per second (0 means unlimited)")
+	f.DurationVar(&pruneOptions.DeleteDelay, "delete-delay", 0, "record unneeded packs and remove them in a later run after `duration`, for backends with eventually consistent listings")
+	f.UintVar(&pruneOptions.RepackBelow, "repack-below", 0, "only rewrite packs in which less than `percent` of the data is still used (0 rewrites all packs with unused data)")
+	f.StringVar(&pruneOptions.MaxUnused, "max-unused", "", "only rewrite packs until at most `limit` of unused data is left, as a percentage of the repository size (e.g. 5%) or a size (e.g. 10G)")
+	f.StringVar(&pruneOptions.MaxRepackSize, "max-repack-size", "", "rewrite packs of at most `size` in total per run (e.g. 50G)")
+	f.BoolVarP(&pruneOptions.DryRun, "dry-run", "n", false, "do not modify the repository, just print what would be done")
+	f.BoolVar(&pruneOptions.Concurrent, "concurrent", false, "allow backups to run while pruning, unneeded packs are removed in a later run after --delete-delay")
 }
 
 // newProgressMax returns a progress that counts blobs.
@@ -59,27 +125,94 @@ func newProgressMax(show bool, max uint64, description string) *restic.Progress
 	return p
 }
 
-func runPrune(gopts GlobalOptions) error {
+func runPrune(opts PruneOptions, gopts GlobalOptions) error {
 	repo, err := OpenRepository(gopts)
 	if err != nil {
 		return err
 	}
 
-	lock, err := lockRepoExclusive(repo)
+	if opts.Concurrent && !opts.DryRun {
+		return runPruneConcurrent(opts, gopts, repo)
+	}
+
+	// nothing is modified in a dry run, so other clients may continue to use
+	// the repository
+	lockFn := lockRepoExclusive
+	if opts.DryRun {
+		lockFn = lockRepo
+	}
+
+	lock, err := lockFn(repo)
 	defer unlockRepo(lock)
 	if err != nil {
 		return err
 	}
 
-	return pruneRepository(gopts, repo)
+	if err = repo.LoadIndex(gopts.ctx); err != nil {
+		return err
+	}
+
+	return pruneRepository(opts, gopts, repo)
+}
+
+// pruneRepository removes unneeded data from the repository. The index must
+// be loaded already.
+func pruneRepository(opts PruneOptions, gopts GlobalOptions, repo *repository.Repository) error {
+	_, err := prunePacks(opts, gopts, repo)
+	if !opts.DryRun {
+		recordOperation(gopts.ctx, repo, "prune", err)
+	}
+	return err
 }
 
-func pruneRepository(gopts GlobalOptions, repo restic.Repository) error {
+// prunePacks does the work of pruneRepository. For a concurrent prune, the
+// packs which are due for removal are not removed but returned, so that they
+// can be removed while the repository is locked exclusively.
+func prunePacks(opts PruneOptions, gopts GlobalOptions, repo *repository.Repository) (*pendingRemoval, error) {
 	ctx := gopts.ctx
+	progress := newPruneProgress(gopts)
+	concurrent := opts.Concurrent && !opts.DryRun
 
-	err := repo.LoadIndex(ctx)
+	maxUnused, err := parseMaxUnused(opts.MaxUnused)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var maxRepackSize uint64
+	if opts.MaxRepackSize != "" {
+		maxRepackSize, err = parseSize(opts.MaxRepackSize)
+		if err != nil {
+			return nil, errors.Fatalf("invalid value for --max-repack-size: %q", opts.MaxRepackSize)
+		}
+	}
+
+	// The packs recorded by earlier runs are only removed at the end, after
+	// the snapshots have been checked for references to them: backups which
+	// ran concurrently with an earlier prune may have used their blobs.
+	removal := &pendingRemoval{}
+	var waiting []*restic.PendingDeletion
+	removal.due, waiting, err = loadPendingDeletions(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	pendingPacks := restic.PendingPacks(append(waiting, removal.due...))
+
+	if len(waiting) > 0 {
+		Verbosef("%d packs recorded by earlier runs are waiting for removal\n", len(restic.PendingPacks(waiting)))
+	}
+	if len(removal.due) > 0 && opts.DryRun {
+		Printf("would remove %d packs recorded by earlier runs\n", len(restic.PendingPacks(removal.due)))
+	}
+
+	if !concurrent && !opts.DryRun {
+		state, packs, err := openPruneState(ctx, gopts, repo)
+		if err != nil {
+			return nil, err
+		}
+
+		if state != nil {
+			return nil, resumePrune(ctx, opts, gopts, repo, progress, state, packs)
+		}
 	}
 
 	var stats struct {
@@ -96,150 +229,628 @@ func pruneRepository(gopts GlobalOptions, repo restic.Repository) error {
 
 	Verbosef("building new index for repo\n")
 
-	bar := newProgressMax(!gopts.Quiet, uint64(stats.packs), "packs")
-	idx, err := index.New(ctx, repo, bar)
+	bar := progress.Phase(prunePhaseIndex, uint64(stats.packs), "packs")
+	packs, err := index.ListPacks(ctx, repo, bar)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer func() {
+		if err := packs.Close(); err != nil {
+			Warnf("unable to remove temporary file: %v\n", err)
+		}
+	}()
+
+	if err = removal.prepare(repo, packs, pendingPacks, concurrent); err != nil {
+		return nil, err
+	}
+
+	// packs which wait for removal are not used any more
+	for id := range pendingPacks {
+		if packs.Has(id) {
+			if err = packs.RemovePack(id); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	blobs := 0
-	for _, pack := range idx.Packs {
-		stats.bytes += pack.Size
-		blobs += len(pack.Entries)
+	for id := range packs.IDs() {
+		stats.bytes += packs.Size(id)
 	}
+	stats.blobs = packs.Blobs()
 	Verbosef("repository contains %v packs (%v blobs) with %v bytes\n",
-		len(idx.Packs), blobs, formatBytes(uint64(stats.bytes)))
+		packs.Len(), stats.blobs, formatBytes(uint64(stats.bytes)))
+
+	// find duplicate blobs
+	dups, err := packs.DuplicateBlobs()
+	if err != nil {
+		return nil, err
+	}
 
-	blobCount := make(map[restic.BlobHandle]int)
 	duplicateBlobs := 0
-	duplicateBytes := 0
+	for _, n := range dups {
+		duplicateBlobs += n - 1
+	}
 
-	// find duplicate blobs
-	for _, p := range idx.Packs {
-		for _, entry := range p.Entries {
-			stats.blobs++
-			h := restic.BlobHandle{ID: entry.ID, Type: entry.Type}
-			blobCount[h]++
-
-			if blobCount[h] > 1 {
-				duplicateBlobs++
-				duplicateBytes += int(entry.Length)
-			}
-		}
+	duplicateBytes, err := duplicateSize(packs, dups)
+	if err != nil {
+		return nil, err
 	}
 
 	Verbosef("processed %d blobs: %d duplicate blobs, %v duplicate\n",
 		stats.blobs, duplicateBlobs, formatBytes(uint64(duplicateBytes)))
+
+	err = progress.repository(pruneJSONRepository{
+		Packs:          packs.Len(),
+		Blobs:          stats.blobs,
+		Bytes:          uint64(stats.bytes),
+		DuplicateBlobs: duplicateBlobs,
+		DuplicateBytes: uint64(duplicateBytes),
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	Verbosef("load all snapshots\n")
 
 	// find referenced blobs
 	snapshots, err := restic.LoadAllSnapshots(ctx, repo)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	removal.snapshots = restic.NewIDSet()
+	for _, sn := range snapshots {
+		removal.snapshots.Insert(*sn.ID())
+	}
+
+	// the data of snapshots in the trash is kept until they have expired
+	trashed, err := processTrash(ctx, repo, opts.DryRun)
+	if err != nil {
+		return nil, err
 	}
+	snapshots = append(snapshots, trashed...)
 
 	stats.snapshots = len(snapshots)
 
 	Verbosef("find data that is still in use for %d snapshots\n", stats.snapshots)
 
-	usedBlobs := restic.NewBlobSet()
-	seenBlobs := restic.NewBlobSet()
+	usedBlobs, err := findUsedBlobs(ctx, gopts, repo, snapshots, progress)
+	if err != nil {
+		return nil, err
+	}
 
-	bar = newProgressMax(!gopts.Quiet, uint64(len(snapshots)), "snapshots")
-	bar.Start()
-	for _, sn := range snapshots {
-		debug.Log("process snapshot %v", sn.ID().Str())
+	removal.used = usedBlobs
 
-		err = restic.FindUsedBlobs(ctx, repo, *sn.Tree, usedBlobs, seenBlobs)
-		if err != nil {
-			return err
-		}
+	Verbosef("found %d of %d data blobs still in use, removing %d blobs\n",
+		len(usedBlobs), stats.blobs, stats.blobs-len(usedBlobs))
+	progress.summary.Snapshots, progress.summary.UsedBlobs = stats.snapshots, len(usedBlobs)
 
-		debug.Log("found %v blobs for snapshot %v", sn.ID().Str())
-		bar.Report(restic.Stat{Blobs: 1})
+	// of duplicate blobs, only the copy in the pack which is used best is
+	// kept
+	usage, err := newBlobUsage(packs, usedBlobs, dups)
+	if err != nil {
+		return nil, err
 	}
-	bar.Done()
 
-	Verbosef("found %d of %d data blobs still in use, removing %d blobs\n",
-		len(usedBlobs), stats.blobs, stats.blobs-len(usedBlobs))
+	removeBytes := 0
 
-	// find packs that need a rewrite
+	// find packs that are unneeded and packs that need a rewrite
+	removePacks := restic.NewIDSet()
 	rewritePacks := restic.NewIDSet()
-	for _, pack := range idx.Packs {
-		for _, blob := range pack.Entries {
-			h := restic.BlobHandle{ID: blob.ID, Type: blob.Type}
-			if !usedBlobs.Has(h) {
-				rewritePacks.Insert(pack.ID)
-				continue
+	err = packs.Each(func(p index.Pack) error {
+		var used, total uint64
+		for _, blob := range p.Entries {
+			total += uint64(blob.Length)
+			if usage.live(p.ID, blob) {
+				used += uint64(blob.Length)
 			}
+		}
 
-			if blobCount[h] > 1 {
-				rewritePacks.Insert(pack.ID)
-			}
+		removeBytes += int(total - used)
+
+		switch {
+		case used == 0:
+			removePacks.Insert(p.ID)
+		case used == total:
+		case opts.RepackBelow > 0 && used*100 >= total*uint64(opts.RepackBelow):
+			// packs which are used well enough are kept even if they contain
+			// unused or duplicate blobs
+			removeBytes -= int(total - used)
+		default:
+			rewritePacks.Insert(p.ID)
 		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	removeBytes := duplicateBytes
+	if maxUnused != nil {
+		kept, err := limitRepack(packs, rewritePacks, usage, maxUnused.limit(uint64(stats.bytes)))
+		if err != nil {
+			return nil, err
+		}
+		removeBytes -= int(kept)
+		Verbosef("keeping %s of unused data in packs which are not rewritten\n", formatBytes(kept))
+	}
 
-	// find packs that are unneeded
-	removePacks := restic.NewIDSet()
-	for packID, p := range idx.Packs {
+	if opts.MaxRepackSize != "" {
+		kept, err := limitRepackSize(packs, rewritePacks, usage, maxRepackSize)
+		if err != nil {
+			return nil, err
+		}
+		removeBytes -= int(kept)
+		if kept > 0 {
+			Verbosef("--max-repack-size reached, %s of unused data is left for the next run\n", formatBytes(kept))
+		}
+	}
 
-		hasActiveBlob := false
-		for _, blob := range p.Entries {
-			h := restic.BlobHandle{ID: blob.ID, Type: blob.Type}
-			if usedBlobs.Has(h) {
-				hasActiveBlob = true
-				continue
-			}
+	// small packs, e.g. from interrupted backups, are combined into full-size
+	// packs, unless only as many packs as necessary are to be rewritten
+	smallPacks := restic.NewIDSet()
+	if maxUnused == nil {
+		smallPacks = findSmallPacks(packs, removePacks, rewritePacks)
+	}
+	if opts.MaxRepackSize != "" {
+		size, err := blobsSize(packs, rewritePacks)
+		if err != nil {
+			return nil, err
+		}
 
-			removeBytes += int(blob.Length)
+		var budget uint64
+		if size < maxRepackSize {
+			budget = maxRepackSize - size
 		}
 
-		if hasActiveBlob {
-			continue
+		if _, err = limitRepackSize(packs, smallPacks, usage, budget); err != nil {
+			return nil, err
+		}
+	}
+	if len(smallPacks) > 0 {
+		Verbosef("found %d small packs which will be combined\n", len(smallPacks))
+	}
+
+	err = progress.plan(pruneJSONPlan{
+		DeletePacks:  len(removePacks),
+		DeleteBytes:  packsSize(packs, removePacks),
+		RewritePacks: len(rewritePacks),
+		RewriteBytes: packsSize(packs, rewritePacks),
+		CombinePacks: len(smallPacks),
+		CombineBytes: packsSize(packs, smallPacks),
+		FreedBytes:   uint64(removeBytes),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.DryRun {
+		progress.summary.DryRun = true
+		if gopts.JSON {
+			return nil, progress.finish()
 		}
 
-		removePacks.Insert(packID)
+		printPruneDryRun(packs, removePacks, rewritePacks, smallPacks, uint64(stats.bytes), uint64(removeBytes))
+		return nil, nil
+	}
+
+	rewritePacks.Merge(smallPacks)
 
-		if !rewritePacks.Has(packID) {
-			return errors.Fatalf("pack %v is unneeded, but not contained in rewritePacks", packID.Str())
+	// a concurrent prune cannot be resumed, the packs it rewrites are
+	// removed by a later run anyway
+	var state *pruneState
+	if !concurrent {
+		state = newPruneState(pruneStateFilename(gopts, repo), snapshots, removePacks, rewritePacks, removeBytes)
+		if err = state.save(); err != nil {
+			return nil, err
 		}
+	}
 
-		rewritePacks.Delete(packID)
+	keepBlobs := usage.repackBlobs(rewritePacks)
+	if err = executePrune(ctx, opts, gopts, repo, progress, state, removePacks, rewritePacks, keepBlobs, removeBytes); err != nil {
+		return nil, err
 	}
 
+	if concurrent {
+		return removal, nil
+	}
+
+	// the repository is locked exclusively already
+	return nil, removal.remove(ctx, opts, gopts, repo)
+}
+
+// executePrune removes and rewrites the packs. When state is not nil, the
+// progress is recorded in it and it is removed at the end.
+func executePrune(ctx context.Context, opts PruneOptions, gopts GlobalOptions, repo *repository.Repository, progress *pruneProgress,
+	state *pruneState, removePacks, rewritePacks restic.IDSet, usedBlobs restic.BlobSet, removeBytes int) error {
+
 	Verbosef("will delete %d packs and rewrite %d packs, this frees %s\n",
 		len(removePacks), len(rewritePacks), formatBytes(uint64(removeBytes)))
 
+	gopts.metrics.Set("prune_packs_deleted", "Number of unneeded packs deleted by prune.", float64(len(removePacks)))
+	gopts.metrics.Set("prune_packs_rewritten", "Number of packs rewritten by prune.", float64(len(rewritePacks)))
+	gopts.metrics.Set("prune_freed_bytes", "Number of bytes freed by prune.", float64(removeBytes))
+
+	if len(rewritePacks) == 0 {
+		progress.Skip(prunePhaseRepack)
+	}
+	if len(removePacks)+len(rewritePacks) == 0 || opts.DeleteDelay > 0 {
+		progress.Skip(prunePhaseDelete)
+	}
+
+	var checkpoint func(restic.IDs) error
+	if state != nil {
+		checkpoint = func(done restic.IDs) error {
+			// the new packs must be found in the index when the prune
+			// is resumed
+			if err := repo.SaveIndex(ctx); err != nil {
+				return err
+			}
+			return state.checkpoint(done)
+		}
+	}
+
+	var (
+		bar    *restic.Progress
+		intent *restic.Intent
+		err    error
+	)
+
 	if len(rewritePacks) != 0 {
-		bar = newProgressMax(!gopts.Quiet, uint64(len(rewritePacks)), "packs rewritten")
+		bar = progress.Phase(prunePhaseRepack, uint64(len(rewritePacks)), "packs rewritten")
 		bar.Start()
-		err = repository.Repack(ctx, repo, rewritePacks, usedBlobs, bar)
+		err = repository.RepackBlobsCheckpoint(ctx, repo, rewritePacks, usedBlobs, bar, pruneCheckpointPacks, checkpoint)
 		if err != nil {
 			return err
 		}
 		bar.Done()
 	}
 
-	if len(removePacks) != 0 {
-		bar = newProgressMax(!gopts.Quiet, uint64(len(removePacks)), "packs deleted")
+	// packs which have been rewritten are not needed any more
+	for id := range rewritePacks {
+		removePacks.Insert(id)
+	}
+
+	if len(removePacks) != 0 && opts.DeleteDelay > 0 {
+		// Only remove the packs after the index has been replaced and the
+		// delay has passed, so that clients never load an index which
+		// references removed packs.
+		d := restic.NewPendingDeletion(removePacks.List(), opts.DeleteDelay)
+		id, err := restic.SavePendingDeletion(ctx, repo, d)
+		if err != nil {
+			return err
+		}
+		Verbosef("recorded %d packs for removal after %v as %v\n", len(removePacks), opts.DeleteDelay, id.Str())
+	} else if len(removePacks) != 0 {
+		intent, err = savePruneIntent(ctx, repo, removePacks)
+		if err != nil {
+			return err
+		}
+
+		bar = progress.Phase(prunePhaseDelete, uint64(len(removePacks)), "packs deleted")
+		err = removePackFiles(ctx, opts, repo, removePacks, bar)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rebuildIndexProgress(ctx, repo, func(packs uint64) *restic.Progress {
+		return progress.Phase(prunePhaseRebuildIndex, packs, "packs")
+	})
+	if err != nil {
+		return err
+	}
+
+	if intent != nil {
+		if err = intent.Remove(ctx, repo); err != nil {
+			return err
+		}
+	}
+
+	if state != nil {
+		if err := state.remove(); err != nil {
+			Warnf("unable to remove prune state: %v\n", err)
+		}
+	}
+
+	Verbosef("done\n")
+	return progress.finish()
+}
+
+// smallPackSize is the size below which packs are combined by prune.
+const smallPackSize = repository.MinPackSize / 2
+
+// findSmallPacks returns the packs which are much smaller than a full pack and
+// are neither removed nor rewritten anyway. Combining a single small pack is
+// pointless, so nothing is returned unless its blobs can be merged with
+// others.
+func findSmallPacks(packs *index.PackList, removePacks, rewritePacks restic.IDSet) restic.IDSet {
+	small := restic.NewIDSet()
+	for id := range packs.IDs() {
+		if packs.Size(id) >= smallPackSize || removePacks.Has(id) || rewritePacks.Has(id) {
+			continue
+		}
+
+		small.Insert(id)
+	}
+
+	if len(small) == 1 && len(rewritePacks) == 0 {
+		return restic.NewIDSet()
+	}
+
+	return small
+}
+
+// packsSize returns the total size of the packs in ids.
+func packsSize(packs *index.PackList, ids restic.IDSet) (size uint64) {
+	for id := range ids {
+		size += uint64(packs.Size(id))
+	}
+	return size
+}
+
+// duplicateSize returns the size of the copies of duplicate blobs which are
+// not needed. The first copy of each blob is not counted.
+func duplicateSize(packs *index.PackList, dups map[index.DomainBlob]int) (size int, err error) {
+	if len(dups) == 0 {
+		return 0, nil
+	}
+
+	seen := make(map[index.DomainBlob]struct{}, len(dups))
+	err = packs.Each(func(p index.Pack) error {
+		for _, blob := range p.Entries {
+			h := index.DomainBlob{BlobHandle: restic.BlobHandle{ID: blob.ID, Type: blob.Type}, Domain: blob.Domain}
+			if _, ok := dups[h]; !ok {
+				continue
+			}
+
+			if _, ok := seen[h]; ok {
+				size += int(blob.Length)
+				continue
+			}
+			seen[h] = struct{}{}
+		}
+		return nil
+	})
+
+	return size, err
+}
+
+// printPruneDryRun prints the packs which prune would delete, rewrite and
+// combine.
+func printPruneDryRun(packs *index.PackList, removePacks, rewritePacks, smallPacks restic.IDSet, totalBytes, removeBytes uint64) {
+	Printf("would delete %d unneeded packs (%s)\n", len(removePacks), formatBytes(packsSize(packs, removePacks)))
+	Printf("would rewrite %d packs (%s) which contain unused or duplicate data\n", len(rewritePacks), formatBytes(packsSize(packs, rewritePacks)))
+	if len(smallPacks) > 0 {
+		Printf("would combine %d small packs (%s)\n", len(smallPacks), formatBytes(packsSize(packs, smallPacks)))
+	}
+	Printf("this would free %s, the repository would contain %s afterwards\n",
+		formatBytes(removeBytes), formatBytes(totalBytes-removeBytes))
+}
+
+// findUsedBlobs returns the blobs referenced by the snapshots. When a cache
+// directory is configured, the counts of the references are kept there, so
+// that only the trees of snapshots which have been added or removed since the
+// last run need to be traversed.
+func findUsedBlobs(ctx context.Context, gopts GlobalOptions, repo *repository.Repository, snapshots restic.Snapshots, progress *pruneProgress) (restic.BlobSet, error) {
+	if gopts.CacheDir == "" {
+		usedBlobs := restic.NewBlobSet()
+		seenBlobs := restic.NewBlobSet()
+
+		bar := progress.Phase(prunePhaseSnapshots, uint64(len(snapshots)), "snapshots")
 		bar.Start()
-		for packID := range removePacks {
-			h := restic.Handle{Type: restic.DataFile, Name: packID.String()}
-			err = repo.Backend().Remove(ctx, h)
+		for _, sn := range snapshots {
+			debug.Log("process snapshot %v", sn.ID().Str())
+
+			err := restic.FindUsedBlobs(ctx, repo, *sn.Tree, usedBlobs, seenBlobs)
 			if err != nil {
-				Warnf("unable to remove file %v from the repository\n", packID.Str())
+				return nil, err
 			}
+
+			debug.Log("found %v blobs for snapshot %v", sn.ID().Str())
 			bar.Report(restic.Stat{Blobs: 1})
 		}
 		bar.Done()
+
+		return usedBlobs, nil
 	}
 
-	if err = rebuildIndex(ctx, repo); err != nil {
-		return err
+	filename := filepath.Join(gopts.CacheDir, repo.Config().ID, "blob-refs")
+	refs := loadBlobRefs(filename)
+	cached := len(refs.Snapshots()) > 0
+
+	err := updateBlobRefs(ctx, repo, refs, snapshots, progress)
+	if err != nil && !cached {
+		return nil, err
+	}
+
+	if err != nil {
+		// trees of removed snapshots may have been pruned by another client
+		debug.Log("updating blob refs failed: %v", err)
+		Verbosef("unable to update the cached blob references, rebuilding them\n")
+
+		refs = restic.NewBlobRefs()
+		if err = updateBlobRefs(ctx, repo, refs, snapshots, progress); err != nil {
+			return nil, err
+		}
+	}
+
+	buf, err := refs.MarshalBinary()
+	if err == nil {
+		err = replaceFile(filename, buf)
+	}
+	if err != nil {
+		Warnf("unable to save the blob references: %v\n", err)
+	}
+
+	return refs.Used(), nil
+}
+
+// loadBlobRefs loads the blob references saved by an earlier run from
+// filename. If that fails, an empty BlobRefs is returned.
+func loadBlobRefs(filename string) *restic.BlobRefs {
+	refs := restic.NewBlobRefs()
+
+	buf, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = refs.UnmarshalBinary(buf)
+	}
+	if err != nil {
+		debug.Log("unable to load blob refs from %v: %v", filename, err)
+		return restic.NewBlobRefs()
+	}
+
+	return refs
+}
+
+// updateBlobRefs adds the snapshots which are not in refs yet and removes the
+// ones which do not exist any more.
+func updateBlobRefs(ctx context.Context, repo restic.Repository, refs *restic.BlobRefs, snapshots restic.Snapshots, progress *pruneProgress) error {
+	known := refs.Snapshots()
+	current := restic.NewIDSet()
+
+	var added restic.Snapshots
+	for _, sn := range snapshots {
+		id := *sn.ID()
+		if !known.Has(id) && !current.Has(id) {
+			added = append(added, sn)
+		}
+		current.Insert(id)
+	}
+	removed := known.Sub(current)
+
+	Verbosef("updating blob references: %d snapshots added, %d removed\n", len(added), len(removed))
+
+	bar := progress.Phase(prunePhaseSnapshots, uint64(len(added)+len(removed)), "snapshots")
+	bar.Start()
+	defer bar.Done()
+
+	// adding first means shared trees are not traversed twice
+	for _, sn := range added {
+		debug.Log("add snapshot %v", sn.ID().Str())
+		if err := refs.AddSnapshot(ctx, repo, *sn.ID(), *sn.Tree); err != nil {
+			return err
+		}
+		bar.Report(restic.Stat{Blobs: 1})
+	}
+
+	for id := range removed {
+		debug.Log("remove snapshot %v", id.Str())
+		if err := refs.RemoveSnapshot(ctx, repo, id); err != nil {
+			return err
+		}
+		bar.Report(restic.Stat{Blobs: 1})
 	}
 
-	Verbosef("done\n")
 	return nil
 }
+
+// savePruneIntent records that prune is about to remove packs, so that an
+// interruption while the packs are removed and the index is rebuilt does not
+// leave an index which references packs that are gone.
+func savePruneIntent(ctx context.Context, repo *repository.Repository, packs restic.IDSet) (*restic.Intent, error) {
+	// blobs copied to new packs must be found in the index files which
+	// replace the current ones when the prune is completed later
+	if err := repo.SaveIndex(ctx); err != nil {
+		return nil, err
+	}
+
+	var indexes restic.IDs
+	for id := range repo.List(ctx, restic.IndexFile) {
+		indexes = append(indexes, id)
+	}
+
+	intent := restic.NewIntent("prune", packs.List(), indexes)
+	id, err := restic.SaveIntent(ctx, repo, intent)
+	if err != nil {
+		return nil, err
+	}
+
+	debug.Log("saved intent %v to remove %d packs", id.Str(), len(packs))
+	return intent, nil
+}
+
+// removePackFiles removes the packs from the backend and reports the progress
+// to bar. Errors for individual files are printed as warnings.
+func removePackFiles(ctx context.Context, opts PruneOptions, repo restic.Repository, packs restic.IDSet, bar *restic.Progress) error {
+	bar.Start()
+	defer bar.Done()
+
+	handles := make([]restic.Handle, 0, len(packs))
+	for packID := range packs {
+		handles = append(handles, restic.Handle{Type: restic.DataFile, Name: packID.String()})
+	}
+
+	return backend.RemoveBatched(ctx, repo.Backend(), handles, opts.DeleteBatchSize, opts.MaxDeleteRate,
+		func(hs []restic.Handle, err error) {
+			if err != nil {
+				if len(hs) == 1 {
+					Warnf("unable to remove file %v from the repository\n", hs[0].Name[:8])
+				} else {
+					Warnf("unable to remove %d files from the repository: %v\n", len(hs), err)
+				}
+			}
+			bar.Report(restic.Stat{Blobs: uint64(len(hs))})
+		})
+}
+
+// loadPendingDeletions loads the pending deletions from the repo and splits
+// them into the ones for which the delay has passed and the ones which are
+// still waiting. The delay is the one of the run which recorded them.
+func loadPendingDeletions(ctx context.Context, repo restic.Repository) (due, waiting []*restic.PendingDeletion, err error) {
+	list, err := restic.LoadAllPendingDeletions(ctx, repo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	for _, d := range list {
+		if d.Due(now) {
+			due = append(due, d)
+		} else {
+			waiting = append(waiting, d)
+		}
+	}
+
+	return due, waiting, nil
+}
+
+// processTrash removes the snapshots from the trash which have expired and
+// returns the others. In a dry run, expired snapshots are only counted.
+func processTrash(ctx context.Context, repo restic.Repository, dryRun bool) (restic.Snapshots, error) {
+	list, err := restic.LoadAllTrashedSnapshots(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots restic.Snapshots
+	expired := 0
+	now := time.Now()
+	for _, t := range list {
+		if !t.Expired(now) {
+			snapshots = append(snapshots, t.Snapshot)
+			continue
+		}
+
+		expired++
+		if dryRun {
+			continue
+		}
+
+		if err = t.Purge(ctx, repo); err != nil {
+			return nil, err
+		}
+	}
+
+	if expired > 0 && dryRun {
+		Printf("would remove %d expired snapshots from the trash\n", expired)
+	} else if expired > 0 {
+		Verbosef("removed %d expired snapshots from the trash\n", expired)
+	}
+
+	if len(snapshots) > 0 {
+		Verbosef("keeping the data of %d snapshots in the trash\n", len(snapshots))
+	}
+
+	return snapshots, nil
+}
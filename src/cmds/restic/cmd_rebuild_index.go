@@ -4,6 +4,7 @@ import (
 	"context"
 	"restic"
 	"restic/index"
+	"restic/repository"
 
 	"github.com/spf13/cobra"
 )
@@ -13,7 +14,8 @@ var cmdRebuildIndex = &cobra.Command{
 	Short: "build a new index file",
 	Long: `
 The "rebuild-index" command creates a new index based on the pack files in the
-repository.
+repository. When a cache directory is used, the local manifest of the
+snapshots is rebuilt as well.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return runRebuildIndex(globalOptions)
@@ -38,10 +40,51 @@ func runRebuildIndex(gopts GlobalOptions) error {
 
 	ctx, cancel := context.WithCancel(gopts.ctx)
 	defer cancel()
-	return rebuildIndex(ctx, repo)
+
+	if err = rebuildIndex(ctx, repo); err != nil {
+		return err
+	}
+
+	return rebuildSnapshotManifest(ctx, repo)
+}
+
+// rebuildSnapshotManifest loads all snapshots from the repository again to
+// rebuild the local snapshot manifest, if one is used.
+func rebuildSnapshotManifest(ctx context.Context, repo *repository.Repository) error {
+	m := repo.SnapshotManifest()
+	if m == nil {
+		return nil
+	}
+
+	Verbosef("rebuilding the snapshot manifest\n")
+
+	m.Reset()
+	if _, err := restic.LoadAllSnapshots(ctx, repo); err != nil {
+		return err
+	}
+
+	Verbosef("snapshot manifest contains %d snapshots\n", m.Len())
+	return m.Write()
 }
 
 func rebuildIndex(ctx context.Context, repo restic.Repository) error {
+	return rebuildIndexProgress(ctx, repo, func(packs uint64) *restic.Progress {
+		return newProgressMax(!globalOptions.Quiet, packs, "packs")
+	})
+}
+
+// rebuildIndexProgress rebuilds the index like rebuildIndex, newBar is called
+// with the number of packs in the repository to create the progress.
+func rebuildIndexProgress(ctx context.Context, repo restic.Repository, newBar func(packs uint64) *restic.Progress) error {
+	// The old index files are listed before the packs, so that index files
+	// saved by a concurrent backup after the packs have been listed are kept.
+	Verbosef("finding old index files\n")
+
+	var supersedes restic.IDs
+	for id := range repo.List(ctx, restic.IndexFile) {
+		supersedes = append(supersedes, id)
+	}
+
 	Verbosef("counting files in repo\n")
 
 	var packs uint64
@@ -49,17 +92,23 @@ func rebuildIndex(ctx context.Context, repo restic.Repository) error {
 		packs++
 	}
 
-	bar := newProgressMax(!globalOptions.Quiet, packs, "packs")
-	idx, err := index.New(ctx, repo, bar)
+	idx, err := index.New(ctx, repo, newBar(packs))
 	if err != nil {
 		return err
 	}
 
-	Verbosef("finding old index files\n")
+	// packs recorded for removal by prune must not be referenced any more
+	pending, err := restic.LoadAllPendingDeletions(ctx, repo)
+	if err != nil {
+		return err
+	}
 
-	var supersedes restic.IDs
-	for id := range repo.List(ctx, restic.IndexFile) {
-		supersedes = append(supersedes, id)
+	for id := range restic.PendingPacks(pending) {
+		if _, ok := idx.Packs[id]; ok {
+			if err = idx.RemovePack(id); err != nil {
+				return err
+			}
+		}
 	}
 
 	id, err := idx.Save(ctx, repo, supersedes)
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
 	"restic"
 	"restic/debug"
 	"restic/errors"
 	"restic/filter"
+	"restic/fs"
+	"sort"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -18,6 +24,24 @@ a directory.
 
 The special snapshot "latest" can be used to restore the latest snapshot in the
 repository.
+
+While restoring, restic records the files which have been restored completely
+in a journal (in the target directory or in --journal-dir). When an interrupted
+restore is started again with --resume, these files are skipped. The journal is
+removed after the restore finished without errors.
+
+Before any data is downloaded, the restore is planned: the packs which contain
+the data are sorted by ID and the blobs needed from each pack are combined into
+few large requests. With --plan-only, the plan is printed (including the number
+of requests and the amount of data to download) and nothing is restored.
+
+Files which contained holes when they were saved are restored as sparse files,
+blocks of zeros are not written. With --sparse, this is done for all files.
+
+With --portable, metadata which is specific to a platform or file system (the
+owner, extended attributes, ACLs and inode flags) is skipped when it cannot be
+restored, e.g. when restoring to another operating system or to FAT. Instead of
+an error for each file, the number of files is reported for each category.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return runRestore(restoreOptions, globalOptions, args)
@@ -32,6 +56,19 @@ type RestoreOptions struct {
 	Host    string
 	Paths   []string
 	Tags    []string
+
+	MapSymlink []string
+	NoXattrs   bool
+
+	Preallocate bool
+	DirectIO    bool
+	Sparse      bool
+
+	Resume     bool
+	JournalDir string
+
+	PlanOnly bool
+	Portable bool
 }
 
 var restoreOptions RestoreOptions
@@ -40,9 +77,18 @@ func init() {
 	cmdRoot.AddCommand(cmdRestore)
 
 	flags := cmdRestore.Flags()
-	flags.StringSliceVarP(&restoreOptions.Exclude, "exclude", "e", nil, "exclude a `pattern` (can be specified multiple times)")
-	flags.StringSliceVarP(&restoreOptions.Include, "include", "i", nil, "include a `pattern`, exclude everything else (can be specified multiple times)")
+	flags.StringArrayVarP(&restoreOptions.Exclude, "exclude", "e", nil, "exclude a `pattern`, commas outside of braces separate several patterns (can be specified multiple times)")
+	flags.StringArrayVarP(&restoreOptions.Include, "include", "i", nil, "include a `pattern`, exclude everything else; commas outside of braces separate several patterns (can be specified multiple times)")
 	flags.StringVarP(&restoreOptions.Target, "target", "t", "", "directory to extract data to")
+	flags.StringSliceVar(&restoreOptions.MapSymlink, "map-symlink", nil, "rewrite absolute symlink targets starting with `old:new` prefix (can be specified multiple times)")
+	flags.BoolVar(&restoreOptions.NoXattrs, "no-xattrs", false, "do not restore extended attributes")
+	flags.BoolVar(&restoreOptions.Preallocate, "preallocate", false, "reserve the space for each file before writing its contents")
+	flags.BoolVar(&restoreOptions.Sparse, "sparse", false, "restore all files as sparse files, blocks of zeros are not written")
+	flags.BoolVar(&restoreOptions.DirectIO, "direct-io", false, "write file contents in large batches, bypassing the page cache where supported")
+	flags.BoolVar(&restoreOptions.Resume, "resume", false, "continue an interrupted restore, skip files which have already been restored")
+	flags.StringVar(&restoreOptions.JournalDir, "journal-dir", "", "store the restore journal in `dir` instead of the target directory")
+	flags.BoolVar(&restoreOptions.PlanOnly, "plan-only", false, "only print the plan for downloading the data, do not restore anything")
+	flags.BoolVar(&restoreOptions.Portable, "portable", false, "skip metadata specific to the platform or file system which cannot be restored and only report it per category")
 
 	flags.StringVarP(&restoreOptions.Host, "host", "H", "", `only consider snapshots for this host when the snapshot ID is "latest"`)
 	flags.StringSliceVar(&restoreOptions.Tags, "tag", nil, "only consider snapshots which include this `tag` for snapshot ID \"latest\"")
@@ -60,10 +106,36 @@ func runRestore(opts RestoreOptions, gopts GlobalOptions, args []string) error {
 		return errors.Fatal("please specify a directory to restore to (--target)")
 	}
 
+	opts.Exclude = splitPatternOptions(opts.Exclude)
+	opts.Include = splitPatternOptions(opts.Include)
+
 	if len(opts.Exclude) > 0 && len(opts.Include) > 0 {
 		return errors.Fatal("exclude and include patterns are mutually exclusive")
 	}
 
+	if opts.PlanOnly && opts.DirectIO {
+		return errors.Fatal("--plan-only cannot be combined with --direct-io, which loads the data file by file")
+	}
+
+	if opts.Sparse && opts.DirectIO {
+		return errors.Fatal("--sparse cannot be combined with --direct-io, which writes files sequentially")
+	}
+
+	excludes, err := parsePatterns("exclude", opts.Exclude)
+	if err != nil {
+		return err
+	}
+
+	includes, err := parsePatterns("include", opts.Include)
+	if err != nil {
+		return err
+	}
+
+	symlinkMappings, err := parseSymlinkMappings(opts.MapSymlink)
+	if err != nil {
+		return err
+	}
+
 	snapshotIDString := args[0]
 
 	debug.Log("restore %v to %v", snapshotIDString, opts.Target)
@@ -105,15 +177,22 @@ func runRestore(opts RestoreOptions, gopts GlobalOptions, args []string) error {
 		Exitf(2, "creating restorer failed: %v\n", err)
 	}
 
-	totalErrors := 0
+	var failed []restoreError
+	skipped := make(skippedMetadata)
 	res.Error = func(dir string, node *restic.Node, err error) error {
+		if opts.Portable {
+			if err = skipped.skip(err); err == nil {
+				return nil
+			}
+		}
+
 		Warnf("ignoring error for %s: %s\n", dir, err)
-		totalErrors++
+		failed = append(failed, restoreError{Path: dir, Err: err})
 		return nil
 	}
 
 	selectExcludeFilter := func(item string, dstpath string, node *restic.Node) bool {
-		matched, err := filter.List(opts.Exclude, item)
+		matched, err := filter.ListPatterns(excludes, item)
 		if err != nil {
 			Warnf("error for exclude pattern: %v", err)
 		}
@@ -122,7 +201,7 @@ func runRestore(opts RestoreOptions, gopts GlobalOptions, args []string) error {
 	}
 
 	selectIncludeFilter := func(item string, dstpath string, node *restic.Node) bool {
-		matched, err := filter.List(opts.Include, item)
+		matched, err := filter.ListPatterns(includes, item)
 		if err != nil {
 			Warnf("error for include pattern: %v", err)
 		}
@@ -130,17 +209,307 @@ func runRestore(opts RestoreOptions, gopts GlobalOptions, args []string) error {
 		return matched
 	}
 
+	if len(symlinkMappings) > 0 {
+		res.MapSymlink = symlinkMappings.Map
+	}
+
+	res.SkipExtendedAttributes = opts.NoXattrs
+	res.FileWrite = restic.FileWriteOptions{
+		Preallocate: opts.Preallocate,
+		DirectIO:    opts.DirectIO,
+		Sparse:      opts.Sparse,
+	}
+
 	if len(opts.Exclude) > 0 {
 		res.SelectFilter = selectExcludeFilter
 	} else if len(opts.Include) > 0 {
 		res.SelectFilter = selectIncludeFilter
 	}
 
+	if opts.PlanOnly {
+		// the journal is only used to skip files restored before, it must
+		// not be removed here
+		if opts.Resume {
+			journal, err := openRestoreJournal(opts, id)
+			if err != nil {
+				return err
+			}
+			defer journal.Close()
+			res.Journal = journal
+		}
+
+		plan, err := res.Plan(ctx, opts.Target)
+		if err != nil {
+			return err
+		}
+
+		return printRestorePlan(gopts, res.Snapshot(), opts.Target, plan)
+	}
+
+	journal, err := openRestoreJournal(opts, id)
+	if err != nil {
+		return err
+	}
+	res.Journal = journal
+
+	if journal.Len() > 0 {
+		Verbosef("resuming restore, skipping %d files restored before\n", journal.Len())
+	}
+
 	Verbosef("restoring %s to %s\n", res.Snapshot(), opts.Target)
 
 	err = res.RestoreTo(ctx, opts.Target)
-	if totalErrors > 0 {
-		Printf("There were %d errors\n", totalErrors)
+	if err != nil {
+		_ = journal.Close()
+		return err
+	}
+
+	skipped.print()
+
+	if len(failed) > 0 {
+		if err = journal.Close(); err != nil {
+			Warnf("unable to close restore journal: %v\n", err)
+		}
+
+		Warnf("There were %d errors:\n", len(failed))
+		for _, e := range failed {
+			Warnf("  %s: %v\n", e.Path, e.Err)
+		}
+		return errPartialRestore{errors: len(failed)}
+	}
+
+	if err = journal.Remove(); err != nil {
+		Warnf("unable to remove restore journal: %v\n", err)
+	}
+
+	return nil
+}
+
+// restorePlanSummary is the JSON representation of a restore plan.
+type restorePlanSummary struct {
+	Snapshot  restic.ID           `json:"snapshot"`
+	Target    string              `json:"target"`
+	Files     int                 `json:"files"`
+	FileBytes uint64              `json:"file_bytes"`
+	Clones    int                 `json:"clones"`
+	Packs     int                 `json:"packs"`
+	Requests  int                 `json:"requests"`
+	Bytes     uint64              `json:"bytes"`
+	BlobBytes uint64              `json:"blob_bytes"`
+	Missing   restic.IDs          `json:"missing,omitempty"`
+	Ranges    []restic.PackRanges `json:"ranges"`
+}
+
+// printRestorePlan prints the number of requests and the amount of data the
+// restore of sn to target downloads.
+func printRestorePlan(gopts GlobalOptions, sn *restic.Snapshot, target string, plan *restic.RestorePlan) error {
+	if gopts.JSON {
+		summary := restorePlanSummary{
+			Snapshot:  *sn.ID(),
+			Target:    target,
+			Files:     plan.Files,
+			FileBytes: plan.FileBytes,
+			Clones:    plan.Clones,
+			Packs:     len(plan.Packs),
+			Requests:  plan.Requests(),
+			Bytes:     plan.Bytes(),
+			BlobBytes: plan.BlobBytes(),
+			Missing:   plan.Missing,
+			Ranges:    plan.Packs,
+		}
+
+		if gopts.JSONSchema > 0 {
+			return printJSONEvent(gopts, "restore_plan", summary)
+		}
+		return json.NewEncoder(gopts.stdout).Encode(summary)
+	}
+
+	Printf("plan for restoring snapshot %s to %s:\n", sn.ID().Str(), target)
+	Printf("  files:        %d (%s)\n", plan.Files, formatBytes(plan.FileBytes))
+	if plan.Clones > 0 {
+		Printf("  duplicates:   %d (copied from another restored file)\n", plan.Clones)
+	}
+	Printf("  packs:        %d\n", len(plan.Packs))
+	Printf("  requests:     %d\n", plan.Requests())
+	Printf("  download:     %s (%s of blobs)\n", formatBytes(plan.Bytes()), formatBytes(plan.BlobBytes()))
+
+	if len(plan.Missing) > 0 {
+		Printf("  %d blobs are not available in the index, the files containing them cannot be restored\n", len(plan.Missing))
+	}
+
+	return nil
+}
+
+// restoreJournalName is the name of the journal in the target directory.
+const restoreJournalName = ".restic-restore-journal"
+
+// restoreJournalFilename returns the file name for the journal of a restore
+// to opts.Target. In the journal directory, the file name is derived from the
+// absolute path of the target so several restores can be journaled there.
+func restoreJournalFilename(opts RestoreOptions) (string, error) {
+	if opts.JournalDir == "" {
+		return filepath.Join(opts.Target, restoreJournalName), nil
+	}
+
+	target, err := filepath.Abs(opts.Target)
+	if err != nil {
+		return "", errors.Wrap(err, "Abs")
+	}
+
+	return filepath.Join(opts.JournalDir, "restore-"+restic.Hash([]byte(target)).String()), nil
+}
+
+// openRestoreJournal opens the journal for restoring snapshot id. Unless
+// opts.Resume is set, an existing journal is discarded.
+func openRestoreJournal(opts RestoreOptions, id restic.ID) (*restic.RestoreJournal, error) {
+	filename, err := restoreJournalFilename(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = fs.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, errors.Wrap(err, "MkdirAll")
 	}
-	return err
+
+	if !opts.Resume {
+		if err = fs.RemoveIfExists(filename); err != nil {
+			return nil, errors.Wrap(err, "Remove")
+		}
+	}
+
+	debug.Log("using restore journal %v", filename)
+	return restic.OpenRestoreJournal(filename, id)
+}
+
+// skippedMetadata counts the files for which metadata of a category has been
+// skipped with --portable.
+type skippedMetadata map[string]*skippedCategory
+
+type skippedCategory struct {
+	files int
+	err   error // the first error, as an example
+}
+
+// skip records the platform-specific metadata which could not be restored
+// according to err and returns the error for the remaining metadata, which is
+// nil if there is none.
+func (s skippedMetadata) skip(err error) error {
+	merr, ok := errors.Cause(err).(*restic.MetadataError)
+	if !ok {
+		return err
+	}
+
+	rest := &restic.MetadataError{Errors: make(map[string]error)}
+	for category, cerr := range merr.Errors {
+		if !restic.PlatformMetadata(category) {
+			rest.Errors[category] = cerr
+			continue
+		}
+
+		if s[category] == nil {
+			s[category] = &skippedCategory{err: cerr}
+		}
+		s[category].files++
+	}
+
+	if len(rest.Errors) == 0 {
+		return nil
+	}
+	return rest
+}
+
+// print reports the skipped metadata for each category.
+func (s skippedMetadata) print() {
+	if len(s) == 0 {
+		return
+	}
+
+	categories := make([]string, 0, len(s))
+	for category := range s {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	Printf("metadata which could not be restored on this system has been skipped:\n")
+	for _, category := range categories {
+		Printf("  %-20s %d files (e.g. %v)\n", category+":", s[category].files, s[category].err)
+	}
+}
+
+// restoreError records a file or directory which could not be restored.
+type restoreError struct {
+	Path string
+	Err  error
+}
+
+// exitCodePartialRestore is the exit code used when the restore finished, but
+// some files or directories could not be restored.
+const exitCodePartialRestore = 3
+
+// errPartialRestore is returned when the restore finished with errors for
+// individual files.
+type errPartialRestore struct {
+	errors int
+}
+
+func (e errPartialRestore) Error() string {
+	return fmt.Sprintf("restore finished, but %d files or directories could not be restored", e.errors)
+}
+
+// ExitCode returns the exit code restic terminates with.
+func (e errPartialRestore) ExitCode() int {
+	return exitCodePartialRestore
+}
+
+// symlinkMapping replaces the prefix Old of a symlink target with New.
+type symlinkMapping struct {
+	Old, New string
+}
+
+type symlinkMappings []symlinkMapping
+
+// parseSymlinkMappings parses a list of mappings in the form "old:new". The
+// old prefix must be an absolute path.
+func parseSymlinkMappings(list []string) (symlinkMappings, error) {
+	var mappings symlinkMappings
+	for _, s := range list {
+		data := strings.SplitN(s, ":", 2)
+		if len(data) != 2 || data[0] == "" || data[1] == "" {
+			return nil, errors.Fatalf("invalid symlink mapping %q, must be in the form old:new", s)
+		}
+
+		if !filepath.IsAbs(data[0]) {
+			return nil, errors.Fatalf("invalid symlink mapping %q, old prefix must be an absolute path", s)
+		}
+
+		mappings = append(mappings, symlinkMapping{
+			Old: filepath.Clean(data[0]),
+			New: filepath.Clean(data[1]),
+		})
+	}
+
+	return mappings, nil
+}
+
+// Map returns target with the prefix of the first matching mapping replaced.
+// Only whole path components are matched, so the mapping "/opt/app:/srv/app"
+// rewrites "/opt/app/bin" but not "/opt/application". Targets which do not
+// match any mapping are returned unchanged.
+func (m symlinkMappings) Map(target string) string {
+	for _, mapping := range m {
+		if target == mapping.Old {
+			return mapping.New
+		}
+
+		prefix := mapping.Old
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+
+		if strings.HasPrefix(target, prefix) {
+			return filepath.Join(mapping.New, target[len(prefix):])
+		}
+	}
+
+	return target
 }
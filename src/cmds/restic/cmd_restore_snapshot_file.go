@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"restic"
+	"restic/errors"
+)
+
+var cmdRestoreSnapshotFile = &cobra.Command{
+	Use:   "restore-snapshot-file [snapshot ID] [...]",
+	Short: "restores snapshots from the trash",
+	Long: `
+The "restore-snapshot-file" command moves snapshots which have been removed by
+"forget --grace" back from the trash. The snapshots keep their original IDs.
+
+When no snapshot ID is given, the snapshots in the trash are listed.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runRestoreSnapshotFile(globalOptions, args)
+	},
+}
+
+func init() {
+	cmdRoot.AddCommand(cmdRestoreSnapshotFile)
+}
+
+// findTrashedSnapshot returns the snapshot in list whose ID starts with s.
+func findTrashedSnapshot(list []*restic.TrashedSnapshot, s string) (*restic.TrashedSnapshot, error) {
+	var match *restic.TrashedSnapshot
+	for _, t := range list {
+		if !strings.HasPrefix(t.ID.String(), s) {
+			continue
+		}
+
+		if match != nil && !match.ID.Equal(t.ID) {
+			return nil, errors.Fatalf("snapshot ID %q is ambiguous", s)
+		}
+
+		// a snapshot may have been trashed more than once (e.g. after it
+		// was restored), the newest copy is used
+		if match == nil || t.Time.After(match.Time) {
+			match = t
+		}
+	}
+
+	if match == nil {
+		return nil, errors.Fatalf("no snapshot with ID %q found in the trash", s)
+	}
+
+	return match, nil
+}
+
+func printTrashedSnapshots(gopts GlobalOptions, list []*restic.TrashedSnapshot) error {
+	tab := NewTable()
+	tab.Header = "ID        Date                 Expires              Host        Directory"
+	tab.RowFormat = "%-8s  %-19s  %-19s  %-10s  %s"
+
+	for _, t := range list {
+		sn := t.Snapshot
+		tab.Rows = append(tab.Rows, []interface{}{t.ID.Str(), sn.Time.Format(TimeFormat),
+			t.Expires.Format(TimeFormat), sn.Hostname, strings.Join(sn.Paths, ", ")})
+	}
+
+	return tab.Write(gopts.stdout)
+}
+
+func runRestoreSnapshotFile(gopts GlobalOptions, args []string) error {
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return err
+	}
+
+	if !gopts.NoLock {
+		lock, err := lockRepo(repo)
+		defer unlockRepo(lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	list, err := restic.LoadAllTrashedSnapshots(gopts.ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return printTrashedSnapshots(gopts, list)
+	}
+
+	now := time.Now()
+	for _, arg := range args {
+		t, err := findTrashedSnapshot(list, arg)
+		if err != nil {
+			return err
+		}
+
+		if t.Expired(now) {
+			// prune has not removed the snapshot yet, so its data is still there
+			Warnf("snapshot %v has expired, restoring it anyway\n", t.ID.Str())
+		}
+
+		if err = t.Restore(gopts.ctx, repo); err != nil {
+			return err
+		}
+
+		Verbosef("restored snapshot %v\n", t.ID.Str())
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"restic"
+	"restic/errors"
+	"testing"
+)
+
+func TestSkippedMetadata(t *testing.T) {
+	skipped := make(skippedMetadata)
+
+	errOwner := errors.New("operation not permitted")
+	err := skipped.skip(&restic.MetadataError{Errors: map[string]error{
+		restic.MetadataOwner:  errOwner,
+		restic.MetadataXattrs: errors.New("operation not supported"),
+	}})
+	if err != nil {
+		t.Fatalf("error for platform-specific metadata returned: %v", err)
+	}
+
+	err = skipped.skip(&restic.MetadataError{Errors: map[string]error{
+		restic.MetadataOwner: errors.New("operation not permitted"),
+		restic.MetadataMode:  errors.New("read-only file system"),
+	}})
+	merr, ok := err.(*restic.MetadataError)
+	if !ok {
+		t.Fatalf("expected a MetadataError, got %T: %v", err, err)
+	}
+	if len(merr.Errors) != 1 || merr.Errors[restic.MetadataMode] == nil {
+		t.Fatalf("wrong remaining error: %v", err)
+	}
+
+	other := errors.New("other error")
+	if err = skipped.skip(other); err != other {
+		t.Fatalf("wrong error returned for other error: %v", err)
+	}
+
+	if skipped[restic.MetadataOwner].files != 2 || skipped[restic.MetadataXattrs].files != 1 {
+		t.Fatalf("wrong counts for skipped metadata")
+	}
+
+	if skipped[restic.MetadataOwner].err != errOwner {
+		t.Fatalf("wrong example error %v", skipped[restic.MetadataOwner].err)
+	}
+}
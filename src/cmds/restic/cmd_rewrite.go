@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"restic"
+	"restic/errors"
+)
+
+var cmdRewrite = &cobra.Command{
+	Use:   "rewrite [flags] [snapshot-ID ...]",
+	Short: "change the host name and paths of snapshots",
+	Long: `
+The "rewrite" command changes the host name and the paths recorded in existing
+snapshots, for example after a host has been renamed or the data has been
+moved to a different directory. Afterwards, the snapshots are grouped together
+with new snapshots by "forget" and used as parents by "backup" again.
+
+The contents of the snapshots are not changed. Like "tag", each modified
+snapshot is saved with a new ID and the original ID is recorded in it.
+
+When no snapshot-ID is given, all snapshots matching the host, tag and path
+filter criteria are modified.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runRewrite(rewriteOptions, globalOptions, args)
+	},
+}
+
+// RewriteOptions bundles all options for the 'rewrite' command.
+type RewriteOptions struct {
+	Host         string
+	Paths        []string
+	Tags         []string
+	SetHost      string
+	ReplacePaths []string
+	DryRun       bool
+}
+
+var rewriteOptions RewriteOptions
+
+func init() {
+	cmdRoot.AddCommand(cmdRewrite)
+
+	f := cmdRewrite.Flags()
+	f.StringVar(&rewriteOptions.SetHost, "set-host", "", "replace the host name of the snapshots with `hostname`")
+	f.StringSliceVar(&rewriteOptions.ReplacePaths, "replace-path", nil, "replace the path `old=new` and the paths below it (can be given multiple times)")
+	f.BoolVarP(&rewriteOptions.DryRun, "dry-run", "n", false, "do not modify the repository, just print what would be done")
+
+	f.StringVarP(&rewriteOptions.Host, "host", "H", "", "only consider snapshots for this `host`, when no snapshot ID is given")
+	f.StringSliceVar(&rewriteOptions.Tags, "tag", nil, "only consider snapshots which include this `tag`, when no snapshot-ID is given")
+	f.StringSliceVar(&rewriteOptions.Paths, "path", nil, "only consider snapshots which include this (absolute) `path`, when no snapshot-ID is given")
+}
+
+// pathReplacement replaces a path and the paths below it.
+type pathReplacement struct {
+	old, new string
+}
+
+// parsePathReplacements parses the arguments given to --replace-path.
+func parsePathReplacements(args []string) ([]pathReplacement, error) {
+	var list []pathReplacement
+	for _, arg := range args {
+		data := strings.SplitN(arg, "=", 2)
+		if len(data) != 2 || data[0] == "" || data[1] == "" {
+			return nil, errors.Fatalf("invalid path replacement %q, expected old=new", arg)
+		}
+
+		// "/srv/" also matches the paths below "/srv"
+		old := data[0]
+		if len(old) > 1 {
+			old = strings.TrimRight(old, `/\`)
+		}
+
+		list = append(list, pathReplacement{old: old, new: data[1]})
+	}
+
+	return list, nil
+}
+
+// replacePath applies the first matching replacement to p.
+func replacePath(p string, list []pathReplacement) string {
+	for _, r := range list {
+		if p == r.old {
+			return r.new
+		}
+
+		if !strings.HasPrefix(p, r.old) {
+			continue
+		}
+
+		// rest starts with the separator, which is the last character of
+		// old for the root directory
+		rest := p[len(r.old):]
+		if strings.ContainsAny(r.old[len(r.old)-1:], `/\`) {
+			rest = p[len(r.old)-1:]
+		}
+
+		if strings.ContainsAny(rest[:1], `/\`) {
+			return strings.TrimRight(r.new, `/\`) + rest
+		}
+	}
+
+	return p
+}
+
+// rewriteSnapshot changes the host name and paths of sn and returns whether it
+// has been modified.
+func rewriteSnapshot(sn *restic.Snapshot, host string, paths []pathReplacement) bool {
+	changed := false
+
+	if host != "" && sn.Hostname != host {
+		sn.Hostname = host
+		changed = true
+	}
+
+	for i, p := range sn.Paths {
+		if np := replacePath(p, paths); np != p {
+			sn.Paths[i] = np
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func runRewrite(opts RewriteOptions, gopts GlobalOptions, args []string) error {
+	if opts.SetHost == "" && len(opts.ReplacePaths) == 0 {
+		return errors.Fatal("nothing to do, specify --set-host or --replace-path")
+	}
+
+	paths, err := parsePathReplacements(opts.ReplacePaths)
+	if err != nil {
+		return err
+	}
+
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return err
+	}
+
+	if !gopts.NoLock && !opts.DryRun {
+		Verbosef("Create exclusive lock for repository\n")
+		lock, err := lockRepoExclusive(repo)
+		defer unlockRepo(lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(gopts.ctx)
+	defer cancel()
+
+	changeCnt := 0
+	for sn := range FindFilteredSnapshots(ctx, repo, opts.Host, opts.Tags, opts.Paths, args) {
+		if !rewriteSnapshot(sn, opts.SetHost, paths) {
+			continue
+		}
+		changeCnt++
+
+		if opts.DryRun {
+			Printf("would rewrite snapshot %v: host %v, paths %v\n", sn.ID().Str(), sn.Hostname, strings.Join(sn.Paths, ", "))
+			continue
+		}
+
+		if _, err := replaceSnapshot(ctx, repo, sn); err != nil {
+			Warnf("unable to rewrite snapshot ID %q, ignoring: %v\n", sn.ID(), err)
+			changeCnt--
+		}
+	}
+
+	switch {
+	case changeCnt == 0:
+		Verbosef("No snapshots were modified\n")
+	case opts.DryRun:
+		Verbosef("Would modify %v snapshots\n", changeCnt)
+	default:
+		Verbosef("Modified %v snapshots\n", changeCnt)
+	}
+
+	return nil
+}
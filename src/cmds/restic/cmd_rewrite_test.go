@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestReplacePath(t *testing.T) {
+	var tests = []struct {
+		replace []string
+		path    string
+		want    string
+	}{
+		{[]string{"/home/foo=/home/bar"}, "/home/foo", "/home/bar"},
+		{[]string{"/home/foo=/home/bar"}, "/home/foo/work", "/home/bar/work"},
+		{[]string{"/home/foo=/home/bar"}, "/home/foobar", "/home/foobar"},
+		{[]string{"/home/foo/=/home/bar/"}, "/home/foo/work", "/home/bar/work"},
+		{[]string{"/=/data"}, "/srv", "/data/srv"},
+		{[]string{"/srv=/"}, "/srv/www", "/www"},
+		{[]string{`C:\Users\foo=C:\Users\bar`}, `C:\Users\foo\Documents`, `C:\Users\bar\Documents`},
+		{[]string{"/srv=/data", "/srv/www=/www"}, "/srv/www", "/data/www"},
+		{[]string{"/srv/www=/www", "/srv=/data"}, "/srv/www", "/www"},
+	}
+
+	for _, test := range tests {
+		list, err := parsePathReplacements(test.replace)
+		if err != nil {
+			t.Errorf("parsing %v failed: %v", test.replace, err)
+			continue
+		}
+
+		got := replacePath(test.path, list)
+		if got != test.want {
+			t.Errorf("replacing %v in %q: want %q, got %q", test.replace, test.path, test.want, got)
+		}
+	}
+}
+
+func TestParsePathReplacementsInvalid(t *testing.T) {
+	for _, arg := range []string{"", "/srv", "=/srv", "/srv="} {
+		if _, err := parsePathReplacements([]string{arg}); err == nil {
+			t.Errorf("no error returned for %q", arg)
+		}
+	}
+}
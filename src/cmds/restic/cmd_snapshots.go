@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -17,6 +19,25 @@ var cmdSnapshots = &cobra.Command{
 	Short: "list all snapshots",
 	Long: `
 The "snapshots" command lists all snapshots stored in the repository.
+
+With --porcelain, one line is printed for each snapshot, the format is
+guaranteed to stay the same in future versions. The line contains the
+following fields, separated by a tab character:
+
+  id      the full snapshot ID
+  time    the time of the snapshot in RFC3339 format
+  host    the host name
+  tags    the tags, separated by commas
+  paths   the paths, separated by commas
+
+Backslashes, tabs, newlines and commas within values are escaped as "\\",
+"\t", "\n" and "\,". New fields may be appended at the end of the line.
+
+With --last, only the most recent snapshot for each combination of host and
+paths is shown.
+
+Checkpoints saved by backups which have not finished are only shown with
+--checkpoints, or when their ID is given.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return runSnapshots(snapshotOptions, globalOptions, args)
@@ -25,9 +46,12 @@ The "snapshots" command lists all snapshots stored in the repository.
 
 // SnapshotOptions bundles all options for the snapshots command.
 type SnapshotOptions struct {
-	Host  string
-	Tags  []string
-	Paths []string
+	Host        string
+	Tags        []string
+	Paths       []string
+	Porcelain   bool
+	Last        bool
+	Checkpoints bool
 }
 
 var snapshotOptions SnapshotOptions
@@ -39,6 +63,9 @@ func init() {
 	f.StringVarP(&snapshotOptions.Host, "host", "H", "", "only consider snapshots for this `host`")
 	f.StringSliceVar(&snapshotOptions.Tags, "tag", nil, "only consider snapshots which include this `tag` (can be specified multiple times)")
 	f.StringSliceVar(&snapshotOptions.Paths, "path", nil, "only consider snapshots for this `path` (can be specified multiple times)")
+	f.BoolVar(&snapshotOptions.Porcelain, "porcelain", false, "print snapshots in a stable, tab-separated format for scripts")
+	f.BoolVar(&snapshotOptions.Last, "last", false, "only show the last snapshot for each host and path")
+	f.BoolVar(&snapshotOptions.Checkpoints, "checkpoints", false, "also show checkpoints of backups which have not finished")
 }
 
 func runSnapshots(opts SnapshotOptions, gopts GlobalOptions, args []string) error {
@@ -60,10 +87,26 @@ func runSnapshots(opts SnapshotOptions, gopts GlobalOptions, args []string) erro
 
 	var list restic.Snapshots
 	for sn := range FindFilteredSnapshots(ctx, repo, opts.Host, opts.Tags, opts.Paths, args) {
+		if sn.Checkpoint && !opts.Checkpoints && len(args) == 0 {
+			continue
+		}
 		list = append(list, sn)
 	}
 	sort.Sort(sort.Reverse(list))
 
+	if opts.Last {
+		list = lastSnapshots(list)
+	}
+
+	if gopts.JSONSchema > 0 {
+		for _, sn := range list {
+			if err = printJSONEvent(gopts, "snapshot", Snapshot{Snapshot: sn, ID: sn.ID()}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	if gopts.JSON {
 		err := printSnapshotsJSON(gopts.stdout, list)
 		if err != nil {
@@ -71,11 +114,39 @@ func runSnapshots(opts SnapshotOptions, gopts GlobalOptions, args []string) erro
 		}
 		return nil
 	}
+
+	if opts.Porcelain {
+		printSnapshotsPorcelain(gopts.stdout, list)
+		return nil
+	}
+
 	PrintSnapshots(gopts.stdout, list)
 
 	return nil
 }
 
+// lastSnapshots returns the first snapshot in list for each combination of
+// host and paths, list must be sorted with the most recent snapshot first.
+func lastSnapshots(list restic.Snapshots) restic.Snapshots {
+	seen := make(map[string]struct{})
+
+	var last restic.Snapshots
+	for _, sn := range list {
+		paths := append([]string(nil), sn.Paths...)
+		sort.Strings(paths)
+
+		key := sn.Hostname + "\x00" + strings.Join(paths, "\x00")
+		if _, ok := seen[key]; ok {
+			continue
+		}
+
+		seen[key] = struct{}{}
+		last = append(last, sn)
+	}
+
+	return last
+}
+
 // PrintSnapshots prints a text table of the snapshots in list to stdout.
 func PrintSnapshots(stdout io.Writer, list restic.Snapshots) {
 
@@ -145,6 +216,32 @@ func PrintSnapshots(stdout io.Writer, list restic.Snapshots) {
 	tab.Write(stdout)
 }
 
+// porcelainEscaper escapes the separators used in the porcelain format.
+var porcelainEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, ",", `\,`)
+
+// porcelainList escapes all items in list and joins them with commas.
+func porcelainList(list []string) string {
+	escaped := make([]string, 0, len(list))
+	for _, s := range list {
+		escaped = append(escaped, porcelainEscaper.Replace(s))
+	}
+	return strings.Join(escaped, ",")
+}
+
+// printSnapshotsPorcelain writes one line with tab-separated fields for each
+// snapshot in list to stdout. The format must not be changed, new fields may
+// only be added at the end.
+func printSnapshotsPorcelain(stdout io.Writer, list restic.Snapshots) {
+	for _, sn := range list {
+		fmt.Fprintf(stdout, "%s\t%s\t%s\t%s\t%s\n",
+			sn.ID(),
+			sn.Time.Format(time.RFC3339),
+			porcelainEscaper.Replace(sn.Hostname),
+			porcelainList(sn.Tags),
+			porcelainList(sn.Paths))
+	}
+}
+
 // Snapshot helps to print Snaphots as JSON with their ID included.
 type Snapshot struct {
 	*restic.Snapshot
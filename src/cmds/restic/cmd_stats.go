@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"restic"
+	"restic/errors"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdStats = &cobra.Command{
+	Use:   "stats [flags]",
+	Short: "print statistics about the data in the repository",
+	Long: `
+The "stats" command prints statistics about the data in the repository.
+
+With "--mode hosts" (the default), the following is printed for each host
+which has saved snapshots in the repository:
+
+ * logical:  the size of the files in all snapshots of the host, as if each
+             snapshot was restored
+ * unique:   the data stored in the repository which is only referenced by the
+             snapshots of this host
+ * shared:   the data stored in the repository which is referenced by the
+             snapshots of this host and at least one other host
+
+The unique and shared data includes the trees (directory listings), sizes are
+the number of bytes stored in the repository, after deduplication and
+encryption.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runRepoStats(statsOptions, globalOptions, args)
+	},
+}
+
+// StatsOptions collects all options for the stats command.
+type StatsOptions struct {
+	Mode string
+}
+
+var statsOptions StatsOptions
+
+func init() {
+	cmdRoot.AddCommand(cmdStats)
+
+	f := cmdStats.Flags()
+	f.StringVar(&statsOptions.Mode, "mode", "hosts", "the statistics to print (hosts)")
+}
+
+// hostUsage is the data referenced by the snapshots of a single host.
+type hostUsage struct {
+	Hostname     string `json:"hostname"`
+	Snapshots    int    `json:"snapshots"`
+	LogicalBytes uint64 `json:"logical_bytes"`
+	UniqueBytes  uint64 `json:"unique_bytes"`
+	SharedBytes  uint64 `json:"shared_bytes"`
+
+	blobs restic.BlobSet
+}
+
+type byHostUsage []*hostUsage
+
+func (l byHostUsage) Len() int           { return len(l) }
+func (l byHostUsage) Less(i, j int) bool { return l[i].Hostname < l[j].Hostname }
+func (l byHostUsage) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// hostStats is the output of "stats --mode hosts".
+type hostStats struct {
+	Hosts []*hostUsage `json:"hosts"`
+
+	// TotalBytes is the data referenced by any snapshot, shared data is
+	// only counted once.
+	TotalBytes uint64 `json:"total_bytes"`
+}
+
+// WriteTo prints the stats in a human readable form to w.
+func (s hostStats) WriteTo(w io.Writer) (int64, error) {
+	tab := NewTable()
+	tab.Header = fmt.Sprintf("%-20s  %-9s  %-10s  %-10s  %s", "Host", "Snapshots", "Logical", "Unique", "Shared")
+	tab.RowFormat = "%-20s  %-9d  %-10s  %-10s  %s"
+	for _, h := range s.Hosts {
+		tab.Rows = append(tab.Rows, []interface{}{h.Hostname, h.Snapshots,
+			formatBytes(h.LogicalBytes), formatBytes(h.UniqueBytes), formatBytes(h.SharedBytes)})
+	}
+	if err := tab.Write(w); err != nil {
+		return 0, err
+	}
+
+	n, err := fmt.Fprintf(w, "\nreferenced data: %s\n", formatBytes(s.TotalBytes))
+	return int64(n), err
+}
+
+// treeSizer computes the size of the files in trees, the result for each
+// tree is remembered since most trees are contained in many snapshots.
+type treeSizer struct {
+	repo  restic.Repository
+	sizes map[restic.ID]uint64
+}
+
+func (ts *treeSizer) size(ctx context.Context, id restic.ID) (uint64, error) {
+	if size, ok := ts.sizes[id]; ok {
+		return size, nil
+	}
+
+	tree, err := ts.repo.LoadTree(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	var size uint64
+	for _, node := range tree.Nodes {
+		switch {
+		case node.Type == "file":
+			size += node.Size
+		case node.Type == "dir" && node.Subtree != nil:
+			s, err := ts.size(ctx, *node.Subtree)
+			if err != nil {
+				return 0, err
+			}
+			size += s
+		}
+	}
+
+	ts.sizes[id] = size
+	return size, nil
+}
+
+// collectHostStats computes the data referenced by the snapshots of each
+// host. Checkpoints of unfinished backups are not counted, their files are
+// contained in the snapshot saved at the end of the backup.
+func collectHostStats(ctx context.Context, repo restic.Repository) (hostStats, error) {
+	snapshots, err := restic.LoadAllSnapshots(ctx, repo)
+	if err != nil {
+		return hostStats{}, err
+	}
+
+	hosts := make(map[string]*hostUsage)
+	ts := &treeSizer{repo: repo, sizes: make(map[restic.ID]uint64)}
+	seen := make(map[string]restic.BlobSet)
+
+	for _, sn := range snapshots {
+		if sn.Checkpoint {
+			continue
+		}
+
+		h, ok := hosts[sn.Hostname]
+		if !ok {
+			h = &hostUsage{Hostname: sn.Hostname, blobs: restic.NewBlobSet()}
+			hosts[sn.Hostname] = h
+			seen[sn.Hostname] = restic.NewBlobSet()
+		}
+
+		h.Snapshots++
+
+		size, err := ts.size(ctx, *sn.Tree)
+		if err != nil {
+			return hostStats{}, err
+		}
+		h.LogicalBytes += size
+
+		err = restic.FindUsedBlobs(ctx, repo, *sn.Tree, h.blobs, seen[sn.Hostname])
+		if err != nil {
+			return hostStats{}, err
+		}
+	}
+
+	// count the hosts which reference each blob
+	refs := make(map[restic.BlobHandle]int)
+	for _, h := range hosts {
+		for blob := range h.blobs {
+			refs[blob]++
+		}
+	}
+
+	var stats hostStats
+	for _, h := range hosts {
+		for blob := range h.blobs {
+			size, err := storedSize(repo, blob)
+			if err != nil {
+				return hostStats{}, err
+			}
+
+			if refs[blob] > 1 {
+				h.SharedBytes += size
+			} else {
+				h.UniqueBytes += size
+			}
+		}
+
+		stats.Hosts = append(stats.Hosts, h)
+	}
+
+	for blob := range refs {
+		size, err := storedSize(repo, blob)
+		if err != nil {
+			return hostStats{}, err
+		}
+		stats.TotalBytes += size
+	}
+
+	sort.Sort(byHostUsage(stats.Hosts))
+	return stats, nil
+}
+
+// storedSize returns the number of bytes stored in the repository for blob.
+func storedSize(repo restic.Repository, blob restic.BlobHandle) (uint64, error) {
+	blobs, err := repo.Index().Lookup(blob.ID, blob.Type)
+	if err != nil {
+		return 0, errors.Errorf("%v blob %v is not contained in the index", blob.Type, blob.ID.Str())
+	}
+
+	return uint64(blobs[0].Length), nil
+}
+
+func runRepoStats(opts StatsOptions, gopts GlobalOptions, args []string) error {
+	if len(args) > 0 {
+		return errors.Fatal("the stats command does not take any arguments")
+	}
+
+	if opts.Mode != "hosts" {
+		return errors.Fatalf("unknown mode %q", opts.Mode)
+	}
+
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return err
+	}
+
+	if !gopts.NoLock {
+		lock, err := lockRepo(repo)
+		defer unlockRepo(lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := gopts.ctx
+	if err = repo.LoadIndex(ctx); err != nil {
+		return err
+	}
+
+	stats, err := collectHostStats(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case gopts.JSONSchema > 0:
+		err = printJSONEvent(gopts, "stats", stats)
+	case gopts.JSON:
+		err = json.NewEncoder(gopts.stdout).Encode(stats)
+	default:
+		_, err = stats.WriteTo(gopts.stdout)
+	}
+
+	return err
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"restic"
+	"restic/errors"
+	"restic/repository"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdStatus = &cobra.Command{
+	Use:   "status",
+	Short: "print an overview of the repository",
+	Long: `
+The "status" command prints an overview of the repository: the latest snapshot
+for each host, the amount of data stored, the number of locks, when the index
+was last rebuilt by "maintain" and when "check" and "prune" were last run.
+Snapshots which cannot be loaded are reported as errors, the command then
+exits with a non-zero exit code.
+
+With --profiles, the overview is printed for the repositories of the given
+profiles (a comma separated list of names, or "all" for all profiles in the
+profile directory) as a single table. Repositories which cannot be opened are
+reported as errors, the remaining ones are still shown.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runStatus(statusOptions, globalOptions, args)
+	},
+}
+
+// StatusOptions bundles all options for the status command.
+type StatusOptions struct {
+	Profiles   string
+	ProfileDir string
+}
+
+var statusOptions StatusOptions
+
+func init() {
+	cmdRoot.AddCommand(cmdStatus)
+
+	f := cmdStatus.Flags()
+	f.StringVar(&statusOptions.Profiles, "profiles", "", "print the status of the repositories of the `profiles` (comma separated names or \"all\")")
+	f.StringVar(&statusOptions.ProfileDir, "profile-dir", defaultProfileDir, "read profiles from `directory`")
+}
+
+// hostStatus summarizes the snapshots of a single host.
+type hostStatus struct {
+	Hostname  string    `json:"hostname"`
+	Snapshots int       `json:"snapshots"`
+	Latest    time.Time `json:"latest"`
+	LatestID  string    `json:"latest_id"`
+}
+
+type byHostname []hostStatus
+
+func (l byHostname) Len() int           { return len(l) }
+func (l byHostname) Less(i, j int) bool { return l[i].Hostname < l[j].Hostname }
+func (l byHostname) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// repoStatus is the overview printed by the status command.
+type repoStatus struct {
+	Profile          string            `json:"profile,omitempty"`
+	Repository       string            `json:"repository"`
+	Snapshots        int               `json:"snapshots"`
+	Hosts            []hostStatus      `json:"hosts"`
+	TotalBytes       uint64            `json:"total_bytes"`
+	Locks            int               `json:"locks"`
+	LastIndexRebuild *time.Time        `json:"last_index_rebuild,omitempty"`
+	LastCheck        *restic.Operation `json:"last_check,omitempty"`
+	LastPrune        *restic.Operation `json:"last_prune,omitempty"`
+	Errors           []string          `json:"errors,omitempty"`
+}
+
+// addSnapshot records the snapshot sn with the given id in the status.
+func (s *repoStatus) addSnapshot(id restic.ID, sn *restic.Snapshot) {
+	s.Snapshots++
+
+	for i := range s.Hosts {
+		h := &s.Hosts[i]
+		if h.Hostname != sn.Hostname {
+			continue
+		}
+
+		h.Snapshots++
+		if sn.Time.After(h.Latest) {
+			h.Latest = sn.Time
+			h.LatestID = id.Str()
+		}
+		return
+	}
+
+	s.Hosts = append(s.Hosts, hostStatus{
+		Hostname:  sn.Hostname,
+		Snapshots: 1,
+		Latest:    sn.Time,
+		LatestID:  id.Str(),
+	})
+}
+
+// formatOperation returns when the operation was last run and whether it
+// failed.
+func formatOperation(op *restic.Operation) string {
+	if op == nil {
+		return "never"
+	}
+
+	s := op.Time.Format(TimeFormat)
+	if op.Error != "" {
+		s += " (failed)"
+	}
+	return s
+}
+
+// WriteTo prints the status in a human readable form to w.
+func (s repoStatus) WriteTo(w io.Writer) (int64, error) {
+	lastRebuild := "never"
+	if s.LastIndexRebuild != nil {
+		lastRebuild = s.LastIndexRebuild.Format(TimeFormat)
+	}
+
+	n, err := fmt.Fprintf(w, "repository:          %s\n"+
+		"snapshots:           %d\n"+
+		"stored data:         %s\n"+
+		"locks:               %d\n"+
+		"last index rebuild:  %s\n"+
+		"last check:          %s\n"+
+		"last prune:          %s\n\n",
+		s.Repository, s.Snapshots, formatBytes(s.TotalBytes), s.Locks, lastRebuild,
+		formatOperation(s.LastCheck), formatOperation(s.LastPrune))
+	if err != nil {
+		return int64(n), err
+	}
+
+	tab := NewTable()
+	tab.Header = fmt.Sprintf("%-20s  %-9s  %-19s  %s", "Host", "Snapshots", "Latest", "ID")
+	tab.RowFormat = "%-20s  %-9d  %-19s  %s"
+	for _, h := range s.Hosts {
+		tab.Rows = append(tab.Rows, []interface{}{h.Hostname, h.Snapshots, h.Latest.Format(TimeFormat), h.LatestID})
+	}
+	if err = tab.Write(w); err != nil {
+		return int64(n), err
+	}
+
+	for _, msg := range s.Errors {
+		m, err := fmt.Fprintf(w, "error: %s\n", msg)
+		n += m
+		if err != nil {
+			return int64(n), err
+		}
+	}
+
+	return int64(n), nil
+}
+
+// profileStatusList is the overview of the repositories of several profiles.
+type profileStatusList []repoStatus
+
+// WriteTo prints a table with one row for each profile and a table with the
+// latest snapshot of each host in all repositories to w.
+func (l profileStatusList) WriteTo(w io.Writer) (int64, error) {
+	tab := NewTable()
+	tab.Header = fmt.Sprintf("%-12s  %-9s  %-10s  %-28s  %-28s  %s", "Profile", "Snapshots", "Size", "Last check", "Last prune", "Errors")
+	tab.RowFormat = "%-12s  %-9d  %-10s  %-28s  %-28s  %d"
+	for _, s := range l {
+		tab.Rows = append(tab.Rows, []interface{}{s.Profile, s.Snapshots, formatBytes(s.TotalBytes),
+			formatOperation(s.LastCheck), formatOperation(s.LastPrune), len(s.Errors)})
+	}
+	if err := tab.Write(w); err != nil {
+		return 0, err
+	}
+
+	n, err := fmt.Fprintln(w)
+	if err != nil {
+		return int64(n), err
+	}
+
+	tab = NewTable()
+	tab.Header = fmt.Sprintf("%-12s  %-20s  %-9s  %-19s  %s", "Profile", "Host", "Snapshots", "Latest", "ID")
+	tab.RowFormat = "%-12s  %-20s  %-9d  %-19s  %s"
+	for _, s := range l {
+		for _, h := range s.Hosts {
+			tab.Rows = append(tab.Rows, []interface{}{s.Profile, h.Hostname, h.Snapshots, h.Latest.Format(TimeFormat), h.LatestID})
+		}
+	}
+	if err = tab.Write(w); err != nil {
+		return int64(n), err
+	}
+
+	for _, s := range l {
+		for _, msg := range s.Errors {
+			m, err := fmt.Fprintf(w, "error: %s: %s\n", s.Profile, msg)
+			n += m
+			if err != nil {
+				return int64(n), err
+			}
+		}
+	}
+
+	return int64(n), nil
+}
+
+func runStatus(opts StatusOptions, gopts GlobalOptions, args []string) error {
+	if len(args) > 0 {
+		return errors.Fatal("the status command does not take any arguments")
+	}
+
+	if opts.Profiles != "" {
+		return runProfilesStatus(opts, gopts)
+	}
+
+	status, err := collectStatus(gopts)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case gopts.JSONSchema > 0:
+		err = printJSONEvent(gopts, "status", status)
+	case gopts.JSON:
+		err = json.NewEncoder(gopts.stdout).Encode(status)
+	default:
+		_, err = status.WriteTo(gopts.stdout)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(status.Errors) > 0 {
+		return errors.Fatalf("found %d errors", len(status.Errors))
+	}
+
+	return nil
+}
+
+// runProfilesStatus prints the status of the repositories of the profiles
+// selected by opts.
+func runProfilesStatus(opts StatusOptions, gopts GlobalOptions) error {
+	profiles, err := loadProfiles(opts.ProfileDir, opts.Profiles)
+	if err != nil {
+		return err
+	}
+
+	var (
+		list   profileStatusList
+		failed int
+	)
+	for _, p := range profiles {
+		status := profileStatus(gopts, p)
+		failed += len(status.Errors)
+
+		if gopts.JSONSchema > 0 {
+			if err = printJSONEvent(gopts, "status", status); err != nil {
+				return err
+			}
+		}
+		list = append(list, status)
+	}
+
+	switch {
+	case gopts.JSONSchema > 0:
+	case gopts.JSON:
+		err = json.NewEncoder(gopts.stdout).Encode(list)
+	default:
+		_, err = list.WriteTo(gopts.stdout)
+	}
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return errors.Fatalf("found %d errors", failed)
+	}
+
+	return nil
+}
+
+// profileStatus returns the status of the repository of the profile p. The
+// variables in the environment file of the profile are set while the
+// repository is accessed. If the repository cannot be opened, the error is
+// recorded in the status.
+func profileStatus(gopts GlobalOptions, p *Profile) repoStatus {
+	status := repoStatus{Profile: p.Name, Repository: p.Repository}
+
+	if p.EnvironmentFile != "" {
+		env, err := readEnvironmentFile(p.EnvironmentFile)
+		if err != nil {
+			status.Errors = append(status.Errors, err.Error())
+			return status
+		}
+
+		restore := setEnvironment(env)
+		defer restore()
+	}
+
+	gopts.Repo = p.Repository
+	gopts.PasswordFile = p.PasswordFile
+	gopts.PasswordCommand = p.PasswordCommand
+	if pw, ok := os.LookupEnv("RESTIC_PASSWORD"); ok {
+		gopts.password = pw
+	}
+
+	s, err := collectStatus(gopts)
+	if err != nil {
+		status.Errors = append(status.Errors, err.Error())
+		return status
+	}
+
+	s.Profile = p.Name
+	return s
+}
+
+// collectStatus opens the repository given in gopts and returns its status.
+// Snapshots which cannot be loaded are recorded as errors in the status.
+func collectStatus(gopts GlobalOptions) (repoStatus, error) {
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return repoStatus{}, err
+	}
+
+	if !gopts.NoLock {
+		lock, err := lockRepo(repo)
+		defer unlockRepo(lock)
+		if err != nil {
+			return repoStatus{}, err
+		}
+	}
+
+	ctx := gopts.ctx
+	if err = repo.LoadIndex(ctx); err != nil {
+		return repoStatus{}, err
+	}
+
+	status := repoStatus{Repository: gopts.Repo}
+
+	err = restic.ForAllSnapshots(ctx, repo, func(id restic.ID, sn *restic.Snapshot, err error) error {
+		if err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("unable to load snapshot %v: %v", id.Str(), err))
+			return nil
+		}
+		status.addSnapshot(id, sn)
+		return nil
+	})
+	if err != nil {
+		return repoStatus{}, err
+	}
+
+	sort.Sort(byHostname(status.Hosts))
+
+	status.TotalBytes, err = countIndexedData(repo)
+	if err != nil {
+		status.Errors = append(status.Errors, err.Error())
+	}
+
+	for range repo.List(ctx, restic.LockFile) {
+		status.Locks++
+	}
+
+	// our own lock is not interesting
+	if !gopts.NoLock && status.Locks > 0 {
+		status.Locks--
+	}
+
+	if p := repo.Config().Maintenance; p != nil && !p.LastIndexRebuild.IsZero() {
+		t := p.LastIndexRebuild
+		status.LastIndexRebuild = &t
+	}
+
+	ops, err := restic.LoadAllOperations(ctx, repo)
+	if err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("unable to load the operations: %v", err))
+	}
+	latest := restic.LatestOperations(ops)
+	status.LastCheck = latest["check"]
+	status.LastPrune = latest["prune"]
+
+	return status, nil
+}
+
+// recordOperation records in the repository that operation has finished with
+// err, so that it is shown by the status command. If this fails, only a
+// warning is printed.
+func recordOperation(ctx context.Context, repo *repository.Repository, operation string, err error) {
+	if _, e := restic.SaveOperation(ctx, repo, restic.NewOperation(operation, err)); e != nil {
+		Warnf("unable to record the %v run in the repository: %v\n", operation, e)
+	}
+}
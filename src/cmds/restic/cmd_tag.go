@@ -70,32 +70,41 @@ func changeTags(repo *repository.Repository, sn *restic.Snapshot, setTags, addTa
 	}
 
 	if changed {
-		// Retain the original snapshot id over all tag changes.
-		if sn.Original == nil {
-			sn.Original = sn.ID()
-		}
-
-		// Save the new snapshot.
-		id, err := repo.SaveJSONUnpacked(context.TODO(), restic.SnapshotFile, sn)
-		if err != nil {
+		if _, err := replaceSnapshot(context.TODO(), repo, sn); err != nil {
 			return false, err
 		}
+	}
+	return changed, nil
+}
 
-		debug.Log("new snapshot saved as %v", id.Str())
+// replaceSnapshot saves the modified snapshot sn as a new snapshot and removes
+// the old one. The ID of the new snapshot is returned.
+func replaceSnapshot(ctx context.Context, repo *repository.Repository, sn *restic.Snapshot) (restic.ID, error) {
+	// Retain the original snapshot id over all changes.
+	if sn.Original == nil {
+		sn.Original = sn.ID()
+	}
 
-		if err = repo.Flush(); err != nil {
-			return false, err
-		}
+	// Save the new snapshot.
+	id, err := repo.SaveJSONUnpacked(ctx, restic.SnapshotFile, sn)
+	if err != nil {
+		return restic.ID{}, err
+	}
 
-		// Remove the old snapshot.
-		h := restic.Handle{Type: restic.SnapshotFile, Name: sn.ID().String()}
-		if err = repo.Backend().Remove(context.TODO(), h); err != nil {
-			return false, err
-		}
+	debug.Log("new snapshot saved as %v", id.Str())
 
-		debug.Log("old snapshot %v removed", sn.ID())
+	if err = repo.Flush(); err != nil {
+		return restic.ID{}, err
 	}
-	return changed, nil
+
+	// Remove the old snapshot.
+	h := restic.Handle{Type: restic.SnapshotFile, Name: sn.ID().String()}
+	if err = repo.Backend().Remove(ctx, h); err != nil {
+		return restic.ID{}, err
+	}
+
+	debug.Log("old snapshot %v removed", sn.ID())
+	return id, nil
 }
 
 func runTag(opts TagOptions, gopts GlobalOptions, args []string) error {
@@ -105,6 +114,9 @@ func runTag(opts TagOptions, gopts GlobalOptions, args []string) error {
 	if len(opts.SetTags) != 0 && (len(opts.AddTags) != 0 || len(opts.RemoveTags) != 0) {
 		return errors.Fatal("--set and --add/--remove cannot be given at the same time")
 	}
+	if err := restic.CheckTags(append(opts.SetTags, opts.AddTags...)); err != nil {
+		return errors.Fatalf("%v", err)
+	}
 
 	repo, err := OpenRepository(gopts)
 	if err != nil {
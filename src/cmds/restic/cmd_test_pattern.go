@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"restic/errors"
+	"restic/filter"
+)
+
+var cmdTestPattern = &cobra.Command{
+	Use:   "test-pattern [flags] [path ...]",
+	Short: "show which paths are matched by include and exclude patterns",
+	Long: `
+The "test-pattern" command checks the given paths (or the paths read from
+stdin, one per line) against the include and exclude patterns and prints for
+each path whether it is selected, and which pattern decided this. The patterns
+are interpreted in the same way as by the "backup" and "restore" commands.
+Relative paths are converted to absolute paths first. The repository is not
+accessed.
+
+A pattern starting with a path separator is anchored at the root, all other
+patterns match anywhere in a path. A pattern matching a directory also matches
+everything in it. Within a pattern, '*' matches any sequence of characters
+except the path separator, '**' matches any number of directories, '?'
+matches a single character and '{a,b}' matches either 'a' or 'b'. Brackets
+match a single character from a set like '[abc]', a range like '[a-z]' or a
+class like '[[:digit:]]', '[!...]' and '[^...]' negate the set.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runTestPattern(testPatternOptions, globalOptions, args)
+	},
+}
+
+// TestPatternOptions collects all options for the test-pattern command.
+type TestPatternOptions struct {
+	Excludes     []string
+	ExcludeFiles []string
+	Includes     []string
+}
+
+var testPatternOptions TestPatternOptions
+
+func init() {
+	cmdRoot.AddCommand(cmdTestPattern)
+
+	f := cmdTestPattern.Flags()
+	f.StringArrayVarP(&testPatternOptions.Excludes, "exclude", "e", nil, "exclude a `pattern`, commas outside of braces separate several patterns (can be specified multiple times)")
+	f.StringSliceVar(&testPatternOptions.ExcludeFiles, "exclude-file", nil, "read exclude patterns from a `file` (can be specified multiple times)")
+	f.StringArrayVarP(&testPatternOptions.Includes, "include", "i", nil, "include a `pattern`, exclude everything else; commas outside of braces separate several patterns (can be specified multiple times)")
+}
+
+// patternMatch is the result for a single path.
+type patternMatch struct {
+	Path     string `json:"path"`
+	Selected bool   `json:"selected"`
+	Pattern  string `json:"pattern,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+	Anchored bool   `json:"anchored,omitempty"`
+}
+
+// firstMatch returns the first pattern which matches path.
+func firstMatch(patterns []filter.Pattern, path string) (filter.Pattern, bool, error) {
+	for _, p := range patterns {
+		matched, err := p.Match(path)
+		if err != nil {
+			return filter.Pattern{}, false, err
+		}
+
+		if matched {
+			return p, true, nil
+		}
+	}
+
+	return filter.Pattern{}, false, nil
+}
+
+func testPatterns(excludes, includes []filter.Pattern, path string) (patternMatch, error) {
+	m := patternMatch{Path: path, Selected: true}
+
+	p, matched, err := firstMatch(excludes, path)
+	if err != nil {
+		return m, err
+	}
+
+	if matched {
+		m.Selected, m.Pattern, m.Kind, m.Anchored = false, p.String(), "exclude", p.Anchored()
+		return m, nil
+	}
+
+	if len(includes) == 0 {
+		return m, nil
+	}
+
+	p, matched, err = firstMatch(includes, path)
+	if err != nil {
+		return m, err
+	}
+
+	if matched {
+		m.Pattern, m.Kind, m.Anchored = p.String(), "include", p.Anchored()
+	} else {
+		m.Selected = false
+	}
+
+	return m, nil
+}
+
+func readPaths(rd io.Reader) ([]string, error) {
+	var paths []string
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		paths = append(paths, line)
+	}
+
+	return paths, errors.Wrap(sc.Err(), "Scan")
+}
+
+func runTestPattern(opts TestPatternOptions, gopts GlobalOptions, args []string) error {
+	opts.Excludes = splitPatternOptions(opts.Excludes)
+	opts.Includes = splitPatternOptions(opts.Includes)
+
+	if len(opts.ExcludeFiles) > 0 {
+		patterns, err := readPatternFiles(opts.ExcludeFiles)
+		if err != nil {
+			return errors.Fatalf("error reading exclude patterns: %v", err)
+		}
+		opts.Excludes = append(opts.Excludes, patterns...)
+	}
+
+	if len(opts.Excludes) == 0 && len(opts.Includes) == 0 {
+		return errors.Fatal("no include or exclude patterns specified")
+	}
+
+	excludes, err := parsePatterns("exclude", opts.Excludes)
+	if err != nil {
+		return err
+	}
+
+	includes, err := parsePatterns("include", opts.Includes)
+	if err != nil {
+		return err
+	}
+
+	paths := args
+	if len(paths) == 0 {
+		paths, err = readPaths(os.Stdin)
+		if err != nil {
+			return err
+		}
+	}
+
+	results := make([]patternMatch, 0, len(paths))
+	for _, path := range paths {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+
+		m, err := testPatterns(excludes, includes, path)
+		if err != nil {
+			return err
+		}
+		results = append(results, m)
+	}
+
+	if gopts.JSONSchema > 0 {
+		for _, m := range results {
+			if err = printJSONEvent(gopts, "pattern_match", m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if gopts.JSON {
+		return json.NewEncoder(gopts.stdout).Encode(results)
+	}
+
+	for _, m := range results {
+		status := "included"
+		if !m.Selected {
+			status = "excluded"
+		}
+
+		if m.Pattern == "" {
+			Printf("%v %v\n", status, m.Path)
+			continue
+		}
+
+		anchored := "unanchored"
+		if m.Anchored {
+			anchored = "anchored"
+		}
+		Printf("%v %v (%s pattern %q, %s)\n", status, m.Path, m.Kind, m.Pattern, anchored)
+	}
+
+	return nil
+}
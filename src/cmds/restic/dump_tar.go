@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path"
+	"restic"
+	"restic/errors"
+	"strings"
+)
+
+// tarDumper writes nodes from snapshots to a tar archive. Files with the same
+// content are only stored once, all later occurrences are written as hard
+// links to the first one.
+type tarDumper struct {
+	repo restic.Repository
+	tw   *tar.Writer
+
+	// files maps the content of the files written so far to their names in
+	// the archive
+	files map[string]string
+}
+
+func newTarDumper(repo restic.Repository, wr io.Writer) *tarDumper {
+	return &tarDumper{
+		repo:  repo,
+		tw:    tar.NewWriter(wr),
+		files: make(map[string]string),
+	}
+}
+
+// Close writes the end of the archive.
+func (d *tarDumper) Close() error {
+	return d.tw.Close()
+}
+
+// contentSize returns the size of the content.
+func (d *tarDumper) contentSize(content restic.IDs) (int64, error) {
+	var size int64
+	for _, id := range content {
+		n, err := d.repo.LookupBlobSize(id, restic.DataBlob)
+		if err != nil {
+			return 0, err
+		}
+		size += int64(n)
+	}
+	return size, nil
+}
+
+// DumpTree writes all nodes in the tree to the archive below the directory
+// name.
+func (d *tarDumper) DumpTree(ctx context.Context, name string, treeID restic.ID) error {
+	tree, err := d.repo.LoadTree(ctx, treeID)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range tree.Nodes {
+		if err = d.DumpNode(ctx, path.Join(name, node.Name), node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DumpNode writes the node to the archive as name. For directories, the
+// contents are written as well.
+func (d *tarDumper) DumpNode(ctx context.Context, name string, node *restic.Node) error {
+	hdr := &tar.Header{
+		Name:       strings.TrimPrefix(name, "/"),
+		Mode:       int64(node.Mode.Perm()),
+		Uid:        int(node.UID),
+		Gid:        int(node.GID),
+		Uname:      node.User,
+		Gname:      node.Group,
+		ModTime:    node.ModTime,
+		AccessTime: node.AccessTime,
+		ChangeTime: node.ChangeTime,
+	}
+
+	switch node.Type {
+	case "dir":
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		if err := d.tw.WriteHeader(hdr); err != nil {
+			return errors.Wrap(err, "WriteHeader")
+		}
+
+		if node.Subtree == nil {
+			return errors.Errorf("directory %v has no subtree", name)
+		}
+		return d.DumpTree(ctx, name, *node.Subtree)
+
+	case "file":
+		key := node.Content.Key()
+		if first, ok := d.files[key]; ok && len(node.Content) > 0 {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			return errors.Wrap(d.tw.WriteHeader(hdr), "WriteHeader")
+		}
+		d.files[key] = hdr.Name
+
+		size, err := d.contentSize(node.Content)
+		if err != nil {
+			return err
+		}
+
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = size
+		if err = d.tw.WriteHeader(hdr); err != nil {
+			return errors.Wrap(err, "WriteHeader")
+		}
+
+		return restic.DumpFileRange(ctx, d.repo, node.Content, 0, 0, d.tw)
+
+	case "symlink":
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = node.LinkTarget
+		return errors.Wrap(d.tw.WriteHeader(hdr), "WriteHeader")
+
+	case "fifo":
+		hdr.Typeflag = tar.TypeFifo
+		return errors.Wrap(d.tw.WriteHeader(hdr), "WriteHeader")
+
+	default:
+		Warnf("skipping %v: nodes of type %q are not supported\n", name, node.Type)
+		return nil
+	}
+}
+
+// dumpTar writes the paths in the snapshots selected by targets to wr as a
+// tar archive. Each target has the form "snapshot-ID[:path]", without a path
+// the whole snapshot is written. The entries are stored below a directory
+// named after the short ID of the snapshot.
+func dumpTar(ctx context.Context, repo restic.Repository, targets []string, wr io.Writer) error {
+	d := newTarDumper(repo, wr)
+
+	for _, target := range targets {
+		snapshotID, p := target, ""
+		if i := strings.Index(target, ":"); i >= 0 {
+			snapshotID, p = target[:i], target[i+1:]
+		}
+
+		id, err := findSnapshotID(ctx, repo, snapshotID)
+		if err != nil {
+			return err
+		}
+
+		sn, err := restic.LoadSnapshot(ctx, repo, id)
+		if err != nil {
+			return err
+		}
+
+		prefix := id.Str()
+		if strings.Trim(p, "/") == "" {
+			err = d.DumpTree(ctx, prefix, *sn.Tree)
+		} else {
+			var node *restic.Node
+			node, err = restic.FindNode(ctx, repo, *sn.Tree, p)
+			if err != nil {
+				return errors.Fatalf("unable to find %v in snapshot %v: %v", p, id.Str(), err)
+			}
+			err = d.DumpNode(ctx, path.Join(prefix, p), node)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.Close()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"restic/debug"
+	"restic/errors"
+	"restic/filter"
+	"restic/fs"
+)
+
+// cacheDirTagSignature is the header of a CACHEDIR.TAG file, see
+// http://www.brynosaurus.com/cachedir/spec.html
+const cacheDirTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// marker is a file which marks a directory as excluded. If header is set, the
+// file must start with it.
+type marker struct {
+	filename string
+	header   string
+}
+
+// parseMarkers parses the values of --exclude-if-present, which have the
+// form "filename[:header]". If caches is set, the marker for cache
+// directories is added.
+func parseMarkers(specs []string, caches bool) ([]marker, error) {
+	var markers []marker
+	for _, spec := range specs {
+		m := marker{filename: spec}
+		if i := strings.Index(spec, ":"); i >= 0 {
+			m.filename, m.header = spec[:i], spec[i+1:]
+		}
+
+		if m.filename == "" || strings.ContainsAny(m.filename, `/\`) {
+			return nil, errors.Fatalf("invalid file name for --exclude-if-present: %q", spec)
+		}
+
+		markers = append(markers, m)
+	}
+
+	if caches {
+		markers = append(markers, marker{filename: "CACHEDIR.TAG", header: cacheDirTagSignature})
+	}
+
+	return markers, nil
+}
+
+// markerExcluder excludes the contents of directories which contain one of
+// the marker files. The result is cached for each directory.
+type markerExcluder struct {
+	markers []marker
+	warn    func(path string, err error)
+
+	m     sync.Mutex
+	cache map[string]bool
+}
+
+func newMarkerExcluder(markers []marker, warn func(string, error)) *markerExcluder {
+	return &markerExcluder{
+		markers: markers,
+		warn:    warn,
+		cache:   make(map[string]bool),
+	}
+}
+
+// Excluded returns true if the directory item is located in contains a
+// marker file. The directory itself is still saved, but it will be empty.
+func (e *markerExcluder) Excluded(item string) bool {
+	dir := filepath.Dir(item)
+
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	excluded, ok := e.cache[dir]
+	if !ok {
+		excluded = e.hasMarker(dir)
+		e.cache[dir] = excluded
+	}
+
+	if excluded {
+		debug.Log("path %q excluded by a marker file in %v", item, dir)
+	}
+
+	return excluded
+}
+
+// hasMarker returns true if dir contains one of the marker files.
+func (e *markerExcluder) hasMarker(dir string) bool {
+	for _, m := range e.markers {
+		ok, err := m.presentIn(dir)
+		if err != nil {
+			e.warn(filepath.Join(dir, m.filename), err)
+			continue
+		}
+
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// presentIn returns true if the marker file exists in dir and starts with the
+// header.
+func (m marker) presentIn(dir string) (bool, error) {
+	filename := filepath.Join(dir, m.filename)
+
+	f, err := fs.Open(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if m.header == "" {
+		return true, nil
+	}
+
+	buf := make([]byte, len(m.header))
+	_, err = io.ReadFull(f, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		debug.Log("marker file %v is too short for the header", filename)
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "ReadFull")
+	}
+
+	return bytes.Equal(buf, []byte(m.header)), nil
+}
+
+// parseIgnoreFileNames checks the values of --use-ignore-files, which must be
+// plain file names.
+func parseIgnoreFileNames(names []string) ([]string, error) {
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			return nil, errors.Fatalf("invalid file name for --use-ignore-files: %q", name)
+		}
+	}
+
+	return names, nil
+}
+
+// ignoreFileExcluder excludes files which match a pattern from an ignore file
+// (e.g. ".resticignore") in one of the directories above them. The patterns
+// in an ignore file only apply to the files below the directory it is located
+// in, a pattern starting with a separator is anchored at this directory. The
+// patterns of each directory are cached.
+type ignoreFileExcluder struct {
+	names []string
+	warn  func(path string, err error)
+
+	m     sync.Mutex
+	cache map[string][]filter.Pattern
+}
+
+func newIgnoreFileExcluder(names []string, warn func(string, error)) *ignoreFileExcluder {
+	return &ignoreFileExcluder{
+		names: names,
+		warn:  warn,
+		cache: make(map[string][]filter.Pattern),
+	}
+}
+
+// Excluded returns true if item matches a pattern of an ignore file in one of
+// the directories above it.
+func (e *ignoreFileExcluder) Excluded(item string) bool {
+	if abs, err := filepath.Abs(item); err == nil {
+		item = abs
+	}
+
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	for dir := filepath.Dir(item); ; dir = filepath.Dir(dir) {
+		patterns, ok := e.cache[dir]
+		if !ok {
+			patterns = e.load(dir)
+			e.cache[dir] = patterns
+		}
+
+		if len(patterns) > 0 {
+			rel, err := filepath.Rel(dir, item)
+			if err == nil {
+				matched, err := filter.ListPatterns(patterns, string(filepath.Separator)+rel)
+				if err != nil {
+					e.warn(dir, err)
+				}
+
+				if matched {
+					debug.Log("path %q excluded by an ignore file in %v", item, dir)
+					return true
+				}
+			}
+		}
+
+		if filepath.Dir(dir) == dir {
+			return false
+		}
+	}
+}
+
+// load returns the patterns of all ignore files in dir.
+func (e *ignoreFileExcluder) load(dir string) []filter.Pattern {
+	var patterns []filter.Pattern
+	for _, name := range e.names {
+		filename := filepath.Join(dir, name)
+		if _, err := fs.Lstat(filename); os.IsNotExist(err) {
+			continue
+		}
+
+		list, err := readPatternFiles([]string{filename})
+		if err != nil {
+			e.warn(filename, err)
+			continue
+		}
+
+		p, err := filter.ParsePatterns(list)
+		if err != nil {
+			e.warn(filename, err)
+			continue
+		}
+
+		debug.Log("read %d patterns from %v", len(p), filename)
+		patterns = append(patterns, p...)
+	}
+
+	return patterns
+}
+
+// parentOnDevice returns true if the directory containing item is located on
+// the device id, so item is a mount point if it is on a different device.
+func parentOnDevice(item string, id uint64) bool {
+	fi, err := fs.Lstat(filepath.Dir(item))
+	if err != nil {
+		debug.Log("unable to stat parent directory of %v: %v", item, err)
+		return false
+	}
+
+	parentID, err := fs.DeviceID(fi)
+	if err != nil {
+		debug.Log("unable to get device of parent directory of %v: %v", item, err)
+		return false
+	}
+
+	return parentID == id
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	. "restic/test"
+)
+
+func TestParseMarkers(t *testing.T) {
+	markers, err := parseMarkers([]string{".nobackup", "TAG:foo:bar"}, true)
+	OK(t, err)
+	Equals(t, []marker{
+		{filename: ".nobackup"},
+		{filename: "TAG", header: "foo:bar"},
+		{filename: "CACHEDIR.TAG", header: cacheDirTagSignature},
+	}, markers)
+
+	for _, spec := range []string{"", ":foo", "sub/.nobackup"} {
+		_, err = parseMarkers([]string{spec}, false)
+		Assert(t, err != nil, "no error returned for invalid marker %q", spec)
+	}
+}
+
+func TestMarkerExcluder(t *testing.T) {
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	files := map[string]string{
+		"work/file":                 "foo",
+		"nobackup/.nobackup":        "",
+		"nobackup/file":             "foo",
+		"cache/CACHEDIR.TAG":        cacheDirTagSignature + "\n# a comment\n",
+		"cache/file":                "foo",
+		"fakecache/CACHEDIR.TAG":    "Signature: foo",
+		"fakecache/file":            "foo",
+		"shortcache/CACHEDIR.TAG":   "Sig",
+		"shortcache/file":           "foo",
+		"nobackup/sub/file":         "foo",
+		"cache/sub/CACHEDIR.TAG.so": "foo",
+	}
+
+	for name, data := range files {
+		filename := filepath.Join(tempdir, filepath.FromSlash(name))
+		OK(t, os.MkdirAll(filepath.Dir(filename), 0700))
+		OK(t, ioutil.WriteFile(filename, []byte(data), 0600))
+	}
+
+	markers, err := parseMarkers([]string{".nobackup"}, true)
+	OK(t, err)
+
+	e := newMarkerExcluder(markers, func(path string, err error) {
+		t.Errorf("unexpected warning for %v: %v", path, err)
+	})
+
+	var tests = []struct {
+		path     string
+		excluded bool
+	}{
+		{"work", false},
+		{"work/file", false},
+		{"nobackup", false},
+		{"nobackup/.nobackup", true},
+		{"nobackup/file", true},
+		{"nobackup/sub", true},
+		{"cache/file", true},
+		{"cache/CACHEDIR.TAG", true},
+		{"fakecache/file", false},
+		{"shortcache/file", false},
+		{"cache/sub/CACHEDIR.TAG.so", false},
+	}
+
+	for _, test := range tests {
+		item := filepath.Join(tempdir, filepath.FromSlash(test.path))
+		excluded := e.Excluded(item)
+		if excluded != test.excluded {
+			t.Errorf("Excluded(%v) returned %v, want %v", test.path, excluded, test.excluded)
+		}
+	}
+}
+
+func TestIgnoreFileExcluder(t *testing.T) {
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	files := map[string]string{
+		".resticignore":           "# comment\n*.tmp\n",
+		"work/.resticignore":      "/build\nlogs/*.log\n",
+		"work/file.tmp":           "foo",
+		"work/file.txt":           "foo",
+		"work/build/file":         "foo",
+		"work/src/build/file":     "foo",
+		"work/logs/a.log":         "foo",
+		"work/logs/a.txt":         "foo",
+		"other/build/file":        "foo",
+		"other/sub/.resticignore": "[invalid\n",
+		"other/sub/file":          "foo",
+	}
+
+	for name, data := range files {
+		filename := filepath.Join(tempdir, filepath.FromSlash(name))
+		OK(t, os.MkdirAll(filepath.Dir(filename), 0700))
+		OK(t, ioutil.WriteFile(filename, []byte(data), 0600))
+	}
+
+	names, err := parseIgnoreFileNames([]string{".resticignore"})
+	OK(t, err)
+
+	warnings := 0
+	e := newIgnoreFileExcluder(names, func(path string, err error) {
+		warnings++
+	})
+
+	var tests = []struct {
+		path     string
+		excluded bool
+	}{
+		{"work", false},
+		{"work/.resticignore", false},
+		{"work/file.tmp", true},
+		{"work/file.txt", false},
+		{"work/build", true},
+		{"work/src/build", false},
+		{"work/src/build/file", false},
+		{"work/logs/a.log", true},
+		{"work/logs/a.txt", false},
+		{"other/build", false},
+		{"other/sub/file", false},
+		{"other/sub/file.tmp", true},
+	}
+
+	for _, test := range tests {
+		item := filepath.Join(tempdir, filepath.FromSlash(test.path))
+		excluded := e.Excluded(item)
+		if excluded != test.excluded {
+			t.Errorf("Excluded(%v) returned %v, want %v", test.path, excluded, test.excluded)
+		}
+	}
+
+	Assert(t, warnings == 1, "expected one warning for the invalid ignore file, got %d", warnings)
+
+	for _, name := range []string{"", "sub/.resticignore"} {
+		_, err = parseIgnoreFileNames([]string{name})
+		Assert(t, err != nil, "no error returned for invalid file name %q", name)
+	}
+}
+
+func TestParentOnDevice(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("test requires /proc")
+	}
+
+	devices, err := gatherDevices([]string{"/", "/proc"})
+	OK(t, err)
+	if devices["/"] == devices["/proc"] {
+		t.Skip("/proc is not mounted")
+	}
+
+	Assert(t, parentOnDevice("/proc", devices["/"]), "/proc is not detected as a mount point")
+	Assert(t, !parentOnDevice("/proc/self", devices["/"]), "/proc/self is detected as a mount point")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"restic/errors"
+)
+
+// expandEnv replaces references to environment variables in the form ${VAR}
+// in s. Referencing a variable which is not set is an error, so that a
+// missing variable does not silently select a different repository. A plain
+// "$" (e.g. in a password contained in a URL) is left alone.
+func expandEnv(s string) (string, error) {
+	var res []string
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			break
+		}
+
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return "", errors.Fatalf("unterminated variable reference in %q", s)
+		}
+		end += start
+
+		name := s[start+2 : end]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.Fatalf("environment variable %q is not set", name)
+		}
+
+		res = append(res, s[:start], value)
+		s = s[end+1:]
+	}
+
+	return strings.Join(append(res, s), ""), nil
+}
+
+// expandHome replaces a leading "~" in path with the home directory of the
+// current user.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return path, nil
+	}
+
+	home := os.Getenv("HOME")
+	if home == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return "", errors.Wrap(err, "user.Current")
+		}
+		home = usr.HomeDir
+	}
+
+	return home + path[1:], nil
+}
+
+// expandPath expands environment variables and a leading "~" in path.
+func expandPath(path string) (string, error) {
+	path, err := expandEnv(path)
+	if err != nil {
+		return "", err
+	}
+
+	return expandHome(path)
+}
+
+// expandRepo expands environment variables in the repository location and a
+// leading "~" in the path of local repositories.
+func expandRepo(repo string) (string, error) {
+	repo, err := expandEnv(repo)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(repo, "local:") {
+		path, err := expandHome(strings.TrimPrefix(repo, "local:"))
+		if err != nil {
+			return "", err
+		}
+		return "local:" + path, nil
+	}
+
+	return expandHome(repo)
+}
+
+// expandGlobalOptions expands environment variables and "~" in the
+// repository location and the paths of the global options.
+func expandGlobalOptions(opts *GlobalOptions) (err error) {
+	if opts.Repo, err = expandRepo(opts.Repo); err != nil {
+		return err
+	}
+
+	for _, path := range []*string{&opts.PasswordFile, &opts.CacheDir, &opts.MetricsFile} {
+		if *path, err = expandPath(*path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -58,21 +58,23 @@ func FindFilteredSnapshots(ctx context.Context, repo *repository.Repository, hos
 			return
 		}
 
-		for id := range repo.List(ctx, restic.SnapshotFile) {
-			sn, err := restic.LoadSnapshot(ctx, repo, id)
+		// snapshots are loaded in parallel and passed on as soon as they are
+		// available
+		_ = restic.ForAllSnapshots(ctx, repo, func(id restic.ID, sn *restic.Snapshot, err error) error {
 			if err != nil {
 				Warnf("Ignoring %q, could not load snapshot: %v\n", id, err)
-				continue
+				return nil
 			}
 			if (host != "" && host != sn.Hostname) || !sn.HasTags(tags) || !sn.HasPaths(paths) {
-				continue
+				return nil
 			}
 			select {
 			case <-ctx.Done():
-				return
+				return ctx.Err()
 			case out <- sn:
 			}
-		}
+			return nil
+		})
 	}()
 	return out
 }
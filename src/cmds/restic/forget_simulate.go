@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"restic"
+	"restic/errors"
+	"sort"
+	"time"
+)
+
+// simulationStep describes the state of the repository on one day of a
+// simulated retention policy.
+type simulationStep struct {
+	Day       int       `json:"day"`
+	Time      time.Time `json:"time"`
+	Snapshots int       `json:"snapshots"`
+
+	// Oldest is the time of the oldest snapshot kept, nil if the policy
+	// keeps none of them (e.g. with only --keep-tag).
+	Oldest *time.Time `json:"oldest,omitempty"`
+
+	// EstimatedBytes is the approximate amount of data referenced by the
+	// snapshots kept, zero if it could not be estimated.
+	EstimatedBytes uint64 `json:"estimated_bytes,omitempty"`
+}
+
+// simulatePolicy creates one snapshot per day for days days after start and
+// applies the policy after each one, as if 'forget' was run after each daily
+// backup. It returns the state after each day.
+func simulatePolicy(policy restic.ExpirePolicy, start time.Time, days int) []simulationStep {
+	var (
+		list  restic.Snapshots
+		steps []simulationStep
+	)
+
+	for day := 1; day <= days; day++ {
+		t := start.AddDate(0, 0, day)
+		list = append(list, &restic.Snapshot{Time: t})
+		list, _ = restic.ApplyPolicy(list, policy)
+
+		step := simulationStep{
+			Day:       day,
+			Time:      t,
+			Snapshots: len(list),
+		}
+		if len(list) > 0 {
+			step.Oldest = &list[len(list)-1].Time
+		}
+		steps = append(steps, step)
+	}
+
+	return steps
+}
+
+// snapshotSizeEstimate models the data referenced by a number of snapshots as
+// the size of a single snapshot plus a constant amount of changed data for
+// each additional one.
+type snapshotSizeEstimate struct {
+	Full   uint64
+	Change uint64
+}
+
+// Bytes returns the estimated amount of data referenced by n snapshots.
+func (e snapshotSizeEstimate) Bytes(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return e.Full + uint64(n-1)*e.Change
+}
+
+// estimateSnapshotSize derives a snapshotSizeEstimate from the existing
+// snapshots: the size of the latest snapshot is taken as the full size, the
+// remaining data in the repository is spread evenly across the other
+// snapshots. The index must be loaded already.
+func estimateSnapshotSize(ctx context.Context, repo restic.Repository, snapshots restic.Snapshots) (snapshotSizeEstimate, error) {
+	if len(snapshots) == 0 {
+		return snapshotSizeEstimate{}, errors.New("no snapshots found")
+	}
+
+	sort.Sort(snapshots)
+	latest := snapshots[0]
+
+	blobs := restic.NewBlobSet()
+	err := restic.FindUsedBlobs(ctx, repo, *latest.Tree, blobs, restic.NewBlobSet())
+	if err != nil {
+		return snapshotSizeEstimate{}, err
+	}
+
+	var full uint64
+	for h := range blobs {
+		pbs, err := repo.Index().Lookup(h.ID, h.Type)
+		if err != nil {
+			return snapshotSizeEstimate{}, err
+		}
+		full += uint64(pbs[0].Length)
+	}
+
+	total, err := countIndexedData(repo)
+	if err != nil {
+		return snapshotSizeEstimate{}, err
+	}
+
+	e := snapshotSizeEstimate{Full: full}
+	if len(snapshots) > 1 && total > full {
+		e.Change = (total - full) / uint64(len(snapshots)-1)
+	}
+
+	return e, nil
+}
+
+// simulationReportDay returns whether the step for day should be printed in
+// a simulation over days days. For longer periods only one line per week is
+// printed.
+func simulationReportDay(day, days int) bool {
+	if day == days || days <= 14 {
+		return true
+	}
+	return day%7 == 0
+}
+
+// runForgetSimulate prints how the policy would behave for daily backups over
+// the given period. The repository is only used to estimate the size of the
+// snapshots, nothing is modified.
+func runForgetSimulate(opts ForgetOptions, gopts GlobalOptions, policy restic.ExpirePolicy, period time.Duration) error {
+	days := int(period / (24 * time.Hour))
+	if days < 1 {
+		return errors.Fatalf("simulation period %v is shorter than one day", opts.Simulate)
+	}
+
+	repo, err := OpenRepository(gopts)
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockRepo(repo)
+	defer unlockRepo(lock)
+	if err != nil {
+		return err
+	}
+
+	if err = repo.LoadIndex(gopts.ctx); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(gopts.ctx)
+	defer cancel()
+
+	var snapshots restic.Snapshots
+	for sn := range FindFilteredSnapshots(ctx, repo, opts.Host, opts.Tags, opts.Paths, nil) {
+		if sn.Checkpoint {
+			continue
+		}
+		snapshots = append(snapshots, sn)
+	}
+
+	estimate, err := estimateSnapshotSize(ctx, repo, snapshots)
+	if err != nil {
+		Warnf("unable to estimate the size of snapshots: %v\n", err)
+	}
+
+	steps := simulatePolicy(policy, time.Now(), days)
+	for i := range steps {
+		steps[i].EstimatedBytes = estimate.Bytes(steps[i].Snapshots)
+	}
+
+	if gopts.JSONSchema > 0 {
+		for _, step := range steps {
+			if err = printJSONEvent(gopts, "forget_simulation", step); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if gopts.JSON {
+		return json.NewEncoder(gopts.stdout).Encode(steps)
+	}
+
+	Verbosef("simulating daily backups for %d days\n", days)
+	if estimate.Full > 0 {
+		Verbosef("assuming %s per snapshot and %s of changed data per day\n",
+			formatBytes(estimate.Full), formatBytes(estimate.Change))
+	}
+
+	tab := NewTable()
+	tab.Header = fmt.Sprintf("%-5s  %-10s  %-9s  %-10s  %s", "Day", "Date", "Snapshots", "Oldest", "Size")
+	tab.RowFormat = "%-5d  %-10s  %-9d  %-10s  %s"
+	for _, step := range steps {
+		if !simulationReportDay(step.Day, days) {
+			continue
+		}
+
+		size := "-"
+		if step.EstimatedBytes > 0 {
+			size = "~" + formatBytes(step.EstimatedBytes)
+		}
+
+		oldest := "-"
+		if step.Oldest != nil {
+			oldest = step.Oldest.Format("2006-01-02")
+		}
+
+		tab.Rows = append(tab.Rows, []interface{}{step.Day,
+			step.Time.Format("2006-01-02"), step.Snapshots, oldest, size})
+	}
+
+	return tab.Write(gopts.stdout)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"restic"
+	"testing"
+	"time"
+
+	. "restic/test"
+)
+
+func TestSimulatePolicy(t *testing.T) {
+	start := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		policy restic.ExpirePolicy
+		days   int
+		kept   int
+		oldest time.Time
+	}{
+		{restic.ExpirePolicy{Last: 5}, 3, 3, start.AddDate(0, 0, 1)},
+		{restic.ExpirePolicy{Last: 5}, 90, 5, start.AddDate(0, 0, 86)},
+		{restic.ExpirePolicy{Daily: 7, Weekly: 4}, 90, 9, start.AddDate(0, 0, 70)},
+		{restic.ExpirePolicy{Daily: 7, Monthly: 12}, 90, 9, start.AddDate(0, 0, 30)},
+		{restic.ExpirePolicy{Tags: []string{"foo"}}, 10, 0, time.Time{}},
+	}
+
+	for i, test := range tests {
+		steps := simulatePolicy(test.policy, start, test.days)
+		Equals(t, test.days, len(steps))
+
+		last := steps[len(steps)-1]
+		if last.Snapshots != test.kept {
+			t.Errorf("test %d: want %d snapshots kept, got %d", i, test.kept, last.Snapshots)
+		}
+		if test.kept == 0 {
+			if last.Oldest != nil {
+				t.Errorf("test %d: want no oldest snapshot, got %v", i, *last.Oldest)
+			}
+			continue
+		}
+		if last.Oldest == nil || !last.Oldest.Equal(test.oldest) {
+			t.Errorf("test %d: want oldest snapshot %v, got %v", i, test.oldest, last.Oldest)
+		}
+	}
+}
+
+func TestSnapshotSizeEstimate(t *testing.T) {
+	e := snapshotSizeEstimate{Full: 1000, Change: 10}
+	Equals(t, uint64(0), e.Bytes(0))
+	Equals(t, uint64(1000), e.Bytes(1))
+	Equals(t, uint64(1090), e.Bytes(10))
+}
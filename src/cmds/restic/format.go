@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"restic"
+	"restic/errors"
 )
 
 func formatBytes(c uint64) string {
@@ -64,21 +67,91 @@ func formatDuration(d time.Duration) string {
 }
 
 func formatNode(prefix string, n *restic.Node, long bool) string {
+	path := filepath.Join(prefix, n.Name)
 	if !long {
-		return filepath.Join(prefix, n.Name)
+		return path
 	}
 
+	mode := n.Mode
 	switch n.Type {
 	case "file":
-		return fmt.Sprintf("%s %5d %5d %6d %s %s",
-			n.Mode, n.UID, n.GID, n.Size, n.ModTime.Format(TimeFormat), filepath.Join(prefix, n.Name))
 	case "dir":
-		return fmt.Sprintf("%s %5d %5d %6d %s %s",
-			n.Mode|os.ModeDir, n.UID, n.GID, n.Size, n.ModTime.Format(TimeFormat), filepath.Join(prefix, n.Name))
+		mode |= os.ModeDir
 	case "symlink":
-		return fmt.Sprintf("%s %5d %5d %6d %s %s -> %s",
-			n.Mode|os.ModeSymlink, n.UID, n.GID, n.Size, n.ModTime.Format(TimeFormat), filepath.Join(prefix, n.Name), n.LinkTarget)
+		mode |= os.ModeSymlink
+	case "dev":
+		mode |= os.ModeDevice
+	case "chardev":
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case "fifo":
+		mode |= os.ModeNamedPipe
+	case "socket":
+		mode |= os.ModeSocket
 	default:
 		return fmt.Sprintf("<Node(%s) %s>", n.Type, n.Name)
 	}
+
+	s := fmt.Sprintf("%s %5d %5d %6d %s %s",
+		mode, n.UID, n.GID, n.Size, n.ModTime.Format(TimeFormat), path)
+	if n.Type == "symlink" {
+		s += " -> " + n.LinkTarget
+	}
+
+	return s
+}
+
+// parseSize parses a size like "512k" or "10G". The suffixes k, m, g and t
+// (case insensitive) denote KiB, MiB, GiB and TiB, without a suffix the value
+// is interpreted as bytes.
+func parseSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.Fatal("empty size")
+	}
+
+	var unit uint64 = 1
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		unit = 1 << 10
+	case 'm', 'M':
+		unit = 1 << 20
+	case 'g', 'G':
+		unit = 1 << 30
+	case 't', 'T':
+		unit = 1 << 40
+	}
+
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+
+	value, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.Fatalf("invalid size %q: %v", s, err)
+	}
+
+	return value * unit, nil
+}
+
+// parseDuration parses a duration like "7d" or "36h". In addition to the
+// units accepted by time.ParseDuration, the suffix d denotes days. Negative
+// durations are rejected.
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseUint(s[:len(s)-1], 10, 32)
+		if err != nil {
+			return 0, errors.Fatalf("invalid duration %q: %v", s, err)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Fatalf("invalid duration: %v", err)
+	}
+	if d < 0 {
+		return 0, errors.Fatalf("invalid duration %q: must not be negative", s)
+	}
+	return d, nil
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"restic"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	var tests = []struct {
+		input string
+		size  uint64
+		err   bool
+	}{
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{"2k", 2 << 10, false},
+		{"2K", 2 << 10, false},
+		{"10m", 10 << 20, false},
+		{"5G", 5 << 30, false},
+		{"1t", 1 << 40, false},
+		{"", 0, true},
+		{"G", 0, true},
+		{"-1", 0, true},
+		{"1.5G", 0, true},
+		{"10x", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			size, err := parseSize(test.input)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error for %q, got size %v", test.input, size)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if size != test.size {
+				t.Fatalf("wrong size for %q, want %v, got %v", test.input, test.size, size)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	var tests = []struct {
+		input string
+		d     time.Duration
+		err   bool
+	}{
+		{"7d", 7 * 24 * time.Hour, false},
+		{"0d", 0, false},
+		{"36h", 36 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"", 0, true},
+		{"d", 0, true},
+		{"-1d", 0, true},
+		{"-36h", 0, true},
+		{"1.5d", 0, true},
+		{"7", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			d, err := parseDuration(test.input)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error for %q, got duration %v", test.input, d)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d != test.d {
+				t.Fatalf("wrong duration for %q, want %v, got %v", test.input, test.d, d)
+			}
+		})
+	}
+}
+
+func TestFormatNode(t *testing.T) {
+	mtime := time.Date(2017, 7, 1, 12, 30, 0, 0, time.Local)
+	prefix := string(filepath.Separator)
+
+	var tests = []struct {
+		node restic.Node
+		want string
+	}{
+		{
+			restic.Node{Name: "file", Type: "file", Mode: 0644, UID: 1000, GID: 100, Size: 1234, ModTime: mtime},
+			"-rw-r--r--  1000   100   1234 2017-07-01 12:30:00 " + filepath.Join(prefix, "file"),
+		},
+		{
+			restic.Node{Name: "dir", Type: "dir", Mode: 0755 | os.ModeDir, ModTime: mtime},
+			"drwxr-xr-x     0     0      0 2017-07-01 12:30:00 " + filepath.Join(prefix, "dir"),
+		},
+		{
+			restic.Node{Name: "link", Type: "symlink", Mode: 0777, ModTime: mtime, LinkTarget: "../target"},
+			"Lrwxrwxrwx     0     0      0 2017-07-01 12:30:00 " + filepath.Join(prefix, "link") + " -> ../target",
+		},
+		{
+			restic.Node{Name: "pipe", Type: "fifo", Mode: 0600, ModTime: mtime},
+			"prw-------     0     0      0 2017-07-01 12:30:00 " + filepath.Join(prefix, "pipe"),
+		},
+		{
+			restic.Node{Name: "tty", Type: "chardev", Mode: 0620, GID: 5, ModTime: mtime},
+			"Dcrw--w----     0     5      0 2017-07-01 12:30:00 " + filepath.Join(prefix, "tty"),
+		},
+	}
+
+	for _, test := range tests {
+		if got := formatNode(prefix, &test.node, true); got != test.want {
+			t.Errorf("wrong output for %v:\n  want: %q\n   got: %q", test.node.Name, test.want, got)
+		}
+
+		if got := formatNode(prefix, &test.node, false); got != filepath.Join(prefix, test.node.Name) {
+			t.Errorf("wrong short output for %v: %q", test.node.Name, got)
+		}
+	}
+}
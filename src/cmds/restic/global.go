@@ -6,21 +6,34 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"restic"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 
 	"restic/backend/b2"
+	"restic/backend/ext"
+	"restic/backend/ftp"
+	"restic/backend/limiter"
 	"restic/backend/local"
 	"restic/backend/location"
+	"restic/backend/mirror"
 	"restic/backend/rest"
 	"restic/backend/s3"
 	"restic/backend/sftp"
+	"restic/backend/shard"
+	"restic/backend/smb"
 	"restic/backend/swift"
+	"restic/cache"
+	"restic/compression"
 	"restic/debug"
+	"restic/limits"
 	"restic/options"
 	"restic/repository"
+	"restic/shell"
 
 	"restic/errors"
 
@@ -31,20 +44,42 @@ var version = "compiled manually"
 
 // GlobalOptions hold all global options for restic.
 type GlobalOptions struct {
-	Repo         string
-	PasswordFile string
-	Quiet        bool
-	NoLock       bool
-	JSON         bool
+	Repo            string
+	PasswordFile    string
+	PasswordCommand string
+	Quiet           bool
+	NoLock          bool
+	JSON            bool
+	JSONSchema      uint
+	CacheDir        string
+	CacheSize       string
+	MaxMemory       string
+	ProgressFPS     float64
+
+	MetricsFile        string
+	MetricsPushgateway string
+	Stats              bool
+
+	LimitUploadKb   uint
+	LimitDownloadKb uint
 
 	ctx      context.Context
 	password string
 	stdout   io.Writer
 	stderr   io.Writer
+	metrics  *runMetrics
+	stats    *runStats
 
 	Options []string
 
 	extended options.Options
+
+	// operation is what the command does with the repository, the key must
+	// allow it
+	operation string
+
+	// command is the name of the command which is run
+	command string
 }
 
 var globalOptions = GlobalOptions{
@@ -68,15 +103,46 @@ func init() {
 	f := cmdRoot.PersistentFlags()
 	f.StringVarP(&globalOptions.Repo, "repo", "r", os.Getenv("RESTIC_REPOSITORY"), "repository to backup to or restore from (default: $RESTIC_REPOSITORY)")
 	f.StringVarP(&globalOptions.PasswordFile, "password-file", "p", "", "read the repository password from a file")
+	f.StringVar(&globalOptions.PasswordCommand, "password-command", os.Getenv("RESTIC_PASSWORD_COMMAND"), "read the repository password from the output of `command` (default: $RESTIC_PASSWORD_COMMAND)")
 	f.BoolVarP(&globalOptions.Quiet, "quiet", "q", false, "do not output comprehensive progress report")
 	f.BoolVar(&globalOptions.NoLock, "no-lock", false, "do not lock the repo, this allows some operations on read-only repos")
-	f.BoolVarP(&globalOptions.JSON, "json", "", false, "set output mode to JSON for commands that support it")
+	f.VarPF(jsonFlag{&globalOptions}, "json", "", "set output mode to JSON for commands that support it (\"v1\" selects the versioned output with one object per line)").NoOptDefVal = "true"
+	f.StringVar(&globalOptions.CacheDir, "cache-dir", os.Getenv("RESTIC_CACHE_DIR"), "cache blobs loaded from the repository in `directory` (default: $RESTIC_CACHE_DIR)")
+	f.StringVar(&globalOptions.CacheSize, "cache-size", "1G", "limit the cache to `size` bytes (allowed suffixes: k, m, g, t)")
+	f.StringVar(&globalOptions.MaxMemory, "max-memory", os.Getenv("RESTIC_MAX_MEMORY"), "use about `size` bytes of memory in addition to the index, by running fewer workers (allowed suffixes: k, m, g, t, default: $RESTIC_MAX_MEMORY)")
+	f.Float64Var(&globalOptions.ProgressFPS, "progress-fps", progressFPSDefault(), "print progress `fps` times per second (default: 1 on a terminal, 0.1 otherwise, $RESTIC_PROGRESS_FPS)")
+	f.StringVar(&globalOptions.MetricsFile, "metrics-file", "", "write metrics in the Prometheus text format to `file` after backup, check, forget and prune")
+	f.StringVar(&globalOptions.MetricsPushgateway, "metrics-pushgateway", "", "push metrics after backup, check, forget and prune to the Prometheus pushgateway at `url`")
+	f.BoolVar(&globalOptions.Stats, "stats", false, "print the runtime, resource usage and backend traffic after backup, check, forget and prune")
+
+	f.UintVar(&globalOptions.LimitUploadKb, "limit-upload", 0, "limits uploads to a maximum rate in KiB/s (default: unlimited)")
+	f.UintVar(&globalOptions.LimitDownloadKb, "limit-download", 0, "limits downloads to a maximum rate in KiB/s (default: unlimited)")
 
 	f.StringSliceVarP(&globalOptions.Options, "option", "o", []string{}, "set extended option (`key=value`, can be specified multiple times)")
 
 	restoreTerminal()
 }
 
+// progressFPSDefault returns the progress rate from $RESTIC_PROGRESS_FPS, or
+// zero to select the automatic default.
+func progressFPSDefault() float64 {
+	fps, err := strconv.ParseFloat(os.Getenv("RESTIC_PROGRESS_FPS"), 64)
+	if err != nil {
+		return 0
+	}
+	return fps
+}
+
+// applyProgressFPS configures the rate of progress updates.
+func applyProgressFPS(gopts GlobalOptions) error {
+	if gopts.ProgressFPS < 0 {
+		return errors.Fatalf("invalid progress rate %v, must not be negative", gopts.ProgressFPS)
+	}
+
+	restic.SetProgressFPS(gopts.ProgressFPS)
+	return nil
+}
+
 // checkErrno returns nil when err is set to syscall.Errno(0), since this is no
 // error condition.
 func checkErrno(err error) error {
@@ -133,15 +199,20 @@ func restoreTerminal() {
 
 // ClearLine creates a platform dependent string to clear the current
 // line, so it can be overwritten. ANSI sequences are not supported on
-// current windows cmd shell.
+// current windows cmd shell. When stdout is not a terminal, progress is
+// printed as complete lines and nothing needs to be cleared.
 func ClearLine() string {
+	if !stdoutIsTerminal() {
+		return ""
+	}
+
 	if runtime.GOOS == "windows" {
 		if w := stdoutTerminalWidth(); w > 0 {
 			return strings.Repeat(" ", w-1) + "\r"
 		}
 		return ""
 	}
-	return "\x1b[2K"
+	return "\x1b[2K\r"
 }
 
 // Printf writes the message to the configured stdout stream.
@@ -235,18 +306,79 @@ func readPasswordTerminal(in *os.File, out io.Writer, prompt string) (password s
 	return password, nil
 }
 
-// ReadPassword reads the password from a password file, the environment
-// variable RESTIC_PASSWORD or prompts the user.
-func ReadPassword(opts GlobalOptions, prompt string) (string, error) {
+// readPasswordCommand runs command and returns what it prints on stdout as
+// the password. The command is split into arguments like a shell does.
+func readPasswordCommand(command string) (string, error) {
+	program, args, err := shell.SplitArgs(command)
+	if err != nil {
+		return "", errors.Fatalf("invalid --password-command %q: %v", command, err)
+	}
+
+	cmd := exec.Command(program, args...)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Fatalf("--password-command %q failed: %v", command, err)
+	}
+
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// passwordSource is one of the places the password can be read from.
+type passwordSource struct {
+	name string
+	read func() (string, error)
+}
+
+// passwordSources returns the configured sources for the password in the
+// order they are tried: the password command, the password file and
+// $RESTIC_PASSWORD.
+func passwordSources(opts GlobalOptions) []passwordSource {
+	var sources []passwordSource
+
+	if opts.PasswordCommand != "" {
+		sources = append(sources, passwordSource{"--password-command", func() (string, error) {
+			return readPasswordCommand(opts.PasswordCommand)
+		}})
+	}
+
 	if opts.PasswordFile != "" {
-		s, err := ioutil.ReadFile(opts.PasswordFile)
-		return strings.TrimSpace(string(s)), errors.Wrap(err, "Readfile")
+		sources = append(sources, passwordSource{"--password-file", func() (string, error) {
+			s, err := ioutil.ReadFile(opts.PasswordFile)
+			return strings.TrimSpace(string(s)), errors.Wrap(err, "Readfile")
+		}})
+	}
+
+	if opts.password != "" {
+		sources = append(sources, passwordSource{"$RESTIC_PASSWORD", func() (string, error) {
+			return opts.password, nil
+		}})
 	}
 
-	if pwd := os.Getenv("RESTIC_PASSWORD"); pwd != "" {
-		return pwd, nil
+	return sources
+}
+
+// hasPasswordSource returns true if the password can be read without using
+// stdin.
+func hasPasswordSource(opts GlobalOptions) bool {
+	return len(passwordSources(opts)) > 0
+}
+
+// ReadPassword reads the password from the first configured source (the
+// password command, the password file or the environment variable
+// RESTIC_PASSWORD) or prompts the user.
+func ReadPassword(opts GlobalOptions, prompt string) (string, error) {
+	if sources := passwordSources(opts); len(sources) > 0 {
+		return sources[0].read()
 	}
 
+	return promptPassword(prompt)
+}
+
+// promptPassword asks the user for the password if stdin is a terminal,
+// otherwise it is read from stdin.
+func promptPassword(prompt string) (string, error) {
 	var (
 		password string
 		err      error
@@ -290,6 +422,66 @@ func ReadPasswordTwice(gopts GlobalOptions, prompt1, prompt2 string) (string, er
 
 const maxKeys = 20
 
+// wrongPassword returns true if err means that no key could be opened with
+// the password.
+func wrongPassword(err error) bool {
+	cause := errors.Cause(err)
+	return cause == repository.ErrNoKeyFound || cause == repository.ErrMaxKeysReached
+}
+
+// searchKey opens a key of the repository with the password of one of the
+// configured sources, which are tried in order. This way, a job keeps working
+// when the password in one of them has been removed from the repository. If
+// none of the passwords opens a key and stdin is a terminal, the user is
+// asked for the password. When no source is configured, it is read from
+// stdin.
+func searchKey(ctx context.Context, s *repository.Repository, opts GlobalOptions) error {
+	sources := passwordSources(opts)
+	if len(sources) == 0 {
+		pw, err := promptPassword("enter password for repository: ")
+		if err != nil {
+			return err
+		}
+		return s.SearchKey(ctx, pw, maxKeys)
+	}
+
+	var err error
+	for _, src := range sources {
+		pw, rerr := src.read()
+		if rerr != nil {
+			Warnf("unable to read the password from %v: %v\n", src.name, rerr)
+			if err == nil {
+				err = rerr
+			}
+			continue
+		}
+
+		err = s.SearchKey(ctx, pw, maxKeys)
+		if err == nil {
+			debug.Log("opened key with password from %v", src.name)
+			return nil
+		}
+
+		if !wrongPassword(err) {
+			return err
+		}
+
+		if len(sources) > 1 {
+			Warnf("the password from %v does not open any key\n", src.name)
+		}
+	}
+
+	if !stdinIsTerminal() {
+		return err
+	}
+
+	pw, perr := promptPassword("enter password for repository: ")
+	if perr != nil {
+		return perr
+	}
+	return s.SearchKey(ctx, pw, maxKeys)
+}
+
 // OpenRepository reads the password and opens the repository.
 func OpenRepository(opts GlobalOptions) (*repository.Repository, error) {
 	if opts.Repo == "" {
@@ -301,21 +493,104 @@ func OpenRepository(opts GlobalOptions) (*repository.Repository, error) {
 		return nil, err
 	}
 
-	s := repository.New(be)
+	s := repository.New(opts.stats.wrap(limitBackend(be, opts)))
+
+	err = searchKey(context.TODO(), s, opts)
+	if err != nil {
+		return nil, errors.WithCode(errors.Fatalf("unable to open repo: %v", err), errors.Code(err))
+	}
+
+	if err = checkKeyOperation(s, opts.operation); err != nil {
+		return nil, err
+	}
+
+	if err = checkMasterKey(s, opts.command); err != nil {
+		return nil, err
+	}
+
+	if err = applyCompressionOptions(s, opts.extended); err != nil {
+		return nil, err
+	}
 
-	if opts.password == "" {
-		opts.password, err = ReadPassword(opts, "enter password for repository: ")
+	if opts.CacheDir != "" {
+		c, err := openCache(opts, s.Config().ID)
 		if err != nil {
 			return nil, err
 		}
+		s.UseCache(c)
+
+		m := cache.NewSnapshotManifest(filepath.Join(opts.CacheDir, s.Config().ID, "snapshots"))
+		s.UseSnapshotManifest(m)
+		AddCleanupHandler(func() error {
+			return m.Write()
+		})
+	}
+
+	return s, nil
+}
+
+// applyCompressionOptions sets the compression modes given with the options
+// compression.data and compression.tree for the repository.
+func applyCompressionOptions(repo *repository.Repository, extended options.Options) error {
+	var cfg compression.Options
+	if err := extended.Extract("compression").Apply("compression", &cfg); err != nil {
+		return err
+	}
+
+	for t, s := range map[restic.BlobType]string{restic.DataBlob: cfg.Data, restic.TreeBlob: cfg.Tree} {
+		if s == "" {
+			continue
+		}
+
+		if !repo.Config().CompressionAllowed() {
+			return errors.Fatalf("the compression options require repository version 6, the repository has version %v", repo.Config().Version)
+		}
+
+		mode, err := compression.ParseMode(s)
+		if err != nil {
+			return errors.Fatalf("invalid option compression.%v: %v", t, err)
+		}
+
+		repo.SetCompression(t, mode)
 	}
 
-	err = s.SearchKey(context.TODO(), opts.password, maxKeys)
+	return nil
+}
+
+// openCache opens the cache for the repository with the given ID below the
+// cache directory.
+func openCache(opts GlobalOptions, id string) (*cache.Cache, error) {
+	size, err := parseSize(opts.CacheSize)
 	if err != nil {
-		return nil, errors.Fatalf("unable to open repo: %v", err)
+		return nil, errors.Fatalf("invalid cache size: %v", err)
 	}
 
-	return s, nil
+	c, err := cache.New(filepath.Join(opts.CacheDir, id), int64(size))
+	if err != nil {
+		return nil, errors.Fatalf("unable to open cache: %v", err)
+	}
+
+	debug.Log("using cache in %v with %d bytes", opts.CacheDir, c.Size())
+	return c, nil
+}
+
+// applyMaxMemory limits the number of workers and the data kept in memory to
+// the budget given with --max-memory.
+func applyMaxMemory(opts GlobalOptions) error {
+	if opts.MaxMemory == "" {
+		return nil
+	}
+
+	size, err := parseSize(opts.MaxMemory)
+	if err != nil {
+		return errors.Fatalf("invalid memory limit: %v", err)
+	}
+
+	l := limits.ForMemory(size)
+	debug.Log("memory budget of %d bytes, limits %+v", size, l)
+	limits.Set(l)
+
+	return nil
 }
 
 func parseConfig(loc location.Location, opts options.Options) (interface{}, error) {
@@ -351,6 +626,10 @@ func parseConfig(loc location.Location, opts options.Options) (interface{}, erro
 			cfg.Secret = os.Getenv("AWS_SECRET_ACCESS_KEY")
 		}
 
+		if cfg.CredentialHelper == "" {
+			cfg.CredentialHelper = os.Getenv("RESTIC_CREDENTIAL_HELPER")
+		}
+
 		if err := opts.Apply(loc.Scheme, &cfg); err != nil {
 			return nil, err
 		}
@@ -391,17 +670,136 @@ func parseConfig(loc location.Location, opts options.Options) (interface{}, erro
 		return cfg, nil
 	case "rest":
 		cfg := loc.Config.(rest.Config)
+		if cfg.CredentialHelper == "" {
+			cfg.CredentialHelper = os.Getenv("RESTIC_CREDENTIAL_HELPER")
+		}
+
 		if err := opts.Apply(loc.Scheme, &cfg); err != nil {
 			return nil, err
 		}
 
 		debug.Log("opening rest repository at %#v", cfg)
 		return cfg, nil
+
+	case "ext":
+		cfg := loc.Config.(ext.Config)
+		if err := opts.Apply(loc.Scheme, &cfg); err != nil {
+			return nil, err
+		}
+
+		debug.Log("opening ext repository at %#v", cfg)
+		return cfg, nil
+
+	case "ftp", "ftps":
+		cfg := loc.Config.(ftp.Config)
+		if cfg.Password == "" {
+			cfg.Password = os.Getenv("FTP_PASSWORD")
+		}
+
+		if err := opts.Apply(loc.Scheme, &cfg); err != nil {
+			return nil, err
+		}
+
+		debug.Log("opening ftp repository at %v:%v", cfg.Host, cfg.Path)
+		return cfg, nil
+
+	case "smb":
+		cfg := loc.Config.(smb.Config)
+		if cfg.Password == "" {
+			cfg.Password = os.Getenv("SMB_PASSWORD")
+		}
+
+		if err := opts.Apply(loc.Scheme, &cfg); err != nil {
+			return nil, err
+		}
+
+		debug.Log("opening smb repository at %v/%v/%v", cfg.Host, cfg.Share, cfg.Path)
+		return cfg, nil
+
+	case "shard":
+		return loc.Config.(shard.Config), nil
+
+	case "mirror":
+		return loc.Config.(mirror.Config), nil
 	}
 
 	return nil, errors.Fatalf("invalid backend: %q", loc.Scheme)
 }
 
+// openLocations opens (or creates) the backends at the locations of a shard
+// or mirror config.
+func openLocations(locations []string, opts options.Options, create bool) ([]restic.Backend, error) {
+	backends := make([]restic.Backend, 0, len(locations))
+	for _, s := range locations {
+		loc, err := location.Parse(s)
+		if err != nil {
+			return nil, errors.Fatalf("parsing location %v failed: %v", s, err)
+		}
+
+		cfg, err := parseConfig(loc, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		var be restic.Backend
+		if create {
+			be, err = createBackend(loc, cfg)
+		} else {
+			be, err = openBackend(loc, cfg)
+		}
+		if err != nil {
+			return nil, errors.Fatalf("unable to open backend at %v: %v", s, err)
+		}
+
+		backends = append(backends, be)
+	}
+
+	return backends, nil
+}
+
+// openShards opens (or creates) the backends of a shard config.
+func openShards(cfg shard.Config, opts options.Options, create bool) (restic.Backend, error) {
+	backends, err := openLocations(cfg.Locations, opts, create)
+	if err != nil {
+		return nil, err
+	}
+
+	return shard.New(backends)
+}
+
+// openMirror opens the primary backend and its mirror. When the primary
+// backend cannot be opened, all reads are served by the mirror.
+func openMirror(cfg mirror.Config, opts options.Options) (restic.Backend, error) {
+	var primary restic.Backend
+	backends, err := openLocations([]string{cfg.Primary}, opts, false)
+	if err != nil {
+		debug.Log("unable to open primary backend: %v", err)
+		primary = mirror.Unavailable(cfg.Primary, err)
+	} else {
+		primary = backends[0]
+	}
+
+	backends, err = openLocations([]string{cfg.Mirror}, opts, false)
+	if err != nil {
+		return nil, err
+	}
+
+	be := mirror.New(primary, backends[0])
+	be.Fallback = func(err error) {
+		Warnf("primary backend failed, reading from mirror %v: %v\n", cfg.Mirror, err)
+	}
+	return be, nil
+}
+
+// limitBackend returns a backend which applies the bandwidth limits to be.
+func limitBackend(be restic.Backend, opts GlobalOptions) restic.Backend {
+	if opts.LimitUploadKb == 0 && opts.LimitDownloadKb == 0 {
+		return be
+	}
+
+	return limiter.LimitBackend(be, limiter.NewStaticLimiter(opts.LimitUploadKb, opts.LimitDownloadKb))
+}
+
 // Open the backend specified by a location config.
 func open(s string, opts options.Options) (restic.Backend, error) {
 	debug.Log("parsing location %v", s)
@@ -418,21 +816,12 @@ func open(s string, opts options.Options) (restic.Backend, error) {
 	}
 
 	switch loc.Scheme {
-	case "local":
-		be, err = local.Open(cfg.(local.Config))
-	case "sftp":
-		be, err = sftp.Open(cfg.(sftp.Config))
-	case "s3":
-		be, err = s3.Open(cfg.(s3.Config))
-	case "swift":
-		be, err = swift.Open(cfg.(swift.Config))
-	case "b2":
-		be, err = b2.Open(cfg.(b2.Config))
-	case "rest":
-		be, err = rest.Open(cfg.(rest.Config))
-
+	case "shard":
+		be, err = openShards(cfg.(shard.Config), opts, false)
+	case "mirror":
+		be, err = openMirror(cfg.(mirror.Config), opts)
 	default:
-		return nil, errors.Fatalf("invalid backend: %q", loc.Scheme)
+		be, err = openBackend(loc, cfg)
 	}
 
 	if err != nil {
@@ -442,7 +831,7 @@ func open(s string, opts options.Options) (restic.Backend, error) {
 	// check if config is there
 	fi, err := be.Stat(context.TODO(), restic.Handle{Type: restic.ConfigFile})
 	if err != nil {
-		return nil, errors.Fatalf("unable to open config file: %v\nIs there a repository at the following location?\n%v", err, s)
+		return nil, errors.WithCode(errors.Fatalf("unable to open config file: %v\nIs there a repository at the following location?\n%v", err, s), errors.CodeRepoNotFound)
 	}
 
 	if fi.Size == 0 {
@@ -465,6 +854,44 @@ func create(s string, opts options.Options) (restic.Backend, error) {
 		return nil, err
 	}
 
+	switch loc.Scheme {
+	case "shard":
+		return openShards(cfg.(shard.Config), opts, true)
+	case "mirror":
+		return nil, errors.Fatal("a mirror backend cannot be initialized, initialize the primary backend instead")
+	}
+
+	return createBackend(loc, cfg)
+}
+
+// openBackend opens the backend for a parsed location.
+func openBackend(loc location.Location, cfg interface{}) (restic.Backend, error) {
+	switch loc.Scheme {
+	case "local":
+		return local.Open(cfg.(local.Config))
+	case "sftp":
+		return sftp.Open(cfg.(sftp.Config))
+	case "s3":
+		return s3.Open(cfg.(s3.Config))
+	case "swift":
+		return swift.Open(cfg.(swift.Config))
+	case "b2":
+		return b2.Open(cfg.(b2.Config))
+	case "rest":
+		return rest.Open(cfg.(rest.Config))
+	case "ext":
+		return ext.Open(cfg.(ext.Config))
+	case "ftp", "ftps":
+		return ftp.Open(cfg.(ftp.Config))
+	case "smb":
+		return smb.Open(cfg.(smb.Config))
+	}
+
+	return nil, errors.Fatalf("invalid backend: %q", loc.Scheme)
+}
+
+// createBackend creates the backend for a parsed location.
+func createBackend(loc location.Location, cfg interface{}) (restic.Backend, error) {
 	switch loc.Scheme {
 	case "local":
 		return local.Create(cfg.(local.Config))
@@ -478,8 +905,14 @@ func create(s string, opts options.Options) (restic.Backend, error) {
 		return b2.Create(cfg.(b2.Config))
 	case "rest":
 		return rest.Create(cfg.(rest.Config))
+	case "ext":
+		return ext.Create(cfg.(ext.Config))
+	case "ftp", "ftps":
+		return ftp.Create(cfg.(ftp.Config))
+	case "smb":
+		return smb.Create(cfg.(smb.Config))
 	}
 
-	debug.Log("invalid repository scheme: %v", s)
+	debug.Log("invalid repository scheme: %v", loc.Scheme)
 	return nil, errors.Fatalf("invalid scheme %q", loc.Scheme)
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"restic"
+	"testing"
+
+	. "restic/test"
+)
+
+func TestBackupRestoreXattrs(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		datafile := filepath.Join(env.testdata, "file")
+		OK(t, ioutil.WriteFile(datafile, []byte("foobar"), 0600))
+		if err := restic.Setxattr(datafile, "user.restic-test", []byte("value")); err != nil {
+			t.Skipf("unable to set extended attribute: %v", err)
+		}
+
+		xattrs := func(dir string) []string {
+			names, err := restic.Listxattr(filepath.Join(dir, "testdata", "file"))
+			OK(t, err)
+			return names
+		}
+
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		restoredir := filepath.Join(env.base, "restore")
+		testRunRestoreLatest(t, gopts, restoredir, nil, "")
+		Equals(t, []string{"user.restic-test"}, xattrs(restoredir))
+		value, err := restic.Getxattr(filepath.Join(restoredir, "testdata", "file"), "user.restic-test")
+		OK(t, err)
+		Equals(t, "value", string(value))
+
+		restoredir = filepath.Join(env.base, "restore-no-xattrs")
+		OK(t, runRestore(RestoreOptions{Target: restoredir, NoXattrs: true}, gopts, []string{"latest"}))
+		Equals(t, 0, len(xattrs(restoredir)))
+
+		testRunBackup(t, []string{env.testdata}, BackupOptions{NoXattrs: true, Force: true}, gopts)
+
+		restoredir = filepath.Join(env.base, "restore-backup-no-xattrs")
+		testRunRestoreLatest(t, gopts, restoredir, nil, "")
+		Equals(t, 0, len(xattrs(restoredir)))
+	})
+}
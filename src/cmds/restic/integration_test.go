@@ -1,6 +1,7 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
 	"crypto/rand"
@@ -10,9 +11,12 @@ import (
 	"io/ioutil"
 	mrand "math/rand"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"restic"
+	"runtime"
+	"sort"
 	"strings"
 	"syscall"
 	"testing"
@@ -20,8 +24,13 @@ import (
 
 	"restic/errors"
 
+	"restic/cache"
+	"restic/compression"
+	"restic/crypto"
 	"restic/debug"
 	"restic/filter"
+	"restic/fs"
+	"restic/index"
 	"restic/repository"
 	. "restic/test"
 )
@@ -47,7 +56,7 @@ func testRunInit(t testing.TB, opts GlobalOptions) {
 	repository.TestUseLowSecurityKDFParameters(t)
 	restic.TestSetLockTimeout(t, 0)
 
-	OK(t, runInit(opts, nil))
+	OK(t, runInit(InitOptions{}, opts, nil))
 	t.Logf("repository initialized at %v", opts.Repo)
 }
 
@@ -149,6 +158,21 @@ func testRunLs(t testing.TB, gopts GlobalOptions, snapshotID string) []string {
 	return strings.Split(string(buf.Bytes()), "\n")
 }
 
+func testRunLsPrint0(t testing.TB, gopts GlobalOptions, snapshotID string) []string {
+	buf := bytes.NewBuffer(nil)
+	globalOptions.stdout = buf
+	defer func() {
+		globalOptions.stdout = os.Stdout
+	}()
+
+	opts := LsOptions{Print0: true}
+	OK(t, runLs(opts, gopts, []string{snapshotID}))
+
+	out := buf.String()
+	Assert(t, strings.HasSuffix(out, "\x00"), "output is not terminated by a NUL byte: %q", out)
+	return strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+}
+
 func testRunFind(t testing.TB, wantJSON bool, gopts GlobalOptions, pattern string) []byte {
 	buf := bytes.NewBuffer(nil)
 	globalOptions.stdout = buf
@@ -197,7 +221,10 @@ func testRunForget(t testing.TB, gopts GlobalOptions, args ...string) {
 }
 
 func testRunPrune(t testing.TB, gopts GlobalOptions) {
-	OK(t, runPrune(gopts))
+	opts := PruneOptions{
+		DeleteBatchSize: 1000,
+	}
+	OK(t, runPrune(opts, gopts))
 }
 
 func TestBackup(t *testing.T) {
@@ -565,6 +592,275 @@ func TestBackupExclude(t *testing.T) {
 			"expected file %q not in first snapshot, but it's included", "foo.tar.gz")
 		Assert(t, !includes(files, filepath.Join(string(filepath.Separator), "testdata", "private", "secret", "passwords.txt")),
 			"expected file %q not in first snapshot, but it's included", "passwords.txt")
+
+		opts.Excludes = []string{"{*.tar.gz,**/source/*.[[:lower:]]}", "/private"}
+		testRunBackup(t, []string{datadir}, opts, gopts)
+		_, snapshotID = lastSnapshot(snapshots, loadSnapshotMap(t, gopts))
+		files = testRunLs(t, gopts, snapshotID)
+		Assert(t, !includes(files, filepath.Join(string(filepath.Separator), "testdata", "work", "source", "test.c")),
+			"expected file %q not in snapshot, but it's included", "test.c")
+		Assert(t, !includes(files, filepath.Join(string(filepath.Separator), "testdata", "foo.tar.gz")),
+			"expected file %q not in snapshot, but it's included", "foo.tar.gz")
+		Assert(t, includes(files, filepath.Join(string(filepath.Separator), "testdata", "private", "secret", "passwords.txt")),
+			"expected file %q in snapshot, the anchored pattern must not match", "passwords.txt")
+
+		opts.Excludes = []string{"[[:nosuchclass:]]"}
+		err := runBackup(opts, gopts, []string{datadir})
+		Assert(t, err != nil && errors.IsFatal(err), "expected fatal error for invalid pattern, got %v", err)
+	})
+}
+
+func TestBackupExcludeIfPresent(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		datadir := filepath.Join(env.base, "testdata")
+		files := map[string]string{
+			"work/file.txt":           "foo",
+			"work/build/.nobackup":    "",
+			"work/build/output.o":     "foo",
+			"cache/CACHEDIR.TAG":      cacheDirTagSignature,
+			"cache/data/entry":        "foo",
+			"notacache/CACHEDIR.TAG":  "foo",
+			"notacache/important.txt": "foo",
+		}
+
+		for name, data := range files {
+			fp := filepath.Join(datadir, filepath.FromSlash(name))
+			OK(t, os.MkdirAll(filepath.Dir(fp), 0755))
+			OK(t, ioutil.WriteFile(fp, []byte(data), 0644))
+		}
+
+		opts := BackupOptions{
+			ExcludeIfPresent: []string{".nobackup"},
+			ExcludeCaches:    true,
+		}
+		testRunBackup(t, []string{datadir}, opts, gopts)
+		_, snapshotID := lastSnapshot(make(map[string]struct{}), loadSnapshotMap(t, gopts))
+		list := testRunLs(t, gopts, snapshotID)
+
+		path := func(name string) string {
+			return filepath.Join(string(filepath.Separator), "testdata", filepath.FromSlash(name))
+		}
+
+		for _, name := range []string{"work/file.txt", "work/build", "cache", "notacache/important.txt"} {
+			Assert(t, includes(list, path(name)), "expected %q in snapshot, but it's not included", name)
+		}
+
+		for _, name := range []string{"work/build/output.o", "work/build/.nobackup", "cache/CACHEDIR.TAG", "cache/data"} {
+			Assert(t, !includes(list, path(name)), "expected %q not in snapshot, but it's included", name)
+		}
+	})
+}
+
+func TestBackupFilesFromNull(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		datadir := filepath.Join(env.base, "testdata")
+		names := []string{"file with spaces.txt", " leading", "new\nline"}
+		if runtime.GOOS == "windows" {
+			names = names[:1]
+		}
+
+		var list []byte
+		for _, name := range names {
+			fp := filepath.Join(datadir, name)
+			OK(t, os.MkdirAll(datadir, 0755))
+			OK(t, ioutil.WriteFile(fp, []byte("foo"), 0644))
+			list = append(list, fp...)
+			list = append(list, 0)
+		}
+		OK(t, ioutil.WriteFile(filepath.Join(env.base, "files"), list, 0644))
+
+		opts := BackupOptions{
+			FilesFrom:     filepath.Join(env.base, "files"),
+			FilesFromNull: true,
+		}
+		testRunBackup(t, nil, opts, gopts)
+		_, snapshotID := lastSnapshot(make(map[string]struct{}), loadSnapshotMap(t, gopts))
+		files := testRunLsPrint0(t, gopts, snapshotID)
+
+		for _, name := range names {
+			path := string(filepath.Separator) + name
+			Assert(t, includes(files, path), "expected %q in snapshot, but it's not included", path)
+		}
+
+		err := runBackup(BackupOptions{FilesFromNull: true}, gopts, []string{datadir})
+		Assert(t, err != nil, "expected error for --files-from-null without --files-from")
+	})
+}
+
+func TestBackupStdin(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		datafile := filepath.Join(env.base, "dump.sql")
+		OK(t, ioutil.WriteFile(datafile, Random(23, 3*1024*1024), 0600))
+
+		backupStdin := func(opts BackupOptions) error {
+			f, err := os.Open(datafile)
+			OK(t, err)
+			defer f.Close()
+
+			stdin := os.Stdin
+			os.Stdin = f
+			defer func() {
+				os.Stdin = stdin
+			}()
+
+			return readBackupFromStdin(opts, gopts, nil)
+		}
+
+		opts := BackupOptions{
+			Stdin:         true,
+			StdinFilename: "db.sql",
+			TimeStamp:     "2017-06-30 22:08:41",
+		}
+
+		OK(t, backupStdin(opts))
+		snapshots, firstID := lastSnapshot(make(map[string]struct{}), loadSnapshotMap(t, gopts))
+		packs := testRunList(t, "packs", gopts)
+
+		// the second dump is deduplicated and uses the first one as the parent
+		opts.TimeStamp = ""
+		OK(t, backupStdin(opts))
+		_, secondID := lastSnapshot(snapshots, loadSnapshotMap(t, gopts))
+		Equals(t, len(packs)+1, len(testRunList(t, "packs", gopts)))
+
+		files := testRunLs(t, gopts, secondID)
+		Assert(t, includes(files, string(filepath.Separator)+"db.sql"), "file db.sql not found in snapshot: %v", files)
+
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+
+		id, err := restic.ParseID(firstID)
+		OK(t, err)
+		sn, err := restic.LoadSnapshot(gopts.ctx, repo, id)
+		OK(t, err)
+		Assert(t, sn.Time.Equal(time.Date(2017, 6, 30, 22, 8, 41, 0, time.Local)),
+			"snapshot has the wrong time: %v", sn.Time)
+		Assert(t, sn.Parent == nil, "first snapshot has a parent: %v", sn.Parent)
+
+		id, err = restic.ParseID(secondID)
+		OK(t, err)
+		sn, err = restic.LoadSnapshot(gopts.ctx, repo, id)
+		OK(t, err)
+		Assert(t, sn.Parent != nil && sn.Parent.String() == firstID,
+			"second snapshot does not have the first one as the parent: %v", sn.Parent)
+
+		opts.TimeStamp = "yesterday"
+		err = backupStdin(opts)
+		Assert(t, err != nil && errors.IsFatal(err), "expected fatal error for invalid time, got %v", err)
+
+		opts.TimeStamp = ""
+		opts.StdinFilename = "dumps/db.sql"
+		err = backupStdin(opts)
+		Assert(t, err != nil && errors.IsFatal(err), "expected fatal error for a path as the file name, got %v", err)
+	})
+}
+
+func TestBackupReadFrom(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		original := filepath.Join(env.base, "original")
+		source := filepath.Join(env.base, "snapshot")
+		for _, name := range []string{
+			filepath.Join(original, "data", "live.txt"),
+			filepath.Join(source, "data", "frozen.txt"),
+			filepath.Join(source, "data", "skip.txt"),
+		} {
+			OK(t, os.MkdirAll(filepath.Dir(name), 0755))
+			OK(t, ioutil.WriteFile(name, []byte(name), 0644))
+		}
+
+		target := filepath.Join(original, "data")
+		opts := BackupOptions{
+			ReadFrom: []string{original + "=" + source},
+			Excludes: []string{filepath.Join(target, "skip.txt")},
+		}
+		testRunBackup(t, []string{target}, opts, gopts)
+
+		snapshot, _ := testRunSnapshots(t, gopts)
+		Equals(t, []string{target}, snapshot.Paths)
+
+		files := testRunLs(t, gopts, snapshot.ID.String())
+		sep := string(filepath.Separator)
+		Assert(t, includes(files, sep+filepath.Join("data", "frozen.txt")),
+			"file from the source not found in snapshot: %v", files)
+		Assert(t, !includes(files, sep+filepath.Join("data", "live.txt")),
+			"file from the original path found in snapshot: %v", files)
+		Assert(t, !includes(files, sep+filepath.Join("data", "skip.txt")),
+			"exclude pattern for the original path was not applied: %v", files)
+
+		opts.ReadFrom = []string{filepath.Join(original, "data") + "=" + source}
+		err := runBackup(opts, gopts, []string{target})
+		Assert(t, err != nil && errors.IsFatal(err), "expected fatal error for different base names, got %v", err)
+	})
+}
+
+func TestTestPattern(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("paths in this test are not absolute on Windows")
+	}
+
+	buf := bytes.NewBuffer(nil)
+	gopts := GlobalOptions{JSON: true, stdout: buf}
+
+	// commas outside of braces separate patterns
+	opts := TestPatternOptions{
+		Excludes: []string{"*.{tmp,bak},/var/cache"},
+	}
+	paths := []string{"/home/user/file.tmp", "/home/user/file.txt", "/var/cache/x", "/home/var/cache/x"}
+	OK(t, runTestPattern(opts, gopts, paths))
+
+	var results []patternMatch
+	OK(t, json.Unmarshal(buf.Bytes(), &results))
+
+	want := []patternMatch{
+		{Path: "/home/user/file.tmp", Pattern: "*.{tmp,bak}", Kind: "exclude"},
+		{Path: "/home/user/file.txt", Selected: true},
+		{Path: "/var/cache/x", Pattern: "/var/cache", Kind: "exclude", Anchored: true},
+		{Path: "/home/var/cache/x", Selected: true},
+	}
+	Equals(t, want, results)
+
+	buf.Reset()
+	opts = TestPatternOptions{Includes: []string{"**/*.go"}}
+	OK(t, runTestPattern(opts, gopts, []string{"/src/a/main.go", "/src/a/README"}))
+
+	results = nil
+	OK(t, json.Unmarshal(buf.Bytes(), &results))
+	want = []patternMatch{
+		{Path: "/src/a/main.go", Selected: true, Pattern: "**/*.go", Kind: "include"},
+		{Path: "/src/a/README"},
+	}
+	Equals(t, want, results)
+}
+
+func TestBackupNewerThan(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		datadir := filepath.Join(env.base, "testdata")
+		OK(t, os.MkdirAll(datadir, 0755))
+		OK(t, appendRandomData(filepath.Join(datadir, "old"), 100))
+
+		snapshots := make(map[string]struct{})
+		testRunBackup(t, []string{datadir}, BackupOptions{}, gopts)
+		snapshots, firstID := lastSnapshot(snapshots, loadSnapshotMap(t, gopts))
+
+		OK(t, appendRandomData(filepath.Join(datadir, "new"), 100))
+
+		testRunBackup(t, []string{datadir}, BackupOptions{NewerThan: firstID}, gopts)
+		_, snapshotID := lastSnapshot(snapshots, loadSnapshotMap(t, gopts))
+		files := testRunLs(t, gopts, snapshotID)
+
+		Assert(t, includes(files, filepath.Join(string(filepath.Separator), "testdata", "new")),
+			"expected file %q in snapshot, but it's not included", "new")
+		Assert(t, !includes(files, filepath.Join(string(filepath.Separator), "testdata", "old")),
+			"expected file %q not in snapshot, but it's included", "old")
 	})
 }
 
@@ -740,7 +1036,7 @@ func testRunKeyListOtherIDs(t testing.TB, gopts GlobalOptions) []string {
 		globalOptions.stdout = os.Stdout
 	}()
 
-	OK(t, runKey(gopts, []string{"list"}))
+	OK(t, runKey(KeyOptions{}, gopts, []string{"list"}))
 
 	scanner := bufio.NewScanner(buf)
 	exp := regexp.MustCompile(`^ ([a-f0-9]+) `)
@@ -761,7 +1057,7 @@ func testRunKeyAddNewKey(t testing.TB, newPassword string, gopts GlobalOptions)
 		testKeyNewPassword = ""
 	}()
 
-	OK(t, runKey(gopts, []string{"add"}))
+	OK(t, runKey(KeyOptions{}, gopts, []string{"add"}))
 }
 
 func testRunKeyPasswd(t testing.TB, newPassword string, gopts GlobalOptions) {
@@ -770,13 +1066,13 @@ func testRunKeyPasswd(t testing.TB, newPassword string, gopts GlobalOptions) {
 		testKeyNewPassword = ""
 	}()
 
-	OK(t, runKey(gopts, []string{"passwd"}))
+	OK(t, runKey(KeyOptions{}, gopts, []string{"passwd"}))
 }
 
 func testRunKeyRemove(t testing.TB, gopts GlobalOptions, IDs []string) {
 	t.Logf("remove %d keys: %q\n", len(IDs), IDs)
 	for _, id := range IDs {
-		OK(t, runKey(gopts, []string{"rm", id}))
+		OK(t, runKey(KeyOptions{}, gopts, []string{"rm", id}))
 	}
 }
 
@@ -802,7 +1098,205 @@ func TestKeyAddRemove(t *testing.T) {
 
 		gopts.password = passwordList[len(passwordList)-1]
 		t.Logf("testing access with last password %q\n", gopts.password)
-		OK(t, runKey(gopts, []string{"list"}))
+		OK(t, runKey(KeyOptions{}, gopts, []string{"list"}))
+		testRunCheck(t, gopts)
+	})
+}
+
+func TestPasswordSources(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		stderr := globalOptions.stderr
+		globalOptions.stderr = ioutil.Discard
+		defer func() {
+			globalOptions.stderr = stderr
+		}()
+
+		// the password file is tried first, the one from the environment
+		// still opens the repository
+		wrongFile := filepath.Join(env.base, "wrong-password")
+		OK(t, ioutil.WriteFile(wrongFile, []byte("wrong\n"), 0600))
+		gopts.PasswordFile = wrongFile
+		OK(t, runKey(KeyOptions{}, gopts, []string{"list"}))
+
+		gopts.password = ""
+		err := runKey(KeyOptions{}, gopts, []string{"list"})
+		Assert(t, err != nil, "expected error when no source has the right password")
+
+		gopts.PasswordFile = filepath.Join(env.base, "missing-file")
+		err = runKey(KeyOptions{}, gopts, []string{"list"})
+		Assert(t, err != nil, "expected error for a missing password file")
+
+		if runtime.GOOS == "windows" {
+			return
+		}
+
+		gopts.PasswordFile = wrongFile
+		gopts.PasswordCommand = "echo " + TestPassword
+		OK(t, runKey(KeyOptions{}, gopts, []string{"list"}))
+
+		gopts.PasswordCommand = "false"
+		gopts.password = TestPassword
+		OK(t, runKey(KeyOptions{}, gopts, []string{"list"}))
+	})
+}
+
+func TestKeyDomain(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		defaultIDs := testRunList(t, "snapshots", gopts)
+
+		testKeyNewPassword = "client-a"
+		OK(t, runKey(KeyOptions{Domain: "a"}, gopts, []string{"add"}))
+		testKeyNewPassword = ""
+
+		domainOpts := gopts
+		domainOpts.password = "client-a"
+
+		repo, err := OpenRepository(domainOpts)
+		OK(t, err)
+		Assert(t, repo.Key() == nil, "the key of the domain contains the master key")
+		Equals(t, "a", repo.Domain())
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, domainOpts)
+
+		var domainID restic.ID
+		for _, id := range testRunList(t, "snapshots", gopts) {
+			if !id.Equal(defaultIDs[0]) {
+				domainID = id
+			}
+		}
+		Assert(t, !domainID.IsNull(), "snapshot of the domain not found")
+
+		restoredir := filepath.Join(env.base, "restore-a")
+		testRunRestore(t, domainOpts, restoredir, domainID)
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
+			"directories are not equal")
+
+		// the master key can read the data of all domains
+		restoredir = filepath.Join(env.base, "restore-default")
+		testRunRestore(t, gopts, restoredir, domainID)
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
+			"directories are not equal")
+
+		// the key of the domain can't read the data saved with the master key
+		restoredir = filepath.Join(env.base, "restore-other")
+		err = runRestore(RestoreOptions{Target: restoredir}, domainOpts, []string{defaultIDs[0].String()})
+		Assert(t, err != nil, "data saved with the master key was restored with the key of a domain")
+
+		testRunCheck(t, gopts)
+
+		checkOpts := domainOpts
+		checkOpts.command = "check"
+		err = runCheck(CheckOptions{}, checkOpts, nil)
+		Assert(t, err != nil, "check with the key of a domain succeeded")
+
+		err = runKey(KeyOptions{Domain: "b"}, domainOpts, []string{"add"})
+		Assert(t, err != nil, "creating a new domain with a key of a domain succeeded")
+
+		// keys added with the key of a domain belong to the same domain
+		testKeyNewPassword = "client-a2"
+		OK(t, runKey(KeyOptions{}, domainOpts, []string{"add"}))
+		testKeyNewPassword = ""
+
+		domainOpts.password = "client-a2"
+		repo, err = OpenRepository(domainOpts)
+		OK(t, err)
+		Assert(t, repo.Key() == nil, "the new key of the domain contains the master key")
+		Equals(t, "a", repo.Domain())
+		testRunRestore(t, domainOpts, filepath.Join(env.base, "restore-a2"), domainID)
+	})
+}
+
+func TestKeyDomainRepoVersion(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		repository.TestUseLowSecurityKDFParameters(t)
+		OK(t, runInit(InitOptions{RepositoryVersion: "3"}, gopts, nil))
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		oldIDs := testRunList(t, "snapshots", gopts)
+
+		testKeyNewPassword = "client-a"
+		defer func() { testKeyNewPassword = "" }()
+
+		err := runKey(KeyOptions{Domain: "a"}, gopts, []string{"add"})
+		Assert(t, err != nil, "adding a key for a domain to a repository with version 3 succeeded")
+
+		OK(t, runMigrate(MigrateOptions{}, gopts, []string{"upgrade_repo_v4"}))
+		OK(t, runKey(KeyOptions{Domain: "a"}, gopts, []string{"add"}))
+
+		domainOpts := gopts
+		domainOpts.password = "client-a"
+
+		// the files saved before the upgrade are skipped by the key of the
+		// domain and still readable with the master key
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, domainOpts)
+		testRunCheck(t, gopts)
+		testRunRestore(t, gopts, filepath.Join(env.base, "restore"), oldIDs[0])
+	})
+}
+
+func TestKeyOperations(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		testKeyNewPassword = "backup-only"
+		OK(t, runKey(KeyOptions{Label: "client", Allow: []string{"backup"}}, gopts, []string{"add"}))
+		testKeyNewPassword = "backup-and-key"
+		OK(t, runKey(KeyOptions{Allow: []string{"backup,key"}}, gopts, []string{"add"}))
+		testKeyNewPassword = ""
+
+		err := runKey(KeyOptions{Allow: []string{"delete"}}, gopts, []string{"add"})
+		Assert(t, err != nil, "adding a key with an invalid operation succeeded")
+
+		buf := bytes.NewBuffer(nil)
+		globalOptions.stdout = buf
+		OK(t, runKey(KeyOptions{}, gopts, []string{"list"}))
+		globalOptions.stdout = os.Stdout
+		Assert(t, regexp.MustCompile(`backup\s+client\n`).MatchString(buf.String()),
+			"label and operations not listed:\n%s", buf.String())
+		Assert(t, strings.Contains(buf.String(), "backup,key"),
+			"operations not listed:\n%s", buf.String())
+
+		backupOpts := gopts
+		backupOpts.password = "backup-only"
+		backupOpts.operation = "backup"
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, backupOpts)
+
+		backupOpts.operation = "read"
+		err = runSnapshots(SnapshotOptions{}, backupOpts, nil)
+		Assert(t, err != nil, "listing snapshots with a backup-only key succeeded")
+
+		backupOpts.operation = "all"
+		_, err = OpenRepository(backupOpts)
+		Assert(t, err != nil, "opening the repository with a backup-only key for all operations succeeded")
+
+		// a restricted key cannot allow more for a new key
+		keyOpts := gopts
+		keyOpts.password = "backup-and-key"
+		keyOpts.operation = "key"
+		err = runKey(KeyOptions{Allow: []string{"read"}}, keyOpts, []string{"add"})
+		Assert(t, err != nil, "adding a key with more operations succeeded")
+
+		testKeyNewPassword = "inherited"
+		OK(t, runKey(KeyOptions{}, keyOpts, []string{"add"}))
+		testKeyNewPassword = ""
+
+		inheritedOpts := keyOpts
+		inheritedOpts.password = "inherited"
+		inheritedOpts.operation = "read"
+		_, err = OpenRepository(inheritedOpts)
+		Assert(t, err != nil, "key added with a restricted key is not restricted")
+
 		testRunCheck(t, gopts)
 	})
 }
@@ -894,81 +1388,244 @@ func TestRestore(t *testing.T) {
 	})
 }
 
-func TestRestoreLatest(t *testing.T) {
+func TestLsPrint0(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file names cannot contain newlines on Windows")
+	}
 
 	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
 		testRunInit(t, gopts)
 
-		p := filepath.Join(env.testdata, "testfile.c")
-		OK(t, os.MkdirAll(filepath.Dir(p), 0755))
-		OK(t, appendRandomData(p, 100))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "foo\nbar"), 100))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "baz"), 100))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
 
-		opts := BackupOptions{}
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Equals(t, 1, len(snapshotIDs))
+
+		files := testRunLsPrint0(t, gopts, snapshotIDs[0].String())
+		Equals(t, []string{
+			"/testdata",
+			"/testdata/baz",
+			"/testdata/foo\nbar",
+		}, files)
+	})
+}
+
+func TestBackupSkipIfUnchanged(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
 
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 1000))
+		opts := BackupOptions{SkipUnchanged: true}
 		testRunBackup(t, []string{env.testdata}, opts, gopts)
-		testRunCheck(t, gopts)
+		Equals(t, 1, len(testRunList(t, "snapshots", gopts)))
 
-		os.Remove(p)
-		OK(t, appendRandomData(p, 101))
 		testRunBackup(t, []string{env.testdata}, opts, gopts)
-		testRunCheck(t, gopts)
+		Equals(t, 1, len(testRunList(t, "snapshots", gopts)))
 
-		// Restore latest without any filters
-		testRunRestoreLatest(t, gopts, filepath.Join(env.base, "restore0"), nil, "")
-		OK(t, testFileSize(filepath.Join(env.base, "restore0", "testdata", "testfile.c"), int64(101)))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 1000))
+		testRunBackup(t, []string{env.testdata}, opts, gopts)
+		Equals(t, 2, len(testRunList(t, "snapshots", gopts)))
 
-		// Setup test files in different directories backed up in different snapshots
-		p1 := filepath.Join(env.testdata, "p1/testfile.c")
-		OK(t, os.MkdirAll(filepath.Dir(p1), 0755))
-		OK(t, appendRandomData(p1, 102))
-		testRunBackup(t, []string{filepath.Dir(p1)}, opts, gopts)
-		testRunCheck(t, gopts)
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		Equals(t, 3, len(testRunList(t, "snapshots", gopts)))
 
-		p2 := filepath.Join(env.testdata, "p2/testfile.c")
-		OK(t, os.MkdirAll(filepath.Dir(p2), 0755))
-		OK(t, appendRandomData(p2, 103))
-		testRunBackup(t, []string{filepath.Dir(p2)}, opts, gopts)
+		// trees saved by skipped backups (e.g. because of changed access times)
+		// are not referenced and removed by prune
+		OK(t, runCheck(CheckOptions{ReadData: true}, gopts, nil))
+		testRunPrune(t, gopts)
 		testRunCheck(t, gopts)
+	})
+}
 
-		p1rAbs := filepath.Join(env.base, "restore1", "p1/testfile.c")
-		p2rAbs := filepath.Join(env.base, "restore2", "p2/testfile.c")
+func TestBackupRequireSnapshotVerify(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
 
-		testRunRestoreLatest(t, gopts, filepath.Join(env.base, "restore1"), []string{filepath.Dir(p1)}, "")
-		OK(t, testFileSize(p1rAbs, int64(102)))
-		if _, err := os.Stat(p2rAbs); os.IsNotExist(errors.Cause(err)) {
-			Assert(t, os.IsNotExist(errors.Cause(err)),
-				"expected %v to not exist in restore, but it exists, err %v", p2rAbs, err)
-		}
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{VerifySnapshot: true}, gopts)
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Equals(t, 1, len(snapshotIDs))
 
-		testRunRestoreLatest(t, gopts, filepath.Join(env.base, "restore2"), []string{filepath.Dir(p2)}, "")
-		OK(t, testFileSize(p2rAbs, int64(103)))
-		if _, err := os.Stat(p1rAbs); os.IsNotExist(errors.Cause(err)) {
-			Assert(t, os.IsNotExist(errors.Cause(err)),
-				"expected %v to not exist in restore, but it exists, err %v", p1rAbs, err)
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		OK(t, repo.LoadIndex(gopts.ctx))
+		OK(t, verifySnapshot(gopts.ctx, repo, snapshotIDs[0]))
+
+		// remove all pack files, the snapshot cannot be restored any more
+		for _, packID := range testRunList(t, "packs", gopts) {
+			OK(t, repo.Backend().Remove(gopts.ctx, restic.Handle{Type: restic.DataFile, Name: packID.String()}))
 		}
 
+		Assert(t, verifySnapshot(gopts.ctx, repo, snapshotIDs[0]) != nil,
+			"snapshot without pack files was verified")
 	})
 }
 
-func TestRestoreWithPermissionFailure(t *testing.T) {
+func TestBackupDryRun(t *testing.T) {
 	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
-		datafile := filepath.Join("testdata", "repo-restore-permissions-test.tar.gz")
-		SetupTarTestFixture(t, env.base, datafile)
+		testRunInit(t, gopts)
 
-		snapshots := testRunList(t, "snapshots", gopts)
-		Assert(t, len(snapshots) > 0,
-			"no snapshots found in repo (%v)", datafile)
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
 
-		globalOptions.stderr = ioutil.Discard
-		defer func() {
-			globalOptions.stderr = os.Stderr
-		}()
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 2000))
+
+		packs := testRunList(t, "packs", gopts)
+		indexes := testRunList(t, "index", gopts)
+
+		buf := bytes.NewBuffer(nil)
+		jsonOpts := gopts
+		jsonOpts.stdout = buf
+		jsonOpts.Quiet = true
+		jsonOpts.JSON = true
+		testRunBackup(t, []string{env.testdata}, BackupOptions{DryRun: true}, jsonOpts)
+
+		var summary backupDryRunSummary
+		OK(t, json.Unmarshal(buf.Bytes(), &summary))
+		Equals(t, uint64(1), summary.ChangedFiles)
+		Equals(t, uint64(2000), summary.ChangedBytes)
+		Equals(t, uint64(1), summary.UnchangedFiles)
+		Equals(t, uint64(1000), summary.UnchangedBytes)
+		Assert(t, summary.DataBlobs > 0 && summary.UploadBytes > 2000,
+			"wrong upload estimate: %s", buf.String())
+
+		// nothing has been written to the repository
+		Equals(t, 1, len(testRunList(t, "snapshots", gopts)))
+		Equals(t, packs, testRunList(t, "packs", gopts))
+		Equals(t, indexes, testRunList(t, "index", gopts))
+
+		Assert(t, runBackup(BackupOptions{DryRun: true, VerifySnapshot: true}, gopts, []string{env.testdata}) != nil,
+			"dry run with --require-snapshot-verify succeeded")
+	})
+}
 
-		testRunRestore(t, gopts, filepath.Join(env.base, "restore"), snapshots[0])
+func TestBackupContentList(t *testing.T) {
+	defer func(threshold int) {
+		restic.ContentListThreshold = threshold
+	}(restic.ContentListThreshold)
+	restic.ContentListThreshold = 2
 
-		// make sure that all files have been restored, regardless of any
-		// permission errors
-		files := testRunLs(t, gopts, snapshots[0].String())
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		p := filepath.Join(env.testdata, "large")
+		OK(t, appendRandomData(p, 10*1024*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		testRunCheck(t, gopts)
+
+		// the snapshot references the root tree, the tree for the directory and
+		// the content list of the file
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		OK(t, repo.LoadIndex(gopts.ctx))
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		sn, err := restic.LoadSnapshot(gopts.ctx, repo, snapshotIDs[0])
+		OK(t, err)
+		blobs := restic.NewBlobSet()
+		OK(t, restic.FindUsedBlobs(gopts.ctx, repo, *sn.Tree, blobs, restic.NewBlobSet()))
+		trees := 0
+		for h := range blobs {
+			if h.Type == restic.TreeBlob {
+				trees++
+			}
+		}
+		Equals(t, 3, trees)
+
+		// the unchanged file is taken from the parent snapshot
+		OK(t, appendRandomData(filepath.Join(env.testdata, "small"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		testRunCheck(t, gopts)
+
+		Equals(t, 2, len(testRunList(t, "snapshots", gopts)))
+		OK(t, runForget(ForgetOptions{Last: 1}, gopts, nil))
+		Equals(t, 1, len(testRunList(t, "snapshots", gopts)))
+		testRunPrune(t, gopts)
+		testRunCheck(t, gopts)
+
+		restoredir := filepath.Join(env.base, "restore")
+		testRunRestoreLatest(t, gopts, restoredir, nil, "")
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, filepath.Base(env.testdata))),
+			"directories are not equal")
+	})
+}
+
+func TestRestoreLatest(t *testing.T) {
+
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		p := filepath.Join(env.testdata, "testfile.c")
+		OK(t, os.MkdirAll(filepath.Dir(p), 0755))
+		OK(t, appendRandomData(p, 100))
+
+		opts := BackupOptions{}
+
+		testRunBackup(t, []string{env.testdata}, opts, gopts)
+		testRunCheck(t, gopts)
+
+		os.Remove(p)
+		OK(t, appendRandomData(p, 101))
+		testRunBackup(t, []string{env.testdata}, opts, gopts)
+		testRunCheck(t, gopts)
+
+		// Restore latest without any filters
+		testRunRestoreLatest(t, gopts, filepath.Join(env.base, "restore0"), nil, "")
+		OK(t, testFileSize(filepath.Join(env.base, "restore0", "testdata", "testfile.c"), int64(101)))
+
+		// Setup test files in different directories backed up in different snapshots
+		p1 := filepath.Join(env.testdata, "p1/testfile.c")
+		OK(t, os.MkdirAll(filepath.Dir(p1), 0755))
+		OK(t, appendRandomData(p1, 102))
+		testRunBackup(t, []string{filepath.Dir(p1)}, opts, gopts)
+		testRunCheck(t, gopts)
+
+		p2 := filepath.Join(env.testdata, "p2/testfile.c")
+		OK(t, os.MkdirAll(filepath.Dir(p2), 0755))
+		OK(t, appendRandomData(p2, 103))
+		testRunBackup(t, []string{filepath.Dir(p2)}, opts, gopts)
+		testRunCheck(t, gopts)
+
+		p1rAbs := filepath.Join(env.base, "restore1", "p1/testfile.c")
+		p2rAbs := filepath.Join(env.base, "restore2", "p2/testfile.c")
+
+		testRunRestoreLatest(t, gopts, filepath.Join(env.base, "restore1"), []string{filepath.Dir(p1)}, "")
+		OK(t, testFileSize(p1rAbs, int64(102)))
+		if _, err := os.Stat(p2rAbs); os.IsNotExist(errors.Cause(err)) {
+			Assert(t, os.IsNotExist(errors.Cause(err)),
+				"expected %v to not exist in restore, but it exists, err %v", p2rAbs, err)
+		}
+
+		testRunRestoreLatest(t, gopts, filepath.Join(env.base, "restore2"), []string{filepath.Dir(p2)}, "")
+		OK(t, testFileSize(p2rAbs, int64(103)))
+		if _, err := os.Stat(p1rAbs); os.IsNotExist(errors.Cause(err)) {
+			Assert(t, os.IsNotExist(errors.Cause(err)),
+				"expected %v to not exist in restore, but it exists, err %v", p1rAbs, err)
+		}
+
+	})
+}
+
+func TestRestoreWithPermissionFailure(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		datafile := filepath.Join("testdata", "repo-restore-permissions-test.tar.gz")
+		SetupTarTestFixture(t, env.base, datafile)
+
+		snapshots := testRunList(t, "snapshots", gopts)
+		Assert(t, len(snapshots) > 0,
+			"no snapshots found in repo (%v)", datafile)
+
+		globalOptions.stderr = ioutil.Discard
+		defer func() {
+			globalOptions.stderr = os.Stderr
+		}()
+
+		testRunRestore(t, gopts, filepath.Join(env.base, "restore"), snapshots[0])
+
+		// make sure that all files have been restored, regardless of any
+		// permission errors
+		files := testRunLs(t, gopts, snapshots[0].String())
 		for _, filename := range files {
 			fi, err := os.Lstat(filepath.Join(env.base, "restore", filename))
 			OK(t, err)
@@ -1028,6 +1685,76 @@ func TestRestoreNoMetadataOnIgnoredIntermediateDirs(t *testing.T) {
 	})
 }
 
+func TestRestoreContinueOnError(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "a"), 1000))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "b"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Assert(t, len(snapshotIDs) == 1,
+			"expected one snapshot, got %v", snapshotIDs)
+
+		// a non-empty directory in place of the file "a" makes restoring it fail
+		restoredir := filepath.Join(env.base, "restore")
+		OK(t, os.MkdirAll(filepath.Join(restoredir, "testdata", "a", "x"), 0700))
+
+		err := runRestore(RestoreOptions{Target: restoredir}, gopts, []string{snapshotIDs[0].String()})
+		e, ok := err.(errPartialRestore)
+		Assert(t, ok, "expected errPartialRestore, got %v", err)
+		Equals(t, 1, e.errors)
+		Equals(t, exitCodePartialRestore, e.ExitCode())
+
+		OK(t, testFileSize(filepath.Join(restoredir, "testdata", "b"), 1000))
+	})
+}
+
+func TestRestoreMapSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks are not restored on windows")
+	}
+
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		links := map[string]string{
+			"link1": "/opt/app/bin/tool",
+			"link2": "/opt/app",
+			"link3": "/opt/application/bin/tool",
+			"link4": "relative/target",
+		}
+
+		for name, target := range links {
+			OK(t, os.Symlink(target, filepath.Join(env.testdata, name)))
+		}
+
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		snapshotID := testRunList(t, "snapshots", gopts)[0]
+
+		restoredir := filepath.Join(env.base, "restore")
+		opts := RestoreOptions{
+			Target:     restoredir,
+			MapSymlink: []string{"/opt/app:/srv/restore/app"},
+		}
+		OK(t, runRestore(opts, gopts, []string{snapshotID.String()}))
+
+		want := map[string]string{
+			"link1": "/srv/restore/app/bin/tool",
+			"link2": "/srv/restore/app",
+			"link3": "/opt/application/bin/tool",
+			"link4": "relative/target",
+		}
+
+		for name, target := range want {
+			linkTarget, err := os.Readlink(filepath.Join(restoredir, "testdata", name))
+			OK(t, err)
+			Equals(t, target, linkTarget)
+		}
+	})
+}
+
 func TestFind(t *testing.T) {
 	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
 		datafile := filepath.Join("testdata", "backup-data.tar.gz")
@@ -1133,155 +1860,2297 @@ func TestRebuildIndexAlwaysFull(t *testing.T) {
 	TestRebuildIndex(t)
 }
 
-func TestCheckRestoreNoLock(t *testing.T) {
+func TestMigrateUpgradeRepoV2(t *testing.T) {
 	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
-		datafile := filepath.Join("testdata", "small-repo.tar.gz")
+		datafile := filepath.Join("testdata", "old-index-repo.tar.gz")
 		SetupTarTestFixture(t, env.base, datafile)
 
-		err := filepath.Walk(env.repo, func(p string, fi os.FileInfo, e error) error {
-			if e != nil {
-				return e
-			}
-			return os.Chmod(p, fi.Mode() & ^(os.FileMode(0222)))
-		})
+		out, err := testRunCheckOutput(gopts)
 		OK(t, err)
+		Assert(t, strings.Contains(out, "has old format"),
+			"did not find checker hint for old index format, output: %v", out)
+		Assert(t, strings.Contains(out, "restic migrate upgrade_repo_v2"),
+			"did not find hint for the migration, output: %v", out)
 
-		gopts.NoLock = true
+		OK(t, runMigrate(MigrateOptions{}, gopts, []string{"upgrade_repo_v2"}))
 
-		testRunCheck(t, gopts)
+		out, err = testRunCheckOutput(gopts)
+		OK(t, err)
+		Equals(t, "", out)
 
-		snapshotIDs := testRunList(t, "snapshots", gopts)
-		if len(snapshotIDs) == 0 {
-			t.Fatalf("found no snapshots")
-		}
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		Equals(t, uint(2), repo.Config().Version)
 
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Assert(t, len(snapshotIDs) > 0, "no snapshots found after the migration")
 		testRunRestore(t, gopts, filepath.Join(env.base, "restore"), snapshotIDs[0])
 	})
 }
 
-func TestPrune(t *testing.T) {
+func TestInitRepositoryVersion(t *testing.T) {
 	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
-		datafile := filepath.Join("testdata", "backup-data.tar.gz")
-		fd, err := os.Open(datafile)
-		if os.IsNotExist(errors.Cause(err)) {
-			t.Skipf("unable to find data file %q, skipping", datafile)
-			return
-		}
+		repository.TestUseLowSecurityKDFParameters(t)
+
+		err := runInit(InitOptions{RepositoryVersion: "7"}, gopts, nil)
+		Assert(t, err != nil, "init with an unsupported repository version did not fail")
+
+		OK(t, runInit(InitOptions{RepositoryVersion: "1"}, gopts, nil))
+
+		repo, err := OpenRepository(gopts)
 		OK(t, err)
-		OK(t, fd.Close())
+		Equals(t, uint(1), repo.Config().Version)
 
-		testRunInit(t, gopts)
+		OK(t, runMigrate(MigrateOptions{}, gopts, []string{"upgrade_repo_v2"}))
+		testRunCheck(t, gopts)
 
-		SetupTarTestFixture(t, env.testdata, datafile)
-		opts := BackupOptions{}
+		repo, err = OpenRepository(gopts)
+		OK(t, err)
+		Equals(t, uint(2), repo.Config().Version)
 
-		testRunBackup(t, []string{filepath.Join(env.testdata, "0", "0", "1")}, opts, gopts)
-		testRunBackup(t, []string{filepath.Join(env.testdata, "0", "0", "2")}, opts, gopts)
-		testRunBackup(t, []string{filepath.Join(env.testdata, "0", "0", "3")}, opts, gopts)
+		OK(t, runMigrate(MigrateOptions{}, gopts, []string{"upgrade_repo_v3"}))
+		testRunCheck(t, gopts)
 
-		snapshotIDs := testRunList(t, "snapshots", gopts)
-		Assert(t, len(snapshotIDs) == 3,
-			"expected one snapshot, got %v", snapshotIDs)
+		repo, err = OpenRepository(gopts)
+		OK(t, err)
+		Equals(t, uint(3), repo.Config().Version)
+		Equals(t, crypto.Cipher(""), repo.Config().Cipher)
 
-		testRunForget(t, gopts, snapshotIDs[0].String())
-		testRunPrune(t, gopts)
+		OK(t, runMigrate(MigrateOptions{}, gopts, []string{"upgrade_repo_v4"}))
+		testRunCheck(t, gopts)
+
+		repo, err = OpenRepository(gopts)
+		OK(t, err)
+		Equals(t, uint(4), repo.Config().Version)
+
+		OK(t, runMigrate(MigrateOptions{}, gopts, []string{"upgrade_repo_v5"}))
+		testRunCheck(t, gopts)
+
+		repo, err = OpenRepository(gopts)
+		OK(t, err)
+		Equals(t, uint(5), repo.Config().Version)
+
+		OK(t, runMigrate(MigrateOptions{}, gopts, []string{"upgrade_repo_v6"}))
 		testRunCheck(t, gopts)
+
+		repo, err = OpenRepository(gopts)
+		OK(t, err)
+		Equals(t, uint(6), repo.Config().Version)
 	})
 }
 
-func TestHardLink(t *testing.T) {
-	// this test assumes a test set with a single directory containing hard linked files
+func TestInitCipher(t *testing.T) {
 	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
-		datafile := filepath.Join("testdata", "test.hl.tar.gz")
-		fd, err := os.Open(datafile)
-		if os.IsNotExist(errors.Cause(err)) {
-			t.Skipf("unable to find data file %q, skipping", datafile)
-			return
-		}
+		repository.TestUseLowSecurityKDFParameters(t)
+
+		err := runInit(InitOptions{RepositoryVersion: "2", Cipher: "chacha20-poly1305"}, gopts, nil)
+		Assert(t, err != nil, "init with a cipher not supported by version 2 did not fail")
+
+		err = runInit(InitOptions{Cipher: "foo"}, gopts, nil)
+		Assert(t, err != nil, "init with an unknown cipher did not fail")
+
+		OK(t, runInit(InitOptions{Cipher: "chacha20-poly1305"}, gopts, nil))
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		testRunCheck(t, gopts)
+
+		repo, err := OpenRepository(gopts)
 		OK(t, err)
-		OK(t, fd.Close())
+		Equals(t, crypto.ChaCha20Poly1305, repo.Config().Cipher)
 
-		testRunInit(t, gopts)
+		restoredir := filepath.Join(env.base, "restore")
+		testRunRestoreLatest(t, gopts, restoredir, nil, "")
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, filepath.Base(env.testdata))),
+			"directories are not equal")
+	})
+}
 
-		SetupTarTestFixture(t, env.testdata, datafile)
+func TestInitCompression(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		repository.TestUseLowSecurityKDFParameters(t)
 
-		linkTests := createFileSetPerHardlink(env.testdata)
+		err := runInit(InitOptions{RepositoryVersion: "5", Compression: "max"}, gopts, nil)
+		Assert(t, err != nil, "init with compression not supported by version 5 did not fail")
 
-		opts := BackupOptions{}
+		err = runInit(InitOptions{Compression: "foo"}, gopts, nil)
+		Assert(t, err != nil, "init with an unknown compression mode did not fail")
 
-		// first backup
-		testRunBackup(t, []string{env.testdata}, opts, gopts)
-		snapshotIDs := testRunList(t, "snapshots", gopts)
-		Assert(t, len(snapshotIDs) == 1,
-			"expected one snapshot, got %v", snapshotIDs)
+		OK(t, runInit(InitOptions{Compression: "max"}, gopts, nil))
 
+		OK(t, os.MkdirAll(env.testdata, 0755))
+		text := bytes.Repeat([]byte("restic compresses this text very well\n"), 10000)
+		OK(t, ioutil.WriteFile(filepath.Join(env.testdata, "text"), text, 0644))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "random"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
 		testRunCheck(t, gopts)
 
-		// restore all backups and compare
-		for i, snapshotID := range snapshotIDs {
-			restoredir := filepath.Join(env.base, fmt.Sprintf("restore%d", i))
-			t.Logf("restoring snapshot %v to %v", snapshotID.Str(), restoredir)
-			testRunRestore(t, gopts, restoredir, snapshotIDs[0])
-			Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
-				"directories are not equal")
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		Equals(t, compression.Max, repo.Config().Compression)
 
-			linkResults := createFileSetPerHardlink(filepath.Join(restoredir, "testdata"))
-			Assert(t, linksEqual(linkTests, linkResults),
-				"links are not equal")
+		compressed := 0
+		for _, packID := range testRunList(t, "packs", gopts) {
+			blobs, _, err := repo.ListPack(gopts.ctx, packID)
+			OK(t, err)
+
+			for _, blob := range blobs {
+				if blob.IsCompressed() {
+					compressed++
+					Assert(t, blob.Length < blob.UncompressedLength,
+						"compressed blob %v is not smaller (%d >= %d)", blob.ID.Str(), blob.Length, blob.UncompressedLength)
+				}
+			}
 		}
+		Assert(t, compressed > 0, "no compressed blobs found in the pack headers")
 
+		restoredir := filepath.Join(env.base, "restore")
+		testRunRestoreLatest(t, gopts, restoredir, nil, "")
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, filepath.Base(env.testdata))),
+			"directories are not equal")
+
+		// the pack headers are the only source for the index
+		testRunRebuildIndex(t, gopts)
 		testRunCheck(t, gopts)
 	})
 }
 
-func linksEqual(source, dest map[uint64][]string) bool {
-	for _, vs := range source {
-		found := false
-		for kd, vd := range dest {
-			if linkEqual(vs, vd) {
-				delete(dest, kd)
-				found = true
-				break
-			}
-		}
+func TestCompressionOptions(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, os.MkdirAll(env.testdata, 0755))
+		text := bytes.Repeat([]byte("restic compresses this text very well\n"), 10000)
+		OK(t, ioutil.WriteFile(filepath.Join(env.testdata, "text"), text, 0644))
+
+		gopts.extended["compression.data"] = "zstd-4"
+		gopts.extended["compression.tree"] = "foo"
+		err := runBackup(BackupOptions{}, gopts, []string{env.testdata})
+		Assert(t, err != nil, "backup with an invalid compression mode did not fail")
+
+		gopts.extended["compression.data"] = "off"
+		gopts.extended["compression.tree"] = "zstd-19"
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		testRunCheck(t, gopts)
+
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+
+		trees := 0
+		for _, packID := range testRunList(t, "packs", gopts) {
+			blobs, _, err := repo.ListPack(gopts.ctx, packID)
+			OK(t, err)
+
+			for _, blob := range blobs {
+				switch blob.Type {
+				case restic.DataBlob:
+					Assert(t, !blob.IsCompressed(), "data blob %v is compressed", blob.ID.Str())
+				case restic.TreeBlob:
+					trees++
+					Assert(t, blob.IsCompressed(), "tree blob %v is not compressed", blob.ID.Str())
+				}
+			}
+		}
+		Assert(t, trees > 0, "no tree blobs found")
+	})
+}
+
+func TestRewrite(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "old"}, gopts)
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "other"}, gopts)
+
+		_, snapshots := testRunSnapshots(t, gopts)
+		Equals(t, 2, len(snapshots))
+
+		OK(t, runRewrite(RewriteOptions{Host: "old", SetHost: "new", DryRun: true}, gopts, nil))
+		_, after := testRunSnapshots(t, gopts)
+		Equals(t, snapshots, after)
+
+		OK(t, runRewrite(RewriteOptions{Host: "old", SetHost: "new"}, gopts, nil))
+		testRunCheck(t, gopts)
+
+		_, snapshots = testRunSnapshots(t, gopts)
+		Equals(t, 2, len(snapshots))
+
+		var renamed restic.ID
+		hosts := make(map[string]int)
+		for id, sn := range snapshots {
+			hosts[sn.Hostname]++
+			if sn.Hostname == "new" {
+				renamed = id
+				Assert(t, sn.Original != nil, "original ID not recorded")
+			}
+		}
+		Equals(t, map[string]int{"new": 1, "other": 1}, hosts)
+
+		// the renamed snapshot is used as the parent for the new host name
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "new"}, gopts)
+		newest, _ := testRunSnapshots(t, gopts)
+		Assert(t, newest.Parent != nil && newest.Parent.Equal(renamed),
+			"renamed snapshot %v not used as parent, got %v", renamed.Str(), newest.Parent)
+
+		OK(t, runRewrite(RewriteOptions{ReplacePaths: []string{env.testdata + "=/data"}}, gopts, nil))
+		_, snapshots = testRunSnapshots(t, gopts)
+		for _, sn := range snapshots {
+			Equals(t, []string{"/data"}, sn.Paths)
+		}
+	})
+}
+
+func TestCheckRestoreNoLock(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		datafile := filepath.Join("testdata", "small-repo.tar.gz")
+		SetupTarTestFixture(t, env.base, datafile)
+
+		err := filepath.Walk(env.repo, func(p string, fi os.FileInfo, e error) error {
+			if e != nil {
+				return e
+			}
+			return os.Chmod(p, fi.Mode() & ^(os.FileMode(0222)))
+		})
+		OK(t, err)
+
+		gopts.NoLock = true
+
+		testRunCheck(t, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		if len(snapshotIDs) == 0 {
+			t.Fatalf("found no snapshots")
+		}
+
+		testRunRestore(t, gopts, filepath.Join(env.base, "restore"), snapshotIDs[0])
+	})
+}
+
+func readCheckResult(t testing.TB, filename string) (res checkResult, status map[string]string) {
+	buf, err := ioutil.ReadFile(filename)
+	OK(t, err)
+	OK(t, json.Unmarshal(buf, &res))
+
+	status = make(map[string]string)
+	for _, r := range res.Checks {
+		status[r.Name] = r.Status
+	}
+	return res, status
+}
+
+func TestCheckLevel(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		resultFile := filepath.Join(env.base, "check.json")
+		var tests = []struct {
+			level  string
+			status map[string]string
+		}{
+			{"quick", map[string]string{"index": "ok", "packs": "ok", "structure": "skipped", "read_data": "skipped"}},
+			{"standard", map[string]string{"index": "ok", "packs": "ok", "structure": "ok", "read_data": "skipped"}},
+			{"deep", map[string]string{"index": "ok", "packs": "ok", "structure": "ok", "read_data": "ok"}},
+		}
+
+		for _, test := range tests {
+			opts := CheckOptions{Level: test.level, ResultFile: resultFile}
+			OK(t, runCheck(opts, gopts, nil))
+
+			res, status := readCheckResult(t, resultFile)
+			Equals(t, test.level, res.Level)
+			Assert(t, res.Success, "check %v was not successful", test.level)
+			Equals(t, guarantees(test.level), res.Guarantees)
+			for name, want := range test.status {
+				Assert(t, status[name] == want, "level %v: want status %q for %v, got %q", test.level, want, name, status[name])
+			}
+		}
+
+		for _, opts := range []CheckOptions{
+			{Level: "paranoid"},
+			{Level: "quick", ReadData: true},
+			{Level: "quick", CheckUnused: true},
+			{Level: "deep", ReadDataPercent: 10},
+			{Level: "deep", ReadDataSubset: "1/2"},
+			{ReadDataSubset: "3/2"},
+			{ReadDataSubset: "1/2", ReadDataPercent: 10},
+		} {
+			Assert(t, runCheck(opts, gopts, nil) != nil, "no error for invalid options %#v", opts)
+		}
+
+		for _, subset := range []string{"1/2", "2/2"} {
+			opts := CheckOptions{ReadDataSubset: subset, ResultFile: resultFile}
+			OK(t, runCheck(opts, gopts, nil))
+
+			res, status := readCheckResult(t, resultFile)
+			Equals(t, "standard", res.Level)
+			Equals(t, "ok", status["read_data"])
+			Equals(t, subset, res.Checks[len(res.Checks)-1].ReadDataSubset)
+		}
+
+		// remove a pack, which is detected by the quick check
+		var pack string
+		OK(t, filepath.Walk(filepath.Join(env.repo, "data"), func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() && pack == "" {
+				pack = p
+			}
+			return err
+		}))
+		OK(t, os.Remove(pack))
+
+		opts := CheckOptions{Level: "quick", ResultFile: resultFile}
+		Assert(t, runCheck(opts, gopts, nil) != nil, "quick check did not find the missing pack")
+
+		res, status := readCheckResult(t, resultFile)
+		Assert(t, !res.Success, "result records success for a damaged repository")
+		Equals(t, "failed", status["packs"])
+	})
+}
+
+func TestCheckRepair(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		for _, opts := range []CheckOptions{
+			{Repair: true},
+			{Level: "quick", Repair: true},
+		} {
+			Assert(t, runCheck(opts, gopts, nil) != nil, "no error for invalid options %#v", opts)
+		}
+
+		noLockOpts := gopts
+		noLockOpts.NoLock = true
+		Assert(t, runCheck(CheckOptions{ReadData: true, Repair: true}, noLockOpts, nil) != nil,
+			"repair without a lock succeeded")
+
+		// damage the first blob of a pack, packs start with the blobs
+		var pack string
+		OK(t, filepath.Walk(filepath.Join(env.repo, "data"), func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() && pack == "" {
+				pack = p
+			}
+			return err
+		}))
+
+		buf, err := ioutil.ReadFile(pack)
+		OK(t, err)
+		buf[0] ^= 0xff
+		OK(t, os.Chmod(pack, 0600))
+		OK(t, ioutil.WriteFile(pack, buf, 0600))
+
+		resultFile := filepath.Join(env.base, "check.json")
+		opts := CheckOptions{ReadData: true, Repair: true, ResultFile: resultFile}
+		Assert(t, runCheck(opts, gopts, nil) != nil, "check did not find the damaged pack")
+
+		res, status := readCheckResult(t, resultFile)
+		Equals(t, "failed", status["read_data"])
+		Equals(t, "ok", status["repair"])
+
+		report := res.Checks[len(res.Checks)-1]
+		Equals(t, []string{filepath.Base(pack)}, report.RepairedPacks)
+		Equals(t, 1, len(report.DamagedBlobs))
+
+		_, err = os.Stat(pack)
+		Assert(t, os.IsNotExist(err), "damaged pack %v has not been removed", pack)
+
+		// the remaining data is intact, the lost blob is still referenced
+		opts = CheckOptions{ReadData: true, ResultFile: resultFile}
+		_ = runCheck(opts, gopts, nil)
+
+		_, status = readCheckResult(t, resultFile)
+		Equals(t, "ok", status["packs"])
+		Equals(t, "ok", status["read_data"])
+	})
+}
+
+func TestDebugIndex(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		indexes1 := testRunList(t, "index", gopts)
+		Equals(t, 1, len(indexes1))
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		indexes2 := testRunList(t, "index", gopts)
+		Equals(t, 2, len(indexes2))
+
+		newIndex := indexes2[0]
+		if newIndex.Equal(indexes1[0]) {
+			newIndex = indexes2[1]
+		}
+
+		buf := bytes.NewBuffer(nil)
+		jsonOpts := gopts
+		jsonOpts.stdout = buf
+		jsonOpts.JSON = true
+
+		OK(t, runDebugCommand(jsonOpts, []string{"index-stats"}))
+
+		var stats indexStats
+		OK(t, json.Unmarshal(buf.Bytes(), &stats))
+		Equals(t, 2, stats.IndexFiles)
+		Equals(t, 0, stats.Superseded)
+		Equals(t, uint64(0), stats.RepeatedEntries)
+		data := stats.Types[restic.DataBlob.String()]
+		Assert(t, data != nil && data.Blobs == 2 && data.Bytes > 2000,
+			"wrong statistics for data blobs: %s", buf.String())
+
+		// the second index only contains the blobs of the second backup
+		buf.Reset()
+		OK(t, runDebugCommand(jsonOpts, []string{"index-diff", indexes1[0].String()[:8], newIndex.String()}))
+
+		var diff indexDiff
+		OK(t, json.Unmarshal(buf.Bytes(), &diff))
+		Equals(t, diff.OldEntries, diff.RemovedBlobs)
+		Equals(t, diff.NewEntries, diff.AddedBlobs)
+		Equals(t, 0, diff.MovedBlobs)
+		Assert(t, len(diff.RemovedPacks) > 0 && len(diff.AddedPacks) > 0,
+			"packs are not listed: %s", buf.String())
+
+		buf.Reset()
+		OK(t, runDebugCommand(jsonOpts, []string{"index-diff", newIndex.String(), newIndex.String()}))
+
+		diff = indexDiff{}
+		OK(t, json.Unmarshal(buf.Bytes(), &diff))
+		Equals(t, 0, diff.RemovedBlobs+diff.AddedBlobs+diff.MovedBlobs+len(diff.RemovedPacks)+len(diff.AddedPacks))
+
+		// the versioned output prints events
+		jsonOpts.JSONSchema = 1
+		for typ, args := range map[string][]string{
+			"index_stats": {"index-stats"},
+			"index_diff":  {"index-diff", newIndex.String(), newIndex.String()},
+		} {
+			buf.Reset()
+			OK(t, runDebugCommand(jsonOpts, args))
+
+			var event struct {
+				Schema uint   `json:"schema"`
+				Type   string `json:"type"`
+			}
+			OK(t, json.Unmarshal(buf.Bytes(), &event))
+			Equals(t, uint(1), event.Schema)
+			Equals(t, typ, event.Type)
+		}
+
+		for _, args := range [][]string{{}, {"index-dump"}, {"index-diff", newIndex.String()}} {
+			Assert(t, runDebugCommand(gopts, args) != nil, "no error for invalid arguments %v", args)
+		}
+	})
+}
+
+func TestPrune(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		datafile := filepath.Join("testdata", "backup-data.tar.gz")
+		fd, err := os.Open(datafile)
+		if os.IsNotExist(errors.Cause(err)) {
+			t.Skipf("unable to find data file %q, skipping", datafile)
+			return
+		}
+		OK(t, err)
+		OK(t, fd.Close())
+
+		testRunInit(t, gopts)
+
+		SetupTarTestFixture(t, env.testdata, datafile)
+		opts := BackupOptions{}
+
+		testRunBackup(t, []string{filepath.Join(env.testdata, "0", "0", "1")}, opts, gopts)
+		testRunBackup(t, []string{filepath.Join(env.testdata, "0", "0", "2")}, opts, gopts)
+		testRunBackup(t, []string{filepath.Join(env.testdata, "0", "0", "3")}, opts, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Assert(t, len(snapshotIDs) == 3,
+			"expected one snapshot, got %v", snapshotIDs)
+
+		testRunForget(t, gopts, snapshotIDs[0].String())
+		testRunPrune(t, gopts)
+		testRunCheck(t, gopts)
+	})
+}
+
+func TestPruneDryRun(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 2*1024*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 2*1024*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Equals(t, 2, len(snapshotIDs))
+		testRunForget(t, gopts, snapshotIDs[0].String())
+
+		packs := testRunList(t, "packs", gopts)
+		indexes := testRunList(t, "index", gopts)
+
+		buf := bytes.NewBuffer(nil)
+		globalOptions.stdout = buf
+		defer func() {
+			globalOptions.stdout = os.Stdout
+		}()
+
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, DryRun: true}, gopts))
+		Assert(t, strings.Contains(buf.String(), "this would free"),
+			"summary missing from output: %s", buf.String())
+
+		Equals(t, restic.NewIDSet(packs...), restic.NewIDSet(testRunList(t, "packs", gopts)...))
+		Equals(t, restic.NewIDSet(indexes...), restic.NewIDSet(testRunList(t, "index", gopts)...))
+
+		testRunPrune(t, gopts)
+		testRunCheck(t, gopts)
+	})
+}
+
+func TestPruneJSON(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 2*1024*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 2*1024*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Equals(t, 2, len(snapshotIDs))
+		testRunForget(t, gopts, snapshotIDs[0].String())
+
+		buf := bytes.NewBuffer(nil)
+		gopts.stdout = buf
+		gopts.Quiet = true
+
+		// the unversioned output is a single summary
+		gopts.JSON = true
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, DryRun: true}, gopts))
+
+		var summary pruneSummary
+		OK(t, json.Unmarshal(buf.Bytes(), &summary))
+		Assert(t, summary.DryRun, "dry run not reported: %s", buf.String())
+		Assert(t, summary.Packs > 0 && summary.FreedBytes > 0,
+			"wrong summary for dry run: %s", buf.String())
+		Equals(t, 1, summary.Snapshots)
+
+		// the versioned output contains one event per line
+		buf.Reset()
+		gopts.JSONSchema = 1
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000}, gopts))
+
+		types := make(map[string]int)
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var event struct {
+				Schema uint   `json:"schema"`
+				Type   string `json:"type"`
+			}
+			OK(t, json.Unmarshal([]byte(line), &event))
+			Equals(t, uint(1), event.Schema)
+			types[event.Type]++
+
+			if event.Type == "prune_summary" {
+				summary = pruneSummary{}
+				OK(t, json.Unmarshal([]byte(line), &summary))
+			}
+		}
+
+		for _, typ := range []string{"prune_repository", "prune_plan", "prune_summary"} {
+			Equals(t, 1, types[typ])
+		}
+		Assert(t, types["prune_progress"] > 0, "no progress reported: %s", buf.String())
+		Assert(t, !summary.DryRun && summary.FreedBytes > 0,
+			"wrong summary: %s", buf.String())
+
+		testRunCheck(t, gopts)
+	})
+}
+
+func TestPruneMaxUnused(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 500*1024))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		OK(t, os.Remove(filepath.Join(env.testdata, "file1")))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Equals(t, 2, len(snapshotIDs))
+		testRunForget(t, gopts, snapshotIDs[0].String())
+
+		// the unused data is below the limit, so no pack is rewritten (but
+		// packs without used data are deleted)
+		packs := restic.NewIDSet(testRunList(t, "packs", gopts)...)
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, MaxUnused: "100%"}, gopts))
+		newPacks := restic.NewIDSet(testRunList(t, "packs", gopts)...).Sub(packs)
+		Equals(t, 0, len(newPacks))
+		OK(t, runCheck(CheckOptions{ReadData: true}, gopts, nil))
+
+		// without unused data left, check does not find unused blobs
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, MaxUnused: "0"}, gopts))
+		testRunCheck(t, gopts)
+
+		Assert(t, runPrune(PruneOptions{MaxUnused: "200%"}, gopts) != nil,
+			"no error for invalid --max-unused")
+	})
+}
+
+func TestPruneMaxRepackSize(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 500*1024))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		OK(t, os.Remove(filepath.Join(env.testdata, "file1")))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Equals(t, 2, len(snapshotIDs))
+		testRunForget(t, gopts, snapshotIDs[0].String())
+
+		// no pack may be rewritten, so no new packs are written
+		packs := restic.NewIDSet(testRunList(t, "packs", gopts)...)
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, MaxRepackSize: "0"}, gopts))
+		newPacks := restic.NewIDSet(testRunList(t, "packs", gopts)...).Sub(packs)
+		Equals(t, 0, len(newPacks))
+		OK(t, runCheck(CheckOptions{ReadData: true}, gopts, nil))
+
+		// with a large enough budget, all unused data is removed
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, MaxRepackSize: "1G"}, gopts))
+		testRunCheck(t, gopts)
+
+		Assert(t, runPrune(PruneOptions{MaxRepackSize: "10x"}, gopts) != nil,
+			"no error for invalid --max-repack-size")
+	})
+}
+
+func TestPruneResume(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 500*1024))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		OK(t, os.Remove(filepath.Join(env.testdata, "file1")))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Equals(t, 2, len(snapshotIDs))
+		testRunForget(t, gopts, snapshotIDs[0].String())
+
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		snapshots, err := restic.LoadAllSnapshots(gopts.ctx, repo)
+		OK(t, err)
+		filename := pruneStateFilename(gopts, repo)
+
+		// a state for which snapshots have been added is discarded
+		packs := restic.NewIDSet(testRunList(t, "packs", gopts)...)
+		OK(t, newPruneState(filename, nil, restic.NewIDSet(), packs, 0).save())
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, DryRun: true}, gopts))
+		_, err = os.Stat(filename)
+		OK(t, err)
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, MaxUnused: "100%"}, gopts))
+		_, err = os.Stat(filename)
+		Assert(t, os.IsNotExist(err), "prune state was not removed")
+		newPacks := restic.NewIDSet(testRunList(t, "packs", gopts)...).Sub(packs)
+		Equals(t, 0, len(newPacks))
+
+		// resume an interrupted prune which rewrites all packs and has
+		// already rewritten one of them
+		packs = restic.NewIDSet(testRunList(t, "packs", gopts)...)
+		state := newPruneState(filename, snapshots, restic.NewIDSet(), packs, 0)
+		state.Done = state.Rewrite[:1]
+		OK(t, state.save())
+
+		idx, err := index.New(gopts.ctx, repo, nil)
+		OK(t, err)
+		keepBlobs := restic.NewBlobSet()
+		for _, blob := range idx.Packs[state.Done[0]].Entries {
+			keepBlobs.Insert(restic.BlobHandle{ID: blob.ID, Type: blob.Type})
+		}
+		OK(t, repo.LoadIndex(gopts.ctx))
+		OK(t, repository.RepackBlobs(gopts.ctx, repo, restic.NewIDSet(state.Done...), keepBlobs, nil))
+		OK(t, repo.SaveIndex(gopts.ctx))
+
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000}, gopts))
+		_, err = os.Stat(filename)
+		Assert(t, os.IsNotExist(err), "prune state was not removed")
+
+		newPacks = restic.NewIDSet(testRunList(t, "packs", gopts)...)
+		for id := range packs {
+			Assert(t, !newPacks.Has(id), "pack %v was not removed", id.Str())
+		}
+		OK(t, runCheck(CheckOptions{ReadData: true}, gopts, nil))
+	})
+}
+
+func TestPruneIntent(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		packs := restic.NewIDSet(testRunList(t, "packs", gopts)...)
+
+		// save an unused blob to a new pack, which prune removes
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		OK(t, repo.LoadIndex(gopts.ctx))
+		_, err = repo.SaveBlob(gopts.ctx, restic.DataBlob, Random(23, 1000), restic.ID{})
+		OK(t, err)
+		OK(t, repo.Flush())
+
+		unused := restic.NewIDSet(testRunList(t, "packs", gopts)...).Sub(packs)
+		Equals(t, 1, len(unused))
+
+		// prune is interrupted after removing the pack, before the index has
+		// been rebuilt
+		_, err = savePruneIntent(gopts.ctx, repo, unused)
+		OK(t, err)
+		h := restic.Handle{Type: restic.DataFile, Name: unused.List()[0].String()}
+		OK(t, repo.Backend().Remove(gopts.ctx, h))
+
+		nolockOpts := gopts
+		nolockOpts.NoLock = true
+		Assert(t, runCheck(CheckOptions{}, nolockOpts, nil) != nil,
+			"check did not find the missing pack")
+
+		// the prune is completed as soon as the repository is locked
+		testRunCheck(t, gopts)
+		Equals(t, 0, len(testRunList(t, "intents", gopts)))
+		Equals(t, packs, restic.NewIDSet(testRunList(t, "packs", gopts)...))
+	})
+}
+
+func TestPruneSuggestion(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		gopts.CacheDir = filepath.Join(env.base, "cache")
+		gopts.CacheSize = "10M"
+		testRunInit(t, gopts)
+
+		OK(t, runConfig(ConfigOptions{PruneMaxUnused: []string{"1%"}}, gopts, nil))
+
+		p := filepath.Join(env.testdata, "file")
+		OK(t, appendRandomData(p, 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		OK(t, os.Remove(p))
+		OK(t, appendRandomData(p, 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Assert(t, len(snapshotIDs) == 2,
+			"expected two snapshots, got %v", snapshotIDs)
+
+		oldest := snapshotIDs[0]
+		newest, _ := testRunSnapshots(t, gopts)
+		if newest != nil && oldest.Equal(*newest.ID) {
+			oldest = snapshotIDs[1]
+		}
+		testRunForget(t, gopts, oldest.String())
+
+		openRepo := func() *repository.Repository {
+			repo, err := OpenRepository(gopts)
+			OK(t, err)
+			OK(t, repo.LoadIndex(gopts.ctx))
+			return repo
+		}
+
+		buf := bytes.NewBuffer(nil)
+		globalOptions.stdout = buf
+		globalOptions.Quiet = true
+		defer func() {
+			globalOptions.stdout = os.Stdout
+			globalOptions.Quiet = gopts.Quiet
+		}()
+		gopts.stdout = buf
+		gopts.JSON = true
+
+		OK(t, printPruneSuggestion(gopts.ctx, gopts, openRepo()))
+
+		var s pruneSuggestion
+		OK(t, json.Unmarshal(buf.Bytes(), &s))
+		Assert(t, s.PruneSuggested, "prune was not suggested: %+v", s)
+		Assert(t, s.UnusedBytes >= 500*1024, "too little unused data found: %+v", s)
+
+		testRunPrune(t, gopts)
+
+		buf.Reset()
+		OK(t, printPruneSuggestion(gopts.ctx, gopts, openRepo()))
+		OK(t, json.Unmarshal(buf.Bytes(), &s))
+		Assert(t, !s.PruneSuggested, "prune was suggested after prune: %+v", s)
+		Equals(t, uint64(0), s.UnusedBytes)
+
+		// without a cache directory the check is skipped with a warning
+		stderr := bytes.NewBuffer(nil)
+		globalOptions.stderr = stderr
+		defer func() {
+			globalOptions.stderr = os.Stderr
+		}()
+
+		buf.Reset()
+		gopts.CacheDir = ""
+		OK(t, printPruneSuggestion(gopts.ctx, gopts, openRepo()))
+		Equals(t, 0, buf.Len())
+		Assert(t, strings.Contains(stderr.String(), "--cache-dir"),
+			"no warning about the missing cache directory: %q", stderr.String())
+	})
+}
+
+func TestSnapshotsJSONSchema(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		buf := bytes.NewBuffer(nil)
+		gopts.stdout = buf
+		gopts.JSON, gopts.JSONSchema = true, 1
+
+		OK(t, runSnapshots(SnapshotOptions{}, gopts, nil))
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		Equals(t, 2, len(lines))
+
+		for _, line := range lines {
+			var event struct {
+				Schema uint       `json:"schema"`
+				Type   string     `json:"type"`
+				ID     *restic.ID `json:"id"`
+			}
+			OK(t, json.Unmarshal([]byte(line), &event))
+			Equals(t, uint(1), event.Schema)
+			Equals(t, "snapshot", event.Type)
+			Assert(t, event.ID != nil, "snapshot ID is missing in %v", line)
+		}
+	})
+}
+
+func TestSnapshotsPorcelain(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Tags: []string{"a,b", "c"}}, gopts)
+
+		_, snapmap := testRunSnapshots(t, gopts)
+		Equals(t, 1, len(snapmap))
+
+		buf := bytes.NewBuffer(nil)
+		globalOptions.stdout = buf
+		defer func() {
+			globalOptions.stdout = os.Stdout
+		}()
+
+		OK(t, runSnapshots(SnapshotOptions{Porcelain: true}, globalOptions, nil))
+
+		for id, sn := range snapmap {
+			want := strings.Join([]string{
+				id.String(),
+				sn.Time.Format(time.RFC3339),
+				sn.Hostname,
+				`a\,b,c`,
+				env.testdata,
+			}, "\t") + "\n"
+			Equals(t, want, buf.String())
+		}
+	})
+}
+
+func TestPruneDeleteDelay(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		p := filepath.Join(env.testdata, "file")
+		OK(t, appendRandomData(p, 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+
+		OK(t, os.Remove(p))
+		OK(t, appendRandomData(p, 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		testRunForget(t, gopts, snapshotIDs[0].String())
+
+		count := func(tpe restic.FileType) int {
+			repo, err := OpenRepository(gopts)
+			OK(t, err)
+
+			n := 0
+			for range repo.List(gopts.ctx, tpe) {
+				n++
+			}
+			return n
+		}
+
+		packsBefore := count(restic.DataFile)
+
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, DeleteDelay: time.Hour}, gopts))
+		Equals(t, 1, count(restic.DeletionFile))
+		Assert(t, count(restic.DataFile) >= packsBefore,
+			"packs were removed before the delay passed")
+		testRunCheck(t, gopts)
+
+		// packs recorded earlier are not removed before the delay has passed
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, DeleteDelay: time.Hour}, gopts))
+		Equals(t, 1, count(restic.DeletionFile))
+
+		// a run without a delay keeps the delay of the run which recorded them
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000}, gopts))
+		Equals(t, 1, count(restic.DeletionFile))
+		Assert(t, count(restic.DataFile) >= packsBefore,
+			"packs were removed by a run without delay before the delay passed")
+
+		// let the delay pass
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		list, err := restic.LoadAllPendingDeletions(gopts.ctx, repo)
+		OK(t, err)
+		for _, d := range list {
+			OK(t, repo.Backend().Remove(gopts.ctx, restic.Handle{Type: restic.DeletionFile, Name: d.ID().String()}))
+			d.NotBefore = time.Now().Add(-time.Minute)
+			_, err = restic.SavePendingDeletion(gopts.ctx, repo, d)
+			OK(t, err)
+		}
+
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000}, gopts))
+		Equals(t, 0, count(restic.DeletionFile))
+		Assert(t, count(restic.DataFile) < packsBefore,
+			"packs were not removed, before %d, after %d", packsBefore, count(restic.DataFile))
+		testRunCheck(t, gopts)
+	})
+}
+
+func TestPruneCombineSmallPacks(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		// each backup saves its data in a new small pack
+		for i := 0; i < 3; i++ {
+			OK(t, appendRandomData(filepath.Join(env.testdata, fmt.Sprintf("file%d", i)), 100*1024))
+			testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		}
+
+		packsBefore := testRunList(t, "packs", gopts)
+		Assert(t, len(packsBefore) >= 3,
+			"expected at least three packs, got %v", len(packsBefore))
+
+		buf := bytes.NewBuffer(nil)
+		globalOptions.stdout = buf
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, DryRun: true}, gopts))
+		globalOptions.stdout = os.Stdout
+		Assert(t, strings.Contains(buf.String(), fmt.Sprintf("would combine %d small packs", len(packsBefore))),
+			"small packs missing from output: %s", buf.String())
+
+		testRunPrune(t, gopts)
+
+		packsAfter := testRunList(t, "packs", gopts)
+		Equals(t, 1, len(packsAfter))
+		testRunCheck(t, gopts)
+
+		// a single small pack is left alone
+		testRunPrune(t, gopts)
+		Equals(t, packsAfter, testRunList(t, "packs", gopts))
+
+		restoredir := filepath.Join(env.base, "restore")
+		testRunRestoreLatest(t, gopts, restoredir, nil, "")
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
+			"directories are not equal")
+	})
+}
+
+func TestPruneDuplicateBlobs(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		// copy all blobs of a pack, so that they are stored twice
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		idx, err := index.New(gopts.ctx, repo, nil)
+		OK(t, err)
+
+		var (
+			packID restic.ID
+			blobs  = restic.NewBlobSet()
+		)
+		for id, pack := range idx.Packs {
+			if len(pack.Entries) > len(blobs) {
+				packID, blobs = id, restic.NewBlobSet()
+				for _, blob := range pack.Entries {
+					blobs.Insert(restic.BlobHandle{ID: blob.ID, Type: blob.Type})
+				}
+			}
+		}
+		OK(t, repo.LoadIndex(gopts.ctx))
+		OK(t, repository.RepackBlobs(gopts.ctx, repo, restic.NewIDSet(packID), blobs, nil))
+		OK(t, repo.SaveIndex(gopts.ctx))
+
+		// one of the copies is removed, none of the packs is rewritten
+		buf := bytes.NewBuffer(nil)
+		globalOptions.stdout = buf
+		OK(t, runPrune(PruneOptions{DeleteBatchSize: 1000, DryRun: true}, gopts))
+		globalOptions.stdout = os.Stdout
+		Assert(t, strings.Contains(buf.String(), "would delete 1 unneeded packs"),
+			"duplicate pack is not deleted: %s", buf.String())
+		Assert(t, strings.Contains(buf.String(), "would rewrite 0 packs"),
+			"packs with duplicate blobs are rewritten: %s", buf.String())
+
+		testRunPrune(t, gopts)
+		testRunCheck(t, gopts)
+
+		restoredir := filepath.Join(env.base, "restore")
+		testRunRestoreLatest(t, gopts, restoredir, nil, "")
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
+			"directories are not equal")
+	})
+}
+
+func TestPruneConcurrent(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		p := filepath.Join(env.testdata, "file")
+		OK(t, appendRandomData(p, 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+
+		OK(t, os.Remove(p))
+		OK(t, appendRandomData(p, 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		sn, err := restic.LoadSnapshot(gopts.ctx, repo, snapshotIDs[0])
+		OK(t, err)
+
+		testRunForget(t, gopts, snapshotIDs[0].String())
+
+		count := func(tpe restic.FileType) int {
+			n := 0
+			for range repo.List(gopts.ctx, tpe) {
+				n++
+			}
+			return n
+		}
+
+		packsBefore := count(restic.DataFile)
+
+		// the packs are only recorded, they are removed by the next run
+		opts := PruneOptions{DeleteBatchSize: 1000, Concurrent: true, DeleteDelay: time.Nanosecond}
+		OK(t, runPrune(opts, gopts))
+		Equals(t, 1, count(restic.DeletionFile))
+		Assert(t, count(restic.DataFile) >= packsBefore,
+			"packs were removed by the run which recorded them")
+		testRunCheck(t, gopts)
+
+		// a snapshot which references the data again, like one saved by a
+		// backup running concurrently, keeps the packs from being removed
+		sn.Tags = append(sn.Tags, "concurrent")
+		_, err = repo.SaveJSONUnpacked(gopts.ctx, restic.SnapshotFile, sn)
+		OK(t, err)
+
+		// a plain prune checks the snapshots for references as well
+		plain := PruneOptions{DeleteBatchSize: 1000, DeleteDelay: time.Nanosecond}
+		OK(t, runPrune(plain, gopts))
+		Equals(t, 0, count(restic.DeletionFile))
+		Assert(t, count(restic.DataFile) >= packsBefore,
+			"packs were removed although they are still referenced")
+		testRunCheck(t, gopts)
+
+		snapshotIDs = testRunList(t, "snapshots", gopts)
+		Equals(t, 2, len(snapshotIDs))
+		for _, id := range snapshotIDs {
+			s, err := restic.LoadSnapshot(gopts.ctx, repo, id)
+			OK(t, err)
+			if s.Tree.Equal(*sn.Tree) {
+				testRunForget(t, gopts, id.String())
+			}
+		}
+
+		OK(t, runPrune(opts, gopts))
+		Equals(t, 1, count(restic.DeletionFile))
+		OK(t, runPrune(opts, gopts))
+		Equals(t, 0, count(restic.DeletionFile))
+		Assert(t, count(restic.DataFile) < packsBefore,
+			"packs were not removed, before %d, after %d", packsBefore, count(restic.DataFile))
+		testRunCheck(t, gopts)
+	})
+}
+
+func TestMaintain(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		err := runMaintain(MaintainOptions{}, gopts, nil)
+		Assert(t, err != nil, "maintain without a policy did not return an error")
+
+		OK(t, runConfig(ConfigOptions{
+			MaintainReadData:     "100%",
+			MaintainRepackBelow:  "50%",
+			MaintainRebuildIndex: "1h",
+		}, gopts, nil))
+
+		p := filepath.Join(env.testdata, "file")
+		OK(t, appendRandomData(p, 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+
+		OK(t, os.Remove(p))
+		OK(t, appendRandomData(p, 500*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		testRunForget(t, gopts, snapshotIDs[0].String())
+
+		config := func() *restic.MaintenancePolicy {
+			repo, err := OpenRepository(gopts)
+			OK(t, err)
+			return repo.Config().Maintenance
+		}
+
+		sparsePacks := func() int {
+			repo, err := OpenRepository(gopts)
+			OK(t, err)
+			OK(t, repo.LoadIndex(gopts.ctx))
+			n, err := countSparsePacks(gopts.ctx, gopts, repo, 50)
+			OK(t, err)
+			return n
+		}
+
+		Assert(t, sparsePacks() > 0, "no sparse packs found after forget")
+
+		OK(t, runMaintain(MaintainOptions{}, gopts, nil))
+		last := config().LastIndexRebuild
+		Assert(t, !last.IsZero(), "index rebuild was not recorded")
+		Equals(t, 0, sparsePacks())
+
+		// nothing is due in the second run
+		OK(t, runMaintain(MaintainOptions{}, gopts, nil))
+		Assert(t, config().LastIndexRebuild.Equal(last),
+			"index was rebuilt again in the second run")
+
+		OK(t, runConfig(ConfigOptions{MaintainRebuildIndex: "off", MaintainRepackBelow: "off", MaintainReadData: "off"}, gopts, nil))
+		Assert(t, config() == nil, "maintenance policy was not removed")
+
+		testRunCheck(t, gopts)
+	})
+}
+
+func TestDumpFileRange(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		p := filepath.Join(env.testdata, "file")
+		OK(t, appendRandomData(p, 5*1024*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		data, err := ioutil.ReadFile(p)
+		OK(t, err)
+
+		tests := []struct {
+			offset, length string
+			start, end     int
+		}{
+			{"0", "0", 0, len(data)},
+			{"1234", "100", 1234, 1334},
+			{"3m", "1m", 3 << 20, 4 << 20},
+			{"4m", "10m", 4 << 20, len(data)},
+		}
+
+		for _, test := range tests {
+			buf := bytes.NewBuffer(nil)
+			gopts.stdout = buf
+
+			opts := DumpOptions{Offset: test.offset, Length: test.length}
+			OK(t, runDump(opts, gopts, []string{"file", "latest", "/testdata/file"}))
+			Assert(t, bytes.Equal(data[test.start:test.end], buf.Bytes()),
+				"wrong data returned for offset %v, length %v", test.offset, test.length)
+		}
+
+		err = runDump(DumpOptions{Offset: "10m", Length: "0"}, gopts, []string{"file", "latest", "/testdata/file"})
+		Assert(t, err != nil, "no error returned for offset beyond the end of the file")
+	})
+}
+
+func TestDumpTar(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "a"), 100*1024))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "c"), 50*1024))
+		data, err := ioutil.ReadFile(filepath.Join(env.testdata, "a"))
+		OK(t, err)
+		OK(t, os.Mkdir(filepath.Join(env.testdata, "sub"), 0755))
+		OK(t, ioutil.WriteFile(filepath.Join(env.testdata, "sub", "b"), data, 0644))
+
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Equals(t, 1, len(snapshotIDs))
+		first := snapshotIDs[0].Str()
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "c"), 10))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		buf := bytes.NewBuffer(nil)
+		gopts.stdout = buf
+		OK(t, runDump(DumpOptions{}, gopts, []string{"tar", "latest:/testdata", first + ":/testdata/sub"}))
+
+		var regular, links int
+		tr := tar.NewReader(buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			OK(t, err)
+
+			switch hdr.Typeflag {
+			case tar.TypeReg:
+				regular++
+				content, err := ioutil.ReadAll(tr)
+				OK(t, err)
+				Equals(t, hdr.Size, int64(len(content)))
+				if path.Base(hdr.Name) != "c" {
+					Assert(t, bytes.Equal(data, content), "wrong content for %v", hdr.Name)
+				}
+			case tar.TypeLink:
+				links++
+				Assert(t, strings.HasSuffix(hdr.Linkname, "/testdata/a") || strings.HasSuffix(hdr.Linkname, "/testdata/sub/b"),
+					"unexpected link target %v for %v", hdr.Linkname, hdr.Name)
+			}
+		}
+
+		// a and c of the latest snapshot are stored, b of both snapshots is
+		// a link to a
+		Equals(t, 2, regular)
+		Equals(t, 2, links)
+
+		err = runDump(DumpOptions{}, gopts, []string{"tar", "latest:/testdata/missing"})
+		Assert(t, err != nil, "no error returned for a missing path")
+	})
+}
+
+func TestLookupBlobs(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		sn, _ := testRunSnapshots(t, gopts)
+		Assert(t, sn != nil, "snapshot not found")
+
+		unknown := restic.NewRandomID()
+
+		buf := bytes.NewBuffer(nil)
+		globalOptions.stdout = buf
+		globalOptions.JSON = true
+		defer func() {
+			globalOptions.stdout = os.Stdout
+			globalOptions.JSON = gopts.JSON
+		}()
+
+		opts := LookupBlobsOptions{Type: "tree"}
+		OK(t, runLookupBlobs(opts, globalOptions, []string{sn.Tree.String(), unknown.String()}))
+
+		var results []lookupResult
+		OK(t, json.Unmarshal(buf.Bytes(), &results))
+		Equals(t, 2, len(results))
+
+		Equals(t, *sn.Tree, results[0].ID)
+		Equals(t, restic.TreeBlob, results[0].Type)
+		Assert(t, results[0].Exists, "tree %v not found", sn.Tree.Str())
+
+		Equals(t, unknown, results[1].ID)
+		Assert(t, !results[1].Exists, "random ID %v found", unknown.Str())
+
+		// the tree is not stored as a data blob
+		buf.Reset()
+		opts = LookupBlobsOptions{Type: "data"}
+		OK(t, runLookupBlobs(opts, globalOptions, []string{sn.Tree.String()}))
+		OK(t, json.Unmarshal(buf.Bytes(), &results))
+		Equals(t, 1, len(results))
+		Assert(t, !results[0].Exists, "tree %v found as data blob", sn.Tree.Str())
+	})
+}
+
+func TestHardLink(t *testing.T) {
+	// this test assumes a test set with a single directory containing hard linked files
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		datafile := filepath.Join("testdata", "test.hl.tar.gz")
+		fd, err := os.Open(datafile)
+		if os.IsNotExist(errors.Cause(err)) {
+			t.Skipf("unable to find data file %q, skipping", datafile)
+			return
+		}
+		OK(t, err)
+		OK(t, fd.Close())
+
+		testRunInit(t, gopts)
+
+		SetupTarTestFixture(t, env.testdata, datafile)
+
+		linkTests := createFileSetPerHardlink(env.testdata)
+
+		opts := BackupOptions{}
+
+		// first backup
+		testRunBackup(t, []string{env.testdata}, opts, gopts)
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Assert(t, len(snapshotIDs) == 1,
+			"expected one snapshot, got %v", snapshotIDs)
+
+		testRunCheck(t, gopts)
+
+		// restore all backups and compare
+		for i, snapshotID := range snapshotIDs {
+			restoredir := filepath.Join(env.base, fmt.Sprintf("restore%d", i))
+			t.Logf("restoring snapshot %v to %v", snapshotID.Str(), restoredir)
+			testRunRestore(t, gopts, restoredir, snapshotIDs[0])
+			Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
+				"directories are not equal")
+
+			linkResults := createFileSetPerHardlink(filepath.Join(restoredir, "testdata"))
+			Assert(t, linksEqual(linkTests, linkResults),
+				"links are not equal")
+		}
+
+		testRunCheck(t, gopts)
+	})
+}
+
+func linksEqual(source, dest map[uint64][]string) bool {
+	for _, vs := range source {
+		found := false
+		for kd, vd := range dest {
+			if linkEqual(vs, vd) {
+				delete(dest, kd)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(dest) != 0 {
+		return false
+	}
+
+	return true
+}
+
+func linkEqual(source, dest []string) bool {
+	// equal if sliced are equal without considering order
+	if source == nil && dest == nil {
+		return true
+	}
+
+	if source == nil || dest == nil {
+		return false
+	}
+
+	if len(source) != len(dest) {
+		return false
+	}
+
+	for i := range source {
+		found := false
+		for j := range dest {
+			if source[i] == dest[j] {
+				found = true
+				break
+			}
+		}
 		if !found {
 			return false
 		}
-	}
+	}
+
+	return true
+}
+
+func TestRestoreResume(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "a"), 1000))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "b"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Assert(t, len(snapshotIDs) == 1,
+			"expected one snapshot, got %v", snapshotIDs)
+
+		// simulate an interrupted restore which has written the file "a"
+		restoredir := filepath.Join(env.base, "restore")
+		OK(t, os.MkdirAll(filepath.Join(restoredir, "testdata"), 0700))
+		marker := bytes.Repeat([]byte("x"), 1000)
+		OK(t, ioutil.WriteFile(filepath.Join(restoredir, "testdata", "a"), marker, 0600))
+
+		journalFile := filepath.Join(restoredir, restoreJournalName)
+		journal, err := restic.OpenRestoreJournal(journalFile, snapshotIDs[0])
+		OK(t, err)
+		OK(t, journal.Add(filepath.FromSlash("/testdata/a")))
+		OK(t, journal.Close())
+
+		opts := RestoreOptions{Target: restoredir, Resume: true}
+		OK(t, runRestore(opts, gopts, []string{snapshotIDs[0].String()}))
+
+		buf, err := ioutil.ReadFile(filepath.Join(restoredir, "testdata", "a"))
+		OK(t, err)
+		Assert(t, bytes.Equal(marker, buf), "file listed in the journal was restored again")
+		OK(t, testFileSize(filepath.Join(restoredir, "testdata", "b"), 1000))
+
+		_, err = os.Stat(journalFile)
+		Assert(t, os.IsNotExist(err), "journal was not removed after the restore")
+
+		// without --resume, an existing journal is ignored
+		journal, err = restic.OpenRestoreJournal(journalFile, snapshotIDs[0])
+		OK(t, err)
+		OK(t, journal.Add(filepath.FromSlash("/testdata/a")))
+		OK(t, journal.Close())
+
+		opts.Resume = false
+		OK(t, runRestore(opts, gopts, []string{snapshotIDs[0].String()}))
+
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
+			"directories are not equal")
+	})
+}
+
+func TestRestorePlan(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		for i := 0; i < 5; i++ {
+			OK(t, appendRandomData(filepath.Join(env.testdata, fmt.Sprintf("file%d", i)), 3*1024*1024))
+		}
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Equals(t, 1, len(snapshotIDs))
+
+		restoredir := filepath.Join(env.base, "restore")
+		buf := bytes.NewBuffer(nil)
+		jsonGopts := gopts
+		jsonGopts.JSON = true
+		jsonGopts.stdout = buf
+		OK(t, runRestore(RestoreOptions{Target: restoredir, PlanOnly: true}, jsonGopts, []string{snapshotIDs[0].String()}))
+
+		var plan restorePlanSummary
+		OK(t, json.Unmarshal(buf.Bytes(), &plan))
+		Equals(t, 5, plan.Files)
+		Equals(t, uint64(5*3*1024*1024), plan.FileBytes)
+		Assert(t, plan.Requests > 0 && plan.Requests <= plan.Packs*2,
+			"ranges were not coalesced, %d requests for %d packs", plan.Requests, plan.Packs)
+		Assert(t, plan.Bytes >= plan.BlobBytes && plan.BlobBytes > plan.FileBytes,
+			"invalid number of bytes in plan: %v", plan)
+
+		_, err := os.Stat(restoredir)
+		Assert(t, os.IsNotExist(err), "restore with --plan-only created the target directory")
+
+		testRunRestore(t, gopts, restoredir, snapshotIDs[0])
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
+			"directories are not equal")
+
+		// files for which the planned download fails are restored blob by
+		// blob, and the errors are reported
+		OK(t, filepath.Walk(filepath.Join(env.repo, "data"), func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() {
+				return os.Truncate(p, fi.Size()/2)
+			}
+			return err
+		}))
+
+		err = runRestore(RestoreOptions{Target: filepath.Join(env.base, "restore2")}, gopts, []string{snapshotIDs[0].String()})
+		_, ok := err.(errPartialRestore)
+		Assert(t, ok, "restore from damaged packs did not report errors for the files, got %v", err)
+	})
+}
+
+func TestRestoreDuplicateFiles(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		data := Random(42, 2*1024*1024)
+		for _, name := range []string{"a", "b", filepath.Join("sub", "c")} {
+			OK(t, os.MkdirAll(filepath.Dir(filepath.Join(env.testdata, name)), 0700))
+			OK(t, ioutil.WriteFile(filepath.Join(env.testdata, name), data, 0600))
+		}
+		OK(t, ioutil.WriteFile(filepath.Join(env.testdata, "d"), Random(43, 1024*1024), 0600))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		restoredir := filepath.Join(env.base, "restore")
+		buf := bytes.NewBuffer(nil)
+		jsonGopts := gopts
+		jsonGopts.JSON = true
+		jsonGopts.stdout = buf
+		OK(t, runRestore(RestoreOptions{Target: restoredir, PlanOnly: true}, jsonGopts, []string{"latest"}))
+
+		var plan restorePlanSummary
+		OK(t, json.Unmarshal(buf.Bytes(), &plan))
+		Equals(t, 4, plan.Files)
+		Equals(t, 2, plan.Clones)
+
+		testRunRestoreLatest(t, gopts, restoredir, nil, "")
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
+			"directories are not equal")
+	})
+}
+
+func TestRestoreSparse(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, os.MkdirAll(env.testdata, 0700))
+		sparse := filepath.Join(env.testdata, "sparse")
+		f, err := os.Create(sparse)
+		OK(t, err)
+		_, err = f.WriteAt(Random(23, 4096), 8*1024*1024)
+		OK(t, err)
+		OK(t, f.Close())
+
+		// zeros in a file without holes
+		data := make([]byte, 2*1024*1024)
+		copy(data, Random(42, 1024))
+		OK(t, ioutil.WriteFile(filepath.Join(env.testdata, "zeros"), data, 0600))
+
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		hasHoles := func(filename string) bool {
+			f, err := fs.Open(filename)
+			OK(t, err)
+			holes, err := fs.HasHoles(f)
+			OK(t, err)
+			OK(t, f.Close())
+			return holes
+		}
 
-	if len(dest) != 0 {
-		return false
-	}
+		if !hasHoles(sparse) {
+			t.Skip("file system does not support holes")
+		}
 
-	return true
+		for i, sparseAll := range []bool{false, true} {
+			restoredir := filepath.Join(env.base, fmt.Sprintf("restore%d", i))
+			OK(t, runRestore(RestoreOptions{Target: restoredir, Sparse: sparseAll}, gopts, []string{"latest"}))
+			Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
+				"directories are not equal")
+
+			Assert(t, hasHoles(filepath.Join(restoredir, "testdata", "sparse")),
+				"restored file has no holes")
+			Equals(t, sparseAll, hasHoles(filepath.Join(restoredir, "testdata", "zeros")))
+		}
+	})
 }
 
-func linkEqual(source, dest []string) bool {
-	// equal if sliced are equal without considering order
-	if source == nil && dest == nil {
-		return true
-	}
+func TestImportTar(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
 
-	if source == nil || dest == nil {
-		return false
-	}
+		files := map[string][]byte{
+			"dir/a":     Random(1, 5000),
+			"dir/sub/b": Random(2, 300000),
+		}
 
-	if len(source) != len(dest) {
-		return false
-	}
+		archive := filepath.Join(env.base, "archive.tar")
+		f, err := os.Create(archive)
+		OK(t, err)
+
+		tw := tar.NewWriter(f)
+		for _, name := range []string{"dir/a", "dir/sub/b"} {
+			OK(t, tw.WriteHeader(&tar.Header{
+				Name:     name,
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				Size:     int64(len(files[name])),
+				ModTime:  time.Now(),
+			}))
+			_, err = tw.Write(files[name])
+			OK(t, err)
+		}
+		OK(t, tw.Close())
+		OK(t, f.Close())
+
+		opts := ImportOptions{Path: "/srv", Hostname: "importhost"}
+		OK(t, runImport(opts, gopts, []string{"tar", archive}))
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Assert(t, len(snapshotIDs) == 1,
+			"expected one snapshot, got %v", snapshotIDs)
+
+		restoredir := filepath.Join(env.base, "restore")
+		testRunRestore(t, gopts, restoredir, snapshotIDs[0])
+
+		// the files are restored below the last component of --path
+		for name, data := range files {
+			buf, err := ioutil.ReadFile(filepath.Join(restoredir, "srv", filepath.FromSlash(name)))
+			OK(t, err)
+			Assert(t, bytes.Equal(data, buf), "restored file %v has wrong content", name)
+		}
+
+		testRunCheck(t, gopts)
+	})
+}
+
+func TestBackupRelativePaths(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, os.MkdirAll(filepath.Join(env.testdata, "project", "src"), 0700))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "project", "src", "main.go"), 1000))
+
+		cwd, err := os.Getwd()
+		OK(t, err)
+		OK(t, os.Chdir(env.testdata))
+		defer func() {
+			OK(t, os.Chdir(cwd))
+		}()
+
+		opts := BackupOptions{RelativePaths: true}
+
+		// with a trailing slash, the contents of the directory are saved
+		testRunBackup(t, []string{"./project/"}, opts, gopts)
+		newest, _ := testRunSnapshots(t, gopts)
+		Equals(t, []string{"project" + string(filepath.Separator)}, newest.Paths)
+
+		restoredir := filepath.Join(env.base, "restore")
+		testRunRestore(t, gopts, restoredir, *newest.ID)
+		OK(t, testFileSize(filepath.Join(restoredir, "src", "main.go"), 1000))
+
+		// the first snapshot is used as the parent for the same argument
+		testRunBackup(t, []string{"project/"}, opts, gopts)
+		second, _ := testRunSnapshots(t, gopts)
+		Assert(t, second.Parent != nil && second.Parent.Equal(*newest.ID),
+			"wrong parent snapshot %v, want %v", second.Parent, newest.ID)
+
+		// without the trailing slash, the directory itself is saved
+		testRunBackup(t, []string{"project"}, opts, gopts)
+		third, _ := testRunSnapshots(t, gopts)
+		Equals(t, []string{"project"}, third.Paths)
+		Assert(t, third.Parent == nil, "unexpected parent snapshot %v", third.Parent)
+
+		restoredir = filepath.Join(env.base, "restore2")
+		testRunRestore(t, gopts, restoredir, *third.ID)
+		OK(t, testFileSize(filepath.Join(restoredir, "project", "src", "main.go"), 1000))
+	})
+}
+
+func TestPruneBlobRefs(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		for i := 0; i < 3; i++ {
+			OK(t, appendRandomData(filepath.Join(env.testdata, fmt.Sprintf("file%d", i)), 100*1024))
+			testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		}
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Equals(t, 3, len(snapshotIDs))
+
+		cacheGopts := gopts
+		cacheGopts.CacheDir = filepath.Join(env.base, "cache")
+		cacheGopts.CacheSize = "10M"
+		testRunPrune(t, cacheGopts)
+
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		filename := filepath.Join(cacheGopts.CacheDir, repo.Config().ID, "blob-refs")
+
+		buf, err := ioutil.ReadFile(filename)
+		OK(t, err)
+		refs := restic.NewBlobRefs()
+		OK(t, refs.UnmarshalBinary(buf))
+		Equals(t, 3, len(refs.Snapshots()))
+
+		// the cached references are updated incrementally
+		testRunForget(t, gopts, snapshotIDs[0].String())
+		testRunPrune(t, cacheGopts)
+		testRunCheck(t, gopts)
+
+		// another client removes a snapshot and its data
+		testRunForget(t, gopts, snapshotIDs[1].String())
+		testRunPrune(t, gopts)
+
+		// the trees of the snapshot cannot be loaded any more
+		testRunPrune(t, cacheGopts)
+		testRunCheck(t, gopts)
+
+		buf, err = ioutil.ReadFile(filename)
+		OK(t, err)
+		refs = restic.NewBlobRefs()
+		OK(t, refs.UnmarshalBinary(buf))
+		Equals(t, 1, len(refs.Snapshots()))
+		Assert(t, refs.Snapshots().Has(snapshotIDs[2]), "remaining snapshot not in cached blob references")
+	})
+}
+
+func TestSnapshotsLast(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "a"}, gopts)
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "a"}, gopts)
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "b"}, gopts)
+
+		newest, _ := testRunSnapshots(t, gopts)
+
+		cacheGopts := gopts
+		cacheGopts.CacheDir = filepath.Join(env.base, "cache")
+		cacheGopts.CacheSize = "10M"
+
+		buf := bytes.NewBuffer(nil)
+		jsonGopts := cacheGopts
+		jsonGopts.stdout = buf
+		jsonGopts.JSON = true
+		OK(t, runSnapshots(SnapshotOptions{Last: true}, jsonGopts, nil))
+
+		var snapshots []Snapshot
+		OK(t, json.Unmarshal(buf.Bytes(), &snapshots))
+		Equals(t, 2, len(snapshots))
 
-	for i := range source {
 		found := false
-		for j := range dest {
-			if source[i] == dest[j] {
+		for _, sn := range snapshots {
+			if sn.ID.Equal(*newest.ID) {
 				found = true
-				break
 			}
 		}
-		if !found {
-			return false
+		Assert(t, found, "newest snapshot %v not listed with --last", newest.ID.Str())
+
+		// rebuild-index creates the snapshot manifest in the cache
+		testRunRebuildIndex(t, cacheGopts)
+
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		m := cache.NewSnapshotManifest(filepath.Join(cacheGopts.CacheDir, repo.Config().ID, "snapshots"))
+		Equals(t, 3, m.Len())
+	})
+}
+
+func TestBackupMetricsFile(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 1000))
+
+		gopts.Quiet = true
+		gopts.MetricsFile = filepath.Join(env.base, "restic.prom")
+		OK(t, runWithMetrics("backup", gopts, func(gopts GlobalOptions) error {
+			return runBackup(BackupOptions{}, gopts, []string{env.testdata})
+		}))
+
+		buf, err := ioutil.ReadFile(gopts.MetricsFile)
+		OK(t, err)
+
+		for _, metric := range []string{
+			`restic_backup_files{command="backup"} 1`,
+			`restic_backup_bytes{command="backup"} 1000`,
+			`restic_last_run_success{command="backup"} 1`,
+		} {
+			Assert(t, bytes.Contains(buf, []byte(metric)), "metric %q not found in:\n%s", metric, buf)
 		}
-	}
+	})
+}
 
-	return true
+func TestBackupStats(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 100*1024))
+
+		buf := bytes.NewBuffer(nil)
+		gopts.Quiet = true
+		gopts.Stats = true
+		gopts.stderr = buf
+		gopts.JSON = true
+		OK(t, runWithMetrics("backup", gopts, func(gopts GlobalOptions) error {
+			return runBackup(BackupOptions{}, gopts, []string{env.testdata})
+		}))
+
+		var sum statsSummary
+		OK(t, json.Unmarshal(buf.Bytes(), &sum))
+		Equals(t, "backup", sum.Command)
+		Assert(t, sum.DurationSeconds > 0, "duration is zero: %+v", sum)
+		Assert(t, sum.BackendRequests > 0, "no backend requests counted: %+v", sum)
+		Assert(t, sum.BytesUploaded >= 100*1024, "too few bytes uploaded: %+v", sum)
+		Assert(t, sum.BytesDownloaded > 0, "no bytes downloaded: %+v", sum)
+
+		// with the versioned JSON output, the stats are printed to stdout
+		buf.Reset()
+		gopts.stdout = buf
+		gopts.JSONSchema = 1
+		OK(t, runWithMetrics("check", gopts, func(gopts GlobalOptions) error {
+			return runCheck(CheckOptions{}, gopts, nil)
+		}))
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		var event struct {
+			Type string `json:"type"`
+			statsSummary
+		}
+		OK(t, json.Unmarshal([]byte(lines[len(lines)-1]), &event))
+		Equals(t, "stats", event.Type)
+		Equals(t, "check", event.Command)
+		Assert(t, event.BytesDownloaded > 0, "no bytes downloaded: %+v", event)
+	})
+}
+
+func TestForgetGrace(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 1000))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		Equals(t, 2, len(snapshotIDs))
+		trashedID := snapshotIDs[0]
+
+		OK(t, runForget(ForgetOptions{Grace: "7d"}, gopts, []string{trashedID.String()}))
+		Equals(t, 1, len(testRunList(t, "snapshots", gopts)))
+
+		// the data of the trashed snapshot is kept by prune
+		testRunPrune(t, gopts)
+		testRunCheck(t, gopts)
+
+		OK(t, runRestoreSnapshotFile(gopts, []string{trashedID.Str()}))
+		snapshotIDs = testRunList(t, "snapshots", gopts)
+		Equals(t, 2, len(snapshotIDs))
+		Assert(t, restic.NewIDSet(snapshotIDs...).Has(trashedID),
+			"snapshot %v has not been restored with the same ID", trashedID.Str())
+		Equals(t, 0, len(testRunList(t, "trash", gopts)))
+		testRunCheck(t, gopts)
+
+		// expired snapshots are removed from the trash by prune
+		OK(t, runForget(ForgetOptions{Grace: "1ns"}, gopts, []string{trashedID.String()}))
+		Equals(t, 1, len(testRunList(t, "trash", gopts)))
+		testRunPrune(t, gopts)
+		Equals(t, 0, len(testRunList(t, "trash", gopts)))
+		Assert(t, runRestoreSnapshotFile(gopts, []string{trashedID.Str()}) != nil,
+			"expired snapshot has been restored after prune")
+		testRunCheck(t, gopts)
+	})
+}
+
+func TestProtect(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		for _, name := range []string{"file1", "file2", "file3"} {
+			OK(t, appendRandomData(filepath.Join(env.testdata, name), 1000))
+			testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		}
+
+		Assert(t, runProtect(ProtectOptions{}, gopts, nil, true) != nil,
+			"protect without snapshots or filters did not return an error")
+
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		snapshots, err := restic.LoadAllSnapshots(gopts.ctx, repo)
+		OK(t, err)
+		sort.Sort(restic.Snapshots(snapshots))
+		oldest := snapshots[len(snapshots)-1]
+
+		OK(t, runProtect(ProtectOptions{}, gopts, []string{oldest.ID().String()}, true))
+		snapshots, err = restic.LoadAllSnapshots(gopts.ctx, repo)
+		OK(t, err)
+		var protected *restic.Snapshot
+		for _, sn := range snapshots {
+			if sn.Protected {
+				protected = sn
+			}
+		}
+		Assert(t, protected != nil && protected.Original.Equal(*oldest.ID()),
+			"snapshot %v has not been protected", oldest.ID().Str())
+		protectedID := protected.ID().String()
+
+		// neither an explicit forget nor a policy removes the snapshot
+		Assert(t, runForget(ForgetOptions{}, gopts, []string{protectedID}) != nil,
+			"forget of a protected snapshot did not return an error")
+		OK(t, runForget(ForgetOptions{Last: 1}, gopts, nil))
+		snapshotIDs := restic.NewIDSet(testRunList(t, "snapshots", gopts)...)
+		Equals(t, 2, len(snapshotIDs))
+		Assert(t, snapshotIDs.Has(*protected.ID()), "protected snapshot has been removed")
+
+		// the data referenced by the protected snapshot is kept
+		testRunPrune(t, gopts)
+		testRunCheck(t, gopts)
+		testRunRestore(t, gopts, filepath.Join(env.base, "restore"), *protected.ID())
+
+		OK(t, runProtect(ProtectOptions{}, gopts, []string{protectedID}, false))
+		OK(t, runForget(ForgetOptions{Last: 1}, gopts, nil))
+		Equals(t, 1, len(testRunList(t, "snapshots", gopts)))
+	})
+}
+
+func TestCheckpointSnapshots(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		for _, name := range []string{"file1", "file2"} {
+			OK(t, appendRandomData(filepath.Join(env.testdata, name), 1000))
+			testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		}
+
+		repo, err := OpenRepository(gopts)
+		OK(t, err)
+		snapshots, err := restic.LoadAllSnapshots(gopts.ctx, repo)
+		OK(t, err)
+		cp := *snapshots[0]
+		cp.Checkpoint = true
+		cpID, err := repo.SaveJSONUnpacked(gopts.ctx, restic.SnapshotFile, cp)
+		OK(t, err)
+
+		// checkpoints are only listed on request
+		_, snapmap := testRunSnapshots(t, gopts)
+		Equals(t, 2, len(snapmap))
+		_, ok := snapmap[cpID]
+		Assert(t, !ok, "checkpoint is listed by default")
+
+		buf := bytes.NewBuffer(nil)
+		jsonGopts := gopts
+		jsonGopts.stdout = buf
+		jsonGopts.JSON = true
+		OK(t, runSnapshots(SnapshotOptions{Checkpoints: true}, jsonGopts, nil))
+		var list []Snapshot
+		OK(t, json.Unmarshal(buf.Bytes(), &list))
+		Equals(t, 3, len(list))
+
+		// the policy neither keeps nor removes the checkpoint
+		OK(t, runForget(ForgetOptions{Last: 1}, gopts, nil))
+		snapshotIDs := restic.NewIDSet(testRunList(t, "snapshots", gopts)...)
+		Equals(t, 2, len(snapshotIDs))
+		Assert(t, snapshotIDs.Has(cpID), "checkpoint has been removed by the policy")
+
+		// "checkpoint" cannot be used as a tag
+		Assert(t, runBackup(BackupOptions{Tags: []string{restic.CheckpointTag}}, gopts, []string{env.testdata}) != nil,
+			"backup with the tag checkpoint did not return an error")
+		Assert(t, runTag(TagOptions{AddTags: []string{restic.CheckpointTag}}, gopts, nil) != nil,
+			"adding the tag checkpoint did not return an error")
+		Equals(t, 2, len(testRunList(t, "snapshots", gopts)))
+	})
+}
+
+func TestForgetSimulate(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 10*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		buf := bytes.NewBuffer(nil)
+		gopts.JSON = true
+		gopts.stdout = buf
+		opts := ForgetOptions{Last: 5, Simulate: "30d"}
+		OK(t, runForget(opts, gopts, nil))
+
+		var steps []simulationStep
+		OK(t, json.Unmarshal(buf.Bytes(), &steps))
+		Equals(t, 30, len(steps))
+		Equals(t, 5, steps[29].Snapshots)
+		Assert(t, steps[29].EstimatedBytes >= 100*1024,
+			"estimated size %d is too small", steps[29].EstimatedBytes)
+
+		// nothing has been removed
+		Equals(t, 2, len(testRunList(t, "snapshots", gopts)))
+
+		opts = ForgetOptions{Simulate: "30d"}
+		Assert(t, runForget(opts, gopts, nil) != nil,
+			"simulation without a policy did not return an error")
+	})
+}
+
+func TestShardRepository(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		shards := []string{filepath.Join(env.base, "shard1"), filepath.Join(env.base, "shard2")}
+		gopts.Repo = "shard:" + strings.Join(shards, "|")
+
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 10*1024*1024))
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file2"), 10*1024*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		testRunCheck(t, gopts)
+
+		packs := testRunList(t, "packs", gopts)
+		Assert(t, len(packs) > 1, "expected several packs, got %d", len(packs))
+
+		total := 0
+		for _, dir := range shards {
+			// the config and the snapshot are stored in all shards
+			_, err := os.Stat(filepath.Join(dir, "config"))
+			OK(t, err)
+
+			snapshots, err := ioutil.ReadDir(filepath.Join(dir, "snapshots"))
+			OK(t, err)
+			Equals(t, 1, len(snapshots))
+
+			err = filepath.Walk(filepath.Join(dir, "data"), func(p string, fi os.FileInfo, err error) error {
+				if err == nil && fi.Mode().IsRegular() {
+					total++
+				}
+				return err
+			})
+			OK(t, err)
+		}
+		Equals(t, len(packs), total)
+
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+		restoredir := filepath.Join(env.base, "restore")
+		testRunRestore(t, gopts, restoredir, snapshotIDs[0])
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
+			"directories are not equal")
+	})
+}
+
+func TestMirrorRepository(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file1"), 1024*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+		snapshotIDs := testRunList(t, "snapshots", gopts)
+
+		// the primary backend is not available, the repository is read from
+		// the mirror. A missing file is not an outage, so the primary is a
+		// file instead of a directory, which makes all accesses fail.
+		unavailable := filepath.Join(env.base, "unavailable")
+		OK(t, ioutil.WriteFile(unavailable, nil, 0600))
+		mirrorGopts := gopts
+		mirrorGopts.Repo = "mirror:" + unavailable + "|" + env.repo
+		mirrorGopts.NoLock = true
+
+		Equals(t, snapshotIDs, testRunList(t, "snapshots", mirrorGopts))
+
+		restoredir := filepath.Join(env.base, "restore")
+		testRunRestore(t, mirrorGopts, restoredir, snapshotIDs[0])
+		Assert(t, directoriesEqualContents(env.testdata, filepath.Join(restoredir, "testdata")),
+			"directories are not equal")
+
+		// nothing is written to the mirror
+		mirrorGopts.NoLock = false
+		err := runBackup(BackupOptions{}, mirrorGopts, []string{env.testdata})
+		Assert(t, err != nil, "backup to unavailable primary backend did not fail")
+		Equals(t, snapshotIDs, testRunList(t, "snapshots", gopts))
+
+		err = runInit(InitOptions{}, mirrorGopts, nil)
+		Assert(t, err != nil, "init of a mirror backend did not fail")
+	})
+}
+
+func TestStatus(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "foo"}, gopts)
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "bar"}, gopts)
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "foo"}, gopts)
+
+		buf := bytes.NewBuffer(nil)
+		gopts.stdout = buf
+		gopts.JSON = true
+		OK(t, runStatus(StatusOptions{}, gopts, nil))
+
+		var status repoStatus
+		OK(t, json.Unmarshal(buf.Bytes(), &status))
+		Equals(t, 3, status.Snapshots)
+		Equals(t, 0, status.Locks)
+		Assert(t, status.TotalBytes >= 100*1024, "too little data reported: %+v", status)
+		Equals(t, 2, len(status.Hosts))
+		Equals(t, "bar", status.Hosts[0].Hostname)
+		Equals(t, 1, status.Hosts[0].Snapshots)
+		Equals(t, "foo", status.Hosts[1].Hostname)
+		Equals(t, 2, status.Hosts[1].Snapshots)
+		Equals(t, 0, len(status.Errors))
+
+		Assert(t, status.LastCheck == nil && status.LastPrune == nil, "unexpected operations: %+v", status)
+
+		buf.Reset()
+		gopts.JSON = false
+		OK(t, runStatus(StatusOptions{}, gopts, nil))
+		Assert(t, strings.Contains(buf.String(), "snapshots:           3"),
+			"unexpected output: %s", buf.String())
+		Assert(t, strings.Contains(buf.String(), "last check:          never"),
+			"unexpected output: %s", buf.String())
+
+		gopts.stdout = ioutil.Discard
+		testRunCheck(t, gopts)
+		testRunCheck(t, gopts)
+		testRunPrune(t, gopts)
+		Equals(t, 2, len(testRunList(t, "operations", gopts)))
+
+		// the profiles select the repository and the password
+		dir := filepath.Join(env.base, "profiles")
+		OK(t, os.Mkdir(dir, 0700))
+		pwfile := filepath.Join(env.base, "password")
+		OK(t, ioutil.WriteFile(pwfile, []byte(TestPassword), 0600))
+		envfile := filepath.Join(env.base, "env")
+		OK(t, ioutil.WriteFile(envfile, []byte("# comment\nRESTIC_TEST_STATUS=\"foo\"\n"), 0600))
+
+		profile := fmt.Sprintf(`{"repository": %q, "password_file": %q, "environment_file": %q, "paths": ["/home"]}`,
+			env.repo, pwfile, envfile)
+		OK(t, ioutil.WriteFile(filepath.Join(dir, "home.json"), []byte(profile), 0600))
+		profile = fmt.Sprintf(`{"repository": %q, "password_file": %q, "paths": ["/srv"]}`,
+			filepath.Join(env.base, "missing"), pwfile)
+		OK(t, ioutil.WriteFile(filepath.Join(dir, "srv.json"), []byte(profile), 0600))
+
+		buf.Reset()
+		gopts.stdout = buf
+		gopts.JSON = true
+		gopts.password = ""
+		err := runStatus(StatusOptions{Profiles: "all", ProfileDir: dir}, gopts, nil)
+		Assert(t, err != nil, "status for a missing repository did not fail")
+
+		var list []repoStatus
+		OK(t, json.Unmarshal(buf.Bytes(), &list))
+		Equals(t, 2, len(list))
+		Equals(t, "home", list[0].Profile)
+		Equals(t, 3, list[0].Snapshots)
+		Equals(t, 0, len(list[0].Errors))
+		Assert(t, list[0].LastCheck != nil && list[0].LastCheck.Error == "", "last check not reported: %+v", list[0])
+		Assert(t, list[0].LastPrune != nil && list[0].LastPrune.Error == "", "last prune not reported: %+v", list[0])
+		Equals(t, "srv", list[1].Profile)
+		Equals(t, 1, len(list[1].Errors))
+		Equals(t, "", os.Getenv("RESTIC_TEST_STATUS"))
+
+		buf.Reset()
+		gopts.JSON = false
+		OK(t, runStatus(StatusOptions{Profiles: "home", ProfileDir: dir}, gopts, nil))
+		Assert(t, strings.Contains(buf.String(), "home "),
+			"unexpected output: %s", buf.String())
+	})
+}
+
+func TestBrowse(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, os.MkdirAll(filepath.Join(env.testdata, "sub", "dir"), 0700))
+		OK(t, ioutil.WriteFile(filepath.Join(env.testdata, "a"), Random(1, 5000), 0600))
+		OK(t, ioutil.WriteFile(filepath.Join(env.testdata, "sub", "b"), Random(2, 300000), 0600))
+		OK(t, ioutil.WriteFile(filepath.Join(env.testdata, "sub", "dir", "c"), Random(3, 1000), 0600))
+		OK(t, ioutil.WriteFile(filepath.Join(env.testdata, "sub", "my file"), Random(4, 1000), 0600))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{}, gopts)
+
+		restoredir := filepath.Join(env.base, "restore")
+		archive := filepath.Join(env.base, "archive.tar")
+		script := strings.Join([]string{
+			"cd latest/testdata",
+			"mark sub",
+			"ls",
+			"cd sub",
+			"ls",
+			"unmark /latest/testdata/sub",
+			"mark dir ../a 'my file'",
+			"marked",
+			"restore " + restoredir,
+			"dump " + archive,
+			"quit",
+			"ls",
+		}, "\n")
+
+		buf := bytes.NewBuffer(nil)
+		gopts.stdout = buf
+		OK(t, runBrowse(gopts, strings.NewReader(script)))
+
+		out := buf.String()
+		Assert(t, strings.Contains(out, "* drwx"), "marked directory not flagged in output:\n%s", out)
+		Assert(t, strings.Contains(out, " sub\n"), "directory not listed in output:\n%s", out)
+
+		for _, name := range []string{"a", filepath.Join("sub", "dir", "c"), filepath.Join("sub", "my file")} {
+			want, err := ioutil.ReadFile(filepath.Join(env.testdata, name))
+			OK(t, err)
+			got, err := ioutil.ReadFile(filepath.Join(restoredir, "testdata", name))
+			OK(t, err)
+			Assert(t, bytes.Equal(want, got), "wrong content for restored file %v", name)
+		}
+
+		_, err := os.Stat(filepath.Join(restoredir, "testdata", "sub", "b"))
+		Assert(t, os.IsNotExist(err), "unmarked file sub/b was restored")
+
+		f, err := os.Open(archive)
+		OK(t, err)
+		defer f.Close()
+
+		var files []string
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			OK(t, err)
+			if hdr.Typeflag == tar.TypeReg {
+				files = append(files, path.Base(hdr.Name))
+			}
+		}
+		Equals(t, []string{"a", "c", "my file"}, files)
+
+		err = runBrowse(gopts, strings.NewReader("cd latest/testdata/a"))
+		Assert(t, err != nil, "cd into a file did not return an error")
+	})
+}
+
+func TestStatsHosts(t *testing.T) {
+	withTestEnvironment(t, func(env *testEnvironment, gopts GlobalOptions) {
+		testRunInit(t, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "file"), 100*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "foo"}, gopts)
+
+		OK(t, appendRandomData(filepath.Join(env.testdata, "extra"), 200*1024))
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "bar"}, gopts)
+		testRunBackup(t, []string{env.testdata}, BackupOptions{Hostname: "bar"}, gopts)
+
+		buf := bytes.NewBuffer(nil)
+		gopts.stdout = buf
+		gopts.JSON = true
+		OK(t, runRepoStats(StatsOptions{Mode: "hosts"}, gopts, nil))
+
+		var stats hostStats
+		OK(t, json.Unmarshal(buf.Bytes(), &stats))
+		Equals(t, 2, len(stats.Hosts))
+
+		bar, foo := stats.Hosts[0], stats.Hosts[1]
+		Equals(t, "bar", bar.Hostname)
+		Equals(t, 2, bar.Snapshots)
+		Equals(t, "foo", foo.Hostname)
+		Equals(t, 1, foo.Snapshots)
+
+		Assert(t, bar.LogicalBytes >= 2*300*1024, "too little logical data for bar: %+v", bar)
+		Assert(t, foo.LogicalBytes >= 100*1024 && foo.LogicalBytes < 300*1024, "wrong logical data for foo: %+v", foo)
+
+		// the file saved by both hosts is shared, the extra file is only
+		// referenced by bar
+		Assert(t, foo.SharedBytes >= 100*1024, "too little shared data for foo: %+v", foo)
+		Equals(t, foo.SharedBytes, bar.SharedBytes)
+		Assert(t, bar.UniqueBytes >= 200*1024, "too little unique data for bar: %+v", bar)
+		Equals(t, stats.TotalBytes, foo.UniqueBytes+bar.UniqueBytes+bar.SharedBytes)
+
+		buf.Reset()
+		gopts.JSON = false
+		OK(t, runRepoStats(StatsOptions{Mode: "hosts"}, gopts, nil))
+		Assert(t, strings.Contains(buf.String(), "referenced data:"), "unexpected output: %s", buf.String())
+
+		err := runRepoStats(StatsOptions{Mode: "foo"}, gopts, nil)
+		Assert(t, err != nil, "no error for an unknown mode")
+	})
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+
+	"restic"
+	"restic/debug"
+	"restic/errors"
+	"restic/repository"
+)
+
+// completeIntents completes or rolls back the operations which have been
+// interrupted while removing files from the repository, see
+// repository.CompleteIntent. Until then, the index may reference packs which
+// are gone, so this must be done before the repository is used. An exclusive
+// lock is held while the intents are processed.
+func completeIntents(ctx context.Context, repo *repository.Repository) error {
+	found := false
+	for range repo.List(ctx, restic.IntentFile) {
+		found = true
+	}
+
+	if !found {
+		return nil
+	}
+
+	lock, err := restic.NewExclusiveLock(ctx, repo)
+	if err != nil {
+		return errors.Fatalf("unable to complete interrupted operations: %v", err)
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			debug.Log("error while unlocking: %v", err)
+		}
+	}()
+
+	// list the intents again, another process may have completed them
+	intents, err := restic.LoadAllIntents(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	for _, intent := range intents {
+		completed, err := repository.CompleteIntent(ctx, repo, intent)
+		if err != nil {
+			return errors.Fatalf("unable to complete interrupted %v from %v: %v",
+				intent.Operation, intent.Time.Format(TimeFormat), err)
+		}
+
+		if completed {
+			Warnf("completed interrupted %v from %v\n",
+				intent.Operation, intent.Time.Format(TimeFormat))
+		} else {
+			Warnf("rolled back interrupted %v from %v, nothing had been removed yet\n",
+				intent.Operation, intent.Time.Format(TimeFormat))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"restic/errors"
+)
+
+// currentJSONSchema is the newest version of the versioned JSON output.
+const currentJSONSchema = 1
+
+// jsonFlag implements the --json option. Without a value (or with "true"),
+// the unversioned JSON output is selected. A schema version like "v1" selects
+// the versioned output, which frames each object in an envelope containing
+// the schema version and the type of the object.
+type jsonFlag struct {
+	opts *GlobalOptions
+}
+
+func (f jsonFlag) String() string {
+	switch {
+	case f.opts.JSONSchema > 0:
+		return fmt.Sprintf("v%d", f.opts.JSONSchema)
+	case f.opts.JSON:
+		return "true"
+	default:
+		return "false"
+	}
+}
+
+func (f jsonFlag) Set(s string) error {
+	switch s {
+	case "true":
+		f.opts.JSON, f.opts.JSONSchema = true, 0
+		return nil
+	case "false":
+		f.opts.JSON, f.opts.JSONSchema = false, 0
+		return nil
+	}
+
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "v"), 10, 32)
+	if err != nil || !strings.HasPrefix(s, "v") || v == 0 || v > currentJSONSchema {
+		return errors.Errorf("unsupported JSON schema %q, the newest schema is v%d", s, currentJSONSchema)
+	}
+
+	f.opts.JSON, f.opts.JSONSchema = true, uint(v)
+	return nil
+}
+
+func (f jsonFlag) Type() string {
+	return "schema"
+}
+
+// jsonError describes the error which terminated restic.
+type jsonError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// printJSONError prints err together with its error code as an event of type
+// "error".
+func printJSONError(gopts GlobalOptions, err error) error {
+	return printJSONEvent(gopts, "error", jsonError{Code: errors.Code(err), Message: err.Error()})
+}
+
+// printJSONEvent writes v as a single line to stdout. When the versioned
+// output is selected, the fields of v (which must be encoded as a JSON
+// object) are framed in an envelope with the schema version and typ.
+func printJSONEvent(gopts GlobalOptions, typ string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "Marshal")
+	}
+
+	if gopts.JSONSchema > 0 {
+		if len(buf) < 2 || buf[0] != '{' {
+			return errors.Errorf("JSON event %v is not an object", typ)
+		}
+
+		envelope := fmt.Sprintf(`{"schema":%d,"type":%q`, gopts.JSONSchema, typ)
+		if !bytes.Equal(buf, []byte("{}")) {
+			envelope += ","
+		}
+		buf = append([]byte(envelope), buf[1:]...)
+	}
+
+	_, err = gopts.stdout.Write(append(buf, '\n'))
+	return err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"restic/errors"
+)
+
+func TestJSONFlag(t *testing.T) {
+	var tests = []struct {
+		input  string
+		json   bool
+		schema uint
+		err    bool
+	}{
+		{"true", true, 0, false},
+		{"false", false, 0, false},
+		{"v1", true, 1, false},
+		{"1", false, 0, true},
+		{"v0", false, 0, true},
+		{"v2", false, 0, true},
+		{"yes", false, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			var opts GlobalOptions
+			err := jsonFlag{&opts}.Set(test.input)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error for %q", test.input)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if opts.JSON != test.json || opts.JSONSchema != test.schema {
+				t.Errorf("wrong options for %q: JSON %v, schema %v", test.input, opts.JSON, opts.JSONSchema)
+			}
+		})
+	}
+}
+
+func TestPrintJSONEvent(t *testing.T) {
+	type event struct {
+		Hits int `json:"hits"`
+	}
+
+	var tests = []struct {
+		schema uint
+		v      interface{}
+		output string
+	}{
+		{0, event{23}, `{"hits":23}` + "\n"},
+		{1, event{23}, `{"schema":1,"type":"test","hits":23}` + "\n"},
+		{1, struct{}{}, `{"schema":1,"type":"test"}` + "\n"},
+	}
+
+	for _, test := range tests {
+		buf := bytes.NewBuffer(nil)
+		gopts := GlobalOptions{JSON: true, JSONSchema: test.schema, stdout: buf}
+
+		if err := printJSONEvent(gopts, "test", test.v); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.String() != test.output {
+			t.Errorf("wrong output, want %q, got %q", test.output, buf.String())
+		}
+	}
+
+	gopts := GlobalOptions{JSON: true, JSONSchema: 1, stdout: bytes.NewBuffer(nil)}
+	if err := printJSONEvent(gopts, "test", []int{1, 2}); err == nil {
+		t.Errorf("no error returned for an event which is not an object")
+	}
+}
+
+func TestPrintJSONError(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	gopts := GlobalOptions{JSON: true, JSONSchema: 1, stdout: buf}
+
+	err := errors.Wrap(errors.WithCode(errors.New("no key found"), errors.CodeWrongPassword), "open")
+	if err := printJSONError(gopts, err); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"schema":1,"type":"error","code":"ERR_WRONG_PASSWORD","message":"open: no key found"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("wrong output, want %q, got %q", want, buf.String())
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"restic/errors"
+	"restic/repository"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// keyOperations are the operations which can be allowed for a key with
+// "key add --allow".
+var keyOperations = []string{"backup", "read", "modify", "key"}
+
+// commandOperations maps the commands which open a repository to the
+// operation the key must allow. Commands which are missing here can only be
+// used with keys which allow all operations, the empty string allows a
+// command for all keys.
+var commandOperations = map[string]string{
+	"backup": "backup",
+	"import": "backup",
+
+	"browse":       "read",
+	"cat":          "read",
+	"check":        "read",
+	"debug":        "read",
+	"dump":         "read",
+	"find":         "read",
+	"list":         "read",
+	"lookup-blobs": "read",
+	"ls":           "read",
+	"mount":        "read",
+	"restore":      "read",
+	"snapshots":    "read",
+	"status":       "read",
+
+	"config":                "modify",
+	"forget":                "modify",
+	"maintain":              "modify",
+	"migrate":               "modify",
+	"protect":               "modify",
+	"prune":                 "modify",
+	"rebuild-index":         "modify",
+	"restore-snapshot-file": "modify",
+	"rewrite":               "modify",
+	"tag":                   "modify",
+
+	"key": "key",
+
+	"unlock": "",
+}
+
+// masterKeyCommands need the master key, because they read or rewrite the
+// data of all encryption domains or replace the config. They can't be used
+// with the keys of encryption domains.
+var masterKeyCommands = map[string]bool{
+	"check":         true,
+	"config":        true,
+	"maintain":      true,
+	"migrate":       true,
+	"prune":         true,
+	"rebuild-index": true,
+}
+
+// commandOperation returns the operation which the command performs.
+func commandOperation(cmd *cobra.Command) string {
+	op, ok := commandOperations[cmd.Name()]
+	if !ok {
+		return "all"
+	}
+	return op
+}
+
+// parseKeyOperations checks the operations given with "key add --allow".
+// Operations may also be separated by commas.
+func parseKeyOperations(list []string) ([]string, error) {
+	seen := make(map[string]struct{})
+	for _, s := range list {
+		for _, op := range strings.Split(s, ",") {
+			op = strings.TrimSpace(op)
+			if !validKeyOperation(op) {
+				return nil, errors.Fatalf("invalid operation %q, valid are: %s", op, strings.Join(keyOperations, ", "))
+			}
+			seen[op] = struct{}{}
+		}
+	}
+
+	ops := make([]string, 0, len(seen))
+	for op := range seen {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	return ops, nil
+}
+
+func validKeyOperation(op string) bool {
+	for _, o := range keyOperations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKeyOperation returns an error if the current key of repo does not
+// allow op. An empty op is allowed for all keys, "all" only for keys without
+// constraints.
+func checkKeyOperation(repo *repository.Repository, op string) error {
+	meta := repo.KeyMetadata()
+	if op == "" || len(meta.Operations) == 0 {
+		return nil
+	}
+
+	if op != "all" && meta.Allows(op) {
+		return nil
+	}
+
+	return errors.Fatalf("the key %v only allows the operations %s", repo.KeyName()[:8], strings.Join(meta.Operations, ", "))
+}
+
+// checkMasterKey returns an error if the command needs the master key, but
+// the current key of repo belongs to an encryption domain.
+func checkMasterKey(repo *repository.Repository, command string) error {
+	if !masterKeyCommands[command] || repo.Key() != nil {
+		return nil
+	}
+
+	return errors.Fatalf("the %q command requires the master key, the key %v belongs to the encryption domain %q", command, repo.KeyName()[:8], repo.Domain())
+}
@@ -28,6 +28,12 @@ func lockRepoExclusive(repo *repository.Repository) (*restic.Lock, error) {
 }
 
 func lockRepository(repo *repository.Repository, exclusive bool) (*restic.Lock, error) {
+	// operations which have been interrupted while removing files must be
+	// completed before the repository is used
+	if err := completeIntents(context.TODO(), repo); err != nil {
+		return nil, err
+	}
+
 	lockFn := restic.NewLock
 	if exclusive {
 		lockFn = restic.NewExclusiveLock
@@ -26,7 +26,10 @@ directories in an encrypted repository stored on different backends.
 	SilenceErrors: true,
 	SilenceUsage:  true,
 
-	PersistentPreRunE: func(*cobra.Command, []string) error {
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		globalOptions.operation = commandOperation(cmd)
+		globalOptions.command = cmd.Name()
+
 		// parse extended options
 		opts, err := options.Parse(globalOptions.Options)
 		if err != nil {
@@ -34,6 +37,19 @@ directories in an encrypted repository stored on different backends.
 		}
 		globalOptions.extended = opts
 
+		// expand environment variables and "~" in the repository location and paths
+		if err := expandGlobalOptions(&globalOptions); err != nil {
+			return err
+		}
+
+		if err := applyMaxMemory(globalOptions); err != nil {
+			return err
+		}
+
+		if err := applyProgressFPS(globalOptions); err != nil {
+			return err
+		}
+
 		// run the debug functions for all subcommands (if build tag "debug" is
 		// enabled)
 		if err := runDebug(); err != nil {
@@ -47,6 +63,12 @@ directories in an encrypted repository stored on different backends.
 	},
 }
 
+// exitCoder is implemented by errors which require restic to terminate with a
+// specific exit code.
+type exitCoder interface {
+	ExitCode() int
+}
+
 var logBuffer = bytes.NewBuffer(nil)
 
 func init() {
@@ -59,7 +81,17 @@ func main() {
 	debug.Log("main %#v", os.Args)
 	err := cmdRoot.Execute()
 
+	exitErr, hasExitCode := errors.Cause(err).(exitCoder)
+
+	if err != nil && globalOptions.JSONSchema > 0 {
+		if e := printJSONError(globalOptions, err); e != nil {
+			fmt.Fprintf(os.Stderr, "unable to print error as JSON: %v\n", e)
+		}
+	}
+
 	switch {
+	case hasExitCode:
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 	case restic.IsAlreadyLocked(errors.Cause(err)):
 		fmt.Fprintf(os.Stderr, "%v\nthe `unlock` command can be used to remove stale locks\n", err)
 	case errors.IsFatal(errors.Cause(err)):
@@ -77,7 +109,10 @@ func main() {
 	}
 
 	var exitCode int
-	if err != nil {
+	switch {
+	case hasExitCode:
+		exitCode = exitErr.ExitCode()
+	case err != nil:
 		exitCode = 1
 	}
 
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"restic/errors"
+	"strings"
+	"time"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeWindow is a daily period of time, optionally restricted to some days of
+// the week. When end is before start, the window extends past midnight into
+// the next day.
+type timeWindow struct {
+	days       map[time.Weekday]bool
+	start, end time.Duration
+	text       string
+}
+
+func (w timeWindow) String() string {
+	return w.text
+}
+
+// parseWeekdays parses a comma-separated list of days like "mon,wed" or
+// "mon-fri".
+func parseWeekdays(s string) (map[time.Weekday]bool, error) {
+	days := make(map[time.Weekday]bool)
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		from, to := item, item
+		if i := strings.Index(item, "-"); i >= 0 {
+			from, to = item[:i], item[i+1:]
+		}
+
+		first, ok := weekdayNames[from]
+		if !ok {
+			return nil, errors.Errorf("invalid day %q", from)
+		}
+		last, ok := weekdayNames[to]
+		if !ok {
+			return nil, errors.Errorf("invalid day %q", to)
+		}
+
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseTimeOfDay parses a time like "01:30" and returns the offset from
+// midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m > 0) {
+		return 0, errors.Errorf("invalid time %q", s)
+	}
+
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// parseTimeWindow parses a window like "01:00-05:00" or "sat,sun 22:00-06:00".
+func parseTimeWindow(s string) (timeWindow, error) {
+	w := timeWindow{text: s}
+
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+	case 2:
+		days, err := parseWeekdays(fields[0])
+		if err != nil {
+			return timeWindow{}, err
+		}
+		w.days = days
+		fields = fields[1:]
+	default:
+		return timeWindow{}, errors.Errorf("invalid window %q", s)
+	}
+
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return timeWindow{}, errors.Errorf("invalid window %q, the format is [DAYS] HH:MM-HH:MM", s)
+	}
+
+	var err error
+	if w.start, err = parseTimeOfDay(times[0]); err != nil {
+		return timeWindow{}, err
+	}
+	if w.end, err = parseTimeOfDay(times[1]); err != nil {
+		return timeWindow{}, err
+	}
+
+	if w.start == w.end {
+		return timeWindow{}, errors.Errorf("window %q is empty", s)
+	}
+
+	return w, nil
+}
+
+// dayAllowed returns true if the window may start on day d.
+func (w timeWindow) dayAllowed(d time.Weekday) bool {
+	return w.days == nil || w.days[d]
+}
+
+// Contains returns true if t is within the window, in the location of t.
+func (w timeWindow) Contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	if w.start < w.end {
+		return w.dayAllowed(t.Weekday()) && offset >= w.start && offset < w.end
+	}
+
+	// the window extends past midnight
+	if offset >= w.start {
+		return w.dayAllowed(t.Weekday())
+	}
+	return offset < w.end && w.dayAllowed((t.Weekday()+6)%7)
+}
+
+// hostJitter returns a delay between zero and max which is derived from the
+// host name, so that each host waits for a different but stable time.
+func hostJitter(hostname string, max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(hostname))
+	return time.Duration(h.Sum64() % uint64(max))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindow(t *testing.T) {
+	// 2017-07-09 is a Sunday
+	at := func(day int, hour, min int) time.Time {
+		return time.Date(2017, 7, day, hour, min, 0, 0, time.UTC)
+	}
+
+	var tests = []struct {
+		window string
+		t      time.Time
+		in     bool
+	}{
+		{"01:00-05:00", at(9, 1, 0), true},
+		{"01:00-05:00", at(10, 4, 59), true},
+		{"01:00-05:00", at(10, 5, 0), false},
+		{"01:00-05:00", at(10, 0, 59), false},
+		{"sun 01:00-05:00", at(9, 3, 0), true},
+		{"sun 01:00-05:00", at(10, 3, 0), false},
+		{"Mon-Fri 01:00-05:00", at(10, 3, 0), true},
+		{"mon-fri 01:00-05:00", at(15, 3, 0), false},
+		{"fri-mon 01:00-05:00", at(9, 3, 0), true},
+		{"sat,sun 01:00-05:00", at(12, 3, 0), false},
+		{"22:00-06:00", at(9, 23, 0), true},
+		{"22:00-06:00", at(9, 5, 0), true},
+		{"22:00-06:00", at(9, 12, 0), false},
+		{"sat 22:00-06:00", at(9, 5, 0), true},
+		{"sat 22:00-06:00", at(9, 23, 0), false},
+		{"sat 22:00-06:00", at(8, 23, 0), true},
+		{"00:00-24:00", at(9, 23, 59), true},
+	}
+
+	for _, test := range tests {
+		w, err := parseTimeWindow(test.window)
+		if err != nil {
+			t.Fatalf("parsing %q failed: %v", test.window, err)
+		}
+
+		if w.Contains(test.t) != test.in {
+			t.Errorf("window %q: Contains(%v) returned %v", test.window, test.t, !test.in)
+		}
+	}
+}
+
+func TestParseTimeWindowInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"01:00",
+		"01:00-01:00",
+		"25:00-01:00",
+		"01:60-02:00",
+		"sunday 01:00-02:00",
+		"sun mon 01:00-02:00",
+		"sun,xyz 01:00-02:00",
+	} {
+		if _, err := parseTimeWindow(s); err == nil {
+			t.Errorf("no error returned for window %q", s)
+		}
+	}
+}
+
+func TestHostJitter(t *testing.T) {
+	max := 30 * time.Minute
+
+	d := hostJitter("kasimir", max)
+	if d < 0 || d >= max {
+		t.Fatalf("jitter %v is out of range", d)
+	}
+
+	if hostJitter("kasimir", max) != d {
+		t.Errorf("jitter is not stable for the same host")
+	}
+
+	if hostJitter("kasimir", 0) != 0 {
+		t.Errorf("jitter returned for zero maximum")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"restic/errors"
+	"restic/fs"
+)
+
+// runMetrics collects the metrics of a single run of a command, which are
+// exported in the Prometheus text format afterwards.
+type runMetrics struct {
+	command string
+
+	m       sync.Mutex
+	samples []metricSample
+}
+
+type metricSample struct {
+	name, help string
+	value      float64
+}
+
+func newRunMetrics(command string) *runMetrics {
+	return &runMetrics{command: command}
+}
+
+// Set records value for the metric name, which is prefixed with "restic_".
+// A value recorded earlier for the same name is replaced. Nothing is done
+// when m is nil, so commands can record metrics unconditionally.
+func (m *runMetrics) Set(name, help string, value float64) {
+	if m == nil {
+		return
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	name = "restic_" + name
+	for i := range m.samples {
+		if m.samples[i].name == name {
+			m.samples[i].value = value
+			return
+		}
+	}
+
+	m.samples = append(m.samples, metricSample{name: name, help: help, value: value})
+}
+
+// WriteTo writes the metrics in the Prometheus text format to w, all samples
+// are labelled with the command.
+func (m *runMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	buf := bytes.NewBuffer(nil)
+	for _, s := range m.samples {
+		fmt.Fprintf(buf, "# HELP %s %s\n", s.name, s.help)
+		fmt.Fprintf(buf, "# TYPE %s gauge\n", s.name)
+		fmt.Fprintf(buf, "%s{command=%q} %s\n", s.name, m.command, strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+
+	return buf.WriteTo(w)
+}
+
+// writeMetricsFile atomically replaces filename with the metrics, so that
+// the textfile collector of the node exporter never reads a partial file.
+func writeMetricsFile(filename string, m *runMetrics) error {
+	buf := bytes.NewBuffer(nil)
+	if _, err := m.WriteTo(buf); err != nil {
+		return err
+	}
+
+	return errors.Wrap(replaceFile(filename, buf.Bytes()), "write metrics file")
+}
+
+// replaceFile atomically replaces the file filename with one containing buf,
+// so that readers never see a partially written file.
+func replaceFile(filename string, buf []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".restic-")
+	if err != nil {
+		return errors.Wrap(err, "TempFile")
+	}
+
+	if _, err = f.Write(buf); err == nil {
+		err = f.Chmod(0644)
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = fs.Rename(f.Name(), filename)
+	}
+
+	if err != nil {
+		_ = fs.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// pushMetrics replaces the metrics of the job "restic" and the command on the
+// Prometheus pushgateway at url.
+func pushMetrics(url string, m *runMetrics) error {
+	buf := bytes.NewBuffer(nil)
+	if _, err := m.WriteTo(buf); err != nil {
+		return err
+	}
+
+	url = strings.TrimSuffix(url, "/") + "/metrics/job/restic/command/" + m.command
+	req, err := http.NewRequest("PUT", url, buf)
+	if err != nil {
+		return errors.Wrap(err, "NewRequest")
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "push metrics")
+	}
+
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	if err = res.Body.Close(); err != nil {
+		return errors.Wrap(err, "Close")
+	}
+
+	if res.StatusCode/100 != 2 {
+		return errors.Errorf("pushgateway returned unexpected status %v", res.Status)
+	}
+
+	return nil
+}
+
+// runWithMetrics runs f for the command. When a metrics file or a
+// pushgateway is configured, the metrics recorded by f and the duration and
+// outcome of the run are exported afterwards. With --stats, the resource usage
+// of the run is printed. Errors while exporting the metrics or printing the
+// stats are printed as warnings.
+func runWithMetrics(command string, gopts GlobalOptions, f func(GlobalOptions) error) error {
+	if gopts.Stats {
+		gopts.stats = newRunStats(command)
+		defer func() {
+			if e := printStats(gopts, gopts.stats); e != nil {
+				Warnf("unable to print stats: %v\n", e)
+			}
+		}()
+	}
+
+	if gopts.MetricsFile == "" && gopts.MetricsPushgateway == "" {
+		return f(gopts)
+	}
+
+	m := newRunMetrics(command)
+	gopts.metrics = m
+
+	start := time.Now()
+	err := f(gopts)
+
+	success := 0.0
+	if err == nil {
+		success = 1
+	}
+
+	m.Set("last_run_timestamp_seconds", "Time when the last run finished.", float64(time.Now().Unix()))
+	m.Set("last_run_duration_seconds", "Duration of the last run.", time.Since(start).Seconds())
+	m.Set("last_run_success", "Whether the last run was successful (1) or failed (0).", success)
+
+	if gopts.MetricsFile != "" {
+		if e := writeMetricsFile(gopts.MetricsFile, m); e != nil {
+			Warnf("unable to write metrics: %v\n", e)
+		}
+	}
+
+	if gopts.MetricsPushgateway != "" {
+		if e := pushMetrics(gopts.MetricsPushgateway, m); e != nil {
+			Warnf("unable to push metrics: %v\n", e)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "restic/test"
+)
+
+func TestRunMetricsWriteTo(t *testing.T) {
+	m := newRunMetrics("backup")
+	m.Set("backup_files", "Number of files.", 23)
+	m.Set("backup_bytes", "Number of bytes.", 1.5)
+	m.Set("backup_files", "Number of files.", 42)
+
+	buf := bytes.NewBuffer(nil)
+	_, err := m.WriteTo(buf)
+	OK(t, err)
+
+	want := `# HELP restic_backup_files Number of files.
+# TYPE restic_backup_files gauge
+restic_backup_files{command="backup"} 42
+# HELP restic_backup_bytes Number of bytes.
+# TYPE restic_backup_bytes gauge
+restic_backup_bytes{command="backup"} 1.5
+`
+	Equals(t, want, buf.String())
+
+	// recording metrics without a collector is a no-op
+	var nilMetrics *runMetrics
+	nilMetrics.Set("foo", "bar", 1)
+}
+
+func TestWriteMetricsFile(t *testing.T) {
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(tempdir, "restic.prom")
+	OK(t, ioutil.WriteFile(filename, []byte("old content"), 0600))
+
+	m := newRunMetrics("prune")
+	m.Set("prune_packs_deleted", "Number of packs.", 5)
+	OK(t, writeMetricsFile(filename, m))
+
+	buf, err := ioutil.ReadFile(filename)
+	OK(t, err)
+	Assert(t, bytes.Contains(buf, []byte(`restic_prune_packs_deleted{command="prune"} 5`)),
+		"metric not found in file:\n%s", buf)
+
+	// no temporary files are left behind
+	entries, err := ioutil.ReadDir(tempdir)
+	OK(t, err)
+	Equals(t, 1, len(entries))
+
+	fi, err := os.Stat(filename)
+	OK(t, err)
+	Equals(t, os.FileMode(0644), fi.Mode().Perm())
+}
+
+func TestPushMetrics(t *testing.T) {
+	var method, path string
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		method, path = req.Method, req.URL.Path
+		body, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer srv.Close()
+
+	m := newRunMetrics("forget")
+	m.Set("forget_snapshots_removed", "Number of snapshots.", 3)
+	OK(t, pushMetrics(srv.URL+"/", m))
+
+	Equals(t, "PUT", method)
+	Equals(t, "/metrics/job/restic/command/forget", path)
+	Assert(t, bytes.Contains(body, []byte(`restic_forget_snapshots_removed{command="forget"} 3`)),
+		"metric not found in body:\n%s", body)
+}
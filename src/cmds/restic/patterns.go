@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"restic/errors"
+	"restic/filter"
+	"restic/fs"
+)
+
+// readPatternFiles returns the patterns from all files, one per line. Empty
+// lines and lines starting with '#' are ignored, environment variables are
+// expanded.
+func readPatternFiles(filenames []string) ([]string, error) {
+	var patterns []string
+	for _, filename := range filenames {
+		file, err := fs.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+
+			// ignore empty lines
+			if line == "" {
+				continue
+			}
+
+			// strip comments
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			line = os.ExpandEnv(line)
+			patterns = append(patterns, line)
+		}
+
+		err = scanner.Err()
+		_ = file.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "Scan")
+		}
+	}
+
+	return patterns, nil
+}
+
+// splitPatternOptions splits the values of --exclude and --include into
+// single patterns, several patterns can be given at once separated by commas.
+func splitPatternOptions(values []string) []string {
+	var patterns []string
+	for _, v := range values {
+		patterns = append(patterns, filter.SplitPatterns(v)...)
+	}
+	return patterns
+}
+
+// parsePatterns parses the patterns given for the option kind (e.g.
+// "exclude"), so that invalid patterns are reported before any work is done.
+func parsePatterns(kind string, patterns []string) ([]filter.Pattern, error) {
+	for _, pat := range patterns {
+		if _, err := filter.ParsePattern(pat); err != nil {
+			return nil, errors.Fatalf("invalid %s pattern %q: %v", kind, pat, err)
+		}
+	}
+
+	return filter.ParsePatterns(patterns)
+}
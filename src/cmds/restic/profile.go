@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"restic/errors"
+)
+
+// defaultProfileDir is the directory in which profiles are looked up by name.
+const defaultProfileDir = "/etc/restic/profiles"
+
+// Profile describes a backup which is run regularly, e.g. by systemd. It is
+// read from the JSON file <name>.json in the profile directory.
+type Profile struct {
+	Name string `json:"-"`
+
+	Repository      string `json:"repository"`
+	PasswordFile    string `json:"password_file"`
+	PasswordCommand string `json:"password_command"`
+
+	// EnvironmentFile contains additional environment variables, e.g. the
+	// credentials for the backend.
+	EnvironmentFile string `json:"environment_file"`
+
+	Paths      []string `json:"paths"`
+	BackupArgs []string `json:"backup_args"`
+
+	// Schedule is a calendar event as understood by systemd, e.g. "daily" or
+	// "Mon..Fri 22:00". RandomizedDelay is a duration like "30m".
+	Schedule        string `json:"schedule"`
+	RandomizedDelay string `json:"randomized_delay"`
+
+	// OnFailure is the name of a unit which is started when the backup fails.
+	OnFailure string `json:"on_failure"`
+
+	// User runs the backup as this user instead of root.
+	User string `json:"user"`
+
+	// ReadWritePaths are additional directories which the backup may modify,
+	// the cache and a local repository are always writable.
+	ReadWritePaths []string `json:"read_write_paths"`
+}
+
+var profileNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// loadProfile reads the profile name from dir.
+func loadProfile(dir, name string) (*Profile, error) {
+	if !profileNameRegexp.MatchString(name) || strings.HasPrefix(name, ".") {
+		return nil, errors.Fatalf("invalid profile name %q", name)
+	}
+
+	filename := filepath.Join(dir, name+".json")
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Fatalf("profile %q not found in %v", name, dir)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadFile")
+	}
+
+	p := &Profile{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		return nil, errors.Fatalf("unable to parse profile %v: %v", filename, err)
+	}
+	p.Name = name
+
+	if err := p.check(); err != nil {
+		return nil, errors.Fatalf("invalid profile %v: %v", filename, err)
+	}
+
+	return p, nil
+}
+
+// check returns an error if the profile is incomplete. Line breaks are
+// rejected in all values, they would end a directive in the unit files.
+func (p *Profile) check() error {
+	if p.Repository == "" {
+		return errors.New("no repository given")
+	}
+
+	if len(p.Paths) == 0 {
+		return errors.New("no paths to back up given")
+	}
+
+	if p.PasswordFile != "" && p.PasswordCommand != "" {
+		return errors.New("password_file and password_command cannot be combined")
+	}
+
+	if p.RandomizedDelay != "" {
+		if _, err := time.ParseDuration(p.RandomizedDelay); err != nil {
+			return errors.Errorf("invalid randomized_delay %q", p.RandomizedDelay)
+		}
+	}
+
+	values := []string{p.Repository, p.PasswordFile, p.PasswordCommand, p.EnvironmentFile,
+		p.Schedule, p.OnFailure, p.User}
+	values = append(values, p.Paths...)
+	values = append(values, p.BackupArgs...)
+	values = append(values, p.ReadWritePaths...)
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return errors.Errorf("line break in value %q", v)
+		}
+	}
+
+	return nil
+}
+
+// loadProfiles reads the profiles given as a comma separated list of names
+// from dir. The name "all" selects all profiles in dir.
+func loadProfiles(dir, names string) ([]*Profile, error) {
+	if names != "all" {
+		var profiles []*Profile
+		for _, name := range strings.Split(names, ",") {
+			p, err := loadProfile(dir, strings.TrimSpace(name))
+			if err != nil {
+				return nil, err
+			}
+			profiles = append(profiles, p)
+		}
+		return profiles, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Glob")
+	}
+
+	if len(files) == 0 {
+		return nil, errors.Fatalf("no profiles found in %v", dir)
+	}
+
+	// Glob returns the files sorted by name
+	profiles := make([]*Profile, 0, len(files))
+	for _, file := range files {
+		p, err := loadProfile(dir, strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, p)
+	}
+
+	return profiles, nil
+}
+
+// readEnvironmentFile reads the variables from an environment file in the
+// format used by systemd: one assignment VAR=value per line, the value may be
+// enclosed in single or double quotes. Empty lines and lines starting with #
+// or ; are ignored.
+func readEnvironmentFile(filename string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadFile")
+	}
+
+	env := make(map[string]string)
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		pos := strings.Index(line, "=")
+		if pos <= 0 {
+			return nil, errors.Fatalf("%v:%d: invalid line %q", filename, i+1, line)
+		}
+
+		name, value := strings.TrimSpace(line[:pos]), strings.TrimSpace(line[pos+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[name] = value
+	}
+
+	return env, nil
+}
+
+// setEnvironment sets the variables in env for this process. The returned
+// function restores the previous values.
+func setEnvironment(env map[string]string) (restore func()) {
+	type previous struct {
+		value string
+		set   bool
+	}
+
+	old := make(map[string]previous, len(env))
+	for name, value := range env {
+		v, ok := os.LookupEnv(name)
+		old[name] = previous{v, ok}
+		_ = os.Setenv(name, value)
+	}
+
+	return func() {
+		for name, p := range old {
+			if p.set {
+				_ = os.Setenv(name, p.value)
+			} else {
+				_ = os.Unsetenv(name)
+			}
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"restic"
+	"restic/debug"
+	"restic/index"
+	"restic/repository"
+	"time"
+)
+
+// defaultPruneGracePeriod is used as the delete delay for a concurrent prune
+// if none is given.
+const defaultPruneGracePeriod = 24 * time.Hour
+
+// pendingRemoval describes the packs recorded for removal by earlier runs of
+// prune. For a concurrent prune, it is handed over from the first phase,
+// which runs with a non-exclusive lock, to the second phase, which removes the
+// packs while the repository is locked exclusively.
+type pendingRemoval struct {
+	// due are the pending deletions for which the delay has passed
+	due []*restic.PendingDeletion
+
+	// packs contains all packs waiting for removal, including the due ones
+	packs map[restic.ID]index.Pack
+
+	// used are the blobs referenced by the snapshots seen in the first phase
+	used      restic.BlobSet
+	snapshots restic.IDSet
+}
+
+// prepare records the packs waiting for removal from packs and makes their
+// blobs available to repo, so that snapshots created by concurrent backups
+// which reference them can still be loaded. For a concurrent prune, packs
+// which are not referenced by any index yet may belong to a backup which is
+// still running, they are removed from packs so that they are neither
+// rewritten nor removed.
+func (r *pendingRemoval) prepare(repo *repository.Repository, packs *index.PackList, pending restic.IDSet, concurrent bool) error {
+	committed := restic.NewIDSet()
+	for _, ri := range repo.Index().(*repository.MasterIndex).All() {
+		committed.Merge(ri.Packs())
+	}
+
+	r.packs = make(map[restic.ID]index.Pack)
+	for id := range pending {
+		if !packs.Has(id) {
+			continue
+		}
+
+		p, err := packs.Pack(id)
+		if err != nil {
+			return err
+		}
+		r.packs[id] = p
+	}
+
+	if err := addPacksToIndex(repo, r.packs); err != nil {
+		return err
+	}
+
+	if !concurrent {
+		return nil
+	}
+
+	skipped := 0
+	for id := range packs.IDs() {
+		if committed.Has(id) || pending.Has(id) {
+			continue
+		}
+
+		if err := packs.RemovePack(id); err != nil {
+			return err
+		}
+		skipped++
+	}
+
+	if skipped > 0 {
+		Verbosef("ignoring %d packs which are not in the index yet\n", skipped)
+	}
+
+	return nil
+}
+
+// addPacksToIndex adds the blobs of the packs to the in-memory index of repo.
+// The index is marked as final, so it is never saved to the repository.
+func addPacksToIndex(repo *repository.Repository, packs map[restic.ID]index.Pack) error {
+	ri := repository.NewIndex()
+	for id, p := range packs {
+		for _, blob := range p.Entries {
+			ri.Store(restic.PackedBlob{Blob: blob, PackID: id})
+		}
+	}
+
+	if err := ri.Finalize(ioutil.Discard); err != nil {
+		return err
+	}
+
+	repo.Index().(*repository.MasterIndex).Insert(ri)
+	return nil
+}
+
+// neededPacks returns the packs waiting for removal which contain used blobs
+// that are not stored in any other pack known to the index of repo.
+func (r *pendingRemoval) neededPacks(repo restic.Repository) restic.IDSet {
+	needed := restic.NewIDSet()
+	kept := restic.NewBlobSet()
+
+	for id, p := range r.packs {
+		for _, blob := range p.Entries {
+			h := restic.BlobHandle{ID: blob.ID, Type: blob.Type}
+			if !r.used.Has(h) || kept.Has(h) || r.storedElsewhere(repo, h) {
+				continue
+			}
+
+			needed.Insert(id)
+			for _, blob := range p.Entries {
+				kept.Insert(restic.BlobHandle{ID: blob.ID, Type: blob.Type})
+			}
+			break
+		}
+	}
+
+	return needed
+}
+
+// storedElsewhere returns true if the blob is stored in a pack which does not
+// wait for removal.
+func (r *pendingRemoval) storedElsewhere(repo restic.Repository, h restic.BlobHandle) bool {
+	blobs, err := repo.Index().Lookup(h.ID, h.Type)
+	if err != nil {
+		return false
+	}
+
+	for _, pb := range blobs {
+		if _, ok := r.packs[pb.PackID]; !ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removePendingPacks is the second phase of a concurrent prune. With an
+// exclusive lock, no backup which may still reference the packs waiting for
+// removal is running. If the lock cannot be acquired, the packs are removed by
+// a later run.
+func removePendingPacks(ctx context.Context, opts PruneOptions, gopts GlobalOptions, repo *repository.Repository, r *pendingRemoval) error {
+	if r == nil || len(r.packs)+len(r.due) == 0 {
+		return nil
+	}
+
+	lock, err := lockRepoExclusive(repo)
+	defer unlockRepo(lock)
+	if err != nil {
+		Warnf("unable to lock the repository exclusively, packs recorded for removal are kept for now: %v\n", err)
+		return nil
+	}
+
+	return r.remove(ctx, opts, gopts, repo)
+}
+
+// remove removes the due packs, the repository must be locked exclusively.
+// The snapshots created since the analysis are checked for references to the
+// packs waiting for removal, the packs which are still needed are added to
+// the index again and the due packs which are not needed are removed.
+func (r *pendingRemoval) remove(ctx context.Context, opts PruneOptions, gopts GlobalOptions, repo *repository.Repository) error {
+	if len(r.packs)+len(r.due) == 0 {
+		return nil
+	}
+
+	// the index has been rebuilt and backups which finished in the meantime
+	// may have added index files
+	repo.SetIndex(repository.NewMasterIndex())
+	err := repo.LoadIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if err = addPacksToIndex(repo, r.packs); err != nil {
+		return err
+	}
+
+	// trees which have been processed before are not traversed again
+	seen := restic.NewBlobSet()
+	for h := range r.used {
+		if h.Type == restic.TreeBlob {
+			seen.Insert(h)
+		}
+	}
+
+	for id := range repo.List(ctx, restic.SnapshotFile) {
+		if r.snapshots.Has(id) {
+			continue
+		}
+
+		debug.Log("process new snapshot %v", id.Str())
+		sn, err := restic.LoadSnapshot(ctx, repo, id)
+		if err != nil {
+			return err
+		}
+
+		if err = restic.FindUsedBlobs(ctx, repo, *sn.Tree, r.used, seen); err != nil {
+			return err
+		}
+	}
+
+	needed := r.neededPacks(repo)
+	if len(needed) > 0 {
+		ri := repository.NewIndex()
+		for id := range needed {
+			for _, blob := range r.packs[id].Entries {
+				ri.Store(restic.PackedBlob{Blob: blob, PackID: id})
+			}
+		}
+
+		id, err := repository.SaveIndex(ctx, repo, ri)
+		if err != nil {
+			return err
+		}
+		Verbosef("keeping %d packs recorded for removal which are still referenced, saved index %v\n", len(needed), id.Str())
+	}
+
+	packs := restic.PendingPacks(r.due)
+	for id := range needed {
+		packs.Delete(id)
+	}
+
+	if len(packs) > 0 {
+		Verbosef("removing %d packs recorded by earlier runs\n", len(packs))
+
+		bar := newProgressMax(!gopts.Quiet, uint64(len(packs)), "packs deleted")
+		if err = removePackFiles(ctx, opts, repo, packs, bar); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range r.due {
+		h := restic.Handle{Type: restic.DeletionFile, Name: d.ID().String()}
+		if err = repo.Backend().Remove(ctx, h); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runPruneConcurrent prunes the repository with a non-exclusive lock and
+// afterwards removes the packs which are due with an exclusive lock.
+func runPruneConcurrent(opts PruneOptions, gopts GlobalOptions, repo *repository.Repository) error {
+	if opts.DeleteDelay == 0 {
+		opts.DeleteDelay = defaultPruneGracePeriod
+	}
+
+	removal, err := func() (*pendingRemoval, error) {
+		lock, err := lockRepo(repo)
+		defer unlockRepo(lock)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = repo.LoadIndex(gopts.ctx); err != nil {
+			return nil, err
+		}
+
+		return prunePacks(opts, gopts, repo)
+	}()
+	if err == nil {
+		err = removePendingPacks(gopts.ctx, opts, gopts, repo, removal)
+	}
+
+	recordOperation(gopts.ctx, repo, "prune", err)
+	return err
+}
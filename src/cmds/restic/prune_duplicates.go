@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"restic"
+	"restic/index"
+)
+
+// blobUsage tells which blobs stored in the packs are still needed. Of a blob
+// which is stored more than once within an encryption domain, only the copy in
+// the pack with the highest share of used data is needed, so that the packs
+// which are used best need not be rewritten.
+type blobUsage struct {
+	used restic.BlobSet
+
+	// kept is the pack of the copy which is kept for blobs stored more than
+	// once
+	kept map[index.DomainBlob]restic.ID
+
+	// domains is the number of encryption domains in which a blob stored more
+	// than once is stored
+	domains map[restic.BlobHandle]int
+}
+
+// newBlobUsage selects the copies of the used blobs in packs which are kept,
+// dups are the duplicate blobs as returned by packs.DuplicateBlobs.
+func newBlobUsage(packs *index.PackList, used restic.BlobSet, dups map[index.DomainBlob]int) (*blobUsage, error) {
+	u := &blobUsage{
+		used:    used,
+		kept:    make(map[index.DomainBlob]restic.ID),
+		domains: make(map[restic.BlobHandle]int),
+	}
+
+	if len(dups) == 0 {
+		return u, nil
+	}
+
+	// the share of used data in each pack, as used and total bytes
+	type share struct{ used, total uint64 }
+	shares := make(map[restic.ID]share, packs.Len())
+	err := packs.Each(func(p index.Pack) error {
+		var s share
+		for _, blob := range p.Entries {
+			s.total += uint64(blob.Length)
+			if used.Has(restic.BlobHandle{ID: blob.ID, Type: blob.Type}) {
+				s.used += uint64(blob.Length)
+			}
+		}
+		shares[p.ID] = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// better returns true if the pack a is used better than b
+	better := func(a, b restic.ID) bool {
+		sa, sb := shares[a], shares[b]
+		if sa.used*sb.total != sb.used*sa.total {
+			return sa.used*sb.total > sb.used*sa.total
+		}
+		return bytes.Compare(a[:], b[:]) < 0
+	}
+
+	err = packs.Each(func(p index.Pack) error {
+		for _, blob := range p.Entries {
+			h := restic.BlobHandle{ID: blob.ID, Type: blob.Type}
+			if !used.Has(h) {
+				continue
+			}
+
+			db := index.DomainBlob{BlobHandle: h, Domain: blob.Domain}
+			if _, ok := dups[db]; !ok {
+				continue
+			}
+
+			if kept, ok := u.kept[db]; !ok || better(p.ID, kept) {
+				u.kept[db] = p.ID
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// a blob which is stored more than once in one domain may be stored only
+	// once in other domains, so all its copies are looked at
+	for db := range u.kept {
+		u.domains[db.BlobHandle] = 0
+	}
+	seen := make(map[index.DomainBlob]struct{})
+	err = packs.Each(func(p index.Pack) error {
+		for _, blob := range p.Entries {
+			h := restic.BlobHandle{ID: blob.ID, Type: blob.Type}
+			if _, ok := u.domains[h]; !ok {
+				continue
+			}
+
+			db := index.DomainBlob{BlobHandle: h, Domain: blob.Domain}
+			if _, ok := seen[db]; ok {
+				continue
+			}
+			seen[db] = struct{}{}
+			u.domains[h]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// live returns true if the blob stored in the pack is still needed.
+func (u *blobUsage) live(packID restic.ID, blob restic.Blob) bool {
+	h := restic.BlobHandle{ID: blob.ID, Type: blob.Type}
+	if !u.used.Has(h) {
+		return false
+	}
+
+	kept, ok := u.kept[index.DomainBlob{BlobHandle: h, Domain: blob.Domain}]
+	return !ok || kept.Equal(packID)
+}
+
+// repackBlobs returns the blobs which are copied from the packs which are
+// rewritten. A blob is left out if its kept copies in all encryption domains
+// are stored in packs which stay as they are.
+func (u *blobUsage) repackBlobs(rewritePacks restic.IDSet) restic.BlobSet {
+	keptElsewhere := make(map[restic.BlobHandle]int)
+	for db, id := range u.kept {
+		if !rewritePacks.Has(id) {
+			keptElsewhere[db.BlobHandle]++
+		}
+	}
+
+	blobs := restic.NewBlobSet()
+	for h := range u.used {
+		if n, ok := keptElsewhere[h]; ok && n == u.domains[h] {
+			continue
+		}
+		blobs.Insert(h)
+	}
+
+	return blobs
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"restic"
+	"restic/index"
+	"testing"
+
+	. "restic/test"
+)
+
+func TestBlobUsage(t *testing.T) {
+	packs, err := index.NewPackList()
+	OK(t, err)
+	defer func() { OK(t, packs.Close()) }()
+
+	usedBlobs := restic.NewBlobSet()
+
+	newBlob := func(length uint, used bool) restic.Blob {
+		blob := restic.Blob{ID: restic.NewRandomID(), Type: restic.DataBlob, Length: length}
+		if used {
+			usedBlobs.Insert(restic.BlobHandle{ID: blob.ID, Type: blob.Type})
+		}
+		return blob
+	}
+
+	addPack := func(blobs ...restic.Blob) restic.ID {
+		id := restic.NewRandomID()
+		OK(t, packs.AddPack(id, 0, blobs))
+		return id
+	}
+
+	dup := newBlob(100, true)
+	otherDomain := dup
+	otherDomain.Domain = "other"
+
+	a := addPack(dup, newBlob(800, true), newBlob(100, false))
+	b := addPack(dup, newBlob(500, true), newBlob(500, false))
+	c := addPack(otherDomain, newBlob(100, true))
+
+	dups, err := packs.DuplicateBlobs()
+	OK(t, err)
+	u, err := newBlobUsage(packs, usedBlobs, dups)
+	OK(t, err)
+
+	// the copy in a is kept, as a contains more used data
+	Assert(t, u.live(a, dup), "copy of duplicate blob in a is not live")
+	Assert(t, !u.live(b, dup), "copy of duplicate blob in b is live")
+	Assert(t, u.live(c, otherDomain), "blob in other domain is not live")
+
+	// the blob is copied to be on the safe side, as it is also stored in
+	// another domain
+	dupHandle := restic.BlobHandle{ID: dup.ID, Type: dup.Type}
+	Assert(t, u.repackBlobs(restic.NewIDSet(b)).Has(dupHandle),
+		"blob stored in another domain is not copied")
+
+	OK(t, packs.RemovePack(c))
+	u, err = newBlobUsage(packs, usedBlobs, dups)
+	OK(t, err)
+	Assert(t, !u.repackBlobs(restic.NewIDSet(b)).Has(dupHandle),
+		"duplicate blob is copied although a is kept")
+	Assert(t, u.repackBlobs(restic.NewIDSet(a, b)).Has(dupHandle),
+		"duplicate blob is not copied when a is rewritten")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"restic"
+	"time"
+)
+
+// pruneSummary is the JSON representation of the result of prune. Sizes of
+// packs are omitted when prune is resumed, as they are not known then.
+type pruneSummary struct {
+	DryRun  bool `json:"dry_run"`
+	Resumed bool `json:"resumed"`
+
+	pruneJSONRepository
+
+	Snapshots int `json:"snapshots"`
+	UsedBlobs int `json:"used_blobs"`
+
+	pruneJSONPlan
+}
+
+// pruneJSONRepository is printed as an event of type "prune_repository"
+// once the packs in the repository have been counted.
+type pruneJSONRepository struct {
+	Packs          int    `json:"packs"`
+	Blobs          int    `json:"blobs"`
+	Bytes          uint64 `json:"bytes"`
+	DuplicateBlobs int    `json:"duplicate_blobs"`
+	DuplicateBytes uint64 `json:"duplicate_bytes"`
+}
+
+// pruneJSONPlan describes what prune does and is printed as an event of type
+// "prune_plan" before it starts to modify the repository.
+type pruneJSONPlan struct {
+	DeletePacks  int    `json:"delete_packs"`
+	DeleteBytes  uint64 `json:"delete_bytes,omitempty"`
+	RewritePacks int    `json:"rewrite_packs"`
+	RewriteBytes uint64 `json:"rewrite_bytes,omitempty"`
+	CombinePacks int    `json:"combine_packs"`
+	CombineBytes uint64 `json:"combine_bytes,omitempty"`
+	FreedBytes   uint64 `json:"freed_bytes"`
+}
+
+// pruneJSONProgress is printed as an event of type "prune_progress" when a
+// phase starts, when it is done and, on a terminal, every second.
+type pruneJSONProgress struct {
+	Phase       int     `json:"phase"`
+	Phases      int     `json:"phases"`
+	Name        string  `json:"name"`
+	Done        uint64  `json:"done"`
+	Total       uint64  `json:"total"`
+	Seconds     float64 `json:"seconds_elapsed"`
+	PercentDone float64 `json:"percent_done"`
+}
+
+// event prints v as an event of type typ if the versioned JSON output is
+// selected.
+func (p *pruneProgress) event(typ string, v interface{}) error {
+	if p.gopts.JSONSchema == 0 {
+		return nil
+	}
+	return printJSONEvent(p.gopts, typ, v)
+}
+
+// repository records the packs and blobs in the repository.
+func (p *pruneProgress) repository(r pruneJSONRepository) error {
+	p.summary.pruneJSONRepository = r
+	return p.event("prune_repository", r)
+}
+
+// plan records what prune does.
+func (p *pruneProgress) plan(plan pruneJSONPlan) error {
+	p.summary.pruneJSONPlan = plan
+	return p.event("prune_plan", plan)
+}
+
+// finish prints the summary if the JSON output is selected. With the
+// versioned output, it is printed as an event of type "prune_summary".
+func (p *pruneProgress) finish() error {
+	switch {
+	case p.gopts.JSONSchema > 0:
+		return printJSONEvent(p.gopts, "prune_summary", p.summary)
+	case p.gopts.JSON:
+		return json.NewEncoder(p.gopts.stdout).Encode(p.summary)
+	}
+	return nil
+}
+
+// jsonPhase returns a progress for the phase which prints events of type
+// "prune_progress".
+func (p *pruneProgress) jsonPhase(phase int, max uint64) *restic.Progress {
+	bar := restic.NewProgress()
+
+	report := func(s restic.Stat, d time.Duration) {
+		var f float64
+		if max > 0 {
+			f = float64(s.Blobs) / float64(max)
+		}
+		if f > 1 {
+			f = 1
+		}
+
+		err := p.event("prune_progress", pruneJSONProgress{
+			Phase:       phase + 1,
+			Phases:      len(prunePhases),
+			Name:        prunePhases[phase].name,
+			Done:        s.Blobs,
+			Total:       max,
+			Seconds:     d.Seconds(),
+			PercentDone: 100 * p.overall(phase, f),
+		})
+		if err != nil {
+			Warnf("unable to print progress: %v\n", err)
+		}
+	}
+
+	bar.OnStart = func() {
+		report(restic.Stat{}, 0)
+	}
+
+	bar.OnUpdate = func(s restic.Stat, d time.Duration, ticker bool) {
+		report(s, d)
+	}
+
+	// OnUpdate is called once more when the phase is done
+	bar.OnDone = func(s restic.Stat, d time.Duration, ticker bool) {}
+
+	return bar
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"restic"
+	"restic/errors"
+	"restic/index"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxUnused is the amount of unused data which prune may leave in packs
+// instead of rewriting them.
+type maxUnused struct {
+	percent uint
+	bytes   uint64
+}
+
+// parseMaxUnused parses the value of --max-unused, which is either a
+// percentage of the repository size like "5%" or a size like "10G". An empty
+// string returns nil, all packs with unused data are rewritten then.
+func parseMaxUnused(s string) (*maxUnused, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	if strings.HasSuffix(s, "%") {
+		p, err := strconv.ParseUint(strings.TrimSuffix(s, "%"), 10, 32)
+		if err != nil || p > 100 {
+			return nil, errors.Fatalf("invalid value for --max-unused: %q", s)
+		}
+		return &maxUnused{percent: uint(p)}, nil
+	}
+
+	size, err := parseSize(s)
+	if err != nil {
+		return nil, errors.Fatalf("invalid value for --max-unused: %q", s)
+	}
+
+	return &maxUnused{bytes: size}, nil
+}
+
+// limit returns the number of unused bytes allowed for a repository which
+// contains totalBytes.
+func (m *maxUnused) limit(totalBytes uint64) uint64 {
+	if m.percent > 0 {
+		return totalBytes / 100 * uint64(m.percent)
+	}
+	return m.bytes
+}
+
+// packUsage is the amount of data in a pack which is still used.
+type packUsage struct {
+	id          restic.ID
+	used, total uint64
+}
+
+// packUsages returns the usage of the packs in ids.
+func packUsages(packs *index.PackList, ids restic.IDSet, usage *blobUsage) ([]packUsage, error) {
+	list := make([]packUsage, 0, len(ids))
+	for id := range ids {
+		pack, err := packs.Pack(id)
+		if err != nil {
+			return nil, err
+		}
+
+		p := packUsage{id: id}
+		for _, blob := range pack.Entries {
+			p.total += uint64(blob.Length)
+			if usage.live(id, blob) {
+				p.used += uint64(blob.Length)
+			}
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// blobsSize returns the total size of the blobs in the packs in ids.
+func blobsSize(packs *index.PackList, ids restic.IDSet) (uint64, error) {
+	var size uint64
+	for id := range ids {
+		pack, err := packs.Pack(id)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, blob := range pack.Entries {
+			size += uint64(blob.Length)
+		}
+	}
+	return size, nil
+}
+
+// byUnusedShare sorts packs by the share of unused data, ascending.
+type byUnusedShare []packUsage
+
+func (s byUnusedShare) Len() int      { return len(s) }
+func (s byUnusedShare) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byUnusedShare) Less(i, j int) bool {
+	// compare (total-used)/total without division
+	return (s[i].total-s[i].used)*s[j].total < (s[j].total-s[j].used)*s[i].total
+}
+
+// limitRepack removes packs from rewritePacks so that they are kept as they
+// are, as long as the unused data in the kept packs stays below limit. The
+// packs with the smallest share of unused data are kept first, so the packs
+// which are rewritten free the most space for the data which is copied. It
+// returns the number of unused bytes which are kept.
+func limitRepack(packs *index.PackList, rewritePacks restic.IDSet, usage *blobUsage, limit uint64) (kept uint64, err error) {
+	list, err := packUsages(packs, rewritePacks, usage)
+	if err != nil {
+		return 0, err
+	}
+	sort.Sort(byUnusedShare(list))
+
+	for _, p := range list {
+		unused := p.total - p.used
+		if kept+unused > limit {
+			break
+		}
+
+		kept += unused
+		rewritePacks.Delete(p.id)
+	}
+
+	return kept, nil
+}
+
+// byUnusedBytes sorts packs by the amount of unused data, descending. Of packs
+// with the same amount, the smaller ones come first.
+type byUnusedBytes []packUsage
+
+func (s byUnusedBytes) Len() int      { return len(s) }
+func (s byUnusedBytes) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byUnusedBytes) Less(i, j int) bool {
+	ui, uj := s[i].total-s[i].used, s[j].total-s[j].used
+	if ui != uj {
+		return ui > uj
+	}
+	return s[i].total < s[j].total
+}
+
+// limitRepackSize removes packs from rewritePacks so that at most budget
+// bytes of packs are rewritten. The packs which free the most space are
+// rewritten first, packs which do not fit into the remaining budget are kept
+// as they are. It returns the number of unused bytes which are kept.
+func limitRepackSize(packs *index.PackList, rewritePacks restic.IDSet, usage *blobUsage, budget uint64) (kept uint64, err error) {
+	list, err := packUsages(packs, rewritePacks, usage)
+	if err != nil {
+		return 0, err
+	}
+	sort.Sort(byUnusedBytes(list))
+
+	var scheduled uint64
+	for _, p := range list {
+		if scheduled+p.total <= budget {
+			scheduled += p.total
+			continue
+		}
+
+		kept += p.total - p.used
+		rewritePacks.Delete(p.id)
+	}
+
+	return kept, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"restic"
+	"restic/index"
+	"testing"
+
+	. "restic/test"
+)
+
+func TestParseMaxUnused(t *testing.T) {
+	var tests = []struct {
+		s     string
+		total uint64
+		limit uint64
+	}{
+		{"5%", 1000, 50},
+		{"100%", 1000, 1000},
+		{"0%", 1000, 0},
+		{"10k", 1000, 10 * 1024},
+		{"0", 1000, 0},
+	}
+
+	for _, test := range tests {
+		m, err := parseMaxUnused(test.s)
+		OK(t, err)
+		Equals(t, test.limit, m.limit(test.total))
+	}
+
+	m, err := parseMaxUnused("")
+	OK(t, err)
+	Assert(t, m == nil, "limit returned for empty value")
+
+	for _, s := range []string{"101%", "x%", "10x", "-1"} {
+		_, err = parseMaxUnused(s)
+		Assert(t, err != nil, "no error for invalid value %q", s)
+	}
+}
+
+// addTestPack adds a pack with a used and an unused blob of the given lengths
+// to packs and records the used blob in usedBlobs.
+func addTestPack(t testing.TB, packs *index.PackList, usedBlobs restic.BlobSet, used, unused uint) restic.ID {
+	var entries []restic.Blob
+	for i, length := range []uint{used, unused} {
+		blob := restic.Blob{ID: restic.NewRandomID(), Type: restic.DataBlob, Length: length}
+		entries = append(entries, blob)
+		if i == 0 {
+			usedBlobs.Insert(restic.BlobHandle{ID: blob.ID, Type: blob.Type})
+		}
+	}
+
+	id := restic.NewRandomID()
+	OK(t, packs.AddPack(id, int64(used+unused), entries))
+	return id
+}
+
+func TestLimitRepack(t *testing.T) {
+	packs, err := index.NewPackList()
+	OK(t, err)
+	defer func() { OK(t, packs.Close()) }()
+
+	usedBlobs := restic.NewBlobSet()
+	a := addTestPack(t, packs, usedBlobs, 900, 100)
+	b := addTestPack(t, packs, usedBlobs, 500, 500)
+	c := addTestPack(t, packs, usedBlobs, 800, 200)
+
+	var tests = []struct {
+		limit   uint64
+		kept    uint64
+		rewrite restic.IDSet
+	}{
+		{0, 0, restic.NewIDSet(a, b, c)},
+		{150, 100, restic.NewIDSet(b, c)},
+		{350, 300, restic.NewIDSet(b)},
+		{800, 800, restic.NewIDSet()},
+	}
+
+	for _, test := range tests {
+		rewritePacks := restic.NewIDSet(a, b, c)
+		kept, err := limitRepack(packs, rewritePacks, &blobUsage{used: usedBlobs}, test.limit)
+		OK(t, err)
+		Equals(t, test.kept, kept)
+		Equals(t, test.rewrite, rewritePacks)
+	}
+}
+
+func TestLimitRepackSize(t *testing.T) {
+	packs, err := index.NewPackList()
+	OK(t, err)
+	defer func() { OK(t, packs.Close()) }()
+
+	usedBlobs := restic.NewBlobSet()
+	a := addTestPack(t, packs, usedBlobs, 900, 100)
+	b := addTestPack(t, packs, usedBlobs, 500, 500)
+	c := addTestPack(t, packs, usedBlobs, 100, 200)
+
+	var tests = []struct {
+		budget  uint64
+		kept    uint64
+		rewrite restic.IDSet
+	}{
+		{0, 800, restic.NewIDSet()},
+		{999, 600, restic.NewIDSet(c)},
+		{1000, 300, restic.NewIDSet(b)},
+		{1300, 100, restic.NewIDSet(b, c)},
+		{2000, 100, restic.NewIDSet(b, c)},
+		{2300, 0, restic.NewIDSet(a, b, c)},
+	}
+
+	for _, test := range tests {
+		rewritePacks := restic.NewIDSet(a, b, c)
+		kept, err := limitRepackSize(packs, rewritePacks, &blobUsage{used: usedBlobs}, test.budget)
+		OK(t, err)
+		Equals(t, test.kept, kept)
+		Equals(t, test.rewrite, rewritePacks)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"restic"
+	"time"
+)
+
+// The phases of prune, in the order in which they are run.
+const (
+	prunePhaseIndex = iota
+	prunePhaseSnapshots
+	prunePhaseRepack
+	prunePhaseDelete
+	prunePhaseRebuildIndex
+)
+
+// prunePhases are the names of the phases of prune together with their
+// approximate share of the total runtime, which is used to estimate the
+// overall progress.
+var prunePhases = []struct {
+	name   string
+	weight float64
+}{
+	{"build index", 0.3},
+	{"scan snapshots", 0.15},
+	{"repack", 0.3},
+	{"delete", 0.05},
+	{"rebuild index", 0.2},
+}
+
+// pruneProgress reports the progress of prune for the current phase and
+// overall. Phases which have nothing to do can be skipped, their share is
+// then distributed to the other phases. With the versioned JSON output, the
+// progress is reported as events of type "prune_progress".
+type pruneProgress struct {
+	show    bool
+	gopts   GlobalOptions
+	skipped map[int]bool
+
+	// summary collects the results for the JSON output
+	summary pruneSummary
+}
+
+func newPruneProgress(gopts GlobalOptions) *pruneProgress {
+	return &pruneProgress{show: !gopts.Quiet, gopts: gopts, skipped: make(map[int]bool)}
+}
+
+// Skip records that the phase has nothing to do.
+func (p *pruneProgress) Skip(phase int) {
+	p.skipped[phase] = true
+}
+
+// overall returns the overall progress when the fraction f of the phase has
+// been done.
+func (p *pruneProgress) overall(phase int, f float64) float64 {
+	var done, total float64
+	for i, ph := range prunePhases {
+		if p.skipped[i] {
+			continue
+		}
+
+		total += ph.weight
+		switch {
+		case i < phase:
+			done += ph.weight
+		case i == phase:
+			done += ph.weight * f
+		}
+	}
+
+	if total == 0 {
+		return 0
+	}
+	return done / total
+}
+
+// Phase returns a progress for the phase, which counts max items of the given
+// description. nil is returned if the progress is not shown.
+func (p *pruneProgress) Phase(phase int, max uint64, description string) *restic.Progress {
+	if p == nil {
+		return nil
+	}
+
+	if p.gopts.JSONSchema > 0 {
+		return p.jsonPhase(phase, max)
+	}
+
+	if !p.show {
+		return nil
+	}
+
+	bar := restic.NewProgress()
+
+	bar.OnUpdate = func(s restic.Stat, d time.Duration, ticker bool) {
+		var f float64
+		if max > 0 {
+			f = float64(s.Blobs) / float64(max)
+		}
+		if f > 1 {
+			f = 1
+		}
+
+		eta := "-"
+		if f > 0 && ticker {
+			eta = formatSeconds(uint64((1 - f) / f * d.Seconds()))
+		}
+
+		status := fmt.Sprintf("[%s] phase %d/%d %s: %s  %d / %d %s  ETA %s  overall %3.2f%%",
+			formatDuration(d),
+			phase+1, len(prunePhases), prunePhases[phase].name,
+			formatPercent(s.Blobs, max),
+			s.Blobs, max, description,
+			eta, 100*p.overall(phase, f))
+
+		if w := stdoutTerminalWidth(); w > 4 && len(status) > w {
+			status = status[:w-4] + "... "
+		}
+
+		PrintProgress("%s", status)
+	}
+
+	bar.OnDone = func(s restic.Stat, d time.Duration, ticker bool) {
+		fmt.Printf("\n")
+	}
+
+	return bar
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPruneProgressOverall(t *testing.T) {
+	p := newPruneProgress(GlobalOptions{Quiet: true})
+
+	var tests = []struct {
+		phase int
+		f     float64
+		want  float64
+	}{
+		{prunePhaseIndex, 0, 0},
+		{prunePhaseIndex, 0.5, 0.15},
+		{prunePhaseSnapshots, 0, 0.3},
+		{prunePhaseRepack, 0.5, 0.6},
+		{prunePhaseRebuildIndex, 1, 1},
+	}
+
+	for _, test := range tests {
+		got := p.overall(test.phase, test.f)
+		if math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("overall(%d, %v) = %v, want %v", test.phase, test.f, got, test.want)
+		}
+	}
+
+	// the share of skipped phases is distributed to the others
+	p.Skip(prunePhaseRepack)
+	p.Skip(prunePhaseDelete)
+	if got := p.overall(prunePhaseRebuildIndex, 0); math.Abs(got-0.45/0.65) > 1e-9 {
+		t.Errorf("overall with skipped phases = %v, want %v", got, 0.45/0.65)
+	}
+
+	if p.Phase(prunePhaseIndex, 10, "packs") != nil {
+		t.Errorf("Phase returned a progress although it is not shown")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"restic"
+	"restic/debug"
+	"restic/errors"
+	"restic/fs"
+	"restic/repository"
+)
+
+// pruneCheckpointPacks is the number of packs after which the progress of the
+// repack is recorded.
+const pruneCheckpointPacks = 100
+
+// pruneState records the packs which prune removes and rewrites and which of
+// them have been rewritten already, so that an interrupted prune can continue
+// where it stopped instead of analyzing the repository again.
+type pruneState struct {
+	Snapshots   restic.IDs `json:"snapshots"`
+	Remove      restic.IDs `json:"remove"`
+	Rewrite     restic.IDs `json:"rewrite"`
+	Done        restic.IDs `json:"done,omitempty"`
+	RemoveBytes int        `json:"remove_bytes"`
+
+	filename string
+}
+
+// pruneStateFilename returns the name of the file which holds the state of an
+// interrupted prune for repo. It is stored in the cache directory or, without
+// a cache, in the directory for temporary files.
+func pruneStateFilename(gopts GlobalOptions, repo *repository.Repository) string {
+	dir := gopts.CacheDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, "restic-prune-"+repo.Config().ID)
+}
+
+// newPruneState returns the state for a prune which removes and rewrites the
+// given packs of the repository containing snapshots.
+func newPruneState(filename string, snapshots restic.Snapshots, removePacks, rewritePacks restic.IDSet, removeBytes int) *pruneState {
+	s := &pruneState{
+		Remove:      removePacks.List(),
+		Rewrite:     rewritePacks.List(),
+		RemoveBytes: removeBytes,
+		filename:    filename,
+	}
+
+	for _, sn := range snapshots {
+		s.Snapshots = append(s.Snapshots, *sn.ID())
+	}
+
+	return s
+}
+
+// loadPruneState loads the state of an interrupted prune from filename. If
+// there is none, nil is returned.
+func loadPruneState(filename string) (*pruneState, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadFile")
+	}
+
+	s := &pruneState{filename: filename}
+	if err = json.Unmarshal(buf, s); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal")
+	}
+
+	return s, nil
+}
+
+// save writes the state to its file. The file is replaced atomically, so an
+// interrupted save leaves the previous state.
+func (s *pruneState) save() error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "Marshal")
+	}
+
+	tmpfile := s.filename + ".tmp"
+	if err = ioutil.WriteFile(tmpfile, buf, 0600); err != nil {
+		return errors.Wrap(err, "WriteFile")
+	}
+
+	return errors.Wrap(fs.Rename(tmpfile, s.filename), "Rename")
+}
+
+// remove removes the file of the state.
+func (s *pruneState) remove() error {
+	return errors.Wrap(fs.RemoveIfExists(s.filename), "Remove")
+}
+
+// checkpoint records that the packs in done have been rewritten.
+func (s *pruneState) checkpoint(done restic.IDs) error {
+	s.Done = append(s.Done, done...)
+	return s.save()
+}
+
+// remaining returns the packs which still need to be rewritten.
+func (s *pruneState) remaining() restic.IDSet {
+	packs := restic.NewIDSet(s.Rewrite...)
+	for _, id := range s.Done {
+		packs.Delete(id)
+	}
+	return packs
+}
+
+// check returns an error if the state cannot be used for the repository any
+// more, which is the case when snapshots have been added since it was saved or
+// when packs which still need to be rewritten are gone. The packs in the
+// repository are returned.
+func (s *pruneState) check(ctx context.Context, repo restic.Repository) (restic.IDSet, error) {
+	snapshots := restic.NewIDSet(s.Snapshots...)
+	for id := range repo.List(ctx, restic.SnapshotFile) {
+		if !snapshots.Has(id) {
+			return nil, errors.Errorf("snapshot %v has been added", id.Str())
+		}
+	}
+
+	packs := restic.NewIDSet()
+	for id := range repo.List(ctx, restic.DataFile) {
+		packs.Insert(id)
+	}
+
+	for id := range s.remaining() {
+		if !packs.Has(id) {
+			return nil, errors.Errorf("pack %v is missing", id.Str())
+		}
+	}
+
+	return packs, nil
+}
+
+// openPruneState loads the state of an interrupted prune for repo. If there is
+// none or the state cannot be used any more, nil is returned. Otherwise the
+// packs in the repository are returned as well.
+func openPruneState(ctx context.Context, gopts GlobalOptions, repo *repository.Repository) (*pruneState, restic.IDSet, error) {
+	filename := pruneStateFilename(gopts, repo)
+	s, err := loadPruneState(filename)
+	if err != nil {
+		Warnf("ignoring state of interrupted prune in %v: %v\n", filename, err)
+		return nil, nil, fs.RemoveIfExists(filename)
+	}
+	if s == nil {
+		return nil, nil, nil
+	}
+
+	packs, err := s.check(ctx, repo)
+	if err != nil {
+		Verbosef("unable to resume interrupted prune (%v), starting over\n", err)
+		return nil, nil, s.remove()
+	}
+
+	debug.Log("resuming prune from %v, %d of %d packs done", filename, len(s.Done), len(s.Rewrite))
+	return s, packs, nil
+}
+
+// resumePrune continues the interrupted prune described by s, packs are the
+// packs in the repository.
+func resumePrune(ctx context.Context, opts PruneOptions, gopts GlobalOptions, repo *repository.Repository, progress *pruneProgress, s *pruneState, packs restic.IDSet) error {
+	Verbosef("resuming interrupted prune, %d of %d packs have been rewritten already\n",
+		len(s.Done), len(s.Rewrite))
+	progress.Skip(prunePhaseIndex)
+
+	snapshots, err := restic.LoadAllSnapshots(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	trashed, err := processTrash(ctx, repo, false)
+	if err != nil {
+		return err
+	}
+	snapshots = append(snapshots, trashed...)
+
+	usedBlobs, err := findUsedBlobs(ctx, gopts, repo, snapshots, progress)
+	if err != nil {
+		return err
+	}
+
+	// blobs which have been saved to new packs before the interruption or
+	// which are contained in packs that are kept need not be copied again
+	obsolete := restic.NewIDSet(s.Remove...)
+	obsolete.Merge(restic.NewIDSet(s.Rewrite...))
+	keepBlobs := restic.NewBlobSet()
+	for h := range usedBlobs {
+		// blobs which cannot be found are copied to be on the safe side
+		blobs, _ := repo.Index().Lookup(h.ID, h.Type)
+
+		kept := false
+		for _, pb := range blobs {
+			if !obsolete.Has(pb.PackID) {
+				kept = true
+				break
+			}
+		}
+
+		if !kept {
+			keepBlobs.Insert(h)
+		}
+	}
+
+	// the packs which have been rewritten before are removed together with
+	// the unneeded ones, unless the interrupted prune removed them already
+	removePacks := restic.NewIDSet()
+	for _, list := range []restic.IDs{s.Remove, s.Done} {
+		for _, id := range list {
+			if packs.Has(id) {
+				removePacks.Insert(id)
+			}
+		}
+	}
+
+	progress.summary.Resumed = true
+	progress.summary.Snapshots, progress.summary.UsedBlobs = len(snapshots), len(usedBlobs)
+	err = progress.plan(pruneJSONPlan{
+		DeletePacks:  len(removePacks),
+		RewritePacks: len(s.remaining()),
+		FreedBytes:   uint64(s.RemoveBytes),
+	})
+	if err != nil {
+		return err
+	}
+
+	return executePrune(ctx, opts, gopts, repo, progress, s, removePacks, s.remaining(), keepBlobs, s.RemoveBytes)
+}
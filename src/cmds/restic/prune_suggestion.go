@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"restic"
+	"restic/errors"
+	"restic/repository"
+)
+
+// pruneSuggestion describes the amount of unused data in a repository and
+// whether running prune is worthwhile.
+type pruneSuggestion struct {
+	TotalBytes    uint64  `json:"total_bytes"`
+	UnusedBytes   uint64  `json:"unused_bytes"`
+	UnusedPercent float64 `json:"unused_percent"`
+
+	// PruneSuggested is true when the unused data exceeds one of the
+	// configured thresholds.
+	PruneSuggested bool `json:"prune_suggested"`
+
+	// RemainingBytes is the amount of unused data which may accumulate until
+	// running prune is suggested.
+	RemainingBytes uint64 `json:"remaining_bytes"`
+}
+
+// countUnusedData returns the number of bytes stored in all packs and the
+// number of bytes which are not referenced by any snapshot. The index must be
+// loaded already.
+func countUnusedData(ctx context.Context, gopts GlobalOptions, repo *repository.Repository) (total, unused uint64, err error) {
+	total, err = countIndexedData(repo)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	usedBlobs, err := findAllUsedBlobs(ctx, gopts, repo)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var used uint64
+	for h := range usedBlobs {
+		blobs, err := repo.Index().Lookup(h.ID, h.Type)
+		if err != nil {
+			return 0, 0, err
+		}
+		used += uint64(blobs[0].Length)
+	}
+
+	if used > total {
+		used = total
+	}
+
+	return total, total - used, nil
+}
+
+// countIndexedData returns the number of bytes stored in all packs listed in
+// the index. The index must be loaded already.
+func countIndexedData(repo restic.Repository) (total uint64, err error) {
+	mi, ok := repo.Index().(*repository.MasterIndex)
+	if !ok {
+		return 0, errors.New("unable to list blobs in index")
+	}
+
+	seen := make(map[restic.PackedBlob]struct{})
+	for _, idx := range mi.All() {
+		for pb := range idx.Each(nil) {
+			if _, ok := seen[pb]; ok {
+				continue
+			}
+			seen[pb] = struct{}{}
+			total += uint64(pb.Length)
+		}
+	}
+
+	return total, nil
+}
+
+// findAllUsedBlobs returns the set of blobs referenced by any snapshot,
+// including the snapshots in the trash. The blob references cached by prune
+// are reused, so only the snapshots added since then are traversed.
+func findAllUsedBlobs(ctx context.Context, gopts GlobalOptions, repo *repository.Repository) (restic.BlobSet, error) {
+	snapshots, err := restic.LoadAllSnapshots(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	trashed, err := restic.LoadAllTrashedSnapshots(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range trashed {
+		snapshots = append(snapshots, t.Snapshot)
+	}
+
+	return findUsedBlobs(ctx, gopts, repo, snapshots, nil)
+}
+
+// newPruneSuggestion compares the amount of unused data against the
+// thresholds in cfg.
+func newPruneSuggestion(cfg *restic.PruneSuggestion, total, unused uint64) pruneSuggestion {
+	s := pruneSuggestion{
+		TotalBytes:  total,
+		UnusedBytes: unused,
+	}
+
+	if total > 0 {
+		s.UnusedPercent = 100 * float64(unused) / float64(total)
+	}
+
+	var limits []uint64
+	if cfg.MaxUnusedPercent > 0 {
+		limits = append(limits, total*uint64(cfg.MaxUnusedPercent)/100)
+	}
+	if cfg.MaxUnusedBytes > 0 {
+		limits = append(limits, cfg.MaxUnusedBytes)
+	}
+
+	for i, limit := range limits {
+		if unused >= limit {
+			s.PruneSuggested = true
+			s.RemainingBytes = 0
+			break
+		}
+
+		if i == 0 || limit-unused < s.RemainingBytes {
+			s.RemainingBytes = limit - unused
+		}
+	}
+
+	return s
+}
+
+// printPruneSuggestion checks the amount of unused data in the repository
+// and prints a suggestion whether prune should be run. Nothing is done when
+// no thresholds are configured in the repository config. Without a cache
+// directory all snapshots would have to be traversed after each backup, so
+// the check is skipped with a warning then.
+func printPruneSuggestion(ctx context.Context, gopts GlobalOptions, repo *repository.Repository) error {
+	cfg := repo.Config().PruneSuggestion
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	if gopts.CacheDir == "" {
+		Warnf("not checking the amount of unused data: this needs the blob references cached by prune, use --cache-dir or $RESTIC_CACHE_DIR to enable the check\n")
+		return nil
+	}
+
+	// the trees of other encryption domains can't be read
+	if repo.Key() == nil {
+		return nil
+	}
+
+	total, unused, err := countUnusedData(ctx, gopts, repo)
+	if err != nil {
+		return err
+	}
+
+	s := newPruneSuggestion(cfg, total, unused)
+
+	if gopts.JSONSchema > 0 {
+		return printJSONEvent(gopts, "prune_suggestion", s)
+	}
+
+	if gopts.JSON {
+		return json.NewEncoder(gopts.stdout).Encode(s)
+	}
+
+	Printf("repository contains %s of unused data (%.1f%% of %s)\n",
+		formatBytes(s.UnusedBytes), s.UnusedPercent, formatBytes(s.TotalBytes))
+	if s.PruneSuggested {
+		Printf("unused data exceeds the configured threshold, running `restic prune` is recommended\n")
+	} else {
+		Printf("running `restic prune` will be recommended after about %s of additional unused data\n",
+			formatBytes(s.RemainingBytes))
+	}
+
+	return nil
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package main
+
+import "restic/errors"
+
+// isRotational returns true if the file system path is located on is stored
+// on a rotating disk. This is only detected on Linux.
+func isRotational(path string) (bool, error) {
+	return false, errors.New("not supported on this platform")
+}
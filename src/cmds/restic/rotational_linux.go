@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"restic/errors"
+)
+
+// isRotational returns true if the file system path is located on is stored
+// on a rotating disk. This is read from the block device in sysfs.
+func isRotational(path string) (bool, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return false, errors.Wrap(err, "Stat")
+	}
+
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+
+	dir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		return false, errors.Wrap(err, "EvalSymlinks")
+	}
+
+	// partitions have no queue, the attribute is found at the disk
+	for _, d := range []string{dir, filepath.Dir(dir)} {
+		buf, err := ioutil.ReadFile(filepath.Join(d, "queue", "rotational"))
+		if err == nil {
+			return strings.TrimSpace(string(buf)) == "1", nil
+		}
+	}
+
+	return false, errors.Errorf("rotational attribute not found for device %d:%d", major, minor)
+}
@@ -0,0 +1,30 @@
+// +build !windows
+
+package main
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// getResourceUsage returns the CPU time used by the process so far and its
+// peak resident set size.
+func getResourceUsage() (resourceUsage, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return resourceUsage{}, err
+	}
+
+	// ru_maxrss is reported in kilobytes, except on macOS
+	maxRSS := uint64(ru.Maxrss)
+	if runtime.GOOS != "darwin" {
+		maxRSS *= 1024
+	}
+
+	return resourceUsage{
+		UserTime:   time.Duration(ru.Utime.Nano()),
+		SystemTime: time.Duration(ru.Stime.Nano()),
+		MaxRSS:     maxRSS,
+	}, nil
+}
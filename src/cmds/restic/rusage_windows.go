@@ -0,0 +1,31 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// filetimeDuration converts a duration returned by GetProcessTimes, which is
+// counted in 100 nanosecond intervals.
+func filetimeDuration(ft syscall.Filetime) time.Duration {
+	return time.Duration(uint64(ft.HighDateTime)<<32|uint64(ft.LowDateTime)) * 100
+}
+
+// getResourceUsage returns the CPU time used by the process so far. The peak
+// resident set size is not available on Windows.
+func getResourceUsage() (resourceUsage, error) {
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return resourceUsage{}, err
+	}
+
+	var creation, exit, kernel, user syscall.Filetime
+	if err = syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return resourceUsage{}, err
+	}
+
+	return resourceUsage{
+		UserTime:   filetimeDuration(user),
+		SystemTime: filetimeDuration(kernel),
+	}, nil
+}
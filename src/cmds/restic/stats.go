@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"restic"
+	"sync"
+	"time"
+
+	"restic/backend/counter"
+)
+
+// resourceUsage is the CPU time and memory used by the process.
+type resourceUsage struct {
+	UserTime   time.Duration
+	SystemTime time.Duration
+	MaxRSS     uint64
+}
+
+// runStats collects the resource usage and backend traffic of a single run
+// of a command, which is printed with --stats.
+type runStats struct {
+	command string
+	start   time.Time
+
+	m        sync.Mutex
+	backends []*counter.Backend
+}
+
+func newRunStats(command string) *runStats {
+	return &runStats{command: command, start: time.Now()}
+}
+
+// wrap returns a backend which counts the requests to be for the stats.
+// Nothing is done when s is nil.
+func (s *runStats) wrap(be restic.Backend) restic.Backend {
+	if s == nil {
+		return be
+	}
+
+	c := counter.New(be)
+
+	s.m.Lock()
+	s.backends = append(s.backends, c)
+	s.m.Unlock()
+
+	return c
+}
+
+// statsSummary is printed at the end of a command when --stats is set.
+type statsSummary struct {
+	Command          string  `json:"command"`
+	DurationSeconds  float64 `json:"duration_seconds"`
+	UserCPUSeconds   float64 `json:"user_cpu_seconds"`
+	SystemCPUSeconds float64 `json:"system_cpu_seconds"`
+	MaxRSSBytes      uint64  `json:"max_rss_bytes,omitempty"`
+	BackendRequests  uint64  `json:"backend_requests"`
+	BytesUploaded    uint64  `json:"bytes_uploaded"`
+	BytesDownloaded  uint64  `json:"bytes_downloaded"`
+}
+
+// summary returns the stats collected since the command was started.
+func (s *runStats) summary() (statsSummary, error) {
+	sum := statsSummary{
+		Command:         s.command,
+		DurationSeconds: time.Since(s.start).Seconds(),
+	}
+
+	ru, err := getResourceUsage()
+	if err != nil {
+		return sum, err
+	}
+	sum.UserCPUSeconds = ru.UserTime.Seconds()
+	sum.SystemCPUSeconds = ru.SystemTime.Seconds()
+	sum.MaxRSSBytes = ru.MaxRSS
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var traffic counter.Stats
+	for _, be := range s.backends {
+		traffic = traffic.Add(be.Stats())
+	}
+	sum.BackendRequests = traffic.Requests
+	sum.BytesUploaded = traffic.BytesUploaded
+	sum.BytesDownloaded = traffic.BytesDownloaded
+
+	return sum, nil
+}
+
+// WriteTo writes the summary in a human readable form to w.
+func (sum statsSummary) WriteTo(w io.Writer) (int64, error) {
+	maxRSS := "unknown"
+	if sum.MaxRSSBytes > 0 {
+		maxRSS = formatBytes(sum.MaxRSSBytes)
+	}
+
+	n, err := fmt.Fprintf(w, "\nstats for %s:\n"+
+		"  duration:          %.3fs\n"+
+		"  CPU time:          %.3fs user, %.3fs system\n"+
+		"  peak memory (RSS): %s\n"+
+		"  backend requests:  %d\n"+
+		"  uploaded:          %s\n"+
+		"  downloaded:        %s\n",
+		sum.Command,
+		sum.DurationSeconds,
+		sum.UserCPUSeconds, sum.SystemCPUSeconds,
+		maxRSS,
+		sum.BackendRequests,
+		formatBytes(sum.BytesUploaded),
+		formatBytes(sum.BytesDownloaded))
+	return int64(n), err
+}
+
+// printStats prints the stats collected for the command. With the versioned
+// JSON output, an event of type "stats" is printed to stdout. Otherwise the
+// stats are printed to stderr, so that the output of the command is kept
+// separate.
+func printStats(gopts GlobalOptions, s *runStats) error {
+	sum, err := s.summary()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case gopts.JSONSchema > 0:
+		return printJSONEvent(gopts, "stats", sum)
+	case gopts.JSON:
+		return json.NewEncoder(gopts.stderr).Encode(sum)
+	default:
+		_, err = sum.WriteTo(gopts.stderr)
+		return err
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"restic/backend/local"
+	"restic/backend/location"
+	"restic/errors"
+)
+
+// systemdCredential is the name under which the password file is passed to
+// the service with LoadCredential.
+const systemdCredential = "restic-password"
+
+// systemdQuote quotes s for a directive in a unit file. Specifiers like %h are
+// escaped, values with spaces or quotes are enclosed in double quotes.
+func systemdQuote(s string) string {
+	s = strings.Replace(s, "%", "%%", -1)
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// systemdExecArg quotes s as an argument for ExecStart, which in addition
+// expands environment variables.
+func systemdExecArg(s string) string {
+	return systemdQuote(strings.Replace(s, "$", "$$", -1))
+}
+
+// systemdUnitName returns the name of the units for the profile, without the
+// suffix.
+func systemdUnitName(p *Profile) string {
+	return "restic-" + p.Name
+}
+
+// localRepositoryPath returns the directory of the repository if it is stored
+// in the local file system, and "" otherwise.
+func localRepositoryPath(repo string) (string, error) {
+	loc, err := location.Parse(repo)
+	if err != nil {
+		return "", errors.Fatalf("invalid repository %q: %v", repo, err)
+	}
+
+	if loc.Scheme != "local" {
+		return "", nil
+	}
+
+	path := loc.Config.(local.Config).Path
+	if !filepath.IsAbs(path) {
+		return "", errors.Fatalf("the path of the local repository %q must be absolute", repo)
+	}
+	return path, nil
+}
+
+// systemdService returns the service unit which runs the backup for the
+// profile with the restic binary at binary.
+func systemdService(p *Profile, binary string) (string, error) {
+	repoPath, err := localRepositoryPath(p.Repository)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{systemdExecArg(binary), "--repo", systemdExecArg(p.Repository)}
+	switch {
+	case p.PasswordFile != "":
+		args = append(args, "--password-file", "${CREDENTIALS_DIRECTORY}/"+systemdCredential)
+	case p.PasswordCommand != "":
+		args = append(args, "--password-command", systemdExecArg(p.PasswordCommand))
+	}
+	args = append(args, "--cache-dir", "%C/restic", "backup")
+	for _, arg := range p.BackupArgs {
+		args = append(args, systemdExecArg(arg))
+	}
+	for _, path := range p.Paths {
+		args = append(args, systemdExecArg(path))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "# generated by \"restic generate systemd --profile %s\"\n", p.Name)
+	fmt.Fprintf(buf, "[Unit]\n")
+	fmt.Fprintf(buf, "Description=restic backup (profile %s)\n", p.Name)
+	fmt.Fprintf(buf, "Wants=network-online.target\n")
+	fmt.Fprintf(buf, "After=network-online.target\n")
+	if p.OnFailure != "" {
+		fmt.Fprintf(buf, "OnFailure=%s\n", p.OnFailure)
+	}
+
+	fmt.Fprintf(buf, "\n[Service]\n")
+	fmt.Fprintf(buf, "Type=oneshot\n")
+	if p.User != "" {
+		fmt.Fprintf(buf, "User=%s\n", systemdQuote(p.User))
+	}
+	if p.EnvironmentFile != "" {
+		fmt.Fprintf(buf, "EnvironmentFile=%s\n", systemdQuote(p.EnvironmentFile))
+	}
+	if p.PasswordFile != "" {
+		fmt.Fprintf(buf, "LoadCredential=%s:%s\n", systemdCredential, systemdQuote(p.PasswordFile))
+	}
+	fmt.Fprintf(buf, "ExecStart=%s\n", strings.Join(args, " "))
+	fmt.Fprintf(buf, "CacheDirectory=restic\n")
+	fmt.Fprintf(buf, "CacheDirectoryMode=0700\n")
+	fmt.Fprintf(buf, "Nice=19\n")
+	fmt.Fprintf(buf, "IOSchedulingClass=idle\n")
+
+	// An unprivileged user needs CAP_DAC_READ_SEARCH to read all files,
+	// root keeps its capabilities so that it can write to a local
+	// repository owned by another user.
+	if p.User != "" {
+		fmt.Fprintf(buf, "CapabilityBoundingSet=CAP_DAC_READ_SEARCH\n")
+		fmt.Fprintf(buf, "AmbientCapabilities=CAP_DAC_READ_SEARCH\n")
+	}
+
+	fmt.Fprintf(buf, "NoNewPrivileges=yes\n")
+	fmt.Fprintf(buf, "ProtectSystem=strict\n")
+	fmt.Fprintf(buf, "ProtectHome=read-only\n")
+	for _, dir := range append([]string{repoPath}, p.ReadWritePaths...) {
+		if dir != "" {
+			fmt.Fprintf(buf, "ReadWritePaths=%s\n", systemdQuote(dir))
+		}
+	}
+	fmt.Fprintf(buf, "PrivateTmp=yes\n")
+	fmt.Fprintf(buf, "PrivateDevices=yes\n")
+	fmt.Fprintf(buf, "ProtectKernelTunables=yes\n")
+	fmt.Fprintf(buf, "ProtectKernelModules=yes\n")
+	fmt.Fprintf(buf, "ProtectControlGroups=yes\n")
+	fmt.Fprintf(buf, "RestrictSUIDSGID=yes\n")
+	fmt.Fprintf(buf, "RestrictRealtime=yes\n")
+	fmt.Fprintf(buf, "RestrictNamespaces=yes\n")
+	fmt.Fprintf(buf, "LockPersonality=yes\n")
+	fmt.Fprintf(buf, "MemoryDenyWriteExecute=yes\n")
+
+	return buf.String(), nil
+}
+
+// systemdTimer returns the timer unit which starts the service for the
+// profile. Runs missed while the system was down are started after the next
+// boot.
+func systemdTimer(p *Profile) string {
+	schedule := p.Schedule
+	if schedule == "" {
+		schedule = "daily"
+	}
+
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "# generated by \"restic generate systemd --profile %s\"\n", p.Name)
+	fmt.Fprintf(buf, "[Unit]\n")
+	fmt.Fprintf(buf, "Description=restic backup (profile %s) schedule\n", p.Name)
+
+	fmt.Fprintf(buf, "\n[Timer]\n")
+	fmt.Fprintf(buf, "OnCalendar=%s\n", schedule)
+	fmt.Fprintf(buf, "Persistent=true\n")
+	if p.RandomizedDelay != "" {
+		// checked when the profile is loaded
+		d, _ := time.ParseDuration(p.RandomizedDelay)
+		fmt.Fprintf(buf, "RandomizedDelaySec=%d\n", int64(d/time.Second))
+	}
+
+	fmt.Fprintf(buf, "\n[Install]\n")
+	fmt.Fprintf(buf, "WantedBy=timers.target\n")
+
+	return buf.String()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "restic/test"
+)
+
+func TestSystemdQuote(t *testing.T) {
+	var tests = []struct {
+		arg, exec, value string
+	}{
+		{"/home/user", "/home/user", "/home/user"},
+		{"", `""`, `""`},
+		{"/srv/my files", `"/srv/my files"`, `"/srv/my files"`},
+		{"100%", "100%%", "100%%"},
+		{"$HOME", "$$HOME", "$HOME"},
+		{`say "hi"`, `"say \"hi\""`, `"say \"hi\""`},
+		{`C:\data`, `"C:\\data"`, `"C:\\data"`},
+		{";", `";"`, `";"`},
+	}
+
+	for _, test := range tests {
+		if s := systemdExecArg(test.arg); s != test.exec {
+			t.Errorf("systemdExecArg(%q): want %q, got %q", test.arg, test.exec, s)
+		}
+		if s := systemdQuote(test.arg); s != test.value {
+			t.Errorf("systemdQuote(%q): want %q, got %q", test.arg, test.value, s)
+		}
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	dir, cleanup := TempDir(t)
+	defer cleanup()
+
+	write := func(name, data string) {
+		OK(t, ioutil.WriteFile(filepath.Join(dir, name+".json"), []byte(data), 0600))
+	}
+
+	write("nightly", `{"repository": "/srv/restic", "password_file": "/etc/restic/pw", "paths": ["/home"]}`)
+	write("nopaths", `{"repository": "/srv/restic"}`)
+	write("twopasswords", `{"repository": "/srv/restic", "password_file": "/pw", "password_command": "pass restic", "paths": ["/home"]}`)
+	write("newline", `{"repository": "/srv/restic", "paths": ["/home\nExecStartPre=/bin/false"]}`)
+	write("delay", `{"repository": "/srv/restic", "paths": ["/home"], "randomized_delay": "often"}`)
+	write("broken", `{"repository": `)
+
+	p, err := loadProfile(dir, "nightly")
+	OK(t, err)
+	Equals(t, "nightly", p.Name)
+	Equals(t, "/srv/restic", p.Repository)
+	Equals(t, []string{"/home"}, p.Paths)
+
+	for _, name := range []string{"nopaths", "twopasswords", "newline", "delay", "broken", "missing", "../nightly", ".hidden"} {
+		if _, err := loadProfile(dir, name); err == nil {
+			t.Errorf("loading profile %q did not return an error", name)
+		}
+	}
+}
+
+func TestSystemdUnits(t *testing.T) {
+	p := &Profile{
+		Name:            "nightly",
+		Repository:      "/srv/restic repo",
+		PasswordFile:    "/etc/restic/nightly.password",
+		EnvironmentFile: "/etc/restic/nightly.env",
+		Paths:           []string{"/home", "/srv/100%"},
+		BackupArgs:      []string{"--exclude-caches"},
+		Schedule:        "*-*-* 02:00:00",
+		RandomizedDelay: "30m",
+		OnFailure:       "notify@%n.service",
+		User:            "backup",
+	}
+
+	service, err := systemdService(p, "/usr/local/bin/restic")
+	OK(t, err)
+
+	for _, line := range []string{
+		"OnFailure=notify@%n.service",
+		"Type=oneshot",
+		"User=backup",
+		"EnvironmentFile=/etc/restic/nightly.env",
+		"LoadCredential=restic-password:/etc/restic/nightly.password",
+		`ExecStart=/usr/local/bin/restic --repo "/srv/restic repo" --password-file ${CREDENTIALS_DIRECTORY}/restic-password --cache-dir %C/restic backup --exclude-caches /home /srv/100%%`,
+		"CacheDirectory=restic",
+		"AmbientCapabilities=CAP_DAC_READ_SEARCH",
+		"ProtectSystem=strict",
+		`ReadWritePaths="/srv/restic repo"`,
+		"NoNewPrivileges=yes",
+	} {
+		if !strings.Contains(service, "\n"+line+"\n") {
+			t.Errorf("line %q not found in service:\n%s", line, service)
+		}
+	}
+
+	timer := systemdTimer(p)
+	for _, line := range []string{
+		"OnCalendar=*-*-* 02:00:00",
+		"Persistent=true",
+		"RandomizedDelaySec=1800",
+		"WantedBy=timers.target",
+	} {
+		if !strings.Contains(timer, "\n"+line+"\n") {
+			t.Errorf("line %q not found in timer:\n%s", line, timer)
+		}
+	}
+
+	p.Repository = "relative/repo"
+	if _, err := systemdService(p, "/usr/local/bin/restic"); err == nil {
+		t.Errorf("relative path of local repository did not return an error")
+	}
+
+	p.Repository = "sftp:backup@example.com:/srv/restic"
+	service, err = systemdService(p, "/usr/local/bin/restic")
+	OK(t, err)
+	if strings.Contains(service, "ReadWritePaths=") {
+		t.Errorf("ReadWritePaths set for remote repository:\n%s", service)
+	}
+}
@@ -18,6 +18,13 @@ type Reader struct {
 
 	Tags     []string
 	Hostname string
+
+	// Time, if set, is recorded as the time of the snapshot and as the
+	// modification time of the file instead of the current time.
+	Time time.Time
+
+	// Parent, if set, is recorded as the parent of the new snapshot.
+	Parent *restic.ID
 }
 
 // Archive reads data from the reader and saves it to the repo.
@@ -31,52 +38,26 @@ func (r *Reader) Archive(ctx context.Context, name string, rd io.Reader, p *rest
 	if err != nil {
 		return nil, restic.ID{}, err
 	}
+	if !r.Time.IsZero() {
+		sn.Time = r.Time
+	}
+	sn.Parent = r.Parent
 
 	p.Start()
 	defer p.Done()
 
 	repo := r.Repository
-	chnker := chunker.New(rd, repo.Config().ChunkerPolynomial)
-
-	ids := restic.IDs{}
-	var fileSize uint64
-
-	for {
-		chunk, err := chnker.Next(getBuf())
-		if errors.Cause(err) == io.EOF {
-			break
-		}
-
-		if err != nil {
-			return nil, restic.ID{}, errors.Wrap(err, "chunker.Next()")
-		}
-
-		id := restic.Hash(chunk.Data)
-
-		if !repo.Index().Has(id, restic.DataBlob) {
-			_, err := repo.SaveBlob(ctx, restic.DataBlob, chunk.Data, id)
-			if err != nil {
-				return nil, restic.ID{}, err
-			}
-			debug.Log("saved blob %v (%d bytes)\n", id.Str(), chunk.Length)
-		} else {
-			debug.Log("blob %v already saved in the repo\n", id.Str())
-		}
-
-		freeBuf(chunk.Data)
-
-		ids = append(ids, id)
-
-		p.Report(restic.Stat{Bytes: uint64(chunk.Length)})
-		fileSize += uint64(chunk.Length)
+	ids, fileSize, err := saveContent(ctx, repo, rd, p)
+	if err != nil {
+		return nil, restic.ID{}, err
 	}
 
 	tree := &restic.Tree{
 		Nodes: []*restic.Node{
 			{
 				Name:       name,
-				AccessTime: time.Now(),
-				ModTime:    time.Now(),
+				AccessTime: sn.Time,
+				ModTime:    sn.Time,
 				Type:       "file",
 				Mode:       0644,
 				Size:       fileSize,
@@ -95,22 +76,66 @@ func (r *Reader) Archive(ctx context.Context, name string, rd io.Reader, p *rest
 	sn.Tree = &treeID
 	debug.Log("tree saved as %v", treeID.Str())
 
-	id, err := repo.SaveJSONUnpacked(ctx, restic.SnapshotFile, sn)
+	err = repo.Flush()
 	if err != nil {
 		return nil, restic.ID{}, err
 	}
 
-	debug.Log("snapshot saved as %v", id.Str())
-
-	err = repo.Flush()
+	err = repo.SaveIndex(ctx)
 	if err != nil {
 		return nil, restic.ID{}, err
 	}
 
-	err = repo.SaveIndex(ctx)
+	// the snapshot is saved last, so that it never references data which has
+	// not been uploaded yet
+	id, err := repo.SaveJSONUnpacked(ctx, restic.SnapshotFile, sn)
 	if err != nil {
 		return nil, restic.ID{}, err
 	}
 
+	debug.Log("snapshot saved as %v", id.Str())
+
 	return sn, id, nil
 }
+
+// saveContent splits the data read from rd into blobs and saves those not
+// yet stored in the repository. It returns the IDs of the blobs and the
+// number of bytes read.
+func saveContent(ctx context.Context, repo restic.Repository, rd io.Reader, p *restic.Progress) (restic.IDs, uint64, error) {
+	chnker := chunker.New(rd, repo.Config().ChunkerPolynomial)
+
+	ids := restic.IDs{}
+	var size uint64
+
+	for {
+		chunk, err := chnker.Next(getBuf())
+		if errors.Cause(err) == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "chunker.Next()")
+		}
+
+		id := restic.Hash(chunk.Data)
+
+		if !repo.Index().Has(id, restic.DataBlob) {
+			_, err := repo.SaveBlob(ctx, restic.DataBlob, chunk.Data, id)
+			if err != nil {
+				return nil, 0, err
+			}
+			debug.Log("saved blob %v (%d bytes)\n", id.Str(), chunk.Length)
+		} else {
+			debug.Log("blob %v already saved in the repo\n", id.Str())
+		}
+
+		freeBuf(chunk.Data)
+
+		ids = append(ids, id)
+
+		p.Report(restic.Stat{Bytes: uint64(chunk.Length)})
+		size += uint64(chunk.Length)
+	}
+
+	return ids, size, nil
+}
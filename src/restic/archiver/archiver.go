@@ -17,6 +17,7 @@ import (
 
 	"restic/debug"
 	"restic/fs"
+	"restic/limits"
 	"restic/pipe"
 
 	"github.com/restic/chunker"
@@ -40,18 +41,92 @@ type Archiver struct {
 		sync.Mutex
 	}
 
+	// linkedFiles holds the files with more than one link which have been
+	// saved, so the content of each inode is only read once.
+	linkedFiles struct {
+		m map[inodeID]*restic.Node
+		sync.Mutex
+	}
+
 	blobToken chan struct{}
 
 	Warn         func(dir string, fi os.FileInfo, err error)
 	SelectFilter pipe.SelectFunc
 	Excludes     []string
+
+	// Selection is recorded in the snapshot, it describes the options
+	// besides Excludes which are used by SelectFilter.
+	Selection []string
+
+	// ChangeDetector, if set, is used to find directories which have not
+	// changed since the parent snapshot. Their trees are taken from the
+	// parent snapshot without reading the directories.
+	ChangeDetector ChangeDetector
+
+	// SnapshotPaths, if set, is recorded as the list of paths in the
+	// snapshot instead of the paths which are read.
+	SnapshotPaths []string
+
+	// SkipIfUnchanged makes Snapshot return ErrUnchanged instead of saving a
+	// new snapshot if nothing but access times changed since the parent
+	// snapshot.
+	SkipIfUnchanged bool
+
+	// Change selects the attributes of a file which are compared with the
+	// parent snapshot to decide whether the file needs to be read again.
+	Change restic.ChangeOptions
+
+	// DryRun makes Snapshot read the files as usual, but nothing is saved to
+	// the repository. What would have been saved is returned by DryRunStats.
+	DryRun bool
+	dryRun dryRunStats
+
+	// Metadata selects which metadata is saved for files and directories.
+	Metadata restic.NodeOptions
+
+	// Time, if set, is recorded as the time of the snapshot instead of the
+	// current time.
+	Time time.Time
+
+	// CheckpointInterval, if set, is the interval in which a checkpoint
+	// snapshot with all files and directories saved so far is written. An
+	// interrupted backup uses it as the parent when it is restarted, so the
+	// files are not read again.
+	CheckpointInterval time.Duration
+
+	// ReadConcurrency, if set, is the number of files which are read in
+	// parallel. The default is suited for SSDs, on rotating disks reading
+	// fewer files at once avoids seeking back and forth.
+	ReadConcurrency int
+
+	// TimeLimit, if set, is the time after which no more files are read.
+	// Instead of the snapshot, a partial snapshot with all files saved until
+	// then is stored and Snapshot returns ErrTimeLimit.
+	TimeLimit time.Duration
+	deadline  time.Time
+
+	// ChangedFileRetries is the number of times a file which changed while
+	// it was read is read again. If it still changes, the content read last
+	// is saved and the node is marked as inconsistent.
+	ChangedFileRetries int
+	inconsistent       []string
+	inconsistentM      sync.Mutex
+
+	// blobLock is held for reading while blobs are saved, and for writing
+	// while a checkpoint is saved.
+	blobLock   sync.RWMutex
+	checkpoint *checkpointState
 }
 
+// ErrUnchanged is returned by Snapshot if SkipIfUnchanged is set and nothing
+// changed since the parent snapshot.
+var ErrUnchanged = errors.New("nothing changed since the parent snapshot")
+
 // New returns a new archiver.
 func New(repo restic.Repository) *Archiver {
 	arch := &Archiver{
 		repo:      repo,
-		blobToken: make(chan struct{}, maxConcurrentBlobs),
+		blobToken: make(chan struct{}, limits.BlobsInFlight(maxConcurrentBlobs)),
 		knownBlobs: struct {
 			restic.IDSet
 			sync.Mutex
@@ -59,8 +134,9 @@ func New(repo restic.Repository) *Archiver {
 			IDSet: restic.NewIDSet(),
 		},
 	}
+	arch.linkedFiles.m = make(map[inodeID]*restic.Node)
 
-	for i := 0; i < maxConcurrentBlobs; i++ {
+	for i := 0; i < cap(arch.blobToken); i++ {
 		arch.blobToken <- struct{}{}
 	}
 
@@ -92,16 +168,52 @@ func (arch *Archiver) isKnownBlob(id restic.ID, t restic.BlobType) bool {
 	return false
 }
 
+// inodeID identifies a file on a device.
+type inodeID struct {
+	device, inode uint64
+}
+
+// linkedFile returns another link to the same inode as node which has been
+// saved already. Its content is only used if the size and the modification
+// time are the same.
+func (arch *Archiver) linkedFile(node *restic.Node) (*restic.Node, bool) {
+	arch.linkedFiles.Lock()
+	defer arch.linkedFiles.Unlock()
+
+	other, ok := arch.linkedFiles.m[inodeID{node.DeviceID, node.Inode}]
+	if !ok || other.Size != node.Size || !other.ModTime.Equal(node.ModTime) {
+		return nil, false
+	}
+
+	return other, true
+}
+
+// addLinkedFile remembers the content of node if the file has more than one
+// link. The content of files which changed while they were read is not reused.
+func (arch *Archiver) addLinkedFile(node *restic.Node) {
+	if node.Links <= 1 || node.Inode == 0 || node.Inconsistent {
+		return
+	}
+
+	arch.linkedFiles.Lock()
+	defer arch.linkedFiles.Unlock()
+
+	arch.linkedFiles.m[inodeID{node.DeviceID, node.Inode}] = node
+}
+
 // Save stores a blob read from rd in the repository.
 func (arch *Archiver) Save(ctx context.Context, t restic.BlobType, data []byte, id restic.ID) error {
 	debug.Log("Save(%v, %v)\n", t, id.Str())
 
+	arch.blobLock.RLock()
+	defer arch.blobLock.RUnlock()
+
 	if arch.isKnownBlob(id, restic.DataBlob) {
 		debug.Log("blob %v is known\n", id.Str())
 		return nil
 	}
 
-	_, err := arch.repo.SaveBlob(ctx, t, data, id)
+	_, err := arch.saveBlob(ctx, t, data, id)
 	if err != nil {
 		debug.Log("Save(%v, %v): error %v\n", t, id.Str(), err)
 		return err
@@ -113,6 +225,24 @@ func (arch *Archiver) Save(ctx context.Context, t restic.BlobType, data []byte,
 
 // SaveTreeJSON stores a tree in the repository.
 func (arch *Archiver) SaveTreeJSON(ctx context.Context, tree *restic.Tree) (restic.ID, error) {
+	arch.blobLock.RLock()
+	defer arch.blobLock.RUnlock()
+
+	return arch.saveTreeJSON(ctx, tree)
+}
+
+func (arch *Archiver) saveTreeJSON(ctx context.Context, tree *restic.Tree) (restic.ID, error) {
+	err := restic.SaveContentLists(arch.repo.Config(), tree, func(id restic.ID, buf []byte) error {
+		if arch.isKnownBlob(id, restic.TreeBlob) {
+			return nil
+		}
+		_, err := arch.saveBlob(ctx, restic.TreeBlob, buf, id)
+		return err
+	})
+	if err != nil {
+		return restic.ID{}, err
+	}
+
 	data, err := json.Marshal(tree)
 	if err != nil {
 		return restic.ID{}, errors.Wrap(err, "Marshal")
@@ -125,7 +255,24 @@ func (arch *Archiver) SaveTreeJSON(ctx context.Context, tree *restic.Tree) (rest
 		return id, nil
 	}
 
-	return arch.repo.SaveBlob(ctx, restic.TreeBlob, data, id)
+	return arch.saveBlob(ctx, restic.TreeBlob, data, id)
+}
+
+// saveBlob stores a blob which is not in the repository yet. With DryRun, the
+// blob is only counted.
+func (arch *Archiver) saveBlob(ctx context.Context, t restic.BlobType, data []byte, id restic.ID) (restic.ID, error) {
+	if arch.DryRun {
+		arch.dryRun.blob(t, len(data))
+		return id, nil
+	}
+
+	return arch.repo.SaveBlob(ctx, t, data, id)
+}
+
+// nodeFromFileInfo returns a new node for the file, with the metadata selected
+// by arch.Metadata.
+func (arch *Archiver) nodeFromFileInfo(path string, fi os.FileInfo) (*restic.Node, error) {
+	return restic.NodeFromFileInfoWithOptions(path, fi, arch.Metadata)
 }
 
 func (arch *Archiver) reloadFileIfChanged(node *restic.Node, file fs.File) (*restic.Node, error) {
@@ -134,13 +281,15 @@ func (arch *Archiver) reloadFileIfChanged(node *restic.Node, file fs.File) (*res
 		return nil, errors.Wrap(err, "restic.Stat")
 	}
 
-	if fi.ModTime() == node.ModTime {
+	// the node has just been created from the same file, so the skew allowed
+	// when comparing with the parent snapshot does not apply
+	if fi.ModTime().Equal(node.ModTime) {
 		return node, nil
 	}
 
 	arch.Warn(node.Path, fi, errors.New("file has changed"))
 
-	node, err = restic.NodeFromFileInfo(node.Path, fi)
+	node, err = arch.nodeFromFileInfo(node.Path, fi)
 	if err != nil {
 		debug.Log("restic.NodeFromFileInfo returned error for %v: %v", node.Path, err)
 		arch.Warn(node.Path, fi, err)
@@ -206,7 +355,9 @@ func updateNodeContent(node *restic.Node, results []saveResult) error {
 }
 
 // SaveFile stores the content of the file on the backend as a Blob by calling
-// Save for each chunk.
+// Save for each chunk. If the file changes while it is read, it is read again
+// up to ChangedFileRetries times. If it still changes, the content read last
+// is saved and the node is marked as inconsistent.
 func (arch *Archiver) SaveFile(ctx context.Context, p *restic.Progress, node *restic.Node) (*restic.Node, error) {
 	file, err := fs.Open(node.Path)
 	defer file.Close()
@@ -221,6 +372,62 @@ func (arch *Archiver) SaveFile(ctx context.Context, p *restic.Progress, node *re
 		return node, err
 	}
 
+	for attempt := 0; ; attempt++ {
+		before, err := file.Stat()
+		if err != nil {
+			return node, errors.Wrap(err, "Stat")
+		}
+
+		node.Sparse, err = fs.HasHoles(file)
+		if err != nil {
+			return node, err
+		}
+
+		results, err := arch.saveFileContent(ctx, p, file)
+		if err != nil {
+			return node, err
+		}
+
+		debug.RunHook("archiver.SaveFile.read", node.Path)
+
+		fi, err := file.Stat()
+		if err != nil {
+			return node, errors.Wrap(err, "Stat")
+		}
+
+		if fi.Size() == before.Size() && fi.ModTime().Equal(before.ModTime()) {
+			return node, updateNodeContent(node, results)
+		}
+
+		if attempt >= arch.ChangedFileRetries {
+			arch.Warn(node.Path, fi, errors.New("file changed while it was read, the saved content may be inconsistent"))
+			arch.addInconsistent(node.Path)
+
+			node.Inconsistent = true
+			node.Size = 0
+			for _, res := range results {
+				node.Size += res.bytes
+			}
+			return node, updateNodeContent(node, results)
+		}
+
+		debug.Log("%v changed while it was read, reading it again", node.Path)
+
+		path := node.Path
+		node, err = arch.nodeFromFileInfo(path, fi)
+		if err != nil {
+			debug.Log("restic.NodeFromFileInfo returned error for %v: %v", path, err)
+			arch.Warn(path, fi, err)
+		}
+
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return node, errors.Wrap(err, "Seek")
+		}
+	}
+}
+
+// saveFileContent splits the file into chunks and saves them.
+func (arch *Archiver) saveFileContent(ctx context.Context, p *restic.Progress, file fs.File) ([]saveResult, error) {
 	chnker := chunker.New(file, arch.repo.Config().ChunkerPolynomial)
 	resultChannels := [](<-chan saveResult){}
 
@@ -231,7 +438,7 @@ func (arch *Archiver) SaveFile(ctx context.Context, p *restic.Progress, node *re
 		}
 
 		if err != nil {
-			return node, errors.Wrap(err, "chunker.Next")
+			return nil, errors.Wrap(err, "chunker.Next")
 		}
 
 		resCh := make(chan saveResult, 1)
@@ -239,13 +446,24 @@ func (arch *Archiver) SaveFile(ctx context.Context, p *restic.Progress, node *re
 		resultChannels = append(resultChannels, resCh)
 	}
 
-	results, err := waitForResults(resultChannels)
-	if err != nil {
-		return node, err
-	}
-	err = updateNodeContent(node, results)
+	return waitForResults(resultChannels)
+}
+
+// addInconsistent records that the file at path changed while it was read.
+func (arch *Archiver) addInconsistent(path string) {
+	arch.inconsistentM.Lock()
+	arch.inconsistent = append(arch.inconsistent, path)
+	arch.inconsistentM.Unlock()
+}
+
+// InconsistentFiles returns the paths of the files which changed while they
+// were read during the last call to Snapshot, even after reading them again.
+// Their content in the snapshot may be inconsistent.
+func (arch *Archiver) InconsistentFiles() []string {
+	arch.inconsistentM.Lock()
+	defer arch.inconsistentM.Unlock()
 
-	return node, err
+	return append([]string(nil), arch.inconsistent...)
 }
 
 func (arch *Archiver) fileWorker(ctx context.Context, wg *sync.WaitGroup, p *restic.Progress, entCh <-chan pipe.Entry) {
@@ -274,7 +492,7 @@ func (arch *Archiver) fileWorker(ctx context.Context, wg *sync.WaitGroup, p *res
 				continue
 			}
 
-			node, err := restic.NodeFromFileInfo(e.Fullpath(), e.Info())
+			node, err := arch.nodeFromFileInfo(e.Fullpath(), e.Info())
 			if err != nil {
 				debug.Log("restic.NodeFromFileInfo returned error for %v: %v", node.Path, err)
 				arch.Warn(e.Fullpath(), e.Info(), err)
@@ -295,15 +513,34 @@ func (arch *Archiver) fileWorker(ctx context.Context, wg *sync.WaitGroup, p *res
 					}
 				}
 
-				if !contentMissing {
+				// the content of files which changed while they were read is
+				// never reused
+				if !contentMissing && !oldNode.Inconsistent {
 					node.Content = oldNode.Content
+					node.Sparse = oldNode.Sparse
 					debug.Log("   %v content is complete", e.Path())
 				}
 			} else {
 				debug.Log("   %v no old data", e.Path())
 			}
 
-			// otherwise read file normally
+			// another link to the same file may have been saved already
+			if node.Type == "file" && len(node.Content) == 0 && node.Links > 1 {
+				if other, ok := arch.linkedFile(node); ok {
+					debug.Log("   %v use data of hard link", e.Path())
+					node.Content = other.Content
+					node.Sparse = other.Sparse
+				}
+			}
+
+			// otherwise read file normally, unless the time limit has been
+			// reached
+			if node.Type == "file" && len(node.Content) == 0 && arch.timeLimitReached() {
+				debug.Log("   time limit reached, skipping %v", e.Path())
+				e.Result() <- skippedResult{}
+				continue
+			}
+
 			if node.Type == "file" && len(node.Content) == 0 {
 				debug.Log("   read and save %v", e.Path())
 				node, err = arch.SaveFile(ctx, p, node)
@@ -315,12 +552,22 @@ func (arch *Archiver) fileWorker(ctx context.Context, wg *sync.WaitGroup, p *res
 					p.Report(restic.Stat{Errors: 1})
 					continue
 				}
+
+				if arch.DryRun {
+					arch.dryRun.file(node.Size, true)
+				}
 			} else {
 				// report old data size
 				p.Report(restic.Stat{Bytes: node.Size})
+
+				if arch.DryRun && node.Type == "file" {
+					arch.dryRun.file(node.Size, false)
+				}
 			}
 
 			debug.Log("   processed %v, %d blobs", e.Path(), len(node.Content))
+			arch.addLinkedFile(node)
+			arch.checkpoint.add(e.Path(), node)
 			e.Result() <- node
 			p.Report(restic.Stat{Files: 1})
 		case <-ctx.Done():
@@ -353,7 +600,25 @@ func (arch *Archiver) dirWorker(ctx context.Context, wg *sync.WaitGroup, p *rest
 				continue
 			}
 
+			// reuse the tree of unchanged directories
+			if dir.Node != nil {
+				oldNode := dir.Node.(*restic.Node)
+				debug.Log("dir %v is unchanged, using old tree %v", dir.Path(), oldNode.Subtree.Str())
+
+				node, err := arch.nodeFromFileInfo(dir.Fullpath(), dir.Info())
+				if err != nil {
+					arch.Warn(dir.Path(), dir.Info(), err)
+				}
+				node.Subtree = oldNode.Subtree
+
+				arch.checkpoint.complete(dir.Path(), node, nil)
+				dir.Result() <- node
+				p.Report(restic.Stat{Dirs: 1})
+				continue
+			}
+
 			tree := restic.NewTree()
+			incomplete := false
 
 			// wait for all content
 			for _, ch := range dir.Entries {
@@ -367,6 +632,11 @@ func (arch *Archiver) dirWorker(ctx context.Context, wg *sync.WaitGroup, p *rest
 					continue
 				}
 
+				if isSkipped(res) {
+					incomplete = true
+					continue
+				}
+
 				// else insert node
 				node := res.(*restic.Node)
 
@@ -385,10 +655,18 @@ func (arch *Archiver) dirWorker(ctx context.Context, wg *sync.WaitGroup, p *rest
 				tree.Insert(node)
 			}
 
+			// the entries which have been saved are kept in the checkpoint,
+			// but the directory itself is not complete
+			if incomplete {
+				debug.Log("dir %v is incomplete, the time limit has been reached", dir.Path())
+				dir.Result() <- skippedResult{}
+				continue
+			}
+
 			node := &restic.Node{}
 
 			if dir.Path() != "" && dir.Info() != nil {
-				n, err := restic.NodeFromFileInfo(dir.Fullpath(), dir.Info())
+				n, err := arch.nodeFromFileInfo(dir.Fullpath(), dir.Info())
 				if err != nil {
 					arch.Warn(dir.Path(), dir.Info(), err)
 				}
@@ -412,6 +690,7 @@ func (arch *Archiver) dirWorker(ctx context.Context, wg *sync.WaitGroup, p *rest
 
 			debug.Log("sending result to %v", dir.Result())
 
+			arch.checkpoint.complete(dir.Path(), node, tree)
 			dir.Result() <- node
 			if dir.Path() != "" {
 				p.Report(restic.Stat{Dirs: 1})
@@ -424,8 +703,9 @@ func (arch *Archiver) dirWorker(ctx context.Context, wg *sync.WaitGroup, p *rest
 }
 
 type archivePipe struct {
-	Old <-chan walk.TreeJob
-	New <-chan pipe.Job
+	Old    <-chan walk.TreeJob
+	New    <-chan pipe.Job
+	Change restic.ChangeOptions
 }
 
 func copyJobs(ctx context.Context, in <-chan pipe.Job, out chan<- pipe.Job) {
@@ -461,6 +741,7 @@ type archiveJob struct {
 	hasOld bool
 	old    walk.TreeJob
 	new    pipe.Job
+	change restic.ChangeOptions
 }
 
 func (a *archivePipe) compare(ctx context.Context, out chan<- pipe.Job) {
@@ -521,7 +802,7 @@ func (a *archivePipe) compare(ctx context.Context, out chan<- pipe.Job) {
 			debug.Log("    same filename %q", file1)
 
 			// send job
-			out <- archiveJob{hasOld: true, old: oldJob, new: newJob}.Copy()
+			out <- archiveJob{hasOld: true, old: oldJob, new: newJob, change: a.Change}.Copy()
 			loadOld = true
 			loadNew = true
 			continue
@@ -567,7 +848,7 @@ func (j archiveJob) Copy() pipe.Job {
 		}
 
 		// if file is newer, return the new job
-		if j.old.Node.IsNewer(j.new.Fullpath(), j.new.Info()) {
+		if j.old.Node.IsNewer(j.new.Fullpath(), j.new.Info(), j.change) {
 			debug.Log("   job %v is newer", j.new.Path())
 			return j.new
 		}
@@ -585,13 +866,22 @@ func (j archiveJob) Copy() pipe.Job {
 
 const saveIndexTime = 30 * time.Second
 
-// saveIndexes regularly queries the master index for full indexes and saves them.
+// saveIndexes regularly queries the master index for full indexes and saves
+// them. If checkpoints are enabled, they are saved here as well, so that they
+// never run concurrently with saving the full indexes.
 func (arch *Archiver) saveIndexes(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	ticker := time.NewTicker(saveIndexTime)
 	defer ticker.Stop()
 
+	var checkpoints <-chan time.Time
+	if arch.checkpoint != nil && arch.CheckpointInterval > 0 {
+		t := time.NewTicker(arch.CheckpointInterval)
+		defer t.Stop()
+		checkpoints = t.C
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -603,6 +893,13 @@ func (arch *Archiver) saveIndexes(ctx context.Context, wg *sync.WaitGroup) {
 				debug.Log("save indexes returned an error: %v", err)
 				fmt.Fprintf(os.Stderr, "error saving preliminary index: %v\n", err)
 			}
+		case <-checkpoints:
+			debug.Log("saving checkpoint")
+			err := arch.saveCheckpoint(ctx)
+			if err != nil {
+				debug.Log("save checkpoint returned an error: %v", err)
+				fmt.Fprintf(os.Stderr, "error saving checkpoint: %v\n", err)
+			}
 		}
 	}
 }
@@ -649,25 +946,60 @@ func (arch *Archiver) Snapshot(ctx context.Context, p *restic.Progress, paths, t
 	p.Start()
 	defer p.Done()
 
+	snapshotPaths := paths
+	if arch.SnapshotPaths != nil {
+		snapshotPaths = arch.SnapshotPaths
+	}
+
 	// create new snapshot
-	sn, err := restic.NewSnapshot(paths, tags, hostname)
+	sn, err := restic.NewSnapshot(snapshotPaths, tags, hostname)
 	if err != nil {
 		return nil, restic.ID{}, err
 	}
 	sn.Excludes = arch.Excludes
+	sn.Selection = arch.Selection
+	if !arch.Time.IsZero() {
+		sn.Time = arch.Time
+	}
+
+	arch.dryRun.m.Lock()
+	arch.dryRun.DryRunStats = DryRunStats{}
+	arch.dryRun.m.Unlock()
+
+	jobs := archivePipe{Change: arch.Change}
 
-	jobs := archivePipe{}
+	var (
+		unchanged pipe.UnchangedFunc
+		parent    *restic.Snapshot
+	)
 
 	// use parent snapshot (if some was given)
 	if parentID != nil {
 		sn.Parent = parentID
 
 		// load parent snapshot
-		parent, err := restic.LoadSnapshot(ctx, arch.repo, *parentID)
+		parent, err = restic.LoadSnapshot(ctx, arch.repo, *parentID)
 		if err != nil {
 			return nil, restic.ID{}, err
 		}
 
+		// a checkpoint is only recorded as the parent of the interrupted
+		// backup
+		if parent.Checkpoint {
+			debug.Log("parent %v is a checkpoint", parentID.Str())
+			sn.Parent = parent.Parent
+		}
+
+		// the trees of incomplete directories in a checkpoint or a partial
+		// snapshot are partial, so directories must not be taken from it
+		// without reading them
+		if arch.ChangeDetector != nil && !parent.Checkpoint && !parent.Partial {
+			unchanged, err = arch.findUnchanged(ctx, parent, paths)
+			if err != nil {
+				return nil, restic.ID{}, err
+			}
+		}
+
 		// start walker on old tree
 		ch := make(chan walk.TreeJob)
 		go walk.Tree(ctx, arch.repo, *parent.Tree, ch)
@@ -679,11 +1011,29 @@ func (arch *Archiver) Snapshot(ctx context.Context, p *restic.Progress, paths, t
 		jobs.Old = ch
 	}
 
+	// the checkpoint state is also needed to save the partial snapshot when
+	// the time limit is reached
+	if arch.CheckpointInterval > 0 || arch.TimeLimit > 0 {
+		arch.checkpoint = newCheckpointState(sn)
+		defer func() {
+			arch.checkpoint = nil
+		}()
+	}
+
+	arch.inconsistentM.Lock()
+	arch.inconsistent = nil
+	arch.inconsistentM.Unlock()
+
+	arch.deadline = time.Time{}
+	if arch.TimeLimit > 0 {
+		arch.deadline = time.Now().Add(arch.TimeLimit)
+	}
+
 	// start walker
 	pipeCh := make(chan pipe.Job)
 	resCh := make(chan pipe.Result, 1)
 	go func() {
-		pipe.Walk(ctx, paths, arch.SelectFilter, pipeCh, resCh)
+		pipe.WalkUnchanged(ctx, paths, arch.SelectFilter, unchanged, pipeCh, resCh)
 		debug.Log("pipe.Walk done")
 	}()
 	jobs.New = pipeCh
@@ -705,18 +1055,29 @@ func (arch *Archiver) Snapshot(ctx context.Context, p *restic.Progress, paths, t
 		wg.Done()
 	}()
 
+	readers := maxConcurrency
+	if arch.ReadConcurrency > 0 {
+		readers = arch.ReadConcurrency
+	}
+
 	// run workers
-	for i := 0; i < maxConcurrency; i++ {
-		wg.Add(2)
+	for i := 0; i < limits.Workers(readers); i++ {
+		wg.Add(1)
 		go arch.fileWorker(ctx, &wg, p, entCh)
+	}
+
+	for i := 0; i < limits.Workers(maxConcurrency); i++ {
+		wg.Add(1)
 		go arch.dirWorker(ctx, &wg, p, dirCh)
 	}
 
 	// run index saver
 	var wgIndexSaver sync.WaitGroup
 	indexCtx, indexCancel := context.WithCancel(ctx)
-	wgIndexSaver.Add(1)
-	go arch.saveIndexes(indexCtx, &wgIndexSaver)
+	if !arch.DryRun {
+		wgIndexSaver.Add(1)
+		go arch.saveIndexes(indexCtx, &wgIndexSaver)
+	}
 
 	// wait for all workers to terminate
 	debug.Log("wait for workers")
@@ -734,11 +1095,25 @@ func (arch *Archiver) Snapshot(ctx context.Context, p *restic.Progress, paths, t
 		return nil, restic.ID{}, err
 	}
 
-	// receive the top-level tree
-	root := (<-resCh).(*restic.Node)
+	// receive the top-level tree, it is incomplete if the time limit has been
+	// reached
+	res := <-resCh
+	if isSkipped(res) {
+		if arch.DryRun {
+			return nil, restic.ID{}, ErrTimeLimit
+		}
+		return arch.savePartialSnapshot(ctx, sn)
+	}
+
+	root := res.(*restic.Node)
 	debug.Log("root node received: %v", root.Subtree.Str())
 	sn.Tree = root.Subtree
 
+	if arch.DryRun {
+		debug.Log("dry run, not saving the snapshot")
+		return sn, restic.ID{}, nil
+	}
+
 	// load top-level tree again to see if it is empty
 	toptree, err := arch.repo.LoadTree(ctx, *root.Subtree)
 	if err != nil {
@@ -758,7 +1133,21 @@ func (arch *Archiver) Snapshot(ctx context.Context, p *restic.Progress, paths, t
 
 	debug.Log("saved indexes")
 
-	// save snapshot
+	if arch.SkipIfUnchanged && parent != nil && sameSnapshotInfo(parent, sn) {
+		same, err := arch.sameTree(ctx, *parent.Tree, *sn.Tree)
+		if err != nil {
+			return nil, restic.ID{}, err
+		}
+
+		if same {
+			debug.Log("nothing changed since parent snapshot %v", parentID.Str())
+			return parent, *parentID, ErrUnchanged
+		}
+	}
+
+	// save snapshot, this is done after all packs and the index have been
+	// uploaded, so that the snapshot never references data which is missing
+	// in the repository
 	id, err := arch.repo.SaveJSONUnpacked(ctx, restic.SnapshotFile, sn)
 	if err != nil {
 		return nil, restic.ID{}, err
@@ -766,9 +1155,165 @@ func (arch *Archiver) Snapshot(ctx context.Context, p *restic.Progress, paths, t
 
 	debug.Log("saved snapshot %v", id.Str())
 
+	if (arch.checkpoint != nil && arch.checkpoint.last != nil) || (parent != nil && parent.Checkpoint) {
+		// the snapshot has been saved, so this is not an error for the backup
+		if err = arch.removeCheckpoints(ctx, sn); err != nil {
+			debug.Log("removing checkpoints returned an error: %v", err)
+			fmt.Fprintf(os.Stderr, "error removing checkpoints: %v\n", err)
+		}
+	}
+
 	return sn, id, nil
 }
 
+// findUnchanged returns a function which returns the node from the parent
+// snapshot for all directories the change detector reports as unchanged. Only
+// the trees of changed directories in the parent snapshot are loaded. If the
+// parent snapshot was taken with different exclude patterns or other options
+// which select the files, nil is returned.
+func (arch *Archiver) findUnchanged(ctx context.Context, parent *restic.Snapshot, paths []string) (pipe.UnchangedFunc, error) {
+	if !sameStrings(parent.Excludes, arch.Excludes) {
+		debug.Log("exclude patterns differ from the parent snapshot, not using the change detector")
+		return nil, nil
+	}
+
+	if !sameStrings(parent.Selection, arch.Selection) {
+		debug.Log("selection options differ from the parent snapshot, not using the change detector")
+		return nil, nil
+	}
+
+	tree, err := arch.repo.LoadTree(ctx, *parent.Tree)
+	if err != nil {
+		return nil, err
+	}
+
+	// the parent snapshot stores the paths by their base name
+	fullpaths := make(map[string]string, len(paths))
+	for _, p := range paths {
+		if _, ok := fullpaths[filepath.Base(p)]; ok {
+			// the base name is ambiguous
+			fullpaths[filepath.Base(p)] = ""
+			continue
+		}
+		fullpaths[filepath.Base(p)] = p
+	}
+
+	nodes := make(map[string]*restic.Node)
+	for _, node := range tree.Nodes {
+		p := fullpaths[node.Name]
+		if p == "" {
+			continue
+		}
+
+		err = arch.findUnchangedNodes(ctx, node, node.Name, p, nodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	debug.Log("%d unchanged directories found", len(nodes))
+
+	return func(path string) interface{} {
+		if node, ok := nodes[path]; ok {
+			return node
+		}
+		return nil
+	}, nil
+}
+
+// findUnchangedNodes adds node to nodes if the directory is unchanged, and
+// otherwise checks all subdirectories.
+func (arch *Archiver) findUnchangedNodes(ctx context.Context, node *restic.Node, path, fullpath string, nodes map[string]*restic.Node) error {
+	if node.Type != "dir" || node.Subtree == nil {
+		return nil
+	}
+
+	if arch.ChangeDetector.Unchanged(fullpath) && arch.repo.Index().Has(*node.Subtree, restic.TreeBlob) {
+		nodes[path] = node
+		return nil
+	}
+
+	tree, err := arch.repo.LoadTree(ctx, *node.Subtree)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range tree.Nodes {
+		err = arch.findUnchangedNodes(ctx, n, filepath.Join(path, n.Name), filepath.Join(fullpath, n.Name), nodes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sameSnapshotInfo returns true if the snapshots a and b have the same
+// paths, tags, host name and exclude patterns.
+func sameSnapshotInfo(a, b *restic.Snapshot) bool {
+	return a.Hostname == b.Hostname &&
+		sameStrings(a.Paths, b.Paths) &&
+		sameStrings(a.Tags, b.Tags) &&
+		sameStrings(a.Excludes, b.Excludes)
+}
+
+// sameTree returns true if the trees a and b only differ in the access times
+// of the nodes they contain. Only subtrees with different IDs are loaded.
+func (arch *Archiver) sameTree(ctx context.Context, a, b restic.ID) (bool, error) {
+	if a.Equal(b) {
+		return true, nil
+	}
+
+	treeA, err := arch.repo.LoadTree(ctx, a)
+	if err != nil {
+		return false, err
+	}
+
+	treeB, err := arch.repo.LoadTree(ctx, b)
+	if err != nil {
+		return false, err
+	}
+
+	if len(treeA.Nodes) != len(treeB.Nodes) {
+		return false, nil
+	}
+
+	for i, nodeA := range treeA.Nodes {
+		nodeB := *treeB.Nodes[i]
+		nodeB.AccessTime = nodeA.AccessTime
+
+		if nodeA.Subtree != nil && nodeB.Subtree != nil {
+			same, err := arch.sameTree(ctx, *nodeA.Subtree, *nodeB.Subtree)
+			if err != nil || !same {
+				return false, err
+			}
+			nodeB.Subtree = nodeA.Subtree
+		}
+
+		if !nodeA.Equals(nodeB) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// sameStrings returns true if both lists contain the same strings in the same
+// order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
 func isRegularFile(fi os.FileInfo) bool {
 	if fi == nil {
 		return false
@@ -13,6 +13,8 @@ import (
 
 	"restic"
 	"restic/archiver"
+	"restic/compression"
+	"restic/crypto"
 	"restic/mock"
 	"restic/repository"
 )
@@ -81,7 +83,7 @@ func testArchiverDuplication(t *testing.T) {
 
 	repo := repository.New(forgetfulBackend())
 
-	err = repo.Init(context.TODO(), "foo")
+	err = repo.Init(context.TODO(), restic.RepoVersion, crypto.DefaultCipher, compression.DefaultMode, "foo")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -3,9 +3,13 @@ package archiver
 import (
 	"context"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"restic"
 	"restic/pipe"
+	"restic/repository"
 	"restic/walk"
 )
 
@@ -143,3 +147,186 @@ func TestArchivePipe(t *testing.T) {
 		i++
 	}
 }
+
+func TestChangedDirs(t *testing.T) {
+	root := filepath.FromSlash("/home/user")
+	c := newChangedDirs([]string{root}, filepath.Clean)
+	c.Add(filepath.FromSlash("/home/user/work/src/"))
+
+	var tests = []struct {
+		dir       string
+		unchanged bool
+	}{
+		{"/home/user", false},
+		{"/home/user/work", false},
+		{"/home/user/work/src", false},
+		{"/home/user/work/src/sub", true},
+		{"/home/user/work/doc", true},
+		{"/home/user/music", true},
+		{"/home/userdata", false},
+		{"/home", false},
+		{"/tmp", false},
+	}
+
+	for _, test := range tests {
+		if c.Unchanged(filepath.FromSlash(test.dir)) != test.unchanged {
+			t.Errorf("Unchanged(%v) returned %v, want %v", test.dir, !test.unchanged, test.unchanged)
+		}
+	}
+}
+
+func TestSameTree(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	ctx := context.TODO()
+	atime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	saveTree := func(atime time.Time, content restic.IDs) restic.ID {
+		sub := restic.NewTree()
+		if err := sub.Insert(&restic.Node{Name: "file", Type: "file", AccessTime: atime, Content: content}); err != nil {
+			t.Fatal(err)
+		}
+		subID, err := repo.SaveTree(ctx, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		root := restic.NewTree()
+		if err = root.Insert(&restic.Node{Name: "dir", Type: "dir", AccessTime: atime, Subtree: &subID}); err != nil {
+			t.Fatal(err)
+		}
+		id, err := repo.SaveTree(ctx, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	content := restic.IDs{restic.NewRandomID()}
+	a := saveTree(atime, content)
+	b := saveTree(atime.Add(time.Hour), content)
+	c := saveTree(atime, restic.IDs{restic.NewRandomID()})
+	if err := repo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	arch := New(repo)
+	for _, test := range []struct {
+		a, b restic.ID
+		same bool
+	}{
+		{a, a, true},
+		{a, b, true},
+		{a, c, false},
+		{b, c, false},
+	} {
+		same, err := arch.sameTree(ctx, test.a, test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same != test.same {
+			t.Errorf("sameTree(%v, %v) returned %v, want %v", test.a.Str(), test.b.Str(), same, test.same)
+		}
+	}
+}
+
+func TestSaveCheckpoint(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	ctx := context.TODO()
+	node := func(name string, data string) *restic.Node {
+		id, err := repo.SaveBlob(ctx, restic.DataBlob, []byte(data), restic.ID{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &restic.Node{Name: name, Type: "file", Content: restic.IDs{id}}
+	}
+
+	sn, err := restic.NewSnapshot([]string{"/home/user/data"}, []string{"foo"}, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arch := New(repo)
+	arch.checkpoint = newCheckpointState(sn)
+
+	// data/a is complete, of data/b only the file x
+	c := arch.checkpoint
+	a1, a2 := node("1", "a1"), node("2", "a2")
+	c.add(filepath.Join("data", "a", "1"), a1)
+	c.add(filepath.Join("data", "a", "2"), a2)
+	dirA := &restic.Node{Name: "a", Type: "dir", Subtree: &restic.ID{}}
+	tree := restic.NewTree()
+	for _, n := range []*restic.Node{a1, a2} {
+		if err = tree.Insert(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.complete(filepath.Join("data", "a"), dirA, tree)
+	c.add(filepath.Join("data", "b", "x"), node("x", "bx"))
+
+	if len(c.nodes) != 2 {
+		t.Fatalf("wrong number of nodes recorded, want 2, got %v: %v", len(c.nodes), c.nodes)
+	}
+
+	if err = arch.saveCheckpoint(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.last == nil {
+		t.Fatal("no checkpoint saved")
+	}
+
+	cp, err := restic.LoadSnapshot(ctx, repo, *c.last)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cp.Checkpoint || !cp.HasTags([]string{"foo"}) || sn.Checkpoint {
+		t.Fatalf("checkpoint not marked or wrong tags: %v %v", cp.Checkpoint, cp.Tags)
+	}
+
+	var list func(prefix string, id restic.ID) []string
+	list = func(prefix string, id restic.ID) []string {
+		tree, err := repo.LoadTree(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, n := range tree.Nodes {
+			name := prefix + n.Name
+			names = append(names, name)
+			if n.Type == "dir" && !n.Subtree.IsNull() {
+				names = append(names, list(name+"/", *n.Subtree)...)
+			}
+		}
+		return names
+	}
+
+	want := []string{"data", "data/a", "data/b", "data/b/x"}
+	got := list("", *cp.Tree)
+	if len(got) != len(want) {
+		t.Fatalf("wrong nodes in checkpoint, want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("wrong nodes in checkpoint, want %v, got %v", want, got)
+		}
+	}
+
+	// a new checkpoint replaces the previous one
+	first := *c.last
+	if err = arch.saveCheckpoint(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshots restic.IDs
+	for id := range repo.List(ctx, restic.SnapshotFile) {
+		snapshots = append(snapshots, id)
+	}
+	if len(snapshots) != 1 || snapshots[0].Equal(first) {
+		t.Fatalf("previous checkpoint was not removed, snapshots: %v", snapshots)
+	}
+}
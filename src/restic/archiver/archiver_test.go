@@ -3,7 +3,11 @@ package archiver_test
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -11,6 +15,8 @@ import (
 	"restic/archiver"
 	"restic/checker"
 	"restic/crypto"
+	"restic/debug"
+	"restic/fs"
 	"restic/repository"
 	. "restic/test"
 
@@ -312,3 +318,475 @@ func TestArchiveEmptySnapshot(t *testing.T) {
 		t.Errorf("expected null snapshot for empty snapshot, got %v", sn)
 	}
 }
+
+// testChangeDetector reports the directories in the set as unchanged.
+type testChangeDetector map[string]bool
+
+func (d testChangeDetector) Unchanged(dir string) bool {
+	return d[dir]
+}
+
+func subtreeFor(t testing.TB, repo restic.Repository, treeID restic.ID, names ...string) restic.ID {
+	for _, name := range names {
+		tree, err := repo.LoadTree(context.TODO(), treeID)
+		OK(t, err)
+
+		found := false
+		for _, node := range tree.Nodes {
+			if node.Name == name {
+				treeID = *node.Subtree
+				found = true
+				break
+			}
+		}
+		Assert(t, found, "node %v not found in tree %v", name, treeID.Str())
+	}
+
+	return treeID
+}
+
+func TestArchiveChangeDetector(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	tempdir, removeTempdir := TempDir(t)
+	defer removeTempdir()
+
+	datadir := filepath.Join(tempdir, "data")
+	for _, dir := range []string{"a", "b"} {
+		OK(t, os.MkdirAll(filepath.Join(datadir, dir), 0700))
+		OK(t, ioutil.WriteFile(filepath.Join(datadir, dir, "file"), []byte("old content"), 0600))
+	}
+
+	arch := archiver.New(repo)
+	sn1, id1, err := arch.Snapshot(context.TODO(), nil, []string{datadir}, nil, "localhost", nil)
+	OK(t, err)
+
+	for _, dir := range []string{"a", "b"} {
+		OK(t, ioutil.WriteFile(filepath.Join(datadir, dir, "file"), []byte("new content"), 0600))
+	}
+
+	// the change detector claims that "b" is unchanged, so the old tree is used
+	arch = archiver.New(repo)
+	arch.ChangeDetector = testChangeDetector{filepath.Join(datadir, "b"): true}
+	sn2, _, err := arch.Snapshot(context.TODO(), nil, []string{datadir}, nil, "localhost", &id1)
+	OK(t, err)
+
+	Equals(t, subtreeFor(t, repo, *sn1.Tree, "data", "b"), subtreeFor(t, repo, *sn2.Tree, "data", "b"))
+	Assert(t, !subtreeFor(t, repo, *sn1.Tree, "data", "a").Equal(subtreeFor(t, repo, *sn2.Tree, "data", "a")),
+		"tree for changed directory was not saved again")
+
+	// with different exclude patterns, the change detector is not used
+	arch = archiver.New(repo)
+	arch.Excludes = []string{"*.tmp"}
+	arch.ChangeDetector = testChangeDetector{filepath.Join(datadir, "b"): true}
+	sn3, _, err := arch.Snapshot(context.TODO(), nil, []string{datadir}, nil, "localhost", &id1)
+	OK(t, err)
+
+	Assert(t, !subtreeFor(t, repo, *sn1.Tree, "data", "b").Equal(subtreeFor(t, repo, *sn3.Tree, "data", "b")),
+		"change detector was used although the exclude patterns differ")
+
+	// the same holds for the other options which select the files
+	OK(t, ioutil.WriteFile(filepath.Join(datadir, "b", "file"), []byte("newer content"), 0600))
+	arch = archiver.New(repo)
+	arch.Selection = []string{"one-file-system"}
+	arch.ChangeDetector = testChangeDetector{filepath.Join(datadir, "b"): true}
+	sn4, _, err := arch.Snapshot(context.TODO(), nil, []string{datadir}, nil, "localhost", &id1)
+	OK(t, err)
+
+	Equals(t, []string{"one-file-system"}, sn4.Selection)
+	Assert(t, !subtreeFor(t, repo, *sn3.Tree, "data", "b").Equal(subtreeFor(t, repo, *sn4.Tree, "data", "b")),
+		"change detector was used although the selection options differ")
+}
+
+func TestArchiveDryRun(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	tempdir, removeTempdir := TempDir(t)
+	defer removeTempdir()
+
+	datadir := filepath.Join(tempdir, "data")
+	OK(t, os.MkdirAll(datadir, 0700))
+	for _, name := range []string{"a", "b"} {
+		OK(t, ioutil.WriteFile(filepath.Join(datadir, name), []byte("old content "+name), 0600))
+	}
+
+	arch := archiver.New(repo)
+	_, id1, err := arch.Snapshot(context.TODO(), nil, []string{datadir}, nil, "localhost", nil)
+	OK(t, err)
+
+	newContent := []byte("new content")
+	OK(t, ioutil.WriteFile(filepath.Join(datadir, "a"), newContent, 0600))
+	future := time.Now().Add(time.Hour)
+	OK(t, os.Chtimes(filepath.Join(datadir, "a"), future, future))
+
+	countFiles := func(tpe restic.FileType) (n int) {
+		for range repo.List(context.TODO(), tpe) {
+			n++
+		}
+		return n
+	}
+	snapshots, packs := countFiles(restic.SnapshotFile), countFiles(restic.DataFile)
+
+	arch = archiver.New(repo)
+	arch.DryRun = true
+	sn, id, err := arch.Snapshot(context.TODO(), nil, []string{datadir}, nil, "localhost", &id1)
+	OK(t, err)
+	Assert(t, id.IsNull(), "dry run returned snapshot ID %v", id.Str())
+	Assert(t, sn != nil && sn.Tree != nil, "dry run did not return the snapshot")
+
+	stats := arch.DryRunStats()
+	Equals(t, uint64(1), stats.ChangedFiles)
+	Equals(t, uint64(len(newContent)), stats.ChangedBytes)
+	Equals(t, uint64(1), stats.UnchangedFiles)
+	Equals(t, uint64(1), stats.DataBlobs)
+	Assert(t, stats.TreeBlobs > 0, "no new trees counted")
+	Assert(t, stats.UploadBytes > uint64(len(newContent))+uint64(crypto.Extension),
+		"upload size %d does not include the trees", stats.UploadBytes)
+
+	Equals(t, snapshots, countFiles(restic.SnapshotFile))
+	Equals(t, packs, countFiles(restic.DataFile))
+	Assert(t, !repo.Index().Has(restic.Hash(newContent), restic.DataBlob), "new blob has been added to the index")
+}
+
+func TestArchiveReadConcurrency(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	tempdir, removeTempdir := TempDir(t)
+	defer removeTempdir()
+
+	for i := 0; i < 10; i++ {
+		OK(t, ioutil.WriteFile(filepath.Join(tempdir, fmt.Sprintf("file%d", i)), Random(i, 100*1024), 0600))
+	}
+
+	arch := archiver.New(repo)
+	arch.ReadConcurrency = 1
+	sn, _, err := arch.Snapshot(context.TODO(), nil, []string{tempdir}, nil, "localhost", nil)
+	OK(t, err)
+
+	tree, err := repo.LoadTree(context.TODO(), subtreeFor(t, repo, *sn.Tree, filepath.Base(tempdir)))
+	OK(t, err)
+	Equals(t, 10, len(tree.Nodes))
+
+	checker.TestCheckRepo(t, repo)
+}
+
+func TestArchiveTimeLimit(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	tempdir, removeTempdir := TempDir(t)
+	defer removeTempdir()
+
+	datadir := filepath.Join(tempdir, "data")
+	for _, dir := range []string{"a", "b"} {
+		OK(t, os.MkdirAll(filepath.Join(datadir, dir), 0700))
+	}
+	OK(t, ioutil.WriteFile(filepath.Join(datadir, "a", "old"), Random(1, 1024), 0600))
+
+	arch := archiver.New(repo)
+	_, id1, err := arch.Snapshot(context.TODO(), nil, []string{datadir}, nil, "localhost", nil)
+	OK(t, err)
+
+	// new files are not read after the time limit, but unchanged ones are
+	// still taken from the parent snapshot
+	OK(t, ioutil.WriteFile(filepath.Join(datadir, "a", "new"), Random(2, 1024), 0600))
+	OK(t, ioutil.WriteFile(filepath.Join(datadir, "b", "new"), Random(3, 1024), 0600))
+
+	arch = archiver.New(repo)
+	arch.TimeLimit = time.Nanosecond
+	partial, partialID, err := arch.Snapshot(context.TODO(), nil, []string{datadir}, []string{"foo"}, "localhost", &id1)
+	Assert(t, err == archiver.ErrTimeLimit, "expected ErrTimeLimit, got %v", err)
+	Equals(t, id1, *partial.Parent)
+
+	partial, err = restic.LoadSnapshot(context.TODO(), repo, partialID)
+	OK(t, err)
+	Assert(t, partial.Partial && !partial.Checkpoint, "snapshot saved at the time limit is not a partial snapshot")
+	Equals(t, []string{"foo", restic.PartialTag}, partial.Tags)
+	tree, err := repo.LoadTree(context.TODO(), subtreeFor(t, repo, *partial.Tree, "data", "a"))
+	OK(t, err)
+	Equals(t, 1, len(tree.Nodes))
+	Equals(t, "old", tree.Nodes[0].Name)
+	checkStructure(t, repo)
+
+	// the next backup continues from the partial snapshot, which is kept
+	arch = archiver.New(repo)
+	sn, id2, err := arch.Snapshot(context.TODO(), nil, []string{datadir}, []string{"foo"}, "localhost", &partialID)
+	OK(t, err)
+	Equals(t, partialID, *sn.Parent)
+	Equals(t, []string{"foo"}, sn.Tags)
+
+	for _, dir := range []string{"a", "b"} {
+		tree, err := repo.LoadTree(context.TODO(), subtreeFor(t, repo, *sn.Tree, "data", dir))
+		OK(t, err)
+		Assert(t, len(tree.Nodes) > 0 && tree.Nodes[0].Name == "new", "new file in %v not saved", dir)
+	}
+
+	remaining := restic.NewIDSet()
+	for id := range repo.List(context.TODO(), restic.SnapshotFile) {
+		remaining.Insert(id)
+	}
+	Equals(t, restic.NewIDSet(id1, partialID, id2), remaining)
+	checkStructure(t, repo)
+}
+
+func TestArchiveChangedFile(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	tempdir, removeTempdir := TempDir(t)
+	defer removeTempdir()
+
+	filename := filepath.Join(tempdir, "file")
+	OK(t, ioutil.WriteFile(filename, []byte("old content"), 0600))
+
+	// modify the file after it has been read the first changes times
+	modify := func(changes int) {
+		n := 0
+		debug.Hook("archiver.SaveFile.read", func(context interface{}) {
+			if context.(string) != filename || n >= changes {
+				return
+			}
+			n++
+
+			data := []byte(fmt.Sprintf("new content %d", n))
+			OK(t, ioutil.WriteFile(filename, data, 0600))
+			mtime := time.Now().Add(time.Duration(n) * time.Hour)
+			OK(t, os.Chtimes(filename, mtime, mtime))
+		})
+	}
+	defer debug.RemoveHook("archiver.SaveFile.read")
+
+	var tests = []struct {
+		changes      int
+		content      string
+		inconsistent bool
+	}{
+		{1, "new content 1", false},
+		{2, "new content 2", false},
+		{3, "new content 2", true},
+	}
+
+	for _, test := range tests {
+		modify(test.changes)
+
+		arch := archiver.New(repo)
+		arch.ChangedFileRetries = 2
+		node := &restic.Node{Path: filename}
+		fi, err := os.Lstat(filename)
+		OK(t, err)
+		node, err = restic.NodeFromFileInfo(filename, fi)
+		OK(t, err)
+
+		node, err = arch.SaveFile(context.TODO(), nil, node)
+		OK(t, err)
+		OK(t, repo.Flush())
+
+		Equals(t, test.inconsistent, node.Inconsistent)
+		Equals(t, test.inconsistent, len(arch.InconsistentFiles()) == 1)
+
+		// the content read last is saved
+		var buf []byte
+		for _, id := range node.Content {
+			data := make([]byte, 1024)
+			n, err := repo.LoadBlob(context.TODO(), restic.DataBlob, id, data)
+			OK(t, err)
+			buf = append(buf, data[:n]...)
+		}
+		Equals(t, test.content, string(buf))
+		Equals(t, uint64(len(buf)), node.Size)
+	}
+}
+
+func TestArchiveHardlinks(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	tempdir, removeTempdir := TempDir(t)
+	defer removeTempdir()
+
+	OK(t, ioutil.WriteFile(filepath.Join(tempdir, "file"), Random(23, 500*1024), 0600))
+	if err := os.Link(filepath.Join(tempdir, "file"), filepath.Join(tempdir, "link")); err != nil {
+		t.Skipf("unable to create hard link: %v", err)
+	}
+
+	arch := archiver.New(repo)
+	arch.ReadConcurrency = 1
+	sn, _, err := arch.Snapshot(context.TODO(), nil, []string{tempdir}, nil, "localhost", nil)
+	OK(t, err)
+
+	tree, err := repo.LoadTree(context.TODO(), subtreeFor(t, repo, *sn.Tree, filepath.Base(tempdir)))
+	OK(t, err)
+	Equals(t, 2, len(tree.Nodes))
+
+	file, link := tree.Nodes[0], tree.Nodes[1]
+	if file.Inode == 0 {
+		t.Skip("file system does not report inodes")
+	}
+
+	Equals(t, uint64(2), file.Links)
+	Equals(t, file.Inode, link.Inode)
+	Equals(t, file.DeviceID, link.DeviceID)
+	Equals(t, file.Content, link.Content)
+
+	checker.TestCheckRepo(t, repo)
+}
+
+func TestArchiveSparse(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	tempdir, removeTempdir := TempDir(t)
+	defer removeTempdir()
+
+	f, err := os.Create(filepath.Join(tempdir, "sparse"))
+	OK(t, err)
+	_, err = f.WriteAt(Random(23, 1024), 4*1024*1024)
+	OK(t, err)
+	OK(t, f.Close())
+
+	f2, err := fs.Open(filepath.Join(tempdir, "sparse"))
+	OK(t, err)
+	holes, err := fs.HasHoles(f2)
+	OK(t, err)
+	OK(t, f2.Close())
+	if !holes {
+		t.Skip("file system does not support holes")
+	}
+
+	OK(t, ioutil.WriteFile(filepath.Join(tempdir, "file"), Random(42, 1024), 0600))
+
+	arch := archiver.New(repo)
+	sn, _, err := arch.Snapshot(context.TODO(), nil, []string{tempdir}, nil, "localhost", nil)
+	OK(t, err)
+
+	tree, err := repo.LoadTree(context.TODO(), subtreeFor(t, repo, *sn.Tree, filepath.Base(tempdir)))
+	OK(t, err)
+	Equals(t, 2, len(tree.Nodes))
+
+	file, sparse := tree.Nodes[0], tree.Nodes[1]
+	Equals(t, false, file.Sparse)
+	Equals(t, true, sparse.Sparse)
+	Equals(t, uint64(4*1024*1024+1024), sparse.Size)
+
+	// the unchanged file is still marked as sparse when the content is reused
+	sn2, _, err := arch.Snapshot(context.TODO(), nil, []string{tempdir}, nil, "localhost", sn.ID())
+	OK(t, err)
+
+	tree, err = repo.LoadTree(context.TODO(), subtreeFor(t, repo, *sn2.Tree, filepath.Base(tempdir)))
+	OK(t, err)
+	Equals(t, true, tree.Nodes[1].Sparse)
+
+	checker.TestCheckRepo(t, repo)
+}
+
+// checkStructure checks that all snapshots reference only data stored in the
+// repository. Unlike checker.TestCheckRepo, unused blobs are allowed.
+func checkStructure(t testing.TB, repo restic.Repository) {
+	chkr := checker.New(repo)
+
+	hints, errs := chkr.LoadIndex(context.TODO())
+	if len(errs) != 0 || len(hints) != 0 {
+		t.Fatalf("errors loading index: %v %v", errs, hints)
+	}
+
+	errChan := make(chan error)
+	go chkr.Structure(context.TODO(), errChan)
+
+	for err := range errChan {
+		t.Error(err)
+	}
+}
+
+func TestArchiveCheckpoint(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	tempdir, removeTempdir := TempDir(t)
+	defer removeTempdir()
+
+	datadir := filepath.Join(tempdir, "data")
+	for i, dir := range []string{"a", "b", "c"} {
+		OK(t, os.MkdirAll(filepath.Join(datadir, dir), 0700))
+		for j := 0; j < 5; j++ {
+			data := Random(10*i+j, 512*1024)
+			OK(t, ioutil.WriteFile(filepath.Join(datadir, dir, fmt.Sprintf("file%d", j)), data, 0600))
+		}
+	}
+
+	// save checkpoints as often as possible
+	arch := archiver.New(repo)
+	arch.CheckpointInterval = time.Millisecond
+	sn1, id1, err := arch.Snapshot(context.TODO(), nil, []string{datadir}, nil, "localhost", nil)
+	OK(t, err)
+
+	var snapshots restic.IDs
+	for id := range repo.List(context.TODO(), restic.SnapshotFile) {
+		snapshots = append(snapshots, id)
+	}
+	Equals(t, restic.IDs{id1}, snapshots)
+	checkStructure(t, repo)
+
+	// simulate the checkpoint of an interrupted backup in which "a" has
+	// been saved completely and "c" partially
+	cTree, err := repo.LoadTree(context.TODO(), subtreeFor(t, repo, *sn1.Tree, "data", "c"))
+	OK(t, err)
+	partial := restic.NewTree()
+	OK(t, partial.Insert(cTree.Nodes[0]))
+	partialID, err := repo.SaveTree(context.TODO(), partial)
+	OK(t, err)
+
+	dataTree := restic.NewTree()
+	aTreeID := subtreeFor(t, repo, *sn1.Tree, "data", "a")
+	OK(t, dataTree.Insert(&restic.Node{Name: "a", Type: "dir", Subtree: &aTreeID}))
+	OK(t, dataTree.Insert(&restic.Node{Name: "c", Type: "dir", Subtree: &partialID}))
+	dataTreeID, err := repo.SaveTree(context.TODO(), dataTree)
+	OK(t, err)
+
+	root := restic.NewTree()
+	OK(t, root.Insert(&restic.Node{Name: "data", Type: "dir", Subtree: &dataTreeID}))
+	rootID, err := repo.SaveTree(context.TODO(), root)
+	OK(t, err)
+	OK(t, repo.Flush())
+	OK(t, repo.SaveIndex(context.TODO()))
+
+	cp, err := restic.NewSnapshot([]string{datadir}, nil, "localhost")
+	OK(t, err)
+	cp.Checkpoint = true
+	cp.Parent = &id1
+	cp.Tree = &rootID
+	cpID, err := repo.SaveJSONUnpacked(context.TODO(), restic.SnapshotFile, cp)
+	OK(t, err)
+
+	// the partial trees of a checkpoint are never used for unchanged
+	// directories
+	arch = archiver.New(repo)
+	arch.ChangeDetector = testChangeDetector{
+		filepath.Join(datadir, "a"): true,
+		filepath.Join(datadir, "c"): true,
+	}
+	sn2, id2, err := arch.Snapshot(context.TODO(), nil, []string{datadir}, nil, "localhost", &cpID)
+	OK(t, err)
+
+	for _, name := range []string{"a", "c"} {
+		tree1, err := repo.LoadTree(context.TODO(), subtreeFor(t, repo, *sn1.Tree, "data", name))
+		OK(t, err)
+		tree2, err := repo.LoadTree(context.TODO(), subtreeFor(t, repo, *sn2.Tree, "data", name))
+		OK(t, err)
+
+		Equals(t, len(tree1.Nodes), len(tree2.Nodes))
+		for i := range tree1.Nodes {
+			Equals(t, tree1.Nodes[i].Content, tree2.Nodes[i].Content)
+		}
+	}
+	Equals(t, id1, *sn2.Parent)
+
+	remaining := restic.NewIDSet()
+	for id := range repo.List(context.TODO(), restic.SnapshotFile) {
+		remaining.Insert(id)
+	}
+	Equals(t, restic.NewIDSet(id1, id2), remaining)
+	checkStructure(t, repo)
+}
@@ -0,0 +1,81 @@
+package archiver
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// ChangeDetector reports directories which have not been modified since the
+// parent snapshot was taken, as recorded by the file system's change journal.
+// The archiver reuses the trees from the parent snapshot for such directories
+// without reading them.
+type ChangeDetector interface {
+	// Unchanged returns true if neither the directory dir nor anything below
+	// it has been modified. When in doubt, false must be returned.
+	Unchanged(dir string) bool
+}
+
+// changedDirs collects the directories in which changes were recorded,
+// together with all their parent directories.
+type changedDirs struct {
+	// roots are the directories for which changes have been collected
+	roots []string
+	dirs  map[string]struct{}
+
+	// normalize is applied to all paths before they are compared
+	normalize func(string) string
+}
+
+func newChangedDirs(roots []string, normalize func(string) string) *changedDirs {
+	c := &changedDirs{
+		dirs:      make(map[string]struct{}),
+		normalize: normalize,
+	}
+
+	for _, root := range roots {
+		c.roots = append(c.roots, c.normalize(root))
+	}
+
+	return c
+}
+
+// Add records a change in dir, which also changes all parent directories.
+func (c *changedDirs) Add(dir string) {
+	dir = c.normalize(dir)
+	for {
+		if _, ok := c.dirs[dir]; ok {
+			return
+		}
+
+		c.dirs[dir] = struct{}{}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return
+		}
+		dir = parent
+	}
+}
+
+// Unchanged returns true if dir is located below one of the roots and no
+// change was recorded in it or any of its subdirectories.
+func (c *changedDirs) Unchanged(dir string) bool {
+	dir = c.normalize(dir)
+
+	if _, ok := c.dirs[dir]; ok {
+		return false
+	}
+
+	for _, root := range c.roots {
+		prefix := root
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+
+		if dir == root || strings.HasPrefix(dir, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,233 @@
+// +build cgo
+
+package archiver
+
+/*
+#cgo LDFLAGS: -framework CoreServices
+#include <CoreServices/CoreServices.h>
+#include <stdlib.h>
+#include <string.h>
+
+typedef struct {
+	char **paths;
+	size_t len, cap;
+	int done, incomplete;
+} changes;
+
+static void changesCallback(ConstFSEventStreamRef stream, void *info, size_t n,
+		void *eventPaths, const FSEventStreamEventFlags flags[],
+		const FSEventStreamEventId ids[]) {
+	changes *c = (changes *)info;
+	char **paths = (char **)eventPaths;
+	size_t i;
+
+	for (i = 0; i < n; i++) {
+		if (flags[i] & kFSEventStreamEventFlagHistoryDone) {
+			c->done = 1;
+			CFRunLoopStop(CFRunLoopGetCurrent());
+			continue;
+		}
+
+		if (flags[i] & (kFSEventStreamEventFlagMustScanSubDirs |
+				kFSEventStreamEventFlagUserDropped |
+				kFSEventStreamEventFlagKernelDropped |
+				kFSEventStreamEventFlagEventIdsWrapped |
+				kFSEventStreamEventFlagRootChanged)) {
+			c->incomplete = 1;
+		}
+
+		if (c->len == c->cap) {
+			c->cap = c->cap ? 2 * c->cap : 64;
+			c->paths = realloc(c->paths, c->cap * sizeof(char *));
+		}
+		c->paths[c->len++] = strdup(paths[i]);
+	}
+}
+
+// readChanges collects the paths of all events recorded for root on the
+// device dev since the time since (seconds since 2001-01-01).
+static int readChanges(const char *root, dev_t dev, double since, changes *c) {
+	FSEventStreamEventId sinceID = FSEventsGetLastEventIdForDeviceBeforeTime(dev, since);
+	if (sinceID == 0) {
+		return -1;
+	}
+
+	CFStringRef path = CFStringCreateWithCString(NULL, root, kCFStringEncodingUTF8);
+	CFArrayRef paths = CFArrayCreate(NULL, (const void **)&path, 1, &kCFTypeArrayCallBacks);
+	FSEventStreamContext ctx = {0, c, NULL, NULL, NULL};
+	FSEventStreamRef stream = FSEventStreamCreate(NULL, changesCallback, &ctx,
+			paths, sinceID, 0, kFSEventStreamCreateFlagNoDefer);
+	CFRelease(paths);
+	CFRelease(path);
+
+	if (stream == NULL) {
+		return -1;
+	}
+
+	FSEventStreamScheduleWithRunLoop(stream, CFRunLoopGetCurrent(), kCFRunLoopDefaultMode);
+	if (!FSEventStreamStart(stream)) {
+		FSEventStreamInvalidate(stream);
+		FSEventStreamRelease(stream);
+		return -1;
+	}
+
+	while (!c->done) {
+		SInt32 res = CFRunLoopRunInMode(kCFRunLoopDefaultMode, 60, false);
+		if (res == kCFRunLoopRunFinished || res == kCFRunLoopRunTimedOut) {
+			break;
+		}
+	}
+
+	FSEventStreamStop(stream);
+	FSEventStreamInvalidate(stream);
+	FSEventStreamRelease(stream);
+
+	return c->done ? 0 : -1;
+}
+
+static char *changesPath(changes *c, size_t i) {
+	return c->paths[i];
+}
+
+static void freeChanges(changes *c) {
+	size_t i;
+	for (i = 0; i < c->len; i++) {
+		free(c->paths[i]);
+	}
+	free(c->paths);
+}
+*/
+import "C"
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"restic/debug"
+	"restic/errors"
+	"restic/fs"
+)
+
+// cfAbsoluteTimeOffset is the number of seconds between 1970-01-01 and
+// 2001-01-01, the reference date for CFAbsoluteTime.
+const cfAbsoluteTimeOffset = 978307200
+
+// fseventsDetector uses the FSEvents database to find changed directories.
+type fseventsDetector struct {
+	*changedDirs
+
+	// real maps the paths passed in to their real paths, which are used by
+	// FSEvents
+	real map[string]string
+
+	// devices of the paths, directories on other devices are not covered
+	devices map[string]uint64
+}
+
+// NewChangeDetector returns a ChangeDetector which reads the events recorded
+// by FSEvents for the paths since the given time. An error is returned if
+// the event history is not available or incomplete.
+func NewChangeDetector(paths []string, since time.Time) (ChangeDetector, error) {
+	d := &fseventsDetector{
+		real:    make(map[string]string),
+		devices: make(map[string]uint64),
+	}
+
+	var roots []string
+	for _, p := range paths {
+		realPath, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "EvalSymlinks")
+		}
+
+		fi, err := fs.Lstat(realPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "Lstat")
+		}
+
+		dev, err := fs.DeviceID(fi)
+		if err != nil {
+			return nil, err
+		}
+
+		d.real[filepath.Clean(p)] = realPath
+		d.devices[realPath] = dev
+		roots = append(roots, realPath)
+	}
+
+	d.changedDirs = newChangedDirs(roots, filepath.Clean)
+
+	for _, root := range roots {
+		if err := d.readEvents(root, since); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+func (d *fseventsDetector) readEvents(root string, since time.Time) error {
+	croot := C.CString(root)
+	defer C.free(unsafe.Pointer(croot))
+
+	var c C.changes
+	defer C.freeChanges(&c)
+
+	t := float64(since.UnixNano())/1e9 - cfAbsoluteTimeOffset
+	if C.readChanges(croot, C.dev_t(d.devices[root]), C.double(t), &c) != 0 {
+		return errors.Errorf("FSEvents history for %v is not available", root)
+	}
+
+	if c.incomplete != 0 {
+		return errors.Errorf("FSEvents history for %v is incomplete", root)
+	}
+
+	debug.Log("%d events for %v since %v", c.len, root, since)
+
+	for i := C.size_t(0); i < c.len; i++ {
+		d.Add(C.GoString(C.changesPath(&c, i)))
+	}
+
+	return nil
+}
+
+// Unchanged returns true if no event was recorded for dir or anything below
+// it.
+func (d *fseventsDetector) Unchanged(dir string) bool {
+	dir = filepath.Clean(dir)
+
+	realPath := ""
+	for p, r := range d.real {
+		if dir == p {
+			realPath = r
+			break
+		}
+
+		if strings.HasPrefix(dir, strings.TrimSuffix(p, "/")+"/") {
+			realPath = filepath.Join(r, dir[len(p):])
+			break
+		}
+	}
+
+	if realPath == "" || !d.changedDirs.Unchanged(realPath) {
+		return false
+	}
+
+	// events for other file systems mounted below the paths are not
+	// necessarily recorded
+	fi, err := fs.Lstat(realPath)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+
+	for root, dev := range d.devices {
+		if realPath == root || strings.HasPrefix(realPath, strings.TrimSuffix(root, "/")+"/") {
+			id, err := fs.DeviceID(fi)
+			return err == nil && id == dev
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,16 @@
+// +build !windows
+// +build !darwin !cgo
+
+package archiver
+
+import (
+	"time"
+
+	"restic/errors"
+)
+
+// NewChangeDetector returns an error, there is no change journal which can be
+// used on this platform.
+func NewChangeDetector(paths []string, since time.Time) (ChangeDetector, error) {
+	return nil, errors.New("change journal is only supported on Windows and macOS")
+}
@@ -0,0 +1,239 @@
+package archiver
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"restic/debug"
+	"restic/errors"
+)
+
+const (
+	fsctlQueryUsnJournal = 0x000900f4
+	fsctlReadUsnJournal  = 0x000900bb
+
+	fileAttributeDirectory  = 0x10
+	fileReadAttributes      = 0x80
+	fileFlagBackupSemantics = 0x02000000
+	fileIDType              = 0
+
+	// usnRecordV2HeaderSize is the size of USN_RECORD_V2 without the file name
+	usnRecordV2HeaderSize = 60
+
+	// filetimeOffset is the number of 100ns intervals between 1601-01-01 and
+	// 1970-01-01.
+	filetimeOffset = 116444736000000000
+)
+
+var (
+	modkernel32                   = syscall.NewLazyDLL("kernel32.dll")
+	procOpenFileByID              = modkernel32.NewProc("OpenFileById")
+	procGetFinalPathNameByHandleW = modkernel32.NewProc("GetFinalPathNameByHandleW")
+)
+
+// usnJournalData is USN_JOURNAL_DATA_V0.
+type usnJournalData struct {
+	UsnJournalID    uint64
+	FirstUsn        int64
+	NextUsn         int64
+	LowestValidUsn  int64
+	MaxUsn          int64
+	MaximumSize     uint64
+	AllocationDelta uint64
+}
+
+// readUsnJournalData is READ_USN_JOURNAL_DATA_V0.
+type readUsnJournalData struct {
+	StartUsn          int64
+	ReasonMask        uint32
+	ReturnOnlyOnClose uint32
+	Timeout           uint64
+	BytesToWaitFor    uint64
+	UsnJournalID      uint64
+}
+
+// fileIDDescriptor is FILE_ID_DESCRIPTOR with a 64 bit file ID.
+type fileIDDescriptor struct {
+	Size   uint32
+	Type   uint32
+	FileID uint64
+	_      uint64
+}
+
+// NewChangeDetector returns a ChangeDetector which reads the NTFS change
+// journal (USN journal) of the volumes the paths are located on. An error is
+// returned if the journal is not active or does not reach back to since. This
+// needs administrator privileges.
+func NewChangeDetector(paths []string, since time.Time) (ChangeDetector, error) {
+	c := newChangedDirs(paths, func(p string) string {
+		return strings.ToLower(filepath.Clean(p))
+	})
+
+	volumes := make(map[string]struct{})
+	for _, p := range paths {
+		vol := filepath.VolumeName(p)
+		if vol == "" || strings.HasPrefix(vol, `\\`) {
+			return nil, errors.Errorf("path %v is not located on a local volume", p)
+		}
+
+		volumes[strings.ToUpper(vol)] = struct{}{}
+	}
+
+	for vol := range volumes {
+		if err := readUsnJournal(vol, since, c); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// readUsnJournal adds all directories on the volume vol (e.g. "C:") in which
+// changes have been recorded since the given time.
+func readUsnJournal(vol string, since time.Time, c *changedDirs) error {
+	name, err := syscall.UTF16PtrFromString(`\\.\` + vol)
+	if err != nil {
+		return errors.Wrap(err, "UTF16PtrFromString")
+	}
+
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return errors.Wrapf(err, "open volume %v", vol)
+	}
+	defer syscall.CloseHandle(h)
+
+	var journal usnJournalData
+	var n uint32
+	err = syscall.DeviceIoControl(h, fsctlQueryUsnJournal, nil, 0,
+		(*byte)(unsafe.Pointer(&journal)), uint32(unsafe.Sizeof(journal)), &n, nil)
+	if err != nil {
+		return errors.Wrapf(err, "query change journal of %v", vol)
+	}
+
+	sinceFiletime := since.UnixNano()/100 + filetimeOffset
+
+	req := readUsnJournalData{
+		StartUsn:     journal.FirstUsn,
+		ReasonMask:   0xffffffff,
+		UsnJournalID: journal.UsnJournalID,
+	}
+
+	// the IDs of the directories which contain changed files
+	changed := make(map[uint64]struct{})
+	first := true
+	buf := make([]byte, 64*1024)
+
+	for req.StartUsn < journal.NextUsn {
+		err = syscall.DeviceIoControl(h, fsctlReadUsnJournal,
+			(*byte)(unsafe.Pointer(&req)), uint32(unsafe.Sizeof(req)),
+			&buf[0], uint32(len(buf)), &n, nil)
+		if err != nil {
+			return errors.Wrapf(err, "read change journal of %v", vol)
+		}
+
+		if n < 8 {
+			break
+		}
+
+		next := int64(binary.LittleEndian.Uint64(buf))
+		records := buf[8:n]
+		for len(records) >= usnRecordV2HeaderSize {
+			length := binary.LittleEndian.Uint32(records)
+			if length < usnRecordV2HeaderSize || int(length) > len(records) {
+				return errors.Errorf("invalid record in change journal of %v", vol)
+			}
+
+			if major := binary.LittleEndian.Uint16(records[4:]); major != 2 {
+				return errors.Errorf("unsupported version %d of change journal records on %v", major, vol)
+			}
+
+			fileID := binary.LittleEndian.Uint64(records[8:])
+			parentID := binary.LittleEndian.Uint64(records[16:])
+			timestamp := int64(binary.LittleEndian.Uint64(records[32:]))
+			attributes := binary.LittleEndian.Uint32(records[52:])
+
+			if first {
+				// the journal must reach back to the parent snapshot
+				if timestamp > sinceFiletime {
+					return errors.Errorf("change journal of %v does not reach back to %v", vol, since)
+				}
+				first = false
+			}
+
+			if timestamp >= sinceFiletime {
+				changed[parentID] = struct{}{}
+				if attributes&fileAttributeDirectory != 0 {
+					changed[fileID] = struct{}{}
+				}
+			}
+
+			records = records[length:]
+		}
+
+		if next <= req.StartUsn {
+			break
+		}
+		req.StartUsn = next
+	}
+
+	if first {
+		return errors.Errorf("change journal of %v is empty", vol)
+	}
+
+	debug.Log("%d directories changed on %v since %v", len(changed), vol, since)
+
+	for id := range changed {
+		path, err := pathForFileID(h, id)
+		if err != nil {
+			// the directory has been removed, so a change was recorded in
+			// its parent directory as well
+			debug.Log("unable to find path for file ID %x: %v", id, err)
+			continue
+		}
+
+		c.Add(path)
+	}
+
+	return nil
+}
+
+// pathForFileID returns the path of the file or directory with the given ID
+// on the volume opened as h.
+func pathForFileID(h syscall.Handle, id uint64) (string, error) {
+	desc := fileIDDescriptor{
+		Type:   fileIDType,
+		FileID: id,
+	}
+	desc.Size = uint32(unsafe.Sizeof(desc))
+
+	r, _, err := procOpenFileByID.Call(uintptr(h), uintptr(unsafe.Pointer(&desc)),
+		fileReadAttributes, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		0, fileFlagBackupSemantics)
+	f := syscall.Handle(r)
+	if f == syscall.InvalidHandle {
+		return "", err
+	}
+	defer syscall.CloseHandle(f)
+
+	buf := make([]uint16, syscall.MAX_PATH)
+	for {
+		r, _, err = procGetFinalPathNameByHandleW.Call(uintptr(f),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0)
+		if r == 0 {
+			return "", err
+		}
+
+		if int(r) < len(buf) {
+			break
+		}
+
+		buf = make([]uint16, r)
+	}
+
+	return strings.TrimPrefix(syscall.UTF16ToString(buf), `\\?\`), nil
+}
@@ -0,0 +1,243 @@
+package archiver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"restic"
+	"restic/debug"
+)
+
+// checkpointState records the nodes which have been saved so far. Only the
+// nodes whose parent directory is not complete yet are kept, the nodes of a
+// complete directory are replaced by the node for the directory itself.
+type checkpointState struct {
+	m     sync.Mutex
+	nodes map[string]*restic.Node
+
+	// sn is the template for checkpoint snapshots, last is the ID of the
+	// checkpoint saved last
+	sn   *restic.Snapshot
+	last *restic.ID
+}
+
+func newCheckpointState(sn *restic.Snapshot) *checkpointState {
+	cp := *sn
+	cp.Checkpoint = true
+
+	return &checkpointState{
+		nodes: make(map[string]*restic.Node),
+		sn:    &cp,
+	}
+}
+
+// add records a file node which has been saved.
+func (c *checkpointState) add(path string, node *restic.Node) {
+	if c == nil || node == nil {
+		return
+	}
+
+	c.m.Lock()
+	c.nodes[path] = node
+	c.m.Unlock()
+}
+
+// complete replaces the nodes of the entries of the directory by the node for
+// the directory.
+func (c *checkpointState) complete(path string, node *restic.Node, tree *restic.Tree) {
+	if c == nil {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if tree != nil {
+		for _, n := range tree.Nodes {
+			delete(c.nodes, filepath.Join(path, n.Name))
+		}
+	}
+
+	if path != "" {
+		c.nodes[path] = node
+	}
+}
+
+// partialTree is a directory which has not been completely saved yet.
+type partialTree struct {
+	nodes   []*restic.Node
+	subdirs map[string]*partialTree
+}
+
+func newPartialTree() *partialTree {
+	return &partialTree{subdirs: make(map[string]*partialTree)}
+}
+
+// insert adds the node at path, creating partial trees for all parent
+// directories.
+func (t *partialTree) insert(path string, node *restic.Node) {
+	dir, _ := filepath.Split(path)
+	dir = filepath.Clean(dir)
+
+	if dir == "." {
+		t.nodes = append(t.nodes, node)
+		return
+	}
+
+	parent := t
+	for _, name := range splitPath(dir) {
+		sub, ok := parent.subdirs[name]
+		if !ok {
+			sub = newPartialTree()
+			parent.subdirs[name] = sub
+		}
+		parent = sub
+	}
+
+	parent.nodes = append(parent.nodes, node)
+}
+
+// splitPath returns the elements of the relative path p.
+func splitPath(p string) []string {
+	var names []string
+	for p != "." && p != "" {
+		dir, name := filepath.Split(p)
+		names = append([]string{name}, names...)
+		p = filepath.Clean(dir)
+	}
+	return names
+}
+
+// save stores the partial tree and all subtrees in the repository.
+// Directories which are not complete only get a minimal node.
+func (t *partialTree) save(ctx context.Context, arch *Archiver) (restic.ID, error) {
+	tree := restic.NewTree()
+	for _, node := range t.nodes {
+		if err := tree.Insert(node); err != nil {
+			return restic.ID{}, err
+		}
+	}
+
+	for name, sub := range t.subdirs {
+		id, err := sub.save(ctx, arch)
+		if err != nil {
+			return restic.ID{}, err
+		}
+
+		node := &restic.Node{
+			Name:    name,
+			Type:    "dir",
+			Mode:    os.ModeDir | 0700,
+			Subtree: &id,
+		}
+
+		if err = tree.Insert(node); err != nil {
+			return restic.ID{}, err
+		}
+	}
+
+	return arch.saveTreeJSON(ctx, tree)
+}
+
+// saveCheckpoint saves a snapshot with the nodes which have been completely
+// saved so far.
+func (arch *Archiver) saveCheckpoint(ctx context.Context) error {
+	c := arch.checkpoint
+
+	treeID, err := arch.savePartialTree(ctx)
+	if err != nil || treeID == nil {
+		return err
+	}
+
+	sn := *c.sn
+	sn.Tree = treeID
+	id, err := arch.repo.SaveJSONUnpacked(ctx, restic.SnapshotFile, sn)
+	if err != nil {
+		return err
+	}
+
+	debug.Log("saved checkpoint %v", id.Str())
+
+	if c.last != nil {
+		if err = arch.removeSnapshot(ctx, *c.last); err != nil {
+			return err
+		}
+	}
+	c.last = &id
+
+	return nil
+}
+
+// savePartialTree saves the tree with the nodes which have been completely
+// saved so far. While the tree is saved, no new blobs are added to the
+// repository, so all blobs referenced by the tree have been uploaded and are
+// contained in an index file when it returns. If nothing has been saved yet,
+// nil is returned.
+func (arch *Archiver) savePartialTree(ctx context.Context) (*restic.ID, error) {
+	c := arch.checkpoint
+
+	arch.blobLock.Lock()
+	defer arch.blobLock.Unlock()
+
+	c.m.Lock()
+	root := newPartialTree()
+	for path, node := range c.nodes {
+		root.insert(path, node)
+	}
+	c.m.Unlock()
+
+	if len(root.nodes) == 0 && len(root.subdirs) == 0 {
+		debug.Log("nothing saved yet, skipping checkpoint")
+		return nil, nil
+	}
+
+	treeID, err := root.save(ctx, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = arch.repo.Flush(); err != nil {
+		return nil, err
+	}
+
+	if err = arch.repo.SaveIndex(ctx); err != nil {
+		return nil, err
+	}
+
+	return &treeID, nil
+}
+
+// removeCheckpoints removes the checkpoints for the snapshot sn, which are
+// superseded by it.
+func (arch *Archiver) removeCheckpoints(ctx context.Context, sn *restic.Snapshot) error {
+	var ids restic.IDs
+	err := restic.ForAllSnapshots(ctx, arch.repo, func(id restic.ID, cp *restic.Snapshot, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if cp.Checkpoint && cp.Hostname == sn.Hostname &&
+			sameStrings(cp.Paths, sn.Paths) && cp.HasTags(sn.Tags) {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err = arch.removeSnapshot(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (arch *Archiver) removeSnapshot(ctx context.Context, id restic.ID) error {
+	debug.Log("remove checkpoint %v", id.Str())
+	return arch.repo.Backend().Remove(ctx, restic.Handle{Type: restic.SnapshotFile, Name: id.String()})
+}
@@ -0,0 +1,66 @@
+package archiver
+
+import (
+	"restic"
+	"sync"
+)
+
+// DryRunStats describes what a snapshot created with DryRun would have saved.
+type DryRunStats struct {
+	// ChangedFiles is the number of files which are new or have changed since
+	// the parent snapshot and have been read, ChangedBytes their size.
+	ChangedFiles uint64
+	ChangedBytes uint64
+
+	// UnchangedFiles is the number of files whose content is taken from the
+	// parent snapshot, UnchangedBytes their size.
+	UnchangedFiles uint64
+	UnchangedBytes uint64
+
+	// DataBlobs and TreeBlobs are the numbers of blobs which are not yet
+	// stored in the repository, UploadBytes is their size after encryption.
+	// The pack headers are not included.
+	DataBlobs   uint64
+	TreeBlobs   uint64
+	UploadBytes uint64
+}
+
+// dryRunStats collects the statistics from the concurrent workers.
+type dryRunStats struct {
+	m sync.Mutex
+	DryRunStats
+}
+
+func (s *dryRunStats) file(size uint64, changed bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if changed {
+		s.ChangedFiles++
+		s.ChangedBytes += size
+	} else {
+		s.UnchangedFiles++
+		s.UnchangedBytes += size
+	}
+}
+
+func (s *dryRunStats) blob(t restic.BlobType, size int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if t == restic.TreeBlob {
+		s.TreeBlobs++
+	} else {
+		s.DataBlobs++
+	}
+	s.UploadBytes += uint64(restic.CiphertextLength(size))
+}
+
+// DryRunStats returns what the last snapshot created with DryRun would have
+// saved.
+func (arch *Archiver) DryRunStats() DryRunStats {
+	arch.dryRun.m.Lock()
+	defer arch.dryRun.m.Unlock()
+
+	return arch.dryRun.DryRunStats
+}
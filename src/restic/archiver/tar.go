@@ -0,0 +1,369 @@
+package archiver
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"restic"
+	"restic/debug"
+	"restic/errors"
+)
+
+// TarImporter creates a snapshot from the contents of a tar archive, keeping
+// the metadata stored in the tar headers.
+type TarImporter struct {
+	restic.Repository
+
+	Tags     []string
+	Hostname string
+
+	// Path is recorded as the path of the snapshot, the contents of the
+	// archive are stored as if they were located in this directory. As for
+	// backups, the tree of the snapshot contains a directory named after the
+	// last component of Path.
+	Path string
+
+	// Warn is called for entries which cannot be imported, they are skipped.
+	Warn func(name string, err error)
+}
+
+// tarDir is a directory which is built from the entries in the archive.
+type tarDir struct {
+	node    *restic.Node
+	dirs    map[string]*tarDir
+	entries map[string]*restic.Node
+}
+
+func newTarDir(node *restic.Node) *tarDir {
+	return &tarDir{
+		node:    node,
+		dirs:    make(map[string]*tarDir),
+		entries: make(map[string]*restic.Node),
+	}
+}
+
+// tarImport holds the state while an archive is imported.
+type tarImport struct {
+	*TarImporter
+	sn *restic.Snapshot
+
+	// top is the root tree of the snapshot, root is the directory which
+	// receives the entries of the archive
+	top, root *tarDir
+
+	// files maps the paths of regular files to their nodes, for hard links
+	files map[string]*restic.Node
+
+	// links contains the nodes which share an inode number
+	links map[uint64][]*restic.Node
+	inode uint64
+}
+
+// Import reads the tar archive from rd and saves all entries in a new snapshot.
+func (t *TarImporter) Import(ctx context.Context, rd io.Reader, p *restic.Progress) (*restic.Snapshot, restic.ID, error) {
+	if t.Path == "" {
+		return nil, restic.ID{}, errors.New("no path given")
+	}
+
+	sn, err := restic.NewSnapshot([]string{t.Path}, t.Tags, t.Hostname)
+	if err != nil {
+		return nil, restic.ID{}, err
+	}
+
+	p.Start()
+	defer p.Done()
+
+	imp := &tarImport{
+		TarImporter: t,
+		sn:          sn,
+		top:         newTarDir(nil),
+		files:       make(map[string]*restic.Node),
+		links:       make(map[uint64][]*restic.Node),
+	}
+
+	imp.root = imp.top
+	if name := tarRootName(t.Path); name != "" {
+		imp.root = newTarDir(imp.newDirNode(name))
+		imp.top.dirs[name] = imp.root
+	}
+
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if errors.Cause(err) == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, restic.ID{}, errors.Wrap(err, "tar.Next")
+		}
+
+		if err = imp.add(ctx, hdr, tr, p); err != nil {
+			return nil, restic.ID{}, err
+		}
+	}
+
+	for _, nodes := range imp.links {
+		for _, node := range nodes {
+			node.Links = uint64(len(nodes))
+		}
+	}
+
+	treeID, err := imp.saveTree(ctx, imp.top, p)
+	if err != nil {
+		return nil, restic.ID{}, err
+	}
+	sn.Tree = &treeID
+	debug.Log("tree saved as %v", treeID.Str())
+
+	err = t.Repository.Flush()
+	if err != nil {
+		return nil, restic.ID{}, err
+	}
+
+	err = t.Repository.SaveIndex(ctx)
+	if err != nil {
+		return nil, restic.ID{}, err
+	}
+
+	id, err := t.Repository.SaveJSONUnpacked(ctx, restic.SnapshotFile, sn)
+	if err != nil {
+		return nil, restic.ID{}, err
+	}
+
+	debug.Log("snapshot saved as %v", id.Str())
+
+	return sn, id, nil
+}
+
+func (imp *tarImport) warn(name string, err error) {
+	debug.Log("skipping %v: %v", name, err)
+	if imp.Warn != nil {
+		imp.Warn(name, err)
+	}
+}
+
+// cleanTarName returns the cleaned path of an entry relative to the root of
+// the archive. Leading slashes and ".." components are removed.
+func cleanTarName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// tarRootName returns the name of the directory in the root tree of the
+// snapshot which contains the entries of the archive, which is the last
+// component of p. The empty string is returned when p is the root directory.
+func tarRootName(p string) string {
+	name := filepath.Base(filepath.Clean(p))
+	if name == string(filepath.Separator) || name == "." {
+		return ""
+	}
+	return name
+}
+
+// newDirNode returns the node for a directory which is not contained in the
+// archive.
+func (imp *tarImport) newDirNode(name string) *restic.Node {
+	imp.inode++
+	return &restic.Node{
+		Name:       name,
+		Type:       "dir",
+		Mode:       os.ModeDir | 0755,
+		ModTime:    imp.sn.Time,
+		AccessTime: imp.sn.Time,
+		ChangeTime: imp.sn.Time,
+		UID:        imp.sn.UID,
+		GID:        imp.sn.GID,
+		User:       imp.sn.Username,
+		Inode:      imp.inode,
+		Links:      1,
+	}
+}
+
+// dir returns the directory for the given path, missing directories are
+// created.
+func (imp *tarImport) dir(dirname string) *tarDir {
+	d := imp.root
+	if dirname == "" || dirname == "." {
+		return d
+	}
+
+	for _, name := range strings.Split(dirname, "/") {
+		sub, ok := d.dirs[name]
+		if !ok {
+			delete(d.entries, name)
+			sub = newTarDir(imp.newDirNode(name))
+			d.dirs[name] = sub
+		}
+		d = sub
+	}
+
+	return d
+}
+
+// mkdev returns the device number in the format used by Linux.
+func mkdev(major, minor int64) uint64 {
+	ma, mi := uint64(major), uint64(minor)
+	return ((ma & 0xfffff000) << 32) | ((ma & 0xfff) << 8) | ((mi & 0xffffff00) << 12) | (mi & 0xff)
+}
+
+// nodeFromHeader returns a node with the metadata from hdr.
+func nodeFromHeader(hdr *tar.Header, name string) *restic.Node {
+	mask := os.ModePerm | os.ModeType | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+	node := &restic.Node{
+		Name:       name,
+		Mode:       hdr.FileInfo().Mode() & mask,
+		ModTime:    hdr.ModTime,
+		AccessTime: hdr.AccessTime,
+		ChangeTime: hdr.ChangeTime,
+		UID:        uint32(hdr.Uid),
+		GID:        uint32(hdr.Gid),
+		User:       hdr.Uname,
+		Group:      hdr.Gname,
+		Links:      1,
+	}
+
+	if node.AccessTime.IsZero() {
+		node.AccessTime = node.ModTime
+	}
+
+	if node.ChangeTime.IsZero() {
+		node.ChangeTime = node.ModTime
+	}
+
+	var names []string
+	for name := range hdr.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node.ExtendedAttributes = append(node.ExtendedAttributes, restic.ExtendedAttribute{
+			Name:  name,
+			Value: []byte(hdr.Xattrs[name]),
+		})
+	}
+
+	return node
+}
+
+// add imports the entry described by hdr, the contents are read from rd.
+func (imp *tarImport) add(ctx context.Context, hdr *tar.Header, rd io.Reader, p *restic.Progress) error {
+	name := cleanTarName(hdr.Name)
+	if name == "" {
+		// the metadata of the root directory of the archive is kept for the
+		// directory named after the path
+		if hdr.Typeflag == tar.TypeDir && imp.root.node != nil {
+			node := nodeFromHeader(hdr, imp.root.node.Name)
+			node.Type = "dir"
+			node.Inode = imp.root.node.Inode
+			imp.root.node = node
+			return nil
+		}
+
+		debug.Log("ignoring entry %q for the root directory", hdr.Name)
+		return nil
+	}
+
+	dir := imp.dir(path.Dir(name))
+	base := path.Base(name)
+	node := nodeFromHeader(hdr, base)
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		d := imp.dir(name)
+		node.Type = "dir"
+		node.Inode = d.node.Inode
+		d.node = node
+		p.Report(restic.Stat{Dirs: 1})
+		return nil
+
+	case tar.TypeReg, tar.TypeRegA:
+		content, size, err := saveContent(ctx, imp.Repository, rd, p)
+		if err != nil {
+			return err
+		}
+
+		node.Type = "file"
+		node.Content = content
+		node.Size = size
+		imp.files[name] = node
+
+	case tar.TypeLink:
+		target, ok := imp.files[cleanTarName(hdr.Linkname)]
+		if !ok {
+			imp.warn(name, errors.Errorf("target %q of hard link not found", hdr.Linkname))
+			return nil
+		}
+
+		node.Type = "file"
+		node.Mode = target.Mode
+		node.Content = target.Content
+		node.Size = target.Size
+		node.Inode = target.Inode
+		imp.links[node.Inode] = append(imp.links[node.Inode], node)
+		imp.files[name] = node
+
+	case tar.TypeSymlink:
+		node.Type = "symlink"
+		node.LinkTarget = hdr.Linkname
+
+	case tar.TypeChar:
+		node.Type = "chardev"
+		node.Device = mkdev(hdr.Devmajor, hdr.Devminor)
+
+	case tar.TypeBlock:
+		node.Type = "dev"
+		node.Device = mkdev(hdr.Devmajor, hdr.Devminor)
+
+	case tar.TypeFifo:
+		node.Type = "fifo"
+
+	default:
+		imp.warn(name, errors.Errorf("unsupported type %q", hdr.Typeflag))
+		return nil
+	}
+
+	if node.Inode == 0 {
+		imp.inode++
+		node.Inode = imp.inode
+		imp.links[node.Inode] = []*restic.Node{node}
+	}
+
+	delete(dir.dirs, base)
+	dir.entries[base] = node
+	p.Report(restic.Stat{Files: 1})
+
+	return nil
+}
+
+// saveTree saves the tree for d and all subdirectories.
+func (imp *tarImport) saveTree(ctx context.Context, d *tarDir, p *restic.Progress) (restic.ID, error) {
+	tree := restic.NewTree()
+
+	for _, sub := range d.dirs {
+		id, err := imp.saveTree(ctx, sub, p)
+		if err != nil {
+			return restic.ID{}, err
+		}
+
+		sub.node.Subtree = &id
+		if err = tree.Insert(sub.node); err != nil {
+			return restic.ID{}, err
+		}
+	}
+
+	for _, node := range d.entries {
+		if err := tree.Insert(node); err != nil {
+			return restic.ID{}, err
+		}
+	}
+
+	return imp.Repository.SaveTree(ctx, tree)
+}
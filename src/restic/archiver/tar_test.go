@@ -0,0 +1,169 @@
+package archiver_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"restic"
+	"restic/archiver"
+	"restic/checker"
+	"restic/repository"
+	. "restic/test"
+)
+
+func findNode(t testing.TB, repo restic.Repository, treeID restic.ID, name string) *restic.Node {
+	tree, err := repo.LoadTree(context.TODO(), treeID)
+	OK(t, err)
+
+	for _, node := range tree.Nodes {
+		if node.Name == name {
+			return node
+		}
+	}
+
+	t.Fatalf("node %v not found in tree %v", name, treeID.Str())
+	return nil
+}
+
+func loadContent(t testing.TB, repo restic.Repository, node *restic.Node) []byte {
+	var data []byte
+	for _, id := range node.Content {
+		size, err := repo.LookupBlobSize(id, restic.DataBlob)
+		OK(t, err)
+
+		buf := restic.NewBlobBuffer(int(size))
+		n, err := repo.LoadBlob(context.TODO(), restic.DataBlob, id, buf)
+		OK(t, err)
+		data = append(data, buf[:n]...)
+	}
+	return data
+}
+
+func TestTarImporter(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	mtime := time.Date(2017, 5, 1, 10, 20, 30, 0, time.UTC)
+	content := Random(23, 3*1024*1024)
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+
+	var entries = []struct {
+		hdr  tar.Header
+		data []byte
+	}{
+		{tar.Header{Name: "./work/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: mtime, Uid: 1000, Gid: 100, Uname: "user"}, nil},
+		{tar.Header{Name: "./work/data.bin", Typeflag: tar.TypeReg, Mode: 0640, ModTime: mtime, Uid: 1000, Gid: 100,
+			Xattrs: map[string]string{"user.comment": "foo"}}, content},
+		{tar.Header{Name: "./work/link", Typeflag: tar.TypeSymlink, Linkname: "data.bin", Mode: 0777, ModTime: mtime}, nil},
+		{tar.Header{Name: "./work/hardlink", Typeflag: tar.TypeLink, Linkname: "./work/data.bin", ModTime: mtime}, nil},
+		{tar.Header{Name: "implicit/dir/file", Typeflag: tar.TypeReg, Mode: 0600, ModTime: mtime}, []byte("foobar")},
+		{tar.Header{Name: "../../evil", Typeflag: tar.TypeReg, Mode: 0600, ModTime: mtime}, []byte("x")},
+	}
+
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		OK(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write(e.data)
+		OK(t, err)
+	}
+	OK(t, tw.Close())
+
+	imp := &archiver.TarImporter{
+		Repository: repo,
+		Hostname:   "localhost",
+		Path:       "/",
+	}
+
+	sn, _, err := imp.Import(context.TODO(), buf, nil)
+	OK(t, err)
+	Equals(t, []string{"/"}, sn.Paths)
+
+	work := findNode(t, repo, *sn.Tree, "work")
+	Equals(t, "dir", work.Type)
+	Equals(t, os.ModeDir|0750, work.Mode)
+	Equals(t, uint32(1000), work.UID)
+	Equals(t, "user", work.User)
+	Assert(t, work.ModTime.Equal(mtime), "wrong mtime %v", work.ModTime)
+
+	file := findNode(t, repo, *work.Subtree, "data.bin")
+	Equals(t, "file", file.Type)
+	Equals(t, os.FileMode(0640), file.Mode)
+	Equals(t, uint64(len(content)), file.Size)
+	Equals(t, uint64(2), file.Links)
+	Equals(t, []byte("foo"), file.GetExtendedAttribute("user.comment"))
+	Assert(t, bytes.Equal(content, loadContent(t, repo, file)), "wrong content for data.bin")
+
+	hardlink := findNode(t, repo, *work.Subtree, "hardlink")
+	Equals(t, file.Inode, hardlink.Inode)
+	Equals(t, uint64(2), hardlink.Links)
+	Equals(t, file.Content, hardlink.Content)
+
+	link := findNode(t, repo, *work.Subtree, "link")
+	Equals(t, "symlink", link.Type)
+	Equals(t, "data.bin", link.LinkTarget)
+
+	dir := findNode(t, repo, *sn.Tree, "implicit")
+	dir = findNode(t, repo, *dir.Subtree, "dir")
+	Equals(t, "dir", dir.Type)
+	implicitFile := findNode(t, repo, *dir.Subtree, "file")
+	Equals(t, []byte("foobar"), loadContent(t, repo, implicitFile))
+
+	// ".." components do not leave the root directory
+	findNode(t, repo, *sn.Tree, "evil")
+
+	chkr := checker.New(repo)
+	hints, errs := chkr.LoadIndex(context.TODO())
+	Assert(t, len(errs) == 0 && len(hints) == 0, "errors loading index: %v %v", errs, hints)
+
+	errCh := make(chan error)
+	go chkr.Structure(context.TODO(), errCh)
+	for err := range errCh {
+		OK(t, err)
+	}
+}
+
+func TestTarImporterPath(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	mtime := time.Date(2017, 5, 1, 10, 20, 30, 0, time.UTC)
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	OK(t, tw.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0700, ModTime: mtime}))
+	OK(t, tw.WriteHeader(&tar.Header{Name: "./index.html", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, Size: 6}))
+	_, err := tw.Write([]byte("foobar"))
+	OK(t, err)
+	OK(t, tw.Close())
+
+	imp := &archiver.TarImporter{
+		Repository: repo,
+		Hostname:   "localhost",
+		Path:       "/srv/www",
+	}
+
+	sn, _, err := imp.Import(context.TODO(), buf, nil)
+	OK(t, err)
+	Equals(t, []string{"/srv/www"}, sn.Paths)
+
+	// the entries are stored in a directory named after the last component
+	// of the path, which has the metadata of the root directory of the archive
+	tree, err := repo.LoadTree(context.TODO(), *sn.Tree)
+	OK(t, err)
+	Equals(t, 1, len(tree.Nodes))
+
+	www := findNode(t, repo, *sn.Tree, "www")
+	Equals(t, "dir", www.Type)
+	Equals(t, os.ModeDir|0700, www.Mode)
+	Assert(t, www.ModTime.Equal(mtime), "wrong mtime %v", www.ModTime)
+
+	file := findNode(t, repo, *www.Subtree, "index.html")
+	Equals(t, []byte("foobar"), loadContent(t, repo, file))
+}
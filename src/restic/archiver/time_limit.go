@@ -0,0 +1,70 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"restic"
+	"restic/debug"
+	"restic/errors"
+)
+
+// ErrTimeLimit is returned by Snapshot if the time limit was reached before
+// all files have been saved. A partial snapshot with the files saved so far
+// has been stored instead, the next backup continues from it.
+var ErrTimeLimit = errors.New("time limit reached")
+
+// skippedResult is sent instead of a node for files which are not read
+// because the time limit has been reached, and for the directories which
+// contain them.
+type skippedResult struct{}
+
+// isSkipped returns true if res is the result for a skipped file or an
+// incomplete directory.
+func isSkipped(res interface{}) bool {
+	_, ok := res.(skippedResult)
+	return ok
+}
+
+// timeLimitReached returns true if a time limit is set and it has passed, so
+// no more files are read.
+func (arch *Archiver) timeLimitReached() bool {
+	return !arch.deadline.IsZero() && time.Now().After(arch.deadline)
+}
+
+// savePartialSnapshot saves sn as a partial snapshot with all files saved
+// before the time limit was reached. It is tagged with restic.PartialTag, and
+// the checkpoints of the backup are removed because they are superseded by it.
+func (arch *Archiver) savePartialSnapshot(ctx context.Context, sn *restic.Snapshot) (*restic.Snapshot, restic.ID, error) {
+	treeID, err := arch.savePartialTree(ctx)
+	if err != nil {
+		return nil, restic.ID{}, err
+	}
+
+	if treeID == nil {
+		return nil, restic.ID{}, errors.Fatal("time limit reached before any file was saved")
+	}
+
+	partial := *sn
+	partial.Tree = treeID
+	partial.Partial = true
+	partial.Tags = append([]string{}, sn.Tags...)
+	partial.AddTags([]string{restic.PartialTag})
+
+	id, err := arch.repo.SaveJSONUnpacked(ctx, restic.SnapshotFile, partial)
+	if err != nil {
+		return nil, restic.ID{}, err
+	}
+
+	debug.Log("time limit reached, saved partial snapshot %v", id.Str())
+
+	// the snapshot has been saved, so this is not an error for the backup
+	if err = arch.removeCheckpoints(ctx, sn); err != nil {
+		debug.Log("removing checkpoints returned an error: %v", err)
+		fmt.Fprintf(os.Stderr, "error removing checkpoints: %v\n", err)
+	}
+
+	return &partial, id, ErrTimeLimit
+}
@@ -38,6 +38,14 @@ type Backend interface {
 	List(ctx context.Context, t FileType) <-chan string
 }
 
+// BulkRemover is implemented by backends which can remove several files with
+// a single request.
+type BulkRemover interface {
+	// RemoveMulti removes all files in hs. An error is returned if at least
+	// one of the files could not be removed.
+	RemoveMulti(ctx context.Context, hs []Handle) error
+}
+
 // FileInfo is returned by Stat() and contains information about a file in the
 // backend.
 type FileInfo struct{ Size int64 }
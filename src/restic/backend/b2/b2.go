@@ -6,6 +6,7 @@ import (
 	"path"
 	"restic"
 	"strings"
+	"sync"
 
 	"restic/backend"
 	"restic/debug"
@@ -282,6 +283,46 @@ func (be *b2Backend) Remove(ctx context.Context, h restic.Handle) error {
 	return errors.Wrap(obj.Delete(ctx), "Delete")
 }
 
+// make sure that *b2Backend implements restic.BulkRemover
+var _ restic.BulkRemover = &b2Backend{}
+
+// RemoveMulti removes all files in hs. B2 does not offer a batch delete
+// request, so the files are removed concurrently, limited by the number of
+// connections.
+func (be *b2Backend) RemoveMulti(ctx context.Context, hs []restic.Handle) error {
+	errs := make(chan error, len(hs))
+	var wg sync.WaitGroup
+	for _, h := range hs {
+		wg.Add(1)
+		go func(h restic.Handle) {
+			defer wg.Done()
+			errs <- be.Remove(ctx, h)
+		}(h)
+	}
+	wg.Wait()
+	close(errs)
+
+	var (
+		firstErr error
+		failed   int
+	)
+	for err := range errs {
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		failed++
+	}
+
+	if firstErr != nil {
+		return errors.Errorf("unable to remove %d of %d files, first error: %v", failed, len(hs), firstErr)
+	}
+
+	return nil
+}
+
 // List returns a channel that yields all names of blobs of type t. A
 // goroutine is started for this. If the channel done is closed, sending
 // stops.
@@ -352,7 +393,13 @@ func (be *b2Backend) Delete(ctx context.Context) error {
 		restic.KeyFile,
 		restic.LockFile,
 		restic.SnapshotFile,
-		restic.IndexFile}
+		restic.IndexFile,
+		restic.DeletionFile,
+		restic.TrashFile,
+		restic.IntentFile,
+		restic.ConfigUpdateFile,
+		restic.DomainConfigFile,
+		restic.OperationFile}
 
 	for _, t := range alltypes {
 		err := be.removeKeys(ctx, t)
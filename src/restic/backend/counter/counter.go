@@ -0,0 +1,175 @@
+// Package counter implements a backend which counts the requests to another
+// backend and the number of bytes transferred.
+package counter
+
+import (
+	"context"
+	"io"
+	"restic"
+	"sync/atomic"
+
+	"restic/backend"
+	"restic/errors"
+)
+
+// Stats contains the number of requests and bytes transferred.
+type Stats struct {
+	Requests        uint64 `json:"requests"`
+	BytesUploaded   uint64 `json:"bytes_uploaded"`
+	BytesDownloaded uint64 `json:"bytes_downloaded"`
+}
+
+// Add returns the sum of s and other.
+func (s Stats) Add(other Stats) Stats {
+	return Stats{
+		Requests:        s.Requests + other.Requests,
+		BytesUploaded:   s.BytesUploaded + other.BytesUploaded,
+		BytesDownloaded: s.BytesDownloaded + other.BytesDownloaded,
+	}
+}
+
+// Backend passes all requests to another backend and counts them.
+type Backend struct {
+	// accessed atomically, must be the first fields for 64 bit alignment
+	requests, uploaded, downloaded uint64
+
+	be restic.Backend
+}
+
+// make sure that *Backend implements restic.Backend
+var _ restic.Backend = &Backend{}
+
+// New returns a backend which counts the requests to be.
+func New(be restic.Backend) *Backend {
+	return &Backend{be: be}
+}
+
+// Stats returns the number of requests and bytes transferred so far.
+func (be *Backend) Stats() Stats {
+	return Stats{
+		Requests:        atomic.LoadUint64(&be.requests),
+		BytesUploaded:   atomic.LoadUint64(&be.uploaded),
+		BytesDownloaded: atomic.LoadUint64(&be.downloaded),
+	}
+}
+
+func (be *Backend) request() {
+	atomic.AddUint64(&be.requests, 1)
+}
+
+// Location returns the location of the underlying backend.
+func (be *Backend) Location() string {
+	return be.be.Location()
+}
+
+// Test returns whether the file h exists.
+func (be *Backend) Test(ctx context.Context, h restic.Handle) (bool, error) {
+	be.request()
+	return be.be.Test(ctx, h)
+}
+
+// Remove removes the file h.
+func (be *Backend) Remove(ctx context.Context, h restic.Handle) error {
+	be.request()
+	return be.be.Remove(ctx, h)
+}
+
+// Close closes the underlying backend.
+func (be *Backend) Close() error {
+	return be.be.Close()
+}
+
+// Save stores the data read from rd under the handle h. If the size of the
+// data can be determined in advance, rd is passed to the underlying backend
+// unchanged, since some backends need to know the size.
+func (be *Backend) Save(ctx context.Context, h restic.Handle, rd io.Reader) error {
+	be.request()
+
+	size, ok := backend.RemainingSize(rd)
+	if !ok {
+		return be.be.Save(ctx, h, countingReader{Reader: rd, n: &be.uploaded})
+	}
+
+	err := be.be.Save(ctx, h, rd)
+	if err == nil {
+		atomic.AddUint64(&be.uploaded, uint64(size))
+	}
+	return err
+}
+
+// Load returns a reader that yields the contents of the file h.
+func (be *Backend) Load(ctx context.Context, h restic.Handle, length int, offset int64) (io.ReadCloser, error) {
+	be.request()
+	rd, err := be.be.Load(ctx, h, length, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return countingReadCloser{ReadCloser: rd, n: &be.downloaded}, nil
+}
+
+// Stat returns information about the file h.
+func (be *Backend) Stat(ctx context.Context, h restic.Handle) (restic.FileInfo, error) {
+	be.request()
+	return be.be.Stat(ctx, h)
+}
+
+// List returns a channel that yields the names of all files of type t.
+func (be *Backend) List(ctx context.Context, t restic.FileType) <-chan string {
+	be.request()
+	return be.be.List(ctx, t)
+}
+
+// make sure that *Backend implements restic.BulkRemover
+var _ restic.BulkRemover = &Backend{}
+
+// RemoveMulti removes all files in hs with a single request if the underlying
+// backend supports this, and one by one otherwise.
+func (be *Backend) RemoveMulti(ctx context.Context, hs []restic.Handle) error {
+	bulk, ok := be.be.(restic.BulkRemover)
+	if !ok {
+		var firstErr error
+		for _, h := range hs {
+			if err := be.Remove(ctx, h); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	be.request()
+	return bulk.RemoveMulti(ctx, hs)
+}
+
+// Delete removes the repository if the underlying backend supports this.
+func (be *Backend) Delete(ctx context.Context) error {
+	d, ok := be.be.(restic.Deleter)
+	if !ok {
+		return errors.New("Delete() called for backend that does not implement this method")
+	}
+
+	be.request()
+	return d.Delete(ctx)
+}
+
+type countingReader struct {
+	io.Reader
+	n *uint64
+}
+
+func (rd countingReader) Read(p []byte) (int, error) {
+	n, err := rd.Reader.Read(p)
+	atomic.AddUint64(rd.n, uint64(n))
+	return n, err
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n *uint64
+}
+
+func (rd countingReadCloser) Read(p []byte) (int, error) {
+	n, err := rd.ReadCloser.Read(p)
+	atomic.AddUint64(rd.n, uint64(n))
+	return n, err
+}
@@ -0,0 +1,101 @@
+package counter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"restic"
+	"testing"
+
+	"restic/backend"
+	"restic/backend/mem"
+	"restic/backend/test"
+	rtest "restic/test"
+)
+
+type counterConfig struct {
+	be *mem.MemoryBackend
+}
+
+func newTestSuite() *test.Suite {
+	return &test.Suite{
+		// NewConfig returns a config for a new temporary backend that will be used in tests.
+		NewConfig: func() (interface{}, error) {
+			return &counterConfig{}, nil
+		},
+
+		// CreateFn is a function that creates a temporary repository for the tests.
+		Create: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(*counterConfig)
+			if cfg.be != nil {
+				ok, err := cfg.be.Test(context.TODO(), restic.Handle{Type: restic.ConfigFile})
+				if err != nil {
+					return nil, err
+				}
+
+				if ok {
+					return nil, errors.New("config already exists")
+				}
+			}
+
+			cfg.be = mem.New()
+			return New(cfg.be), nil
+		},
+
+		// OpenFn is a function that opens a previously created temporary repository.
+		Open: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(*counterConfig)
+			if cfg.be == nil {
+				cfg.be = mem.New()
+			}
+			return New(cfg.be), nil
+		},
+
+		// CleanupFn removes data created during the tests.
+		Cleanup: func(config interface{}) error {
+			// no cleanup needed
+			return nil
+		},
+	}
+}
+
+func TestSuiteBackendCounter(t *testing.T) {
+	newTestSuite().RunTests(t)
+}
+
+// plainReader hides the Len() method of the reader, so that the size cannot
+// be determined in advance.
+type plainReader struct {
+	io.Reader
+}
+
+func TestCounter(t *testing.T) {
+	ctx := context.TODO()
+	be := New(mem.New())
+
+	data := []byte("foobar")
+	h1 := restic.Handle{Type: restic.DataFile, Name: "1"}
+	h2 := restic.Handle{Type: restic.DataFile, Name: "2"}
+	rtest.OK(t, be.Save(ctx, h1, bytes.NewReader(data)))
+	rtest.OK(t, be.Save(ctx, h2, plainReader{bytes.NewReader(data)}))
+	rtest.Equals(t, Stats{Requests: 2, BytesUploaded: 12}, be.Stats())
+
+	buf, err := backend.LoadAll(ctx, be, h1)
+	rtest.OK(t, err)
+	rtest.Equals(t, data, buf)
+
+	rd, err := be.Load(ctx, h2, 3, 1)
+	rtest.OK(t, err)
+	_, err = io.Copy(ioutil.Discard, rd)
+	rtest.OK(t, err)
+	rtest.OK(t, rd.Close())
+
+	_, err = be.Stat(ctx, h1)
+	rtest.OK(t, err)
+	rtest.OK(t, be.RemoveMulti(ctx, []restic.Handle{h1, h2}))
+
+	rtest.Equals(t, Stats{Requests: 7, BytesUploaded: 12, BytesDownloaded: 9}, be.Stats())
+	rtest.Equals(t, Stats{Requests: 8, BytesUploaded: 13, BytesDownloaded: 10}, be.Stats().Add(Stats{1, 1, 1}))
+}
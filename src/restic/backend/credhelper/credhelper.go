@@ -0,0 +1,222 @@
+// Package credhelper obtains credentials for a backend from an external
+// program, the credential helper. The helper is run again when the
+// credentials it returned before are about to expire, so that long running
+// operations can use short-lived credentials (e.g. temporary security
+// credentials for S3).
+//
+// The helper receives a JSON encoded Request on stdin and prints a JSON
+// encoded Credentials object to stdout. Messages printed to stderr are
+// passed on to the user. When the helper exits with a non-zero status, the
+// credentials could not be obtained.
+package credhelper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"restic/debug"
+	"restic/errors"
+	"restic/shell"
+)
+
+// ProtocolVersion is the version of the protocol sent in each Request.
+const ProtocolVersion = 1
+
+// Reasons why the helper is run.
+const (
+	ReasonInitial  = "initial"
+	ReasonExpired  = "expired"
+	ReasonRejected = "rejected"
+)
+
+// Request describes the credentials which are requested from the helper.
+type Request struct {
+	Version  int    `json:"version"`
+	Backend  string `json:"backend"`
+	Location string `json:"location"`
+	Reason   string `json:"reason"`
+}
+
+// Credentials are returned by the helper. Which fields must be set depends
+// on the backend.
+type Credentials struct {
+	// used by the s3 backend
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+
+	// used by the rest backend, a token is sent as a bearer token instead
+	// of the user name and password
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+
+	// TTL is the number of seconds the credentials are valid. Alternatively,
+	// the time at which they expire can be set in Expiration. When neither
+	// is set, the credentials do not expire.
+	TTL        int64      `json:"ttl,omitempty"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+// helperTimeout is the time the helper may take to print the credentials.
+const helperTimeout = 2 * time.Minute
+
+// maxRefreshWindow is the longest time before the credentials expire at
+// which the helper is run again.
+const maxRefreshWindow = time.Minute
+
+// Helper runs a credential helper and caches the credentials until they
+// expire. It is safe for concurrent use.
+type Helper struct {
+	backend  string
+	location string
+
+	m        sync.Mutex
+	creds    *Credentials
+	refresh  time.Time
+	rejected bool
+
+	now func() time.Time
+	run func(req Request) ([]byte, error)
+}
+
+// New returns a Helper which runs command to obtain the credentials for the
+// backend at location. The command is split into arguments like a shell
+// does.
+func New(command, backend, location string) (*Helper, error) {
+	program, args, err := shell.SplitArgs(command)
+	if err != nil {
+		return nil, errors.Fatalf("invalid credential helper %q: %v", command, err)
+	}
+
+	h := &Helper{
+		backend:  backend,
+		location: location,
+		now:      time.Now,
+	}
+
+	h.run = func(req Request) ([]byte, error) {
+		return runHelper(program, args, req)
+	}
+
+	return h, nil
+}
+
+func runHelper(program string, args []string, req Request) ([]byte, error) {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), helperTimeout)
+	defer cancel()
+
+	debug.Log("run credential helper %v %v, reason %v", program, args, req.Reason)
+
+	cmd := exec.CommandContext(ctx, program, args...)
+	cmd.Stdin = bytes.NewReader(buf)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Fatalf("credential helper %v failed: %v", program, err)
+	}
+
+	return out, nil
+}
+
+// Get returns the credentials. The helper is run when no credentials have
+// been obtained yet, when they are about to expire or when they have been
+// rejected by the server.
+func (h *Helper) Get() (Credentials, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.creds != nil && !h.expired() {
+		return *h.creds, nil
+	}
+
+	req := Request{
+		Version:  ProtocolVersion,
+		Backend:  h.backend,
+		Location: h.location,
+		Reason:   ReasonInitial,
+	}
+
+	switch {
+	case h.rejected:
+		req.Reason = ReasonRejected
+	case h.creds != nil:
+		req.Reason = ReasonExpired
+	}
+
+	out, err := h.run(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var creds Credentials
+	if err = json.Unmarshal(out, &creds); err != nil {
+		return Credentials{}, errors.Fatalf("credential helper returned invalid credentials: %v", err)
+	}
+
+	if creds.TTL < 0 {
+		return Credentials{}, errors.Fatalf("credential helper returned negative TTL %d", creds.TTL)
+	}
+
+	now := h.now()
+	var expires time.Time
+	switch {
+	case creds.TTL > 0:
+		expires = now.Add(time.Duration(creds.TTL) * time.Second)
+	case creds.Expiration != nil:
+		expires = *creds.Expiration
+	}
+
+	h.refresh = time.Time{}
+	if !expires.IsZero() {
+		// run the helper again a bit before the credentials expire, so
+		// that no request is sent with expired credentials
+		window := expires.Sub(now) / 10
+		if window > maxRefreshWindow {
+			window = maxRefreshWindow
+		}
+		h.refresh = expires.Add(-window)
+		debug.Log("credentials expire at %v, refresh at %v", expires, h.refresh)
+	}
+
+	h.creds = &creds
+	h.rejected = false
+	return creds, nil
+}
+
+func (h *Helper) expired() bool {
+	if h.rejected {
+		return true
+	}
+
+	return !h.refresh.IsZero() && !h.now().Before(h.refresh)
+}
+
+// Expired returns true if the next call to Get will run the helper.
+func (h *Helper) Expired() bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.creds == nil || h.expired()
+}
+
+// Expire marks the credentials as rejected by the server, the next call to
+// Get runs the helper again.
+func (h *Helper) Expire() {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.creds != nil {
+		h.rejected = true
+	}
+}
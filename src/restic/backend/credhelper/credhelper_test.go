@@ -0,0 +1,192 @@
+package credhelper
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+type fakeHelper struct {
+	reasons []string
+	out     []string
+}
+
+func (f *fakeHelper) run(req Request) ([]byte, error) {
+	if req.Version != ProtocolVersion || req.Backend != "s3" || req.Location != "bucket/prefix" {
+		return nil, fmt.Errorf("invalid request %#v", req)
+	}
+
+	f.reasons = append(f.reasons, req.Reason)
+	out := f.out[0]
+	if len(f.out) > 1 {
+		f.out = f.out[1:]
+	}
+	return []byte(out), nil
+}
+
+func newTestHelper(f *fakeHelper, now *time.Time) *Helper {
+	return &Helper{
+		backend:  "s3",
+		location: "bucket/prefix",
+		now:      func() time.Time { return *now },
+		run:      f.run,
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHelperTTL(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	f := &fakeHelper{out: []string{
+		`{"access_key_id": "key1", "secret_access_key": "secret", "ttl": 3600}`,
+		`{"access_key_id": "key2", "secret_access_key": "secret", "ttl": 3600}`,
+		`{"access_key_id": "key3", "secret_access_key": "secret"}`,
+	}}
+	h := newTestHelper(f, &now)
+
+	if !h.Expired() {
+		t.Fatalf("helper without credentials is not expired")
+	}
+
+	var tests = []struct {
+		now   time.Duration
+		keyID string
+	}{
+		{0, "key1"},
+		{time.Minute, "key1"},
+		{58 * time.Minute, "key1"},
+		{59 * time.Minute, "key2"},
+		{time.Hour + 57*time.Minute, "key2"},
+		{time.Hour + 58*time.Minute, "key3"},
+		{1000 * time.Hour, "key3"},
+	}
+
+	start := now
+	for _, test := range tests {
+		now = start.Add(test.now)
+		creds, err := h.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if creds.AccessKeyID != test.keyID {
+			t.Errorf("at %v: want key %v, got %v", test.now, test.keyID, creds.AccessKeyID)
+		}
+	}
+
+	want := []string{ReasonInitial, ReasonExpired, ReasonExpired}
+	if !equalStrings(f.reasons, want) {
+		t.Fatalf("wrong reasons, want %v, got %v", want, f.reasons)
+	}
+}
+
+func TestHelperExpiration(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	expiration, err := json.Marshal(now.Add(100 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeHelper{out: []string{fmt.Sprintf(`{"username": "user", "password": "pw", "expiration": %s}`, expiration)}}
+	h := newTestHelper(f, &now)
+
+	if _, err = h.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	// refreshed 10s before the credentials expire
+	now = now.Add(89 * time.Second)
+	if h.Expired() {
+		t.Fatalf("credentials expired too early")
+	}
+
+	now = now.Add(time.Second)
+	if !h.Expired() {
+		t.Fatalf("credentials not expired")
+	}
+}
+
+func TestHelperExpire(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	f := &fakeHelper{out: []string{`{"token": "foo"}`}}
+	h := newTestHelper(f, &now)
+
+	// nothing to expire yet
+	h.Expire()
+
+	for i := 0; i < 3; i++ {
+		if _, err := h.Get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h.Expire()
+	if !h.Expired() {
+		t.Fatalf("credentials not expired")
+	}
+
+	creds, err := h.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if creds.Token != "foo" {
+		t.Fatalf("wrong token %q", creds.Token)
+	}
+
+	want := []string{ReasonInitial, ReasonRejected}
+	if !equalStrings(f.reasons, want) {
+		t.Fatalf("wrong reasons, want %v, got %v", want, f.reasons)
+	}
+}
+
+func TestHelperInvalidOutput(t *testing.T) {
+	now := time.Now()
+	for _, out := range []string{"", "foo", `{"ttl": -5}`, `{"ttl": "x"}`} {
+		h := newTestHelper(&fakeHelper{out: []string{out}}, &now)
+		if _, err := h.Get(); err == nil {
+			t.Errorf("no error for helper output %q", out)
+		}
+	}
+}
+
+func TestHelperCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on Windows")
+	}
+
+	h, err := New(`sh -c 'grep -q "\"reason\":\"initial\"" && echo "{\"token\": \"secret\"}"'`, "rest", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := h.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if creds.Token != "secret" {
+		t.Fatalf("wrong token %q", creds.Token)
+	}
+
+	h, err = New("sh -c 'exit 1'", "rest", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = h.Get(); err == nil {
+		t.Fatalf("no error for failing helper")
+	}
+}
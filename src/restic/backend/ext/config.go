@@ -0,0 +1,56 @@
+package ext
+
+import (
+	"strings"
+
+	"restic/errors"
+	"restic/options"
+)
+
+// Config contains the name of the helper program and the location passed to
+// it.
+type Config struct {
+	Name     string
+	Location string
+	Command  string `option:"command" help:"run this program instead of restic-backend-<name>"`
+}
+
+func init() {
+	options.Register("ext", Config{})
+}
+
+// ParseConfig parses the string s and extracts the config for an external
+// backend. The format is ext:name:location, restic runs the helper program
+// restic-backend-name with the location as its argument.
+func ParseConfig(s string) (interface{}, error) {
+	if !strings.HasPrefix(s, "ext:") {
+		return nil, errors.New(`invalid format, does not start with "ext:"`)
+	}
+
+	data := strings.SplitN(s[4:], ":", 2)
+	name := data[0]
+	if name == "" {
+		return nil, errors.New("ext: name of the helper not found")
+	}
+
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return nil, errors.Errorf("ext: invalid character %q in helper name %q", c, name)
+		}
+	}
+
+	cfg := Config{Name: name}
+	if len(data) > 1 {
+		cfg.Location = data[1]
+	}
+
+	return cfg, nil
+}
+
+// program returns the helper program to run.
+func (cfg Config) program() string {
+	if cfg.Command != "" {
+		return cfg.Command
+	}
+	return "restic-backend-" + cfg.Name
+}
@@ -0,0 +1,55 @@
+package ext
+
+import (
+	"reflect"
+	"testing"
+)
+
+var configTests = []struct {
+	s   string
+	cfg Config
+}{
+	{"ext:tahoe:URI:DIR2:abcdef", Config{
+		Name:     "tahoe",
+		Location: "URI:DIR2:abcdef",
+	}},
+	{"ext:tape-robot:/dev/nst0", Config{
+		Name:     "tape-robot",
+		Location: "/dev/nst0",
+	}},
+	{"ext:ipfs", Config{
+		Name: "ipfs",
+	}},
+}
+
+func TestParseConfig(t *testing.T) {
+	for i, test := range configTests {
+		cfg, err := ParseConfig(test.s)
+		if err != nil {
+			t.Errorf("test %d:%s failed: %v", i, test.s, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(cfg, test.cfg) {
+			t.Errorf("test %d:\ninput:\n  %s\n wrong config, want:\n  %v\ngot:\n  %v",
+				i, test.s, test.cfg, cfg)
+			continue
+		}
+	}
+}
+
+var invalidConfigTests = []string{
+	"ext:",
+	"ext::/srv/repo",
+	"ext:../bin/foo:/srv/repo",
+	"ext:foo bar:/srv/repo",
+	"local:/srv/repo",
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for _, s := range invalidConfigTests {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("no error for invalid config %q", s)
+		}
+	}
+}
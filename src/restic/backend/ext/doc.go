@@ -0,0 +1,36 @@
+// Package ext implements repository storage via an external helper program,
+// similar to the remote helpers of git. This allows using storage systems
+// restic does not support itself without changing restic.
+//
+// For the location ext:name:location, restic runs the program
+// restic-backend-name (found in $PATH) with location as the only argument and
+// talks to it via stdin and stdout. Messages on stderr are printed by restic.
+//
+// The helper starts by writing the line "restic-backend 1". Afterwards,
+// restic sends commands, one per line, with the arguments separated by
+// single spaces. TYPE is one of data, key, lock, snapshot, index, config,
+// deletion and trash, NAME is the name of the file (for the config file, it
+// is always "config"):
+//
+//	open                          use the repository at the location
+//	create                        create a new repository at the location
+//	stat TYPE NAME                reply "ok SIZE" with the size of the file
+//	load TYPE NAME OFFSET LENGTH  reply "ok N", followed by N bytes of the
+//	                              file starting at OFFSET; LENGTH 0 means
+//	                              until the end of the file
+//	save TYPE NAME LENGTH         followed by LENGTH bytes to store as the
+//	                              file, reply "ok"
+//	remove TYPE NAME              reply "ok"
+//	list TYPE                     reply "ok", followed by the names of all
+//	                              files of the type, one per line, and an
+//	                              empty line
+//	quit                          no reply, the helper exits
+//
+// The first command is always open or create. Instead of "ok", every command
+// may be answered with "notfound" if the file does not exist or with
+// "error MESSAGE". Commands are sent one at a time, restic waits for the reply
+// before sending the next command.
+//
+// Helpers written in Go can use Serve, which implements the protocol on top
+// of a restic.Backend.
+package ext
@@ -0,0 +1,416 @@
+package ext
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"restic"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"restic/debug"
+	"restic/errors"
+)
+
+// greeting is the first line written by a helper.
+const greeting = "restic-backend 1"
+
+// errNotFound is returned when the helper replies "notfound".
+var errNotFound = errors.New("file does not exist")
+
+// Backend is a backend which is implemented by an external helper program.
+type Backend struct {
+	Config
+
+	cmd    *exec.Cmd
+	result <-chan error
+
+	// m serializes the commands sent to the helper
+	m  sync.Mutex
+	wr io.WriteCloser
+	rd *bufio.Reader
+}
+
+var _ restic.Backend = &Backend{}
+
+// start runs the helper and checks the greeting.
+func start(cfg Config) (*Backend, error) {
+	program := cfg.program()
+	debug.Log("start helper %v %v", program, cfg.Location)
+	cmd := exec.Command(program, cfg.Location)
+
+	// prefix the errors with the program name
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cmd.StderrPipe")
+	}
+
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			fmt.Fprintf(os.Stderr, "subprocess %v: %v\n", program, sc.Text())
+		}
+	}()
+
+	// ignore signals sent to the parent (e.g. SIGINT)
+	cmd.SysProcAttr = ignoreSigIntProcAttr()
+
+	wr, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cmd.StdinPipe")
+	}
+	rd, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cmd.StdoutPipe")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "cmd.Start")
+	}
+
+	ch := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		debug.Log("helper exited, err %v", err)
+		ch <- errors.Wrap(err, "cmd.Wait")
+	}()
+
+	be := &Backend{
+		Config: cfg,
+		cmd:    cmd,
+		result: ch,
+		wr:     wr,
+		rd:     bufio.NewReader(rd),
+	}
+
+	line, err := be.readLine()
+	if err != nil {
+		_ = be.Close()
+		return nil, errors.Errorf("unable to start helper %v: %v", program, err)
+	}
+
+	if line != greeting {
+		_ = be.Close()
+		return nil, errors.Errorf("helper %v sent an unknown greeting %q", program, line)
+	}
+
+	return be, nil
+}
+
+// Open runs the helper for the repository described by the config.
+func Open(cfg Config) (*Backend, error) {
+	debug.Log("open backend with config %#v", cfg)
+
+	be, err := start(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = be.command(nil, "open"); err != nil {
+		_ = be.Close()
+		return nil, err
+	}
+
+	return be, nil
+}
+
+// Create runs the helper and creates a new repository as described by the
+// config.
+func Create(cfg Config) (*Backend, error) {
+	debug.Log("create backend with config %#v", cfg)
+
+	be, err := start(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = be.command(nil, "create"); err != nil {
+		_ = be.Close()
+		return nil, err
+	}
+
+	// test if config file already exists
+	ok, err := be.Test(context.TODO(), restic.Handle{Type: restic.ConfigFile})
+	if err == nil && ok {
+		err = errors.New("config file already exists")
+	}
+	if err != nil {
+		_ = be.Close()
+		return nil, err
+	}
+
+	return be, nil
+}
+
+// Location returns the location passed to the helper.
+func (be *Backend) Location() string {
+	return be.Config.Location
+}
+
+// readLine reads a line from the helper and returns it without the newline.
+func (be *Backend) readLine() (string, error) {
+	line, err := be.rd.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", errors.Wrap(err, "read")
+	}
+
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// send sends the command with the arguments to the helper, followed by
+// data, and reads the status line of the reply. The rest of the status line
+// after "ok" is returned. The caller must hold be.m.
+func (be *Backend) send(data []byte, args ...string) (string, error) {
+	if _, err := fmt.Fprintf(be.wr, "%s\n", strings.Join(args, " ")); err != nil {
+		return "", errors.Wrap(err, "write")
+	}
+
+	if data != nil {
+		if _, err := be.wr.Write(data); err != nil {
+			return "", errors.Wrap(err, "write")
+		}
+	}
+
+	line, err := be.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case line == "ok":
+		return "", nil
+	case strings.HasPrefix(line, "ok "):
+		return line[3:], nil
+	case line == "notfound":
+		return "", errNotFound
+	case strings.HasPrefix(line, "error "):
+		return "", errors.Errorf("%v: %s", be.program(), line[6:])
+	}
+
+	return "", errors.Errorf("%v: invalid reply %q to %v", be.program(), line, args[0])
+}
+
+// command is like send, but locks be.m.
+func (be *Backend) command(data []byte, args ...string) (string, error) {
+	be.m.Lock()
+	defer be.m.Unlock()
+
+	return be.send(data, args...)
+}
+
+// handleArgs returns the type and name of h as sent to the helper.
+func handleArgs(h restic.Handle) ([]string, error) {
+	if err := h.Valid(); err != nil {
+		return nil, err
+	}
+
+	if h.Type == restic.ConfigFile {
+		return []string{string(h.Type), "config"}, nil
+	}
+
+	if strings.ContainsAny(h.Name, " \t\r\n") {
+		return nil, errors.Errorf("invalid name %q", h.Name)
+	}
+
+	return []string{string(h.Type), h.Name}, nil
+}
+
+// Save stores data in the backend at the handle.
+func (be *Backend) Save(ctx context.Context, h restic.Handle, rd io.Reader) error {
+	debug.Log("Save %v", h)
+	args, err := handleArgs(h)
+	if err != nil {
+		return err
+	}
+
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return errors.Wrap(err, "ReadAll")
+	}
+
+	args = append([]string{"save"}, args...)
+	_, err = be.command(buf, append(args, strconv.Itoa(len(buf)))...)
+	return err
+}
+
+// Load returns a reader that yields the contents of the file at h at the
+// given offset. If length is nonzero, only a portion of the file is
+// returned. rd must be closed after use.
+func (be *Backend) Load(ctx context.Context, h restic.Handle, length int, offset int64) (io.ReadCloser, error) {
+	debug.Log("Load %v, length %v, offset %v", h, length, offset)
+	args, err := handleArgs(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < 0 {
+		return nil, errors.New("offset is negative")
+	}
+
+	if length < 0 {
+		return nil, errors.Errorf("invalid length %d", length)
+	}
+
+	be.m.Lock()
+	defer be.m.Unlock()
+
+	args = append([]string{"load"}, args...)
+	res, err := be.send(nil, append(args, strconv.FormatInt(offset, 10), strconv.Itoa(length))...)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(res)
+	if err != nil || n < 0 {
+		return nil, errors.Errorf("%v: invalid length %q in reply to load", be.program(), res)
+	}
+
+	// the reply must be read completely before the next command is sent
+	buf := make([]byte, n)
+	if _, err = io.ReadFull(be.rd, buf); err != nil {
+		return nil, errors.Wrap(err, "ReadFull")
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+// Stat returns information about a file in the backend.
+func (be *Backend) Stat(ctx context.Context, h restic.Handle) (restic.FileInfo, error) {
+	debug.Log("Stat %v", h)
+	args, err := handleArgs(h)
+	if err != nil {
+		return restic.FileInfo{}, err
+	}
+
+	res, err := be.command(nil, append([]string{"stat"}, args...)...)
+	if err != nil {
+		return restic.FileInfo{}, err
+	}
+
+	size, err := strconv.ParseInt(res, 10, 64)
+	if err != nil {
+		return restic.FileInfo{}, errors.Errorf("%v: invalid size %q in reply to stat", be.program(), res)
+	}
+
+	return restic.FileInfo{Size: size}, nil
+}
+
+// Test returns true if a file of the given type and name exists in the
+// backend.
+func (be *Backend) Test(ctx context.Context, h restic.Handle) (bool, error) {
+	debug.Log("Test %v", h)
+	_, err := be.Stat(ctx, h)
+	if err == errNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Remove removes the file at the handle.
+func (be *Backend) Remove(ctx context.Context, h restic.Handle) error {
+	debug.Log("Remove %v", h)
+	args, err := handleArgs(h)
+	if err != nil {
+		return err
+	}
+
+	_, err = be.command(nil, append([]string{"remove"}, args...)...)
+	return err
+}
+
+// List returns a channel that yields all names of files of type t. A
+// goroutine is started for this. If the context is cancelled, sending stops.
+func (be *Backend) List(ctx context.Context, t restic.FileType) <-chan string {
+	debug.Log("List %v", t)
+
+	ch := make(chan string)
+
+	names, err := be.list(t)
+	if err != nil {
+		debug.Log("list %v failed: %v", t, err)
+		close(ch)
+		return ch
+	}
+
+	go func() {
+		defer close(ch)
+		for _, name := range names {
+			select {
+			case ch <- name:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// list reads the names of all files of type t from the helper.
+func (be *Backend) list(t restic.FileType) (names []string, err error) {
+	be.m.Lock()
+	defer be.m.Unlock()
+
+	if _, err = be.send(nil, "list", string(t)); err != nil {
+		return nil, err
+	}
+
+	for {
+		line, err := be.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if line == "" {
+			return names, nil
+		}
+
+		names = append(names, line)
+	}
+}
+
+var closeTimeout = 2 * time.Second
+
+// Close asks the helper to exit and waits for it.
+func (be *Backend) Close() error {
+	debug.Log("")
+	if be == nil {
+		return nil
+	}
+
+	be.m.Lock()
+	defer be.m.Unlock()
+
+	_, _ = fmt.Fprintf(be.wr, "quit\n")
+	_ = be.wr.Close()
+
+	// wait for closeTimeout before killing the process
+	select {
+	case err := <-be.result:
+		return err
+	case <-time.After(closeTimeout):
+	}
+
+	if err := be.cmd.Process.Kill(); err != nil {
+		return err
+	}
+
+	// get the error, but ignore it
+	<-be.result
+	return nil
+}
@@ -0,0 +1,103 @@
+package ext_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"restic"
+	"testing"
+
+	"restic/backend/ext"
+	"restic/backend/local"
+	"restic/backend/test"
+	. "restic/test"
+)
+
+// helperEnv is set when the test binary runs as the helper program.
+const helperEnv = "RESTIC_TEST_EXT_HELPER"
+
+// TestMain runs the test binary as a helper which serves a local backend
+// when helperEnv is set.
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) != "" {
+		cfg := local.Config{Path: os.Args[1]}
+		err := ext.Serve(context.Background(), os.Stdin, os.Stdout, func(create bool) (restic.Backend, error) {
+			if create {
+				return local.Create(cfg)
+			}
+			return local.Open(cfg)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// the helpers started by the tests inherit the environment
+	if err := os.Setenv(helperEnv, "1"); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+func newTestSuite(t testing.TB) *test.Suite {
+	return &test.Suite{
+		// NewConfig returns a config for a new temporary backend that will be used in tests.
+		NewConfig: func() (interface{}, error) {
+			dir, err := ioutil.TempDir(TestTempDir, "restic-test-ext-")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Logf("create new backend at %v", dir)
+
+			cfg := ext.Config{
+				Name:     "test",
+				Location: dir,
+				Command:  os.Args[0],
+			}
+			return cfg, nil
+		},
+
+		// CreateFn is a function that creates a temporary repository for the tests.
+		Create: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(ext.Config)
+			return ext.Create(cfg)
+		},
+
+		// OpenFn is a function that opens a previously created temporary repository.
+		Open: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(ext.Config)
+			return ext.Open(cfg)
+		},
+
+		// CleanupFn removes data created during the tests.
+		Cleanup: func(config interface{}) error {
+			cfg := config.(ext.Config)
+			if !TestCleanupTempDirs {
+				t.Logf("leaving test backend dir at %v", cfg.Location)
+			}
+
+			RemoveAll(t, cfg.Location)
+			return nil
+		},
+	}
+}
+
+func TestBackendExt(t *testing.T) {
+	newTestSuite(t).RunTests(t)
+}
+
+func BenchmarkBackendExt(t *testing.B) {
+	newTestSuite(t).RunBenchmarks(t)
+}
+
+func TestOpenMissingHelper(t *testing.T) {
+	_, err := ext.Open(ext.Config{Name: "does-not-exist-2f6c"})
+	if err == nil {
+		t.Fatal("no error returned for a missing helper")
+	}
+}
@@ -0,0 +1,13 @@
+// +build !windows
+
+package ext
+
+import (
+	"syscall"
+)
+
+// ignoreSigIntProcAttr returns a syscall.SysProcAttr that
+// disables SIGINT on parent.
+func ignoreSigIntProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
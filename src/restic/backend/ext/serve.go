@@ -0,0 +1,217 @@
+package ext
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"restic"
+	"strconv"
+	"strings"
+
+	"restic/errors"
+)
+
+// server implements the helper side of the protocol for a restic.Backend.
+type server struct {
+	rd *bufio.Reader
+	wr *bufio.Writer
+	be restic.Backend
+}
+
+// Serve implements the helper side of the protocol: it reads commands from
+// rd, runs them against the backend returned by open and writes the replies
+// to wr. The function open is called with create set for the "create"
+// command. Serve returns when rd is closed or the command "quit" is received.
+func Serve(ctx context.Context, rd io.Reader, wr io.Writer, open func(create bool) (restic.Backend, error)) error {
+	s := &server{
+		rd: bufio.NewReader(rd),
+		wr: bufio.NewWriter(wr),
+	}
+
+	defer func() {
+		if s.be != nil {
+			_ = s.be.Close()
+		}
+	}()
+
+	if _, err := fmt.Fprintf(s.wr, "%s\n", greeting); err != nil {
+		return err
+	}
+
+	for {
+		if err := s.wr.Flush(); err != nil {
+			return err
+		}
+
+		line, err := s.rd.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			s.reply(errors.New("empty command"), "")
+			continue
+		}
+
+		switch {
+		case args[0] == "quit":
+			return s.wr.Flush()
+
+		case args[0] == "open" || args[0] == "create":
+			if s.be != nil {
+				s.reply(errors.New("repository already opened"), "")
+				continue
+			}
+
+			s.be, err = open(args[0] == "create")
+			s.reply(err, "")
+
+		case s.be == nil:
+			s.reply(errors.Errorf("command %v before open", args[0]), "")
+
+		default:
+			if err = s.run(ctx, args); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reply writes the reply for the result of a command.
+func (s *server) reply(err error, result string) {
+	switch {
+	case err == errNotFound:
+		fmt.Fprintf(s.wr, "notfound\n")
+	case err != nil:
+		msg := strings.Replace(err.Error(), "\n", " ", -1)
+		fmt.Fprintf(s.wr, "error %s\n", msg)
+	case result != "":
+		fmt.Fprintf(s.wr, "ok %s\n", result)
+	default:
+		fmt.Fprintf(s.wr, "ok\n")
+	}
+}
+
+// handle returns the handle for the type and name in args.
+func handle(args []string) restic.Handle {
+	h := restic.Handle{Type: restic.FileType(args[0]), Name: args[1]}
+	if h.Type == restic.ConfigFile {
+		h.Name = ""
+	}
+	return h
+}
+
+// stat returns the size of the file at h. If it does not exist, errNotFound
+// is returned.
+func (s *server) stat(ctx context.Context, h restic.Handle) (int64, error) {
+	ok, err := s.be.Test(ctx, h)
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		return 0, errNotFound
+	}
+
+	fi, err := s.be.Stat(ctx, h)
+	return fi.Size, err
+}
+
+// run runs a command which accesses the backend. Only errors which prevent
+// further communication are returned.
+func (s *server) run(ctx context.Context, args []string) error {
+	want := map[string]int{"stat": 3, "load": 5, "save": 4, "remove": 3, "list": 2}
+	n, ok := want[args[0]]
+	if !ok {
+		s.reply(errors.Errorf("unknown command %v", args[0]), "")
+		return nil
+	}
+
+	if len(args) != n {
+		s.reply(errors.Errorf("wrong number of arguments for %v", args[0]), "")
+		return nil
+	}
+
+	switch args[0] {
+	case "stat":
+		size, err := s.stat(ctx, handle(args[1:]))
+		s.reply(err, strconv.FormatInt(size, 10))
+
+	case "load":
+		h := handle(args[1:])
+		offset, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			s.reply(errors.Errorf("invalid offset %q", args[3]), "")
+			return nil
+		}
+		length, err := strconv.Atoi(args[4])
+		if err != nil {
+			s.reply(errors.Errorf("invalid length %q", args[4]), "")
+			return nil
+		}
+
+		if _, err = s.stat(ctx, h); err != nil {
+			s.reply(err, "")
+			return nil
+		}
+
+		buf, err := s.load(ctx, h, length, offset)
+		if err != nil {
+			s.reply(err, "")
+			return nil
+		}
+
+		s.reply(nil, strconv.Itoa(len(buf)))
+		_, err = s.wr.Write(buf)
+		return err
+
+	case "save":
+		length, err := strconv.Atoi(args[3])
+		if err != nil || length < 0 {
+			// the data cannot be skipped without knowing its length
+			return errors.Errorf("invalid length %q", args[3])
+		}
+
+		buf := make([]byte, length)
+		if _, err = io.ReadFull(s.rd, buf); err != nil {
+			return err
+		}
+
+		s.reply(s.be.Save(ctx, handle(args[1:]), bytes.NewReader(buf)), "")
+
+	case "remove":
+		s.reply(s.be.Remove(ctx, handle(args[1:])), "")
+
+	case "list":
+		s.reply(nil, "")
+		for name := range s.be.List(ctx, restic.FileType(args[1])) {
+			fmt.Fprintf(s.wr, "%s\n", name)
+		}
+		fmt.Fprintf(s.wr, "\n")
+	}
+
+	return nil
+}
+
+// load reads the file at h from the backend.
+func (s *server) load(ctx context.Context, h restic.Handle, length int, offset int64) ([]byte, error) {
+	rd, err := s.be.Load(ctx, h, length, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+
+	return buf, rd.Close()
+}
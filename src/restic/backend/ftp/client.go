@@ -0,0 +1,498 @@
+package ftp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"restic/debug"
+	"restic/errors"
+)
+
+// dialTimeout limits the time for establishing control and data connections.
+var dialTimeout = 30 * time.Second
+
+// conn is a control connection to an FTP server. It is not safe for
+// concurrent use, the backend keeps a pool of connections.
+type conn struct {
+	nc   net.Conn
+	text *textproto.Conn
+	tls  *tls.Config // nil for plain connections
+
+	home     string // the directory the session started in
+	mlsd     bool   // the server supports MLSD
+	noEPSV   bool   // the server does not support EPSV
+	lastUsed time.Time
+}
+
+// dial connects to the server, secures the connection if tlsConfig is set
+// and logs in.
+func dial(cfg Config, tlsConfig *tls.Config) (*conn, error) {
+	debug.Log("connect to %v", cfg.address())
+	nc, err := net.DialTimeout("tcp", cfg.address(), dialTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "Dial")
+	}
+
+	c := &conn{nc: nc, text: textproto.NewConn(nc)}
+	if err = c.login(cfg, tlsConfig); err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+
+	c.lastUsed = time.Now()
+	return c, nil
+}
+
+func (c *conn) login(cfg Config, tlsConfig *tls.Config) error {
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return errors.Wrap(err, "greeting")
+	}
+
+	if tlsConfig != nil {
+		if _, _, err := c.cmd(234, "AUTH TLS"); err != nil {
+			return errors.Wrap(err, "AUTH TLS")
+		}
+
+		tc := tls.Client(c.nc, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			return errors.Wrap(err, "TLS handshake")
+		}
+
+		c.nc = tc
+		c.text = textproto.NewConn(tc)
+		c.tls = tlsConfig
+	}
+
+	user := cfg.User
+	if user == "" {
+		user = "anonymous"
+	}
+
+	code, _, err := c.cmd(0, "USER %s", user)
+	if err == nil && code == 331 {
+		code, _, err = c.cmd(0, "PASS %s", cfg.Password)
+	}
+	if err != nil {
+		return errors.Wrap(err, "login")
+	}
+	if code != 230 && code != 202 {
+		return errors.Errorf("login failed: server replied %d", code)
+	}
+
+	if c.tls != nil {
+		// protect the data connections as well
+		if _, _, err = c.cmd(2, "PBSZ 0"); err != nil {
+			return errors.Wrap(err, "PBSZ")
+		}
+		if _, _, err = c.cmd(2, "PROT P"); err != nil {
+			return errors.Wrap(err, "PROT")
+		}
+	}
+
+	if _, _, err = c.cmd(2, "TYPE I"); err != nil {
+		return errors.Wrap(err, "TYPE")
+	}
+
+	_, msg, err := c.cmd(257, "PWD")
+	if err != nil {
+		return errors.Wrap(err, "PWD")
+	}
+	c.home, err = parsePWD(msg)
+	if err != nil {
+		return err
+	}
+
+	// FEAT is optional, older servers do not know it
+	if _, msg, err = c.cmd(211, "FEAT"); err == nil {
+		for _, line := range strings.Split(msg, "\n") {
+			if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(line)), "MLST") {
+				c.mlsd = true
+			}
+		}
+	}
+
+	debug.Log("logged in as %v, home %v, mlsd %v", user, c.home, c.mlsd)
+	return nil
+}
+
+// parsePWD extracts the directory from the reply to PWD, which is quoted with
+// double quotes (a double quote in the name is doubled).
+func parsePWD(msg string) (string, error) {
+	start := strings.Index(msg, `"`)
+	end := strings.LastIndex(msg, `"`)
+	if start < 0 || end <= start {
+		return "", errors.Errorf("unable to parse reply to PWD: %q", msg)
+	}
+
+	return strings.Replace(msg[start+1:end], `""`, `"`, -1), nil
+}
+
+// cmd sends a command and reads the reply, which must match expect (see
+// textproto.Reader.ReadResponse). A negative reply is returned as a
+// *textproto.Error.
+func (c *conn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+
+	code, msg, err := c.text.ReadResponse(expect)
+	c.lastUsed = time.Now()
+	return code, msg, err
+}
+
+// close ends the session and closes the connection.
+func (c *conn) close() error {
+	_, _, _ = c.cmd(0, "QUIT")
+	return c.nc.Close()
+}
+
+// isReply returns true if err is a reply from the server, so the connection
+// can still be used.
+func isReply(err error) bool {
+	_, ok := errors.Cause(err).(*textproto.Error)
+	return ok
+}
+
+// isPermanent returns true if the server replied with a permanent negative
+// reply (5xx), so retrying the command does not help.
+func isPermanent(err error) bool {
+	e, ok := errors.Cause(err).(*textproto.Error)
+	return ok && e.Code >= 500
+}
+
+// isNotExist returns true if the server replied that the file or directory is
+// not available.
+func isNotExist(err error) bool {
+	e, ok := errors.Cause(err).(*textproto.Error)
+	return ok && e.Code == 550
+}
+
+// passive asks the server to listen for a data connection and connects to it.
+// Like most clients, the address in the reply is ignored and the server is
+// contacted at the address of the control connection, which also works for
+// servers behind NAT that announce their internal address.
+func (c *conn) passive() (net.Conn, error) {
+	host, _, err := net.SplitHostPort(c.nc.RemoteAddr().String())
+	if err != nil {
+		return nil, errors.Wrap(err, "SplitHostPort")
+	}
+
+	var port int
+	if !c.noEPSV {
+		_, msg, err := c.cmd(229, "EPSV")
+		switch {
+		case err == nil:
+			port, err = parseEPSV(msg)
+			if err != nil {
+				return nil, err
+			}
+		case isPermanent(err):
+			debug.Log("EPSV not supported: %v", err)
+			c.noEPSV = true
+		default:
+			return nil, errors.Wrap(err, "EPSV")
+		}
+	}
+
+	if c.noEPSV {
+		_, msg, err := c.cmd(227, "PASV")
+		if err != nil {
+			return nil, errors.Wrap(err, "PASV")
+		}
+
+		port, err = parsePASV(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nc, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), dialTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "Dial")
+	}
+
+	return nc, nil
+}
+
+// parseEPSV extracts the port from the reply to EPSV, e.g. "Entering
+// Extended Passive Mode (|||6446|)".
+func parseEPSV(msg string) (int, error) {
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start+2 {
+		return 0, errors.Errorf("unable to parse reply to EPSV: %q", msg)
+	}
+
+	s := msg[start+1 : end]
+	fields := strings.Split(s, s[:1])
+	if len(fields) != 5 {
+		return 0, errors.Errorf("unable to parse reply to EPSV: %q", msg)
+	}
+
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return 0, errors.Errorf("unable to parse reply to EPSV: %q", msg)
+	}
+
+	return int(port), nil
+}
+
+// parsePASV extracts the port from the reply to PASV, e.g. "Entering Passive
+// Mode (192,168,1,2,25,46)".
+func parsePASV(msg string) (int, error) {
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return 0, errors.Errorf("unable to parse reply to PASV: %q", msg)
+	}
+
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, errors.Errorf("unable to parse reply to PASV: %q", msg)
+	}
+
+	hi, err1 := strconv.ParseUint(fields[4], 10, 8)
+	lo, err2 := strconv.ParseUint(fields[5], 10, 8)
+	if err1 != nil || err2 != nil {
+		return 0, errors.Errorf("unable to parse reply to PASV: %q", msg)
+	}
+
+	return int(hi<<8 | lo), nil
+}
+
+// transfer is a data connection for a single command, like RETR or STOR.
+type transfer struct {
+	c    *conn
+	data net.Conn
+}
+
+// transfer opens a data connection and sends the command. If offset is
+// positive, the transfer is restarted at this offset with REST.
+func (c *conn) transfer(offset int64, format string, args ...interface{}) (*transfer, error) {
+	data, err := c.passive()
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, _, err = c.cmd(350, "REST %d", offset); err != nil {
+			_ = data.Close()
+			return nil, errors.Wrap(err, "REST")
+		}
+	}
+
+	if _, _, err = c.cmd(1, format, args...); err != nil {
+		_ = data.Close()
+		return nil, err
+	}
+
+	if c.tls != nil {
+		tc := tls.Client(data, c.tls)
+		if err = tc.Handshake(); err != nil {
+			_ = tc.Close()
+			// the server still sends the final reply
+			_, _, _ = c.text.ReadResponse(0)
+			return nil, errors.Wrap(err, "TLS handshake")
+		}
+		data = tc
+	}
+
+	return &transfer{c: c, data: data}, nil
+}
+
+func (t *transfer) Read(p []byte) (int, error) {
+	return t.data.Read(p)
+}
+
+func (t *transfer) Write(p []byte) (int, error) {
+	return t.data.Write(p)
+}
+
+// Close closes the data connection and reads the final reply of the server,
+// which tells whether the transfer was successful.
+func (t *transfer) Close() error {
+	err := t.data.Close()
+	_, _, rerr := t.c.text.ReadResponse(2)
+	t.c.lastUsed = time.Now()
+	if rerr != nil {
+		return rerr
+	}
+
+	return errors.Wrap(err, "Close")
+}
+
+// fileInfo is returned by readDir.
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+var _ os.FileInfo = fileInfo{}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fileInfo) IsDir() bool        { return fi.dir }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+func (fi fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+
+// readDir lists the entries of a directory. MLSD is used if the server
+// supports it, otherwise the output of LIST is parsed, which is not
+// standardized but the same on almost all servers.
+func (c *conn) readDir(dir string) ([]os.FileInfo, error) {
+	command, parse := "LIST", parseListLine
+	if c.mlsd {
+		command, parse = "MLSD", parseMLSDLine
+	}
+
+	t, err := c.transfer(0, "%s %s", command, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []os.FileInfo
+	sc := bufio.NewScanner(t)
+	for sc.Scan() {
+		fi, ok := parse(strings.TrimRight(sc.Text(), "\r"))
+		if !ok || fi.name == "." || fi.name == ".." {
+			continue
+		}
+		entries = append(entries, fi)
+	}
+
+	err = sc.Err()
+	if cerr := t.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// parseMLSDLine parses an entry in the machine-readable format of MLSD (RFC
+// 3659), e.g. "type=file;size=1024;modify=20170506102344; name".
+func parseMLSDLine(line string) (fileInfo, bool) {
+	i := strings.Index(line, " ")
+	if i < 0 {
+		return fileInfo{}, false
+	}
+
+	fi := fileInfo{name: line[i+1:]}
+	for _, fact := range strings.Split(line[:i], ";") {
+		data := strings.SplitN(fact, "=", 2)
+		if len(data) != 2 {
+			continue
+		}
+
+		switch strings.ToLower(data[0]) {
+		case "type":
+			switch strings.ToLower(data[1]) {
+			case "file":
+			case "dir":
+				fi.dir = true
+			default:
+				// skip cdir, pdir and links
+				return fileInfo{}, false
+			}
+		case "size":
+			fi.size, _ = strconv.ParseInt(data[1], 10, 64)
+		}
+	}
+
+	return fi, true
+}
+
+// parseListLine parses an entry in the output of LIST, which is either in the
+// format of "ls -l" or the one of the MS-DOS "dir" command.
+func parseListLine(line string) (fileInfo, bool) {
+	fields := strings.Fields(line)
+
+	switch {
+	case len(fields) >= 4 && (fields[2] == "<DIR>" || isDigits(fields[2])):
+		// 05-06-17  10:23AM       <DIR>          data
+		fi := fileInfo{name: strings.Join(fields[3:], " ")}
+		if fields[2] == "<DIR>" {
+			fi.dir = true
+		} else {
+			fi.size, _ = strconv.ParseInt(fields[2], 10, 64)
+		}
+		return fi, true
+
+	case len(fields) >= 9 && len(fields[0]) == 10:
+		// -rw-r--r--   1 user  group      1024 May  6 10:23 config
+		fi := fileInfo{name: strings.Join(fields[8:], " ")}
+		switch fields[0][0] {
+		case '-':
+		case 'd':
+			fi.dir = true
+		default:
+			return fileInfo{}, false
+		}
+		fi.size, _ = strconv.ParseInt(fields[4], 10, 64)
+		return fi, true
+	}
+
+	return fileInfo{}, false
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isDir returns true if dir is an existing directory.
+func (c *conn) isDir(dir string) bool {
+	if _, _, err := c.cmd(2, "CWD %s", dir); err != nil {
+		return false
+	}
+
+	// go back, all paths are relative to the home directory
+	_, _, _ = c.cmd(2, "CWD %s", c.home)
+	return true
+}
+
+// mkdirAll creates the directory dir and its parents.
+func (c *conn) mkdirAll(dir string) error {
+	if dir == "" || dir == "." || dir == "/" {
+		return nil
+	}
+
+	if _, _, err := c.cmd(257, "MKD %s", dir); err == nil || c.isDir(dir) {
+		return nil
+	}
+
+	if err := c.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+
+	_, _, err := c.cmd(257, "MKD %s", dir)
+	if err != nil && !c.isDir(dir) {
+		return errors.Wrapf(err, "MKD %v", dir)
+	}
+
+	return nil
+}
@@ -0,0 +1,4 @@
+// Package ftp implements repository storage in a directory on an FTP server,
+// optionally secured with explicit TLS (ftps). Only passive mode is supported.
+// Uploads and downloads which are interrupted are resumed where they stopped.
+package ftp
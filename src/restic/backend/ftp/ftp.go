@@ -0,0 +1,591 @@
+package ftp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"restic"
+	"strings"
+	"sync"
+	"time"
+
+	"restic/backend"
+	"restic/debug"
+	"restic/errors"
+)
+
+// Backend stores data on an FTP server.
+type Backend struct {
+	cfg Config
+	tls *tls.Config
+	sem *backend.Semaphore
+
+	m    sync.Mutex
+	idle []*conn
+
+	backend.Layout
+}
+
+var _ restic.Backend = &Backend{}
+
+const defaultLayout = "default"
+
+// maxRetries is the number of times an interrupted transfer is resumed.
+const maxRetries = 5
+
+// idleCheck is the time after which an idle connection is checked with NOOP
+// before it is used again, servers close idle connections after a while.
+const idleCheck = 30 * time.Second
+
+// partialSuffix is appended to the name of files while they are uploaded.
+const partialSuffix = ".partial"
+
+func newBackend(cfg Config) (*Backend, error) {
+	if cfg.Connections <= 0 {
+		return nil, errors.New("ftp.connections must be a positive number")
+	}
+
+	sem, err := backend.NewSemaphore(uint(cfg.Connections))
+	if err != nil {
+		return nil, err
+	}
+
+	be := &Backend{cfg: cfg, sem: sem}
+
+	if cfg.TLS {
+		host, _, err := net.SplitHostPort(cfg.address())
+		if err != nil {
+			return nil, errors.Wrap(err, "SplitHostPort")
+		}
+
+		be.tls = &tls.Config{
+			ServerName: host,
+			// many servers require that the data connections reuse the TLS
+			// session of the control connection
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		}
+
+		if cfg.CAFile != "" {
+			buf, err := ioutil.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "ReadFile")
+			}
+
+			be.tls.RootCAs = x509.NewCertPool()
+			if !be.tls.RootCAs.AppendCertsFromPEM(buf) {
+				return nil, errors.Errorf("no certificates found in %v", cfg.CAFile)
+			}
+		}
+	} else if cfg.CAFile != "" {
+		return nil, errors.New("ftp.ca-file can only be used with ftps")
+	}
+
+	// connect once to report errors early
+	c, err := be.get()
+	if err != nil {
+		return nil, err
+	}
+	be.put(c, nil)
+
+	be.Layout, err = backend.ParseLayout(be, cfg.Layout, defaultLayout, cfg.Path)
+	if err != nil {
+		_ = be.Close()
+		return nil, err
+	}
+
+	debug.Log("layout: %v", be.Layout)
+	return be, nil
+}
+
+// Open opens the FTP backend as described by the config.
+func Open(cfg Config) (*Backend, error) {
+	debug.Log("open backend at %v:%v", cfg.Host, cfg.Path)
+	return newBackend(cfg)
+}
+
+// Create creates the directories for a new repository on the FTP server.
+func Create(cfg Config) (*Backend, error) {
+	debug.Log("create backend at %v:%v", cfg.Host, cfg.Path)
+	be, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = be.Stat(context.TODO(), restic.Handle{Type: restic.ConfigFile})
+	if err == nil {
+		_ = be.Close()
+		return nil, errors.New("config file already exists")
+	}
+
+	c, err := be.get()
+	if err != nil {
+		_ = be.Close()
+		return nil, err
+	}
+
+	for _, d := range be.Paths() {
+		err = c.mkdirAll(d)
+		debug.Log("mkdirAll %v -> %v", d, err)
+		if err != nil {
+			break
+		}
+	}
+
+	be.put(c, err)
+	if err != nil {
+		_ = be.Close()
+		return nil, err
+	}
+
+	return be, nil
+}
+
+// get returns an idle connection from the pool or opens a new one. It blocks
+// until less than cfg.Connections connections are in use.
+func (be *Backend) get() (*conn, error) {
+	be.sem.GetToken()
+
+	for {
+		be.m.Lock()
+		if len(be.idle) == 0 {
+			be.m.Unlock()
+			break
+		}
+		c := be.idle[len(be.idle)-1]
+		be.idle = be.idle[:len(be.idle)-1]
+		be.m.Unlock()
+
+		if time.Since(c.lastUsed) < idleCheck {
+			return c, nil
+		}
+
+		if _, _, err := c.cmd(2, "NOOP"); err == nil {
+			return c, nil
+		}
+
+		debug.Log("idle connection has been closed by the server")
+		_ = c.nc.Close()
+	}
+
+	c, err := dial(be.cfg, be.tls)
+	if err != nil {
+		be.sem.ReleaseToken()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// put returns the connection to the pool. If err shows that the connection
+// is broken, it is closed instead.
+func (be *Backend) put(c *conn, err error) {
+	if err != nil && !isReply(err) {
+		debug.Log("close connection after error %v", err)
+		_ = c.nc.Close()
+	} else {
+		be.m.Lock()
+		be.idle = append(be.idle, c)
+		be.m.Unlock()
+	}
+
+	be.sem.ReleaseToken()
+}
+
+// do runs fn with a connection from the pool.
+func (be *Backend) do(fn func(c *conn) error) error {
+	c, err := be.get()
+	if err != nil {
+		return err
+	}
+
+	err = fn(c)
+	be.put(c, err)
+	return err
+}
+
+// Location returns this backend's location (the directory name).
+func (be *Backend) Location() string {
+	return be.cfg.Path
+}
+
+// Join combines path components with slashes.
+func (be *Backend) Join(p ...string) string {
+	return path.Join(p...)
+}
+
+// ReadDir returns the entries for a directory.
+func (be *Backend) ReadDir(dir string) (list []os.FileInfo, err error) {
+	err = be.do(func(c *conn) error {
+		list, err = c.readDir(dir)
+		return err
+	})
+	return list, err
+}
+
+// IsNotExist returns true if the error is caused by a not existing file.
+func (be *Backend) IsNotExist(err error) bool {
+	return os.IsNotExist(errors.Cause(err)) || isNotExist(err)
+}
+
+// size returns the size of the file.
+func (c *conn) size(filename string) (int64, error) {
+	_, msg, err := c.cmd(213, "SIZE %s", filename)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, c := range strings.TrimSpace(msg) {
+		if c < '0' || c > '9' {
+			return 0, errors.Errorf("unable to parse reply to SIZE: %q", msg)
+		}
+		size = size*10 + int64(c-'0')
+	}
+
+	return size, nil
+}
+
+// Save stores data in the backend at the handle. The data is first uploaded
+// to a temporary file, which is renamed when the upload is complete. If rd is
+// seekable, interrupted uploads are resumed.
+func (be *Backend) Save(ctx context.Context, h restic.Handle, rd io.Reader) error {
+	debug.Log("Save %v", h)
+	if err := h.Valid(); err != nil {
+		return err
+	}
+
+	filename := be.Filename(h)
+	partial := filename + partialSuffix
+
+	ok, err := be.Test(ctx, h)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return errors.Errorf("file %v already exists", filename)
+	}
+
+	// remember the start position for resuming the upload
+	seeker, _ := rd.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			seeker = nil
+		}
+	}
+
+	createdDir := false
+	resume := false
+	for retries := 0; ; retries++ {
+		started := false
+		err = be.do(func(c *conn) error {
+			command := "STOR"
+			if resume {
+				// continue after the data which has been stored so far
+				size, err := c.size(partial)
+				if err != nil {
+					return err
+				}
+
+				debug.Log("resume upload of %v at %d", h, size)
+				if _, err = seeker.Seek(start+size, io.SeekStart); err != nil {
+					return errors.Wrap(err, "Seek")
+				}
+				command = "APPE"
+			}
+
+			t, err := c.transfer(0, "%s %s", command, partial)
+			if err != nil {
+				return err
+			}
+			started = true
+
+			_, err = io.Copy(t, rd)
+			if cerr := t.Close(); err == nil {
+				err = cerr
+			}
+			return err
+		})
+
+		if err == nil {
+			break
+		}
+
+		if !createdDir && !started && !resume && isPermanent(err) {
+			// the directory might be missing, create it and try again
+			debug.Log("create directory for %v after error %v", h, err)
+			createdDir = true
+			err = be.do(func(c *conn) error {
+				return c.mkdirAll(be.Dirname(h))
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if seeker == nil || isPermanent(err) || retries >= maxRetries {
+			// try to remove the partial file, but ignore errors
+			_ = be.do(func(c *conn) error {
+				_, _, err := c.cmd(2, "DELE %s", partial)
+				return err
+			})
+			return errors.Wrap(err, "upload")
+		}
+
+		debug.Log("upload of %v interrupted: %v", h, err)
+		resume = true
+	}
+
+	return be.do(func(c *conn) error {
+		if _, _, err := c.cmd(350, "RNFR %s", partial); err != nil {
+			return errors.Wrap(err, "RNFR")
+		}
+		_, _, err := c.cmd(2, "RNTO %s", filename)
+		return errors.Wrap(err, "RNTO")
+	})
+}
+
+// Load returns a reader that yields the contents of the file at h at the
+// given offset. If length is nonzero, only a portion of the file is
+// returned. rd must be closed after use. Interrupted downloads are resumed.
+func (be *Backend) Load(ctx context.Context, h restic.Handle, length int, offset int64) (io.ReadCloser, error) {
+	debug.Log("Load %v, length %v, offset %v", h, length, offset)
+	if err := h.Valid(); err != nil {
+		return nil, err
+	}
+
+	if offset < 0 {
+		return nil, errors.New("offset is negative")
+	}
+
+	if length < 0 {
+		return nil, errors.Errorf("invalid length %d", length)
+	}
+
+	rd := &loadReader{be: be, filename: be.Filename(h), offset: offset}
+	if err := rd.open(); err != nil {
+		return nil, err
+	}
+
+	if length > 0 {
+		return backend.LimitReadCloser(rd, int64(length)), nil
+	}
+
+	return rd, nil
+}
+
+// loadReader downloads a file. When the download is interrupted, it
+// reconnects and continues at the current offset.
+type loadReader struct {
+	be       *Backend
+	filename string
+	offset   int64
+	retries  int
+
+	c   *conn
+	t   *transfer
+	eof bool
+}
+
+// open starts the download at the current offset.
+func (rd *loadReader) open() error {
+	for {
+		c, err := rd.be.get()
+		if err != nil {
+			return err
+		}
+
+		t, err := c.transfer(rd.offset, "RETR %s", rd.filename)
+		if err == nil {
+			rd.c, rd.t = c, t
+			return nil
+		}
+
+		rd.be.put(c, err)
+		if isPermanent(err) || rd.retries >= maxRetries {
+			return err
+		}
+
+		rd.retries++
+		debug.Log("retry download of %v after error %v", rd.filename, err)
+	}
+}
+
+// finish closes the transfer and returns the connection to the pool.
+func (rd *loadReader) finish() error {
+	err := rd.t.Close()
+	rd.be.put(rd.c, err)
+	rd.c, rd.t = nil, nil
+	return err
+}
+
+func (rd *loadReader) Read(p []byte) (int, error) {
+	if rd.eof {
+		return 0, io.EOF
+	}
+
+	if rd.t == nil {
+		if err := rd.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rd.t.Read(p)
+	rd.offset += int64(n)
+
+	if err == io.EOF {
+		// the download is only complete when the server says so
+		err = rd.finish()
+		if err == nil {
+			rd.eof = true
+			return n, io.EOF
+		}
+	} else if err != nil {
+		_ = rd.finish()
+	}
+
+	if err != nil {
+		if isPermanent(err) || rd.retries >= maxRetries {
+			return n, err
+		}
+
+		rd.retries++
+		debug.Log("download of %v interrupted at %d: %v", rd.filename, rd.offset, err)
+		// the next call to Read continues the download
+		if n == 0 {
+			return rd.Read(p)
+		}
+	}
+
+	return n, nil
+}
+
+// Close aborts the download if it is still running.
+func (rd *loadReader) Close() error {
+	if rd.t == nil {
+		return nil
+	}
+
+	err := rd.finish()
+	if isReply(err) {
+		// the server complains that the download has been aborted
+		return nil
+	}
+	return err
+}
+
+// Stat returns information about a blob.
+func (be *Backend) Stat(ctx context.Context, h restic.Handle) (restic.FileInfo, error) {
+	debug.Log("Stat(%v)", h)
+	if err := h.Valid(); err != nil {
+		return restic.FileInfo{}, err
+	}
+
+	var size int64
+	err := be.do(func(c *conn) (err error) {
+		size, err = c.size(be.Filename(h))
+		return err
+	})
+	if err != nil {
+		return restic.FileInfo{}, errors.Wrap(err, "SIZE")
+	}
+
+	return restic.FileInfo{Size: size}, nil
+}
+
+// Test returns true if a blob of the given type and name exists in the backend.
+func (be *Backend) Test(ctx context.Context, h restic.Handle) (bool, error) {
+	debug.Log("Test(%v)", h)
+	_, err := be.Stat(ctx, h)
+	if isNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Remove removes the content stored at name.
+func (be *Backend) Remove(ctx context.Context, h restic.Handle) error {
+	debug.Log("Remove(%v)", h)
+	return be.do(func(c *conn) error {
+		_, _, err := c.cmd(2, "DELE %s", be.Filename(h))
+		return errors.Wrap(err, "DELE")
+	})
+}
+
+// List returns a channel that yields all names of blobs of type t. A
+// goroutine is started for this. If the channel done is closed, sending
+// stops.
+func (be *Backend) List(ctx context.Context, t restic.FileType) <-chan string {
+	debug.Log("List %v", t)
+
+	ch := make(chan string)
+
+	go func() {
+		defer close(ch)
+		be.list(ctx, be.Basedir(t), ch)
+	}()
+
+	return ch
+}
+
+// list sends the names of all files in dir and its subdirectories to ch. It
+// returns false if ctx has been cancelled.
+func (be *Backend) list(ctx context.Context, dir string, ch chan<- string) bool {
+	entries, err := be.ReadDir(dir)
+	if err != nil {
+		debug.Log("ReadDir(%v): %v", dir, err)
+		return true
+	}
+
+	for _, fi := range entries {
+		if fi.IsDir() {
+			if !be.list(ctx, path.Join(dir, fi.Name()), ch) {
+				return false
+			}
+			continue
+		}
+
+		if strings.HasSuffix(fi.Name(), partialSuffix) {
+			continue
+		}
+
+		select {
+		case ch <- fi.Name():
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	return true
+}
+
+// Close closes all idle connections.
+func (be *Backend) Close() error {
+	debug.Log("")
+
+	be.m.Lock()
+	idle := be.idle
+	be.idle = nil
+	be.m.Unlock()
+
+	var err error
+	for _, c := range idle {
+		if cerr := c.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return errors.Wrap(err, "Close")
+}
@@ -0,0 +1,217 @@
+package ftp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"restic"
+	"sync"
+	"testing"
+	"time"
+
+	"restic/backend"
+	"restic/backend/ftp"
+	"restic/backend/test"
+	. "restic/test"
+)
+
+func newTestSuite(t testing.TB, tlsConfig *tls.Config, caFile string) *test.Suite {
+	var m sync.Mutex
+	servers := make(map[string]*testServer)
+
+	return &test.Suite{
+		// NewConfig returns a config for a new temporary backend that will be used in tests.
+		NewConfig: func() (interface{}, error) {
+			dir, err := ioutil.TempDir(TestTempDir, "restic-test-ftp-")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Logf("create new backend at %v", dir)
+
+			srv := newTestServer(t, dir, tlsConfig)
+			m.Lock()
+			servers[srv.Addr()] = srv
+			m.Unlock()
+
+			cfg := ftp.NewConfig()
+			cfg.Host = srv.Addr()
+			cfg.Path = "repo"
+			if tlsConfig != nil {
+				cfg.TLS = true
+				cfg.CAFile = caFile
+			}
+			return cfg, nil
+		},
+
+		// CreateFn is a function that creates a temporary repository for the tests.
+		Create: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(ftp.Config)
+			return ftp.Create(cfg)
+		},
+
+		// OpenFn is a function that opens a previously created temporary repository.
+		Open: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(ftp.Config)
+			return ftp.Open(cfg)
+		},
+
+		// CleanupFn removes data created during the tests.
+		Cleanup: func(config interface{}) error {
+			cfg := config.(ftp.Config)
+
+			m.Lock()
+			srv := servers[cfg.Host]
+			m.Unlock()
+
+			if err := srv.Close(); err != nil {
+				return err
+			}
+
+			if !TestCleanupTempDirs {
+				t.Logf("leaving test backend dir at %v", srv.dir)
+			}
+
+			RemoveAll(t, srv.dir)
+			return nil
+		},
+	}
+}
+
+func TestBackendFTP(t *testing.T) {
+	newTestSuite(t, nil, "").RunTests(t)
+}
+
+func BenchmarkBackendFTP(t *testing.B) {
+	newTestSuite(t, nil, "").RunBenchmarks(t)
+}
+
+// newTLSConfig returns a server config with a self-signed certificate for
+// 127.0.0.1, which is also written to a file in dir.
+func newTLSConfig(t testing.TB, dir string) (*tls.Config, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "restic test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(dir, "ca.pem")
+	buf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = ioutil.WriteFile(caFile, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	return cfg, caFile
+}
+
+func TestBackendFTPS(t *testing.T) {
+	dir, cleanup := TempDir(t)
+	defer cleanup()
+
+	tlsConfig, caFile := newTLSConfig(t, dir)
+
+	suite := newTestSuite(t, tlsConfig, caFile)
+	suite.MinimalData = true
+	suite.RunTests(t)
+}
+
+func TestFTPSUnknownCertificate(t *testing.T) {
+	dir, cleanup := TempDir(t)
+	defer cleanup()
+
+	tlsConfig, _ := newTLSConfig(t, dir)
+	srv := newTestServer(t, dir, tlsConfig)
+	defer srv.Close()
+
+	cfg := ftp.NewConfig()
+	cfg.Host = srv.Addr()
+	cfg.Path = "repo"
+	cfg.TLS = true
+
+	_, err := ftp.Create(cfg)
+	if err == nil {
+		t.Fatal("no error returned for a certificate signed by an unknown CA")
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir, cleanup := TempDir(t)
+	defer cleanup()
+
+	srv := newTestServer(t, dir, nil)
+	defer srv.Close()
+
+	cfg := ftp.NewConfig()
+	cfg.Host = srv.Addr()
+	cfg.Path = "repo"
+
+	be, err := ftp.Create(cfg)
+	OK(t, err)
+	defer func() {
+		OK(t, be.Close())
+	}()
+
+	data := Random(23, 500*1024)
+	h := restic.Handle{Type: restic.DataFile, Name: restic.Hash(data).String()}
+
+	// interrupt the upload twice
+	srv.failNext(2, 100*1024)
+	OK(t, be.Save(context.TODO(), h, bytes.NewReader(data)))
+	Assert(t, srv.failed(), "upload was not interrupted")
+
+	fi, err := be.Stat(context.TODO(), h)
+	OK(t, err)
+	Equals(t, int64(len(data)), fi.Size)
+
+	// interrupt the download three times
+	srv.failNext(3, 64*1024)
+	buf, err := backend.LoadAll(context.TODO(), be, h)
+	OK(t, err)
+	Assert(t, srv.failed(), "download was not interrupted")
+	Assert(t, bytes.Equal(buf, data), "wrong data returned after resuming the download")
+
+	// the upload cannot be resumed without seeking in the data
+	h2 := restic.Handle{Type: restic.DataFile, Name: "foo"}
+	srv.failNext(1, 1024)
+	err = be.Save(context.TODO(), h2, ioutil.NopCloser(bytes.NewReader(data)))
+	Assert(t, err != nil, "interrupted upload without seeking did not return an error")
+
+	ok, err := be.Test(context.TODO(), h2)
+	OK(t, err)
+	Assert(t, !ok, "file of interrupted upload was created")
+
+	var names []string
+	for name := range be.List(context.TODO(), restic.DataFile) {
+		names = append(names, name)
+	}
+	Equals(t, []string{h.Name}, names)
+}
@@ -0,0 +1,369 @@
+package ftp_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testServer is a minimal FTP server which serves a local directory. It
+// implements just enough of the protocol for the backend.
+type testServer struct {
+	t   testing.TB
+	dir string
+	ln  net.Listener
+	tls *tls.Config // if nil, AUTH TLS is rejected
+
+	m sync.Mutex
+	// the next failTransfers data transfers are interrupted after failAfter
+	// bytes
+	failTransfers int
+	failAfter     int64
+}
+
+func newTestServer(t testing.TB, dir string, tlsConfig *tls.Config) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{t: t, dir: dir, ln: ln, tls: tlsConfig}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(nc)
+		}
+	}()
+
+	return s
+}
+
+func (s *testServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *testServer) Close() error {
+	return s.ln.Close()
+}
+
+// failNext interrupts the next n data transfers after the given number of
+// bytes.
+func (s *testServer) failNext(n int, after int64) {
+	s.m.Lock()
+	s.failTransfers, s.failAfter = n, after
+	s.m.Unlock()
+}
+
+// failed returns true if all transfers which should fail have been
+// interrupted.
+func (s *testServer) failed() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.failTransfers == 0
+}
+
+// limit returns the number of bytes the next transfer may copy, or -1.
+func (s *testServer) limit() int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.failTransfers == 0 {
+		return -1
+	}
+
+	s.failTransfers--
+	return s.failAfter
+}
+
+// path returns the local path for the name used by the client.
+func (s *testServer) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(filepath.Clean("/"+name)))
+}
+
+// session holds the state of a control connection.
+type session struct {
+	s    *testServer
+	nc   net.Conn
+	text *textproto.Conn
+
+	pasv   net.Listener
+	prot   bool
+	rest   int64
+	rnfr   string
+	closed bool
+}
+
+func (s *testServer) serve(nc net.Conn) {
+	sess := &session{s: s, nc: nc, text: textproto.NewConn(nc)}
+	defer func() {
+		if sess.pasv != nil {
+			_ = sess.pasv.Close()
+		}
+		_ = sess.nc.Close()
+	}()
+
+	sess.reply(220, "test server ready")
+	for !sess.closed {
+		line, err := sess.text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		data := strings.SplitN(line, " ", 2)
+		cmd := strings.ToUpper(data[0])
+		arg := ""
+		if len(data) > 1 {
+			arg = data[1]
+		}
+
+		sess.handle(cmd, arg)
+	}
+}
+
+func (sess *session) reply(code int, format string, args ...interface{}) {
+	_ = sess.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (sess *session) handle(cmd, arg string) {
+	s := sess.s
+	switch cmd {
+	case "AUTH":
+		if s.tls == nil {
+			sess.reply(502, "TLS not supported")
+			return
+		}
+		sess.reply(234, "start TLS")
+		tc := tls.Server(sess.nc, s.tls)
+		sess.nc = tc
+		sess.text = textproto.NewConn(tc)
+	case "USER":
+		sess.reply(331, "password required")
+	case "PASS":
+		sess.reply(230, "logged in")
+	case "PBSZ", "TYPE", "NOOP":
+		sess.reply(200, "ok")
+	case "PROT":
+		sess.prot = arg == "P"
+		sess.reply(200, "ok")
+	case "FEAT":
+		_ = sess.text.PrintfLine("211-Features:\r\n MLST type*;size*;\r\n EPSV\r\n REST STREAM\r\n211 End")
+	case "PWD":
+		sess.reply(257, `"/" is the current directory`)
+	case "CWD":
+		if fi, err := os.Stat(s.path(arg)); err != nil || !fi.IsDir() {
+			sess.reply(550, "no such directory")
+			return
+		}
+		sess.reply(250, "ok")
+	case "EPSV":
+		if !sess.listen() {
+			return
+		}
+		sess.reply(229, "Entering Extended Passive Mode (|||%d|)", sess.pasv.Addr().(*net.TCPAddr).Port)
+	case "PASV":
+		if !sess.listen() {
+			return
+		}
+		port := sess.pasv.Addr().(*net.TCPAddr).Port
+		sess.reply(227, "Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+	case "REST":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			sess.reply(501, "invalid offset")
+			return
+		}
+		sess.rest = n
+		sess.reply(350, "restarting at %d", n)
+	case "RETR":
+		sess.retr(arg)
+	case "STOR", "APPE":
+		sess.stor(arg, cmd == "APPE")
+	case "MLSD":
+		sess.mlsd(arg)
+	case "SIZE":
+		fi, err := os.Stat(s.path(arg))
+		if err != nil || fi.IsDir() {
+			sess.reply(550, "no such file")
+			return
+		}
+		sess.reply(213, "%d", fi.Size())
+	case "DELE":
+		if err := os.Remove(s.path(arg)); err != nil {
+			sess.reply(550, "unable to remove file")
+			return
+		}
+		sess.reply(250, "ok")
+	case "MKD":
+		if err := os.Mkdir(s.path(arg), 0700); err != nil {
+			sess.reply(550, "unable to create directory")
+			return
+		}
+		sess.reply(257, "created")
+	case "RNFR":
+		if _, err := os.Stat(s.path(arg)); err != nil {
+			sess.reply(550, "no such file")
+			return
+		}
+		sess.rnfr = arg
+		sess.reply(350, "ok")
+	case "RNTO":
+		if err := os.Rename(s.path(sess.rnfr), s.path(arg)); err != nil {
+			sess.reply(550, "unable to rename file")
+			return
+		}
+		sess.reply(250, "ok")
+	case "QUIT":
+		sess.reply(221, "bye")
+		sess.closed = true
+	default:
+		sess.reply(502, "command not implemented")
+	}
+}
+
+func (sess *session) listen() bool {
+	if sess.pasv != nil {
+		_ = sess.pasv.Close()
+	}
+
+	var err error
+	sess.pasv, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		sess.reply(425, "unable to listen: %v", err)
+		return false
+	}
+	return true
+}
+
+// data accepts the data connection and sends the preliminary reply.
+func (sess *session) data() net.Conn {
+	if sess.pasv == nil {
+		sess.reply(425, "use EPSV or PASV first")
+		return nil
+	}
+
+	nc, err := sess.pasv.Accept()
+	_ = sess.pasv.Close()
+	sess.pasv = nil
+	if err != nil {
+		sess.reply(425, "unable to accept data connection")
+		return nil
+	}
+
+	sess.reply(150, "opening data connection")
+	if !sess.prot {
+		return nc
+	}
+
+	tc := tls.Server(nc, sess.s.tls)
+	if err = tc.Handshake(); err != nil {
+		_ = tc.Close()
+		sess.reply(425, "TLS handshake failed")
+		return nil
+	}
+	return tc
+}
+
+// transfer copies from rd to wr, it is interrupted if the server is told to
+// fail transfers.
+func (sess *session) transfer(wr io.Writer, rd io.Reader) bool {
+	if limit := sess.s.limit(); limit >= 0 {
+		_, _ = io.Copy(wr, io.LimitReader(rd, limit))
+		return false
+	}
+
+	_, err := io.Copy(wr, rd)
+	return err == nil
+}
+
+func (sess *session) retr(name string) {
+	f, err := os.Open(sess.s.path(name))
+	offset := sess.rest
+	sess.rest = 0
+	if err != nil {
+		sess.reply(550, "no such file")
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		sess.reply(550, "unable to seek")
+		return
+	}
+
+	nc := sess.data()
+	if nc == nil {
+		return
+	}
+
+	ok := sess.transfer(nc, f)
+	_ = nc.Close()
+	if !ok {
+		sess.reply(426, "transfer aborted")
+		return
+	}
+	sess.reply(226, "transfer complete")
+}
+
+func (sess *session) stor(name string, appendData bool) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendData {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	f, err := os.OpenFile(sess.s.path(name), flags, 0600)
+	if err != nil {
+		sess.reply(553, "unable to create file")
+		return
+	}
+	defer f.Close()
+
+	nc := sess.data()
+	if nc == nil {
+		return
+	}
+
+	ok := sess.transfer(f, nc)
+	_ = nc.Close()
+	if !ok {
+		sess.reply(426, "transfer aborted")
+		return
+	}
+	sess.reply(226, "transfer complete")
+}
+
+func (sess *session) mlsd(dir string) {
+	entries, err := ioutil.ReadDir(sess.s.path(dir))
+	if err != nil {
+		sess.reply(550, "no such directory")
+		return
+	}
+
+	nc := sess.data()
+	if nc == nil {
+		return
+	}
+
+	for _, fi := range entries {
+		tpe := "file"
+		if fi.IsDir() {
+			tpe = "dir"
+		}
+		_, _ = fmt.Fprintf(nc, "type=%s;size=%d; %s\r\n", tpe, fi.Size(), fi.Name())
+	}
+
+	_ = nc.Close()
+	sess.reply(226, "transfer complete")
+}
@@ -12,11 +12,17 @@ type DefaultLayout struct {
 }
 
 var defaultLayoutPaths = map[restic.FileType]string{
-	restic.DataFile:     "data",
-	restic.SnapshotFile: "snapshots",
-	restic.IndexFile:    "index",
-	restic.LockFile:     "locks",
-	restic.KeyFile:      "keys",
+	restic.DataFile:         "data",
+	restic.SnapshotFile:     "snapshots",
+	restic.IndexFile:        "index",
+	restic.LockFile:         "locks",
+	restic.KeyFile:          "keys",
+	restic.DeletionFile:     "deletions",
+	restic.TrashFile:        "trash",
+	restic.IntentFile:       "intents",
+	restic.ConfigUpdateFile: "configupdates",
+	restic.DomainConfigFile: "domainconfigs",
+	restic.OperationFile:    "operations",
 }
 
 func (l *DefaultLayout) String() string {
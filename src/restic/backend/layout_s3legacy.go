@@ -11,11 +11,17 @@ type S3LegacyLayout struct {
 }
 
 var s3LayoutPaths = map[restic.FileType]string{
-	restic.DataFile:     "data",
-	restic.SnapshotFile: "snapshot",
-	restic.IndexFile:    "index",
-	restic.LockFile:     "lock",
-	restic.KeyFile:      "key",
+	restic.DataFile:         "data",
+	restic.SnapshotFile:     "snapshot",
+	restic.IndexFile:        "index",
+	restic.LockFile:         "lock",
+	restic.KeyFile:          "key",
+	restic.DeletionFile:     "deletion",
+	restic.TrashFile:        "trash",
+	restic.IntentFile:       "intent",
+	restic.ConfigUpdateFile: "configupdate",
+	restic.DomainConfigFile: "domainconfig",
+	restic.OperationFile:    "operation",
 }
 
 func (l *S3LegacyLayout) String() string {
@@ -109,6 +109,12 @@ func TestDefaultLayout(t *testing.T) {
 			filepath.Join(tempdir, "index"),
 			filepath.Join(tempdir, "locks"),
 			filepath.Join(tempdir, "keys"),
+			filepath.Join(tempdir, "deletions"),
+			filepath.Join(tempdir, "trash"),
+			filepath.Join(tempdir, "intents"),
+			filepath.Join(tempdir, "configupdates"),
+			filepath.Join(tempdir, "domainconfigs"),
+			filepath.Join(tempdir, "operations"),
 		}
 
 		sort.Sort(sort.StringSlice(want))
@@ -182,6 +188,12 @@ func TestRESTLayout(t *testing.T) {
 			filepath.Join(path, "index"),
 			filepath.Join(path, "locks"),
 			filepath.Join(path, "keys"),
+			filepath.Join(path, "deletions"),
+			filepath.Join(path, "trash"),
+			filepath.Join(path, "intents"),
+			filepath.Join(path, "configupdates"),
+			filepath.Join(path, "domainconfigs"),
+			filepath.Join(path, "operations"),
 		}
 
 		sort.Sort(sort.StringSlice(want))
@@ -328,6 +340,12 @@ func TestS3LegacyLayout(t *testing.T) {
 			filepath.Join(path, "index"),
 			filepath.Join(path, "lock"),
 			filepath.Join(path, "key"),
+			filepath.Join(path, "deletion"),
+			filepath.Join(path, "trash"),
+			filepath.Join(path, "intent"),
+			filepath.Join(path, "configupdate"),
+			filepath.Join(path, "domainconfig"),
+			filepath.Join(path, "operation"),
 		}
 
 		sort.Sort(sort.StringSlice(want))
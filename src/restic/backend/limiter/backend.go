@@ -0,0 +1,99 @@
+package limiter
+
+import (
+	"context"
+	"io"
+	"restic"
+
+	"restic/errors"
+)
+
+// Backend passes all requests to another backend and limits the rate of the
+// data transferred.
+type Backend struct {
+	be restic.Backend
+	l  Limiter
+}
+
+// make sure that *Backend implements restic.Backend
+var _ restic.Backend = &Backend{}
+
+// LimitBackend returns a backend which limits the transfers to and from be.
+func LimitBackend(be restic.Backend, l Limiter) *Backend {
+	return &Backend{be: be, l: l}
+}
+
+// Location returns the location of the underlying backend.
+func (be *Backend) Location() string {
+	return be.be.Location()
+}
+
+// Test returns whether the file h exists.
+func (be *Backend) Test(ctx context.Context, h restic.Handle) (bool, error) {
+	return be.be.Test(ctx, h)
+}
+
+// Remove removes the file h.
+func (be *Backend) Remove(ctx context.Context, h restic.Handle) error {
+	return be.be.Remove(ctx, h)
+}
+
+// Close closes the underlying backend.
+func (be *Backend) Close() error {
+	return be.be.Close()
+}
+
+// Save stores the data read from rd under the handle h.
+func (be *Backend) Save(ctx context.Context, h restic.Handle, rd io.Reader) error {
+	return be.be.Save(ctx, h, be.l.Upstream(rd))
+}
+
+// Load returns a reader that yields the contents of the file h.
+func (be *Backend) Load(ctx context.Context, h restic.Handle, length int, offset int64) (io.ReadCloser, error) {
+	rd, err := be.be.Load(ctx, h, length, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return be.l.Downstream(rd), nil
+}
+
+// Stat returns information about the file h.
+func (be *Backend) Stat(ctx context.Context, h restic.Handle) (restic.FileInfo, error) {
+	return be.be.Stat(ctx, h)
+}
+
+// List returns a channel that yields the names of all files of type t.
+func (be *Backend) List(ctx context.Context, t restic.FileType) <-chan string {
+	return be.be.List(ctx, t)
+}
+
+// make sure that *Backend implements restic.BulkRemover
+var _ restic.BulkRemover = &Backend{}
+
+// RemoveMulti removes all files in hs with a single request if the underlying
+// backend supports this, and one by one otherwise.
+func (be *Backend) RemoveMulti(ctx context.Context, hs []restic.Handle) error {
+	bulk, ok := be.be.(restic.BulkRemover)
+	if !ok {
+		var firstErr error
+		for _, h := range hs {
+			if err := be.Remove(ctx, h); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	return bulk.RemoveMulti(ctx, hs)
+}
+
+// Delete removes the repository if the underlying backend supports this.
+func (be *Backend) Delete(ctx context.Context) error {
+	d, ok := be.be.(restic.Deleter)
+	if !ok {
+		return errors.New("Delete() called for backend that does not implement this method")
+	}
+
+	return d.Delete(ctx)
+}
@@ -0,0 +1,165 @@
+// Package limiter implements a backend which limits the rate at which data
+// is uploaded to and downloaded from another backend.
+package limiter
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"restic/backend"
+)
+
+// maxChunk is the largest number of bytes which is passed through a limited
+// reader in a single call to Read, so that the transfer stays smooth.
+const maxChunk = 32 * 1024
+
+// Limiter limits the rate of uploads and downloads.
+type Limiter interface {
+	// Upstream returns a reader which limits the rate at which data is read
+	// from rd for uploading.
+	Upstream(rd io.Reader) io.Reader
+
+	// Downstream returns a reader which limits the rate at which the
+	// downloaded data is read from rd.
+	Downstream(rd io.ReadCloser) io.ReadCloser
+}
+
+// bucket is a token bucket, which is filled with rate tokens (bytes) per
+// second and holds at most rate tokens. It is shared by all readers, so the
+// limit applies to all concurrent transfers together.
+type bucket struct {
+	rate float64
+
+	m      sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(kib uint) *bucket {
+	if kib == 0 {
+		return nil
+	}
+
+	rate := float64(kib) * 1024
+	return &bucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// take removes n tokens from the bucket and returns how long the caller has
+// to wait until they would have been available.
+func (b *bucket) take(n int) time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type staticLimiter struct {
+	up, down *bucket
+}
+
+// NewStaticLimiter returns a limiter which limits uploads to uploadKiB and
+// downloads to downloadKiB KiB/s. A limit of zero disables limiting.
+func NewStaticLimiter(uploadKiB, downloadKiB uint) Limiter {
+	return staticLimiter{
+		up:   newBucket(uploadKiB),
+		down: newBucket(downloadKiB),
+	}
+}
+
+func (l staticLimiter) Upstream(rd io.Reader) io.Reader {
+	if l.up == nil {
+		return rd
+	}
+
+	lr := &limitedReader{Reader: rd, b: l.up}
+
+	size, ok := backend.RemainingSize(rd)
+	if !ok {
+		return lr
+	}
+
+	sr := &sizedReader{limitedReader: lr, size: size}
+	if seeker, ok := rd.(io.Seeker); ok {
+		return seekableReader{sizedReader: sr, seeker: seeker}
+	}
+
+	return sr
+}
+
+func (l staticLimiter) Downstream(rd io.ReadCloser) io.ReadCloser {
+	if l.down == nil {
+		return rd
+	}
+
+	return limitedReadCloser{
+		limitedReader: &limitedReader{Reader: rd, b: l.down},
+		c:             rd,
+	}
+}
+
+// limitedReader waits after each read until the bucket has enough tokens
+// for the bytes read.
+type limitedReader struct {
+	io.Reader
+	b *bucket
+}
+
+func (rd *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+
+	n, err := rd.Reader.Read(p)
+	if d := rd.b.take(n); d > 0 {
+		time.Sleep(d)
+	}
+
+	return n, err
+}
+
+type limitedReadCloser struct {
+	*limitedReader
+	c io.Closer
+}
+
+func (rd limitedReadCloser) Close() error {
+	return rd.c.Close()
+}
+
+// sizedReader is used for uploads of which the size is known in advance,
+// since some backends need it.
+type sizedReader struct {
+	*limitedReader
+	size int64
+}
+
+// Size returns the number of bytes which were remaining when the upload was
+// started.
+func (rd *sizedReader) Size() int64 {
+	return rd.size
+}
+
+// seekableReader allows a backend to rewind the data and read it again
+// (e.g. after computing a checksum). All bytes read count against the limit,
+// even if they are read more than once.
+type seekableReader struct {
+	*sizedReader
+	seeker io.Seeker
+}
+
+func (rd seekableReader) Seek(offset int64, whence int) (int64, error) {
+	return rd.seeker.Seek(offset, whence)
+}
@@ -0,0 +1,117 @@
+package limiter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"restic"
+	"testing"
+	"time"
+
+	"restic/backend/mem"
+	"restic/backend/test"
+	rtest "restic/test"
+)
+
+type limiterConfig struct {
+	be *mem.MemoryBackend
+}
+
+func newTestSuite() *test.Suite {
+	lim := NewStaticLimiter(100*1024, 100*1024)
+
+	return &test.Suite{
+		// NewConfig returns a config for a new temporary backend that will be used in tests.
+		NewConfig: func() (interface{}, error) {
+			return &limiterConfig{}, nil
+		},
+
+		// CreateFn is a function that creates a temporary repository for the tests.
+		Create: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(*limiterConfig)
+			if cfg.be != nil {
+				ok, err := cfg.be.Test(context.TODO(), restic.Handle{Type: restic.ConfigFile})
+				if err != nil {
+					return nil, err
+				}
+
+				if ok {
+					return nil, errors.New("config already exists")
+				}
+			}
+
+			cfg.be = mem.New()
+			return LimitBackend(cfg.be, lim), nil
+		},
+
+		// OpenFn is a function that opens a previously created temporary repository.
+		Open: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(*limiterConfig)
+			if cfg.be == nil {
+				cfg.be = mem.New()
+			}
+			return LimitBackend(cfg.be, lim), nil
+		},
+
+		// CleanupFn removes data created during the tests.
+		Cleanup: func(config interface{}) error {
+			// no cleanup needed
+			return nil
+		},
+	}
+}
+
+func TestSuiteBackendLimiter(t *testing.T) {
+	newTestSuite().RunTests(t)
+}
+
+func TestLimiterUpstream(t *testing.T) {
+	lim := NewStaticLimiter(100, 0)
+	data := rtest.Random(23, 150*1024)
+
+	rd := lim.Upstream(bytes.NewReader(data))
+
+	sizer, ok := rd.(interface {
+		Size() int64
+	})
+	rtest.Assert(t, ok, "size of the upload is not available")
+	rtest.Equals(t, int64(len(data)), sizer.Size())
+
+	_, ok = rd.(io.Seeker)
+	rtest.Assert(t, ok, "upload is not seekable")
+
+	start := time.Now()
+	buf, err := ioutil.ReadAll(rd)
+	rtest.OK(t, err)
+	rtest.Equals(t, data, buf)
+
+	// the first 100 KiB are available immediately, the rest takes 0.5s
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("upload was not limited, took %v", d)
+	}
+
+	// no limit for downloads
+	down := ioutil.NopCloser(bytes.NewReader(data))
+	rtest.Assert(t, lim.Downstream(down) == down, "download was limited")
+}
+
+func TestLimiterDownstream(t *testing.T) {
+	lim := NewStaticLimiter(0, 100)
+	data := rtest.Random(42, 150*1024)
+
+	up := bytes.NewReader(data)
+	rtest.Assert(t, lim.Upstream(up) == up, "upload was limited")
+
+	start := time.Now()
+	rd := lim.Downstream(ioutil.NopCloser(bytes.NewReader(data)))
+	buf, err := ioutil.ReadAll(rd)
+	rtest.OK(t, err)
+	rtest.OK(t, rd.Close())
+	rtest.Equals(t, data, buf)
+
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("download was not limited, took %v", d)
+	}
+}
@@ -5,10 +5,15 @@ import (
 	"strings"
 
 	"restic/backend/b2"
+	"restic/backend/ext"
+	"restic/backend/ftp"
 	"restic/backend/local"
+	"restic/backend/mirror"
 	"restic/backend/rest"
 	"restic/backend/s3"
 	"restic/backend/sftp"
+	"restic/backend/shard"
+	"restic/backend/smb"
 	"restic/backend/swift"
 )
 
@@ -33,6 +38,12 @@ var parsers = []parser{
 	{"s3", s3.ParseConfig},
 	{"swift", swift.ParseConfig},
 	{"rest", rest.ParseConfig},
+	{"shard", shard.ParseConfig},
+	{"mirror", mirror.ParseConfig},
+	{"ext", ext.ParseConfig},
+	{"ftp", ftp.ParseConfig},
+	{"ftps", ftp.ParseConfig},
+	{"smb", smb.ParseConfig},
 }
 
 // Parse extracts repository location information from the string s. If s
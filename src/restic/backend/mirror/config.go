@@ -0,0 +1,43 @@
+package mirror
+
+import (
+	"strings"
+
+	"restic/errors"
+)
+
+// Config contains the locations of the primary backend and its read-only
+// mirror.
+type Config struct {
+	Primary string
+	Mirror  string
+}
+
+// ParseConfig parses the string s and extracts the mirror config. The
+// locations of the primary backend and the mirror are separated by '|', e.g.
+// mirror:sftp:host:/srv/repo|s3:s3.amazonaws.com/bucket.
+func ParseConfig(s string) (interface{}, error) {
+	if !strings.HasPrefix(s, "mirror:") {
+		return nil, errors.New("invalid mirror backend specification")
+	}
+
+	locs := strings.Split(s[7:], "|")
+	if len(locs) != 2 {
+		return nil, errors.New("mirror: exactly two locations are needed")
+	}
+
+	for i, loc := range locs {
+		loc = strings.TrimSpace(loc)
+		if loc == "" {
+			return nil, errors.New("mirror: empty location")
+		}
+
+		if strings.HasPrefix(loc, "mirror:") || strings.HasPrefix(loc, "shard:") {
+			return nil, errors.New("mirror: locations must not be mirror or shard backends")
+		}
+
+		locs[i] = loc
+	}
+
+	return Config{Primary: locs[0], Mirror: locs[1]}, nil
+}
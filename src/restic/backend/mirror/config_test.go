@@ -0,0 +1,52 @@
+package mirror
+
+import (
+	"reflect"
+	"testing"
+)
+
+var configTests = []struct {
+	s   string
+	cfg Config
+}{
+	{"mirror:/srv/repo|/mnt/mirror", Config{
+		Primary: "/srv/repo",
+		Mirror:  "/mnt/mirror",
+	}},
+	{"mirror:sftp:host:/srv/repo | s3:s3.amazonaws.com/bucket", Config{
+		Primary: "sftp:host:/srv/repo",
+		Mirror:  "s3:s3.amazonaws.com/bucket",
+	}},
+}
+
+func TestParseConfig(t *testing.T) {
+	for i, test := range configTests {
+		cfg, err := ParseConfig(test.s)
+		if err != nil {
+			t.Errorf("test %d:%s failed: %v", i, test.s, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(cfg, test.cfg) {
+			t.Errorf("test %d:\ninput:\n  %s\n wrong config, want:\n  %v\ngot:\n  %v",
+				i, test.s, test.cfg, cfg)
+			continue
+		}
+	}
+}
+
+var invalidConfigTests = []string{
+	"mirror:/srv/repo",
+	"mirror:/srv/repo|",
+	"mirror:/srv/repo1|/srv/repo2|/srv/repo3",
+	"mirror:/srv/repo|shard:/srv/repo1|/srv/repo2",
+	"local:/srv/repo",
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for _, s := range invalidConfigTests {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("no error for invalid config %q", s)
+		}
+	}
+}
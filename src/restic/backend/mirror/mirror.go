@@ -0,0 +1,240 @@
+// Package mirror implements a backend which reads from a read-only mirror of
+// the repository when the primary backend fails, so that snapshots can still
+// be restored or mounted during an outage of the primary backend. Files are
+// only written to (and removed from) the primary backend, the mirror must be
+// kept up to date by other means. While reads are served by the mirror, the
+// repository cannot be modified.
+package mirror
+
+import (
+	"context"
+	"io"
+	"restic"
+	"sync"
+	"time"
+
+	"restic/debug"
+	"restic/errors"
+)
+
+// retryPrimary is the time after a failure of the primary backend during
+// which all reads are served by the mirror.
+const retryPrimary = time.Minute
+
+// errReadOnly is returned when a file is saved or removed while reads are
+// served by the mirror. The data read from the mirror may be outdated, so
+// modifying the repository based on it is not safe.
+var errReadOnly = errors.New("primary backend failed, the repository is read-only while reading from the mirror")
+
+// Backend reads from the mirror if the primary backend fails.
+type Backend struct {
+	primary, mirror restic.Backend
+
+	// Fallback, if set, is called with the error returned by the primary
+	// backend when reads are served by the mirror.
+	Fallback func(err error)
+
+	m    sync.Mutex
+	down time.Time
+	now  func() time.Time
+}
+
+// make sure that *Backend implements restic.Backend
+var _ restic.Backend = &Backend{}
+
+// New returns a backend which reads from mirror if primary fails.
+func New(primary, mirror restic.Backend) *Backend {
+	return &Backend{
+		primary: primary,
+		mirror:  mirror,
+		now:     time.Now,
+	}
+}
+
+// primaryDown returns true if the primary backend failed recently.
+func (be *Backend) primaryDown() bool {
+	be.m.Lock()
+	defer be.m.Unlock()
+	return !be.down.IsZero() && be.now().Sub(be.down) < retryPrimary
+}
+
+// missing returns true if the primary backend is reachable and the file does
+// not exist there. Such an error is not an outage, the file has most likely
+// been removed from the primary backend but not from the mirror yet.
+func (be *Backend) missing(ctx context.Context, h restic.Handle) bool {
+	found, err := be.primary.Test(ctx, h)
+	return err == nil && !found
+}
+
+// failed records that the primary backend returned err for a read which
+// succeeded on the mirror.
+func (be *Backend) failed(err error) {
+	be.m.Lock()
+	wasDown := !be.down.IsZero() && be.now().Sub(be.down) < retryPrimary
+	be.down = be.now()
+	be.m.Unlock()
+
+	debug.Log("primary backend failed, reading from mirror: %v", err)
+	if !wasDown && be.Fallback != nil {
+		be.Fallback(err)
+	}
+}
+
+// Location returns the locations of both backends.
+func (be *Backend) Location() string {
+	return "mirror:" + be.primary.Location() + "|" + be.mirror.Location()
+}
+
+// Test returns whether the file exists. The mirror is only asked when the
+// primary backend returns an error.
+func (be *Backend) Test(ctx context.Context, h restic.Handle) (bool, error) {
+	if be.primaryDown() {
+		return be.mirror.Test(ctx, h)
+	}
+
+	found, err := be.primary.Test(ctx, h)
+	if err == nil {
+		return found, nil
+	}
+
+	found, e := be.mirror.Test(ctx, h)
+	if e != nil {
+		return false, err
+	}
+
+	be.failed(err)
+	return found, nil
+}
+
+// Remove removes the file from the primary backend. It fails while reads are
+// served by the mirror.
+func (be *Backend) Remove(ctx context.Context, h restic.Handle) error {
+	if be.primaryDown() {
+		return errReadOnly
+	}
+	return be.primary.Remove(ctx, h)
+}
+
+// Close closes both backends.
+func (be *Backend) Close() error {
+	err := be.primary.Close()
+	if e := be.mirror.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Save stores the file in the primary backend, the mirror is never written
+// to. It fails while reads are served by the mirror.
+func (be *Backend) Save(ctx context.Context, h restic.Handle, rd io.Reader) error {
+	if be.primaryDown() {
+		return errReadOnly
+	}
+	return be.primary.Save(ctx, h, rd)
+}
+
+// Load returns a reader for the file from the primary backend, or from the
+// mirror if that fails.
+func (be *Backend) Load(ctx context.Context, h restic.Handle, length int, offset int64) (io.ReadCloser, error) {
+	if be.primaryDown() {
+		return be.mirror.Load(ctx, h, length, offset)
+	}
+
+	rd, err := be.primary.Load(ctx, h, length, offset)
+	if err == nil || be.missing(ctx, h) {
+		return rd, err
+	}
+
+	rd, e := be.mirror.Load(ctx, h, length, offset)
+	if e != nil {
+		// the file does not exist or the request is invalid
+		return nil, err
+	}
+
+	be.failed(err)
+	return rd, nil
+}
+
+// Stat returns information about the file from the primary backend, or from
+// the mirror if that fails.
+func (be *Backend) Stat(ctx context.Context, h restic.Handle) (restic.FileInfo, error) {
+	if be.primaryDown() {
+		return be.mirror.Stat(ctx, h)
+	}
+
+	fi, err := be.primary.Stat(ctx, h)
+	if err == nil || be.missing(ctx, h) {
+		return fi, err
+	}
+
+	fi, e := be.mirror.Stat(ctx, h)
+	if e != nil {
+		return restic.FileInfo{}, err
+	}
+
+	be.failed(err)
+	return fi, nil
+}
+
+// List returns the names of the files of type t in the primary backend, or in
+// the mirror if the primary backend failed recently.
+func (be *Backend) List(ctx context.Context, t restic.FileType) <-chan string {
+	if !be.primaryDown() {
+		// listing does not report errors, so the primary backend is checked
+		// by loading the information about the config first
+		h := restic.Handle{Type: restic.ConfigFile}
+		_, err := be.primary.Stat(ctx, h)
+		if err == nil || be.missing(ctx, h) {
+			return be.primary.List(ctx, t)
+		}
+
+		if _, e := be.mirror.Stat(ctx, h); e != nil {
+			return be.primary.List(ctx, t)
+		}
+
+		be.failed(err)
+	}
+
+	return be.mirror.List(ctx, t)
+}
+
+// unavailable is used in place of a backend which could not be opened.
+type unavailable struct {
+	location string
+	err      error
+}
+
+// Unavailable returns a backend which returns err for all operations. It is
+// used as the primary backend when it could not be opened.
+func Unavailable(location string, err error) restic.Backend {
+	return unavailable{location: location, err: err}
+}
+
+func (be unavailable) Location() string { return be.location }
+func (be unavailable) Close() error     { return nil }
+
+func (be unavailable) Test(ctx context.Context, h restic.Handle) (bool, error) {
+	return false, be.err
+}
+
+func (be unavailable) Remove(ctx context.Context, h restic.Handle) error {
+	return be.err
+}
+
+func (be unavailable) Save(ctx context.Context, h restic.Handle, rd io.Reader) error {
+	return be.err
+}
+
+func (be unavailable) Load(ctx context.Context, h restic.Handle, length int, offset int64) (io.ReadCloser, error) {
+	return nil, be.err
+}
+
+func (be unavailable) Stat(ctx context.Context, h restic.Handle) (restic.FileInfo, error) {
+	return restic.FileInfo{}, be.err
+}
+
+func (be unavailable) List(ctx context.Context, t restic.FileType) <-chan string {
+	ch := make(chan string)
+	close(ch)
+	return ch
+}
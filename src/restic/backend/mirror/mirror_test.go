@@ -0,0 +1,228 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"restic"
+	"testing"
+	"time"
+
+	"restic/backend"
+	"restic/backend/mem"
+	"restic/backend/test"
+	rtest "restic/test"
+)
+
+type mirrorConfig struct {
+	primary, mirror *mem.MemoryBackend
+}
+
+func newTestSuite() *test.Suite {
+	return &test.Suite{
+		// NewConfig returns a config for a new temporary backend that will be used in tests.
+		NewConfig: func() (interface{}, error) {
+			return &mirrorConfig{}, nil
+		},
+
+		// CreateFn is a function that creates a temporary repository for the tests.
+		Create: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(*mirrorConfig)
+			if cfg.primary != nil {
+				ok, err := cfg.primary.Test(context.TODO(), restic.Handle{Type: restic.ConfigFile})
+				if err != nil {
+					return nil, err
+				}
+
+				if ok {
+					return nil, errors.New("config already exists")
+				}
+			}
+
+			cfg.primary, cfg.mirror = mem.New(), mem.New()
+			return New(cfg.primary, cfg.mirror), nil
+		},
+
+		// OpenFn is a function that opens a previously created temporary repository.
+		Open: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(*mirrorConfig)
+			if cfg.primary == nil {
+				cfg.primary, cfg.mirror = mem.New(), mem.New()
+			}
+			return New(cfg.primary, cfg.mirror), nil
+		},
+
+		// CleanupFn removes data created during the tests.
+		Cleanup: func(config interface{}) error {
+			// no cleanup needed
+			return nil
+		},
+	}
+}
+
+func TestSuiteBackendMirror(t *testing.T) {
+	newTestSuite().RunTests(t)
+}
+
+// failingBackend returns an error for all operations while failing is set.
+type failingBackend struct {
+	restic.Backend
+	failing bool
+}
+
+var errFailing = errors.New("backend is failing")
+
+func (be *failingBackend) Test(ctx context.Context, h restic.Handle) (bool, error) {
+	if be.failing {
+		return false, errFailing
+	}
+	return be.Backend.Test(ctx, h)
+}
+
+func (be *failingBackend) Save(ctx context.Context, h restic.Handle, rd io.Reader) error {
+	if be.failing {
+		return errFailing
+	}
+	return be.Backend.Save(ctx, h, rd)
+}
+
+func (be *failingBackend) Load(ctx context.Context, h restic.Handle, length int, offset int64) (io.ReadCloser, error) {
+	if be.failing {
+		return nil, errFailing
+	}
+	return be.Backend.Load(ctx, h, length, offset)
+}
+
+func (be *failingBackend) Stat(ctx context.Context, h restic.Handle) (restic.FileInfo, error) {
+	if be.failing {
+		return restic.FileInfo{}, errFailing
+	}
+	return be.Backend.Stat(ctx, h)
+}
+
+func (be *failingBackend) List(ctx context.Context, t restic.FileType) <-chan string {
+	if be.failing {
+		ch := make(chan string)
+		close(ch)
+		return ch
+	}
+	return be.Backend.List(ctx, t)
+}
+
+func list(be restic.Backend, t restic.FileType) (names []string) {
+	for name := range be.List(context.TODO(), t) {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestMirrorFallback(t *testing.T) {
+	primary := &failingBackend{Backend: mem.New()}
+	mirror := mem.New()
+
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	be := New(primary, mirror)
+	be.now = func() time.Time { return now }
+
+	var fallbacks int
+	be.Fallback = func(err error) {
+		fallbacks++
+	}
+
+	// the mirror contains a copy of the repository
+	config := restic.Handle{Type: restic.ConfigFile}
+	snapshot := restic.Handle{Type: restic.SnapshotFile, Name: restic.NewRandomID().String()}
+	for _, h := range []restic.Handle{config, snapshot} {
+		rtest.OK(t, be.Save(context.TODO(), h, bytes.NewReader([]byte(h.Type))))
+		rtest.OK(t, mirror.Save(context.TODO(), h, bytes.NewReader([]byte(h.Type))))
+	}
+
+	// a file which only exists in the primary backend is not found in the mirror
+	only := restic.Handle{Type: restic.DataFile, Name: restic.NewRandomID().String()}
+	rtest.OK(t, be.Save(context.TODO(), only, bytes.NewReader([]byte("data"))))
+	found, err := mirror.Test(context.TODO(), only)
+	rtest.OK(t, err)
+	rtest.Assert(t, !found, "file was saved to the mirror")
+
+	primary.failing = true
+
+	buf, err := backend.LoadAll(context.TODO(), be, snapshot)
+	rtest.OK(t, err)
+	rtest.Equals(t, []byte(restic.SnapshotFile), buf)
+	rtest.Equals(t, 1, fallbacks)
+
+	rtest.Equals(t, []string{snapshot.Name}, list(be, restic.SnapshotFile))
+
+	_, err = be.Stat(context.TODO(), only)
+	rtest.Assert(t, err != nil, "no error for file missing in the mirror")
+
+	// the repository cannot be modified while reading from the mirror
+	err = be.Save(context.TODO(), restic.Handle{Type: restic.LockFile, Name: "foo"}, bytes.NewReader(nil))
+	rtest.Assert(t, err == errReadOnly, "expected read-only error for Save, got %v", err)
+	rtest.Equals(t, 0, len(list(mirror, restic.LockFile)))
+
+	// even when the primary backend is reachable again
+	primary.failing = false
+	err = be.Remove(context.TODO(), snapshot)
+	rtest.Assert(t, err == errReadOnly, "expected read-only error for Remove, got %v", err)
+	found, err = primary.Test(context.TODO(), snapshot)
+	rtest.OK(t, err)
+	rtest.Assert(t, found, "file was removed from the primary backend")
+
+	// the primary backend is used again after a while
+	now = now.Add(retryPrimary)
+	rtest.OK(t, be.Save(context.TODO(), restic.Handle{Type: restic.LockFile, Name: "foo"}, bytes.NewReader(nil)))
+	rtest.OK(t, be.Remove(context.TODO(), restic.Handle{Type: restic.LockFile, Name: "foo"}))
+
+	fi, err := be.Stat(context.TODO(), only)
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(4), fi.Size)
+	rtest.Equals(t, []string{only.Name}, list(be, restic.DataFile))
+
+	// a failure when listing files is detected by checking the config
+	primary.failing = true
+	rtest.Equals(t, []string{snapshot.Name}, list(be, restic.SnapshotFile))
+	rtest.Equals(t, 2, fallbacks)
+}
+
+func TestMirrorUnavailable(t *testing.T) {
+	mirror := mem.New()
+	config := restic.Handle{Type: restic.ConfigFile}
+	rtest.OK(t, mirror.Save(context.TODO(), config, bytes.NewReader([]byte("config"))))
+
+	be := New(Unavailable("sftp:host:/srv/repo", errFailing), mirror)
+
+	fi, err := be.Stat(context.TODO(), config)
+	rtest.OK(t, err)
+	rtest.Equals(t, int64(6), fi.Size)
+
+	err = be.Remove(context.TODO(), config)
+	rtest.Assert(t, err == errReadOnly, "expected read-only error for Remove, got %v", err)
+}
+
+func TestMirrorNotFound(t *testing.T) {
+	primary := mem.New()
+	mirror := mem.New()
+
+	be := New(primary, mirror)
+	var fallbacks int
+	be.Fallback = func(err error) {
+		fallbacks++
+	}
+
+	// a file which has been removed from the primary backend but not from the
+	// mirror yet is not read from the mirror
+	h := restic.Handle{Type: restic.DataFile, Name: restic.NewRandomID().String()}
+	rtest.OK(t, mirror.Save(context.TODO(), h, bytes.NewReader([]byte("data"))))
+
+	_, err := backend.LoadAll(context.TODO(), be, h)
+	rtest.Assert(t, err != nil, "no error for file missing in the primary backend")
+	_, err = be.Stat(context.TODO(), h)
+	rtest.Assert(t, err != nil, "no error for file missing in the primary backend")
+	rtest.Equals(t, 0, fallbacks)
+
+	// the repository can still be modified
+	rtest.OK(t, be.Save(context.TODO(), h, bytes.NewReader([]byte("data"))))
+	rtest.OK(t, be.Remove(context.TODO(), h))
+}
@@ -0,0 +1,56 @@
+package rest
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"restic/backend/credhelper"
+	"restic/debug"
+)
+
+// helperTransport adds the credentials obtained by a credential helper to
+// each request. When the server rejects the credentials, the helper is run
+// again and requests without a body are retried once.
+type helperTransport struct {
+	rt     http.RoundTripper
+	helper *credhelper.Helper
+}
+
+func (t helperTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for i := 0; ; i++ {
+		creds, err := t.helper.Get()
+		if err != nil {
+			return nil, err
+		}
+
+		// the request must not be modified, so the headers are copied
+		r := new(http.Request)
+		*r = *req
+		r.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+
+		if creds.Token != "" {
+			r.Header.Set("Authorization", "Bearer "+creds.Token)
+		} else {
+			r.SetBasicAuth(creds.Username, creds.Password)
+		}
+
+		resp, err := t.rt.RoundTrip(r)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+
+		debug.Log("credentials rejected by server for %v %v", req.Method, req.URL)
+		t.helper.Expire()
+
+		if i > 0 || req.Body != nil {
+			return resp, nil
+		}
+
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+}
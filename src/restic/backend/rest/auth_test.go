@@ -0,0 +1,89 @@
+package rest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"restic"
+	"runtime"
+	"sync"
+	"testing"
+
+	. "restic/test"
+)
+
+func TestCredentialHelper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on Windows")
+	}
+
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	// the helper returns the token stored in a file, so that the test can
+	// change it
+	tokenFile := filepath.Join(tempdir, "token")
+	OK(t, ioutil.WriteFile(tokenFile, []byte("token1"), 0600))
+
+	var (
+		m                  sync.Mutex
+		valid              = "token1"
+		requests, rejected int
+	)
+	setValid := func(token string) {
+		m.Lock()
+		valid = token
+		m.Unlock()
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		requests++
+		if req.Header.Get("Authorization") != "Bearer "+valid {
+			rejected++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Length", "23")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/")
+	OK(t, err)
+
+	cfg := NewConfig()
+	cfg.URL = u
+	cfg.CredentialHelper = "sh -c 'echo \"{\\\"token\\\": \\\"$(cat " + tokenFile + ")\\\"}\"'"
+
+	be, err := Open(cfg)
+	OK(t, err)
+
+	h := restic.Handle{Type: restic.ConfigFile}
+	fi, err := be.Stat(context.TODO(), h)
+	OK(t, err)
+	Equals(t, int64(23), fi.Size)
+
+	// the server only accepts the new token, which is obtained after the
+	// first request has been rejected
+	setValid("token2")
+	OK(t, ioutil.WriteFile(tokenFile, []byte("token2"), 0600))
+
+	_, err = be.Stat(context.TODO(), h)
+	OK(t, err)
+
+	m.Lock()
+	Equals(t, 3, requests)
+	Equals(t, 1, rejected)
+	m.Unlock()
+
+	// a helper which always returns rejected credentials results in an error
+	setValid("token3")
+	_, err = be.Stat(context.TODO(), h)
+	Assert(t, err != nil, "expected error for rejected credentials")
+}
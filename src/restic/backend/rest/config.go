@@ -12,6 +12,8 @@ import (
 type Config struct {
 	URL         *url.URL
 	Connections uint `option:"connections" help:"set a limit for the number of concurrent connections (default: 20)"`
+
+	CredentialHelper string `option:"credential-helper" help:"run this command to obtain (temporary) credentials"`
 }
 
 func init() {
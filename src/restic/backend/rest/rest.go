@@ -18,6 +18,7 @@ import (
 	"restic/errors"
 
 	"restic/backend"
+	"restic/backend/credhelper"
 )
 
 const connLimit = 40
@@ -36,6 +37,19 @@ type restBackend struct {
 func Open(cfg Config) (restic.Backend, error) {
 	client := &http.Client{Transport: backend.Transport()}
 
+	if cfg.CredentialHelper != "" {
+		// the credentials are not passed to the helper
+		location := *cfg.URL
+		location.User = nil
+
+		helper, err := credhelper.New(cfg.CredentialHelper, "rest", location.String())
+		if err != nil {
+			return nil, err
+		}
+
+		client.Transport = helperTransport{rt: client.Transport, helper: helper}
+	}
+
 	sem, err := backend.NewSemaphore(cfg.Connections)
 	if err != nil {
 		return nil, err
@@ -74,7 +88,7 @@ func Create(cfg Config) (restic.Backend, error) {
 	values.Set("create", "true")
 	url.RawQuery = values.Encode()
 
-	resp, err := http.Post(url.String(), "binary/octet-stream", strings.NewReader(""))
+	resp, err := be.(*restBackend).client.Post(url.String(), "binary/octet-stream", strings.NewReader(""))
 	if err != nil {
 		return nil, err
 	}
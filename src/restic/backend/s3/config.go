@@ -20,6 +20,8 @@ type Config struct {
 	Layout        string `option:"layout" help:"use this backend layout (default: auto-detect)"`
 
 	Connections uint `option:"connections" help:"set a limit for the number of concurrent connections (default: 20)"`
+
+	CredentialHelper string `option:"credential-helper" help:"run this command to obtain (temporary) credentials"`
 }
 
 // NewConfig returns a new Config with the default values filled in.
@@ -2,6 +2,8 @@ package s3
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
@@ -11,9 +13,11 @@ import (
 	"time"
 
 	"restic/backend"
+	"restic/backend/credhelper"
 	"restic/errors"
 
 	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
 
 	"restic/debug"
 )
@@ -23,6 +27,7 @@ const connLimit = 10
 // Backend stores data on an S3 endpoint.
 type Backend struct {
 	client     *minio.Client
+	helper     *credhelper.Helper
 	sem        *backend.Semaphore
 	bucketname string
 	prefix     string
@@ -39,7 +44,23 @@ const defaultLayout = "default"
 func Open(cfg Config) (restic.Backend, error) {
 	debug.Log("open, config %#v", cfg)
 
-	client, err := minio.New(cfg.Endpoint, cfg.KeyID, cfg.Secret, !cfg.UseHTTP)
+	var (
+		client *minio.Client
+		helper *credhelper.Helper
+		err    error
+	)
+
+	if cfg.CredentialHelper != "" {
+		helper, err = credhelper.New(cfg.CredentialHelper, "s3", path.Join(cfg.Endpoint, cfg.Bucket, cfg.Prefix))
+		if err != nil {
+			return nil, err
+		}
+
+		creds := credentials.New(helperProvider{helper})
+		client, err = minio.NewWithCredentials(cfg.Endpoint, creds, !cfg.UseHTTP, "")
+	} else {
+		client, err = minio.New(cfg.Endpoint, cfg.KeyID, cfg.Secret, !cfg.UseHTTP)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "minio.New")
 	}
@@ -51,6 +72,7 @@ func Open(cfg Config) (restic.Backend, error) {
 
 	be := &Backend{
 		client:     client,
+		helper:     helper,
 		sem:        sem,
 		bucketname: cfg.Bucket,
 		prefix:     cfg.Prefix,
@@ -82,6 +104,56 @@ func Open(cfg Config) (restic.Backend, error) {
 	return be, nil
 }
 
+// helperProvider returns the credentials obtained by a credential helper to
+// the minio client.
+type helperProvider struct {
+	helper *credhelper.Helper
+}
+
+func (p helperProvider) Retrieve() (credentials.Value, error) {
+	creds, err := p.helper.Get()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return credentials.Value{}, errors.Fatal("credential helper did not return access_key_id and secret_access_key")
+	}
+
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+func (p helperProvider) IsExpired() bool {
+	return p.helper.Expired()
+}
+
+// credentialErrors are the error codes returned by the server for expired or
+// invalid temporary credentials.
+var credentialErrors = map[string]bool{
+	"ExpiredToken":         true,
+	"InvalidToken":         true,
+	"TokenRefreshRequired": true,
+	"InvalidAccessKeyId":   true,
+}
+
+// checkCredentials makes sure that the credentials are obtained again from
+// the credential helper after the server rejected them with err.
+func (be *Backend) checkCredentials(err error) {
+	if be.helper == nil || err == nil {
+		return
+	}
+
+	if code := minio.ToErrorResponse(errors.Cause(err)).Code; credentialErrors[code] {
+		debug.Log("credentials rejected by server: %v", code)
+		be.helper.Expire()
+	}
+}
+
 // IsNotExist returns true if the error is caused by a not existing file.
 func (be *Backend) IsNotExist(err error) bool {
 	debug.Log("IsNotExist(%T, %#v)", err, err)
@@ -215,6 +287,11 @@ func (be *Backend) Save(ctx context.Context, h restic.Handle, rd io.Reader) (err
 		return err
 	}
 
+	md5sum, sha256sum, err := hashRemaining(rd)
+	if err != nil {
+		return err
+	}
+
 	debug.Log("Save %v at %v", h, objName)
 
 	// Check key does not already exist
@@ -237,14 +314,43 @@ func (be *Backend) Save(ctx context.Context, h restic.Handle, rd io.Reader) (err
 
 	debug.Log("PutObject(%v, %v)", be.bucketname, objName)
 	coreClient := minio.Core{Client: be.client}
-	info, err := coreClient.PutObject(be.bucketname, objName, size, rd, nil, nil, nil)
+	info, err := coreClient.PutObject(be.bucketname, objName, size, rd, md5sum, sha256sum, nil)
 
 	be.sem.ReleaseToken()
 	debug.Log("%v -> %v bytes, err %#v", objName, info.Size, err)
+	be.checkCredentials(err)
 
 	return errors.Wrap(err, "client.PutObject")
 }
 
+// hashRemaining returns the MD5 and SHA256 hashes of the remaining data in
+// rd, which are sent with the upload so that the server rejects the object if
+// the data it received is corrupted. rd is rewound afterwards. When rd is not
+// seekable, no hashes are computed and nil is returned.
+func hashRemaining(rd io.Reader) (md5sum, sha256sum []byte, err error) {
+	seeker, ok := rd.(io.Seeker)
+	if !ok {
+		debug.Log("unable to hash reader of type %T", rd)
+		return nil, nil, nil
+	}
+
+	pos, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Seek")
+	}
+
+	hmd5, hsha256 := md5.New(), sha256.New()
+	if _, err = io.Copy(io.MultiWriter(hmd5, hsha256), rd); err != nil {
+		return nil, nil, errors.Wrap(err, "Copy")
+	}
+
+	if _, err = seeker.Seek(pos, io.SeekStart); err != nil {
+		return nil, nil, errors.Wrap(err, "Seek")
+	}
+
+	return hmd5.Sum(nil), hsha256.Sum(nil), nil
+}
+
 // wrapReader wraps an io.ReadCloser to run an additional function on Close.
 type wrapReader struct {
 	io.ReadCloser
@@ -290,6 +396,7 @@ func (be *Backend) Load(ctx context.Context, h restic.Handle, length int, offset
 	rd, _, err := coreClient.GetObject(be.bucketname, objName, headers)
 	if err != nil {
 		be.sem.ReleaseToken()
+		be.checkCredentials(err)
 		return nil, err
 	}
 
@@ -328,6 +435,7 @@ func (be *Backend) Stat(ctx context.Context, h restic.Handle) (bi restic.FileInf
 	fi, err := obj.Stat()
 	if err != nil {
 		debug.Log("Stat() err %v", err)
+		be.checkCredentials(err)
 		return restic.FileInfo{}, errors.Wrap(err, "Stat")
 	}
 
@@ -342,6 +450,7 @@ func (be *Backend) Test(ctx context.Context, h restic.Handle) (bool, error) {
 	if err == nil {
 		found = true
 	}
+	be.checkCredentials(err)
 
 	// If error, then not found
 	return found, nil
@@ -352,9 +461,50 @@ func (be *Backend) Remove(ctx context.Context, h restic.Handle) error {
 	objName := be.Filename(h)
 	err := be.client.RemoveObject(be.bucketname, objName)
 	debug.Log("Remove(%v) at %v -> err %v", h, objName, err)
+	be.checkCredentials(err)
 	return errors.Wrap(err, "client.RemoveObject")
 }
 
+// make sure that *Backend implements restic.BulkRemover
+var _ restic.BulkRemover = &Backend{}
+
+// RemoveMulti removes all files in hs using the multi-object delete API, which
+// handles up to 1000 objects per request.
+func (be *Backend) RemoveMulti(ctx context.Context, hs []restic.Handle) error {
+	objects := make(chan string)
+	go func() {
+		defer close(objects)
+		for _, h := range hs {
+			select {
+			case objects <- be.Filename(h):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	be.sem.GetToken()
+	defer be.sem.ReleaseToken()
+
+	var (
+		firstErr error
+		failed   int
+	)
+	for e := range be.client.RemoveObjects(be.bucketname, objects) {
+		debug.Log("RemoveObjects: unable to remove %v: %v", e.ObjectName, e.Err)
+		if firstErr == nil {
+			firstErr = e.Err
+		}
+		failed++
+	}
+
+	if firstErr != nil {
+		return errors.Errorf("unable to remove %d of %d files, first error: %v", failed, len(hs), firstErr)
+	}
+
+	return ctx.Err()
+}
+
 // List returns a channel that yields all names of blobs of type t. A
 // goroutine is started for this. If the channel done is closed, sending
 // stops.
@@ -409,7 +559,13 @@ func (be *Backend) Delete(ctx context.Context) error {
 		restic.KeyFile,
 		restic.LockFile,
 		restic.SnapshotFile,
-		restic.IndexFile}
+		restic.IndexFile,
+		restic.DeletionFile,
+		restic.TrashFile,
+		restic.IntentFile,
+		restic.ConfigUpdateFile,
+		restic.DomainConfigFile,
+		restic.OperationFile}
 
 	for _, t := range alltypes {
 		err := be.removeKeys(ctx, t)
@@ -2,11 +2,18 @@ package s3
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
 	"io"
 	"io/ioutil"
 	"os"
+	"restic/backend/credhelper"
+	"restic/errors"
 	"restic/test"
+	"runtime"
 	"testing"
+
+	"github.com/minio/minio-go"
 )
 
 func writeFile(t testing.TB, data []byte, offset int64) *os.File {
@@ -69,3 +76,56 @@ func TestGetRemainingSize(t *testing.T) {
 		})
 	}
 }
+
+func TestHashRemaining(t *testing.T) {
+	data := test.Random(42, 5*1024)
+	offset := 1023
+	rest := data[offset:]
+
+	rd := bytes.NewReader(data)
+	_, err := rd.Seek(int64(offset), io.SeekStart)
+	test.OK(t, err)
+
+	md5sum, sha256sum, err := hashRemaining(rd)
+	test.OK(t, err)
+
+	wantMD5 := md5.Sum(rest)
+	wantSHA256 := sha256.Sum256(rest)
+	test.Equals(t, wantMD5[:], md5sum)
+	test.Equals(t, wantSHA256[:], sha256sum)
+
+	buf, err := ioutil.ReadAll(rd)
+	test.OK(t, err)
+	test.Assert(t, bytes.Equal(buf, rest), "reader was not rewound after hashing")
+
+	md5sum, sha256sum, err = hashRemaining(bytes.NewBufferString("foo"))
+	test.OK(t, err)
+	test.Assert(t, md5sum == nil && sha256sum == nil, "hashes computed for a reader which cannot be rewound")
+}
+
+func TestCredentialHelperProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on Windows")
+	}
+
+	helper, err := credhelper.New(`sh -c 'echo "{\"access_key_id\": \"key\", \"secret_access_key\": \"secret\", \"session_token\": \"token\"}"'`, "s3", "bucket")
+	test.OK(t, err)
+
+	p := helperProvider{helper}
+	test.Assert(t, p.IsExpired(), "provider without credentials is not expired")
+
+	v, err := p.Retrieve()
+	test.OK(t, err)
+	test.Equals(t, "key", v.AccessKeyID)
+	test.Equals(t, "secret", v.SecretAccessKey)
+	test.Equals(t, "token", v.SessionToken)
+	test.Assert(t, !p.IsExpired(), "credentials without TTL expired")
+
+	be := &Backend{helper: helper}
+
+	be.checkCredentials(errors.Wrap(minio.ErrorResponse{Code: "NoSuchKey"}, "Stat"))
+	test.Assert(t, !p.IsExpired(), "credentials expired for unrelated error")
+
+	be.checkCredentials(errors.Wrap(minio.ErrorResponse{Code: "ExpiredToken"}, "Stat"))
+	test.Assert(t, p.IsExpired(), "credentials not expired after the server rejected them")
+}
@@ -14,6 +14,10 @@ type Config struct {
 	User, Host, Path string
 	Layout           string `option:"layout" help:"use this backend directory layout (default: auto-detect)"`
 	Command          string `option:"command" help:"specify command to create sftp connection"`
+	Client           string `option:"client" help:"use the external ssh program (\"ssh\") or the built-in ssh client (\"internal\") (default: ssh)"`
+	ProxyJump        string `option:"proxy-jump" help:"connect via this jump host ([user@]host[:port], only for the built-in client)"`
+	KnownHosts       string `option:"known-hosts" help:"verify the host keys with this known_hosts file (default: ~/.ssh/known_hosts, only for the built-in client)"`
+	IdentityFile     string `option:"identity-file" help:"authenticate with this unencrypted private key (default: ~/.ssh/id_*, only for the built-in client)"`
 }
 
 func init() {
@@ -16,6 +16,7 @@ import (
 
 	"restic/backend"
 	"restic/debug"
+	"restic/shell"
 
 	"github.com/pkg/sftp"
 )
@@ -28,6 +29,9 @@ type SFTP struct {
 	cmd    *exec.Cmd
 	result <-chan error
 
+	// closeConn closes the connection of the built-in ssh client
+	closeConn func() error
+
 	backend.Layout
 	Config
 }
@@ -36,6 +40,9 @@ var _ restic.Backend = &SFTP{}
 
 const defaultLayout = "default"
 
+// sshFxNoSuchFile is the status code SSH_FX_NO_SUCH_FILE of the sftp protocol.
+const sshFxNoSuchFile = 2
+
 func startClient(program string, args ...string) (*SFTP, error) {
 	debug.Log("start client %v %v", program, args)
 	// Connect to a remote host and request the sftp subsystem via the 'ssh'
@@ -103,10 +110,23 @@ func (r *SFTP) clientError() error {
 	return nil
 }
 
-// Open opens an sftp backend as described by the config by running
-// "ssh" with the appropriate arguments (or cfg.Command, if set).
-func Open(cfg Config) (*SFTP, error) {
-	debug.Log("open backend with config %#v", cfg)
+// connect opens the sftp session, either with the built-in ssh client or by
+// running "ssh" with the appropriate arguments (or cfg.Command, if set).
+func connect(cfg Config) (*SFTP, error) {
+	switch cfg.Client {
+	case "", "ssh":
+	case "internal":
+		if cfg.Command != "" {
+			return nil, errors.New("sftp.command cannot be used with the built-in ssh client")
+		}
+		return startInternalClient(cfg)
+	default:
+		return nil, errors.Errorf("invalid ssh client %q, use \"ssh\" or \"internal\"", cfg.Client)
+	}
+
+	if cfg.ProxyJump != "" {
+		return nil, errors.New("sftp.proxy-jump is only supported by the built-in ssh client (-o sftp.client=internal)")
+	}
 
 	cmd, args, err := buildSSHCommand(cfg)
 	if err != nil {
@@ -119,6 +139,18 @@ func Open(cfg Config) (*SFTP, error) {
 		return nil, err
 	}
 
+	return sftp, nil
+}
+
+// Open opens an sftp backend as described by the config, see connect.
+func Open(cfg Config) (*SFTP, error) {
+	debug.Log("open backend with config %#v", cfg)
+
+	sftp, err := connect(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	sftp.Layout, err = backend.ParseLayout(sftp, cfg.Layout, defaultLayout, cfg.Path)
 	if err != nil {
 		return nil, err
@@ -152,12 +184,13 @@ func (r *SFTP) IsNotExist(err error) bool {
 		return false
 	}
 
-	return statusError.Error() == `sftp: "No such file" (SSH_FX_NO_SUCH_FILE)`
+	// the message depends on the server, so only the status code is checked
+	return statusError.Code == sshFxNoSuchFile
 }
 
 func buildSSHCommand(cfg Config) (cmd string, args []string, err error) {
 	if cfg.Command != "" {
-		return SplitShellArgs(cfg.Command)
+		return shell.SplitArgs(cfg.Command)
 	}
 
 	cmd = "ssh"
@@ -176,17 +209,10 @@ func buildSSHCommand(cfg Config) (cmd string, args []string, err error) {
 	return cmd, args, nil
 }
 
-// Create creates an sftp backend as described by the config by running
-// "ssh" with the appropriate arguments (or cfg.Command, if set).
+// Create creates an sftp backend as described by the config, see connect.
 func Create(cfg Config) (*SFTP, error) {
-	cmd, args, err := buildSSHCommand(cfg)
-	if err != nil {
-		return nil, err
-	}
-
-	sftp, err := startClient(cmd, args...)
+	sftp, err := connect(cfg)
 	if err != nil {
-		debug.Log("unable to start program: %v", err)
 		return nil, err
 	}
 
@@ -439,6 +465,10 @@ func (r *SFTP) Close() error {
 	err := r.c.Close()
 	debug.Log("Close returned error %v", err)
 
+	if r.closeConn != nil {
+		return r.closeConn()
+	}
+
 	// wait for closeTimeout before killing the process
 	select {
 	case err := <-r.result:
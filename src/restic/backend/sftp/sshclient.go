@@ -0,0 +1,261 @@
+package sftp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"restic/debug"
+	"restic/errors"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const dialTimeout = 30 * time.Second
+
+// defaultIdentityFiles are the private keys (relative to ~/.ssh) which are
+// tried by the internal client, like OpenSSH does.
+var defaultIdentityFiles = []string{"id_rsa", "id_ecdsa", "id_ed25519"}
+
+// homeDir returns the home directory of the current user.
+func homeDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return home
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return usr.HomeDir
+}
+
+// splitUserHost splits s ("[user@]host[:port]") into the user and the
+// address, the port defaults to 22. If no user is given, defaultUser is used.
+func splitUserHost(s, defaultUser string) (username, addr string) {
+	username = defaultUser
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		username, s = s[:i], s[i+1:]
+	}
+
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(s, "22")
+	}
+
+	return username, s
+}
+
+// currentUser returns the name of the user running restic.
+func currentUser() string {
+	if usr, err := user.Current(); err == nil {
+		// on Windows, the name contains the domain
+		name := usr.Username
+		if i := strings.LastIndex(name, `\`); i >= 0 {
+			name = name[i+1:]
+		}
+		return name
+	}
+
+	return os.Getenv("USER")
+}
+
+// prompt asks the user for a secret on the terminal.
+func prompt(question string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", errors.New("unable to ask for credentials, stdin is not a terminal")
+	}
+
+	fmt.Fprint(os.Stderr, question)
+	buf, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errors.Wrap(err, "ReadPassword")
+	}
+
+	return string(buf), nil
+}
+
+// authMethods returns the methods used by the internal client to
+// authenticate: the keys of a running agent, the default private keys
+// (which must not be encrypted), and the password or keyboard-interactive
+// authentication with prompts on the terminal.
+func authMethods(cfg Config, username, addr string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			debug.Log("unable to connect to the ssh agent: %v", err)
+		}
+	}
+
+	identityFiles := []string{cfg.IdentityFile}
+	if cfg.IdentityFile == "" {
+		identityFiles = nil
+		for _, name := range defaultIdentityFiles {
+			identityFiles = append(identityFiles, filepath.Join(homeDir(), ".ssh", name))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, filename := range identityFiles {
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil {
+			debug.Log("unable to read private key: %v", err)
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey(buf)
+		if err != nil {
+			// encrypted keys are only supported via the agent
+			debug.Log("unable to use private key %v: %v", filename, err)
+			continue
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	methods = append(methods,
+		ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			if instruction != "" {
+				fmt.Fprintln(os.Stderr, instruction)
+			}
+
+			answers := make([]string, len(questions))
+			for i, q := range questions {
+				answer, err := prompt(q)
+				if err != nil {
+					return nil, err
+				}
+				answers[i] = answer
+			}
+			return answers, nil
+		}),
+		ssh.PasswordCallback(func() (string, error) {
+			return prompt(fmt.Sprintf("password for %v@%v: ", username, addr))
+		}),
+	)
+
+	return methods
+}
+
+// clientConfig returns the configuration for connecting to the server at addr
+// as username. The host keys are verified against the known_hosts file.
+func clientConfig(cfg Config, username, addr string) (*ssh.ClientConfig, error) {
+	filename := cfg.KnownHosts
+	if filename == "" {
+		filename = filepath.Join(homeDir(), ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "knownhosts.New")
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            authMethods(cfg, username, addr),
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         dialTimeout,
+	}, nil
+}
+
+// dialSSH connects to the server at cfg.Host, via the jump host if
+// configured. The returned function closes all connections.
+func dialSSH(cfg Config) (*ssh.Client, func() error, error) {
+	username, addr := splitUserHost(cfg.Host, cfg.User)
+	if username == "" {
+		username = currentUser()
+	}
+
+	config, err := clientConfig(cfg, username, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.ProxyJump == "" {
+		debug.Log("connecting to %v as %v", addr, username)
+		client, err := ssh.Dial("tcp", addr, config)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "connecting to %v", addr)
+		}
+		return client, client.Close, nil
+	}
+
+	jumpUser, jumpAddr := splitUserHost(cfg.ProxyJump, username)
+	jumpConfig, err := clientConfig(cfg, jumpUser, jumpAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	debug.Log("connecting to jump host %v as %v", jumpAddr, jumpUser)
+	jump, err := ssh.Dial("tcp", jumpAddr, jumpConfig)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "connecting to jump host %v", jumpAddr)
+	}
+
+	debug.Log("connecting to %v as %v via %v", addr, username, jumpAddr)
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		_ = jump.Close()
+		return nil, nil, errors.Wrapf(err, "connecting to %v via %v", addr, jumpAddr)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		_ = jump.Close()
+		return nil, nil, errors.Wrapf(err, "connecting to %v via %v", addr, jumpAddr)
+	}
+
+	client := ssh.NewClient(c, chans, reqs)
+	closeAll := func() error {
+		err := client.Close()
+		if e := jump.Close(); err == nil {
+			err = e
+		}
+		return err
+	}
+
+	return client, closeAll, nil
+}
+
+// startInternalClient opens the sftp session with the built-in ssh client
+// instead of running an external program.
+func startInternalClient(cfg Config) (*SFTP, error) {
+	client, closeConn, err := dialSSH(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// report when the connection is closed, like an exiting ssh program
+	ch := make(chan error, 1)
+	go func() {
+		err := client.Wait()
+		debug.Log("ssh connection closed, err %v", err)
+		ch <- errors.Wrap(err, "ssh connection")
+	}()
+
+	c, err := sftp.NewClient(client)
+	if err != nil {
+		_ = closeConn()
+		return nil, errors.Errorf("unable to start the sftp session, error: %v", err)
+	}
+
+	return &SFTP{c: c, closeConn: closeConn, result: ch}, nil
+}
@@ -0,0 +1,247 @@
+package sftp_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"restic"
+	"restic/backend/sftp"
+	"restic/backend/test"
+	"testing"
+
+	. "restic/test"
+
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newTestKey generates an RSA key, the private key is written to filename if
+// it is not empty.
+func newTestKey(t testing.TB, filename string) ssh.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	OK(t, err)
+
+	if filename != "" {
+		buf := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		OK(t, ioutil.WriteFile(filename, buf, 0600))
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	OK(t, err)
+	return signer
+}
+
+// serveSSH runs a minimal ssh server on l, which accepts the client key,
+// serves the sftp subsystem and forwards TCP connections (for jump hosts).
+func serveSSH(l net.Listener, hostKey ssh.Signer, clientKey ssh.PublicKey) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		// NewServerConn modifies the config, so each connection gets its own
+		config := &ssh.ServerConfig{
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if string(key.Marshal()) != string(clientKey.Marshal()) {
+					return nil, fmt.Errorf("unknown key for %v", conn.User())
+				}
+				return nil, nil
+			},
+		}
+		config.AddHostKey(hostKey)
+
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+
+			for newChannel := range chans {
+				go handleChannel(newChannel)
+			}
+		}()
+	}
+}
+
+func handleChannel(newChannel ssh.NewChannel) {
+	switch newChannel.ChannelType() {
+	case "session":
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		defer ch.Close()
+
+		for req := range reqs {
+			if req.Type != "subsystem" || string(req.Payload[4:]) != "sftp" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+
+			srv, err := pkgsftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			_ = srv.Serve()
+			return
+		}
+
+	case "direct-tcpip":
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+
+		conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+
+		go func() {
+			_, _ = io.Copy(ch, conn)
+			_ = ch.Close()
+		}()
+		_, _ = io.Copy(conn, ch)
+		_ = conn.Close()
+
+	default:
+		_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+	}
+}
+
+// startTestSSHServer starts an ssh server and returns its address and a
+// config for the built-in client, which trusts the server and authenticates
+// with a new key.
+func startTestSSHServer(t testing.TB, dir string) (addr string, cfg sftp.Config, cleanup func()) {
+	hostKey := newTestKey(t, "")
+	identityFile := filepath.Join(dir, "id_rsa")
+	clientKey := newTestKey(t, identityFile)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	OK(t, err)
+	go serveSSH(l, hostKey, clientKey.PublicKey())
+
+	addr = l.Addr().String()
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{addr}, hostKey.PublicKey())
+	OK(t, ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600))
+
+	cfg = sftp.Config{
+		User:         "user",
+		Host:         addr,
+		Client:       "internal",
+		KnownHosts:   knownHosts,
+		IdentityFile: identityFile,
+	}
+
+	return addr, cfg, func() { _ = l.Close() }
+}
+
+func newInternalClientTestSuite(t testing.TB, cfg sftp.Config) *test.Suite {
+	return &test.Suite{
+		NewConfig: func() (interface{}, error) {
+			dir, err := ioutil.TempDir(TestTempDir, "restic-test-sftp-")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := cfg
+			cfg.Path = dir
+			return cfg, nil
+		},
+
+		Create: func(config interface{}) (restic.Backend, error) {
+			return sftp.Create(config.(sftp.Config))
+		},
+
+		Open: func(config interface{}) (restic.Backend, error) {
+			return sftp.Open(config.(sftp.Config))
+		},
+
+		Cleanup: func(config interface{}) error {
+			RemoveAll(t, config.(sftp.Config).Path)
+			return nil
+		},
+	}
+}
+
+func TestBackendSFTPInternalClient(t *testing.T) {
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	_, cfg, stop := startTestSSHServer(t, tempdir)
+	defer stop()
+
+	newInternalClientTestSuite(t, cfg).RunTests(t)
+}
+
+func TestSFTPInternalClientProxyJump(t *testing.T) {
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	addr, cfg, stop := startTestSSHServer(t, tempdir)
+	defer stop()
+
+	// the server forwards the connection to itself
+	cfg.ProxyJump = "jump@" + addr
+	cfg.Path = filepath.Join(tempdir, "repo")
+
+	be, err := sftp.Create(cfg)
+	OK(t, err)
+	OK(t, be.Close())
+
+	be, err = sftp.Open(cfg)
+	OK(t, err)
+	OK(t, be.Close())
+}
+
+func TestSFTPInternalClientUnknownHost(t *testing.T) {
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	_, cfg, stop := startTestSSHServer(t, tempdir)
+	defer stop()
+
+	OK(t, ioutil.WriteFile(cfg.KnownHosts, nil, 0600))
+	cfg.Path = filepath.Join(tempdir, "repo")
+
+	_, err := sftp.Create(cfg)
+	Assert(t, err != nil, "connection to a host with an unknown key succeeded")
+}
+
+func TestSFTPClientOptions(t *testing.T) {
+	var tests = []sftp.Config{
+		{Host: "host", Path: "/srv", Client: "putty"},
+		{Host: "host", Path: "/srv", ProxyJump: "jump"},
+		{Host: "host", Path: "/srv", Client: "internal", Command: "ssh host"},
+	}
+
+	for _, cfg := range tests {
+		_, err := sftp.Open(cfg)
+		Assert(t, err != nil, "no error for invalid config %#v", cfg)
+	}
+}
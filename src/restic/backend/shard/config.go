@@ -0,0 +1,43 @@
+package shard
+
+import (
+	"strings"
+
+	"restic/errors"
+)
+
+// Config contains the locations of the backends the repository is
+// distributed across.
+type Config struct {
+	Locations []string
+}
+
+// ParseConfig parses the string s and extracts the shard config. The
+// locations of the backends are separated by '|', e.g.
+// shard:/srv/repo1|sftp:host:/srv/repo2. At least two locations are needed,
+// and their order must not change after the repository has been created.
+func ParseConfig(s string) (interface{}, error) {
+	if !strings.HasPrefix(s, "shard:") {
+		return nil, errors.New("invalid shard backend specification")
+	}
+
+	var cfg Config
+	for _, loc := range strings.Split(s[6:], "|") {
+		loc = strings.TrimSpace(loc)
+		if loc == "" {
+			return nil, errors.New("shard: empty location")
+		}
+
+		if strings.HasPrefix(loc, "shard:") || strings.HasPrefix(loc, "mirror:") {
+			return nil, errors.New("shard: locations must not be shard or mirror backends")
+		}
+
+		cfg.Locations = append(cfg.Locations, loc)
+	}
+
+	if len(cfg.Locations) < 2 {
+		return nil, errors.New("shard: at least two locations are needed")
+	}
+
+	return cfg, nil
+}
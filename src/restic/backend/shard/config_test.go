@@ -0,0 +1,51 @@
+package shard
+
+import (
+	"reflect"
+	"testing"
+)
+
+var configTests = []struct {
+	s   string
+	cfg Config
+}{
+	{"shard:/srv/repo1|/srv/repo2", Config{
+		Locations: []string{"/srv/repo1", "/srv/repo2"},
+	}},
+	{"shard:s3:s3.amazonaws.com/bucket1 | s3:s3.amazonaws.com/bucket2 | rest:http://host:8000/", Config{
+		Locations: []string{"s3:s3.amazonaws.com/bucket1", "s3:s3.amazonaws.com/bucket2", "rest:http://host:8000/"},
+	}},
+}
+
+func TestParseConfig(t *testing.T) {
+	for i, test := range configTests {
+		cfg, err := ParseConfig(test.s)
+		if err != nil {
+			t.Errorf("test %d:%s failed: %v", i, test.s, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(cfg, test.cfg) {
+			t.Errorf("test %d:\ninput:\n  %s\n wrong config, want:\n  %v\ngot:\n  %v",
+				i, test.s, test.cfg, cfg)
+			continue
+		}
+	}
+}
+
+var invalidConfigTests = []string{
+	"shard:/srv/repo",
+	"shard:/srv/repo1|",
+	"shard:/srv/repo1||/srv/repo2",
+	"shard:/srv/repo1|shard:/srv/repo2|/srv/repo3",
+	"shard:/srv/repo1|mirror:/srv/repo2",
+	"local:/srv/repo",
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for _, s := range invalidConfigTests {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("no error for invalid config %q", s)
+		}
+	}
+}
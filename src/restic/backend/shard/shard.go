@@ -0,0 +1,285 @@
+// Package shard implements a backend which distributes a repository across
+// several backends. Each data file is stored in one of the backends, which is
+// selected by the hash of the file name, all other files (config, keys,
+// locks, snapshots and index files) are stored in all backends.
+package shard
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"restic"
+	"strings"
+
+	"restic/debug"
+	"restic/errors"
+)
+
+// Backend distributes the data files across several backends.
+type Backend struct {
+	backends []restic.Backend
+}
+
+// make sure that *Backend implements restic.Backend
+var _ restic.Backend = &Backend{}
+
+// New returns a backend which distributes the data files across backends.
+// The order of the backends must always be the same for a repository.
+func New(backends []restic.Backend) (*Backend, error) {
+	if len(backends) < 2 {
+		return nil, errors.New("at least two backends are needed")
+	}
+
+	return &Backend{backends: backends}, nil
+}
+
+// mirrored returns true if files of type t are stored in all backends.
+func mirrored(t restic.FileType) bool {
+	return t != restic.DataFile
+}
+
+// Shard returns the index of the backend the data file name is stored in.
+func (be *Backend) Shard(name string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return int(h.Sum32() % uint32(len(be.backends)))
+}
+
+// order returns the indexes of the backends in the order in which they are
+// tried to find the file h. For data files, the backend selected by the hash
+// comes first, the others are tried in case the file has been stored with a
+// different number of backends.
+func (be *Backend) order(h restic.Handle) []int {
+	first := 0
+	if !mirrored(h.Type) {
+		first = be.Shard(h.Name)
+	}
+
+	order := make([]int, 0, len(be.backends))
+	order = append(order, first)
+	for i := range be.backends {
+		if i != first {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// Location returns the locations of all backends.
+func (be *Backend) Location() string {
+	locs := make([]string, 0, len(be.backends))
+	for _, b := range be.backends {
+		locs = append(locs, b.Location())
+	}
+	return "shard:" + strings.Join(locs, "|")
+}
+
+// Test returns true if the file exists in one of the backends.
+func (be *Backend) Test(ctx context.Context, h restic.Handle) (bool, error) {
+	var firstErr error
+	for _, i := range be.order(h) {
+		found, err := be.backends[i].Test(ctx, h)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		if found {
+			return true, nil
+		}
+	}
+
+	return false, firstErr
+}
+
+// Remove removes the file from all backends it is stored in.
+func (be *Backend) Remove(ctx context.Context, h restic.Handle) error {
+	if mirrored(h.Type) {
+		var firstErr error
+		for _, b := range be.backends {
+			if err := b.Remove(ctx, h); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	order := be.order(h)
+	err := be.backends[order[0]].Remove(ctx, h)
+	if err == nil {
+		return nil
+	}
+
+	// the file may be stored in another backend
+	for _, i := range order[1:] {
+		if found, e := be.backends[i].Test(ctx, h); e == nil && found {
+			return be.backends[i].Remove(ctx, h)
+		}
+	}
+
+	return err
+}
+
+// Close closes all backends.
+func (be *Backend) Close() error {
+	var firstErr error
+	for _, b := range be.backends {
+		if err := b.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Save stores a data file in the backend selected by the hash of its name,
+// other files are stored in all backends.
+func (be *Backend) Save(ctx context.Context, h restic.Handle, rd io.Reader) error {
+	if err := h.Valid(); err != nil {
+		return err
+	}
+
+	if !mirrored(h.Type) {
+		i := be.Shard(h.Name)
+		debug.Log("Save %v in backend %d", h, i)
+		return be.backends[i].Save(ctx, h, rd)
+	}
+
+	// these files are small, so they are read into memory once
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return errors.Wrap(err, "ReadAll")
+	}
+
+	for i, b := range be.backends {
+		if err = b.Save(ctx, h, bytes.NewReader(buf)); err != nil {
+			return errors.Wrapf(err, "backend %d", i)
+		}
+	}
+
+	return nil
+}
+
+// Load returns a reader for the file h from the first backend which contains
+// it.
+func (be *Backend) Load(ctx context.Context, h restic.Handle, length int, offset int64) (io.ReadCloser, error) {
+	var firstErr error
+	for _, i := range be.order(h) {
+		rd, err := be.backends[i].Load(ctx, h, length, offset)
+		if err == nil {
+			return rd, nil
+		}
+
+		debug.Log("Load %v from backend %d failed: %v", h, i, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+// Stat returns information about the file h from the first backend which
+// contains it.
+func (be *Backend) Stat(ctx context.Context, h restic.Handle) (restic.FileInfo, error) {
+	var firstErr error
+	for _, i := range be.order(h) {
+		fi, err := be.backends[i].Stat(ctx, h)
+		if err == nil {
+			return fi, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return restic.FileInfo{}, firstErr
+}
+
+// List returns the names of the files of type t in all backends, each name is
+// only returned once.
+func (be *Backend) List(ctx context.Context, t restic.FileType) <-chan string {
+	ch := make(chan string)
+
+	go func() {
+		defer close(ch)
+
+		seen := make(map[string]struct{})
+		for _, b := range be.backends {
+			for name := range b.List(ctx, t) {
+				if _, ok := seen[name]; ok {
+					continue
+				}
+				seen[name] = struct{}{}
+
+				select {
+				case ch <- name:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+// make sure that *Backend implements restic.BulkRemover
+var _ restic.BulkRemover = &Backend{}
+
+// RemoveMulti removes all files in hs, the files are grouped by the backend
+// they are stored in.
+func (be *Backend) RemoveMulti(ctx context.Context, hs []restic.Handle) error {
+	groups := make([][]restic.Handle, len(be.backends))
+	var firstErr error
+	for _, h := range hs {
+		if mirrored(h.Type) {
+			if err := be.Remove(ctx, h); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		i := be.Shard(h.Name)
+		groups[i] = append(groups[i], h)
+	}
+
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+
+		var err error
+		if bulk, ok := be.backends[i].(restic.BulkRemover); ok {
+			err = bulk.RemoveMulti(ctx, group)
+		} else {
+			for _, h := range group {
+				if e := be.Remove(ctx, h); e != nil && err == nil {
+					err = e
+				}
+			}
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Delete removes the repository from all backends.
+func (be *Backend) Delete(ctx context.Context) error {
+	for _, b := range be.backends {
+		if d, ok := b.(restic.Deleter); ok {
+			if err := d.Delete(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
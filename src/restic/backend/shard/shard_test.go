@@ -0,0 +1,155 @@
+package shard_test
+
+import (
+	"bytes"
+	"context"
+	"restic"
+	"testing"
+
+	"restic/backend"
+	"restic/backend/mem"
+	"restic/backend/shard"
+	"restic/backend/test"
+	"restic/errors"
+	rtest "restic/test"
+)
+
+type shardConfig struct {
+	backends []*mem.MemoryBackend
+}
+
+func (cfg *shardConfig) open() (restic.Backend, error) {
+	backends := make([]restic.Backend, 0, len(cfg.backends))
+	for _, be := range cfg.backends {
+		backends = append(backends, be)
+	}
+	return shard.New(backends)
+}
+
+func newTestSuite() *test.Suite {
+	return &test.Suite{
+		// NewConfig returns a config for a new temporary backend that will be used in tests.
+		NewConfig: func() (interface{}, error) {
+			return &shardConfig{}, nil
+		},
+
+		// CreateFn is a function that creates a temporary repository for the tests.
+		Create: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(*shardConfig)
+			if cfg.backends != nil {
+				be, err := cfg.open()
+				if err != nil {
+					return nil, err
+				}
+
+				ok, err := be.Test(context.TODO(), restic.Handle{Type: restic.ConfigFile})
+				if err != nil {
+					return nil, err
+				}
+
+				if ok {
+					return nil, errors.New("config already exists")
+				}
+			}
+
+			cfg.backends = []*mem.MemoryBackend{mem.New(), mem.New(), mem.New()}
+			return cfg.open()
+		},
+
+		// OpenFn is a function that opens a previously created temporary repository.
+		Open: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(*shardConfig)
+			if cfg.backends == nil {
+				cfg.backends = []*mem.MemoryBackend{mem.New(), mem.New(), mem.New()}
+			}
+			return cfg.open()
+		},
+
+		// CleanupFn removes data created during the tests.
+		Cleanup: func(config interface{}) error {
+			// no cleanup needed
+			return nil
+		},
+	}
+}
+
+func TestSuiteBackendShard(t *testing.T) {
+	newTestSuite().RunTests(t)
+}
+
+func count(t testing.TB, be restic.Backend, tpe restic.FileType) int {
+	n := 0
+	for range be.List(context.TODO(), tpe) {
+		n++
+	}
+	return n
+}
+
+func TestShardDistribution(t *testing.T) {
+	backends := []*mem.MemoryBackend{mem.New(), mem.New(), mem.New()}
+	be, err := shard.New([]restic.Backend{backends[0], backends[1], backends[2]})
+	rtest.OK(t, err)
+
+	const files = 300
+	for i := 0; i < files; i++ {
+		id := restic.NewRandomID()
+		h := restic.Handle{Type: restic.DataFile, Name: id.String()}
+		rtest.OK(t, be.Save(context.TODO(), h, bytes.NewReader(id[:])))
+
+		// the file is stored only in the selected backend
+		for j, b := range backends {
+			found, err := b.Test(context.TODO(), h)
+			rtest.OK(t, err)
+			rtest.Assert(t, found == (j == be.Shard(h.Name)), "file %v found in backend %d: %v", h, j, found)
+		}
+	}
+
+	for i, b := range backends {
+		n := count(t, b, restic.DataFile)
+		rtest.Assert(t, n > files/6, "backend %d contains only %d of %d files", i, n, files)
+	}
+	rtest.Equals(t, files, count(t, be, restic.DataFile))
+
+	// other files are stored in all backends, but listed once
+	h := restic.Handle{Type: restic.SnapshotFile, Name: restic.NewRandomID().String()}
+	rtest.OK(t, be.Save(context.TODO(), h, bytes.NewReader([]byte("snapshot"))))
+	for i, b := range backends {
+		rtest.Equals(t, 1, count(t, b, restic.SnapshotFile))
+
+		buf, err := backend.LoadAll(context.TODO(), b, h)
+		rtest.OK(t, err)
+		rtest.Assert(t, string(buf) == "snapshot", "wrong data in backend %d: %q", i, buf)
+	}
+	rtest.Equals(t, 1, count(t, be, restic.SnapshotFile))
+
+	rtest.OK(t, be.Remove(context.TODO(), h))
+	for _, b := range backends {
+		rtest.Equals(t, 0, count(t, b, restic.SnapshotFile))
+	}
+}
+
+func TestShardMovedFile(t *testing.T) {
+	backends := []*mem.MemoryBackend{mem.New(), mem.New()}
+	be, err := shard.New([]restic.Backend{backends[0], backends[1]})
+	rtest.OK(t, err)
+
+	// store a data file in the backend it does not belong to, e.g. because
+	// the number of backends has changed
+	id := restic.NewRandomID()
+	h := restic.Handle{Type: restic.DataFile, Name: id.String()}
+	other := backends[1-be.Shard(h.Name)]
+	rtest.OK(t, other.Save(context.TODO(), h, bytes.NewReader(id[:])))
+
+	found, err := be.Test(context.TODO(), h)
+	rtest.OK(t, err)
+	rtest.Assert(t, found, "file in other backend not found")
+
+	buf, err := backend.LoadAll(context.TODO(), be, h)
+	rtest.OK(t, err)
+	rtest.Equals(t, id[:], buf)
+
+	rtest.OK(t, be.RemoveMulti(context.TODO(), []restic.Handle{h}))
+	found, err = other.Test(context.TODO(), h)
+	rtest.OK(t, err)
+	rtest.Assert(t, !found, "file not removed from other backend")
+}
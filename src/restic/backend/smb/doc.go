@@ -0,0 +1,5 @@
+// Package smb implements repository storage in a directory on an SMB2/3 file
+// share, e.g. a Windows share or a Samba server. The share is accessed
+// directly without mounting it, and the connection is re-established when it
+// breaks.
+package smb
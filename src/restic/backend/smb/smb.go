@@ -0,0 +1,632 @@
+package smb
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path"
+	"restic"
+	"strings"
+	"sync"
+	"time"
+
+	"restic/backend"
+	"restic/debug"
+	"restic/errors"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// Backend stores data on an SMB share.
+type Backend struct {
+	cfg Config
+	sem *backend.Semaphore
+
+	m sync.Mutex
+	c *conn // nil if not connected
+
+	backend.Layout
+}
+
+var _ restic.Backend = &Backend{}
+
+const defaultLayout = "default"
+
+// maxRetries is the number of times an operation is retried after the
+// connection broke.
+const maxRetries = 5
+
+// retryDelay is multiplied with the number of the retry to get the time to
+// wait before reconnecting.
+var retryDelay = time.Second
+
+// dialTimeout limits the time for establishing the connection.
+var dialTimeout = 30 * time.Second
+
+// keepAlive is the interval of TCP keep-alive probes, so that a connection
+// to a server which has vanished is detected.
+var keepAlive = 30 * time.Second
+
+// partialSuffix is appended to the name of files while they are uploaded.
+const partialSuffix = ".partial"
+
+// NTSTATUS codes (see [MS-ERREF]) which are checked by the backend.
+const (
+	statusNoSuchFile            = 0xC000000F
+	statusObjectNameNotFound    = 0xC0000034
+	statusObjectPathNotFound    = 0xC000003A
+	statusNetworkNameDeleted    = 0xC00000C9
+	statusUserSessionDeleted    = 0xC0000203
+	statusNetworkSessionExpired = 0xC000035C
+)
+
+// conn is an authenticated connection with the share mounted. It is safe for
+// concurrent use, requests are multiplexed over the connection.
+type conn struct {
+	tcp     net.Conn
+	session *smb2.Session
+	share   *smb2.Share
+}
+
+func newBackend(cfg Config) (*Backend, error) {
+	if cfg.Connections <= 0 {
+		return nil, errors.New("smb.connections must be a positive number")
+	}
+
+	sem, err := backend.NewSemaphore(uint(cfg.Connections))
+	if err != nil {
+		return nil, err
+	}
+
+	be := &Backend{cfg: cfg, sem: sem}
+
+	// connect once to report errors early
+	if _, err = be.connect(); err != nil {
+		return nil, err
+	}
+
+	be.Layout, err = backend.ParseLayout(be, cfg.Layout, defaultLayout, cfg.Path)
+	if err != nil {
+		_ = be.Close()
+		return nil, err
+	}
+
+	debug.Log("layout: %v", be.Layout)
+	return be, nil
+}
+
+// Open opens the SMB backend as described by the config.
+func Open(cfg Config) (*Backend, error) {
+	debug.Log("open backend at %v/%v/%v", cfg.Host, cfg.Share, cfg.Path)
+	return newBackend(cfg)
+}
+
+// Create creates the directories for a new repository on the share.
+func Create(cfg Config) (*Backend, error) {
+	debug.Log("create backend at %v/%v/%v", cfg.Host, cfg.Share, cfg.Path)
+	be, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = be.Stat(context.TODO(), restic.Handle{Type: restic.ConfigFile})
+	if err == nil {
+		_ = be.Close()
+		return nil, errors.New("config file already exists")
+	}
+
+	for _, d := range be.Paths() {
+		err = be.do(context.TODO(), func(share *smb2.Share) error {
+			return share.MkdirAll(d, backend.Modes.Dir)
+		})
+		debug.Log("MkdirAll %v -> %v", d, err)
+		if err != nil {
+			_ = be.Close()
+			return nil, errors.Wrap(err, "MkdirAll")
+		}
+	}
+
+	return be, nil
+}
+
+// connect returns the current connection or establishes a new one.
+func (be *Backend) connect() (*conn, error) {
+	be.m.Lock()
+	defer be.m.Unlock()
+
+	if be.c != nil {
+		return be.c, nil
+	}
+
+	debug.Log("connect to %v", be.cfg.address())
+	dialer := net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlive}
+	tcp, err := dialer.Dial("tcp", be.cfg.address())
+	if err != nil {
+		return nil, errors.Wrap(err, "Dial")
+	}
+
+	d := &smb2.Dialer{
+		Initiator: &smb2.NTLMInitiator{
+			User:     be.cfg.User,
+			Password: be.cfg.Password,
+			Domain:   be.cfg.Domain,
+		},
+	}
+
+	session, err := d.Dial(tcp)
+	if err != nil {
+		_ = tcp.Close()
+		return nil, errors.Wrap(err, "session setup")
+	}
+
+	share, err := session.Mount(be.cfg.Share)
+	if err != nil {
+		_ = session.Logoff()
+		_ = tcp.Close()
+		return nil, errors.Wrapf(err, "mount share %v", be.cfg.Share)
+	}
+
+	be.c = &conn{tcp: tcp, session: session, share: share}
+	return be.c, nil
+}
+
+// reset closes the connection c after it broke. If another goroutine has
+// already replaced it, nothing is done.
+func (be *Backend) reset(c *conn) {
+	be.m.Lock()
+	defer be.m.Unlock()
+
+	if be.c != c {
+		return
+	}
+
+	debug.Log("close broken connection")
+	_ = c.tcp.Close()
+	be.c = nil
+}
+
+// retry returns true if an operation which failed with err for the
+// retries'th time should be run again. If the connection c is broken, it is
+// closed so that the next attempt reconnects.
+func (be *Backend) retry(c *conn, err error, retries int) bool {
+	if retries >= maxRetries || !isConnError(err) {
+		return false
+	}
+
+	if c != nil {
+		be.reset(c)
+	}
+
+	debug.Log("retry after error %v", err)
+	time.Sleep(time.Duration(retries) * retryDelay)
+	return true
+}
+
+// do runs fn with the share. When the connection breaks, it is re-established
+// and fn is run again.
+func (be *Backend) do(ctx context.Context, fn func(share *smb2.Share) error) error {
+	be.sem.GetToken()
+	defer be.sem.ReleaseToken()
+
+	for retries := 0; ; retries++ {
+		c, err := be.connect()
+		if err == nil {
+			err = fn(c.share.WithContext(ctx))
+			if err == nil {
+				return nil
+			}
+		}
+
+		if !be.retry(c, err, retries) {
+			return err
+		}
+	}
+}
+
+// isConnError returns true if err shows that the connection to the server
+// is broken or the server has ended the session.
+func isConnError(err error) bool {
+	err = errors.Cause(err)
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Err
+	}
+
+	switch e := err.(type) {
+	case *smb2.TransportError, net.Error:
+		return true
+	case *smb2.ResponseError:
+		switch e.Code {
+		case statusNetworkNameDeleted, statusUserSessionDeleted, statusNetworkSessionExpired:
+			return true
+		}
+	}
+
+	return false
+}
+
+// isNotExist returns true if err shows that a file or directory does not
+// exist.
+func isNotExist(err error) bool {
+	err = errors.Cause(err)
+	if os.IsNotExist(err) {
+		return true
+	}
+
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Err
+	}
+
+	e, ok := err.(*smb2.ResponseError)
+	if !ok {
+		return false
+	}
+
+	switch e.Code {
+	case statusNoSuchFile, statusObjectNameNotFound, statusObjectPathNotFound:
+		return true
+	}
+
+	return false
+}
+
+// Location returns this backend's location (the share and directory name).
+func (be *Backend) Location() string {
+	return path.Join(be.cfg.Share, be.cfg.Path)
+}
+
+// Join combines path components with slashes.
+func (be *Backend) Join(p ...string) string {
+	return path.Join(p...)
+}
+
+// ReadDir returns the entries for a directory.
+func (be *Backend) ReadDir(dir string) (list []os.FileInfo, err error) {
+	err = be.do(context.TODO(), func(share *smb2.Share) error {
+		list, err = share.ReadDir(dir)
+		return err
+	})
+	return list, err
+}
+
+// IsNotExist returns true if the error is caused by a not existing file.
+func (be *Backend) IsNotExist(err error) bool {
+	return isNotExist(err)
+}
+
+// Save stores data in the backend at the handle. The data is first written
+// to a temporary file, which is renamed when it is complete. If the
+// connection breaks and rd is seekable, the upload is restarted.
+func (be *Backend) Save(ctx context.Context, h restic.Handle, rd io.Reader) error {
+	debug.Log("Save %v", h)
+	if err := h.Valid(); err != nil {
+		return err
+	}
+
+	filename := be.Filename(h)
+	partial := filename + partialSuffix
+
+	ok, err := be.Test(ctx, h)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return errors.Errorf("file %v already exists", filename)
+	}
+
+	// remember the start position for restarting the upload
+	seeker, _ := rd.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			seeker = nil
+		}
+	}
+
+	started := false
+	err = be.do(ctx, func(share *smb2.Share) error {
+		if started {
+			if seeker == nil {
+				return errors.New("connection broke during the upload, the data cannot be read again")
+			}
+
+			debug.Log("restart upload of %v", h)
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return errors.Wrap(err, "Seek")
+			}
+		}
+		started = true
+
+		return upload(share, be.Dirname(h), partial, rd)
+	})
+
+	if err == nil {
+		err = be.do(ctx, func(share *smb2.Share) error {
+			err := share.Rename(partial, filename)
+			if isNotExist(err) {
+				// the file may have been renamed before the connection broke
+				if _, serr := share.Stat(filename); serr == nil {
+					return nil
+				}
+			}
+			return err
+		})
+	}
+
+	if err != nil {
+		// try to remove the partial file, but ignore errors
+		_ = be.do(ctx, func(share *smb2.Share) error {
+			return share.Remove(partial)
+		})
+		return errors.Wrap(err, "upload")
+	}
+
+	return nil
+}
+
+// upload writes the data from rd to the file filename in dir, which is
+// created if it does not exist.
+func upload(share *smb2.Share, dir, filename string, rd io.Reader) error {
+	f, err := share.Create(filename)
+	if isNotExist(err) {
+		if err = share.MkdirAll(dir, backend.Modes.Dir); err != nil {
+			return err
+		}
+		f, err = share.Create(filename)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, rd)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Load returns a reader that yields the contents of the file at h at the
+// given offset. If length is nonzero, only a portion of the file is
+// returned. rd must be closed after use. When the connection breaks, the
+// download continues after reconnecting.
+func (be *Backend) Load(ctx context.Context, h restic.Handle, length int, offset int64) (io.ReadCloser, error) {
+	debug.Log("Load %v, length %v, offset %v", h, length, offset)
+	if err := h.Valid(); err != nil {
+		return nil, err
+	}
+
+	if offset < 0 {
+		return nil, errors.New("offset is negative")
+	}
+
+	if length < 0 {
+		return nil, errors.Errorf("invalid length %d", length)
+	}
+
+	rd := &loadReader{be: be, ctx: ctx, filename: be.Filename(h), offset: offset}
+	if err := rd.open(); err != nil {
+		return nil, err
+	}
+
+	if length > 0 {
+		return backend.LimitReadCloser(rd, int64(length)), nil
+	}
+
+	return rd, nil
+}
+
+// loadReader reads a file. When the connection breaks, it reconnects and
+// continues at the current offset.
+type loadReader struct {
+	be       *Backend
+	ctx      context.Context
+	filename string
+	offset   int64
+	retries  int
+
+	c *conn
+	f *smb2.File
+}
+
+// open opens the file at the current offset.
+func (rd *loadReader) open() error {
+	for {
+		c, err := rd.be.connect()
+		if err == nil {
+			rd.f, err = openAt(c.share.WithContext(rd.ctx), rd.filename, rd.offset)
+			if err == nil {
+				rd.c = c
+				return nil
+			}
+		}
+
+		if !rd.be.retry(c, err, rd.retries) {
+			return err
+		}
+		rd.retries++
+	}
+}
+
+// openAt opens the file filename and seeks to offset.
+func openAt(share *smb2.Share, filename string, offset int64) (*smb2.File, error) {
+	f, err := share.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func (rd *loadReader) Read(p []byte) (int, error) {
+	if rd.f == nil {
+		if err := rd.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rd.f.Read(p)
+	if n < 0 {
+		n = 0
+	}
+	rd.offset += int64(n)
+
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	_ = rd.f.Close()
+	rd.f = nil
+
+	if !rd.be.retry(rd.c, err, rd.retries) {
+		return n, err
+	}
+
+	rd.retries++
+	debug.Log("read of %v interrupted at %d: %v", rd.filename, rd.offset, err)
+
+	// the next call to Read continues after reconnecting
+	if n == 0 {
+		return rd.Read(p)
+	}
+
+	return n, nil
+}
+
+// Close closes the file.
+func (rd *loadReader) Close() error {
+	if rd.f == nil {
+		return nil
+	}
+
+	err := rd.f.Close()
+	rd.f = nil
+	if isConnError(err) {
+		// the server closes the file when the connection is gone
+		return nil
+	}
+
+	return err
+}
+
+// Stat returns information about a blob.
+func (be *Backend) Stat(ctx context.Context, h restic.Handle) (restic.FileInfo, error) {
+	debug.Log("Stat(%v)", h)
+	if err := h.Valid(); err != nil {
+		return restic.FileInfo{}, err
+	}
+
+	var fi os.FileInfo
+	err := be.do(ctx, func(share *smb2.Share) (err error) {
+		fi, err = share.Stat(be.Filename(h))
+		return err
+	})
+	if err != nil {
+		return restic.FileInfo{}, errors.Wrap(err, "Stat")
+	}
+
+	return restic.FileInfo{Size: fi.Size()}, nil
+}
+
+// Test returns true if a blob of the given type and name exists in the backend.
+func (be *Backend) Test(ctx context.Context, h restic.Handle) (bool, error) {
+	debug.Log("Test(%v)", h)
+	_, err := be.Stat(ctx, h)
+	if isNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Remove removes the content stored at name.
+func (be *Backend) Remove(ctx context.Context, h restic.Handle) error {
+	debug.Log("Remove(%v)", h)
+	return be.do(ctx, func(share *smb2.Share) error {
+		err := share.Remove(be.Filename(h))
+		return errors.Wrap(err, "Remove")
+	})
+}
+
+// List returns a channel that yields all names of blobs of type t. A
+// goroutine is started for this. If the channel done is closed, sending
+// stops.
+func (be *Backend) List(ctx context.Context, t restic.FileType) <-chan string {
+	debug.Log("List %v", t)
+
+	ch := make(chan string)
+
+	go func() {
+		defer close(ch)
+		be.list(ctx, be.Basedir(t), ch)
+	}()
+
+	return ch
+}
+
+// list sends the names of all files in dir and its subdirectories to ch. It
+// returns false if ctx has been cancelled.
+func (be *Backend) list(ctx context.Context, dir string, ch chan<- string) bool {
+	entries, err := be.ReadDir(dir)
+	if err != nil {
+		debug.Log("ReadDir(%v): %v", dir, err)
+		return true
+	}
+
+	for _, fi := range entries {
+		if fi.IsDir() {
+			if !be.list(ctx, path.Join(dir, fi.Name()), ch) {
+				return false
+			}
+			continue
+		}
+
+		if strings.HasSuffix(fi.Name(), partialSuffix) {
+			continue
+		}
+
+		select {
+		case ch <- fi.Name():
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	return true
+}
+
+// Close unmounts the share and closes the connection.
+func (be *Backend) Close() error {
+	debug.Log("")
+
+	be.m.Lock()
+	c := be.c
+	be.c = nil
+	be.m.Unlock()
+
+	if c == nil {
+		return nil
+	}
+
+	err := c.share.Umount()
+	if lerr := c.session.Logoff(); err == nil {
+		err = lerr
+	}
+	if cerr := c.tcp.Close(); err == nil {
+		err = cerr
+	}
+
+	return errors.Wrap(err, "Close")
+}
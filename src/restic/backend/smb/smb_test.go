@@ -0,0 +1,133 @@
+package smb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"restic"
+	"testing"
+	"time"
+
+	"restic/backend/test"
+	"restic/errors"
+	. "restic/test"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+func newSMBTestSuite(t testing.TB) *test.Suite {
+	return &test.Suite{
+		// do not use excessive data
+		MinimalData: true,
+
+		// NewConfig returns a config for a new temporary backend that will be used in tests.
+		NewConfig: func() (interface{}, error) {
+			smbcfg, err := ParseConfig(os.Getenv("RESTIC_TEST_SMB_REPOSITORY"))
+			if err != nil {
+				return nil, err
+			}
+
+			cfg := smbcfg.(Config)
+			cfg.Password = os.Getenv("RESTIC_TEST_SMB_PASSWORD")
+			cfg.Path = path.Join(cfg.Path, fmt.Sprintf("test-%d", time.Now().UnixNano()))
+			return cfg, nil
+		},
+
+		// CreateFn is a function that creates a temporary repository for the tests.
+		Create: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(Config)
+			return Create(cfg)
+		},
+
+		// OpenFn is a function that opens a previously created temporary repository.
+		Open: func(config interface{}) (restic.Backend, error) {
+			cfg := config.(Config)
+			return Open(cfg)
+		},
+
+		// CleanupFn removes data created during the tests.
+		Cleanup: func(config interface{}) error {
+			cfg := config.(Config)
+			if !TestCleanupTempDirs {
+				t.Logf("leaving test backend dir at %v", cfg.Path)
+				return nil
+			}
+
+			be, err := Open(cfg)
+			if err != nil {
+				return err
+			}
+
+			err = be.do(context.TODO(), func(share *smb2.Share) error {
+				return share.RemoveAll(cfg.Path)
+			})
+			if err != nil {
+				_ = be.Close()
+				return err
+			}
+
+			return be.Close()
+		},
+	}
+}
+
+func testVars(t testing.TB) {
+	vars := []string{
+		"RESTIC_TEST_SMB_REPOSITORY",
+		"RESTIC_TEST_SMB_PASSWORD",
+	}
+
+	for _, v := range vars {
+		if os.Getenv(v) == "" {
+			t.Skipf("environment variable %v not set", v)
+			return
+		}
+	}
+}
+
+func TestBackendSMB(t *testing.T) {
+	defer func() {
+		if t.Skipped() {
+			SkipDisallowed(t, "restic/backend/smb.TestBackendSMB")
+		}
+	}()
+
+	testVars(t)
+	newSMBTestSuite(t).RunTests(t)
+}
+
+func BenchmarkBackendSMB(t *testing.B) {
+	testVars(t)
+	newSMBTestSuite(t).RunBenchmarks(t)
+}
+
+var errorTests = []struct {
+	err      error
+	conn     bool
+	notExist bool
+}{
+	{&smb2.TransportError{Err: io.ErrUnexpectedEOF}, true, false},
+	{errors.Wrap(&os.PathError{Op: "open", Path: "config", Err: &smb2.TransportError{Err: io.EOF}}, "Stat"), true, false},
+	{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true, false},
+	{&smb2.ResponseError{Code: statusUserSessionDeleted}, true, false},
+	{&os.PathError{Op: "open", Path: "config", Err: &smb2.ResponseError{Code: statusObjectNameNotFound}}, false, true},
+	{errors.Wrap(&os.PathError{Op: "open", Path: "data/00/00", Err: &smb2.ResponseError{Code: statusObjectPathNotFound}}, "Stat"), false, true},
+	{&smb2.ResponseError{Code: 0xC0000022}, false, false}, // STATUS_ACCESS_DENIED
+	{os.ErrNotExist, false, true},
+	{errors.New("foo"), false, false},
+}
+
+func TestErrors(t *testing.T) {
+	for _, test := range errorTests {
+		if isConnError(test.err) != test.conn {
+			t.Errorf("isConnError(%v): want %v", test.err, test.conn)
+		}
+
+		if isNotExist(test.err) != test.notExist {
+			t.Errorf("isNotExist(%v): want %v", test.err, test.notExist)
+		}
+	}
+}
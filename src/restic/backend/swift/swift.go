@@ -310,7 +310,13 @@ func (be *beSwift) Delete(ctx context.Context) error {
 		restic.KeyFile,
 		restic.LockFile,
 		restic.SnapshotFile,
-		restic.IndexFile}
+		restic.IndexFile,
+		restic.DeletionFile,
+		restic.TrashFile,
+		restic.IntentFile,
+		restic.ConfigUpdateFile,
+		restic.DomainConfigFile,
+		restic.OperationFile}
 
 	for _, t := range alltypes {
 		err := be.removeKeys(ctx, t)
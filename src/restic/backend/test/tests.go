@@ -460,7 +460,9 @@ func (s *Suite) TestBackend(t *testing.T) {
 
 	for _, tpe := range []restic.FileType{
 		restic.DataFile, restic.KeyFile, restic.LockFile,
-		restic.SnapshotFile, restic.IndexFile,
+		restic.SnapshotFile, restic.IndexFile, restic.DeletionFile, restic.TrashFile,
+		restic.IntentFile, restic.ConfigUpdateFile, restic.DomainConfigFile,
+		restic.OperationFile,
 	} {
 		// detect non-existing files
 		for _, ts := range testStrings {
@@ -4,7 +4,9 @@ import (
 	"context"
 	"io"
 	"io/ioutil"
+	"os"
 	"restic"
+	"time"
 )
 
 // LoadAll reads all data stored in the backend for the handle.
@@ -29,6 +31,85 @@ func LoadAll(ctx context.Context, be restic.Backend, h restic.Handle) (buf []byt
 	return ioutil.ReadAll(rd)
 }
 
+// RemoveBatched removes all files in hs from be. If be implements
+// restic.BulkRemover, up to batchSize files are removed with a single request,
+// otherwise they are removed one by one. If rate is larger than zero, at most
+// rate files are removed per second. After each batch, report is called with
+// the handles and the error returned by the backend (if any). Only an error
+// for the context is returned.
+func RemoveBatched(ctx context.Context, be restic.Backend, hs []restic.Handle, batchSize int, rate float64, report func([]restic.Handle, error)) error {
+	bulk, ok := be.(restic.BulkRemover)
+	if !ok || batchSize < 1 {
+		batchSize = 1
+	}
+
+	start := time.Now()
+	for i := 0; i < len(hs); i += batchSize {
+		if rate > 0 {
+			next := start.Add(time.Duration(float64(i) / rate * float64(time.Second)))
+			if d := time.Until(next); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		end := i + batchSize
+		if end > len(hs) {
+			end = len(hs)
+		}
+		batch := hs[i:end]
+
+		var err error
+		if bulk != nil && batchSize > 1 {
+			err = bulk.RemoveMulti(ctx, batch)
+		} else {
+			err = be.Remove(ctx, batch[0])
+		}
+
+		if report != nil {
+			report(batch, err)
+		}
+	}
+
+	return nil
+}
+
+// RemainingSize returns the number of bytes which can be read from rd, if
+// this can be determined.
+func RemainingSize(rd io.Reader) (int64, bool) {
+	switch r := rd.(type) {
+	case interface {
+		Len() int
+	}:
+		return int64(r.Len()), true
+	case interface {
+		Size() int64
+	}:
+		return r.Size(), true
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil {
+			return 0, false
+		}
+
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+
+		return fi.Size() - pos, true
+	}
+
+	return 0, false
+}
+
 // Closer wraps an io.Reader and adds a Close() method that does nothing.
 type Closer struct {
 	io.Reader
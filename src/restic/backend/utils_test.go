@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"restic"
 	"testing"
+	"time"
 
 	"restic/backend"
 	"restic/backend/mem"
@@ -89,3 +90,84 @@ func TestLoadLargeBuffer(t *testing.T) {
 		}
 	}
 }
+
+type bulkRemoveBackend struct {
+	restic.Backend
+	calls int
+}
+
+func (be *bulkRemoveBackend) RemoveMulti(ctx context.Context, hs []restic.Handle) error {
+	be.calls++
+	for _, h := range hs {
+		if err := be.Backend.Remove(ctx, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveRandomFiles(t testing.TB, be restic.Backend, n int) []restic.Handle {
+	var hs []restic.Handle
+	for i := 0; i < n; i++ {
+		data := Random(i, 100)
+		h := restic.Handle{Type: restic.DataFile, Name: restic.Hash(data).String()}
+		OK(t, be.Save(context.TODO(), h, bytes.NewReader(data)))
+		hs = append(hs, h)
+	}
+	return hs
+}
+
+func TestRemoveBatched(t *testing.T) {
+	var tests = []struct {
+		bulk      bool
+		batchSize int
+		calls     int
+		reports   int
+	}{
+		{false, 10, 0, 25},
+		{true, 1, 0, 25},
+		{true, 10, 3, 3},
+		{true, 100, 1, 1},
+	}
+
+	for _, test := range tests {
+		var be restic.Backend = mem.New()
+		bulk := &bulkRemoveBackend{Backend: be}
+		if test.bulk {
+			be = bulk
+		}
+
+		hs := saveRandomFiles(t, be, 25)
+
+		reports, removed := 0, 0
+		err := backend.RemoveBatched(context.TODO(), be, hs, test.batchSize, 0, func(hs []restic.Handle, err error) {
+			OK(t, err)
+			reports++
+			removed += len(hs)
+		})
+		OK(t, err)
+
+		Equals(t, test.calls, bulk.calls)
+		Equals(t, test.reports, reports)
+		Equals(t, len(hs), removed)
+
+		for _, h := range hs {
+			found, err := be.Test(context.TODO(), h)
+			OK(t, err)
+			Assert(t, !found, "file %v has not been removed", h)
+		}
+	}
+}
+
+func TestRemoveBatchedRate(t *testing.T) {
+	be := mem.New()
+	hs := saveRandomFiles(t, be, 6)
+
+	start := time.Now()
+	OK(t, backend.RemoveBatched(context.TODO(), be, hs, 1, 50, nil))
+
+	// the last file may only be removed after 5/50 seconds
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("files were removed too fast, took %v", d)
+	}
+}
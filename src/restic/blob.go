@@ -12,6 +12,27 @@ type Blob struct {
 	Length uint
 	ID     ID
 	Offset uint
+
+	// Domain is the encryption domain the blob belongs to, it is empty for
+	// blobs encrypted with the master key.
+	Domain string
+
+	// UncompressedLength is the length of the plaintext of a compressed
+	// blob, it is zero for blobs which are stored uncompressed.
+	UncompressedLength uint
+}
+
+// IsCompressed returns true if the blob is stored compressed.
+func (b Blob) IsCompressed() bool {
+	return b.UncompressedLength != 0
+}
+
+// DataLength returns the length of the plaintext of the blob.
+func (b Blob) DataLength() uint {
+	if b.IsCompressed() {
+		return b.UncompressedLength
+	}
+	return uint(PlaintextLength(int(b.Length)))
 }
 
 func (b Blob) String() string {
@@ -0,0 +1,237 @@
+package restic
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"restic/errors"
+)
+
+// BlobRefs counts the references to all blobs used by a set of snapshots, so
+// that the set of used blobs can be updated incrementally when snapshots are
+// added or removed. Each snapshot references its tree, and each tree which is
+// referenced at least once references the blobs it contains. Only the trees
+// of added or removed snapshots which are not shared with other snapshots are
+// loaded.
+//
+// When an error is returned by AddSnapshot or RemoveSnapshot, the counts are
+// inconsistent and the BlobRefs must not be used any more.
+type BlobRefs struct {
+	snapshots map[ID]ID
+	refs      map[BlobHandle]uint32
+}
+
+// NewBlobRefs returns an empty BlobRefs.
+func NewBlobRefs() *BlobRefs {
+	return &BlobRefs{
+		snapshots: make(map[ID]ID),
+		refs:      make(map[BlobHandle]uint32),
+	}
+}
+
+// Snapshots returns the IDs of the snapshots the counts are derived from.
+func (r *BlobRefs) Snapshots() IDSet {
+	ids := NewIDSet()
+	for id := range r.snapshots {
+		ids.Insert(id)
+	}
+	return ids
+}
+
+// Used returns the set of all blobs referenced by the snapshots.
+func (r *BlobRefs) Used() BlobSet {
+	blobs := NewBlobSet()
+	for h := range r.refs {
+		blobs.Insert(h)
+	}
+	return blobs
+}
+
+// AddSnapshot adds the references of the snapshot id with the given tree.
+// Adding a snapshot which has already been added does nothing.
+func (r *BlobRefs) AddSnapshot(ctx context.Context, repo Repository, id ID, tree ID) error {
+	if _, ok := r.snapshots[id]; ok {
+		return nil
+	}
+
+	r.snapshots[id] = tree
+	return r.addTree(ctx, repo, tree)
+}
+
+// RemoveSnapshot removes the references of the snapshot id. The trees which
+// are not referenced any more must still be stored in the repository.
+func (r *BlobRefs) RemoveSnapshot(ctx context.Context, repo Repository, id ID) error {
+	tree, ok := r.snapshots[id]
+	if !ok {
+		return errors.Errorf("snapshot %v is unknown", id.Str())
+	}
+
+	delete(r.snapshots, id)
+	return r.removeTree(ctx, repo, tree)
+}
+
+func (r *BlobRefs) addTree(ctx context.Context, repo Repository, id ID) error {
+	h := BlobHandle{ID: id, Type: TreeBlob}
+	r.refs[h]++
+	if r.refs[h] > 1 {
+		return nil
+	}
+
+	tree, err := repo.LoadTree(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range tree.Nodes {
+		switch node.Type {
+		case "file":
+			if node.ContentList != nil {
+				r.refs[BlobHandle{ID: *node.ContentList, Type: TreeBlob}]++
+			}
+			for _, blob := range node.Content {
+				r.refs[BlobHandle{ID: blob, Type: DataBlob}]++
+			}
+		case "dir":
+			if err = r.addTree(ctx, repo, *node.Subtree); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *BlobRefs) removeTree(ctx context.Context, repo Repository, id ID) error {
+	h := BlobHandle{ID: id, Type: TreeBlob}
+	if r.refs[h] > 1 {
+		r.refs[h]--
+		return nil
+	}
+
+	tree, err := repo.LoadTree(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	delete(r.refs, h)
+
+	for _, node := range tree.Nodes {
+		switch node.Type {
+		case "file":
+			if node.ContentList != nil {
+				r.release(BlobHandle{ID: *node.ContentList, Type: TreeBlob})
+			}
+			for _, blob := range node.Content {
+				r.release(BlobHandle{ID: blob, Type: DataBlob})
+			}
+		case "dir":
+			if err = r.removeTree(ctx, repo, *node.Subtree); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// release removes a single reference to the blob h.
+func (r *BlobRefs) release(h BlobHandle) {
+	if r.refs[h] > 1 {
+		r.refs[h]--
+		return
+	}
+	delete(r.refs, h)
+}
+
+const blobRefsMagic = "restic blob refs 1\n"
+
+// MarshalBinary encodes the snapshots and the counts, a checksum is appended.
+func (r *BlobRefs) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(blobRefsMagic)
+
+	var tmp [binary.MaxVarintLen64]byte
+	writeUvarint := func(v uint64) {
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+	}
+
+	writeUvarint(uint64(len(r.snapshots)))
+	for id, tree := range r.snapshots {
+		buf.Write(id[:])
+		buf.Write(tree[:])
+	}
+
+	writeUvarint(uint64(len(r.refs)))
+	for h, n := range r.refs {
+		buf.Write(h.ID[:])
+		buf.WriteByte(byte(h.Type))
+		writeUvarint(uint64(n))
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes data written by MarshalBinary.
+func (r *BlobRefs) UnmarshalBinary(data []byte) error {
+	if len(data) < len(blobRefsMagic)+sha256.Size || string(data[:len(blobRefsMagic)]) != blobRefsMagic {
+		return errors.New("invalid blob refs header")
+	}
+
+	data, checksum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], checksum) {
+		return errors.New("blob refs checksum mismatch")
+	}
+
+	rd := bytes.NewReader(data[len(blobRefsMagic):])
+	var id, tree ID
+
+	n, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return errors.Wrap(err, "ReadUvarint")
+	}
+
+	snapshots := make(map[ID]ID, n)
+	for i := uint64(0); i < n; i++ {
+		if _, err = io.ReadFull(rd, id[:]); err == nil {
+			_, err = io.ReadFull(rd, tree[:])
+		}
+		if err != nil {
+			return errors.Wrap(err, "ReadFull")
+		}
+		snapshots[id] = tree
+	}
+
+	if n, err = binary.ReadUvarint(rd); err != nil {
+		return errors.Wrap(err, "ReadUvarint")
+	}
+
+	refs := make(map[BlobHandle]uint32, n)
+	for i := uint64(0); i < n; i++ {
+		var t byte
+		if _, err = io.ReadFull(rd, id[:]); err == nil {
+			t, err = rd.ReadByte()
+		}
+		if err != nil {
+			return errors.Wrap(err, "ReadFull")
+		}
+
+		count, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return errors.Wrap(err, "ReadUvarint")
+		}
+		refs[BlobHandle{ID: id, Type: BlobType(t)}] = uint32(count)
+	}
+
+	if rd.Len() != 0 {
+		return errors.New("trailing data after blob refs")
+	}
+
+	r.snapshots, r.refs = snapshots, refs
+	return nil
+}
@@ -0,0 +1,117 @@
+package restic_test
+
+import (
+	"context"
+	"restic"
+	"testing"
+	"time"
+
+	"restic/repository"
+)
+
+func usedBlobs(t testing.TB, repo restic.Repository, snapshots []*restic.Snapshot) restic.BlobSet {
+	blobs := restic.NewBlobSet()
+	seen := restic.NewBlobSet()
+	for _, sn := range snapshots {
+		if err := restic.FindUsedBlobs(context.TODO(), repo, *sn.Tree, blobs, seen); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return blobs
+}
+
+func TestBlobRefs(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	var snapshots []*restic.Snapshot
+	for i := 0; i < findTestSnapshots; i++ {
+		sn := restic.TestCreateSnapshot(t, repo, findTestTime.Add(time.Duration(i)*time.Second), findTestDepth, 0)
+		snapshots = append(snapshots, sn)
+	}
+
+	refs := restic.NewBlobRefs()
+	for _, sn := range snapshots {
+		if err := refs.AddSnapshot(context.TODO(), repo, *sn.ID(), *sn.Tree); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// adding a snapshot twice does not change the counts
+	if err := refs.AddSnapshot(context.TODO(), repo, *snapshots[0].ID(), *snapshots[0].Tree); err != nil {
+		t.Fatal(err)
+	}
+
+	// another snapshot which shares the tree with the first one
+	sharedID := restic.NewRandomID()
+	if err := refs.AddSnapshot(context.TODO(), repo, sharedID, *snapshots[0].Tree); err != nil {
+		t.Fatal(err)
+	}
+
+	want := usedBlobs(t, repo, snapshots)
+	if used := refs.Used(); !want.Equals(used) {
+		t.Fatalf("wrong blobs used:\n  missing blobs: %v\n  extra blobs: %v", want.Sub(used), used.Sub(want))
+	}
+
+	buf, err := refs.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs = restic.NewBlobRefs()
+	if err = refs.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(refs.Snapshots()) != len(snapshots)+1 {
+		t.Fatalf("wrong number of snapshots after decoding, want %d, got %d", len(snapshots)+1, len(refs.Snapshots()))
+	}
+
+	if err = refs.RemoveSnapshot(context.TODO(), repo, sharedID); err != nil {
+		t.Fatal(err)
+	}
+
+	if used := refs.Used(); !want.Equals(used) {
+		t.Fatalf("wrong blobs used after removing a snapshot with a shared tree:\n  missing blobs: %v\n  extra blobs: %v",
+			want.Sub(used), used.Sub(want))
+	}
+
+	for len(snapshots) > 0 {
+		sn := snapshots[0]
+		snapshots = snapshots[1:]
+
+		if err = refs.RemoveSnapshot(context.TODO(), repo, *sn.ID()); err != nil {
+			t.Fatal(err)
+		}
+
+		want := usedBlobs(t, repo, snapshots)
+		if used := refs.Used(); !want.Equals(used) {
+			t.Fatalf("wrong blobs used after removing %v:\n  missing blobs: %v\n  extra blobs: %v",
+				sn.ID().Str(), want.Sub(used), used.Sub(want))
+		}
+	}
+
+	if err = refs.RemoveSnapshot(context.TODO(), repo, restic.NewRandomID()); err == nil {
+		t.Fatalf("removing an unknown snapshot did not return an error")
+	}
+}
+
+func TestBlobRefsUnmarshalInvalid(t *testing.T) {
+	buf, err := restic.NewBlobRefs().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range buf {
+		data := append([]byte(nil), buf...)
+		data[i] ^= 0x01
+
+		if err = restic.NewBlobRefs().UnmarshalBinary(data); err == nil {
+			t.Errorf("no error for modified byte %d", i)
+		}
+	}
+
+	if err = restic.NewBlobRefs().UnmarshalBinary(buf[:len(buf)-1]); err == nil {
+		t.Errorf("no error for truncated data")
+	}
+}
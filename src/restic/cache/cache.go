@@ -0,0 +1,262 @@
+// Package cache implements a local cache for blobs loaded from a repository.
+package cache
+
+import (
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"restic"
+	"sort"
+	"sync"
+	"time"
+
+	"restic/debug"
+	"restic/errors"
+	"restic/fs"
+)
+
+// Cache stores blobs in a local directory exactly as they are saved in the
+// pack files, so the data is encrypted. When the total size exceeds the
+// limit, the least recently used blobs are removed.
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	m       sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[restic.BlobHandle]*list.Element
+}
+
+type entry struct {
+	h    restic.BlobHandle
+	size int64
+}
+
+// New returns a cache which stores at most maxSize bytes in dir. Blobs which
+// are already stored in dir by earlier runs are reused.
+func New(dir string, maxSize int64) (*Cache, error) {
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[restic.BlobHandle]*list.Element),
+	}
+
+	for _, t := range []restic.BlobType{restic.DataBlob, restic.TreeBlob} {
+		err := fs.MkdirAll(filepath.Join(dir, t.String()), 0700)
+		if err != nil {
+			return nil, errors.Wrap(err, "MkdirAll")
+		}
+	}
+
+	if err := c.scan(); err != nil {
+		return nil, err
+	}
+
+	c.m.Lock()
+	c.evict()
+	c.m.Unlock()
+
+	return c, nil
+}
+
+type cachedFile struct {
+	entry
+	modTime time.Time
+}
+
+type byModTime []cachedFile
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byModTime) Less(i, j int) bool { return s[i].modTime.Before(s[j].modTime) }
+
+// scan adds all files found in the cache directory, the least recently used
+// file is added first.
+func (c *Cache) scan() error {
+	var files []cachedFile
+	for _, t := range []restic.BlobType{restic.DataBlob, restic.TreeBlob} {
+		entries, err := ioutil.ReadDir(filepath.Join(c.dir, t.String()))
+		if err != nil {
+			return errors.Wrap(err, "ReadDir")
+		}
+
+		for _, fi := range entries {
+			id, err := restic.ParseID(fi.Name())
+			if err != nil || !fi.Mode().IsRegular() {
+				debug.Log("ignoring file %v in cache", fi.Name())
+				continue
+			}
+
+			files = append(files, cachedFile{
+				entry:   entry{h: restic.BlobHandle{ID: id, Type: t}, size: fi.Size()},
+				modTime: fi.ModTime(),
+			})
+		}
+	}
+
+	sort.Sort(byModTime(files))
+
+	for _, f := range files {
+		c.entries[f.h] = c.lru.PushFront(f.entry)
+		c.size += f.size
+	}
+
+	debug.Log("found %d blobs with %d bytes in cache %v", len(files), c.size, c.dir)
+	return nil
+}
+
+func (c *Cache) filename(h restic.BlobHandle) string {
+	return filepath.Join(c.dir, h.Type.String(), h.ID.String())
+}
+
+// Has returns true iff the blob is stored in the cache.
+func (c *Cache) Has(h restic.BlobHandle) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	_, ok := c.entries[h]
+	return ok
+}
+
+// Load reads the blob from the cache into buf and returns the number of bytes
+// read. If the blob is not in the cache, ok is false.
+func (c *Cache) Load(h restic.BlobHandle, buf []byte) (n int, ok bool) {
+	c.m.Lock()
+	e, ok := c.entries[h]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.m.Unlock()
+
+	if !ok {
+		return 0, false
+	}
+
+	f, err := fs.Open(c.filename(h))
+	if err != nil {
+		debug.Log("unable to open cached blob %v: %v", h, err)
+		c.Remove(h)
+		return 0, false
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.Size() > int64(len(buf)) {
+		debug.Log("cached blob %v has wrong size or stat failed: %v", h, err)
+		c.Remove(h)
+		return 0, false
+	}
+
+	n, err = io.ReadFull(f, buf[:fi.Size()])
+	if err != nil {
+		debug.Log("reading cached blob %v failed: %v", h, err)
+		c.Remove(h)
+		return 0, false
+	}
+
+	// record the access for other processes using the same cache
+	now := time.Now()
+	_ = os.Chtimes(c.filename(h), now, now)
+
+	return n, true
+}
+
+// Save stores the blob in the cache. Afterwards, the least recently used
+// blobs are removed until the cache is small enough again.
+func (c *Cache) Save(h restic.BlobHandle, data []byte) error {
+	if int64(len(data)) > c.maxSize {
+		return nil
+	}
+
+	c.m.Lock()
+	_, ok := c.entries[h]
+	c.m.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(filepath.Join(c.dir, h.Type.String()), "tmp-")
+	if err != nil {
+		return errors.Wrap(err, "TempFile")
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		_ = f.Close()
+		_ = fs.Remove(f.Name())
+		return errors.Wrap(err, "Write")
+	}
+
+	if err = f.Close(); err != nil {
+		_ = fs.Remove(f.Name())
+		return errors.Wrap(err, "Close")
+	}
+
+	if err = fs.Rename(f.Name(), c.filename(h)); err != nil {
+		_ = fs.Remove(f.Name())
+		return errors.Wrap(err, "Rename")
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if _, ok := c.entries[h]; !ok {
+		c.entries[h] = c.lru.PushFront(entry{h: h, size: int64(len(data))})
+		c.size += int64(len(data))
+	}
+	c.evict()
+
+	return nil
+}
+
+// Remove removes the blob from the cache.
+func (c *Cache) Remove(h restic.BlobHandle) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.remove(h)
+}
+
+func (c *Cache) remove(h restic.BlobHandle) {
+	e, ok := c.entries[h]
+	if !ok {
+		return
+	}
+
+	c.lru.Remove(e)
+	delete(c.entries, h)
+	c.size -= e.Value.(entry).size
+
+	if err := fs.RemoveIfExists(c.filename(h)); err != nil {
+		debug.Log("unable to remove cached blob %v: %v", h, err)
+	}
+}
+
+// evict removes the least recently used blobs until the size of the cache is
+// below the limit. The caller must hold the lock.
+func (c *Cache) evict() {
+	for c.size > c.maxSize {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+
+		h := e.Value.(entry).h
+		debug.Log("evicting blob %v from the cache", h)
+		c.remove(h)
+	}
+}
+
+// Size returns the number of bytes stored in the cache.
+func (c *Cache) Size() int64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.size
+}
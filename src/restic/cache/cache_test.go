@@ -0,0 +1,78 @@
+package cache_test
+
+import (
+	"bytes"
+	"testing"
+
+	"restic"
+	"restic/cache"
+	. "restic/test"
+)
+
+func randomBlob(t testing.TB, seed, size int) (restic.BlobHandle, []byte) {
+	data := Random(seed, size)
+	return restic.BlobHandle{ID: restic.Hash(data), Type: restic.DataBlob}, data
+}
+
+func TestCacheSaveLoad(t *testing.T) {
+	dir, cleanup := TempDir(t)
+	defer cleanup()
+
+	c, err := cache.New(dir, 1<<20)
+	OK(t, err)
+
+	h, data := randomBlob(t, 23, 1000)
+	Assert(t, !c.Has(h), "blob found in empty cache")
+
+	OK(t, c.Save(h, data))
+	Assert(t, c.Has(h), "blob not found after Save()")
+
+	buf := make([]byte, 2000)
+	n, ok := c.Load(h, buf)
+	Assert(t, ok, "blob could not be loaded")
+	Assert(t, bytes.Equal(data, buf[:n]), "wrong data returned")
+
+	// a cache opened on the same directory finds the blob again
+	c, err = cache.New(dir, 1<<20)
+	OK(t, err)
+	Assert(t, c.Has(h), "blob not found after reopening the cache")
+	Equals(t, int64(len(data)), c.Size())
+
+	c.Remove(h)
+	Assert(t, !c.Has(h), "blob found after Remove()")
+	Equals(t, int64(0), c.Size())
+}
+
+func TestCacheEvict(t *testing.T) {
+	dir, cleanup := TempDir(t)
+	defer cleanup()
+
+	c, err := cache.New(dir, 3000)
+	OK(t, err)
+
+	h1, data1 := randomBlob(t, 1, 1000)
+	h2, data2 := randomBlob(t, 2, 1000)
+	h3, data3 := randomBlob(t, 3, 1000)
+	h4, data4 := randomBlob(t, 4, 1000)
+
+	OK(t, c.Save(h1, data1))
+	OK(t, c.Save(h2, data2))
+	OK(t, c.Save(h3, data3))
+
+	// use the first blob, so the second one is the least recently used
+	_, ok := c.Load(h1, make([]byte, 1000))
+	Assert(t, ok, "blob could not be loaded")
+
+	OK(t, c.Save(h4, data4))
+
+	Assert(t, c.Has(h1), "recently used blob was evicted")
+	Assert(t, !c.Has(h2), "least recently used blob was not evicted")
+	Assert(t, c.Has(h3), "blob was evicted")
+	Assert(t, c.Has(h4), "new blob was evicted")
+	Equals(t, int64(3000), c.Size())
+
+	// blobs larger than the cache are not stored
+	h5, data5 := randomBlob(t, 5, 4000)
+	OK(t, c.Save(h5, data5))
+	Assert(t, !c.Has(h5), "blob larger than the cache was stored")
+}
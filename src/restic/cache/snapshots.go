@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"restic"
+	"sync"
+
+	"restic/debug"
+	"restic/errors"
+	"restic/fs"
+)
+
+// snapshotManifestHeader is written at the start of the manifest file.
+const snapshotManifestHeader = "restic snapshot manifest 1\n"
+
+// SnapshotManifest keeps the snapshot files loaded from a repository in a
+// single local file, so that listing the snapshots only needs to load the
+// ones which have been added since the last run. The files are stored exactly
+// as in the repository, so they are encrypted. As snapshot files are named
+// after the hash of their contents, the manifest never becomes outdated, it
+// can only contain snapshots which have been removed in the meantime.
+type SnapshotManifest struct {
+	filename string
+
+	m       sync.Mutex
+	files   map[restic.ID][]byte
+	changed bool
+}
+
+// NewSnapshotManifest returns a manifest which is stored in filename. The
+// snapshot files saved there by earlier runs are loaded. If that fails, the
+// manifest starts empty.
+func NewSnapshotManifest(filename string) *SnapshotManifest {
+	m := &SnapshotManifest{
+		filename: filename,
+		files:    make(map[restic.ID][]byte),
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = m.decode(buf)
+	}
+	if err != nil {
+		debug.Log("unable to load snapshot manifest %v: %v", filename, err)
+		m.files = make(map[restic.ID][]byte)
+	}
+
+	return m
+}
+
+// decode parses the contents of the manifest file. Each file is stored as
+// its ID, the length as a 32 bit number and the data.
+func (m *SnapshotManifest) decode(buf []byte) error {
+	if !bytes.HasPrefix(buf, []byte(snapshotManifestHeader)) {
+		return errors.New("invalid header")
+	}
+	buf = buf[len(snapshotManifestHeader):]
+
+	for len(buf) > 0 {
+		if len(buf) < len(restic.ID{})+4 {
+			return errors.New("file is truncated")
+		}
+
+		var id restic.ID
+		copy(id[:], buf)
+		n := int(binary.LittleEndian.Uint32(buf[len(id):]))
+		buf = buf[len(id)+4:]
+
+		if len(buf) < n {
+			return errors.New("file is truncated")
+		}
+
+		m.files[id] = buf[:n:n]
+		buf = buf[n:]
+	}
+
+	return nil
+}
+
+// Get returns the contents of the snapshot file with the ID, if it is in the
+// manifest. The caller may modify the returned buffer.
+func (m *SnapshotManifest) Get(id restic.ID) ([]byte, bool) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	buf, ok := m.files[id]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte(nil), buf...), true
+}
+
+// Add records the contents of the snapshot file with the ID.
+func (m *SnapshotManifest) Add(id restic.ID, buf []byte) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if _, ok := m.files[id]; ok {
+		return
+	}
+
+	m.files[id] = append([]byte(nil), buf...)
+	m.changed = true
+}
+
+// Retain removes all snapshot files which are not in ids, for example after
+// all snapshot files in the repository have been listed.
+func (m *SnapshotManifest) Retain(ids restic.IDSet) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	for id := range m.files {
+		if !ids.Has(id) {
+			debug.Log("snapshot %v has been removed", id.Str())
+			delete(m.files, id)
+			m.changed = true
+		}
+	}
+}
+
+// Reset removes all snapshot files from the manifest.
+func (m *SnapshotManifest) Reset() {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	m.files = make(map[restic.ID][]byte)
+	m.changed = true
+}
+
+// Len returns the number of snapshot files in the manifest.
+func (m *SnapshotManifest) Len() int {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	return len(m.files)
+}
+
+// Write saves the manifest to its file if it has been modified.
+func (m *SnapshotManifest) Write() error {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if !m.changed {
+		return nil
+	}
+
+	if err := fs.MkdirAll(filepath.Dir(m.filename), 0700); err != nil {
+		return errors.Wrap(err, "MkdirAll")
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(m.filename), "tmp-")
+	if err != nil {
+		return errors.Wrap(err, "TempFile")
+	}
+
+	err = m.encode(f)
+	if e := f.Close(); err == nil {
+		err = errors.Wrap(e, "Close")
+	}
+
+	if err == nil {
+		err = errors.Wrap(fs.Rename(f.Name(), m.filename), "Rename")
+	}
+
+	if err != nil {
+		_ = fs.Remove(f.Name())
+		return err
+	}
+
+	debug.Log("saved %d snapshots to %v", len(m.files), m.filename)
+	m.changed = false
+	return nil
+}
+
+// encode writes the manifest to wr.
+func (m *SnapshotManifest) encode(wr io.Writer) error {
+	buf := []byte(snapshotManifestHeader)
+	for id, data := range m.files {
+		buf = append(buf, id[:]...)
+
+		var n [4]byte
+		binary.LittleEndian.PutUint32(n[:], uint32(len(data)))
+		buf = append(buf, n[:]...)
+		buf = append(buf, data...)
+	}
+
+	_, err := wr.Write(buf)
+	return errors.Wrap(err, "Write")
+}
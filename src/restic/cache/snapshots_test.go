@@ -0,0 +1,86 @@
+package cache_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"restic"
+	"restic/cache"
+	. "restic/test"
+)
+
+func TestSnapshotManifest(t *testing.T) {
+	dir, cleanup := TempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(dir, "repo", "snapshots")
+	m := cache.NewSnapshotManifest(filename)
+	Equals(t, 0, m.Len())
+
+	files := make(map[restic.ID][]byte)
+	for i := 0; i < 5; i++ {
+		data := Random(i, 100+i)
+		id := restic.Hash(data)
+		files[id] = data
+		m.Add(id, data)
+	}
+	Equals(t, len(files), m.Len())
+
+	for id, data := range files {
+		buf, ok := m.Get(id)
+		Assert(t, ok, "snapshot %v not found", id.Str())
+		Assert(t, bytes.Equal(data, buf), "wrong data returned for %v", id.Str())
+
+		// the returned buffer may be modified by the caller
+		buf[0] ^= 0xff
+		buf, _ = m.Get(id)
+		Assert(t, bytes.Equal(data, buf), "modifying the returned buffer changed the manifest")
+	}
+
+	OK(t, m.Write())
+
+	// a manifest opened on the same file contains the snapshots again
+	m = cache.NewSnapshotManifest(filename)
+	Equals(t, len(files), m.Len())
+	for id, data := range files {
+		buf, ok := m.Get(id)
+		Assert(t, ok, "snapshot %v not found after reloading", id.Str())
+		Assert(t, bytes.Equal(data, buf), "wrong data returned for %v after reloading", id.Str())
+	}
+
+	var removed restic.ID
+	keep := restic.NewIDSet()
+	for id := range files {
+		keep.Insert(id)
+		removed = id
+	}
+	keep.Delete(removed)
+
+	m.Retain(keep)
+	Equals(t, len(files)-1, m.Len())
+	_, ok := m.Get(removed)
+	Assert(t, !ok, "removed snapshot %v still in the manifest", removed.Str())
+
+	OK(t, m.Write())
+	Equals(t, len(files)-1, cache.NewSnapshotManifest(filename).Len())
+}
+
+func TestSnapshotManifestDamaged(t *testing.T) {
+	dir, cleanup := TempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(dir, "snapshots")
+	m := cache.NewSnapshotManifest(filename)
+	data := Random(23, 100)
+	m.Add(restic.Hash(data), data)
+	OK(t, m.Write())
+
+	buf, err := ioutil.ReadFile(filename)
+	OK(t, err)
+	OK(t, ioutil.WriteFile(filename, buf[:len(buf)-10], 0600))
+
+	// a damaged manifest is ignored
+	Equals(t, 0, cache.NewSnapshotManifest(filename).Len())
+}
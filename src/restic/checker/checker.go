@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"sync"
 
 	"restic/errors"
@@ -13,9 +14,10 @@ import (
 	"restic/hashing"
 
 	"restic"
+	"restic/compression"
 	"restic/crypto"
 	"restic/debug"
-	"restic/pack"
+	"restic/limits"
 	"restic/repository"
 )
 
@@ -34,6 +36,10 @@ type Checker struct {
 	indexes       map[restic.ID]*repository.Index
 	orphanedPacks restic.IDs
 
+	// packBlobs holds the blobs the index lists for each pack, taken from the
+	// first index which contains the pack like MasterIndex.ListPack does
+	packBlobs map[restic.ID][]restic.Blob
+
 	masterIndex *repository.MasterIndex
 
 	repo restic.Repository
@@ -46,6 +52,7 @@ func New(repo restic.Repository) *Checker {
 		blobs:       restic.NewIDSet(),
 		masterIndex: repository.NewMasterIndex(),
 		indexes:     make(map[restic.ID]*repository.Index),
+		packBlobs:   make(map[restic.ID][]restic.Blob),
 		repo:        repo,
 	}
 
@@ -90,14 +97,15 @@ func (c *Checker) LoadIndex(ctx context.Context) (hints []error, errs []error) {
 	worker := func(ctx context.Context, id restic.ID) error {
 		debug.Log("worker got index %v", id)
 		idx, err := repository.LoadIndexWithDecoder(ctx, c.repo, id, repository.DecodeIndex)
-		if errors.Cause(err) == repository.ErrOldIndexFormat {
+		// from repository version 2 on, the old format is an error
+		if errors.Cause(err) == repository.ErrOldIndexFormat && c.repo.Config().OldIndexAllowed() {
 			debug.Log("index %v has old format", id.Str())
 			hints = append(hints, ErrOldIndexFormat{id})
 
 			idx, err = repository.LoadIndexWithDecoder(ctx, c.repo, id, repository.DecodeOldIndex)
 		}
 
-		err = errors.Wrapf(err, "error loading index %v", id.Str())
+		err = errors.WithCode(errors.Wrapf(err, "error loading index %v", id.Str()), errors.CodeIndexInvalid)
 
 		select {
 		case indexCh <- indexRes{Index: idx, ID: id.String(), err: err}:
@@ -110,7 +118,7 @@ func (c *Checker) LoadIndex(ctx context.Context) (hints []error, errs []error) {
 	go func() {
 		defer close(indexCh)
 		debug.Log("start loading indexes in parallel")
-		err := repository.FilesInParallel(ctx, c.repo.Backend(), restic.IndexFile, defaultParallelism,
+		err := repository.FilesInParallel(ctx, c.repo.Backend(), restic.IndexFile, uint(limits.Workers(defaultParallelism)),
 			repository.ParallelWorkFuncParseID(worker))
 		debug.Log("loading indexes finished, error: %v", err)
 		if err != nil {
@@ -122,6 +130,7 @@ func (c *Checker) LoadIndex(ctx context.Context) (hints []error, errs []error) {
 	defer close(done)
 
 	packToIndex := make(map[restic.ID]restic.IDSet)
+	firstIndex := make(map[restic.ID]restic.ID)
 
 	for res := range indexCh {
 		debug.Log("process index %v, err %v", res.ID, res.err)
@@ -150,8 +159,13 @@ func (c *Checker) LoadIndex(ctx context.Context) (hints []error, errs []error) {
 
 			if _, ok := packToIndex[blob.PackID]; !ok {
 				packToIndex[blob.PackID] = restic.NewIDSet()
+				firstIndex[blob.PackID] = idxID
 			}
 			packToIndex[blob.PackID].Insert(idxID)
+
+			if firstIndex[blob.PackID] == idxID {
+				c.packBlobs[blob.PackID] = append(c.packBlobs[blob.PackID], blob.Blob)
+			}
 		}
 
 		debug.Log("%d blobs processed", cnt)
@@ -184,7 +198,15 @@ func (e PackError) Error() string {
 	return "pack " + e.ID.String() + ": " + e.Err.Error()
 }
 
-func packIDTester(ctx context.Context, repo restic.Repository, inChan <-chan restic.ID, errChan chan<- error, wg *sync.WaitGroup) {
+// ErrorCode returns the error code for the problem with the pack.
+func (e PackError) ErrorCode() string {
+	if e.Orphaned {
+		return errors.CodePackOrphaned
+	}
+	return errors.Code(e.Err)
+}
+
+func packIDTester(ctx context.Context, repo restic.Repository, packBlobs map[restic.ID][]restic.Blob, inChan <-chan restic.ID, errChan chan<- error, wg *sync.WaitGroup) {
 	debug.Log("worker start")
 	defer debug.Log("worker done")
 
@@ -192,13 +214,16 @@ func packIDTester(ctx context.Context, repo restic.Repository, inChan <-chan res
 
 	for id := range inChan {
 		h := restic.Handle{Type: restic.DataFile, Name: id.String()}
-		ok, err := repo.Backend().Test(ctx, h)
+		fi, err := repo.Backend().Stat(ctx, h)
 		if err != nil {
-			err = PackError{ID: id, Err: err}
-		} else {
-			if !ok {
-				err = PackError{ID: id, Err: errors.New("does not exist")}
+			// find out whether the pack is missing or the backend failed
+			ok, testErr := repo.Backend().Test(ctx, h)
+			if testErr == nil && !ok {
+				err = errors.WithCode(errors.New("does not exist"), errors.CodePackMissing)
 			}
+			err = PackError{ID: id, Err: err}
+		} else if errs := checkBlobLayout(packBlobs[id], fi.Size); len(errs) > 0 {
+			err = PackError{ID: id, Err: errors.WithCode(errors.Errorf("invalid index entries: %v", errs), errors.CodeIndexInvalid)}
 		}
 
 		if err != nil {
@@ -216,6 +241,40 @@ func packIDTester(ctx context.Context, repo restic.Repository, inChan <-chan res
 	}
 }
 
+type blobsByOffset []restic.Blob
+
+func (l blobsByOffset) Len() int           { return len(l) }
+func (l blobsByOffset) Less(i, j int) bool { return l[i].Offset < l[j].Offset }
+func (l blobsByOffset) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// checkBlobLayout returns an error for each blob which overlaps with another
+// blob or extends beyond size bytes.
+func checkBlobLayout(blobs []restic.Blob, size int64) (errs []error) {
+	sorted := make(blobsByOffset, len(blobs))
+	copy(sorted, blobs)
+	sort.Sort(sorted)
+
+	for i, blob := range sorted {
+		end := int64(blob.Offset) + int64(blob.Length)
+		if end > size {
+			errs = append(errs, errors.Errorf("blob %v (offset %d, length %d) extends beyond the end of the pack at %d",
+				blob.ID.Str(), blob.Offset, blob.Length, size))
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		prev := sorted[i-1]
+		if blob.Offset < prev.Offset+prev.Length {
+			errs = append(errs, errors.Errorf("blob %v (offset %d, length %d) overlaps blob %v (offset %d, length %d)",
+				blob.ID.Str(), blob.Offset, blob.Length, prev.ID.Str(), prev.Offset, prev.Length))
+		}
+	}
+
+	return errs
+}
+
 // Packs checks that all packs referenced in the index are still available and
 // there are no packs that aren't in an index. errChan is closed after all
 // packs have been checked.
@@ -228,9 +287,9 @@ func (c *Checker) Packs(ctx context.Context, errChan chan<- error) {
 	var workerWG sync.WaitGroup
 
 	IDChan := make(chan restic.ID)
-	for i := 0; i < defaultParallelism; i++ {
+	for i := 0; i < limits.Workers(defaultParallelism); i++ {
 		workerWG.Add(1)
-		go packIDTester(ctx, c.repo, IDChan, errChan, &workerWG)
+		go packIDTester(ctx, c.repo, c.packBlobs, IDChan, errChan, &workerWG)
 	}
 
 	for id := range c.packs {
@@ -239,13 +298,24 @@ func (c *Checker) Packs(ctx context.Context, errChan chan<- error) {
 	}
 	close(IDChan)
 
-	debug.Log("waiting for %d workers to terminate", defaultParallelism)
+	debug.Log("waiting for %d workers to terminate", limits.Workers(defaultParallelism))
 	workerWG.Wait()
 	debug.Log("workers terminated")
 
+	// packs recorded for removal by prune are expected to be unreferenced
+	pending, err := restic.LoadAllPendingDeletions(ctx, c.repo)
+	if err != nil {
+		select {
+		case <-ctx.Done():
+		case errChan <- err:
+		}
+		return
+	}
+	pendingPacks := restic.PendingPacks(pending)
+
 	for id := range c.repo.List(ctx, restic.DataFile) {
 		debug.Log("check data blob %v", id.Str())
-		if !seenPacks.Has(id) {
+		if !seenPacks.Has(id) && !pendingPacks.Has(id) {
 			c.orphanedPacks = append(c.orphanedPacks, id)
 			select {
 			case <-ctx.Done():
@@ -278,6 +348,16 @@ func (e Error) Error() string {
 	return e.Err.Error()
 }
 
+// ErrorCode returns the error code of Err. Errors without a code within a
+// tree are reported as an invalid tree.
+func (e Error) ErrorCode() string {
+	code := errors.Code(e.Err)
+	if code == errors.CodeUnknown && !e.TreeID.IsNull() {
+		return errors.CodeTreeInvalid
+	}
+	return code
+}
+
 func loadTreeFromSnapshot(ctx context.Context, repo restic.Repository, id restic.ID) (restic.ID, error) {
 	sn, err := restic.LoadSnapshot(ctx, repo, id)
 	if err != nil {
@@ -329,11 +409,25 @@ func loadSnapshotTreeIDs(ctx context.Context, repo restic.Repository) (restic.ID
 		return nil
 	}
 
-	err := repository.FilesInParallel(ctx, repo.Backend(), restic.SnapshotFile, defaultParallelism, snapshotWorker)
+	err := repository.FilesInParallel(ctx, repo.Backend(), restic.SnapshotFile, uint(limits.Workers(defaultParallelism)), snapshotWorker)
+	if err != nil {
+		errs.errs = append(errs.errs, err)
+	}
+
+	// snapshots in the trash can still be restored, so they are checked too
+	trashed, err := restic.LoadAllTrashedSnapshots(ctx, repo)
 	if err != nil {
 		errs.errs = append(errs.errs, err)
 	}
 
+	for _, t := range trashed {
+		if t.Snapshot.Tree == nil {
+			errs.errs = append(errs.errs, errors.Errorf("trashed snapshot %v has no tree", t.ID.Str()))
+			continue
+		}
+		trees.IDs = append(trees.IDs, *t.Snapshot.Tree)
+	}
+
 	return trees.IDs, errs.errs
 }
 
@@ -347,6 +441,16 @@ func (e TreeError) Error() string {
 	return fmt.Sprintf("tree %v: %v", e.ID.Str(), e.Errors)
 }
 
+// ErrorCode returns the code of the first error for the tree which has one.
+func (e TreeError) ErrorCode() string {
+	for _, err := range e.Errors {
+		if code := errors.Code(err); code != errors.CodeUnknown {
+			return code
+		}
+	}
+	return errors.CodeTreeInvalid
+}
+
 type treeJob struct {
 	restic.ID
 	error
@@ -569,7 +673,7 @@ func (c *Checker) Structure(ctx context.Context, errChan chan<- error) {
 	treeJobChan2 := make(chan treeJob)
 
 	var wg sync.WaitGroup
-	for i := 0; i < defaultParallelism; i++ {
+	for i := 0; i < limits.Workers(defaultParallelism); i++ {
 		wg.Add(2)
 		go loadTreeWorker(ctx, c.repo, treeIDChan, treeJobChan1, &wg)
 		go c.checkTreeWorker(ctx, treeJobChan2, errChan, &wg)
@@ -592,6 +696,10 @@ func (c *Checker) checkTree(id restic.ID, tree *restic.Tree) (errs []error) {
 				errs = append(errs, Error{TreeID: id, Err: errors.Errorf("file %q has nil blob list", node.Name)})
 			}
 
+			if node.ContentList != nil {
+				blobs = append(blobs, *node.ContentList)
+			}
+
 			for b, blobID := range node.Content {
 				if blobID.IsNull() {
 					errs = append(errs, Error{TreeID: id, Err: errors.Errorf("file %q blob %d has null ID", node.Name, b)})
@@ -631,7 +739,7 @@ func (c *Checker) checkTree(id restic.ID, tree *restic.Tree) (errs []error) {
 		if !c.blobs.Has(blobID) {
 			debug.Log("tree %v references blob %v which isn't contained in index", id.Str(), blobID.Str())
 
-			errs = append(errs, Error{TreeID: id, BlobID: blobID, Err: errors.New("not found in index")})
+			errs = append(errs, Error{TreeID: id, BlobID: blobID, Err: errors.WithCode(errors.New("not found in index"), errors.CodeBlobMissing)})
 		}
 	}
 
@@ -659,8 +767,9 @@ func (c *Checker) CountPacks() uint64 {
 	return uint64(len(c.packs))
 }
 
-// checkPack reads a pack and checks the integrity of all blobs.
-func checkPack(ctx context.Context, r restic.Repository, id restic.ID) error {
+// checkPack reads a pack and checks the integrity of all blobs. The entries
+// the index lists for the pack are compared with the pack header.
+func checkPack(ctx context.Context, r restic.Repository, id restic.ID, indexed []restic.Blob) error {
 	debug.Log("checking pack %v", id.Str())
 	h := restic.Handle{Type: restic.DataFile, Name: id.String()}
 
@@ -694,16 +803,20 @@ func checkPack(ctx context.Context, r restic.Repository, id restic.ID) error {
 
 	if !hash.Equal(id) {
 		debug.Log("Pack ID does not match, want %v, got %v", id.Str(), hash.Str())
-		return errors.Errorf("Pack ID does not match, want %v, got %v", id.Str(), hash.Str())
+		code := errors.CodePackHashMismatch
+		if packTruncated(indexed, size) {
+			code = errors.CodePackTruncated
+		}
+		return errors.WithCode(errors.Errorf("Pack ID does not match, want %v, got %v", id.Str(), hash.Str()), code)
 	}
 
-	blobs, err := pack.List(r.Key(), packfile, size)
+	blobs, err := r.PackBlobs(packfile, size)
 	if err != nil {
-		return err
+		return errors.WithCode(err, errors.CodePackHeader)
 	}
 
-	var errs []error
-	var buf []byte
+	var errs, unverified []error
+	var buf, decompressed []byte
 	for i, blob := range blobs {
 		debug.Log("  check blob %d: %v", i, blob)
 
@@ -725,15 +838,32 @@ func checkPack(ctx context.Context, r restic.Repository, id restic.ID) error {
 			continue
 		}
 
-		n, err := crypto.Decrypt(r.Key(), buf, buf)
+		key, err := r.DomainKey(blob.Domain)
+		if err != nil {
+			debug.Log("  unable to check blob %v: %v", blob.ID.Str(), err)
+			unverified = append(unverified, errors.Errorf("blob %v: %v", blob.ID.Str(), err))
+			continue
+		}
+
+		n, err := crypto.Decrypt(key, buf, buf)
 		if err != nil {
 			debug.Log("  error decrypting blob %v: %v", blob.ID.Str(), err)
 			errs = append(errs, errors.Errorf("blob %v: %v", i, err))
 			continue
 		}
-		buf = buf[:n]
+		plaintext := buf[:n]
 
-		hash := restic.Hash(buf)
+		if blob.IsCompressed() {
+			decompressed, err = compression.Decompress(decompressed, plaintext, blob.UncompressedLength)
+			if err != nil {
+				debug.Log("  error decompressing blob %v: %v", blob.ID.Str(), err)
+				errs = append(errs, errors.Errorf("blob %v: %v", i, err))
+				continue
+			}
+			plaintext = decompressed
+		}
+
+		hash := restic.Hash(plaintext)
 		if !hash.Equal(blob.ID) {
 			debug.Log("  Blob ID does not match, want %v, got %v", blob.ID.Str(), hash.Str())
 			errs = append(errs, errors.Errorf("Blob ID does not match, want %v, got %v", blob.ID.Str(), hash.Str()))
@@ -742,14 +872,104 @@ func checkPack(ctx context.Context, r restic.Repository, id restic.ID) error {
 	}
 
 	if len(errs) > 0 {
-		return errors.Errorf("pack %v contains %v errors: %v", id.Str(), len(errs), errs)
+		return errors.WithCode(errors.Errorf("pack %v contains %v errors: %v", id.Str(), len(errs), errs), errors.CodeBlobCorrupted)
+	}
+
+	if errs = compareIndexEntries(indexed, blobs); len(errs) > 0 {
+		return errors.WithCode(errors.Errorf("index entries for pack %v do not match the pack header: %v", id.Str(), errs), errors.CodeIndexInvalid)
+	}
+
+	if len(unverified) > 0 {
+		return errors.WithCode(errors.Errorf("pack %v contains %v blobs which cannot be verified: %v", id.Str(), len(unverified), unverified), errors.CodeBlobUnverified)
 	}
 
 	return nil
 }
 
-// ReadData loads all data from the repository and checks the integrity.
+// compareIndexEntries returns an error for each blob in indexed which is not
+// stored at the same position in the pack according to the pack header.
+func compareIndexEntries(indexed []restic.Blob, header []restic.Blob) (errs []error) {
+	type blobPos struct {
+		offset, length uint
+		domain         string
+		uncompressed   uint
+	}
+
+	positions := make(map[restic.BlobHandle][]blobPos)
+	for _, blob := range header {
+		h := restic.BlobHandle{ID: blob.ID, Type: blob.Type}
+		positions[h] = append(positions[h], blobPos{blob.Offset, blob.Length, blob.Domain, blob.UncompressedLength})
+	}
+
+	for _, pb := range indexed {
+		h := restic.BlobHandle{ID: pb.ID, Type: pb.Type}
+		list, ok := positions[h]
+		if !ok {
+			errs = append(errs, errors.Errorf("blob %v is not contained in the pack header", pb.ID.Str()))
+			continue
+		}
+
+		found := false
+		for _, pos := range list {
+			if pos.offset == pb.Offset && pos.length == pb.Length {
+				found = true
+				if pos.domain != pb.Domain {
+					errs = append(errs, errors.Errorf("blob %v belongs to the encryption domain %q according to the index, but to %q according to the pack header",
+						pb.ID.Str(), pb.Domain, pos.domain))
+				}
+				if pos.uncompressed != pb.UncompressedLength {
+					errs = append(errs, errors.Errorf("blob %v has the uncompressed length %d according to the index, but %d according to the pack header",
+						pb.ID.Str(), pb.UncompressedLength, pos.uncompressed))
+				}
+				break
+			}
+		}
+
+		if !found {
+			errs = append(errs, errors.Errorf("blob %v is stored at offset %d with length %d according to the index, but at offset %d with length %d according to the pack header",
+				pb.ID.Str(), pb.Offset, pb.Length, list[0].offset, list[0].length))
+		}
+	}
+
+	return errs
+}
+
+// packTruncated returns true if the index lists blobs for the pack which
+// extend beyond size.
+func packTruncated(indexed []restic.Blob, size int64) bool {
+	for _, blob := range indexed {
+		if int64(blob.Offset)+int64(blob.Length) > size {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReadData loads all data from the repository and checks the integrity. The
+// errors sent to errChan are of type PackError.
 func (c *Checker) ReadData(ctx context.Context, p *restic.Progress, errChan chan<- error) {
+	c.readPacks(ctx, c.repo.List(ctx, restic.DataFile), p, errChan)
+}
+
+// ReadPacks loads the packs from the repository and checks the integrity.
+func (c *Checker) ReadPacks(ctx context.Context, packs restic.IDSet, p *restic.Progress, errChan chan<- error) {
+	ch := make(chan restic.ID)
+	go func() {
+		defer close(ch)
+		for id := range packs {
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- id:
+			}
+		}
+	}()
+
+	c.readPacks(ctx, ch, p, errChan)
+}
+
+func (c *Checker) readPacks(ctx context.Context, ch <-chan restic.ID, p *restic.Progress, errChan chan<- error) {
 	defer close(errChan)
 
 	p.Start()
@@ -770,11 +990,12 @@ func (c *Checker) ReadData(ctx context.Context, p *restic.Progress, errChan chan
 				}
 			}
 
-			err := checkPack(ctx, c.repo, id)
+			err := checkPack(ctx, c.repo, id, c.packBlobs[id])
 			p.Report(restic.Stat{Blobs: 1})
 			if err == nil {
 				continue
 			}
+			err = PackError{ID: id, Err: err}
 
 			select {
 			case <-ctx.Done():
@@ -784,10 +1005,8 @@ func (c *Checker) ReadData(ctx context.Context, p *restic.Progress, errChan chan
 		}
 	}
 
-	ch := c.repo.List(ctx, restic.DataFile)
-
 	var wg sync.WaitGroup
-	for i := 0; i < defaultParallelism; i++ {
+	for i := 0; i < limits.Workers(defaultParallelism); i++ {
 		wg.Add(1)
 		go worker(&wg, ch)
 	}
@@ -6,11 +6,13 @@ import (
 	"math/rand"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 
 	"restic"
 	"restic/archiver"
 	"restic/checker"
+	"restic/errors"
 	"restic/repository"
 	"restic/test"
 )
@@ -98,6 +100,7 @@ func TestMissingPack(t *testing.T) {
 
 	if err, ok := errs[0].(checker.PackError); ok {
 		test.Equals(t, packHandle.Name, err.ID.String())
+		test.Equals(t, errors.CodePackMissing, errors.Code(err))
 	} else {
 		t.Errorf("expected error returned by checker.Packs() to be PackError, got %v", err)
 	}
@@ -134,6 +137,7 @@ func TestUnreferencedPack(t *testing.T) {
 
 	if err, ok := errs[0].(checker.PackError); ok {
 		test.Equals(t, packID, err.ID.String())
+		test.Equals(t, errors.CodePackOrphaned, errors.Code(err))
 	} else {
 		t.Errorf("expected error returned by checker.Packs() to be PackError, got %v", err)
 	}
@@ -223,6 +227,75 @@ func TestModifiedIndex(t *testing.T) {
 	}
 }
 
+func TestOverlappingIndexEntries(t *testing.T) {
+	repodir, cleanup := test.Env(t, checkerTestData)
+	defer cleanup()
+
+	repo := repository.TestOpenLocal(t, repodir)
+
+	var (
+		blobs      []restic.PackedBlob
+		oldIndexes restic.IDs
+	)
+	for id := range repo.List(context.TODO(), restic.IndexFile) {
+		idx, err := repository.LoadIndex(context.TODO(), repo, id)
+		test.OK(t, err)
+
+		for pb := range idx.Each(nil) {
+			blobs = append(blobs, pb)
+		}
+		oldIndexes = append(oldIndexes, id)
+	}
+
+	// move a blob so that it overlaps the blob stored in front of it
+	var packID restic.ID
+	found := false
+	for i := range blobs {
+		for _, prev := range blobs {
+			if prev.PackID.Equal(blobs[i].PackID) && prev.Offset+prev.Length == blobs[i].Offset {
+				blobs[i].Offset--
+				packID = blobs[i].PackID
+				found = true
+				break
+			}
+		}
+		if found {
+			break
+		}
+	}
+	test.Assert(t, found, "no pack with two blobs found")
+
+	idx := repository.NewIndex()
+	for _, pb := range blobs {
+		idx.Store(pb)
+	}
+	_, err := repository.SaveIndex(context.TODO(), repo, idx)
+	test.OK(t, err)
+
+	for _, id := range oldIndexes {
+		test.OK(t, repo.Backend().Remove(context.TODO(), restic.Handle{Type: restic.IndexFile, Name: id.String()}))
+	}
+
+	chkr := checker.New(repo)
+	_, errs := chkr.LoadIndex(context.TODO())
+	test.OKs(t, errs)
+
+	errs = checkPacks(chkr)
+	test.Assert(t, len(errs) == 1, "expected exactly one error, got %v: %v", len(errs), errs)
+	err = errs[0]
+	if perr, ok := err.(checker.PackError); ok {
+		test.Equals(t, packID, perr.ID)
+	} else {
+		t.Errorf("expected error returned by checker.Packs() to be PackError, got %v", err)
+	}
+	test.Equals(t, errors.CodeIndexInvalid, errors.Code(err))
+	test.Assert(t, strings.Contains(err.Error(), "overlaps"), "unexpected error %v", err)
+
+	errs = checkData(chkr)
+	test.Assert(t, len(errs) == 1, "expected exactly one error, got %v: %v", len(errs), errs)
+	test.Equals(t, errors.CodeIndexInvalid, errors.Code(errs[0]))
+}
+
 var checkerDuplicateIndexTestData = filepath.Join("testdata", "duplicate-packs-in-index-test-repo.tar.gz")
 
 func TestDuplicatePacksInIndex(t *testing.T) {
@@ -337,6 +410,16 @@ func TestCheckerModifiedData(t *testing.T) {
 	for _, err := range checkData(chkr) {
 		t.Logf("data error: %v", err)
 		errFound = true
+
+		switch code := errors.Code(err); code {
+		case errors.CodePackHashMismatch, errors.CodePackTruncated:
+		default:
+			t.Errorf("unexpected error code %v for %v", code, err)
+		}
+
+		if _, ok := err.(checker.PackError); !ok {
+			t.Errorf("expected error returned by checker.ReadData() to be PackError, got %v", err)
+		}
 	}
 
 	if !errFound {
@@ -0,0 +1,174 @@
+// Package compression compresses and decompresses the content of blobs with
+// zstd.
+package compression
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"restic/errors"
+	"restic/options"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Mode selects whether and how strongly blobs are compressed. Besides the
+// named modes, "zstd-N" selects the zstd level N (1 to 22). The levels are
+// mapped to the closest level the encoder supports, at the moment levels
+// below 3 use the fastest and all others the default level.
+type Mode string
+
+const (
+	// Auto compresses with the fastest level, blobs which don't get smaller
+	// are stored uncompressed.
+	Auto Mode = "auto"
+
+	// Max compresses with the best level available.
+	Max Mode = "max"
+
+	// Off disables compression.
+	Off Mode = "off"
+
+	// DefaultMode is used when no mode is selected.
+	DefaultMode = Auto
+)
+
+// Modes contains all supported modes.
+var Modes = []Mode{Auto, Max, Off}
+
+// MaxZstdLevel is the highest level which can be selected with "zstd-N".
+const MaxZstdLevel = 22
+
+// ParseMode returns the mode with the name s. The empty string selects the
+// default mode.
+func ParseMode(s string) (Mode, error) {
+	if s == "" {
+		return DefaultMode, nil
+	}
+
+	for _, m := range Modes {
+		if string(m) == s {
+			return m, nil
+		}
+	}
+
+	if _, ok := zstdLevel(s); ok {
+		return Mode(s), nil
+	}
+
+	return "", errors.Errorf("unknown compression mode %q, must be auto, max, off or zstd-N with N between 1 and %d", s, MaxZstdLevel)
+}
+
+// zstdLevel returns the level of a mode in the form "zstd-N".
+func zstdLevel(s string) (int, bool) {
+	if !strings.HasPrefix(s, "zstd-") {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "zstd-"))
+	if err != nil || n < 1 || n > MaxZstdLevel {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// level returns the encoder level used for the mode.
+func (m Mode) level() zstd.EncoderLevel {
+	if n, ok := zstdLevel(string(m)); ok {
+		return zstd.EncoderLevelFromZstd(n)
+	}
+
+	if m == Max {
+		return zstd.SpeedBestCompression
+	}
+	return zstd.SpeedFastest
+}
+
+// Options configure the compression of data and tree blobs separately, they
+// override the mode stored in the repository config for the current run.
+type Options struct {
+	Data string `option:"data" help:"compression mode for data blobs (auto, max, off or zstd-N)"`
+	Tree string `option:"tree" help:"compression mode for tree blobs (auto, max, off or zstd-N)"`
+}
+
+func init() {
+	options.Register("compression", Options{})
+}
+
+var (
+	encoderMu sync.Mutex
+	encoders  = make(map[zstd.EncoderLevel]*zstd.Encoder)
+
+	decoderOnce sync.Once
+	decoder     *zstd.Decoder
+	decoderErr  error
+)
+
+// encoder returns the encoder for level, which is created on first use. An
+// encoder can be used concurrently.
+func encoder(level zstd.EncoderLevel) (*zstd.Encoder, error) {
+	encoderMu.Lock()
+	defer encoderMu.Unlock()
+
+	if enc, ok := encoders[level]; ok {
+		return enc, nil
+	}
+
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderCRC(false))
+	if err != nil {
+		return nil, errors.Wrap(err, "zstd.NewWriter")
+	}
+
+	encoders[level] = enc
+	return enc, nil
+}
+
+// Compress appends the compressed data to dst and returns the resulting
+// slice. If the mode is Off or the data does not get smaller, nil is
+// returned and the data should be stored uncompressed.
+func Compress(dst, data []byte, mode Mode) ([]byte, error) {
+	if mode == Off || len(data) == 0 {
+		return nil, nil
+	}
+
+	enc, err := encoder(mode.level())
+	if err != nil {
+		return nil, err
+	}
+
+	buf := enc.EncodeAll(data, dst[:0])
+	if len(buf) >= len(data) {
+		return nil, nil
+	}
+
+	return buf, nil
+}
+
+// Decompress appends the decompressed data to dst and returns the resulting
+// slice. An error is returned if the data is invalid or its decompressed
+// length is not length.
+func Decompress(dst, data []byte, length uint) ([]byte, error) {
+	decoderOnce.Do(func() {
+		decoder, decoderErr = zstd.NewReader(nil)
+	})
+	if decoderErr != nil {
+		return nil, errors.Wrap(decoderErr, "zstd.NewReader")
+	}
+
+	if uint(cap(dst)) < length {
+		dst = make([]byte, 0, length)
+	}
+
+	buf, err := decoder.DecodeAll(data, dst[:0])
+	if err != nil {
+		return nil, errors.Wrap(err, "DecodeAll")
+	}
+
+	if uint(len(buf)) != length {
+		return nil, errors.Errorf("decompressed data has length %d, want %d", len(buf), length)
+	}
+
+	return buf, nil
+}
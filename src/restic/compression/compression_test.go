@@ -0,0 +1,68 @@
+package compression_test
+
+import (
+	"bytes"
+	"testing"
+
+	"restic/compression"
+	. "restic/test"
+)
+
+func TestParseMode(t *testing.T) {
+	var tests = []struct {
+		s    string
+		mode compression.Mode
+		ok   bool
+	}{
+		{"", compression.Auto, true},
+		{"auto", compression.Auto, true},
+		{"max", compression.Max, true},
+		{"off", compression.Off, true},
+		{"zstd-1", compression.Mode("zstd-1"), true},
+		{"zstd-19", compression.Mode("zstd-19"), true},
+		{"zstd-22", compression.Mode("zstd-22"), true},
+		{"zstd-0", "", false},
+		{"zstd-23", "", false},
+		{"zstd-", "", false},
+		{"zstd", "", false},
+		{"gzip", "", false},
+	}
+
+	for _, test := range tests {
+		mode, err := compression.ParseMode(test.s)
+		if !test.ok {
+			Assert(t, err != nil, "no error for mode %q", test.s)
+			continue
+		}
+
+		OK(t, err)
+		Equals(t, test.mode, mode)
+	}
+}
+
+func TestCompressDecompress(t *testing.T) {
+	compressible := bytes.Repeat([]byte("restic "), 10000)
+	random := Random(42, 10000)
+
+	for _, mode := range []compression.Mode{compression.Auto, compression.Max, "zstd-1", "zstd-19"} {
+		buf, err := compression.Compress(nil, compressible, mode)
+		OK(t, err)
+		Assert(t, buf != nil && len(buf) < len(compressible), "data was not compressed with mode %v", mode)
+
+		plaintext, err := compression.Decompress(nil, buf, uint(len(compressible)))
+		OK(t, err)
+		Equals(t, compressible, plaintext)
+
+		_, err = compression.Decompress(nil, buf, uint(len(compressible))+1)
+		Assert(t, err != nil, "no error for a wrong uncompressed length")
+
+		// random data does not get smaller
+		buf, err = compression.Compress(nil, random, mode)
+		OK(t, err)
+		Assert(t, buf == nil, "random data was compressed with mode %v", mode)
+	}
+
+	buf, err := compression.Compress(nil, compressible, compression.Off)
+	OK(t, err)
+	Assert(t, buf == nil, "data was compressed with mode off")
+}
@@ -3,7 +3,10 @@ package restic
 import (
 	"context"
 	"testing"
+	"time"
 
+	"restic/compression"
+	"restic/crypto"
 	"restic/errors"
 
 	"restic/debug"
@@ -16,32 +19,175 @@ type Config struct {
 	Version           uint        `json:"version"`
 	ID                string      `json:"id"`
 	ChunkerPolynomial chunker.Pol `json:"chunker_polynomial"`
+
+	// Cipher is the algorithm used to encrypt the files and blobs in the
+	// repository, the default cipher is used when it is empty. The config
+	// itself is always encrypted with the default cipher.
+	Cipher crypto.Cipher `json:"cipher,omitempty"`
+
+	// Compression selects how blobs are compressed, the default mode is used
+	// when it is empty. It can only be set for repository version 6.
+	Compression compression.Mode `json:"compression,omitempty"`
+
+	// PruneSuggestion configures when running prune is suggested after a
+	// backup. It is nil unless configured by the user.
+	PruneSuggestion *PruneSuggestion `json:"prune_suggestion,omitempty"`
+
+	// Maintenance configures the tasks run by the maintain command. It is
+	// nil unless configured by the user.
+	Maintenance *MaintenancePolicy `json:"maintenance,omitempty"`
+}
+
+// PruneSuggestion contains the thresholds for the amount of unused data in a
+// repository above which running prune is suggested. A threshold is disabled
+// when it is set to zero.
+type PruneSuggestion struct {
+	MaxUnusedPercent uint   `json:"max_unused_percent,omitempty"`
+	MaxUnusedBytes   uint64 `json:"max_unused_bytes,omitempty"`
+}
+
+// Enabled returns true if at least one threshold is configured.
+func (p *PruneSuggestion) Enabled() bool {
+	return p != nil && (p.MaxUnusedPercent > 0 || p.MaxUnusedBytes > 0)
 }
 
+// MaintenancePolicy describes which maintenance tasks are due. A task is
+// disabled when its setting is zero.
+type MaintenancePolicy struct {
+	// ReadDataPercent is the percentage of the packs which are read and
+	// verified in each run.
+	ReadDataPercent uint `json:"read_data_percent,omitempty"`
+
+	// RepackBelowPercent selects the packs which are rewritten: those in
+	// which less than this percentage of the data is still used.
+	RepackBelowPercent uint `json:"repack_below_percent,omitempty"`
+
+	// RebuildIndexAfter is the age after which the index is rebuilt.
+	RebuildIndexAfter time.Duration `json:"rebuild_index_after,omitempty"`
+
+	// LastIndexRebuild records when the index was rebuilt by maintain.
+	LastIndexRebuild time.Time `json:"last_index_rebuild"`
+}
+
+// Enabled returns true if at least one task is configured.
+func (p *MaintenancePolicy) Enabled() bool {
+	return p != nil && (p.ReadDataPercent > 0 || p.RepackBelowPercent > 0 || p.RebuildIndexAfter > 0)
+}
+
+// IndexRebuildDue returns true if the index was rebuilt longer than
+// RebuildIndexAfter ago (or never).
+func (p *MaintenancePolicy) IndexRebuildDue(now time.Time) bool {
+	return p != nil && p.RebuildIndexAfter > 0 && !now.Before(p.LastIndexRebuild.Add(p.RebuildIndexAfter))
+}
+
+// The repository versions are:
+//
+//	1: the original format
+//	2: all index files use the current format, index files in the old format
+//	   (a plain list of packs) are rejected
+//	3: the data may be encrypted with a cipher other than the default one,
+//	   which is recorded in the config
+//	4: all files except the config are encrypted with a metadata key derived
+//	   from the master key, keys of encryption domains don't contain the
+//	   master key
+//	5: the list of data blobs of very large files may be stored in a separate
+//	   content list blob
+//	6: blobs may be compressed with zstd, the uncompressed length is recorded
+//	   in the pack header and the index
+//
+// Repositories are upgraded with the "migrate" command.
+const (
+	// MinRepoVersion is the oldest repository version which can be used.
+	MinRepoVersion = 1
+
+	// MaxRepoVersion is the newest repository version which can be used.
+	MaxRepoVersion = 6
+)
+
 // RepoVersion is the version that is written to the config when a repository
 // is newly created with Init().
-const RepoVersion = 1
+const RepoVersion = MaxRepoVersion
+
+// OldIndexAllowed returns true if index files in the old format may be
+// present in the repository.
+func (cfg Config) OldIndexAllowed() bool {
+	return cfg.Version < 2
+}
+
+// DomainsAllowed returns true if keys for separate encryption domains can be
+// added to the repository.
+func (cfg Config) DomainsAllowed() bool {
+	return cfg.Version >= 4
+}
+
+// ContentListsAllowed returns true if the content of very large files may be
+// stored in separate content list blobs.
+func (cfg Config) ContentListsAllowed() bool {
+	return cfg.Version >= 5
+}
+
+// CompressionAllowed returns true if blobs may be stored compressed.
+func (cfg Config) CompressionAllowed() bool {
+	return cfg.Version >= 6
+}
+
+// CheckCipher returns an error if the cipher is unknown or cannot be used
+// with the repository version.
+func (cfg Config) CheckCipher() error {
+	c, err := crypto.ParseCipher(string(cfg.Cipher))
+	if err != nil {
+		return err
+	}
+
+	if c != crypto.DefaultCipher && cfg.Version < 3 {
+		return errors.Errorf("cipher %v requires repository version 3, the repository has version %v", c, cfg.Version)
+	}
+
+	return nil
+}
+
+// CheckCompression returns an error if the compression mode is unknown or
+// cannot be used with the repository version.
+func (cfg Config) CheckCompression() error {
+	if cfg.Compression == "" {
+		return nil
+	}
+
+	if _, err := compression.ParseMode(string(cfg.Compression)); err != nil {
+		return err
+	}
+
+	if !cfg.CompressionAllowed() {
+		return errors.Errorf("compression requires repository version 6, the repository has version %v", cfg.Version)
+	}
+
+	return nil
+}
 
 // JSONUnpackedLoader loads unpacked JSON.
 type JSONUnpackedLoader interface {
 	LoadJSONUnpacked(context.Context, FileType, ID, interface{}) error
 }
 
-// CreateConfig creates a config file with a randomly selected polynomial and
-// ID.
-func CreateConfig() (Config, error) {
+// CreateConfig creates a config file for the repository version with a
+// randomly selected polynomial and ID.
+func CreateConfig(version uint) (Config, error) {
 	var (
 		err error
 		cfg Config
 	)
 
+	if version < MinRepoVersion || version > MaxRepoVersion {
+		return Config{}, errors.Errorf("unsupported repository version %v", version)
+	}
+
 	cfg.ChunkerPolynomial, err = chunker.RandomPolynomial()
 	if err != nil {
 		return Config{}, errors.Wrap(err, "chunker.RandomPolynomial")
 	}
 
 	cfg.ID = NewRandomID().String()
-	cfg.Version = RepoVersion
+	cfg.Version = version
 
 	debug.Log("New config: %#v", cfg)
 	return cfg, nil
@@ -68,13 +214,25 @@ func LoadConfig(ctx context.Context, r JSONUnpackedLoader) (Config, error) {
 		return Config{}, err
 	}
 
-	if cfg.Version != RepoVersion {
-		return Config{}, errors.New("unsupported repository version")
+	if cfg.Version < MinRepoVersion {
+		return Config{}, errors.Errorf("unsupported repository version %v", cfg.Version)
+	}
+
+	if cfg.Version > MaxRepoVersion {
+		return Config{}, errors.Errorf("repository version %v is not supported by this version of restic (at most %v), please upgrade restic", cfg.Version, MaxRepoVersion)
 	}
 
 	if !cfg.ChunkerPolynomial.Irreducible() {
 		return Config{}, errors.New("invalid chunker polynomial")
 	}
 
+	if err = cfg.CheckCipher(); err != nil {
+		return Config{}, err
+	}
+
+	if err = cfg.CheckCompression(); err != nil {
+		return Config{}, err
+	}
+
 	return cfg, nil
 }
@@ -32,7 +32,7 @@ func TestConfig(t *testing.T) {
 		return restic.ID{}, nil
 	}
 
-	cfg1, err := restic.CreateConfig()
+	cfg1, err := restic.CreateConfig(restic.RepoVersion)
 	OK(t, err)
 
 	_, err = saver(save).SaveJSONUnpacked(restic.ConfigFile, cfg1)
@@ -53,3 +53,28 @@ func TestConfig(t *testing.T) {
 	Assert(t, cfg1 == cfg2,
 		"configs aren't equal: %v != %v", cfg1, cfg2)
 }
+
+func TestConfigVersion(t *testing.T) {
+	base, err := restic.CreateConfig(restic.RepoVersion)
+	OK(t, err)
+
+	for version := uint(0); version <= restic.MaxRepoVersion+1; version++ {
+		_, err := restic.CreateConfig(version)
+		valid := version >= restic.MinRepoVersion && version <= restic.MaxRepoVersion
+		if valid != (err == nil) {
+			t.Errorf("CreateConfig(%v) returned unexpected error %v", version, err)
+		}
+
+		cfg := base
+		cfg.Version = version
+		load := func(ctx context.Context, tpe restic.FileType, id restic.ID, arg interface{}) error {
+			*arg.(*restic.Config) = cfg
+			return nil
+		}
+
+		_, err = restic.LoadConfig(context.TODO(), loader(load))
+		if valid != (err == nil) {
+			t.Errorf("LoadConfig() for version %v returned unexpected error %v", version, err)
+		}
+	}
+}
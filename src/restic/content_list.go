@@ -0,0 +1,71 @@
+package restic
+
+import (
+	"encoding/json"
+
+	"restic/errors"
+)
+
+// ContentListThreshold is the number of data blobs above which the content of
+// a file is stored in a separate ContentList blob instead of the tree, so
+// that trees containing very large files stay small.
+var ContentListThreshold = 2000
+
+// ContentList is the list of data blobs of a single file. It is stored as a
+// tree blob and referenced by the ContentList field of a node.
+type ContentList struct {
+	Content IDs `json:"content"`
+}
+
+// SaveContentLists calls save for each file node in tree with more than
+// ContentListThreshold data blobs with the encoded ContentList and its ID,
+// and sets the ContentList field of the node. The field is cleared for all
+// other nodes, and for all nodes if the repository version of cfg does not
+// allow content lists.
+func SaveContentLists(cfg Config, tree *Tree, save func(id ID, buf []byte) error) error {
+	for _, node := range tree.Nodes {
+		if !cfg.ContentListsAllowed() || node.Type != "file" || len(node.Content) <= ContentListThreshold {
+			node.ContentList = nil
+			continue
+		}
+
+		buf, err := json.Marshal(ContentList{Content: node.Content})
+		if err != nil {
+			return errors.Wrap(err, "Marshal")
+		}
+		buf = append(buf, '\n')
+
+		id := Hash(buf)
+		if err = save(id, buf); err != nil {
+			return err
+		}
+
+		node.ContentList = &id
+	}
+
+	return nil
+}
+
+// LoadContentLists sets the content of all nodes in tree which reference a
+// ContentList, load is called to retrieve the blob.
+func LoadContentLists(tree *Tree, load func(id ID) ([]byte, error)) error {
+	for _, node := range tree.Nodes {
+		if node.ContentList == nil {
+			continue
+		}
+
+		buf, err := load(*node.ContentList)
+		if err != nil {
+			return err
+		}
+
+		var list ContentList
+		if err = json.Unmarshal(buf, &list); err != nil {
+			return errors.Wrapf(err, "content list for %q", node.Name)
+		}
+
+		node.Content = list.Content
+	}
+
+	return nil
+}
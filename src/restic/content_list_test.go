@@ -0,0 +1,84 @@
+package restic_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"restic"
+	"restic/repository"
+	. "restic/test"
+)
+
+func TestContentList(t *testing.T) {
+	defer func(threshold int) {
+		restic.ContentListThreshold = threshold
+	}(restic.ContentListThreshold)
+	restic.ContentListThreshold = 3
+
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	small := &restic.Node{Name: "small", Type: "file", Content: restic.IDs{restic.NewRandomID()}}
+	large := &restic.Node{Name: "large", Type: "file"}
+	for i := 0; i < 5; i++ {
+		large.Content = append(large.Content, restic.NewRandomID())
+	}
+
+	tree := restic.NewTree()
+	OK(t, tree.Insert(large))
+	OK(t, tree.Insert(small))
+
+	id, err := repo.SaveTree(context.TODO(), tree)
+	OK(t, err)
+	OK(t, repo.Flush())
+
+	Assert(t, large.ContentList != nil, "large file has no content list")
+	Assert(t, small.ContentList == nil, "small file has a content list")
+
+	// the content of the large file is not stored in the tree itself
+	buf, err := json.Marshal(large)
+	OK(t, err)
+	var n restic.Node
+	OK(t, json.Unmarshal(buf, &n))
+	Equals(t, 0, len(n.Content))
+	Equals(t, *large.ContentList, *n.ContentList)
+
+	tree2, err := repo.LoadTree(context.TODO(), id)
+	OK(t, err)
+	Assert(t, tree.Equals(tree2), "trees are not equal: want %v, got %v", tree, tree2)
+	Equals(t, large.Content, tree2.Nodes[0].Content)
+
+	blobs := restic.NewBlobSet()
+	OK(t, restic.FindUsedBlobs(context.TODO(), repo, id, blobs, restic.NewBlobSet()))
+	Assert(t, blobs.Has(restic.BlobHandle{ID: *large.ContentList, Type: restic.TreeBlob}),
+		"content list is not contained in the used blobs")
+	Equals(t, 1+1+len(large.Content)+len(small.Content), len(blobs))
+}
+
+func TestContentListRepoVersion(t *testing.T) {
+	defer func(threshold int) {
+		restic.ContentListThreshold = threshold
+	}(restic.ContentListThreshold)
+	restic.ContentListThreshold = 1
+
+	large := &restic.Node{Name: "large", Type: "file", Content: restic.IDs{restic.NewRandomID(), restic.NewRandomID()}}
+	tree := restic.NewTree()
+	OK(t, tree.Insert(large))
+
+	saved := 0
+	save := func(id restic.ID, buf []byte) error {
+		saved++
+		return nil
+	}
+
+	cfg := restic.Config{Version: 4}
+	OK(t, restic.SaveContentLists(cfg, tree, save))
+	Equals(t, 0, saved)
+	Assert(t, large.ContentList == nil, "content list stored for repository version 4")
+
+	cfg.Version = 5
+	OK(t, restic.SaveContentLists(cfg, tree, save))
+	Equals(t, 1, saved)
+	Assert(t, large.ContentList != nil, "no content list stored for repository version 5")
+}
@@ -3,12 +3,15 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 
 	"restic/errors"
 
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/poly1305"
 )
 
@@ -23,6 +26,40 @@ const (
 	Extension = ivSize + macSize
 )
 
+// Cipher identifies the algorithm used to encrypt and authenticate data.
+type Cipher string
+
+const (
+	// AES256Poly1305 is AES-256 in counter mode with Poly1305-AES as MAC.
+	AES256Poly1305 Cipher = "aes256-poly1305"
+
+	// ChaCha20Poly1305 is XChaCha20-Poly1305, which is faster than AES on
+	// CPUs without hardware support for AES.
+	ChaCha20Poly1305 Cipher = "chacha20-poly1305"
+
+	// DefaultCipher is used when no cipher is selected.
+	DefaultCipher = AES256Poly1305
+)
+
+// Ciphers contains all supported ciphers.
+var Ciphers = []Cipher{AES256Poly1305, ChaCha20Poly1305}
+
+// ParseCipher returns the cipher with the name s. The empty string selects
+// the default cipher.
+func ParseCipher(s string) (Cipher, error) {
+	if s == "" {
+		return DefaultCipher, nil
+	}
+
+	for _, c := range Ciphers {
+		if string(c) == s {
+			return c, nil
+		}
+	}
+
+	return "", errors.Errorf("unknown cipher %q", s)
+}
+
 var (
 	// ErrUnauthenticated is returned when ciphertext verification has failed.
 	ErrUnauthenticated = errors.New("ciphertext verification failed")
@@ -34,6 +71,25 @@ var (
 type Key struct {
 	MAC     MACKey        `json:"mac"`
 	Encrypt EncryptionKey `json:"encrypt"`
+
+	// Cipher is the algorithm used with the key, the default cipher is used
+	// when it is empty. It is configured for the repository and not stored
+	// with the key.
+	Cipher Cipher `json:"-"`
+}
+
+// WithCipher returns a copy of k which uses the cipher c.
+func (k *Key) WithCipher(c Cipher) *Key {
+	nk := *k
+	nk.Cipher = c
+	return &nk
+}
+
+func (k *Key) cipher() Cipher {
+	if k.Cipher == "" {
+		return DefaultCipher
+	}
+	return k.Cipher
 }
 
 type EncryptionKey [32]byte
@@ -142,6 +198,29 @@ func NewRandomKey() *Key {
 	return k
 }
 
+// DeriveKey returns a new key derived from k for the given purpose with
+// HMAC-SHA-256. The key k cannot be computed from the derived key, which
+// uses the same cipher as k.
+func DeriveKey(k *Key, purpose string) *Key {
+	secret := make([]byte, 0, aesKeySize+macKeySize)
+	secret = append(secret, k.Encrypt[:]...)
+	secret = append(secret, k.MAC.K[:]...)
+	secret = append(secret, k.MAC.R[:]...)
+
+	var buf []byte
+	for i := byte(1); len(buf) < aesKeySize+macKeySize; i++ {
+		h := hmac.New(sha256.New, secret)
+		h.Write([]byte(purpose))
+		h.Write([]byte{i})
+		buf = h.Sum(buf)
+	}
+
+	dk := &Key{Cipher: k.Cipher}
+	copy(dk.Encrypt[:], buf[:aesKeySize])
+	macKeyFromSlice(&dk.MAC, buf[aesKeySize:])
+	return dk
+}
+
 func newIV() []byte {
 	iv := make([]byte, ivSize)
 	n, err := rand.Read(iv)
@@ -220,6 +299,23 @@ func (k *EncryptionKey) Valid() bool {
 	return false
 }
 
+// newXChaCha20Poly1305 returns the AEAD for the cipher ChaCha20Poly1305.
+func newXChaCha20Poly1305(key *EncryptionKey) cipher.AEAD {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		panic(fmt.Sprintf("unable to create cipher: %v", err))
+	}
+	return aead
+}
+
+// chachaNonce returns the 24 byte XChaCha20 nonce for the 16 byte iv, which
+// is padded with zeros.
+func chachaNonce(iv []byte) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, iv)
+	return nonce
+}
+
 // ErrInvalidCiphertext is returned when trying to encrypt into the slice that
 // holds the plaintext.
 var ErrInvalidCiphertext = errors.New("invalid ciphertext, same slice used for plaintext")
@@ -248,20 +344,29 @@ func Encrypt(ks *Key, ciphertext []byte, plaintext []byte) ([]byte, error) {
 	}
 
 	iv := newIV()
-	c, err := aes.NewCipher(ks.Encrypt[:])
-	if err != nil {
-		panic(fmt.Sprintf("unable to create cipher: %v", err))
-	}
 
-	e := cipher.NewCTR(c, iv[:])
+	var mac []byte
+	switch ks.cipher() {
+	case AES256Poly1305:
+		c, err := aes.NewCipher(ks.Encrypt[:])
+		if err != nil {
+			panic(fmt.Sprintf("unable to create cipher: %v", err))
+		}
+
+		e := cipher.NewCTR(c, iv[:])
+		e.XORKeyStream(ciphertext[ivSize:], plaintext)
+		mac = poly1305MAC(ciphertext[ivSize:ivSize+len(plaintext)], iv, &ks.MAC)
+	case ChaCha20Poly1305:
+		sealed := newXChaCha20Poly1305(&ks.Encrypt).Seal(ciphertext[ivSize:ivSize], chachaNonce(iv), plaintext, nil)
+		mac = sealed[len(plaintext):]
+	default:
+		return nil, errors.Errorf("unknown cipher %q", ks.Cipher)
+	}
 
-	e.XORKeyStream(ciphertext[ivSize:], plaintext)
 	copy(ciphertext, iv[:])
 
 	// truncate to only cover iv and actual ciphertext
 	ciphertext = ciphertext[:ivSize+len(plaintext)]
-
-	mac := poly1305MAC(ciphertext[ivSize:], ciphertext[:ivSize], &ks.MAC)
 	ciphertext = append(ciphertext, mac...)
 
 	return ciphertext, nil
@@ -290,11 +395,6 @@ func Decrypt(ks *Key, plaintext []byte, ciphertextWithMac []byte) (int, error) {
 	l := len(ciphertextWithMac) - macSize
 	ciphertextWithIV, mac := ciphertextWithMac[:l], ciphertextWithMac[l:]
 
-	// verify mac
-	if !poly1305Verify(ciphertextWithIV[ivSize:], ciphertextWithIV[:ivSize], &ks.MAC, mac) {
-		return 0, ErrUnauthenticated
-	}
-
 	// extract iv
 	iv, ciphertext := ciphertextWithIV[:ivSize], ciphertextWithIV[ivSize:]
 
@@ -302,16 +402,44 @@ func Decrypt(ks *Key, plaintext []byte, ciphertextWithMac []byte) (int, error) {
 		return 0, errors.Errorf("plaintext and ciphertext lengths do not match: %d != %d", len(ciphertext), plaintextLength)
 	}
 
-	// decrypt data
-	c, err := aes.NewCipher(ks.Encrypt[:])
-	if err != nil {
-		panic(fmt.Sprintf("unable to create cipher: %v", err))
-	}
-
-	// decrypt
-	e := cipher.NewCTR(c, iv)
 	plaintext = plaintext[:len(ciphertext)]
-	e.XORKeyStream(plaintext, ciphertext)
+
+	switch ks.cipher() {
+	case AES256Poly1305:
+		// verify mac
+		if !poly1305Verify(ciphertext, iv, &ks.MAC, mac) {
+			return 0, ErrUnauthenticated
+		}
+
+		// decrypt data
+		c, err := aes.NewCipher(ks.Encrypt[:])
+		if err != nil {
+			panic(fmt.Sprintf("unable to create cipher: %v", err))
+		}
+
+		e := cipher.NewCTR(c, iv)
+		e.XORKeyStream(plaintext, ciphertext)
+	case ChaCha20Poly1305:
+		aead := newXChaCha20Poly1305(&ks.Encrypt)
+		ciphertext = ciphertextWithMac[ivSize:]
+
+		// Open requires plaintext and ciphertext to overlap exactly or not at
+		// all, so decrypt in place when they are the same slice.
+		if len(plaintext) > 0 && &plaintext[0] == &ciphertextWithMac[0] {
+			buf, err := aead.Open(ciphertext[:0], chachaNonce(iv), ciphertext, nil)
+			if err != nil {
+				return 0, ErrUnauthenticated
+			}
+			copy(plaintext, buf)
+			break
+		}
+
+		if _, err := aead.Open(plaintext[:0], chachaNonce(iv), ciphertext, nil); err != nil {
+			return 0, ErrUnauthenticated
+		}
+	default:
+		return 0, errors.Errorf("unknown cipher %q", ks.Cipher)
+	}
 
 	return plaintextLength, nil
 }
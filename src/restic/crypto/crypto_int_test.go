@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/hex"
 	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // test vectors from http://cr.yp.to/mac/poly1305-20050329.pdf
@@ -137,3 +139,28 @@ func TestCrypto(t *testing.T) {
 		}
 	}
 }
+
+// TestXChaCha20Poly1305Format checks that data encrypted with the cipher
+// ChaCha20Poly1305 is IV || XChaCha20-Poly1305 ciphertext and tag, with the IV
+// padded with zeros as nonce.
+func TestXChaCha20Poly1305Format(t *testing.T) {
+	k := NewRandomKey().WithCipher(ChaCha20Poly1305)
+	plaintext := []byte("restic encrypts with XChaCha20-Poly1305")
+
+	ciphertext, err := Encrypt(k, nil, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iv := ciphertext[:ivSize]
+	nonce := append(append([]byte{}, iv...), make([]byte, 8)...)
+	aead, err := chacha20poly1305.NewX(k.Encrypt[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := aead.Seal(append([]byte{}, iv...), nonce, plaintext, nil)
+	if !bytes.Equal(ciphertext, want) {
+		t.Fatalf("wrong ciphertext:\n  want %x\n   got %x", want, ciphertext)
+	}
+}
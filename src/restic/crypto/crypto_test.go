@@ -15,9 +15,15 @@ import (
 const testLargeCrypto = false
 
 func TestEncryptDecrypt(t *testing.T) {
-	k := crypto.NewRandomKey()
+	for _, c := range crypto.Ciphers {
+		t.Run(string(c), func(t *testing.T) {
+			testEncryptDecrypt(t, crypto.NewRandomKey().WithCipher(c))
+		})
+	}
+}
 
-	tests := []int{5, 23, 2<<18 + 23, 1 << 20}
+func testEncryptDecrypt(t *testing.T, k *crypto.Key) {
+	tests := []int{0, 5, 23, 64, 2<<18 + 23, 1 << 20}
 	if testLargeCrypto {
 		tests = append(tests, 7<<20+123)
 	}
@@ -44,6 +50,60 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 }
 
+func TestCipherMismatch(t *testing.T) {
+	k := crypto.NewRandomKey()
+	data := Random(23, 1000)
+
+	ciphertext, err := crypto.Encrypt(k.WithCipher(crypto.ChaCha20Poly1305), nil, data)
+	OK(t, err)
+
+	// decrypt in place
+	buf := append([]byte{}, ciphertext...)
+	n, err := crypto.Decrypt(k.WithCipher(crypto.ChaCha20Poly1305), buf, buf)
+	OK(t, err)
+	Equals(t, data, buf[:n])
+
+	_, err = crypto.Decrypt(k, make([]byte, len(ciphertext)), ciphertext)
+	Assert(t, err == crypto.ErrUnauthenticated,
+		"expected ErrUnauthenticated for the wrong cipher, got %v", err)
+
+	_, err = crypto.Encrypt(k.WithCipher("foo"), nil, data)
+	Assert(t, err != nil, "no error for unknown cipher")
+}
+
+func TestDeriveKey(t *testing.T) {
+	k := crypto.NewRandomKey()
+
+	dk := crypto.DeriveKey(k, "metadata")
+	Assert(t, dk.Valid(), "derived key is not valid")
+	Equals(t, dk, crypto.DeriveKey(k, "metadata"))
+	Assert(t, dk.Encrypt != k.Encrypt, "derived key equals the original key")
+
+	other := crypto.DeriveKey(k, "other")
+	Assert(t, other.Encrypt != dk.Encrypt, "keys for different purposes are equal")
+
+	ciphertext, err := crypto.Encrypt(dk, nil, []byte("foobar"))
+	OK(t, err)
+	_, err = crypto.Decrypt(k, make([]byte, len(ciphertext)), ciphertext)
+	Assert(t, err == crypto.ErrUnauthenticated,
+		"expected ErrUnauthenticated for the original key, got %v", err)
+}
+
+func TestParseCipher(t *testing.T) {
+	for _, s := range []string{"", "aes256-poly1305", "chacha20-poly1305"} {
+		c, err := crypto.ParseCipher(s)
+		OK(t, err)
+		if s == "" {
+			Equals(t, crypto.DefaultCipher, c)
+		} else {
+			Equals(t, s, string(c))
+		}
+	}
+
+	_, err := crypto.ParseCipher("aes128")
+	Assert(t, err != nil, "no error for unknown cipher")
+}
+
 func TestSmallBuffer(t *testing.T) {
 	k := crypto.NewRandomKey()
 
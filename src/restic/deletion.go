@@ -0,0 +1,89 @@
+package restic
+
+import (
+	"context"
+	"time"
+)
+
+// PendingDeletion records packs which are not referenced by any index any
+// more and are to be removed from the backend later. Deferring the removal
+// ensures that clients of backends with eventually consistent listings never
+// load an (old) index which references packs that are already gone.
+type PendingDeletion struct {
+	Time  time.Time `json:"time"`
+	Packs IDs       `json:"packs"`
+
+	// NotBefore is the time after which the packs may be removed, it is
+	// computed from the delay of the run of prune which recorded them.
+	NotBefore time.Time `json:"not_before"`
+
+	id *ID
+}
+
+// NewPendingDeletion returns a new pending deletion for packs at the current
+// time, the packs may be removed once delay has passed.
+func NewPendingDeletion(packs IDs, delay time.Duration) *PendingDeletion {
+	now := time.Now()
+	return &PendingDeletion{
+		Time:      now,
+		Packs:     packs,
+		NotBefore: now.Add(delay),
+	}
+}
+
+// LoadPendingDeletion loads the pending deletion with the id and returns it.
+func LoadPendingDeletion(ctx context.Context, repo Repository, id ID) (*PendingDeletion, error) {
+	d := &PendingDeletion{id: &id}
+	err := repo.LoadJSONUnpacked(ctx, DeletionFile, id, d)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// LoadAllPendingDeletions returns a list of all pending deletions in the repo.
+func LoadAllPendingDeletions(ctx context.Context, repo Repository) (list []*PendingDeletion, err error) {
+	for id := range repo.List(ctx, DeletionFile) {
+		d, err := LoadPendingDeletion(ctx, repo, id)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// SavePendingDeletion saves d in the repo.
+func SavePendingDeletion(ctx context.Context, repo Repository, d *PendingDeletion) (ID, error) {
+	id, err := repo.SaveJSONUnpacked(ctx, DeletionFile, d)
+	if err != nil {
+		return ID{}, err
+	}
+
+	d.id = &id
+	return id, nil
+}
+
+// ID returns the ID of the pending deletion.
+func (d PendingDeletion) ID() *ID {
+	return d.id
+}
+
+// Due returns true if the packs may be removed, which is the case when the
+// delay given when the pending deletion was recorded has passed.
+func (d PendingDeletion) Due(now time.Time) bool {
+	return !now.Before(d.NotBefore)
+}
+
+// PendingPacks returns the set of all packs contained in list.
+func PendingPacks(list []*PendingDeletion) IDSet {
+	packs := NewIDSet()
+	for _, d := range list {
+		for _, id := range d.Packs {
+			packs.Insert(id)
+		}
+	}
+	return packs
+}
@@ -0,0 +1,30 @@
+package restic_test
+
+import (
+	"testing"
+	"time"
+
+	"restic"
+	. "restic/test"
+)
+
+func TestPendingDeletionDue(t *testing.T) {
+	d := restic.NewPendingDeletion(restic.IDs{restic.NewRandomID()}, 0)
+	Assert(t, d.Due(d.Time), "deletion without delay is not due")
+
+	d = restic.NewPendingDeletion(restic.IDs{restic.NewRandomID()}, time.Hour)
+	Assert(t, !d.Due(d.Time.Add(time.Minute)), "deletion is due before the delay passed")
+	Assert(t, d.Due(d.Time.Add(time.Hour)), "deletion is not due after the delay passed")
+}
+
+func TestPendingPacks(t *testing.T) {
+	id1, id2, id3 := restic.NewRandomID(), restic.NewRandomID(), restic.NewRandomID()
+
+	list := []*restic.PendingDeletion{
+		restic.NewPendingDeletion(restic.IDs{id1, id2}, 0),
+		restic.NewPendingDeletion(restic.IDs{id2, id3}, 0),
+	}
+
+	packs := restic.PendingPacks(list)
+	Equals(t, restic.NewIDSet(id1, id2, id3), packs)
+}
@@ -0,0 +1,87 @@
+package errors
+
+import (
+	"fmt"
+	"io"
+)
+
+// Error codes identify specific failure modes. They are included in the JSON
+// output and stay the same in future versions, so that scripts can act on
+// them instead of parsing error messages.
+const (
+	CodeUnknown          = "ERR_UNKNOWN"
+	CodeRepoNotFound     = "ERR_REPO_NOT_FOUND"
+	CodeRepoLocked       = "ERR_REPO_LOCKED"
+	CodeWrongPassword    = "ERR_WRONG_PASSWORD"
+	CodeNoKey            = "ERR_NO_KEY"
+	CodeIndexInvalid     = "ERR_INDEX_INVALID"
+	CodePackMissing      = "ERR_PACK_MISSING"
+	CodePackOrphaned     = "ERR_PACK_ORPHANED"
+	CodePackTruncated    = "ERR_PACK_TRUNCATED"
+	CodePackHashMismatch = "ERR_PACK_HASH_MISMATCH"
+	CodePackHeader       = "ERR_PACK_HEADER_INVALID"
+	CodeBlobMissing      = "ERR_BLOB_MISSING"
+	CodeBlobCorrupted    = "ERR_BLOB_CORRUPTED"
+	CodeBlobUnverified   = "ERR_BLOB_UNVERIFIED"
+	CodeTreeInvalid      = "ERR_TREE_INVALID"
+)
+
+// Coder is an error which carries one of the error codes.
+type Coder interface {
+	ErrorCode() string
+}
+
+// codedError attaches an error code to an error.
+type codedError struct {
+	error
+	code string
+}
+
+func (e codedError) ErrorCode() string {
+	return e.code
+}
+
+func (e codedError) Cause() error {
+	return e.error
+}
+
+// Format keeps the stack trace of the underlying error for "%+v".
+func (e codedError) Format(s fmt.State, verb rune) {
+	if f, ok := e.error.(fmt.Formatter); ok {
+		f.Format(s, verb)
+		return
+	}
+
+	_, _ = io.WriteString(s, e.Error())
+}
+
+// WithCode returns an error which carries the error code. Cause() still
+// returns the cause of err. If err is nil, WithCode returns nil.
+func WithCode(err error, code string) error {
+	if err == nil {
+		return nil
+	}
+	return codedError{error: err, code: code}
+}
+
+// Code returns the error code attached to err or one of the errors it wraps.
+// If no code is found, CodeUnknown is returned.
+func Code(err error) string {
+	type causer interface {
+		Cause() error
+	}
+
+	for err != nil {
+		if c, ok := err.(Coder); ok && c.ErrorCode() != "" {
+			return c.ErrorCode()
+		}
+
+		cause, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+
+	return CodeUnknown
+}
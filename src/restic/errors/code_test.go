@@ -0,0 +1,47 @@
+package errors_test
+
+import (
+	"fmt"
+	"testing"
+
+	"restic/errors"
+)
+
+func TestCode(t *testing.T) {
+	base := errors.New("pack is too short")
+	err := errors.WithCode(base, errors.CodePackTruncated)
+
+	var tests = []struct {
+		err  error
+		code string
+	}{
+		{nil, errors.CodeUnknown},
+		{base, errors.CodeUnknown},
+		{err, errors.CodePackTruncated},
+		{errors.Wrap(err, "Load"), errors.CodePackTruncated},
+		{errors.WithCode(errors.Wrap(err, "Load"), errors.CodePackMissing), errors.CodePackMissing},
+	}
+
+	for i, test := range tests {
+		if code := errors.Code(test.err); code != test.code {
+			t.Errorf("test %d: want code %v, got %v", i, test.code, code)
+		}
+	}
+
+	if errors.Cause(errors.Wrap(err, "Load")) != base {
+		t.Errorf("cause of coded error was not preserved")
+	}
+
+	if errors.WithCode(nil, errors.CodePackMissing) != nil {
+		t.Errorf("WithCode returned an error for nil")
+	}
+
+	fatal := errors.WithCode(errors.Fatal("no key"), errors.CodeWrongPassword)
+	if !errors.IsFatal(errors.Cause(fatal)) {
+		t.Errorf("fatal error with code is not fatal")
+	}
+
+	if msg := fmt.Sprintf("%v", err); msg != base.Error() {
+		t.Errorf("wrong message %q", msg)
+	}
+}
@@ -11,12 +11,18 @@ type FileType string
 
 // These are the different data types a backend can store.
 const (
-	DataFile     FileType = "data"
-	KeyFile               = "key"
-	LockFile              = "lock"
-	SnapshotFile          = "snapshot"
-	IndexFile             = "index"
-	ConfigFile            = "config"
+	DataFile         FileType = "data"
+	KeyFile                   = "key"
+	LockFile                  = "lock"
+	SnapshotFile              = "snapshot"
+	IndexFile                 = "index"
+	ConfigFile                = "config"
+	DeletionFile              = "deletion"
+	TrashFile                 = "trash"
+	IntentFile                = "intent"
+	ConfigUpdateFile          = "configupdate"
+	DomainConfigFile          = "domainconfig"
+	OperationFile             = "operation"
 )
 
 // Handle is used to store and access data in a backend.
@@ -46,6 +52,12 @@ func (h Handle) Valid() error {
 	case SnapshotFile:
 	case IndexFile:
 	case ConfigFile:
+	case DeletionFile:
+	case TrashFile:
+	case IntentFile:
+	case ConfigUpdateFile:
+	case DomainConfigFile:
+	case OperationFile:
 	default:
 		return errors.Errorf("invalid Type %q", h.Type)
 	}
@@ -0,0 +1,146 @@
+package restic
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+
+	"restic/errors"
+)
+
+// BlobRange is the part of a data blob which is covered by a byte range of a
+// file.
+type BlobRange struct {
+	ID ID
+
+	// Offset and Length describe the part within the (plaintext) blob.
+	Offset uint
+	Length uint
+}
+
+// BlobSizeLookuper returns the plaintext size of blobs.
+type BlobSizeLookuper interface {
+	LookupBlobSize(ID, BlobType) (uint, error)
+}
+
+// FindBlobRanges returns the parts of the data blobs in content which contain
+// length bytes of the file starting at offset. If length is zero or the range
+// extends beyond the end of the file, the range ends with the file.
+func FindBlobRanges(repo BlobSizeLookuper, content IDs, offset, length uint64) ([]BlobRange, error) {
+	var ranges []BlobRange
+	var pos uint64
+
+	for _, id := range content {
+		if length > 0 && pos >= offset+length {
+			break
+		}
+
+		size, err := repo.LookupBlobSize(id, DataBlob)
+		if err != nil {
+			return nil, err
+		}
+
+		start, end := pos, pos+uint64(size)
+		pos = end
+
+		if end <= offset {
+			continue
+		}
+
+		r := BlobRange{ID: id, Length: uint(size)}
+		if start < offset {
+			r.Offset = uint(offset - start)
+			r.Length -= r.Offset
+		}
+
+		if length > 0 && end > offset+length {
+			r.Length -= uint(end - (offset + length))
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges, nil
+}
+
+// DumpFileRange writes length bytes of the file with the given content,
+// starting at offset, to wr. Only the blobs which cover the range are loaded
+// from the repository. If length is zero, everything up to the end of the
+// file is written.
+func DumpFileRange(ctx context.Context, repo Repository, content IDs, offset, length uint64, wr io.Writer) error {
+	ranges, err := FindBlobRanges(repo, content, offset, length)
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, r := range ranges {
+		size, err := repo.LookupBlobSize(r.ID, DataBlob)
+		if err != nil {
+			return err
+		}
+
+		if cap(buf) < CiphertextLength(int(size)) {
+			buf = NewBlobBuffer(int(size))
+		}
+		buf = buf[:size]
+
+		n, err := repo.LoadBlob(ctx, DataBlob, r.ID, buf)
+		if err != nil {
+			return err
+		}
+
+		if uint(n) < r.Offset+r.Length {
+			return errors.Errorf("blob %v is too short: %d < %d", r.ID.Str(), n, r.Offset+r.Length)
+		}
+
+		if _, err = wr.Write(buf[r.Offset : r.Offset+r.Length]); err != nil {
+			return errors.Wrap(err, "Write")
+		}
+	}
+
+	return nil
+}
+
+// FindNode returns the node for the slash-separated path p (e.g.
+// "/home/user/file.txt") below the tree with the given id.
+func FindNode(ctx context.Context, repo Repository, treeID ID, p string) (*Node, error) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil, errors.New("empty path")
+	}
+
+	id := treeID
+	names := strings.Split(p, "/")
+	for i, name := range names {
+		tree, err := repo.LoadTree(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		var node *Node
+		for _, n := range tree.Nodes {
+			if n.Name == name {
+				node = n
+				break
+			}
+		}
+
+		if node == nil {
+			return nil, errors.Errorf("%q not found", path.Join(names[:i+1]...))
+		}
+
+		if i == len(names)-1 {
+			return node, nil
+		}
+
+		if node.Type != "dir" || node.Subtree == nil {
+			return nil, errors.Errorf("%q is not a directory", path.Join(names[:i+1]...))
+		}
+
+		id = *node.Subtree
+	}
+
+	panic("unreachable")
+}
@@ -0,0 +1,61 @@
+package restic_test
+
+import (
+	"restic"
+	"testing"
+
+	"restic/errors"
+	. "restic/test"
+)
+
+// blobSizes returns the sizes stored in the map.
+type blobSizes map[restic.ID]uint
+
+func (s blobSizes) LookupBlobSize(id restic.ID, tpe restic.BlobType) (uint, error) {
+	size, ok := s[id]
+	if !ok {
+		return 0, errors.Errorf("blob %v not found", id.Str())
+	}
+	return size, nil
+}
+
+func TestFindBlobRanges(t *testing.T) {
+	sizes := make(blobSizes)
+	var content restic.IDs
+	for i := 0; i < 3; i++ {
+		id := restic.NewRandomID()
+		sizes[id] = 100
+		content = append(content, id)
+	}
+
+	var tests = []struct {
+		offset, length uint64
+		ranges         []restic.BlobRange
+	}{
+		{0, 0, []restic.BlobRange{
+			{ID: content[0], Offset: 0, Length: 100},
+			{ID: content[1], Offset: 0, Length: 100},
+			{ID: content[2], Offset: 0, Length: 100},
+		}},
+		{50, 10, []restic.BlobRange{
+			{ID: content[0], Offset: 50, Length: 10},
+		}},
+		{100, 100, []restic.BlobRange{
+			{ID: content[1], Offset: 0, Length: 100},
+		}},
+		{150, 100, []restic.BlobRange{
+			{ID: content[1], Offset: 50, Length: 50},
+			{ID: content[2], Offset: 0, Length: 50},
+		}},
+		{250, 1000, []restic.BlobRange{
+			{ID: content[2], Offset: 50, Length: 50},
+		}},
+		{300, 0, nil},
+	}
+
+	for _, test := range tests {
+		ranges, err := restic.FindBlobRanges(sizes, content, test.offset, test.length)
+		OK(t, err)
+		Equals(t, test.ranges, ranges)
+	}
+}
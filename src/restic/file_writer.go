@@ -0,0 +1,184 @@
+package restic
+
+import (
+	"io"
+	"os"
+	"unsafe"
+
+	"restic/debug"
+	"restic/errors"
+	"restic/fs"
+)
+
+// FileWriteOptions configures how the contents of files are written when
+// they are restored.
+type FileWriteOptions struct {
+	// Preallocate reserves the space for the complete file before the
+	// contents are written, which avoids fragmentation on file systems like
+	// XFS and ext4. It is ignored where the file system doesn't support it.
+	Preallocate bool
+
+	// DirectIO collects the contents in large aligned buffers and writes them
+	// bypassing the page cache (O_DIRECT on Linux). When the file system does
+	// not support it, the buffered data is written normally.
+	DirectIO bool
+
+	// Sparse skips writing blocks of zeros, they are left as holes in the
+	// file. This is ignored with DirectIO, which writes files sequentially.
+	Sparse bool
+}
+
+const (
+	// directIOAlignment is the alignment required for O_DIRECT, for buffers
+	// as well as for the length and offset of writes.
+	directIOAlignment = 4096
+
+	// directIOBufferSize is the amount of data collected before it is written.
+	directIOBufferSize = 8 * 1024 * 1024
+)
+
+// fileWriter writes the contents of a restored file.
+type fileWriter struct {
+	path   string
+	f      *os.File
+	direct bool
+	buf    []byte
+
+	// sparse files are truncated to size when they are closed, so that
+	// holes at the end are created as well
+	sparse bool
+	size   int64
+}
+
+// newFileWriter creates the file at path, which will contain size bytes.
+func newFileWriter(path string, size int64, opts FileWriteOptions) (*fileWriter, error) {
+	const flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+
+	w := &fileWriter{path: path, size: size}
+
+	var err error
+	if opts.DirectIO {
+		w.f, err = fs.OpenFile(path, flags|oDirect, 0600)
+		if err == nil {
+			w.direct = true
+			w.buf = alignedBuffer(directIOBufferSize)
+		} else if !os.IsNotExist(err) {
+			debug.Log("opening %v with O_DIRECT failed, using normal writes: %v", path, err)
+		}
+	}
+
+	if w.f == nil {
+		w.f, err = fs.OpenFile(path, flags, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "OpenFile")
+		}
+	}
+
+	// preallocating the space would fill the holes
+	w.sparse = opts.Sparse && !w.direct
+	if opts.Preallocate && !w.sparse && size > 0 {
+		if err = preallocate(w.f, size); err != nil {
+			debug.Log("preallocating %d bytes for %v failed: %v", size, path, err)
+		}
+	}
+
+	return w, nil
+}
+
+// isZero returns true if p contains only zero bytes.
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// alignedBuffer returns an empty buffer with capacity size, which starts at
+// an address aligned for O_DIRECT.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlignment)
+	offset := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1))
+	if offset != 0 {
+		offset = directIOAlignment - offset
+	}
+	return buf[offset : offset+size][:0]
+}
+
+// Write writes p to the file. With direct I/O, the data is buffered until the
+// buffer is full.
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.sparse && isZero(p) {
+		if _, err := w.f.Seek(int64(len(p)), io.SeekCurrent); err != nil {
+			return 0, errors.Wrap(err, "Seek")
+		}
+		return len(p), nil
+	}
+
+	if !w.direct {
+		n, err := w.f.Write(p)
+		return n, errors.Wrap(err, "Write")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(w.buf) == cap(w.buf) {
+			if _, err := w.f.Write(w.buf); err != nil {
+				return written, errors.Wrap(err, "Write")
+			}
+			w.buf = w.buf[:0]
+		}
+	}
+
+	return written, nil
+}
+
+// Close writes the remaining buffered data and closes the file.
+func (w *fileWriter) Close() error {
+	if w.sparse {
+		if err := w.f.Truncate(w.size); err != nil {
+			_ = w.f.Close()
+			return errors.Wrap(err, "Truncate")
+		}
+	}
+
+	if !w.direct || len(w.buf) == 0 {
+		return errors.Wrap(w.f.Close(), "Close")
+	}
+
+	// with O_DIRECT, only whole blocks can be written
+	aligned := len(w.buf) &^ (directIOAlignment - 1)
+	if aligned > 0 {
+		if _, err := w.f.Write(w.buf[:aligned]); err != nil {
+			_ = w.f.Close()
+			return errors.Wrap(err, "Write")
+		}
+	}
+
+	if err := w.f.Close(); err != nil {
+		return errors.Wrap(err, "Close")
+	}
+
+	if aligned == len(w.buf) {
+		return nil
+	}
+
+	// write the rest without O_DIRECT
+	f, err := fs.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "OpenFile")
+	}
+
+	if _, err = f.Write(w.buf[aligned:]); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "Write")
+	}
+
+	return errors.Wrap(f.Close(), "Close")
+}
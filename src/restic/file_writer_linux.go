@@ -0,0 +1,29 @@
+package restic
+
+import (
+	"os"
+	"syscall"
+)
+
+const oDirect = syscall.O_DIRECT
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, the file size is not changed.
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes for the file f.
+func preallocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+}
+
+// ficlone is the ioctl FICLONE.
+const ficlone = 0x40049409
+
+// reflink makes dst share the data of src, which is supported e.g. by btrfs
+// and XFS.
+func reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
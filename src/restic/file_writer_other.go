@@ -0,0 +1,22 @@
+// +build !linux
+
+package restic
+
+import (
+	"os"
+
+	"restic/errors"
+)
+
+// oDirect is not available, direct I/O only collects data in large buffers.
+const oDirect = 0
+
+// preallocate is not supported on this platform.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
+
+// reflink is not supported on this platform.
+func reflink(dst, src *os.File) error {
+	return errors.New("reflinks are not supported")
+}
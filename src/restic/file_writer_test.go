@@ -0,0 +1,93 @@
+package restic
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"restic/fs"
+	. "restic/test"
+)
+
+func TestFileWriter(t *testing.T) {
+	dir, cleanup := TempDir(t)
+	defer cleanup()
+
+	var tests = []struct {
+		size int
+		opts FileWriteOptions
+	}{
+		{0, FileWriteOptions{}},
+		{5000, FileWriteOptions{}},
+		{5000, FileWriteOptions{Preallocate: true}},
+		{0, FileWriteOptions{DirectIO: true}},
+		{directIOAlignment, FileWriteOptions{DirectIO: true}},
+		{3*directIOAlignment + 17, FileWriteOptions{DirectIO: true}},
+		{directIOBufferSize + 4711, FileWriteOptions{DirectIO: true, Preallocate: true}},
+	}
+
+	for i, test := range tests {
+		data := Random(i, test.size)
+		filename := filepath.Join(dir, fmt.Sprintf("file-%d", i))
+
+		w, err := newFileWriter(filename, int64(len(data)), test.opts)
+		OK(t, err)
+
+		// write in chunks which are not aligned
+		for buf := data; len(buf) > 0; {
+			n := 1000
+			if n > len(buf) {
+				n = len(buf)
+			}
+
+			_, err = w.Write(buf[:n])
+			OK(t, err)
+			buf = buf[n:]
+		}
+
+		OK(t, w.Close())
+
+		restored, err := ioutil.ReadFile(filename)
+		OK(t, err)
+		Assert(t, bytes.Equal(data, restored),
+			"test %d: restored file has wrong content (%d bytes, want %d)", i, len(restored), len(data))
+	}
+}
+
+func TestFileWriterSparse(t *testing.T) {
+	dir, cleanup := TempDir(t)
+	defer cleanup()
+
+	// zeros in the middle and at the end of the file
+	data := make([]byte, 5*65536)
+	copy(data, Random(23, 65536))
+	copy(data[3*65536:], Random(42, 1000))
+
+	filename := filepath.Join(dir, "file")
+	w, err := newFileWriter(filename, int64(len(data)), FileWriteOptions{Sparse: true, Preallocate: true})
+	OK(t, err)
+
+	for buf := data; len(buf) > 0; buf = buf[65536:] {
+		_, err = w.Write(buf[:65536])
+		OK(t, err)
+	}
+	OK(t, w.Close())
+
+	restored, err := ioutil.ReadFile(filename)
+	OK(t, err)
+	Assert(t, bytes.Equal(data, restored),
+		"restored file has wrong content (%d bytes, want %d)", len(restored), len(data))
+
+	f, err := fs.Open(filename)
+	OK(t, err)
+	holes, err := fs.HasHoles(f)
+	OK(t, err)
+	OK(t, f.Close())
+
+	if runtime.GOOS == "linux" && !holes {
+		t.Logf("no holes found in %v, the file system may not support them", filename)
+	}
+}
@@ -2,4 +2,8 @@
 // in contrast to filepath.Glob a pattern may specify directories.
 //
 // For a list of valid patterns please see the documentation on filepath.Glob.
+// In addition, '**' matches any number of directories, braces like '{a,b}'
+// are expanded and named character classes like '[:alpha:]' may be used
+// within brackets. A pattern starting with a path separator is anchored at
+// the root, other patterns match anywhere in a path.
 package filter
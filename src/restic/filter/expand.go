@@ -0,0 +1,208 @@
+package filter
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"restic/errors"
+)
+
+// escapes is true if a backslash escapes the next character in a pattern,
+// which is not the case on Windows where it is the path separator.
+const escapes = filepath.Separator != '\\'
+
+// skipBracket returns the index of the ']' which closes the bracket
+// expression starting at pattern[i], or i if it is not closed.
+func skipBracket(pattern string, i int) int {
+	for j := i + 1; j < len(pattern); j++ {
+		switch {
+		case pattern[j] == '\\' && escapes:
+			j++
+		case pattern[j] == '[' && strings.HasPrefix(pattern[j:], "[:"):
+			if end := strings.Index(pattern[j+2:], ":]"); end >= 0 {
+				j += end + 3
+			}
+		case pattern[j] == ']':
+			return j
+		}
+	}
+
+	return i
+}
+
+// findBraces returns the positions of the first '{' which is closed by a
+// matching '}' and contains at least one ',' on the same level, together with
+// the positions of these commas. If there is no such group, start is -1.
+func findBraces(pattern string) (start, end int, commas []int) {
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '\\' && escapes:
+			i++
+		case pattern[i] == '[':
+			i = skipBracket(pattern, i)
+		case pattern[i] == '{':
+			depth := 0
+			commas = commas[:0]
+		inner:
+			for j := i + 1; j < len(pattern); j++ {
+				switch {
+				case pattern[j] == '\\' && escapes:
+					j++
+				case pattern[j] == '[':
+					j = skipBracket(pattern, j)
+				case pattern[j] == '{':
+					depth++
+				case pattern[j] == ',' && depth == 0:
+					commas = append(commas, j)
+				case pattern[j] == '}':
+					if depth > 0 {
+						depth--
+						continue
+					}
+
+					if len(commas) > 0 {
+						return i, j, commas
+					}
+					break inner
+				}
+			}
+		}
+	}
+
+	return -1, -1, nil
+}
+
+// SplitPatterns splits a comma separated list of patterns. Commas within
+// braces or brackets and escaped commas are part of the pattern, so that
+// "*.{tmp,bak},*.o" yields the two patterns "*.{tmp,bak}" and "*.o". Empty
+// patterns are dropped.
+func SplitPatterns(list string) []string {
+	var patterns []string
+	depth, begin := 0, 0
+	for i := 0; i < len(list); i++ {
+		switch {
+		case list[i] == '\\' && escapes:
+			i++
+		case list[i] == '[':
+			i = skipBracket(list, i)
+		case list[i] == '{':
+			depth++
+		case list[i] == '}' && depth > 0:
+			depth--
+		case list[i] == ',' && depth == 0:
+			if i > begin {
+				patterns = append(patterns, list[begin:i])
+			}
+			begin = i + 1
+		}
+	}
+
+	if begin < len(list) {
+		patterns = append(patterns, list[begin:])
+	}
+
+	return patterns
+}
+
+// expandBraces returns all patterns described by pattern, like a shell does
+// for '{a,b}'. Braces which are not closed or which do not contain a comma
+// are kept.
+func expandBraces(pattern string) []string {
+	start, end, commas := findBraces(pattern)
+	if start < 0 {
+		return []string{pattern}
+	}
+
+	prefix, suffix := pattern[:start], pattern[end+1:]
+
+	var result []string
+	seen := make(map[string]struct{})
+	begin := start + 1
+	for _, pos := range append(commas, end) {
+		for _, p := range expandBraces(prefix + pattern[begin:pos] + suffix) {
+			if _, ok := seen[p]; ok {
+				continue
+			}
+			seen[p] = struct{}{}
+			result = append(result, p)
+		}
+		begin = pos + 1
+	}
+
+	return result
+}
+
+// characterClasses are the named classes which can be used within brackets.
+var characterClasses = map[string]string{
+	"alnum":  "a-zA-Z0-9",
+	"alpha":  "a-zA-Z",
+	"blank":  " \t",
+	"digit":  "0-9",
+	"lower":  "a-z",
+	"space":  " \t\n\v\f\r",
+	"upper":  "A-Z",
+	"xdigit": "0-9a-fA-F",
+}
+
+// translateClasses replaces named character classes like '[:digit:]' within
+// brackets by the characters they stand for, and '[!' by '[^', so that the
+// pattern can be used with filepath.Match.
+func translateClasses(pattern string) (string, error) {
+	if !strings.Contains(pattern, "[") {
+		return pattern, nil
+	}
+
+	var buf []byte
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && escapes && i+1 < len(pattern):
+			buf = append(buf, c, pattern[i+1])
+			i++
+			continue
+		case c != '[':
+			buf = append(buf, c)
+			continue
+		}
+
+		buf = append(buf, '[')
+		if i+1 < len(pattern) && pattern[i+1] == '!' {
+			buf = append(buf, '^')
+			i++
+		}
+
+		for i++; i < len(pattern); i++ {
+			c = pattern[i]
+			if c == '\\' && escapes && i+1 < len(pattern) {
+				buf = append(buf, c, pattern[i+1])
+				i++
+				continue
+			}
+
+			if strings.HasPrefix(pattern[i:], "[:") {
+				end := strings.Index(pattern[i+2:], ":]")
+				if end < 0 {
+					return "", errors.Wrap(filepath.ErrBadPattern, "unterminated character class")
+				}
+
+				name := pattern[i+2 : i+2+end]
+				chars, ok := characterClasses[name]
+				if !ok {
+					return "", errors.Wrap(filepath.ErrBadPattern, fmt.Sprintf("unknown character class %q", name))
+				}
+
+				buf = append(buf, chars...)
+				i += end + 3
+				continue
+			}
+
+			buf = append(buf, c)
+			if c == ']' {
+				break
+			}
+		}
+	}
+
+	return string(buf), nil
+}
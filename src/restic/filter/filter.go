@@ -11,18 +11,97 @@ import (
 // second argument.
 var ErrBadString = errors.New("filter.Match: string is empty")
 
-// Match returns true if str matches the pattern. When the pattern is
-// malformed, filepath.ErrBadPattern is returned. The empty pattern matches
-// everything, when str is the empty string ErrBadString is returned.
-//
-// Pattern can be a combination of patterns suitable for filepath.Match, joined
-// by filepath.Separator.
-func Match(pattern, str string) (matched bool, err error) {
+// Pattern is a parsed pattern, it can be used to match many strings without
+// parsing the pattern again.
+type Pattern struct {
+	original     string
+	alternatives [][]string
+}
+
+// ParsePattern parses pattern, braces are expanded and the character classes
+// are checked. When the pattern is malformed, an error wrapping
+// filepath.ErrBadPattern is returned. The empty pattern matches everything.
+func ParsePattern(pattern string) (Pattern, error) {
+	p := Pattern{original: pattern}
 	if pattern == "" {
-		return true, nil
+		return p, nil
+	}
+
+	for _, alt := range expandBraces(pattern) {
+		if alt == "" {
+			continue
+		}
+
+		alt, err := translateClasses(filepath.Clean(alt))
+		if err != nil {
+			return Pattern{}, err
+		}
+
+		// convert file path separator to '/'
+		if filepath.Separator != '/' {
+			alt = strings.Replace(alt, string(filepath.Separator), "/", -1)
+		}
+
+		parts := strings.Split(alt, "/")
+		for _, part := range parts {
+			if _, err := filepath.Match(part, ""); err != nil {
+				return Pattern{}, err
+			}
+		}
+
+		p.alternatives = append(p.alternatives, parts)
+	}
+
+	return p, nil
+}
+
+// ParsePatterns parses all patterns, empty patterns are ignored.
+func ParsePatterns(patterns []string) ([]Pattern, error) {
+	var list []Pattern
+	for _, pat := range patterns {
+		if pat == "" {
+			continue
+		}
+
+		p, err := ParsePattern(pat)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, p)
+	}
+
+	return list, nil
+}
+
+// String returns the pattern as it was passed to ParsePattern.
+func (p Pattern) String() string {
+	return p.original
+}
+
+// Anchored returns true if the pattern starts at the root of the file system
+// and therefore only matches paths below the root, instead of matching
+// anywhere in a path.
+func (p Pattern) Anchored() bool {
+	if len(p.alternatives) == 0 {
+		return false
 	}
 
-	pattern = filepath.Clean(pattern)
+	for _, parts := range p.alternatives {
+		if parts[0] != "" && filepath.VolumeName(parts[0]) == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Match returns true if str matches the pattern, when str is the empty string
+// ErrBadString is returned.
+func (p Pattern) Match(str string) (matched bool, err error) {
+	if p.original == "" {
+		return true, nil
+	}
 
 	if str == "" {
 		return false, ErrBadString
@@ -30,14 +109,38 @@ func Match(pattern, str string) (matched bool, err error) {
 
 	// convert file path separator to '/'
 	if filepath.Separator != '/' {
-		pattern = strings.Replace(pattern, string(filepath.Separator), "/", -1)
 		str = strings.Replace(str, string(filepath.Separator), "/", -1)
 	}
 
-	patterns := strings.Split(pattern, "/")
 	strs := strings.Split(str, "/")
+	for _, patterns := range p.alternatives {
+		matched, err = match(patterns, strs)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+
+	return false, nil
+}
+
+// Match returns true if str matches the pattern. When the pattern is
+// malformed, an error wrapping filepath.ErrBadPattern is returned. The empty
+// pattern matches everything, when str is the empty string ErrBadString is
+// returned.
+//
+// Pattern can be a combination of patterns suitable for filepath.Match, joined
+// by filepath.Separator. In addition, '**' matches any number of directories,
+// '{a,b}' matches either 'a' or 'b', character classes like '[[:digit:]]' can
+// be used within brackets and '[!...]' is the same as '[^...]'. A pattern
+// which starts with a separator is anchored at the root, all other patterns
+// may match anywhere in str.
+func Match(pattern, str string) (matched bool, err error) {
+	p, err := ParsePattern(pattern)
+	if err != nil {
+		return false, err
+	}
 
-	return match(patterns, strs)
+	return p.Match(str)
 }
 
 func hasDoubleWildcard(list []string) (ok bool, pos int) {
@@ -120,3 +223,19 @@ func List(patterns []string, str string) (matched bool, err error) {
 
 	return false, nil
 }
+
+// ListPatterns returns true if str matches one of the parsed patterns.
+func ListPatterns(patterns []Pattern, str string) (matched bool, err error) {
+	for _, p := range patterns {
+		matched, err = p.Match(str)
+		if err != nil {
+			return false, err
+		}
+
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
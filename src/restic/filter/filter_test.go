@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -89,6 +90,28 @@ var matchTests = []struct {
 	{"c:/foo/", "c:/foo/bar", true},
 	{"c:/foo/*/test.*", "c:/foo/bar/test.go", true},
 	{"c:/foo/*/bar/test.*", "c:/foo/bar/test.go", false},
+	{"**/test.go", "/foo/bar/test.go", true},
+	{"/foo/**", "/foo/bar/test.go", true},
+	{"/foo/**", "/bar/foo/test.go", false},
+	{"*.{go,c}", "/foo/bar/test.go", true},
+	{"*.{go,c}", "/foo/bar/test.c", true},
+	{"*.{go,c}", "/foo/bar/test.h", false},
+	{"/{foo,bar}/bar/*.go", "/foo/bar/test.go", true},
+	{"/{foo,bar}/bar/*.go", "/bar/bar/test.go", true},
+	{"/{foo,baz/x}/bar", "/baz/x/bar/test.go", true},
+	{"test{,.go}", "/foo/bar/test.go", true},
+	{"{a,b{c,d}}.go", "/foo/bd.go", true},
+	{"{a,b{c,d}}.go", "/foo/b.go", false},
+	{"{foo}", "/foo", false},
+	{"{foo}", "/{foo}", true},
+	{"{foo", "/{foo", true},
+	{"[[:digit:]]*.go", "/foo/1test.go", true},
+	{"[[:digit:]]*.go", "/foo/test.go", false},
+	{"[[:upper:][:digit:]]*", "/foo/Test.go", true},
+	{"[![:upper:]]*", "/foo/Test.go", true},
+	{"/foo/[!b]*", "/foo/bar/test.go", false},
+	{"/foo/[!x]*", "/foo/bar/test.go", true},
+	{"[{,}]", "/foo/,", true},
 }
 
 func testpattern(t *testing.T, pattern, path string, shouldMatch bool) {
@@ -124,6 +147,69 @@ func TestMatch(t *testing.T) {
 	}
 }
 
+var invalidPatterns = []string{
+	"[",
+	"foo/[a-",
+	"[[:word:]]",
+	"[[:digit]",
+	"{foo,[}",
+}
+
+func TestParsePatternInvalid(t *testing.T) {
+	for _, pattern := range invalidPatterns {
+		if _, err := filter.ParsePattern(pattern); err == nil {
+			t.Errorf("pattern %q: expected error, got nil", pattern)
+		}
+	}
+}
+
+var splitTests = []struct {
+	list     string
+	patterns []string
+}{
+	{"", nil},
+	{"*.go", []string{"*.go"}},
+	{"*.go,*.c", []string{"*.go", "*.c"}},
+	{"*.{tmp,bak},*.o", []string{"*.{tmp,bak}", "*.o"}},
+	{"{a,b{c,d}},e", []string{"{a,b{c,d}}", "e"}},
+	{"foo[,]bar,baz", []string{"foo[,]bar", "baz"}},
+	{",foo,,bar,", []string{"foo", "bar"}},
+}
+
+func TestSplitPatterns(t *testing.T) {
+	for _, test := range splitTests {
+		patterns := filter.SplitPatterns(test.list)
+		if !reflect.DeepEqual(patterns, test.patterns) {
+			t.Errorf("SplitPatterns(%q): want %q, got %q", test.list, test.patterns, patterns)
+		}
+	}
+}
+
+var anchoredTests = []struct {
+	pattern  string
+	anchored bool
+}{
+	{"", false},
+	{"/foo", true},
+	{"foo", false},
+	{"**/foo", false},
+	{"/{foo,bar}", true},
+	{"{/foo,bar}", false},
+}
+
+func TestPatternAnchored(t *testing.T) {
+	for _, test := range anchoredTests {
+		p, err := filter.ParsePattern(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Anchored() != test.anchored {
+			t.Errorf("pattern %q: expected anchored %v, got %v", test.pattern, test.anchored, p.Anchored())
+		}
+	}
+}
+
 func ExampleMatch() {
 	match, _ := filter.Match("*.go", "/home/user/file.go")
 	fmt.Printf("match: %v\n", match)
@@ -171,6 +257,28 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestListPatterns(t *testing.T) {
+	for i, test := range filterListTests {
+		patterns, err := filter.ParsePatterns(test.patterns)
+		if err != nil {
+			t.Errorf("test %d: parsing patterns %q failed: %v", i, test.patterns, err)
+			continue
+		}
+
+		match, err := filter.ListPatterns(patterns, test.path)
+		if err != nil {
+			t.Errorf("test %d failed: expected no error for patterns %q, but error returned: %v",
+				i, test.patterns, err)
+			continue
+		}
+
+		if match != test.match {
+			t.Errorf("test %d: filter.ListPatterns(%q, %q): expected %v, got %v",
+				i, test.patterns, test.path, test.match, match)
+		}
+	}
+}
+
 func ExampleList() {
 	match, _ := filter.List([]string{"*.c", "*.go"}, "/home/user/file.go")
 	fmt.Printf("match: %v\n", match)
@@ -16,6 +16,9 @@ func FindUsedBlobs(ctx context.Context, repo Repository, treeID ID, blobs BlobSe
 	for _, node := range tree.Nodes {
 		switch node.Type {
 		case "file":
+			if node.ContentList != nil {
+				blobs.Insert(BlobHandle{ID: *node.ContentList, Type: TreeBlob})
+			}
 			for _, blob := range node.Content {
 				blobs.Insert(BlobHandle{ID: blob, Type: DataBlob})
 			}
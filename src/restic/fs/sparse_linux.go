@@ -0,0 +1,32 @@
+package fs
+
+import (
+	"io"
+
+	"restic/errors"
+)
+
+// seekHole is SEEK_HOLE, Seek moves to the start of the next hole.
+const seekHole = 4
+
+// HasHoles returns true if the file f contains holes, i.e. ranges which have
+// never been written and do not take up space on disk, they are read as
+// zeros. Afterwards, f is positioned at the start.
+func HasHoles(f File) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, "Stat")
+	}
+
+	off, err := f.Seek(0, seekHole)
+	if err != nil {
+		// the file system does not support SEEK_HOLE
+		off = fi.Size()
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return false, errors.Wrap(err, "Seek")
+	}
+
+	return off < fi.Size(), nil
+}
@@ -0,0 +1,72 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHasHoles(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "restic-test-sparse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	filename := filepath.Join(tempdir, "file")
+	if err = ioutil.WriteFile(filename, make([]byte, 1024*1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sparse := filepath.Join(tempdir, "sparse")
+	f, err := os.Create(sparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("foo"), 1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		filename string
+		holes    bool
+	}{
+		{filename, false},
+		{sparse, true},
+	}
+
+	for _, test := range tests {
+		f, err := Open(test.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		holes, err := HasHoles(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.holes && !holes {
+			f.Close()
+			t.Skipf("file system of %v does not support holes", tempdir)
+		}
+
+		if holes != test.holes {
+			t.Errorf("HasHoles(%v): want %v, got %v", test.filename, test.holes, holes)
+		}
+
+		// the file must be positioned at the start again
+		buf := make([]byte, 1)
+		if n, err := f.Read(buf); n != 1 || err != nil {
+			t.Errorf("unable to read %v after HasHoles: %v", test.filename, err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
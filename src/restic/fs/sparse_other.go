@@ -0,0 +1,8 @@
+// +build !linux
+
+package fs
+
+// HasHoles returns false, holes are only detected on Linux.
+func HasHoles(f File) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,134 @@
+package fs
+
+import (
+	"sort"
+	"strings"
+)
+
+// VSSSnapshot is a Volume Shadow Copy of a volume on Windows. Files are read
+// from it as they were when it was created, even if they are opened
+// exclusively by other programs.
+type VSSSnapshot struct {
+	// Volume is the volume name, e.g. "C:".
+	Volume string
+
+	// ID identifies the shadow copy, DeviceObject is the path of the device
+	// under which its files can be accessed, e.g.
+	// `\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy5`.
+	ID           string
+	DeviceObject string
+}
+
+// VSSSnapshots are the shadow copies of all volumes a backup reads from,
+// indexed by the upper-case volume name.
+type VSSSnapshots map[string]*VSSSnapshot
+
+// volumeName returns the volume name of a path with a drive letter, e.g. "C:"
+// for `C:\Users`. Other paths, e.g. UNC paths, are not supported by shadow
+// copies, for them the empty string is returned.
+func volumeName(path string) string {
+	if len(path) < 2 || path[1] != ':' {
+		return ""
+	}
+
+	c := path[0] | 0x20
+	if c < 'a' || c > 'z' {
+		return ""
+	}
+
+	return strings.ToUpper(path[:2])
+}
+
+// Volumes returns the volumes of paths which need a shadow copy, sorted by
+// name. Paths without a drive letter are ignored.
+func Volumes(paths []string) []string {
+	seen := make(map[string]struct{})
+	var list []string
+	for _, p := range paths {
+		vol := volumeName(p)
+		if vol == "" {
+			continue
+		}
+
+		if _, ok := seen[vol]; !ok {
+			seen[vol] = struct{}{}
+			list = append(list, vol)
+		}
+	}
+
+	sort.Strings(list)
+	return list
+}
+
+// Path returns the path under which the file at path is read from the shadow
+// copy of its volume. If there is none, path is returned unchanged.
+func (s VSSSnapshots) Path(path string) string {
+	sn, ok := s[volumeName(path)]
+	if !ok {
+		return path
+	}
+
+	rest := path[2:]
+	if rest == "" {
+		rest = `\`
+	}
+	return sn.DeviceObject + rest
+}
+
+// OriginalPath reverses Path, it returns the path of the file in the original
+// volume for a path in one of the shadow copies.
+func (s VSSSnapshots) OriginalPath(path string) string {
+	for vol, sn := range s {
+		if !strings.HasPrefix(path, sn.DeviceObject) {
+			continue
+		}
+
+		rest := path[len(sn.DeviceObject):]
+		if rest != "" && rest[0] != '\\' {
+			// a different device, e.g. ShadowCopy12 for ShadowCopy1
+			continue
+		}
+
+		if rest == "" {
+			rest = `\`
+		}
+		return vol + rest
+	}
+
+	return path
+}
+
+// Delete removes all shadow copies. Those which have been removed are dropped
+// from s, so Delete can be called again after an error.
+func (s VSSSnapshots) Delete() error {
+	var firstErr error
+	for vol, sn := range s {
+		if err := deleteVSSSnapshot(sn); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		delete(s, vol)
+	}
+
+	return firstErr
+}
+
+// NewVSSSnapshots creates a shadow copy for each of the volumes, which are
+// volume names like "C:". If one of them cannot be created, the ones created
+// before are removed again.
+func NewVSSSnapshots(volumes []string) (VSSSnapshots, error) {
+	s := make(VSSSnapshots)
+	for _, vol := range volumes {
+		sn, err := newVSSSnapshot(vol)
+		if err != nil {
+			_ = s.Delete()
+			return nil, err
+		}
+
+		s[strings.ToUpper(vol)] = sn
+	}
+
+	return s, nil
+}
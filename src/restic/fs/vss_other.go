@@ -0,0 +1,15 @@
+// +build !windows
+
+package fs
+
+import "restic/errors"
+
+// newVSSSnapshot returns an error, shadow copies only exist on Windows.
+func newVSSSnapshot(vol string) (*VSSSnapshot, error) {
+	return nil, errors.New("Volume Shadow Copies are only supported on Windows")
+}
+
+// deleteVSSSnapshot does nothing, as no shadow copies can be created.
+func deleteVSSSnapshot(sn *VSSSnapshot) error {
+	return nil
+}
@@ -0,0 +1,44 @@
+package fs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVSSSnapshotsPath(t *testing.T) {
+	s := VSSSnapshots{
+		"C:": &VSSSnapshot{Volume: "C:", DeviceObject: `\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy1`},
+		"D:": &VSSSnapshot{Volume: "D:", DeviceObject: `\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy12`},
+	}
+
+	var tests = []struct {
+		path, shadow string
+	}{
+		{`C:\Users\foo`, `\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy1\Users\foo`},
+		{`c:\Users\foo`, `\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy1\Users\foo`},
+		{`C:\`, `\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy1\`},
+		{`D:\data`, `\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy12\data`},
+		{`E:\data`, `E:\data`},
+		{`\\server\share\data`, `\\server\share\data`},
+	}
+
+	for _, test := range tests {
+		if p := s.Path(test.path); p != test.shadow {
+			t.Errorf("Path(%q): want %q, got %q", test.path, test.shadow, p)
+		}
+
+		orig := s.OriginalPath(test.shadow)
+		if volumeName(test.path) == "C:" || volumeName(test.path) == "D:" {
+			if orig != volumeName(test.path)+test.path[2:] {
+				t.Errorf("OriginalPath(%q): want %q, got %q", test.shadow, test.path, orig)
+			}
+		} else if orig != test.path {
+			t.Errorf("OriginalPath(%q): want %q, got %q", test.shadow, test.path, orig)
+		}
+	}
+
+	want := []string{"C:", "D:"}
+	if vols := Volumes([]string{`d:\x`, `C:\y`, `D:\z`, `\\server\share`}); !reflect.DeepEqual(vols, want) {
+		t.Errorf("wrong volumes, want %v, got %v", want, vols)
+	}
+}
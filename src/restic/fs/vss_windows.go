@@ -0,0 +1,79 @@
+// +build windows
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"restic/debug"
+	"restic/errors"
+)
+
+// runPowerShell runs script with PowerShell and returns the lines it prints.
+func runPowerShell(script string) ([]string, error) {
+	cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return nil, errors.Wrap(err, "powershell")
+		}
+		return nil, errors.Errorf("powershell: %v: %s", err, msg)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// newVSSSnapshot creates a shadow copy of the volume vol with the WMI class
+// Win32_ShadowCopy, this requires administrator privileges.
+func newVSSSnapshot(vol string) (*VSSSnapshot, error) {
+	script := fmt.Sprintf(`$ErrorActionPreference = 'Stop'
+$r = (Get-WmiObject -List Win32_ShadowCopy).Create('%s\', 'ClientAccessible')
+if ($r.ReturnValue -ne 0) { throw "Win32_ShadowCopy.Create returned $($r.ReturnValue)" }
+$s = Get-WmiObject Win32_ShadowCopy | Where-Object { $_.ID -eq $r.ShadowID }
+Write-Output $s.ID
+Write-Output $s.DeviceObject`, vol)
+
+	lines, err := runPowerShell(script)
+	if err != nil {
+		return nil, errors.Errorf("unable to create shadow copy of %v: %v", vol, err)
+	}
+
+	if len(lines) != 2 {
+		return nil, errors.Errorf("unable to create shadow copy of %v: unexpected output %q", vol, lines)
+	}
+
+	sn := &VSSSnapshot{
+		Volume:       vol,
+		ID:           lines[0],
+		DeviceObject: lines[1],
+	}
+	debug.Log("created shadow copy %v of %v at %v", sn.ID, vol, sn.DeviceObject)
+	return sn, nil
+}
+
+// deleteVSSSnapshot removes the shadow copy sn.
+func deleteVSSSnapshot(sn *VSSSnapshot) error {
+	script := fmt.Sprintf(`$ErrorActionPreference = 'Stop'
+Get-WmiObject Win32_ShadowCopy | Where-Object { $_.ID -eq '%s' } | ForEach-Object { $_.Delete() }`, sn.ID)
+
+	if _, err := runPowerShell(script); err != nil {
+		return errors.Errorf("unable to remove shadow copy %v of %v: %v", sn.ID, sn.Volume, err)
+	}
+
+	debug.Log("removed shadow copy %v of %v", sn.ID, sn.Volume)
+	return nil
+}
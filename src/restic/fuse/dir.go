@@ -12,11 +12,14 @@ import (
 
 	"restic"
 	"restic/debug"
+	"restic/walk"
 )
 
 // Statically ensure that *dir implement those interface
 var _ = fs.HandleReadDirAller(&dir{})
 var _ = fs.NodeStringLookuper(&dir{})
+var _ = fs.NodeListxattrer(&dir{})
+var _ = fs.NodeGetxattrer(&dir{})
 
 type dir struct {
 	repo        restic.Repository
@@ -26,15 +29,20 @@ type dir struct {
 	ownerIsRoot bool
 
 	blobsize *BlobSizeCache
+	trees    *walk.Prefetcher
 }
 
-func newDir(ctx context.Context, repo restic.Repository, node *restic.Node, ownerIsRoot bool, blobsize *BlobSizeCache) (*dir, error) {
+func newDir(ctx context.Context, repo restic.Repository, node *restic.Node, ownerIsRoot bool, blobsize *BlobSizeCache, trees *walk.Prefetcher) (*dir, error) {
 	debug.Log("new dir for %v (%v)", node.Name, node.Subtree.Str())
-	tree, err := repo.LoadTree(ctx, *node.Subtree)
+	tree, err := trees.LoadTree(ctx, *node.Subtree)
 	if err != nil {
 		debug.Log("  error loading tree %v: %v", node.Subtree.Str(), err)
 		return nil, err
 	}
+
+	// the subdirectories are likely to be opened next
+	trees.PrefetchSubtrees(tree)
+
 	items := make(map[string]*restic.Node)
 	for _, node := range tree.Nodes {
 		items[node.Name] = node
@@ -47,12 +55,13 @@ func newDir(ctx context.Context, repo restic.Repository, node *restic.Node, owne
 		inode:       node.Inode,
 		ownerIsRoot: ownerIsRoot,
 		blobsize:    blobsize,
+		trees:       trees,
 	}, nil
 }
 
 // replaceSpecialNodes replaces nodes with name "." and "/" by their contents.
 // Otherwise, the node is returned.
-func replaceSpecialNodes(ctx context.Context, repo restic.Repository, node *restic.Node) ([]*restic.Node, error) {
+func replaceSpecialNodes(ctx context.Context, trees *walk.Prefetcher, node *restic.Node) ([]*restic.Node, error) {
 	if node.Type != "dir" || node.Subtree == nil {
 		return []*restic.Node{node}, nil
 	}
@@ -61,7 +70,7 @@ func replaceSpecialNodes(ctx context.Context, repo restic.Repository, node *rest
 		return []*restic.Node{node}, nil
 	}
 
-	tree, err := repo.LoadTree(ctx, *node.Subtree)
+	tree, err := trees.LoadTree(ctx, *node.Subtree)
 	if err != nil {
 		return nil, err
 	}
@@ -69,16 +78,16 @@ func replaceSpecialNodes(ctx context.Context, repo restic.Repository, node *rest
 	return tree.Nodes, nil
 }
 
-func newDirFromSnapshot(ctx context.Context, repo restic.Repository, snapshot SnapshotWithId, ownerIsRoot bool, blobsize *BlobSizeCache) (*dir, error) {
+func newDirFromSnapshot(ctx context.Context, repo restic.Repository, snapshot SnapshotWithId, ownerIsRoot bool, blobsize *BlobSizeCache, trees *walk.Prefetcher) (*dir, error) {
 	debug.Log("new dir for snapshot %v (%v)", snapshot.ID.Str(), snapshot.Tree.Str())
-	tree, err := repo.LoadTree(ctx, *snapshot.Tree)
+	tree, err := trees.LoadTree(ctx, *snapshot.Tree)
 	if err != nil {
 		debug.Log("  loadTree(%v) failed: %v", snapshot.ID.Str(), err)
 		return nil, err
 	}
 	items := make(map[string]*restic.Node)
 	for _, n := range tree.Nodes {
-		nodes, err := replaceSpecialNodes(ctx, repo, n)
+		nodes, err := replaceSpecialNodes(ctx, trees, n)
 		if err != nil {
 			debug.Log("  replaceSpecialNodes(%v) failed: %v", n, err)
 			return nil, err
@@ -86,6 +95,9 @@ func newDirFromSnapshot(ctx context.Context, repo restic.Repository, snapshot Sn
 
 		for _, node := range nodes {
 			items[node.Name] = node
+			if node.Type == "dir" && node.Subtree != nil {
+				trees.Prefetch(*node.Subtree)
+			}
 		}
 	}
 
@@ -103,6 +115,7 @@ func newDirFromSnapshot(ctx context.Context, repo restic.Repository, snapshot Sn
 		inode:       inodeFromBackendID(snapshot.ID),
 		ownerIsRoot: ownerIsRoot,
 		blobsize:    blobsize,
+		trees:       trees,
 	}, nil
 }
 
@@ -171,7 +184,7 @@ func (d *dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	}
 	switch node.Type {
 	case "dir":
-		return newDir(ctx, d.repo, node, d.ownerIsRoot, d.blobsize)
+		return newDir(ctx, d.repo, node, d.ownerIsRoot, d.blobsize, d.trees)
 	case "file":
 		return newFile(d.repo, node, d.ownerIsRoot, d.blobsize)
 	case "symlink":
@@ -183,19 +196,10 @@ func (d *dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 }
 
 func (d *dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
-	debug.Log("Listxattr(%v, %v)", d.node.Name, req.Size)
-	for _, attr := range d.node.ExtendedAttributes {
-		resp.Append(attr.Name)
-	}
+	listxattr(d.node, resp)
 	return nil
 }
 
 func (d *dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
-	debug.Log("Getxattr(%v, %v, %v)", d.node.Name, req.Name, req.Size)
-	attrval := d.node.GetExtendedAttribute(req.Name)
-	if attrval != nil {
-		resp.Xattr = attrval
-		return nil
-	}
-	return fuse.ErrNoXattr
+	return getxattr(d.node, req, resp)
 }
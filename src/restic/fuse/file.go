@@ -22,6 +22,8 @@ const blockSize = 512
 // Statically ensure that *file implements the given interface
 var _ = fs.HandleReader(&file{})
 var _ = fs.HandleReleaser(&file{})
+var _ = fs.NodeListxattrer(&file{})
+var _ = fs.NodeGetxattrer(&file{})
 
 // BlobLoader is an abstracted repository with a reduced set of methods used
 // for fuse operations.
@@ -171,19 +173,10 @@ func (f *file) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 }
 
 func (f *file) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
-	debug.Log("Listxattr(%v, %v)", f.node.Name, req.Size)
-	for _, attr := range f.node.ExtendedAttributes {
-		resp.Append(attr.Name)
-	}
+	listxattr(f.node, resp)
 	return nil
 }
 
 func (f *file) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
-	debug.Log("Getxattr(%v, %v, %v)", f.node.Name, req.Name, req.Size)
-	attrval := f.node.GetExtendedAttribute(req.Name)
-	if attrval != nil {
-		resp.Xattr = attrval
-		return nil
-	}
-	return fuse.ErrNoXattr
+	return getxattr(f.node, req, resp)
 }
@@ -135,3 +135,44 @@ func TestFuseFile(t *testing.T) {
 
 	OK(t, f.Release(ctx, nil))
 }
+
+func TestFuseXattr(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acl := []byte{2, 0, 0, 0, 1, 0, 6, 0, 0xff, 0xff, 0xff, 0xff}
+	node := &restic.Node{
+		Name: "foo",
+		ExtendedAttributes: []restic.ExtendedAttribute{
+			{Name: "user.comment", Value: []byte("hello")},
+			{Name: "user.empty", Value: []byte{}},
+			{Name: "system.posix_acl_access", Value: acl},
+		},
+	}
+
+	f, err := newFile(nil, node, false, nil)
+	OK(t, err)
+
+	list := &fuse.ListxattrResponse{}
+	OK(t, f.Listxattr(ctx, &fuse.ListxattrRequest{}, list))
+	Equals(t, "user.comment\x00user.empty\x00system.posix_acl_access\x00", string(list.Xattr))
+
+	var tests = []struct {
+		name  string
+		value []byte
+	}{
+		{"user.comment", []byte("hello")},
+		{"user.empty", []byte{}},
+		{"system.posix_acl_access", acl},
+	}
+
+	for _, test := range tests {
+		resp := &fuse.GetxattrResponse{}
+		OK(t, f.Getxattr(ctx, &fuse.GetxattrRequest{Name: test.name}, resp))
+		Assert(t, bytes.Equal(test.value, resp.Xattr),
+			"wrong value for %v: want %v, got %v", test.name, test.value, resp.Xattr)
+	}
+
+	err = f.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.missing"}, &fuse.GetxattrResponse{})
+	Equals(t, fuse.ErrNoXattr, err)
+}
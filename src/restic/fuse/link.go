@@ -13,6 +13,8 @@ import (
 
 // Statically ensure that *file implements the given interface
 var _ = fs.NodeReadlinker(&link{})
+var _ = fs.NodeListxattrer(&link{})
+var _ = fs.NodeGetxattrer(&link{})
 
 type link struct {
 	node        *restic.Node
@@ -43,3 +45,12 @@ func (l *link) Attr(ctx context.Context, a *fuse.Attr) error {
 
 	return nil
 }
+
+func (l *link) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	listxattr(l.node, resp)
+	return nil
+}
+
+func (l *link) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return getxattr(l.node, req, resp)
+}
@@ -14,7 +14,9 @@ import (
 
 	"restic"
 	"restic/debug"
+	"restic/errors"
 	"restic/repository"
+	"restic/walk"
 
 	"golang.org/x/net/context"
 )
@@ -29,7 +31,7 @@ func NewBlobSizeCache(midx *repository.MasterIndex) *BlobSizeCache {
 	m := make(map[restic.ID]uint, 1000)
 	for _, idx := range midx.All() {
 		for pb := range idx.Each(nil) {
-			m[pb.ID] = pb.Length
+			m[pb.ID] = pb.DataLength()
 		}
 	}
 	return &BlobSizeCache{
@@ -58,6 +60,9 @@ type SnapshotWithId struct {
 var _ = fs.HandleReadDirAller(&SnapshotsDir{})
 var _ = fs.NodeStringLookuper(&SnapshotsDir{})
 
+// prefetchTrees is the number of trees kept in memory for the mount.
+const prefetchTrees = 10000
+
 type SnapshotsDir struct {
 	repo        restic.Repository
 	ownerIsRoot bool
@@ -66,6 +71,7 @@ type SnapshotsDir struct {
 	host        string
 
 	blobsize *BlobSizeCache
+	trees    *walk.Prefetcher
 
 	// knownSnapshots maps snapshot timestamp to the snapshot
 	sync.RWMutex
@@ -85,6 +91,7 @@ func NewSnapshotsDir(repo restic.Repository, ownerIsRoot bool, paths []string, t
 		knownSnapshots: make(map[string]SnapshotWithId),
 		processed:      restic.NewIDSet(),
 		blobsize:       NewBlobSizeCache(repo.Index().(*repository.MasterIndex)),
+		trees:          walk.NewPrefetcher(context.Background(), repo, prefetchTrees),
 	}
 }
 
@@ -113,6 +120,10 @@ func (sn *SnapshotsDir) updateCache(ctx context.Context) error {
 
 		debug.Log("found snapshot id %v", id.Str())
 		snapshot, err := restic.LoadSnapshot(ctx, sn.repo, id)
+		if errors.Code(err) == errors.CodeNoKey {
+			debug.Log("skipping snapshot %v, not readable with the key", id.Str())
+			continue
+		}
 		if err != nil {
 			return err
 		}
@@ -160,6 +171,7 @@ func (sn *SnapshotsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
 	ret := make([]fuse.Dirent, 0)
 	for timestamp, snapshot := range sn.knownSnapshots {
+		sn.trees.Prefetch(*snapshot.Tree)
 		ret = append(ret, fuse.Dirent{
 			Inode: inodeFromBackendID(snapshot.ID),
 			Type:  fuse.DT_Dir,
@@ -190,5 +202,5 @@ func (sn *SnapshotsDir) Lookup(ctx context.Context, name string) (fs.Node, error
 		}
 	}
 
-	return newDirFromSnapshot(ctx, sn.repo, snapshot, sn.ownerIsRoot, sn.blobsize)
+	return newDirFromSnapshot(ctx, sn.repo, snapshot, sn.ownerIsRoot, sn.blobsize, sn.trees)
 }
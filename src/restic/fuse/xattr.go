@@ -0,0 +1,36 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"restic"
+	"restic/debug"
+
+	"bazil.org/fuse"
+)
+
+// listxattr adds the names of all extended attributes stored for node to
+// resp. On Linux, this includes POSIX ACLs (system.posix_acl_access and
+// system.posix_acl_default), so getfacl works on the mounted repository.
+func listxattr(node *restic.Node, resp *fuse.ListxattrResponse) {
+	debug.Log("Listxattr(%v)", node.Name)
+	for _, attr := range node.ExtendedAttributesWithACL() {
+		resp.Append(attr.Name)
+	}
+}
+
+// getxattr returns the value of the extended attribute req.Name of node. An
+// attribute with an empty value is returned as such, only missing attributes
+// are reported as fuse.ErrNoXattr.
+func getxattr(node *restic.Node, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	debug.Log("Getxattr(%v, %v, %v)", node.Name, req.Name, req.Size)
+	for _, attr := range node.ExtendedAttributesWithACL() {
+		if attr.Name == req.Name {
+			resp.Xattr = attr.Value
+			return nil
+		}
+	}
+
+	return fuse.ErrNoXattr
+}
@@ -54,6 +54,16 @@ func (ids IDs) Uniq() (list IDs) {
 	return list
 }
 
+// Key returns a string which identifies the list, e.g. the content of a file.
+// It can be used as a map key.
+func (ids IDs) Key() string {
+	buf := make([]byte, 0, len(ids)*len(ID{}))
+	for _, id := range ids {
+		buf = append(buf, id[:]...)
+	}
+	return string(buf)
+}
+
 type shortID ID
 
 func (id shortID) String() string {
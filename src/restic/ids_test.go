@@ -53,3 +53,18 @@ func TestUniqIDs(t *testing.T) {
 		}
 	}
 }
+
+func TestIDsKey(t *testing.T) {
+	a := TestParseID("7bb086db0d06285d831485da8031281e28336a56baa313539eaea1c73a2a1a40")
+	b := TestParseID("1285b30394f3b74693cc29a758d9624996ae643157776fce8154aabd2f01515f")
+
+	if (IDs{a, b}).Key() != (IDs{a, b}).Key() {
+		t.Errorf("same lists have different keys")
+	}
+
+	for _, ids := range []IDs{{b, a}, {a}, {a, b, a}, nil} {
+		if ids.Key() == (IDs{a, b}).Key() {
+			t.Errorf("list %v has the same key as %v", ids, IDs{a, b})
+		}
+	}
+}
@@ -75,6 +75,9 @@ type blobJSON struct {
 	Type   restic.BlobType `json:"type"`
 	Offset uint            `json:"offset"`
 	Length uint            `json:"length"`
+	Domain string          `json:"domain,omitempty"`
+
+	UncompressedLength uint `json:"uncompressed_length,omitempty"`
 }
 
 type indexJSON struct {
@@ -126,10 +129,12 @@ func Load(ctx context.Context, repo restic.Repository, p *restic.Progress) (*Ind
 			entries := make([]restic.Blob, 0, len(jpack.Blobs))
 			for _, blob := range jpack.Blobs {
 				entry := restic.Blob{
-					ID:     blob.ID,
-					Type:   blob.Type,
-					Offset: blob.Offset,
-					Length: blob.Length,
+					ID:                 blob.ID,
+					Type:               blob.Type,
+					Offset:             blob.Offset,
+					Length:             blob.Length,
+					Domain:             blob.Domain,
+					UncompressedLength: blob.UncompressedLength,
 				}
 				entries = append(entries, entry)
 			}
@@ -265,10 +270,12 @@ func Save(ctx context.Context, repo restic.Repository, packs map[restic.ID][]res
 		b := make([]blobJSON, 0, len(blobs))
 		for _, blob := range blobs {
 			b = append(b, blobJSON{
-				ID:     blob.ID,
-				Type:   blob.Type,
-				Offset: blob.Offset,
-				Length: blob.Length,
+				ID:                 blob.ID,
+				Type:               blob.Type,
+				Offset:             blob.Offset,
+				Length:             blob.Length,
+				Domain:             blob.Domain,
+				UncompressedLength: blob.UncompressedLength,
 			})
 		}
 
@@ -0,0 +1,391 @@
+package index
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"restic"
+	"restic/debug"
+	"restic/errors"
+	"restic/fs"
+	"restic/list"
+	"restic/worker"
+	"sort"
+)
+
+// packListEntry is the part of a pack which is kept in memory.
+type packListEntry struct {
+	size   int64
+	offset int64 // offset of the blobs in the file
+	count  int
+}
+
+const (
+	// packListHeaderSize is the size of the header in front of the blobs of
+	// a pack in the file: ID and number of blobs
+	packListHeaderSize = len(restic.ID{}) + 4
+
+	// packListBlobSize is the size of a blob in the file: ID, type, offset,
+	// length, encryption domain and uncompressed length
+	packListBlobSize = len(restic.ID{}) + 1 + 4 + 4 + 2 + 4
+)
+
+// PackList contains the packs stored in a repo and the blobs they contain,
+// like Index. Only the size of each pack is held in memory, the blobs are
+// written to a temporary file in a compact format and read back when they are
+// needed, so that the list can be built for repositories with many millions
+// of blobs on machines with little memory.
+type PackList struct {
+	packs map[restic.ID]packListEntry
+	blobs int
+
+	file *os.File
+	wr   *bufio.Writer
+	size int64
+
+	domains  []string
+	domainID map[string]uint16
+}
+
+// NewPackList creates an empty PackList. Close must be called to remove the
+// temporary file.
+func NewPackList() (*PackList, error) {
+	f, err := fs.TempFile("", "restic-temp-packlist-")
+	if err != nil {
+		return nil, errors.Wrap(err, "TempFile")
+	}
+
+	return &PackList{
+		packs:    make(map[restic.ID]packListEntry),
+		file:     f,
+		wr:       bufio.NewWriter(f),
+		domainID: make(map[string]uint16),
+	}, nil
+}
+
+// ListPacks creates a PackList for repo from the headers of all packs.
+func ListPacks(ctx context.Context, repo restic.Repository, p *restic.Progress) (*PackList, error) {
+	p.Start()
+	defer p.Done()
+
+	pl, err := NewPackList()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan worker.Job)
+	go list.AllPacks(ctx, repo, ch)
+
+	for job := range ch {
+		p.Report(restic.Stat{Blobs: 1})
+
+		packID := job.Data.(restic.ID)
+		if job.Error != nil {
+			fmt.Fprintf(os.Stderr, "unable to list pack %v: %v\n", packID.Str(), job.Error)
+			continue
+		}
+
+		j := job.Result.(list.Result)
+
+		debug.Log("pack %v contains %d blobs", packID.Str(), len(j.Entries()))
+
+		if err = pl.AddPack(packID, j.Size(), j.Entries()); err != nil {
+			_ = pl.Close()
+			return nil, err
+		}
+	}
+
+	return pl, nil
+}
+
+// AddPack adds a pack to the list. If this pack is already in the list, an
+// error is returned.
+func (pl *PackList) AddPack(id restic.ID, size int64, entries []restic.Blob) error {
+	if _, ok := pl.packs[id]; ok {
+		return errors.Errorf("pack %v already present in the index", id.Str())
+	}
+
+	buf := make([]byte, packListHeaderSize, packListHeaderSize+len(entries)*packListBlobSize)
+	copy(buf, id[:])
+	binary.LittleEndian.PutUint32(buf[len(id):], uint32(len(entries)))
+
+	rec := make([]byte, packListBlobSize)
+	for _, blob := range entries {
+		if blob.Offset > math.MaxUint32 || blob.Length > math.MaxUint32 || blob.UncompressedLength > math.MaxUint32 {
+			return errors.Errorf("pack %v: blob %v is too large", id.Str(), blob.ID.Str())
+		}
+
+		domain, err := pl.domain(blob.Domain)
+		if err != nil {
+			return err
+		}
+
+		copy(rec, blob.ID[:])
+		rec[32] = byte(blob.Type)
+		binary.LittleEndian.PutUint32(rec[33:], uint32(blob.Offset))
+		binary.LittleEndian.PutUint32(rec[37:], uint32(blob.Length))
+		binary.LittleEndian.PutUint16(rec[41:], domain)
+		binary.LittleEndian.PutUint32(rec[43:], uint32(blob.UncompressedLength))
+		buf = append(buf, rec...)
+	}
+
+	if _, err := pl.wr.Write(buf); err != nil {
+		return errors.Wrap(err, "Write")
+	}
+
+	pl.packs[id] = packListEntry{
+		size:   size,
+		offset: pl.size + int64(packListHeaderSize),
+		count:  len(entries),
+	}
+	pl.blobs += len(entries)
+	pl.size += int64(len(buf))
+
+	return nil
+}
+
+// domain returns the number which represents the encryption domain in the
+// file.
+func (pl *PackList) domain(name string) (uint16, error) {
+	if id, ok := pl.domainID[name]; ok {
+		return id, nil
+	}
+
+	if len(pl.domains) > math.MaxUint16 {
+		return 0, errors.New("too many encryption domains")
+	}
+
+	id := uint16(len(pl.domains))
+	pl.domains = append(pl.domains, name)
+	pl.domainID[name] = id
+	return id, nil
+}
+
+// RemovePack deletes a pack from the list.
+func (pl *PackList) RemovePack(id restic.ID) error {
+	e, ok := pl.packs[id]
+	if !ok {
+		return errors.Errorf("pack %v not found in the index", id.Str())
+	}
+
+	pl.blobs -= e.count
+	delete(pl.packs, id)
+	return nil
+}
+
+// Has returns true if the pack is in the list.
+func (pl *PackList) Has(id restic.ID) bool {
+	_, ok := pl.packs[id]
+	return ok
+}
+
+// Len returns the number of packs in the list.
+func (pl *PackList) Len() int {
+	return len(pl.packs)
+}
+
+// Blobs returns the number of blobs in all packs in the list.
+func (pl *PackList) Blobs() int {
+	return pl.blobs
+}
+
+// Size returns the size of the pack.
+func (pl *PackList) Size(id restic.ID) int64 {
+	return pl.packs[id].size
+}
+
+// IDs returns the IDs of all packs in the list.
+func (pl *PackList) IDs() restic.IDSet {
+	ids := restic.NewIDSet()
+	for id := range pl.packs {
+		ids.Insert(id)
+	}
+	return ids
+}
+
+// decode decodes the blobs in buf, the returned slice reuses entries.
+func (pl *PackList) decode(buf []byte, entries []restic.Blob) []restic.Blob {
+	entries = entries[:0]
+	for len(buf) >= packListBlobSize {
+		var blob restic.Blob
+		copy(blob.ID[:], buf)
+		blob.Type = restic.BlobType(buf[32])
+		blob.Offset = uint(binary.LittleEndian.Uint32(buf[33:]))
+		blob.Length = uint(binary.LittleEndian.Uint32(buf[37:]))
+		blob.Domain = pl.domains[binary.LittleEndian.Uint16(buf[41:])]
+		blob.UncompressedLength = uint(binary.LittleEndian.Uint32(buf[43:]))
+		entries = append(entries, blob)
+		buf = buf[packListBlobSize:]
+	}
+
+	return entries
+}
+
+// Pack returns the pack with the given ID.
+func (pl *PackList) Pack(id restic.ID) (Pack, error) {
+	e, ok := pl.packs[id]
+	if !ok {
+		return Pack{}, errors.Errorf("pack %v not found in the index", id.Str())
+	}
+
+	if err := pl.wr.Flush(); err != nil {
+		return Pack{}, errors.Wrap(err, "Flush")
+	}
+
+	buf := make([]byte, e.count*packListBlobSize)
+	if _, err := pl.file.ReadAt(buf, e.offset); err != nil {
+		return Pack{}, errors.Wrap(err, "ReadAt")
+	}
+
+	return Pack{ID: id, Size: e.size, Entries: pl.decode(buf, nil)}, nil
+}
+
+// Each calls fn for each pack in the list, in the order in which they were
+// added. The blobs passed to fn are only valid until fn returns. If fn
+// returns an error, Each stops and returns it.
+func (pl *PackList) Each(fn func(p Pack) error) error {
+	if err := pl.wr.Flush(); err != nil {
+		return errors.Wrap(err, "Flush")
+	}
+
+	rd := bufio.NewReader(io.NewSectionReader(pl.file, 0, pl.size))
+	header := make([]byte, packListHeaderSize)
+	var buf []byte
+	var entries []restic.Blob
+	var pos int64
+
+	for {
+		_, err := io.ReadFull(rd, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "ReadFull")
+		}
+
+		var id restic.ID
+		copy(id[:], header)
+		n := int(binary.LittleEndian.Uint32(header[len(id):])) * packListBlobSize
+		offset := pos + int64(packListHeaderSize)
+		pos = offset + int64(n)
+
+		e, ok := pl.packs[id]
+		if !ok || e.offset != offset {
+			// the pack has been removed (and maybe added again later)
+			if _, err = rd.Discard(n); err != nil {
+				return errors.Wrap(err, "Discard")
+			}
+			continue
+		}
+
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			return errors.Wrap(err, "ReadFull")
+		}
+
+		entries = pl.decode(buf, entries)
+		if err = fn(Pack{ID: id, Size: e.size, Entries: entries}); err != nil {
+			return err
+		}
+	}
+}
+
+// DomainBlob identifies a blob within an encryption domain. Blobs are only
+// duplicates of each other within the same domain.
+type DomainBlob struct {
+	restic.BlobHandle
+	Domain string
+}
+
+// blobKey returns a short key for the blob, which is the same for duplicate
+// blobs. As the blob IDs are hashes, different blobs rarely have the same key.
+func blobKey(blob restic.Blob, domain uint16) uint64 {
+	k := binary.LittleEndian.Uint64(blob.ID[:8])
+	return k ^ uint64(blob.Type)<<56 ^ uint64(domain)
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// DuplicateBlobs returns the number of copies of the blobs which are stored
+// more than once in the packs. Instead of counting all blobs in a map, the
+// short keys of all blobs are sorted to find candidates, which are then
+// counted exactly, so this needs only eight bytes of memory per blob.
+func (pl *PackList) DuplicateBlobs() (map[DomainBlob]int, error) {
+	keys := make(uint64Slice, 0, pl.blobs)
+	err := pl.Each(func(p Pack) error {
+		for _, blob := range p.Entries {
+			keys = append(keys, blobKey(blob, pl.domainID[blob.Domain]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(keys)
+
+	candidates := make(map[uint64]struct{})
+	for i := 1; i < len(keys); i++ {
+		if keys[i] == keys[i-1] {
+			candidates[keys[i]] = struct{}{}
+		}
+	}
+	keys = nil
+
+	dups := make(map[DomainBlob]int)
+	if len(candidates) == 0 {
+		return dups, nil
+	}
+
+	err = pl.Each(func(p Pack) error {
+		for _, blob := range p.Entries {
+			if _, ok := candidates[blobKey(blob, pl.domainID[blob.Domain])]; !ok {
+				continue
+			}
+			dups[DomainBlob{restic.BlobHandle{ID: blob.ID, Type: blob.Type}, blob.Domain}]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// remove the blobs which only have the same key as another one
+	for h, n := range dups {
+		if n < 2 {
+			delete(dups, h)
+		}
+	}
+
+	return dups, nil
+}
+
+// Close removes the temporary file.
+func (pl *PackList) Close() error {
+	if pl.file == nil {
+		return nil
+	}
+
+	err := pl.file.Close()
+	// on some platforms, the file has not been removed by TempFile
+	if rerr := os.Remove(pl.file.Name()); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+		err = rerr
+	}
+	pl.file = nil
+	return errors.Wrap(err, "Close")
+}
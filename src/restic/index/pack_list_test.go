@@ -0,0 +1,150 @@
+package index
+
+import (
+	"context"
+	"restic"
+	"testing"
+)
+
+func TestPackList(t *testing.T) {
+	repo, cleanup := createFilledRepo(t, 3, 0)
+	defer cleanup()
+
+	idx, err := New(context.TODO(), repo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl, err := ListPacks(context.TODO(), repo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := pl.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if pl.Len() != len(idx.Packs) {
+		t.Fatalf("wrong number of packs: want %v, got %v", len(idx.Packs), pl.Len())
+	}
+
+	blobs := 0
+	for id, want := range idx.Packs {
+		blobs += len(want.Entries)
+
+		p, err := pl.Pack(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.Size != want.Size {
+			t.Errorf("pack %v: wrong size: want %v, got %v", id.Str(), want.Size, p.Size)
+		}
+
+		if len(p.Entries) != len(want.Entries) {
+			t.Errorf("pack %v: wrong number of blobs: want %v, got %v", id.Str(), len(want.Entries), len(p.Entries))
+			continue
+		}
+
+		for i := range want.Entries {
+			if p.Entries[i] != want.Entries[i] {
+				t.Errorf("pack %v: blob %d does not match: want %v, got %v", id.Str(), i, want.Entries[i], p.Entries[i])
+			}
+		}
+	}
+
+	if pl.Blobs() != blobs {
+		t.Errorf("wrong number of blobs: want %v, got %v", blobs, pl.Blobs())
+	}
+
+	// remove a pack and add it again
+	var removed Pack
+	for _, p := range idx.Packs {
+		removed = p
+		break
+	}
+
+	if err = pl.RemovePack(removed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if pl.Has(removed.ID) {
+		t.Errorf("removed pack %v still in the list", removed.ID.Str())
+	}
+
+	seen := restic.NewIDSet()
+	err = pl.Each(func(p Pack) error {
+		if !idx.Packs[p.ID].ID.Equal(p.ID) {
+			t.Errorf("unknown pack %v", p.ID.Str())
+		}
+		seen.Insert(p.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != len(idx.Packs)-1 || seen.Has(removed.ID) {
+		t.Errorf("wrong packs passed to Each: want %v packs without %v, got %v", len(idx.Packs)-1, removed.ID.Str(), seen)
+	}
+
+	if err = pl.AddPack(removed.ID, removed.Size, removed.Entries); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	err = pl.Each(func(p Pack) error {
+		if p.ID.Equal(removed.ID) {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("pack %v passed to Each %d times", removed.ID.Str(), count)
+	}
+}
+
+func TestPackListDuplicateBlobs(t *testing.T) {
+	repo, cleanup := createFilledRepo(t, 3, 0.01)
+	defer cleanup()
+
+	idx, err := New(context.TODO(), repo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl, err := ListPacks(context.TODO(), repo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+
+	dups, err := pl.DuplicateBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := idx.DuplicateBlobs()
+	if len(want) == 0 {
+		t.Fatal("no duplicate blobs in the test repository")
+	}
+
+	if len(dups) != len(want) {
+		t.Errorf("wrong number of duplicate blobs: want %v, got %v", len(want), len(dups))
+	}
+
+	for h, n := range dups {
+		if !want.Has(h.BlobHandle) {
+			t.Errorf("blob %v is not a duplicate", h)
+		}
+
+		if n < 2 {
+			t.Errorf("blob %v is stored %d times", h, n)
+		}
+	}
+}
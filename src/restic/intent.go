@@ -0,0 +1,94 @@
+package restic
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"restic/errors"
+)
+
+// Intent records the files an operation such as prune is about to remove
+// from the repository. It is saved before the first file is removed and
+// removed when the operation has finished, so an intent which is found later
+// means the operation has been interrupted and the index may reference packs
+// which are gone. Such an operation is completed (or rolled back, if nothing
+// has been removed yet) by repository.CompleteIntent.
+type Intent struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Hostname  string    `json:"hostname,omitempty"`
+
+	// Packs are the packs to remove, Indexes the index files which reference
+	// them and are replaced by a new index afterwards.
+	Packs   IDs `json:"packs,omitempty"`
+	Indexes IDs `json:"indexes,omitempty"`
+
+	id *ID
+}
+
+// NewIntent returns a new intent of operation to remove packs and replace
+// the index files indexes.
+func NewIntent(operation string, packs, indexes IDs) *Intent {
+	i := &Intent{
+		Time:      time.Now(),
+		Operation: operation,
+		Packs:     packs,
+		Indexes:   indexes,
+	}
+
+	// the hostname is only informational
+	i.Hostname, _ = os.Hostname()
+
+	return i
+}
+
+// LoadIntent loads the intent with the id and returns it.
+func LoadIntent(ctx context.Context, repo Repository, id ID) (*Intent, error) {
+	i := &Intent{id: &id}
+	err := repo.LoadJSONUnpacked(ctx, IntentFile, id, i)
+	if err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+// LoadAllIntents returns a list of all intents in the repo.
+func LoadAllIntents(ctx context.Context, repo Repository) (list []*Intent, err error) {
+	for id := range repo.List(ctx, IntentFile) {
+		i, err := LoadIntent(ctx, repo, id)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, i)
+	}
+	return list, nil
+}
+
+// SaveIntent saves i in the repo.
+func SaveIntent(ctx context.Context, repo Repository, i *Intent) (ID, error) {
+	id, err := repo.SaveJSONUnpacked(ctx, IntentFile, i)
+	if err != nil {
+		return ID{}, err
+	}
+
+	i.id = &id
+	return id, nil
+}
+
+// ID returns the ID of the intent.
+func (i Intent) ID() *ID {
+	return i.id
+}
+
+// Remove removes the intent from the repo, which marks the operation as
+// finished.
+func (i *Intent) Remove(ctx context.Context, repo Repository) error {
+	if i.id == nil {
+		return errors.New("intent has no ID")
+	}
+
+	return repo.Backend().Remove(ctx, Handle{Type: IntentFile, Name: i.id.String()})
+}
@@ -0,0 +1,117 @@
+// Package limits bounds the resources restic uses, so that it can run on
+// machines with little memory. Packages which start workers or keep data in
+// memory pass their default to the functions in this package, which return
+// the default unless a lower limit has been set.
+package limits
+
+import (
+	"runtime/debug"
+	"sync"
+
+	"github.com/restic/chunker"
+)
+
+// Limits are upper bounds for resources, zero means unlimited.
+type Limits struct {
+	// Workers is the number of goroutines which load or process data in
+	// parallel, e.g. snapshots, trees or files.
+	Workers int
+
+	// BlobsInFlight is the number of chunks read by the archiver which may
+	// be held in memory while they are encrypted and saved.
+	BlobsInFlight int
+
+	// CachedTrees is the number of decoded trees kept in memory.
+	CachedTrees int
+
+	// GCPercent is passed to debug.SetGCPercent when the limits are set.
+	GCPercent int
+}
+
+var (
+	m       sync.Mutex
+	current Limits
+)
+
+// The shares of a memory budget which are used for the different purposes.
+const (
+	workerMemory = 32 * 1024 * 1024
+	treeMemory   = 64 * 1024
+	minWorkers   = 2
+)
+
+// ForMemory returns limits so that restic uses about budget bytes of memory,
+// in addition to the index which is always held in memory.
+func ForMemory(budget uint64) Limits {
+	l := Limits{
+		Workers:       int(budget / workerMemory),
+		BlobsInFlight: int(budget / 4 / chunker.MaxSize),
+		CachedTrees:   int(budget / 8 / treeMemory),
+		GCPercent:     100,
+	}
+
+	if l.Workers < minWorkers {
+		l.Workers = minWorkers
+	}
+
+	if l.BlobsInFlight < minWorkers {
+		l.BlobsInFlight = minWorkers
+	}
+
+	if l.CachedTrees < 1 {
+		l.CachedTrees = 1
+	}
+
+	// collect garbage more often, so that the heap stays closer to the
+	// memory which is actually in use
+	switch {
+	case budget < 1024*1024*1024:
+		l.GCPercent = 25
+	case budget < 4*1024*1024*1024:
+		l.GCPercent = 50
+	}
+
+	return l
+}
+
+// Set configures the limits for the whole process.
+func Set(l Limits) {
+	m.Lock()
+	current = l
+	m.Unlock()
+
+	if l.GCPercent > 0 {
+		debug.SetGCPercent(l.GCPercent)
+	}
+}
+
+// Get returns the current limits.
+func Get() Limits {
+	m.Lock()
+	defer m.Unlock()
+	return current
+}
+
+func bound(n, max int) int {
+	if max > 0 && n > max {
+		return max
+	}
+	return n
+}
+
+// Workers returns the number of workers to start instead of n.
+func Workers(n int) int {
+	return bound(n, Get().Workers)
+}
+
+// BlobsInFlight returns the number of chunks which may be held in memory
+// instead of n.
+func BlobsInFlight(n int) int {
+	return bound(n, Get().BlobsInFlight)
+}
+
+// CachedTrees returns the number of trees which may be kept in memory
+// instead of n.
+func CachedTrees(n int) int {
+	return bound(n, Get().CachedTrees)
+}
@@ -0,0 +1,56 @@
+package limits_test
+
+import (
+	"testing"
+
+	"restic/limits"
+)
+
+const miB = 1024 * 1024
+
+func TestForMemory(t *testing.T) {
+	var tests = []struct {
+		budget uint64
+		want   limits.Limits
+	}{
+		{0, limits.Limits{Workers: 2, BlobsInFlight: 2, CachedTrees: 1, GCPercent: 25}},
+		{64 * miB, limits.Limits{Workers: 2, BlobsInFlight: 2, CachedTrees: 128, GCPercent: 25}},
+		{512 * miB, limits.Limits{Workers: 16, BlobsInFlight: 16, CachedTrees: 1024, GCPercent: 25}},
+		{2048 * miB, limits.Limits{Workers: 64, BlobsInFlight: 64, CachedTrees: 4096, GCPercent: 50}},
+		{8192 * miB, limits.Limits{Workers: 256, BlobsInFlight: 256, CachedTrees: 16384, GCPercent: 100}},
+	}
+
+	for _, test := range tests {
+		l := limits.ForMemory(test.budget)
+		if l != test.want {
+			t.Errorf("budget %d: want limits %+v, got %+v", test.budget, test.want, l)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	defer limits.Set(limits.Limits{GCPercent: 100})
+
+	if n := limits.Workers(10); n != 10 {
+		t.Errorf("Workers(10) without limit returned %d", n)
+	}
+
+	limits.Set(limits.Limits{Workers: 4, BlobsInFlight: 3, CachedTrees: 100, GCPercent: 100})
+
+	var tests = []struct {
+		f       func(int) int
+		n, want int
+	}{
+		{limits.Workers, 10, 4},
+		{limits.Workers, 2, 2},
+		{limits.BlobsInFlight, 32, 3},
+		{limits.CachedTrees, 1000, 100},
+		{limits.CachedTrees, 10, 10},
+	}
+
+	for i, test := range tests {
+		if got := test.f(test.n); got != test.want {
+			t.Errorf("test %d: want %d, got %d", i, test.want, got)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package list
 import (
 	"context"
 	"restic"
+	"restic/limits"
 	"restic/worker"
 )
 
@@ -50,7 +51,7 @@ func AllPacks(ctx context.Context, repo Lister, ch chan<- worker.Job) {
 	}
 
 	jobCh := make(chan worker.Job)
-	wp := worker.New(ctx, listPackWorkers, f, jobCh, ch)
+	wp := worker.New(ctx, limits.Workers(listPackWorkers), f, jobCh, ch)
 
 	go func() {
 		defer close(jobCh)
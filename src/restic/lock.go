@@ -47,6 +47,11 @@ func (e ErrAlreadyLocked) Error() string {
 	return fmt.Sprintf("repository is already locked by %v", e.otherLock)
 }
 
+// ErrorCode returns the error code for a locked repository.
+func (e ErrAlreadyLocked) ErrorCode() string {
+	return errors.CodeRepoLocked
+}
+
 // IsAlreadyLocked returns true iff err is an instance of ErrAlreadyLocked.
 func IsAlreadyLocked(err error) bool {
 	if _, ok := errors.Cause(err).(ErrAlreadyLocked); ok {
@@ -0,0 +1,104 @@
+package migrations
+
+import (
+	"context"
+	"restic"
+	"restic/debug"
+	"restic/errors"
+	"restic/repository"
+)
+
+func init() {
+	register(&UpgradeRepoV2{})
+}
+
+// UpgradeRepoV2 upgrades a repository from version 1 to version 2. Index
+// files in the old format are rewritten in the current format, afterwards the
+// version in the config is changed.
+type UpgradeRepoV2 struct{}
+
+// configSaver is implemented by repositories which can replace their config.
+type configSaver interface {
+	SaveConfig(context.Context, restic.Config) error
+}
+
+// Check tests whether the migration can be applied.
+func (m *UpgradeRepoV2) Check(ctx context.Context, repo restic.Repository) (bool, error) {
+	return repo.Config().Version == 1, nil
+}
+
+// convertIndex rewrites the old index id in the current format and removes
+// it. The new index supersedes the old one, so it does no harm if the old
+// index cannot be removed.
+func (m *UpgradeRepoV2) convertIndex(ctx context.Context, repo restic.Repository, id restic.ID) error {
+	old, err := repository.LoadIndexWithDecoder(ctx, repo, id, repository.DecodeOldIndex)
+	if err != nil {
+		return err
+	}
+
+	idx := repository.NewIndex()
+	done := make(chan struct{})
+	for pb := range old.Each(done) {
+		idx.Store(pb)
+	}
+	close(done)
+
+	if err = idx.AddToSupersedes(id); err != nil {
+		return err
+	}
+
+	newID, err := repository.SaveIndex(ctx, repo, idx)
+	if err != nil {
+		return err
+	}
+
+	debug.Log("converted index %v to %v", id.Str(), newID.Str())
+	return repo.Backend().Remove(ctx, restic.Handle{Type: restic.IndexFile, Name: id.String()})
+}
+
+// Apply runs the migration.
+func (m *UpgradeRepoV2) Apply(ctx context.Context, repo restic.Repository) error {
+	cfg := repo.Config()
+	if cfg.Version != 1 {
+		return errors.Errorf("repository has version %v, expected 1", cfg.Version)
+	}
+
+	saver, ok := repo.(configSaver)
+	if !ok {
+		return errors.New("the config of the repository cannot be replaced")
+	}
+
+	var ids restic.IDs
+	for id := range repo.List(ctx, restic.IndexFile) {
+		ids = append(ids, id)
+	}
+
+	// the version is only changed when no old index is left
+	for _, id := range ids {
+		_, err := repository.LoadIndexWithDecoder(ctx, repo, id, repository.DecodeIndex)
+		if err == nil {
+			continue
+		}
+
+		if errors.Cause(err) != repository.ErrOldIndexFormat {
+			return err
+		}
+
+		if err = m.convertIndex(ctx, repo, id); err != nil {
+			return errors.Wrapf(err, "converting index %v", id.Str())
+		}
+	}
+
+	cfg.Version = 2
+	return saver.SaveConfig(ctx, cfg)
+}
+
+// Name returns the name for this migration.
+func (m *UpgradeRepoV2) Name() string {
+	return "upgrade_repo_v2"
+}
+
+// Desc returns a short description what the migration does.
+func (m *UpgradeRepoV2) Desc() string {
+	return "upgrade the repository to version 2, converting index files in the old format"
+}
@@ -0,0 +1,47 @@
+package migrations
+
+import (
+	"context"
+	"restic"
+	"restic/errors"
+)
+
+func init() {
+	register(&UpgradeRepoV3{})
+}
+
+// UpgradeRepoV3 upgrades a repository from version 2 to version 3. The data
+// is not changed, it stays encrypted with the default cipher. Only the
+// version in the config is changed.
+type UpgradeRepoV3 struct{}
+
+// Check tests whether the migration can be applied.
+func (m *UpgradeRepoV3) Check(ctx context.Context, repo restic.Repository) (bool, error) {
+	return repo.Config().Version == 2, nil
+}
+
+// Apply runs the migration.
+func (m *UpgradeRepoV3) Apply(ctx context.Context, repo restic.Repository) error {
+	cfg := repo.Config()
+	if cfg.Version != 2 {
+		return errors.Errorf("repository has version %v, expected 2", cfg.Version)
+	}
+
+	saver, ok := repo.(configSaver)
+	if !ok {
+		return errors.New("the config of the repository cannot be replaced")
+	}
+
+	cfg.Version = 3
+	return saver.SaveConfig(ctx, cfg)
+}
+
+// Name returns the name for this migration.
+func (m *UpgradeRepoV3) Name() string {
+	return "upgrade_repo_v3"
+}
+
+// Desc returns a short description what the migration does.
+func (m *UpgradeRepoV3) Desc() string {
+	return "upgrade the repository to version 3, which records the cipher in the config"
+}
@@ -0,0 +1,53 @@
+package migrations
+
+import (
+	"context"
+	"restic"
+	"restic/errors"
+)
+
+func init() {
+	register(&UpgradeRepoV4{})
+}
+
+// UpgradeRepoV4 upgrades a repository from version 3 to version 4, which
+// allows keys for encryption domains. Files saved afterwards are encrypted
+// with the metadata key, existing files stay encrypted with the master key
+// and can only be read with it. Saving the config also saves the copy of the
+// config which the keys of encryption domains read.
+type UpgradeRepoV4 struct{}
+
+// Check tests whether the migration can be applied.
+func (m *UpgradeRepoV4) Check(ctx context.Context, repo restic.Repository) (bool, error) {
+	return repo.Config().Version == 3, nil
+}
+
+// Apply runs the migration.
+func (m *UpgradeRepoV4) Apply(ctx context.Context, repo restic.Repository) error {
+	cfg := repo.Config()
+	if cfg.Version != 3 {
+		return errors.Errorf("repository has version %v, expected 3", cfg.Version)
+	}
+
+	if repo.Key() == nil {
+		return errors.New("upgrading the repository requires the master key")
+	}
+
+	saver, ok := repo.(configSaver)
+	if !ok {
+		return errors.New("the config of the repository cannot be replaced")
+	}
+
+	cfg.Version = 4
+	return saver.SaveConfig(ctx, cfg)
+}
+
+// Name returns the name for this migration.
+func (m *UpgradeRepoV4) Name() string {
+	return "upgrade_repo_v4"
+}
+
+// Desc returns a short description what the migration does.
+func (m *UpgradeRepoV4) Desc() string {
+	return "upgrade the repository to version 4, which allows keys for encryption domains"
+}
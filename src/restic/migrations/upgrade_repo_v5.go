@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"context"
+	"restic"
+	"restic/errors"
+)
+
+func init() {
+	register(&UpgradeRepoV5{})
+}
+
+// UpgradeRepoV5 upgrades a repository from version 4 to version 5, which
+// allows storing the content of very large files in separate content list
+// blobs. Existing trees are not modified, older versions of restic refuse to
+// access the repository afterwards.
+type UpgradeRepoV5 struct{}
+
+// Check tests whether the migration can be applied.
+func (m *UpgradeRepoV5) Check(ctx context.Context, repo restic.Repository) (bool, error) {
+	return repo.Config().Version == 4, nil
+}
+
+// Apply runs the migration.
+func (m *UpgradeRepoV5) Apply(ctx context.Context, repo restic.Repository) error {
+	cfg := repo.Config()
+	if cfg.Version != 4 {
+		return errors.Errorf("repository has version %v, expected 4", cfg.Version)
+	}
+
+	if repo.Key() == nil {
+		return errors.New("upgrading the repository requires the master key")
+	}
+
+	saver, ok := repo.(configSaver)
+	if !ok {
+		return errors.New("the config of the repository cannot be replaced")
+	}
+
+	cfg.Version = 5
+	return saver.SaveConfig(ctx, cfg)
+}
+
+// Name returns the name for this migration.
+func (m *UpgradeRepoV5) Name() string {
+	return "upgrade_repo_v5"
+}
+
+// Desc returns a short description what the migration does.
+func (m *UpgradeRepoV5) Desc() string {
+	return "upgrade the repository to version 5, which allows content lists for very large files"
+}
@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"context"
+	"restic"
+	"restic/errors"
+)
+
+func init() {
+	register(&UpgradeRepoV6{})
+}
+
+// UpgradeRepoV6 upgrades a repository from version 5 to version 6, which
+// allows compressing blobs. Blobs which are already stored are not modified,
+// only new blobs are compressed. Older versions of restic refuse to access the
+// repository afterwards.
+type UpgradeRepoV6 struct{}
+
+// Check tests whether the migration can be applied.
+func (m *UpgradeRepoV6) Check(ctx context.Context, repo restic.Repository) (bool, error) {
+	return repo.Config().Version == 5, nil
+}
+
+// Apply runs the migration.
+func (m *UpgradeRepoV6) Apply(ctx context.Context, repo restic.Repository) error {
+	cfg := repo.Config()
+	if cfg.Version != 5 {
+		return errors.Errorf("repository has version %v, expected 5", cfg.Version)
+	}
+
+	if repo.Key() == nil {
+		return errors.New("upgrading the repository requires the master key")
+	}
+
+	saver, ok := repo.(configSaver)
+	if !ok {
+		return errors.New("the config of the repository cannot be replaced")
+	}
+
+	cfg.Version = 6
+	return saver.SaveConfig(ctx, cfg)
+}
+
+// Name returns the name for this migration.
+func (m *UpgradeRepoV6) Name() string {
+	return "upgrade_repo_v6"
+}
+
+// Desc returns a short description what the migration does.
+func (m *UpgradeRepoV6) Desc() string {
+	return "upgrade the repository to version 6, which compresses new blobs"
+}
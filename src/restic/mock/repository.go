@@ -1,6 +1,7 @@
 package mock
 
 import (
+	"io"
 	"restic"
 	"restic/crypto"
 )
@@ -9,7 +10,8 @@ import (
 type Repository struct {
 	BackendFn func() restic.Backend
 
-	KeyFn func() *crypto.Key
+	KeyFn       func() *crypto.Key
+	DomainKeyFn func(string) (*crypto.Key, error)
 
 	SetIndexFn func(restic.Index)
 
@@ -22,8 +24,9 @@ type Repository struct {
 
 	LookupBlobSizeFn func(restic.ID, restic.BlobType) (uint, error)
 
-	ListFn     func(restic.FileType, <-chan struct{}) <-chan restic.ID
-	ListPackFn func(restic.ID) ([]restic.Blob, int64, error)
+	ListFn      func(restic.FileType, <-chan struct{}) <-chan restic.ID
+	ListPackFn  func(restic.ID) ([]restic.Blob, int64, error)
+	PackBlobsFn func(io.ReaderAt, int64) ([]restic.Blob, error)
 
 	FlushFn func() error
 
@@ -50,6 +53,11 @@ func (repo Repository) Key() *crypto.Key {
 	return repo.KeyFn()
 }
 
+// DomainKey is a stub method.
+func (repo Repository) DomainKey(domain string) (*crypto.Key, error) {
+	return repo.DomainKeyFn(domain)
+}
+
 // SetIndex is a stub method.
 func (repo Repository) SetIndex(idx restic.Index) {
 	repo.SetIndexFn(idx)
@@ -95,6 +103,11 @@ func (repo Repository) ListPack(id restic.ID) ([]restic.Blob, int64, error) {
 	return repo.ListPackFn(id)
 }
 
+// PackBlobs is a stub method.
+func (repo Repository) PackBlobs(rd io.ReaderAt, size int64) ([]restic.Blob, error) {
+	return repo.PackBlobsFn(rd, size)
+}
+
 // Flush is a stub method.
 func (repo Repository) Flush() error {
 	return repo.FlushFn()
@@ -17,6 +17,8 @@ import (
 	"restic/debug"
 	"restic/fs"
 	"runtime"
+	"sort"
+	"strings"
 )
 
 // ExtendedAttribute is a tuple storing the xattr name and value.
@@ -43,12 +45,24 @@ type Node struct {
 	Links              uint64              `json:"links,omitempty"`
 	LinkTarget         string              `json:"linktarget,omitempty"`
 	ExtendedAttributes []ExtendedAttribute `json:"extended_attributes,omitempty"`
-	Device             uint64              `json:"device,omitempty"` // in case of Type == "dev", stat.st_rdev
+	Flags              uint32              `json:"flags,omitempty"`       // inode flags (immutable, append-only), Linux only
+	ACL                []ACLEntry          `json:"acl,omitempty"`         // POSIX access ACL, Linux only
+	DefaultACL         []ACLEntry          `json:"default_acl,omitempty"` // POSIX default ACL of directories, Linux only
+	Device             uint64              `json:"device,omitempty"`      // in case of Type == "dev", stat.st_rdev
 	Content            IDs                 `json:"content"`
+	ContentList        *ID                 `json:"content_list,omitempty"` // stored instead of Content for very large files
 	Subtree            *ID                 `json:"subtree,omitempty"`
 
 	Error string `json:"error,omitempty"`
 
+	// Inconsistent is set for files which changed while they were read, the
+	// content may be a mix of old and new data.
+	Inconsistent bool `json:"inconsistent,omitempty"`
+
+	// Sparse is set for files which contained holes, blocks of zeros are
+	// not written when they are restored.
+	Sparse bool `json:"sparse,omitempty"`
+
 	Path string `json:"-"`
 }
 
@@ -65,9 +79,21 @@ func (node Node) String() string {
 	return fmt.Sprintf("<Node(%s) %s>", node.Type, node.Name)
 }
 
+// NodeOptions select which metadata is read for a node.
+type NodeOptions struct {
+	// SkipExtendedAttributes disables reading the extended attributes.
+	SkipExtendedAttributes bool
+}
+
 // NodeFromFileInfo returns a new node from the given path and FileInfo. It
 // returns the first error that is encountered, together with a node.
 func NodeFromFileInfo(path string, fi os.FileInfo) (*Node, error) {
+	return NodeFromFileInfoWithOptions(path, fi, NodeOptions{})
+}
+
+// NodeFromFileInfoWithOptions works like NodeFromFileInfo, the metadata is
+// read as configured by opts.
+func NodeFromFileInfoWithOptions(path string, fi os.FileInfo, opts NodeOptions) (*Node, error) {
 	mask := os.ModePerm | os.ModeType | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
 	node := &Node{
 		Path:    path,
@@ -81,7 +107,7 @@ func NodeFromFileInfo(path string, fi os.FileInfo) (*Node, error) {
 		node.Size = uint64(fi.Size())
 	}
 
-	err := node.fillExtra(path, fi)
+	err := node.fillExtra(path, fi, opts)
 	return node, err
 }
 
@@ -118,6 +144,12 @@ func (node Node) GetExtendedAttribute(a string) []byte {
 
 // CreateAt creates the node at the given path and restores all the meta data.
 func (node *Node) CreateAt(ctx context.Context, path string, repo Repository, idx *HardlinkIndex) error {
+	return node.CreateAtWithOptions(ctx, path, repo, idx, FileWriteOptions{})
+}
+
+// CreateAtWithOptions works like CreateAt, the contents of files are written
+// as configured by opts.
+func (node *Node) CreateAtWithOptions(ctx context.Context, path string, repo Repository, idx *HardlinkIndex, opts FileWriteOptions) error {
 	debug.Log("create node %v at %v", node.Name, path)
 
 	switch node.Type {
@@ -126,7 +158,7 @@ func (node *Node) CreateAt(ctx context.Context, path string, repo Repository, id
 			return err
 		}
 	case "file":
-		if err := node.createFileAt(ctx, path, repo, idx); err != nil {
+		if err := node.createFileAt(ctx, path, repo, idx, opts); err != nil {
 			return err
 		}
 	case "symlink":
@@ -159,38 +191,110 @@ func (node *Node) CreateAt(ctx context.Context, path string, repo Repository, id
 	return err
 }
 
+// The categories of metadata which are restored for a node.
+const (
+	MetadataOwner      = "owner"
+	MetadataMode       = "mode"
+	MetadataTimestamps = "timestamps"
+	MetadataXattrs     = "extended attributes"
+	MetadataFlags      = "flags"
+	MetadataACL        = "acl"
+)
+
+// PlatformMetadata returns true if the metadata of category is specific to
+// the platform or the file system and therefore cannot be restored everywhere,
+// e.g. the owner for an unprivileged user or extended attributes on FAT.
+func PlatformMetadata(category string) bool {
+	switch category {
+	case MetadataOwner, MetadataXattrs, MetadataFlags, MetadataACL:
+		return true
+	}
+	return false
+}
+
+// MetadataError is returned when a node has been created, but some of its
+// metadata could not be restored. Errors maps the category of the metadata to
+// the error.
+type MetadataError struct {
+	Errors map[string]error
+}
+
+func (e *MetadataError) add(category string, err error) {
+	if e.Errors == nil {
+		e.Errors = make(map[string]error)
+	}
+	e.Errors[category] = err
+}
+
+// err returns e if an error has been added and nil otherwise.
+func (e *MetadataError) err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *MetadataError) Error() string {
+	categories := make([]string, 0, len(e.Errors))
+	for category := range e.Errors {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	msgs := make([]string, 0, len(categories))
+	for _, category := range categories {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", category, e.Errors[category]))
+	}
+
+	return "unable to restore metadata: " + strings.Join(msgs, ", ")
+}
+
+// restoreMetadata restores the metadata of the node at path. All categories
+// are restored even if one fails, the errors are returned as a MetadataError.
 func (node Node) restoreMetadata(path string) error {
-	var firsterr error
+	var merr MetadataError
 
 	if err := lchown(path, int(node.UID), int(node.GID)); err != nil {
-		firsterr = errors.Wrap(err, "Lchown")
+		merr.add(MetadataOwner, errors.Wrap(err, "Lchown"))
 	}
 
 	if node.Type != "symlink" {
 		if err := fs.Chmod(path, node.Mode); err != nil {
-			if firsterr != nil {
-				firsterr = errors.Wrap(err, "Chmod")
-			}
+			merr.add(MetadataMode, errors.Wrap(err, "Chmod"))
 		}
 	}
 
 	if node.Type != "dir" {
 		if err := node.RestoreTimestamps(path); err != nil {
 			debug.Log("error restoring timestamps for dir %v: %v", path, err)
-			if firsterr != nil {
-				firsterr = err
-			}
+			merr.add(MetadataTimestamps, err)
 		}
 	}
 
+	// Extended attributes must be restored after Lchown, because changing
+	// the owner of a file clears the file capabilities stored in the
+	// attribute security.capability.
 	if err := node.restoreExtendedAttributes(path); err != nil {
 		debug.Log("error restoring extended attributes for %v: %v", path, err)
-		if firsterr != nil {
-			firsterr = err
+		merr.add(MetadataXattrs, err)
+	}
+
+	if err := node.restoreACL(path); err != nil {
+		debug.Log("error restoring ACLs for %v: %v", path, err)
+		merr.add(MetadataACL, err)
+	}
+
+	// Inode flags like immutable prevent all further modifications, so they
+	// are set last. For directories, this is done by the restorer after all
+	// entries have been restored.
+	if node.Type != "dir" {
+		if err := node.RestoreFlags(path); err != nil {
+			debug.Log("error restoring flags for %v: %v", path, err)
+			merr.add(MetadataFlags, err)
 		}
 	}
 
-	return firsterr
+	return merr.err()
 }
 
 func (node Node) restoreExtendedAttributes(path string) error {
@@ -203,6 +307,12 @@ func (node Node) restoreExtendedAttributes(path string) error {
 	return nil
 }
 
+// RestoreFlags sets the inode flags (e.g. immutable, append-only) saved in the
+// node. This is a no-op on systems other than Linux.
+func (node Node) RestoreFlags(path string) error {
+	return node.restoreFlags(path)
+}
+
 func (node Node) RestoreTimestamps(path string) error {
 	var utimes = [...]syscall.Timespec{
 		syscall.NsecToTimespec(node.AccessTime.UnixNano()),
@@ -229,7 +339,7 @@ func (node Node) createDirAt(path string) error {
 	return nil
 }
 
-func (node Node) createFileAt(ctx context.Context, path string, repo Repository, idx *HardlinkIndex) error {
+func (node Node) createFileAt(ctx context.Context, path string, repo Repository, idx *HardlinkIndex, opts FileWriteOptions) error {
 	if node.Links > 1 && idx.Has(node.Inode, node.DeviceID) {
 		if err := fs.Remove(path); !os.IsNotExist(err) {
 			return errors.Wrap(err, "RemoveCreateHardlink")
@@ -241,17 +351,17 @@ func (node Node) createFileAt(ctx context.Context, path string, repo Repository,
 		return nil
 	}
 
-	f, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
-	defer f.Close()
-
+	opts.Sparse = opts.Sparse || node.Sparse
+	f, err := newFileWriter(path, int64(node.Size), opts)
 	if err != nil {
-		return errors.Wrap(err, "OpenFile")
+		return err
 	}
 
 	var buf []byte
 	for _, id := range node.Content {
 		size, err := repo.LookupBlobSize(id, DataBlob)
 		if err != nil {
+			_ = f.Close()
 			return err
 		}
 
@@ -262,16 +372,22 @@ func (node Node) createFileAt(ctx context.Context, path string, repo Repository,
 
 		n, err := repo.LoadBlob(ctx, DataBlob, id, buf)
 		if err != nil {
+			_ = f.Close()
 			return err
 		}
 		buf = buf[:n]
 
 		_, err = f.Write(buf)
 		if err != nil {
-			return errors.Wrap(err, "Write")
+			_ = f.Close()
+			return err
 		}
 	}
 
+	if err = f.Close(); err != nil {
+		return err
+	}
+
 	if node.Links > 1 {
 		idx.Add(node.Inode, node.DeviceID, path)
 	}
@@ -328,6 +444,10 @@ func (node Node) MarshalJSON() ([]byte, error) {
 	name := strconv.Quote(node.Name)
 	nj.Name = name[1 : len(name)-1]
 
+	if node.ContentList != nil {
+		nj.Content = nil
+	}
+
 	return json.Marshal(nj)
 }
 
@@ -399,6 +519,12 @@ func (node Node) Equals(other Node) bool {
 	if !node.sameExtendedAttributes(other) {
 		return false
 	}
+	if node.Flags != other.Flags {
+		return false
+	}
+	if !sameACL(node.ACL, other.ACL) || !sameACL(node.DefaultACL, other.DefaultACL) {
+		return false
+	}
 	if node.Subtree != nil {
 		if other.Subtree == nil {
 			return false
@@ -415,6 +541,12 @@ func (node Node) Equals(other Node) bool {
 	if node.Error != other.Error {
 		return false
 	}
+	if node.Inconsistent != other.Inconsistent {
+		return false
+	}
+	if node.Sparse != other.Sparse {
+		return false
+	}
 
 	return true
 }
@@ -486,8 +618,33 @@ func (node Node) sameExtendedAttributes(other Node) bool {
 	return true
 }
 
+// SameTime returns true if the timestamps a and b differ by at most skew. A
+// skew of zero requires both timestamps to be equal.
+func SameTime(a, b time.Time, skew time.Duration) bool {
+	d := a.Sub(b)
+	if d < 0 {
+		d = -d
+	}
+	return d <= skew
+}
+
+// ChangeOptions select how a file is compared with its node in the parent
+// snapshot. The modification time and the size are always compared.
+type ChangeOptions struct {
+	// MtimeSkew is the amount by which the modification and change times
+	// may differ, which accommodates file systems with coarse or unstable
+	// timestamps.
+	MtimeSkew time.Duration
+
+	// IgnoreInode and IgnoreCtime disable comparing the inode and the change
+	// time, which change e.g. for files on FUSE or NFS mounts or after the
+	// files have been copied with their timestamps.
+	IgnoreInode bool
+	IgnoreCtime bool
+}
+
 // IsNewer returns true of the file has been updated since the last Stat().
-func (node *Node) IsNewer(path string, fi os.FileInfo) bool {
+func (node *Node) IsNewer(path string, fi os.FileInfo, opts ChangeOptions) bool {
 	if node.Type != "file" {
 		debug.Log("node %v is newer: not file", path)
 		return true
@@ -503,7 +660,7 @@ func (node *Node) IsNewer(path string, fi os.FileInfo) bool {
 
 	extendedStat, ok := toStatT(fi.Sys())
 	if !ok {
-		if node.ModTime != fi.ModTime() ||
+		if !SameTime(node.ModTime, fi.ModTime(), opts.MtimeSkew) ||
 			node.Size != size {
 			debug.Log("node %v is newer: timestamp or size changed", path)
 			return true
@@ -513,9 +670,9 @@ func (node *Node) IsNewer(path string, fi os.FileInfo) bool {
 
 	inode := extendedStat.ino()
 
-	if node.ModTime != fi.ModTime() ||
-		node.ChangeTime != changeTime(extendedStat) ||
-		node.Inode != uint64(inode) ||
+	if !SameTime(node.ModTime, fi.ModTime(), opts.MtimeSkew) ||
+		(!opts.IgnoreCtime && !SameTime(node.ChangeTime, changeTime(extendedStat), opts.MtimeSkew)) ||
+		(!opts.IgnoreInode && node.Inode != uint64(inode)) ||
 		node.Size != size {
 		debug.Log("node %v is newer: timestamp, size or inode changed", path)
 		return true
@@ -566,7 +723,7 @@ func lookupUsername(uid string) (string, error) {
 	return username, nil
 }
 
-func (node *Node) fillExtra(path string, fi os.FileInfo) error {
+func (node *Node) fillExtra(path string, fi os.FileInfo, opts NodeOptions) error {
 	stat, ok := toStatT(fi.Sys())
 	if !ok {
 		return nil
@@ -606,7 +763,17 @@ func (node *Node) fillExtra(path string, fi os.FileInfo) error {
 		return errors.Errorf("invalid node type %q", node.Type)
 	}
 
-	if err = node.fillExtendedAttributes(path); err != nil {
+	if !opts.SkipExtendedAttributes {
+		if err = node.fillExtendedAttributes(path); err != nil {
+			return err
+		}
+	}
+
+	if err = node.fillFlags(path); err != nil {
+		return err
+	}
+
+	if err = node.fillACL(path); err != nil {
 		return err
 	}
 
@@ -626,6 +793,11 @@ func (node *Node) fillExtendedAttributes(path string) error {
 
 	node.ExtendedAttributes = make([]ExtendedAttribute, 0, len(xattrs))
 	for _, attr := range xattrs {
+		if isACLXattr(attr) {
+			// saved in node.ACL and node.DefaultACL
+			continue
+		}
+
 		attrVal, err := Getxattr(path, attr)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "can not obtain extended attribute %v for %v:\n", attr, path)
@@ -670,3 +842,20 @@ func changeTime(stat statT) time.Time {
 	ctim := stat.ctim()
 	return time.Unix(ctim.Unix())
 }
+
+// ChangedSince returns true if the modification time of fi or, where the
+// platform records it, the change time is after t. The change time catches
+// files whose modification time has been preserved, e.g. when moved or
+// extracted from an archive.
+func ChangedSince(fi os.FileInfo, t time.Time) bool {
+	if fi.ModTime().After(t) {
+		return true
+	}
+
+	stat, ok := toStatT(fi.Sys())
+	if !ok {
+		return false
+	}
+
+	return changeTime(stat).After(t)
+}
@@ -0,0 +1,165 @@
+package restic
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"restic/errors"
+)
+
+// ACLEntry is an entry of a POSIX access control list. Tag is one of
+// "user_obj", "user", "group_obj", "group", "mask" and "other", ID is the UID
+// or GID for the tags "user" and "group". Perm contains the permission bits
+// read (4), write (2) and execute (1).
+type ACLEntry struct {
+	Tag  string `json:"tag"`
+	ID   uint32 `json:"id,omitempty"`
+	Perm uint16 `json:"perm"`
+}
+
+func (e ACLEntry) String() string {
+	if e.Tag == "user" || e.Tag == "group" {
+		return fmt.Sprintf("%v:%d:%o", e.Tag, e.ID, e.Perm)
+	}
+	return fmt.Sprintf("%v::%o", e.Tag, e.Perm)
+}
+
+// The names of the extended attributes Linux uses to store the access and
+// the default ACL.
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+)
+
+// isACLXattr returns true if the extended attribute name holds an ACL, those
+// are saved in the fields ACL and DefaultACL of a node instead.
+func isACLXattr(name string) bool {
+	return name == aclAccessXattr || name == aclDefaultXattr
+}
+
+// The format of the extended attributes holding ACLs, as defined in
+// linux/posix_acl_xattr.h: a little-endian version number followed by
+// entries of tag (16 bit), permissions (16 bit) and ID (32 bit).
+const (
+	aclXattrVersion   = 2
+	aclXattrEntrySize = 8
+	aclUndefinedID    = 0xffffffff
+)
+
+var aclTags = []struct {
+	tag  uint16
+	name string
+}{
+	{0x01, "user_obj"},
+	{0x02, "user"},
+	{0x04, "group_obj"},
+	{0x08, "group"},
+	{0x10, "mask"},
+	{0x20, "other"},
+}
+
+// decodeACL parses the value of an ACL extended attribute.
+func decodeACL(buf []byte) ([]ACLEntry, error) {
+	if len(buf) < 4 || (len(buf)-4)%aclXattrEntrySize != 0 {
+		return nil, errors.Errorf("invalid ACL length %d", len(buf))
+	}
+
+	if v := binary.LittleEndian.Uint32(buf); v != aclXattrVersion {
+		return nil, errors.Errorf("unsupported ACL version %d", v)
+	}
+
+	acl := make([]ACLEntry, 0, (len(buf)-4)/aclXattrEntrySize)
+	for buf = buf[4:]; len(buf) > 0; buf = buf[aclXattrEntrySize:] {
+		tag := binary.LittleEndian.Uint16(buf)
+
+		e := ACLEntry{Perm: binary.LittleEndian.Uint16(buf[2:])}
+		for _, t := range aclTags {
+			if t.tag == tag {
+				e.Tag = t.name
+			}
+		}
+		if e.Tag == "" {
+			return nil, errors.Errorf("invalid ACL tag %#x", tag)
+		}
+
+		if e.Tag == "user" || e.Tag == "group" {
+			e.ID = binary.LittleEndian.Uint32(buf[4:])
+		}
+
+		acl = append(acl, e)
+	}
+
+	return acl, nil
+}
+
+// encodeACL returns the value of an ACL extended attribute for acl.
+func encodeACL(acl []ACLEntry) ([]byte, error) {
+	buf := make([]byte, 4+len(acl)*aclXattrEntrySize)
+	binary.LittleEndian.PutUint32(buf, aclXattrVersion)
+
+	p := buf[4:]
+	for _, e := range acl {
+		var tag uint16
+		for _, t := range aclTags {
+			if t.name == e.Tag {
+				tag = t.tag
+			}
+		}
+		if tag == 0 {
+			return nil, errors.Errorf("invalid ACL tag %q", e.Tag)
+		}
+
+		id := uint32(aclUndefinedID)
+		if e.Tag == "user" || e.Tag == "group" {
+			id = e.ID
+		}
+
+		binary.LittleEndian.PutUint16(p, tag)
+		binary.LittleEndian.PutUint16(p[2:], e.Perm)
+		binary.LittleEndian.PutUint32(p[4:], id)
+		p = p[aclXattrEntrySize:]
+	}
+
+	return buf, nil
+}
+
+func sameACL(a, b []ACLEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ExtendedAttributesWithACL returns the extended attributes of the node,
+// including the ACLs encoded as the extended attributes Linux uses for them.
+// Nodes saved by older versions of restic have the ACLs in
+// ExtendedAttributes already.
+func (node Node) ExtendedAttributesWithACL() []ExtendedAttribute {
+	attrs := node.ExtendedAttributes
+	for _, a := range []struct {
+		name string
+		acl  []ACLEntry
+	}{
+		{aclAccessXattr, node.ACL},
+		{aclDefaultXattr, node.DefaultACL},
+	} {
+		if len(a.acl) == 0 {
+			continue
+		}
+
+		buf, err := encodeACL(a.acl)
+		if err != nil {
+			continue
+		}
+
+		attrs = append(attrs[:len(attrs):len(attrs)], ExtendedAttribute{Name: a.name, Value: buf})
+	}
+
+	return attrs
+}
@@ -0,0 +1,80 @@
+package restic
+
+import (
+	"syscall"
+
+	"github.com/pkg/xattr"
+
+	"restic/debug"
+	"restic/errors"
+)
+
+// getACL returns the ACL stored in the extended attribute name of path, or
+// nil if there is none or the file system does not support ACLs.
+func getACL(path, name string) ([]ACLEntry, error) {
+	buf, err := xattr.Get(path, name)
+	if err != nil {
+		if e, ok := err.(*xattr.Error); ok && (e.Err == syscall.ENODATA || e.Err == syscall.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "Getxattr")
+	}
+
+	acl, err := decodeACL(buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%v of %v", name, path)
+	}
+	return acl, nil
+}
+
+// fillACL reads the access ACL and, for directories, the default ACL.
+func (node *Node) fillACL(path string) error {
+	if node.Type == "symlink" {
+		return nil
+	}
+
+	acl, err := getACL(path, aclAccessXattr)
+	if err != nil {
+		return err
+	}
+	node.ACL = acl
+
+	if node.Type == "dir" {
+		acl, err = getACL(path, aclDefaultXattr)
+		if err != nil {
+			return err
+		}
+		node.DefaultACL = acl
+	}
+
+	debug.Log("ACLs of %v: %v, default %v", path, node.ACL, node.DefaultACL)
+	return nil
+}
+
+func setACL(path, name string, acl []ACLEntry) error {
+	buf, err := encodeACL(acl)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(xattr.Set(path, name, buf), "Setxattr")
+}
+
+// restoreACL sets the ACLs saved in the node on path. This must be done after
+// the mode has been restored, Chmod changes the permissions of the entries
+// "user_obj", "mask" and "other".
+func (node Node) restoreACL(path string) error {
+	if len(node.ACL) > 0 {
+		if err := setACL(path, aclAccessXattr, node.ACL); err != nil {
+			return err
+		}
+	}
+
+	if len(node.DefaultACL) > 0 && node.Type == "dir" {
+		if err := setACL(path, aclDefaultXattr, node.DefaultACL); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package restic
+
+// fillACL is a no-op, POSIX ACLs are only supported on Linux.
+func (node *Node) fillACL(path string) error {
+	return nil
+}
+
+// restoreACL is a no-op, POSIX ACLs are only supported on Linux.
+func (node Node) restoreACL(path string) error {
+	return nil
+}
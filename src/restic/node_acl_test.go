@@ -0,0 +1,59 @@
+package restic
+
+import (
+	"testing"
+
+	. "restic/test"
+)
+
+func TestACLEncodeDecode(t *testing.T) {
+	acl := []ACLEntry{
+		{Tag: "user_obj", Perm: 6},
+		{Tag: "user", ID: 1000, Perm: 4},
+		{Tag: "group_obj", Perm: 4},
+		{Tag: "group", ID: 100, Perm: 7},
+		{Tag: "mask", Perm: 7},
+		{Tag: "other", Perm: 0},
+	}
+
+	buf, err := encodeACL(acl)
+	OK(t, err)
+	Equals(t, 4+len(acl)*aclXattrEntrySize, len(buf))
+
+	acl2, err := decodeACL(buf)
+	OK(t, err)
+	Equals(t, acl, acl2)
+
+	if _, err := encodeACL([]ACLEntry{{Tag: "foo"}}); err == nil {
+		t.Errorf("encoding an invalid tag did not return an error")
+	}
+
+	for _, buf := range [][]byte{
+		nil,
+		{2, 0, 0, 0, 1},
+		{1, 0, 0, 0},
+		{2, 0, 0, 0, 0x40, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if _, err := decodeACL(buf); err == nil {
+			t.Errorf("decoding invalid ACL %v did not return an error", buf)
+		}
+	}
+}
+
+func TestExtendedAttributesWithACL(t *testing.T) {
+	node := Node{
+		ExtendedAttributes: []ExtendedAttribute{{Name: "user.foo", Value: []byte("bar")}},
+		ACL:                []ACLEntry{{Tag: "user_obj", Perm: 6}, {Tag: "group_obj", Perm: 4}, {Tag: "other", Perm: 4}},
+	}
+
+	attrs := node.ExtendedAttributesWithACL()
+	Equals(t, 2, len(attrs))
+	Equals(t, "user.foo", attrs[0].Name)
+	Equals(t, aclAccessXattr, attrs[1].Name)
+
+	acl, err := decodeACL(attrs[1].Value)
+	OK(t, err)
+	Equals(t, node.ACL, acl)
+
+	Equals(t, 1, len(node.ExtendedAttributes))
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package restic
+
+// fillFlags is a no-op, inode flags are only supported on Linux.
+func (node *Node) fillFlags(path string) error {
+	return nil
+}
+
+// restoreFlags is a no-op, inode flags are only supported on Linux.
+func (node Node) restoreFlags(path string) error {
+	return nil
+}
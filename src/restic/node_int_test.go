@@ -0,0 +1,56 @@
+package restic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	. "restic/test"
+)
+
+func TestRestoreMetadataError(t *testing.T) {
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(tempdir, "file")
+	OK(t, ioutil.WriteFile(path, []byte("content"), 0600))
+
+	node := Node{
+		Name:    "file",
+		Type:    "file",
+		Mode:    0644,
+		ModTime: time.Unix(1234567890, 0),
+	}
+
+	OK(t, node.restoreMetadata(path))
+
+	oldLchown := lchown
+	defer func() {
+		lchown = oldLchown
+	}()
+	lchown = func(string, int, int) error {
+		return &os.LinkError{Op: "lchown", Err: syscall.EPERM}
+	}
+
+	err := node.restoreMetadata(path)
+	merr, ok := err.(*MetadataError)
+	if !ok {
+		t.Fatalf("expected a MetadataError, got %T: %v", err, err)
+	}
+
+	if len(merr.Errors) != 1 || merr.Errors[MetadataOwner] == nil {
+		t.Fatalf("wrong categories in error: %v", err)
+	}
+
+	// the other metadata is restored nevertheless
+	fi, err := os.Stat(path)
+	OK(t, err)
+	Equals(t, os.FileMode(0644), fi.Mode().Perm())
+	Assert(t, fi.ModTime().Equal(node.ModTime), "wrong modification time %v", fi.ModTime())
+
+	Assert(t, PlatformMetadata(MetadataOwner), "owner is not platform-specific metadata")
+	Assert(t, !PlatformMetadata(MetadataMode), "mode is platform-specific metadata")
+}
@@ -3,9 +3,11 @@ package restic
 import (
 	"path/filepath"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 
+	"restic/debug"
 	"restic/errors"
 
 	"restic/fs"
@@ -35,3 +37,86 @@ func (node Node) restoreSymlinkTimestamps(path string, utimes [2]syscall.Timespe
 func (s statUnix) atim() syscall.Timespec { return s.Atim }
 func (s statUnix) mtim() syscall.Timespec { return s.Mtim }
 func (s statUnix) ctim() syscall.Timespec { return s.Ctim }
+
+// Inode flags as defined in linux/fs.h, these can be queried and modified
+// with lsattr(1) and chattr(1).
+const (
+	fsImmutableFlag = 0x00000010
+	fsAppendFlag    = 0x00000020
+
+	// supportedFlags are the inode flags which are saved and restored.
+	supportedFlags = fsImmutableFlag | fsAppendFlag
+)
+
+// ioctl request numbers FS_IOC_GETFLAGS and FS_IOC_SETFLAGS, the size of a
+// long is encoded in them.
+var (
+	fsIocGetFlags = uintptr(0x80006601 | unsafe.Sizeof(uintptr(0))<<16)
+	fsIocSetFlags = uintptr(0x40006602 | unsafe.Sizeof(uintptr(0))<<16)
+)
+
+// isUnsupportedFlagsError returns true if err signals that the file system
+// does not support inode flags.
+func isUnsupportedFlagsError(err error) bool {
+	switch err {
+	case syscall.ENOTTY, syscall.ENOTSUP, syscall.EINVAL, syscall.ENOSYS:
+		return true
+	}
+	return false
+}
+
+// fillFlags reads the inode flags for files and directories.
+func (node *Node) fillFlags(path string) error {
+	if node.Type != "file" && node.Type != "dir" {
+		return nil
+	}
+
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		// errors reading the file are reported by the archiver
+		debug.Log("unable to open %v for reading flags: %v", path, err)
+		return nil
+	}
+	defer syscall.Close(fd)
+
+	var flags int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), fsIocGetFlags, uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		if isUnsupportedFlagsError(errno) {
+			return nil
+		}
+		return errors.Wrap(errno, "ioctl(FS_IOC_GETFLAGS)")
+	}
+
+	node.Flags = uint32(flags) & supportedFlags
+	return nil
+}
+
+// restoreFlags sets the inode flags saved in the node on path. Setting the
+// immutable and append-only flags requires the CAP_LINUX_IMMUTABLE
+// capability, so this usually only works when run as root.
+func (node Node) restoreFlags(path string) error {
+	if node.Flags == 0 {
+		return nil
+	}
+
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return errors.Wrap(err, "Open")
+	}
+	defer syscall.Close(fd)
+
+	var flags int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), fsIocGetFlags, uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		return errors.Wrap(errno, "ioctl(FS_IOC_GETFLAGS)")
+	}
+
+	flags |= int32(node.Flags & supportedFlags)
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), fsIocSetFlags, uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		return errors.Wrap(errno, "ioctl(FS_IOC_SETFLAGS)")
+	}
+
+	return nil
+}
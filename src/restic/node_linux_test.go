@@ -0,0 +1,101 @@
+package restic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/pkg/xattr"
+
+	"restic/errors"
+	. "restic/test"
+)
+
+func TestNodeRestoreFlags(t *testing.T) {
+	tempdir, err := ioutil.TempDir(TestTempDir, "restic-test-flags-")
+	OK(t, err)
+	defer RemoveAll(t, tempdir)
+
+	filename := filepath.Join(tempdir, "file")
+	OK(t, ioutil.WriteFile(filename, []byte("foobar"), 0600))
+
+	node := Node{Type: "file", Flags: fsAppendFlag}
+	err = node.RestoreFlags(filename)
+	if err != nil {
+		errno := errors.Cause(err)
+		if errno == syscall.EPERM || isUnsupportedFlagsError(errno) {
+			t.Skipf("unable to set inode flags: %v", err)
+		}
+		t.Fatal(err)
+	}
+
+	// remove the flag again so that the temp dir can be removed
+	defer func() {
+		fd, err := syscall.Open(filename, syscall.O_RDONLY, 0)
+		OK(t, err)
+		var flags int32
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), fsIocSetFlags, uintptr(unsafe.Pointer(&flags)))
+		if errno != 0 {
+			t.Errorf("unable to reset flags: %v", errno)
+		}
+		OK(t, syscall.Close(fd))
+	}()
+
+	fi, err := os.Lstat(filename)
+	OK(t, err)
+
+	n2, err := NodeFromFileInfo(filename, fi)
+	OK(t, err)
+
+	Equals(t, uint32(fsAppendFlag), n2.Flags)
+}
+
+func TestNodeRestoreACL(t *testing.T) {
+	tempdir, err := ioutil.TempDir(TestTempDir, "restic-test-acl-")
+	OK(t, err)
+	defer RemoveAll(t, tempdir)
+
+	dirname := filepath.Join(tempdir, "dir")
+	OK(t, os.Mkdir(dirname, 0750))
+
+	acl := []ACLEntry{
+		{Tag: "user_obj", Perm: 7},
+		{Tag: "user", ID: 12345, Perm: 5},
+		{Tag: "group_obj", Perm: 5},
+		{Tag: "mask", Perm: 5},
+		{Tag: "other", Perm: 0},
+	}
+	defaultACL := []ACLEntry{
+		{Tag: "user_obj", Perm: 7},
+		{Tag: "group_obj", Perm: 5},
+		{Tag: "group", ID: 12345, Perm: 7},
+		{Tag: "mask", Perm: 7},
+		{Tag: "other", Perm: 0},
+	}
+
+	node := Node{Type: "dir", ACL: acl, DefaultACL: defaultACL}
+	err = node.restoreACL(dirname)
+	if err != nil {
+		errno := errors.Cause(err)
+		if e, ok := errno.(*xattr.Error); ok {
+			errno = e.Err
+		}
+		if errno == syscall.ENOTSUP || errno == syscall.EPERM {
+			t.Skipf("unable to set ACLs: %v", err)
+		}
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(dirname)
+	OK(t, err)
+
+	n2, err := NodeFromFileInfo(dirname, fi)
+	OK(t, err)
+
+	Equals(t, acl, n2.ACL)
+	Equals(t, defaultACL, n2.DefaultACL)
+	Equals(t, 0, len(n2.ExtendedAttributes))
+}
@@ -242,3 +242,96 @@ func AssertFsTimeEqual(t *testing.T, label string, nodeType string, t1 time.Time
 
 	Assert(t, equal, "%s: %s doesn't match (%v != %v)", label, nodeType, t1, t2)
 }
+
+func TestChangedSince(t *testing.T) {
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(tempdir, "file")
+	OK(t, ioutil.WriteFile(filename, []byte("foobar"), 0600))
+
+	// the modification time is in the past, but the change time is not
+	old := time.Now().Add(-24 * time.Hour)
+	OK(t, os.Chtimes(filename, old, old))
+
+	fi, err := os.Lstat(filename)
+	OK(t, err)
+
+	Assert(t, restic.ChangedSince(fi, old.Add(-time.Hour)),
+		"file modified after the reference is not reported as changed")
+	Assert(t, !restic.ChangedSince(fi, time.Now().Add(time.Hour)),
+		"file modified before the reference is reported as changed")
+
+	if runtime.GOOS != "windows" {
+		Assert(t, restic.ChangedSince(fi, old.Add(time.Hour)),
+			"file with a recent change time is not reported as changed")
+	}
+}
+
+func TestIsNewerSkew(t *testing.T) {
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(tempdir, "file")
+	OK(t, ioutil.WriteFile(filename, []byte("foobar"), 0600))
+
+	fi, err := os.Lstat(filename)
+	OK(t, err)
+
+	node, err := restic.NodeFromFileInfo(filename, fi)
+	OK(t, err)
+	Assert(t, !node.IsNewer(filename, fi, restic.ChangeOptions{}), "unmodified file is reported as newer")
+
+	// simulate a file system which only stores whole seconds
+	node.ModTime = node.ModTime.Add(-700 * time.Millisecond)
+	node.ChangeTime = node.ChangeTime.Add(-700 * time.Millisecond)
+
+	Assert(t, node.IsNewer(filename, fi, restic.ChangeOptions{}), "file with different timestamps is not reported as newer")
+	Assert(t, !node.IsNewer(filename, fi, restic.ChangeOptions{MtimeSkew: time.Second}), "file within the skew is reported as newer")
+
+	node.ModTime = node.ModTime.Add(-2 * time.Second)
+	Assert(t, node.IsNewer(filename, fi, restic.ChangeOptions{MtimeSkew: time.Second}), "file outside of the skew is not reported as newer")
+
+	node.ModTime = fi.ModTime()
+	node.Size++
+	Assert(t, node.IsNewer(filename, fi, restic.ChangeOptions{MtimeSkew: time.Hour}), "file with a different size is not reported as newer")
+}
+
+func TestIsNewerIgnore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("inode and change time are not available on Windows")
+	}
+
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(tempdir, "file")
+	OK(t, ioutil.WriteFile(filename, []byte("foobar"), 0600))
+
+	fi, err := os.Lstat(filename)
+	OK(t, err)
+
+	node, err := restic.NodeFromFileInfo(filename, fi)
+	OK(t, err)
+
+	// simulate a file which has been copied with its modification time
+	node.Inode++
+	node.ChangeTime = node.ChangeTime.Add(-time.Hour)
+
+	for _, test := range []struct {
+		opts  restic.ChangeOptions
+		newer bool
+	}{
+		{restic.ChangeOptions{}, true},
+		{restic.ChangeOptions{IgnoreInode: true}, true},
+		{restic.ChangeOptions{IgnoreCtime: true}, true},
+		{restic.ChangeOptions{IgnoreInode: true, IgnoreCtime: true}, false},
+	} {
+		Equals(t, test.newer, node.IsNewer(filename, fi, test.opts))
+	}
+
+	// the modification time is still compared
+	node.ModTime = node.ModTime.Add(-time.Hour)
+	Assert(t, node.IsNewer(filename, fi, restic.ChangeOptions{IgnoreInode: true, IgnoreCtime: true}),
+		"file with a different modification time is not reported as newer")
+}
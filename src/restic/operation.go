@@ -0,0 +1,110 @@
+package restic
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"restic/debug"
+)
+
+// Operation records that an operation which maintains the repository, such
+// as check or prune, has finished. Only the latest record of each operation is
+// kept, it is shown by the status command.
+type Operation struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Hostname  string    `json:"hostname,omitempty"`
+
+	// Error is the error the operation failed with, it is empty if the
+	// operation was successful.
+	Error string `json:"error,omitempty"`
+
+	id *ID
+}
+
+// NewOperation returns a new record for operation, which finished with err.
+func NewOperation(operation string, err error) *Operation {
+	op := &Operation{
+		Time:      time.Now(),
+		Operation: operation,
+	}
+
+	if err != nil {
+		op.Error = err.Error()
+	}
+
+	// the hostname is only informational
+	op.Hostname, _ = os.Hostname()
+
+	return op
+}
+
+// LoadOperation loads the operation record with the id and returns it.
+func LoadOperation(ctx context.Context, repo Repository, id ID) (*Operation, error) {
+	op := &Operation{id: &id}
+	err := repo.LoadJSONUnpacked(ctx, OperationFile, id, op)
+	if err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+// LoadAllOperations returns a list of all operation records in the repo.
+func LoadAllOperations(ctx context.Context, repo Repository) (list []*Operation, err error) {
+	for id := range repo.List(ctx, OperationFile) {
+		op, err := LoadOperation(ctx, repo, id)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, op)
+	}
+	return list, nil
+}
+
+// LatestOperations returns the latest record of each operation in list.
+func LatestOperations(list []*Operation) map[string]*Operation {
+	latest := make(map[string]*Operation)
+	for _, op := range list {
+		if l, ok := latest[op.Operation]; !ok || op.Time.After(l.Time) {
+			latest[op.Operation] = op
+		}
+	}
+	return latest
+}
+
+// SaveOperation saves op in the repo and removes the older records of the
+// same operation. Errors removing them are ignored, e.g. an append-only
+// backend refuses to remove files, the latest record is still found.
+func SaveOperation(ctx context.Context, repo Repository, op *Operation) (ID, error) {
+	id, err := repo.SaveJSONUnpacked(ctx, OperationFile, op)
+	if err != nil {
+		return ID{}, err
+	}
+	op.id = &id
+
+	list, err := LoadAllOperations(ctx, repo)
+	if err != nil {
+		return id, err
+	}
+
+	for _, old := range list {
+		if old.Operation != op.Operation || old.id.Equal(id) || old.Time.After(op.Time) {
+			continue
+		}
+
+		err = repo.Backend().Remove(ctx, Handle{Type: OperationFile, Name: old.id.String()})
+		if err != nil {
+			debug.Log("unable to remove operation %v: %v", old.id.Str(), err)
+		}
+	}
+
+	return id, nil
+}
+
+// ID returns the ID of the operation record.
+func (op Operation) ID() *ID {
+	return op.id
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"restic"
+	"strings"
 	"sync"
 
 	"restic/debug"
@@ -37,10 +39,32 @@ func NewPacker(k *crypto.Key, wr io.Writer) *Packer {
 // Add saves the data read from rd as a new blob to the packer. Returned is the
 // number of bytes written to the pack.
 func (p *Packer) Add(t restic.BlobType, id restic.ID, data []byte) (int, error) {
+	return p.AddToDomain(t, id, "", data)
+}
+
+// AddToDomain saves the data as a new blob which belongs to the encryption
+// domain to the packer. The domain is recorded in the header. Returned is the
+// number of bytes written to the pack.
+func (p *Packer) AddToDomain(t restic.BlobType, id restic.ID, domain string, data []byte) (int, error) {
+	return p.AddBlob(restic.Blob{Type: t, ID: id, Domain: domain}, data)
+}
+
+// AddBlob saves the data as a new blob to the packer. The type, ID, encryption
+// domain and uncompressed length are taken from b and recorded in the header.
+// Returned is the number of bytes written to the pack.
+func (p *Packer) AddBlob(b restic.Blob, data []byte) (int, error) {
+	if err := ValidDomain(b.Domain); err != nil {
+		return 0, err
+	}
+
+	if uint64(b.UncompressedLength) > math.MaxUint32 {
+		return 0, errors.Errorf("uncompressed length %d of blob %v is too large", b.UncompressedLength, b.ID.Str())
+	}
+
 	p.m.Lock()
 	defer p.m.Unlock()
 
-	c := restic.Blob{Type: t, ID: id}
+	c := restic.Blob{Type: b.Type, ID: b.ID, Domain: b.Domain, UncompressedLength: b.UncompressedLength}
 
 	n, err := p.wr.Write(data)
 	c.Length = uint(n)
@@ -60,6 +84,34 @@ type headerEntry struct {
 	ID     restic.ID
 }
 
+// domainEntryType marks a header entry which sets the encryption domain of
+// the blobs listed after it. The name of the domain is stored in the ID,
+// padded with zero bytes, the length is zero. The blobs listed before the
+// first domain entry belong to the default domain.
+const domainEntryType = 2
+
+// compressedEntryType marks a header entry which states that the blob listed
+// directly after it is compressed. The length is the length of the
+// uncompressed plaintext, the ID is zero.
+const compressedEntryType = 3
+
+// MaxDomainLength is the maximum length of the name of an encryption domain.
+const MaxDomainLength = len(restic.ID{})
+
+// ValidDomain returns an error if name cannot be used as the name of an
+// encryption domain.
+func ValidDomain(name string) error {
+	if len(name) > MaxDomainLength {
+		return errors.Errorf("name of encryption domain %q is longer than %d bytes", name, MaxDomainLength)
+	}
+
+	if strings.IndexByte(name, 0) >= 0 {
+		return errors.Errorf("name of encryption domain %q contains a null byte", name)
+	}
+
+	return nil
+}
+
 // Finalize writes the header for all added blobs and finalizes the pack.
 // Returned are the number of bytes written, including the header. If the
 // underlying writer implements io.Closer, it is closed.
@@ -94,7 +146,7 @@ func (p *Packer) Finalize() (uint, error) {
 	bytesWritten += uint(hdrBytes)
 
 	// write length
-	err = binary.Write(p.wr, binary.LittleEndian, uint32(restic.CiphertextLength(len(p.blobs)*int(entrySize))))
+	err = binary.Write(p.wr, binary.LittleEndian, uint32(hdrBytes))
 	if err != nil {
 		return 0, errors.Wrap(err, "binary.Write")
 	}
@@ -111,7 +163,32 @@ func (p *Packer) Finalize() (uint, error) {
 
 // writeHeader constructs and writes the header to wr.
 func (p *Packer) writeHeader(wr io.Writer) (bytesWritten uint, err error) {
+	var domain string
 	for _, b := range p.blobs {
+		if b.Domain != domain {
+			entry := headerEntry{Type: domainEntryType}
+			copy(entry.ID[:], b.Domain)
+
+			err := binary.Write(wr, binary.LittleEndian, entry)
+			if err != nil {
+				return bytesWritten, errors.Wrap(err, "binary.Write")
+			}
+
+			bytesWritten += entrySize
+			domain = b.Domain
+		}
+
+		if b.IsCompressed() {
+			entry := headerEntry{Type: compressedEntryType, Length: uint32(b.UncompressedLength)}
+
+			err := binary.Write(wr, binary.LittleEndian, entry)
+			if err != nil {
+				return bytesWritten, errors.Wrap(err, "binary.Write")
+			}
+
+			bytesWritten += entrySize
+		}
+
 		entry := headerEntry{
 			Length: uint32(b.Length),
 			ID:     b.ID,
@@ -266,6 +343,9 @@ func List(k *crypto.Key, rd io.ReaderAt, size int64) (entries []restic.Blob, err
 		return nil, err
 	}
 
+	// the blobs are stored in front of the header and its length
+	dataSize := size - int64(len(buf)) - int64(binary.Size(uint32(0)))
+
 	n, err := crypto.Decrypt(k, buf, buf)
 	if err != nil {
 		return nil, err
@@ -277,6 +357,8 @@ func List(k *crypto.Key, rd io.ReaderAt, size int64) (entries []restic.Blob, err
 	entries = make([]restic.Blob, 0, uint(n)/entrySize)
 
 	pos := uint(0)
+	domain := ""
+	uncompressed := uint(0)
 	for {
 		e := headerEntry{}
 		err = binary.Read(hdrRd, binary.LittleEndian, &e)
@@ -288,11 +370,27 @@ func List(k *crypto.Key, rd io.ReaderAt, size int64) (entries []restic.Blob, err
 			return nil, errors.Wrap(err, "binary.Read")
 		}
 
+		if e.Type == domainEntryType {
+			domain = string(bytes.TrimRight(e.ID[:], "\x00"))
+			continue
+		}
+
+		if e.Type == compressedEntryType {
+			if e.Length == 0 {
+				return nil, errors.New("compressed blob with uncompressed length zero")
+			}
+			uncompressed = uint(e.Length)
+			continue
+		}
+
 		entry := restic.Blob{
-			Length: uint(e.Length),
-			ID:     e.ID,
-			Offset: pos,
+			Length:             uint(e.Length),
+			ID:                 e.ID,
+			Offset:             pos,
+			Domain:             domain,
+			UncompressedLength: uncompressed,
 		}
+		uncompressed = 0
 
 		switch e.Type {
 		case 0:
@@ -308,5 +406,14 @@ func List(k *crypto.Key, rd io.ReaderAt, size int64) (entries []restic.Blob, err
 		pos += uint(e.Length)
 	}
 
+	if uncompressed != 0 {
+		return nil, errors.New("header ends with a compressed entry without a blob")
+	}
+
+	if int64(pos) > dataSize {
+		err := InvalidFileError{Message: fmt.Sprintf("blobs in the header need %d bytes, but the pack only contains %d bytes of data", pos, dataSize)}
+		return nil, errors.Wrap(err, "List")
+	}
+
 	return entries, nil
 }
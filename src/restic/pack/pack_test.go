@@ -143,3 +143,80 @@ func TestShortPack(t *testing.T) {
 	OK(t, b.Save(context.TODO(), handle, bytes.NewReader(packData)))
 	verifyBlobs(t, bufs, k, restic.ReaderAt(b, handle), packSize)
 }
+
+func TestListBlobsBeyondData(t *testing.T) {
+	k := crypto.NewRandomKey()
+
+	_, packData, packSize := newPack(t, k, testLens)
+
+	// remove some bytes from the blob data, the header is still intact
+	packData = packData[100:]
+	_, err := pack.List(k, bytes.NewReader(packData), int64(packSize)-100)
+	Assert(t, err != nil, "List() did not return an error for blobs extending beyond the data")
+}
+
+func TestPackDomains(t *testing.T) {
+	k := crypto.NewRandomKey()
+
+	domains := []string{"", "", "foo", "foo", "", "0123456789abcdef0123456789abcdef"}
+	p := pack.NewPacker(k, nil)
+	for i, domain := range domains {
+		data := Random(i, 100+i)
+		_, err := p.AddToDomain(restic.DataBlob, restic.Hash(data), domain, data)
+		OK(t, err)
+	}
+
+	_, err := p.Finalize()
+	OK(t, err)
+
+	packData := p.Writer().(*bytes.Buffer).Bytes()
+	Equals(t, uint(len(packData)), p.Size())
+
+	entries, err := pack.List(k, bytes.NewReader(packData), int64(len(packData)))
+	OK(t, err)
+	Equals(t, len(domains), len(entries))
+
+	for i, e := range entries {
+		Equals(t, domains[i], e.Domain)
+		Equals(t, uint(100+i), e.Length)
+	}
+}
+
+func TestPackInvalidDomain(t *testing.T) {
+	p := pack.NewPacker(crypto.NewRandomKey(), nil)
+
+	for _, domain := range []string{"0123456789abcdef0123456789abcdef0", "foo\x00"} {
+		_, err := p.AddToDomain(restic.DataBlob, restic.ID{}, domain, []byte("foo"))
+		Assert(t, err != nil, "no error for invalid domain %q", domain)
+	}
+}
+
+func TestPackCompressed(t *testing.T) {
+	k := crypto.NewRandomKey()
+
+	uncompressed := []uint{0, 1000, 0, 2000, 3000, 0}
+	p := pack.NewPacker(k, nil)
+	for i, length := range uncompressed {
+		data := Random(i, 100+i)
+		b := restic.Blob{Type: restic.TreeBlob, ID: restic.Hash(data), Domain: "foo", UncompressedLength: length}
+		_, err := p.AddBlob(b, data)
+		OK(t, err)
+	}
+
+	_, err := p.Finalize()
+	OK(t, err)
+
+	packData := p.Writer().(*bytes.Buffer).Bytes()
+	entries, err := pack.List(k, bytes.NewReader(packData), int64(len(packData)))
+	OK(t, err)
+	Equals(t, len(uncompressed), len(entries))
+
+	var offset uint
+	for i, e := range entries {
+		Equals(t, uncompressed[i], e.UncompressedLength)
+		Equals(t, uint(100+i), e.Length)
+		Equals(t, offset, e.Offset)
+		Equals(t, "foo", e.Domain)
+		offset += e.Length
+	}
+}
@@ -50,6 +50,11 @@ type Dir struct {
 
 	Entries [](<-chan Result)
 	result  chan<- Result
+
+	// points to the old node if the directory has not changed since the
+	// parent snapshot, its contents were not walked in this case.
+	// interface{} is used to prevent circular import
+	Node interface{}
 }
 
 func (e Dir) Path() string          { return e.path }
@@ -79,7 +84,12 @@ func readDirNames(dirname string) ([]string, error) {
 // dirs). If false is returned, files are ignored and dirs are not even walked.
 type SelectFunc func(item string, fi os.FileInfo) bool
 
-func walk(ctx context.Context, basedir, dir string, selectFunc SelectFunc, jobs chan<- Job, res chan<- Result) (excluded bool) {
+// UnchangedFunc returns the old node for a directory (given as the path
+// relative to the base directory) if neither the directory nor anything below
+// it has changed since the parent snapshot, and nil otherwise.
+type UnchangedFunc func(path string) interface{}
+
+func walk(ctx context.Context, basedir, dir string, selectFunc SelectFunc, unchanged UnchangedFunc, jobs chan<- Job, res chan<- Result) (excluded bool) {
 	debug.Log("start on %q, basedir %q", dir, basedir)
 
 	relpath, err := filepath.Rel(basedir, dir)
@@ -113,6 +123,17 @@ func walk(ctx context.Context, basedir, dir string, selectFunc SelectFunc, jobs
 		return
 	}
 
+	if unchanged != nil {
+		if node := unchanged(relpath); node != nil {
+			debug.Log("dir %v is unchanged, not walking it, res %p", dir, res)
+			select {
+			case jobs <- Dir{basedir: basedir, path: relpath, info: info, Node: node, result: res}:
+			case <-ctx.Done():
+			}
+			return
+		}
+	}
+
 	debug.RunHook("pipe.readdirnames", dir)
 	names, err := readDirNames(dir)
 	if err != nil {
@@ -157,7 +178,7 @@ func walk(ctx context.Context, basedir, dir string, selectFunc SelectFunc, jobs
 		// between walk and open
 		debug.RunHook("pipe.walk2", filepath.Join(relpath, name))
 
-		walk(ctx, basedir, subpath, selectFunc, jobs, ch)
+		walk(ctx, basedir, subpath, selectFunc, unchanged, jobs, ch)
 	}
 
 	debug.Log("sending dirjob for %q, basedir %q, res %p", dir, basedir, res)
@@ -193,6 +214,13 @@ func cleanupPath(path string) ([]string, error) {
 // Walk sends a Job for each file and directory it finds below the paths. When
 // the channel done is closed, processing stops.
 func Walk(ctx context.Context, walkPaths []string, selectFunc SelectFunc, jobs chan<- Job, res chan<- Result) {
+	WalkUnchanged(ctx, walkPaths, selectFunc, nil, jobs, res)
+}
+
+// WalkUnchanged works like Walk, but directories for which unchanged returns
+// a node are not walked. Instead, a Dir job without entries is sent for them,
+// with the node stored in the field Node.
+func WalkUnchanged(ctx context.Context, walkPaths []string, selectFunc SelectFunc, unchanged UnchangedFunc, jobs chan<- Job, res chan<- Result) {
 	var paths []string
 
 	for _, p := range walkPaths {
@@ -216,7 +244,7 @@ func Walk(ctx context.Context, walkPaths []string, selectFunc SelectFunc, jobs c
 	for _, path := range paths {
 		debug.Log("start walker for %v", path)
 		ch := make(chan Result, 1)
-		excluded := walk(ctx, filepath.Dir(path), path, selectFunc, jobs, ch)
+		excluded := walk(ctx, filepath.Dir(path), path, selectFunc, unchanged, jobs, ch)
 
 		if excluded {
 			debug.Log("walker for %v done, it was excluded by the filter", path)
@@ -11,9 +11,40 @@ import (
 
 const minTickerTime = time.Second / 60
 
+// nonTerminalInterval is the default interval between progress updates when
+// stdout is not a terminal, so logs are not flooded.
+const nonTerminalInterval = 10 * time.Second
+
 var isTerminal = terminal.IsTerminal(int(os.Stdout.Fd()))
 var forceUpdateProgress = make(chan bool)
 
+// progressInterval is the interval between two progress updates, zero
+// disables periodic updates.
+var progressInterval = defaultProgressInterval()
+
+func defaultProgressInterval() time.Duration {
+	if isTerminal {
+		return time.Second
+	}
+	return nonTerminalInterval
+}
+
+// SetProgressFPS sets the number of progress updates per second for all
+// progress reporters created afterwards. A value of zero restores the default,
+// which is one update per second on a terminal and one every ten seconds
+// otherwise.
+func SetProgressFPS(fps float64) {
+	if fps <= 0 {
+		progressInterval = defaultProgressInterval()
+		return
+	}
+
+	progressInterval = time.Duration(float64(time.Second) / fps)
+	if progressInterval < minTickerTime {
+		progressInterval = minTickerTime
+	}
+}
+
 // Progress reports progress on an operation.
 type Progress struct {
 	OnStart  func()
@@ -48,15 +79,11 @@ type ProgressFunc func(s Stat, runtime time.Duration, ticker bool)
 
 // NewProgress returns a new progress reporter. When Start() is called, the
 // function OnStart is executed once. Afterwards the function OnUpdate is
-// called when new data arrives or at least every d interval. The function
-// OnDone is called when Done() is called. Both functions are called
-// synchronously and can use shared state.
+// called when new data arrives (only on a terminal) or at least once per
+// interval set by SetProgressFPS. The function OnDone is called when Done() is
+// called. Both functions are called synchronously and can use shared state.
 func NewProgress() *Progress {
-	var d time.Duration
-	if isTerminal {
-		d = time.Second
-	}
-	return &Progress{d: d}
+	return &Progress{d: progressInterval}
 }
 
 // Start resets and runs the progress reporter.
@@ -0,0 +1,28 @@
+package restic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetProgressFPS(t *testing.T) {
+	defer SetProgressFPS(0)
+
+	var tests = []struct {
+		fps float64
+		d   time.Duration
+	}{
+		{0, defaultProgressInterval()},
+		{1, time.Second},
+		{0.1, 10 * time.Second},
+		{4, 250 * time.Millisecond},
+		{1000, minTickerTime},
+	}
+
+	for _, test := range tests {
+		SetProgressFPS(test.fps)
+		if p := NewProgress(); p.d != test.d {
+			t.Errorf("fps %v: want interval %v, got %v", test.fps, test.d, p.d)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package restic
 
 import (
 	"context"
+	"io"
 	"restic/crypto"
 )
 
@@ -13,6 +14,7 @@ type Repository interface {
 	Backend() Backend
 
 	Key() *crypto.Key
+	DomainKey(domain string) (*crypto.Key, error)
 
 	SetIndex(Index)
 
@@ -27,6 +29,7 @@ type Repository interface {
 
 	List(context.Context, FileType) <-chan ID
 	ListPack(context.Context, ID) ([]Blob, int64, error)
+	PackBlobs(io.ReaderAt, int64) ([]Blob, error)
 
 	Flush() error
 
@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"restic"
+	"restic/compression"
+	"restic/crypto"
+	"restic/errors"
+)
+
+// SetCompression sets the compression mode for new blobs of type t, which
+// overrides the mode stored in the config. It has no effect if the repository
+// version does not allow compression.
+func (r *Repository) SetCompression(t restic.BlobType, m compression.Mode) {
+	if r.compression == nil {
+		r.compression = make(map[restic.BlobType]compression.Mode)
+	}
+	r.compression[t] = m
+}
+
+// compressBlob compresses data of a blob of type t if the repository version
+// allows it. The compressed data is returned in a buffer from the pool, it is
+// nil if data is to be stored uncompressed.
+func (r *Repository) compressBlob(t restic.BlobType, data []byte) ([]byte, error) {
+	if !r.cfg.CompressionAllowed() {
+		return nil, nil
+	}
+
+	mode, ok := r.compression[t]
+	if !ok {
+		var err error
+		mode, err = compression.ParseMode(string(r.cfg.Compression))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buf := getBuf()
+	compressed, err := compression.Compress(buf, data, mode)
+	if compressed == nil {
+		freeBuf(buf)
+	}
+
+	return compressed, err
+}
+
+// decompressBlob decompresses the compressed plaintext stored at the start of
+// buf. The result is copied to buf, which must have a capacity of at least
+// length bytes.
+func decompressBlob(buf []byte, length uint) ([]byte, error) {
+	if uint(cap(buf)) < length {
+		return nil, errors.Errorf("buffer is too small: %v < %v", cap(buf), length)
+	}
+
+	plaintext, err := compression.Decompress(getBuf(), buf, length)
+	if err != nil {
+		return nil, err
+	}
+	defer freeBuf(plaintext)
+
+	buf = buf[:length]
+	copy(buf, plaintext)
+	return buf, nil
+}
+
+// decryptBlob decrypts the ciphertext of blob with key and decompresses it if
+// the blob is compressed. The plaintext is stored in buf if it is large
+// enough, the possibly grown buffer is returned.
+func decryptBlob(key *crypto.Key, blob restic.Blob, ciphertext, buf []byte) ([]byte, error) {
+	size := len(ciphertext)
+	if int(blob.UncompressedLength) > size {
+		size = int(blob.UncompressedLength)
+	}
+
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+
+	n, err := crypto.Decrypt(key, buf[:len(ciphertext)], ciphertext)
+	if err != nil {
+		return buf, err
+	}
+
+	if !blob.IsCompressed() {
+		return buf[:n], nil
+	}
+
+	return decompressBlob(buf[:n], blob.UncompressedLength)
+}
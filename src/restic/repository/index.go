@@ -28,6 +28,9 @@ type indexEntry struct {
 	packID restic.ID
 	offset uint
 	length uint
+	domain string
+
+	uncompressedLength uint
 }
 
 // NewIndex returns a new index.
@@ -43,6 +46,9 @@ func (idx *Index) store(blob restic.PackedBlob) {
 		packID: blob.PackID,
 		offset: blob.Offset,
 		length: blob.Length,
+		domain: blob.Domain,
+
+		uncompressedLength: blob.UncompressedLength,
 	}
 	h := restic.BlobHandle{ID: blob.ID, Type: blob.Type}
 	idx.pack[h] = append(idx.pack[h], newEntry)
@@ -124,10 +130,12 @@ func (idx *Index) Lookup(id restic.ID, tpe restic.BlobType) (blobs []restic.Pack
 
 			blob := restic.PackedBlob{
 				Blob: restic.Blob{
-					Type:   tpe,
-					Length: p.length,
-					ID:     id,
-					Offset: p.offset,
+					Type:               tpe,
+					Length:             p.length,
+					ID:                 id,
+					Offset:             p.offset,
+					Domain:             p.domain,
+					UncompressedLength: p.uncompressedLength,
 				},
 				PackID: p.packID,
 			}
@@ -152,10 +160,12 @@ func (idx *Index) ListPack(id restic.ID) (list []restic.PackedBlob) {
 			if entry.packID == id {
 				list = append(list, restic.PackedBlob{
 					Blob: restic.Blob{
-						ID:     h.ID,
-						Type:   h.Type,
-						Length: entry.length,
-						Offset: entry.offset,
+						ID:                 h.ID,
+						Type:               h.Type,
+						Length:             entry.length,
+						Offset:             entry.offset,
+						Domain:             entry.domain,
+						UncompressedLength: entry.uncompressedLength,
 					},
 					PackID: entry.packID,
 				})
@@ -177,14 +187,14 @@ func (idx *Index) Has(id restic.ID, tpe restic.BlobType) bool {
 }
 
 // LookupSize returns the length of the plaintext content of the blob with the
-// given id.
+// given id. For compressed blobs, this is the uncompressed length.
 func (idx *Index) LookupSize(id restic.ID, tpe restic.BlobType) (plaintextLength uint, err error) {
 	blobs, err := idx.Lookup(id, tpe)
 	if err != nil {
 		return 0, err
 	}
 
-	return uint(restic.PlaintextLength(int(blobs[0].Length))), nil
+	return blobs[0].DataLength(), nil
 }
 
 // Supersedes returns the list of indexes this index supersedes, if any.
@@ -227,10 +237,12 @@ func (idx *Index) Each(done chan struct{}) <-chan restic.PackedBlob {
 					return
 				case ch <- restic.PackedBlob{
 					Blob: restic.Blob{
-						ID:     h.ID,
-						Type:   h.Type,
-						Offset: blob.offset,
-						Length: blob.length,
+						ID:                 h.ID,
+						Type:               h.Type,
+						Offset:             blob.offset,
+						Length:             blob.length,
+						Domain:             blob.domain,
+						UncompressedLength: blob.uncompressedLength,
 					},
 					PackID: blob.packID,
 				}:
@@ -284,6 +296,9 @@ type blobJSON struct {
 	Type   restic.BlobType `json:"type"`
 	Offset uint            `json:"offset"`
 	Length uint            `json:"length"`
+	Domain string          `json:"domain,omitempty"`
+
+	UncompressedLength uint `json:"uncompressed_length,omitempty"`
 }
 
 // generatePackList returns a list of packs.
@@ -318,10 +333,12 @@ func (idx *Index) generatePackList() ([]*packJSON, error) {
 
 			// add blob
 			p.Blobs = append(p.Blobs, blobJSON{
-				ID:     h.ID,
-				Type:   h.Type,
-				Offset: blob.offset,
-				Length: blob.length,
+				ID:                 h.ID,
+				Type:               h.Type,
+				Offset:             blob.offset,
+				Length:             blob.length,
+				Domain:             blob.domain,
+				UncompressedLength: blob.uncompressedLength,
 			})
 		}
 	}
@@ -472,10 +489,12 @@ func DecodeIndex(buf []byte) (idx *Index, err error) {
 		for _, blob := range pack.Blobs {
 			idx.store(restic.PackedBlob{
 				Blob: restic.Blob{
-					Type:   blob.Type,
-					ID:     blob.ID,
-					Offset: blob.Offset,
-					Length: blob.Length,
+					Type:               blob.Type,
+					ID:                 blob.ID,
+					Offset:             blob.Offset,
+					Length:             blob.Length,
+					Domain:             blob.Domain,
+					UncompressedLength: blob.UncompressedLength,
 				},
 				PackID: pack.ID,
 			})
@@ -504,10 +523,12 @@ func DecodeOldIndex(buf []byte) (idx *Index, err error) {
 		for _, blob := range pack.Blobs {
 			idx.store(restic.PackedBlob{
 				Blob: restic.Blob{
-					Type:   blob.Type,
-					ID:     blob.ID,
-					Offset: blob.Offset,
-					Length: blob.Length,
+					Type:               blob.Type,
+					ID:                 blob.ID,
+					Offset:             blob.Offset,
+					Length:             blob.Length,
+					Domain:             blob.Domain,
+					UncompressedLength: blob.UncompressedLength,
 				},
 				PackID: pack.ID,
 			})
@@ -379,3 +379,92 @@ func TestIndexPacks(t *testing.T) {
 	idxPacks := idx.Packs()
 	Assert(t, packs.Equals(idxPacks), "packs in index do not match packs added to index")
 }
+
+func TestMasterIndexFindExisting(t *testing.T) {
+	mi := repository.NewMasterIndex()
+
+	present := restic.NewBlobSet()
+	for i := 0; i < 3; i++ {
+		idx := repository.NewIndex()
+		packID := restic.NewRandomID()
+		for j := 0; j < 10; j++ {
+			h := restic.BlobHandle{ID: restic.NewRandomID(), Type: restic.DataBlob}
+			idx.Store(restic.PackedBlob{
+				Blob: restic.Blob{
+					Type:   h.Type,
+					ID:     h.ID,
+					Offset: uint(j * 100),
+					Length: 100,
+				},
+				PackID: packID,
+			})
+			present.Insert(h)
+		}
+		mi.Insert(idx)
+	}
+
+	query := restic.NewBlobSet()
+	for h := range present {
+		query.Insert(h)
+
+		// same ID, but different type
+		query.Insert(restic.BlobHandle{ID: h.ID, Type: restic.TreeBlob})
+	}
+
+	for i := 0; i < 10; i++ {
+		query.Insert(restic.BlobHandle{ID: restic.NewRandomID(), Type: restic.DataBlob})
+	}
+
+	existing := mi.FindExisting(query)
+	Assert(t, existing.Equals(present),
+		"wrong blobs returned, want %v, got %v", present, existing)
+}
+
+func TestMasterIndexDomain(t *testing.T) {
+	idx := repository.NewIndex()
+	packID := restic.NewRandomID()
+
+	blobs := make(map[string]restic.ID)
+	for i, domain := range []string{"", "a", "b"} {
+		id := restic.NewRandomID()
+		idx.Store(restic.PackedBlob{
+			Blob: restic.Blob{
+				Type:   restic.DataBlob,
+				ID:     id,
+				Offset: uint(i * 100),
+				Length: 100,
+				Domain: domain,
+			},
+			PackID: packID,
+		})
+		blobs[domain] = id
+	}
+
+	mi := repository.NewMasterIndex()
+	mi.Insert(idx)
+	mi.SetDomain("a", false)
+
+	Assert(t, !mi.Has(blobs[""], restic.DataBlob), "blob of the default domain found")
+	Assert(t, mi.Has(blobs["a"], restic.DataBlob), "blob of the own domain not found")
+	Assert(t, !mi.Has(blobs["b"], restic.DataBlob), "blob of another domain found")
+
+	list, err := mi.Lookup(blobs["a"], restic.DataBlob)
+	OK(t, err)
+	Equals(t, "a", list[0].Domain)
+
+	_, err = mi.Lookup(blobs["b"], restic.DataBlob)
+	Assert(t, err != nil, "blob of another domain returned by Lookup()")
+
+	Equals(t, 3, len(mi.ListPack(packID)))
+
+	// with the master key, blobs of all domains can be read but only those
+	// of the default domain are used for deduplication
+	mi.SetDomain("", true)
+
+	Assert(t, mi.Has(blobs[""], restic.DataBlob), "blob of the default domain not found")
+	Assert(t, !mi.Has(blobs["b"], restic.DataBlob), "blob of another domain found")
+
+	list, err = mi.Lookup(blobs["b"], restic.DataBlob)
+	OK(t, err)
+	Equals(t, "b", list[0].Domain)
+}
@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"restic"
+	"restic/debug"
+)
+
+// CompleteIntent finishes the interrupted operation described by intent: the
+// packs which are still there are removed and the index files listed in the
+// intent are replaced by a new index which does not reference the packs any
+// more. If the operation did not remove anything before it was interrupted,
+// it is rolled back instead and the repository is left as it is. Afterwards,
+// the intent is removed. The return value is true if the operation has been
+// completed. This requires an exclusive lock on the repo.
+func CompleteIntent(ctx context.Context, repo *Repository, intent *restic.Intent) (completed bool, err error) {
+	packs, err := existingFiles(ctx, repo, restic.DataFile, intent.Packs)
+	if err != nil {
+		return false, err
+	}
+
+	indexes, err := existingFiles(ctx, repo, restic.IndexFile, intent.Indexes)
+	if err != nil {
+		return false, err
+	}
+
+	if len(packs) == len(intent.Packs) && len(indexes) == len(intent.Indexes) {
+		debug.Log("intent %v: nothing removed yet, rolling back", intent.ID().Str())
+		return false, intent.Remove(ctx, repo)
+	}
+
+	debug.Log("intent %v: removing %d of %d packs, replacing %d of %d index files",
+		intent.ID().Str(), len(packs), len(intent.Packs), len(indexes), len(intent.Indexes))
+
+	for _, id := range packs {
+		h := restic.Handle{Type: restic.DataFile, Name: id.String()}
+		if err = repo.Backend().Remove(ctx, h); err != nil {
+			return false, err
+		}
+	}
+
+	if len(indexes) > 0 {
+		mi := NewMasterIndex()
+		for _, id := range indexes {
+			idx, err := LoadIndex(ctx, repo, id)
+			if err != nil {
+				return false, err
+			}
+			mi.Insert(idx)
+		}
+
+		idx, err := mi.RebuildIndex(restic.NewIDSet(intent.Packs...))
+		if err != nil {
+			return false, err
+		}
+
+		id, err := SaveIndex(ctx, repo, idx)
+		if err != nil {
+			return false, err
+		}
+		debug.Log("saved new index as %v", id.Str())
+
+		for _, id := range indexes {
+			h := restic.Handle{Type: restic.IndexFile, Name: id.String()}
+			if err = repo.Backend().Remove(ctx, h); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	return true, intent.Remove(ctx, repo)
+}
+
+// existingFiles returns the files of type t in ids which are still stored in
+// the backend.
+func existingFiles(ctx context.Context, repo *Repository, t restic.FileType, ids restic.IDs) (restic.IDs, error) {
+	var list restic.IDs
+	for _, id := range ids {
+		ok, err := repo.Backend().Test(ctx, restic.Handle{Type: t, Name: id.String()})
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			list = append(list, id)
+		}
+	}
+
+	return list, nil
+}
@@ -0,0 +1,101 @@
+package repository_test
+
+import (
+	"context"
+	"restic"
+	"restic/repository"
+	"testing"
+)
+
+func listIndexes(t *testing.T, repo restic.Repository) restic.IDs {
+	var list restic.IDs
+	for id := range repo.List(context.TODO(), restic.IndexFile) {
+		list = append(list, id)
+	}
+
+	return list
+}
+
+func saveIntent(t *testing.T, repo restic.Repository, packs restic.IDSet) *restic.Intent {
+	intent := restic.NewIntent("test", packs.List(), listIndexes(t, repo))
+	if _, err := restic.SaveIntent(context.TODO(), repo, intent); err != nil {
+		t.Fatal(err)
+	}
+
+	return intent
+}
+
+func TestCompleteIntent(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	createRandomBlobs(t, repo, 50, 0.7)
+	saveIndex(t, repo)
+
+	packs := listPacks(t, repo)
+	if len(packs) < 3 {
+		t.Skipf("only %d packs created", len(packs))
+	}
+
+	remove := restic.NewIDSet()
+	for id := range packs {
+		remove.Insert(id)
+		if len(remove) == 2 {
+			break
+		}
+	}
+
+	// nothing has been removed, the intent is rolled back
+	intent := saveIntent(t, repo, remove)
+	completed, err := repository.CompleteIntent(context.TODO(), repo.(*repository.Repository), intent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if completed {
+		t.Errorf("intent without removed files has been completed")
+	}
+	if !listPacks(t, repo).Equals(packs) {
+		t.Errorf("packs have been removed by the rollback")
+	}
+
+	// the operation was interrupted after removing the first pack
+	intent = saveIntent(t, repo, remove)
+	first := remove.List()[0]
+	h := restic.Handle{Type: restic.DataFile, Name: first.String()}
+	if err = repo.Backend().Remove(context.TODO(), h); err != nil {
+		t.Fatal(err)
+	}
+
+	oldIndexes := restic.NewIDSet(intent.Indexes...)
+	completed, err = repository.CompleteIntent(context.TODO(), repo.(*repository.Repository), intent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !completed {
+		t.Errorf("interrupted operation has not been completed")
+	}
+	if !listPacks(t, repo).Equals(packs.Sub(remove)) {
+		t.Errorf("wrong packs after completion, want %v, got %v", packs.Sub(remove), listPacks(t, repo))
+	}
+
+	for _, id := range listIndexes(t, repo) {
+		if oldIndexes.Has(id) {
+			t.Errorf("old index %v has not been removed", id.Str())
+		}
+	}
+
+	for range repo.List(context.TODO(), restic.IntentFile) {
+		t.Errorf("intent has not been removed")
+	}
+
+	// the new index references exactly the remaining packs
+	reloadIndex(t, repo)
+	for id := range packs {
+		found := len(repo.Index().(*repository.MasterIndex).ListPack(id)) > 0
+		if found == remove.Has(id) {
+			t.Errorf("pack %v: wrong index entries, found %v", id.Str(), found)
+		}
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"restic/backend"
 	"restic/crypto"
 	"restic/debug"
+	"restic/pack"
 )
 
 var (
@@ -25,7 +26,11 @@ var (
 	ErrMaxKeysReached = errors.New("maximum number of keys reached")
 )
 
-// Key represents an encrypted master key for a repository.
+// Key represents an encrypted master key for a repository. Keys of an
+// encryption domain don't contain the master key: Data contains the metadata
+// key, which is used for all files except the config, and DomainData the data
+// key of the domain. DomainMasterData is the data key encrypted with the
+// master key, so that it can be read with all keys which have the master key.
 type Key struct {
 	Created  time.Time `json:"created"`
 	Username string    `json:"username"`
@@ -38,12 +43,52 @@ type Key struct {
 	Salt []byte `json:"salt"`
 	Data []byte `json:"data"`
 
-	user   *crypto.Key
-	master *crypto.Key
+	// Domain is the name of the encryption domain of this key, DomainData
+	// contains the encrypted data key for the domain.
+	Domain           string `json:"domain,omitempty"`
+	DomainData       []byte `json:"domain_data,omitempty"`
+	DomainMasterData []byte `json:"domain_master_data,omitempty"`
+
+	KeyMetadata
+
+	user     *crypto.Key
+	master   *crypto.Key
+	metadata *crypto.Key
+	dataKey  *crypto.Key
 
 	name string
 }
 
+// KeyMetadata describes a key and the operations restic allows with it. It is
+// stored unencrypted with the key and only checked by the client, so it does
+// not protect the repository against a modified client.
+type KeyMetadata struct {
+	// Label is a description of the key.
+	Label string `json:"label,omitempty"`
+
+	// CreatedBy is the name of the key which was used to add this key.
+	CreatedBy string `json:"created_by,omitempty"`
+
+	// Operations lists the operations which are allowed with this key. An
+	// empty list allows all operations.
+	Operations []string `json:"operations,omitempty"`
+}
+
+// Allows returns true if the operation op is allowed.
+func (m KeyMetadata) Allows(op string) bool {
+	if len(m.Operations) == 0 {
+		return true
+	}
+
+	for _, o := range m.Operations {
+		if o == op {
+			return true
+		}
+	}
+
+	return false
+}
+
 // KDFParams tracks the parameters used for the KDF. If not set, it will be
 // calibrated on the first run of AddKey().
 var KDFParams *crypto.KDFParams
@@ -86,28 +131,72 @@ func OpenKey(ctx context.Context, s *Repository, name string, password string) (
 		return nil, errors.Wrap(err, "crypto.KDF")
 	}
 
-	// decrypt master keys
-	buf := make([]byte, len(k.Data))
-	n, err := crypto.Decrypt(k.user, buf, k.Data)
+	// decrypt master keys, keys of an encryption domain only contain the
+	// metadata key
+	dec, err := decryptKey(k.user, k.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.HasMasterKey() {
+		k.master = dec
+	} else {
+		k.metadata = dec
+	}
+
+	if k.Domain != "" {
+		k.dataKey, err = decryptKey(k.user, k.DomainData)
+		if err != nil {
+			return nil, err
+		}
+
+		if !k.dataKey.Valid() {
+			return nil, errors.New("Invalid data key for encryption domain")
+		}
+	}
+	k.name = name
+
+	if !k.Valid() {
+		return nil, errors.New("Invalid key for repository")
+	}
+
+	return k, nil
+}
+
+// HasMasterKey returns true if the key contains the master key. Keys of an
+// encryption domain created before repository version 4 still contain it.
+func (k *Key) HasMasterKey() bool {
+	return k.Domain == "" || len(k.DomainMasterData) == 0
+}
+
+// decryptKey decrypts data with the user key and restores the key from JSON.
+func decryptKey(user *crypto.Key, data []byte) (*crypto.Key, error) {
+	buf := make([]byte, len(data))
+	n, err := crypto.Decrypt(user, buf, data)
 	if err != nil {
 		return nil, err
 	}
 	buf = buf[:n]
 
 	// restore json
-	k.master = &crypto.Key{}
-	err = json.Unmarshal(buf, k.master)
+	k := &crypto.Key{}
+	err = json.Unmarshal(buf, k)
 	if err != nil {
 		debug.Log("Unmarshal() returned error %v", err)
 		return nil, errors.Wrap(err, "Unmarshal")
 	}
-	k.name = name
 
-	if !k.Valid() {
-		return nil, errors.New("Invalid key for repository")
+	return k, nil
+}
+
+// encryptKey encrypts the key (as JSON) with the user key.
+func encryptKey(user *crypto.Key, k *crypto.Key) ([]byte, error) {
+	buf, err := json.Marshal(k)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal")
 	}
 
-	return k, nil
+	return crypto.Encrypt(user, nil, buf)
 }
 
 // SearchKey tries to decrypt at most maxKeys keys in the backend with the
@@ -140,7 +229,7 @@ func SearchKey(ctx context.Context, s *Repository, password string, maxKeys int)
 		return key, nil
 	}
 
-	return nil, ErrNoKeyFound
+	return nil, errors.WithCode(ErrNoKeyFound, errors.CodeWrongPassword)
 }
 
 // LoadKey loads a key from the backend.
@@ -160,8 +249,106 @@ func LoadKey(ctx context.Context, s *Repository, name string) (k *Key, err error
 	return k, nil
 }
 
-// AddKey adds a new key to an already existing repository.
+// AddKey adds a new key to an already existing repository. The key contains
+// the master key template, or a new random master key if template is nil.
 func AddKey(ctx context.Context, s *Repository, password string, template *crypto.Key) (*Key, error) {
+	if template == nil {
+		template = crypto.NewRandomKey()
+	}
+
+	newkey, err := newKey(password, KeyMetadata{})
+	if err != nil {
+		return nil, err
+	}
+
+	newkey.master = template
+	if err = saveKey(ctx, s, newkey); err != nil {
+		return nil, err
+	}
+
+	return newkey, nil
+}
+
+// AddDomainKey adds a new key for the encryption domain to the repository,
+// which must have been opened with the master key. The new key does not
+// contain the master key, all blobs saved with it are encrypted with the data
+// key of the domain. If the domain does not exist yet, a new random data key
+// is generated.
+func AddDomainKey(ctx context.Context, s *Repository, password string, domain string, meta KeyMetadata) (*Key, error) {
+	if s.key == nil {
+		return nil, errors.New("creating a key for an encryption domain requires the master key")
+	}
+
+	if !s.cfg.DomainsAllowed() {
+		return nil, errors.Errorf("encryption domains require repository version 4, the repository has version %v", s.cfg.Version)
+	}
+
+	if domain == "" {
+		return nil, errors.New("name of encryption domain is empty")
+	}
+
+	if err := pack.ValidDomain(domain); err != nil {
+		return nil, err
+	}
+
+	dataKey, ok := s.domainKeys[domain]
+	if !ok {
+		dataKey = crypto.NewRandomKey()
+	}
+
+	domainMasterData, err := encryptKey(s.key.WithCipher(crypto.DefaultCipher), dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	newkey, err := newKey(password, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	newkey.Domain = domain
+	newkey.metadata = s.metaKey
+	newkey.dataKey = dataKey
+	newkey.DomainMasterData = domainMasterData
+
+	if err = saveKey(ctx, s, newkey); err != nil {
+		return nil, err
+	}
+
+	if s.domainKeys == nil {
+		s.domainKeys = make(map[string]*crypto.Key)
+	}
+	s.domainKeys[domain] = dataKey.WithCipher(s.cfg.Cipher)
+
+	return newkey, nil
+}
+
+// AddKeyWithMetadata adds a new key which allows the same access to the
+// repository as the current key of s and stores meta with it.
+func AddKeyWithMetadata(ctx context.Context, s *Repository, password string, meta KeyMetadata) (*Key, error) {
+	newkey, err := newKey(password, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	newkey.master = s.key
+	newkey.Domain = s.domain
+	newkey.dataKey = s.dataKey
+	newkey.DomainMasterData = s.domainMasterData
+	if !newkey.HasMasterKey() {
+		newkey.master = nil
+		newkey.metadata = s.metaKey
+	}
+
+	if err = saveKey(ctx, s, newkey); err != nil {
+		return nil, err
+	}
+
+	return newkey, nil
+}
+
+// newKey returns a new key with the user key derived from the password.
+func newKey(password string, meta KeyMetadata) (*Key, error) {
 	// make sure we have valid KDF parameters
 	if KDFParams == nil {
 		p, err := crypto.Calibrate(KDFTimeout, KDFMemory)
@@ -175,11 +362,12 @@ func AddKey(ctx context.Context, s *Repository, password string, template *crypt
 
 	// fill meta data about key
 	newkey := &Key{
-		Created: time.Now(),
-		KDF:     "scrypt",
-		N:       KDFParams.N,
-		R:       KDFParams.R,
-		P:       KDFParams.P,
+		Created:     time.Now(),
+		KDF:         "scrypt",
+		N:           KDFParams.N,
+		R:           KDFParams.R,
+		P:           KDFParams.P,
+		KeyMetadata: meta,
 	}
 
 	hn, err := os.Hostname()
@@ -204,26 +392,33 @@ func AddKey(ctx context.Context, s *Repository, password string, template *crypt
 		return nil, err
 	}
 
-	if template == nil {
-		// generate new random master keys
-		newkey.master = crypto.NewRandomKey()
-	} else {
-		// copy master keys from old key
-		newkey.master = template
-	}
+	return newkey, nil
+}
 
+// saveKey encrypts the master or metadata key and the data key with the user
+// key and stores the key in the repository.
+func saveKey(ctx context.Context, s *Repository, newkey *Key) (err error) {
 	// encrypt master keys (as json) with user key
-	buf, err := json.Marshal(newkey.master)
+	if newkey.HasMasterKey() {
+		newkey.Data, err = encryptKey(newkey.user, newkey.master)
+	} else {
+		newkey.Data, err = encryptKey(newkey.user, newkey.metadata)
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "Marshal")
+		return err
 	}
 
-	newkey.Data, err = crypto.Encrypt(newkey.user, nil, buf)
+	if newkey.Domain != "" {
+		newkey.DomainData, err = encryptKey(newkey.user, newkey.dataKey)
+		if err != nil {
+			return err
+		}
+	}
 
 	// dump as json
-	buf, err = json.Marshal(newkey)
+	buf, err := json.Marshal(newkey)
 	if err != nil {
-		return nil, errors.Wrap(err, "Marshal")
+		return errors.Wrap(err, "Marshal")
 	}
 
 	// store in repository and return
@@ -234,12 +429,12 @@ func AddKey(ctx context.Context, s *Repository, password string, template *crypt
 
 	err = s.be.Save(ctx, h, bytes.NewReader(buf))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	newkey.name = h.Name
 
-	return newkey, nil
+	return nil
 }
 
 func (k *Key) String() string {
@@ -256,5 +451,8 @@ func (k Key) Name() string {
 
 // Valid tests whether the mac and encryption keys are valid (i.e. not zero)
 func (k *Key) Valid() bool {
+	if !k.HasMasterKey() {
+		return k.user.Valid() && k.metadata.Valid()
+	}
 	return k.user.Valid() && k.master.Valid()
 }
@@ -13,6 +13,12 @@ import (
 type MasterIndex struct {
 	idx      []*Index
 	idxMutex sync.RWMutex
+
+	// domain is the encryption domain of the client, blobs of other domains
+	// are not used for deduplication. Unless allDomains is set, they can't
+	// be decrypted and are also ignored by Lookup().
+	domain     string
+	allDomains bool
 }
 
 // NewMasterIndex creates a new master index.
@@ -30,8 +36,12 @@ func (mi *MasterIndex) Lookup(id restic.ID, tpe restic.BlobType) (blobs []restic
 	for _, idx := range mi.idx {
 		blobs, err = idx.Lookup(id, tpe)
 		if err == nil {
+			blobs = mi.readable(blobs)
+		}
+
+		if len(blobs) > 0 {
 			debug.Log("found id %v: %v", id.Str(), blobs)
-			return
+			return blobs, nil
 		}
 	}
 
@@ -39,13 +49,40 @@ func (mi *MasterIndex) Lookup(id restic.ID, tpe restic.BlobType) (blobs []restic
 	return nil, errors.Errorf("id %v not found in any index", id)
 }
 
+// readable returns the blobs of list which the client can decrypt.
+func (mi *MasterIndex) readable(list []restic.PackedBlob) []restic.PackedBlob {
+	if mi.allDomains {
+		return list
+	}
+
+	res := list[:0]
+	for _, pb := range list {
+		if pb.Domain == mi.domain {
+			res = append(res, pb)
+		}
+	}
+	return res
+}
+
+// SetDomain sets the encryption domain of the client. Has() only considers
+// blobs which belong to this domain. Lookup() also returns blobs of other
+// domains if allDomains is set, which is the case for the master key.
+func (mi *MasterIndex) SetDomain(domain string, allDomains bool) {
+	mi.idxMutex.Lock()
+	defer mi.idxMutex.Unlock()
+
+	mi.domain = domain
+	mi.allDomains = allDomains
+}
+
 // LookupSize queries all known Indexes for the ID and returns the first match.
 func (mi *MasterIndex) LookupSize(id restic.ID, tpe restic.BlobType) (uint, error) {
 	mi.idxMutex.RLock()
 	defer mi.idxMutex.RUnlock()
 
 	for _, idx := range mi.idx {
-		if idx.Has(id, tpe) {
+		blobs, err := idx.Lookup(id, tpe)
+		if err == nil && len(mi.readable(blobs)) > 0 {
 			return idx.LookupSize(id, tpe)
 		}
 	}
@@ -75,7 +112,7 @@ func (mi *MasterIndex) Has(id restic.ID, tpe restic.BlobType) bool {
 	defer mi.idxMutex.RUnlock()
 
 	for _, idx := range mi.idx {
-		if idx.Has(id, tpe) {
+		if mi.has(idx, id, tpe) {
 			return true
 		}
 	}
@@ -83,6 +120,43 @@ func (mi *MasterIndex) Has(id restic.ID, tpe restic.BlobType) bool {
 	return false
 }
 
+// has returns true iff idx contains the blob in the encryption domain of the
+// client. The caller must hold idxMutex.
+func (mi *MasterIndex) has(idx *Index, id restic.ID, tpe restic.BlobType) bool {
+	blobs, err := idx.Lookup(id, tpe)
+	if err != nil {
+		return false
+	}
+
+	for _, pb := range blobs {
+		if pb.Domain == mi.domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FindExisting returns the subset of blobs which are contained in at least one
+// index. The lock is acquired only once, so this is faster than calling Has()
+// for each blob individually.
+func (mi *MasterIndex) FindExisting(blobs restic.BlobSet) restic.BlobSet {
+	mi.idxMutex.RLock()
+	defer mi.idxMutex.RUnlock()
+
+	existing := restic.NewBlobSet()
+	for h := range blobs {
+		for _, idx := range mi.idx {
+			if mi.has(idx, h.ID, h.Type) {
+				existing.Insert(h)
+				break
+			}
+		}
+	}
+
+	return existing
+}
+
 // Count returns the number of blobs of type t in the index.
 func (mi *MasterIndex) Count(t restic.BlobType) (n uint) {
 	mi.idxMutex.RLock()
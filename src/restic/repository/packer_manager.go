@@ -39,7 +39,9 @@ type packerManager struct {
 	pool sync.Pool
 }
 
-const minPackSize = 4 * 1024 * 1024
+// MinPackSize is the size up to which a pack is filled before it is saved.
+const MinPackSize = 4 * 1024 * 1024
+
 const maxPackSize = 16 * 1024 * 1024
 const maxPackers = 200
 
@@ -51,7 +53,7 @@ func newPackerManager(be Saver, key *crypto.Key) *packerManager {
 		key: key,
 		pool: sync.Pool{
 			New: func() interface{} {
-				return make([]byte, (minPackSize+maxPackSize)/2)
+				return make([]byte, (MinPackSize+maxPackSize)/2)
 			},
 		},
 	}
@@ -142,10 +144,12 @@ func (r *Repository) savePacker(p *Packer) error {
 		debug.Log("  updating blob %v to pack %v", b.ID.Str(), id.Str())
 		r.idx.Store(restic.PackedBlob{
 			Blob: restic.Blob{
-				Type:   b.Type,
-				ID:     b.ID,
-				Offset: b.Offset,
-				Length: uint(b.Length),
+				Type:               b.Type,
+				ID:                 b.ID,
+				Offset:             b.Offset,
+				Length:             uint(b.Length),
+				Domain:             b.Domain,
+				UncompressedLength: b.UncompressedLength,
 			},
 			PackID: id,
 		})
@@ -90,7 +90,7 @@ func fillPacks(t testing.TB, rnd *randReader, be Saver, pm *packerManager, buf [
 		}
 		bytes += l
 
-		if packer.Size() < minPackSize && pm.countPacker() < maxPackers {
+		if packer.Size() < MinPackSize && pm.countPacker() < maxPackers {
 			pm.insertPacker(packer)
 			continue
 		}
@@ -5,11 +5,9 @@ import (
 	"crypto/sha256"
 	"io"
 	"restic"
-	"restic/crypto"
 	"restic/debug"
 	"restic/fs"
 	"restic/hashing"
-	"restic/pack"
 
 	"restic/errors"
 )
@@ -18,9 +16,57 @@ import (
 // these packs. Each pack is loaded and the blobs listed in keepBlobs is saved
 // into a new pack. Afterwards, the packs are removed. This operation requires
 // an exclusive lock on the repo.
-func Repack(ctx context.Context, repo restic.Repository, packs restic.IDSet, keepBlobs restic.BlobSet, p *restic.Progress) (err error) {
+func Repack(ctx context.Context, repo *Repository, packs restic.IDSet, keepBlobs restic.BlobSet, p *restic.Progress) (err error) {
+	if err = RepackBlobs(ctx, repo, packs, keepBlobs, p); err != nil {
+		return err
+	}
+
+	for packID := range packs {
+		h := restic.Handle{Type: restic.DataFile, Name: packID.String()}
+		err := repo.Backend().Remove(ctx, h)
+		if err != nil {
+			debug.Log("error removing pack %v: %v", packID.Str(), err)
+			return err
+		}
+		debug.Log("removed pack %v", packID.Str())
+	}
+
+	return nil
+}
+
+// RepackBlobs works like Repack, but does not remove the packs afterwards.
+// Blobs are copied to the new packs without being encrypted again, so they
+// stay in their encryption domain. Blobs of domains for which no key is
+// available can't be verified and are copied as they are.
+func RepackBlobs(ctx context.Context, repo *Repository, packs restic.IDSet, keepBlobs restic.BlobSet, p *restic.Progress) (err error) {
+	return RepackBlobsCheckpoint(ctx, repo, packs, keepBlobs, p, 0, nil)
+}
+
+// RepackBlobsCheckpoint works like RepackBlobs. In addition, after every n
+// packs and at the end, all new packs are saved and checkpoint is called with
+// the packs processed since the last call, so that an interrupted repack can
+// be continued with the remaining packs.
+func RepackBlobsCheckpoint(ctx context.Context, repo *Repository, packs restic.IDSet, keepBlobs restic.BlobSet, p *restic.Progress, n int, checkpoint func(done restic.IDs) error) (err error) {
 	debug.Log("repacking %d packs while keeping %d blobs", len(packs), len(keepBlobs))
 
+	// each blob is kept once per encryption domain
+	saved := make(map[domainBlob]bool)
+
+	var done restic.IDs
+	flush := func() error {
+		if err := repo.Flush(); err != nil {
+			return err
+		}
+
+		if checkpoint == nil || len(done) == 0 {
+			return nil
+		}
+
+		err := checkpoint(done)
+		done = nil
+		return err
+	}
+
 	for packID := range packs {
 		// load the complete pack into a temp file
 		h := restic.Handle{Type: restic.DataFile, Name: packID.String()}
@@ -57,19 +103,23 @@ func Repack(ctx context.Context, repo restic.Repository, packs restic.IDSet, kee
 			return errors.Wrap(err, "Seek")
 		}
 
-		blobs, err := pack.List(repo.Key(), tempfile, packLength)
+		blobs, err := repo.PackBlobs(tempfile, packLength)
 		if err != nil {
 			return err
 		}
 
 		debug.Log("processing pack %v, blobs: %v", packID.Str(), len(blobs))
-		var buf []byte
+		var buf, plaintext []byte
 		for _, entry := range blobs {
 			h := restic.BlobHandle{ID: entry.ID, Type: entry.Type}
 			if !keepBlobs.Has(h) {
 				continue
 			}
 
+			if saved[domainBlob{h, entry.Domain}] {
+				continue
+			}
+
 			debug.Log("  process blob %v", h)
 
 			buf = buf[:]
@@ -88,27 +138,30 @@ func Repack(ctx context.Context, repo restic.Repository, packs restic.IDSet, kee
 					h, tempfile.Name(), len(buf), n)
 			}
 
-			n, err = crypto.Decrypt(repo.Key(), buf, buf)
-			if err != nil {
-				return err
+			key, err := repo.DomainKey(entry.Domain)
+			if err == nil {
+				plaintext, err = decryptBlob(key, entry, buf, plaintext)
+				if err != nil {
+					return err
+				}
+
+				id := restic.Hash(plaintext)
+				if !id.Equal(entry.ID) {
+					return errors.Errorf("read blob %v from %v: wrong data returned, hash is %v",
+						h, tempfile.Name(), id)
+				}
+			} else {
+				debug.Log("  unable to verify blob %v: %v", h, err)
 			}
 
-			buf = buf[:n]
-
-			id := restic.Hash(buf)
-			if !id.Equal(entry.ID) {
-				return errors.Errorf("read blob %v from %v: wrong data returned, hash is %v",
-					h, tempfile.Name(), id)
-			}
-
-			_, err = repo.SaveBlob(ctx, entry.Type, buf, entry.ID)
+			err = repo.saveCiphertext(entry, buf)
 			if err != nil {
 				return err
 			}
 
 			debug.Log("  saved blob %v", entry.ID.Str())
 
-			keepBlobs.Delete(h)
+			saved[domainBlob{h, entry.Domain}] = true
 		}
 
 		if err = tempfile.Close(); err != nil {
@@ -121,21 +174,20 @@ func Repack(ctx context.Context, repo restic.Repository, packs restic.IDSet, kee
 		if p != nil {
 			p.Report(restic.Stat{Blobs: 1})
 		}
-	}
-
-	if err := repo.Flush(); err != nil {
-		return err
-	}
 
-	for packID := range packs {
-		h := restic.Handle{Type: restic.DataFile, Name: packID.String()}
-		err := repo.Backend().Remove(ctx, h)
-		if err != nil {
-			debug.Log("error removing pack %v: %v", packID.Str(), err)
-			return err
+		done = append(done, packID)
+		if n > 0 && len(done) >= n {
+			if err = flush(); err != nil {
+				return err
+			}
 		}
-		debug.Log("removed pack %v", packID.Str())
 	}
 
-	return nil
+	return flush()
+}
+
+// domainBlob identifies a blob within an encryption domain.
+type domainBlob struct {
+	restic.BlobHandle
+	Domain string
 }
@@ -127,7 +127,7 @@ func findPacksForBlobs(t *testing.T, repo restic.Repository, blobs restic.BlobSe
 }
 
 func repack(t *testing.T, repo restic.Repository, packs restic.IDSet, blobs restic.BlobSet) {
-	err := repository.Repack(context.TODO(), repo, packs, blobs, nil)
+	err := repository.Repack(context.TODO(), repo.(*repository.Repository), packs, blobs, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -231,3 +231,41 @@ func TestRepack(t *testing.T) {
 		}
 	}
 }
+
+func TestRepackBlobsCheckpoint(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	createRandomBlobs(t, repo, 100, 0.7)
+	saveIndex(t, repo)
+
+	removeBlobs, keepBlobs := selectBlobs(t, repo, 0.2)
+	packs := findPacksForBlobs(t, repo, removeBlobs)
+
+	var calls int
+	done := restic.NewIDSet()
+	checkpoint := func(ids restic.IDs) error {
+		calls++
+		if len(ids) > 2 {
+			t.Errorf("checkpoint called with %d packs, want at most 2", len(ids))
+		}
+
+		for _, id := range ids {
+			done.Insert(id)
+		}
+		return nil
+	}
+
+	err := repository.RepackBlobsCheckpoint(context.TODO(), repo.(*repository.Repository), packs, keepBlobs, nil, 2, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !done.Equals(packs) {
+		t.Errorf("checkpoints reported wrong packs, want %v, got %v", packs, done)
+	}
+
+	if want := (len(packs) + 1) / 2; calls != want {
+		t.Errorf("wrong number of checkpoints, want %d, got %d", want, calls)
+	}
+}
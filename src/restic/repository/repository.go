@@ -5,12 +5,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"restic"
 
 	"restic/errors"
 
 	"restic/backend"
+	"restic/cache"
+	"restic/compression"
 	"restic/crypto"
 	"restic/debug"
 	"restic/pack"
@@ -24,6 +27,35 @@ type Repository struct {
 	keyName string
 	idx     *MasterIndex
 
+	// metaKey encrypts the pack headers and all files except the config. It
+	// is derived from the master key for repository version 4 and is the
+	// master key for older versions. Keys of an encryption domain only
+	// contain the metadata key and the data key of the domain, key is nil.
+	metaKey *crypto.Key
+
+	// domain is the encryption domain of the key, all blobs are encrypted
+	// with dataKey. For the default domain, both are unset.
+	domain  string
+	dataKey *crypto.Key
+
+	// domainMasterData is the data key of the domain encrypted with the
+	// master key, it is copied to new keys of the domain.
+	domainMasterData []byte
+
+	// domainKeys holds the data keys of all encryption domains, it is only
+	// available with the master key.
+	domainKeys map[string]*crypto.Key
+
+	// keyMeta holds the description and constraints of the key
+	keyMeta KeyMetadata
+
+	cache     *cache.Cache
+	snapshots *cache.SnapshotManifest
+
+	// compression overrides the compression mode of the config for blobs of
+	// a type, it is set with SetCompression.
+	compression map[restic.BlobType]compression.Mode
+
 	*packerManager
 }
 
@@ -43,6 +75,159 @@ func (r *Repository) Config() restic.Config {
 	return r.cfg
 }
 
+// SaveConfig replaces the repository configuration with cfg. The new config
+// is first saved as a config update file, which is only removed after the
+// config has been replaced. When the process is interrupted in between, the
+// config is restored from the update the next time the repository is opened.
+// The repository should be locked exclusively.
+func (r *Repository) SaveConfig(ctx context.Context, cfg restic.Config) error {
+	// remove updates left over from an earlier interrupted run, the config
+	// has been restored from them already
+	for id := range r.be.List(ctx, restic.ConfigUpdateFile) {
+		h := restic.Handle{Type: restic.ConfigUpdateFile, Name: id}
+		if err := r.be.Remove(ctx, h); err != nil {
+			return err
+		}
+	}
+
+	updateID, err := r.SaveJSONUnpacked(ctx, restic.ConfigUpdateFile, cfg)
+	if err != nil {
+		return err
+	}
+	debug.Log("new config saved as update %v", updateID.Str())
+
+	if err = r.be.Remove(ctx, restic.Handle{Type: restic.ConfigFile}); err != nil {
+		return err
+	}
+
+	if _, err = r.SaveJSONUnpacked(ctx, restic.ConfigFile, cfg); err != nil {
+		return errors.Wrapf(err, "saving config failed, it is restored from update %v on the next run", updateID.Str())
+	}
+
+	r.setConfig(cfg)
+	if err = r.saveDomainConfig(ctx); err != nil {
+		return err
+	}
+
+	return r.be.Remove(ctx, restic.Handle{Type: restic.ConfigUpdateFile, Name: updateID.String()})
+}
+
+// saveDomainConfig saves a copy of the config encrypted with the metadata
+// key, which is read by the keys of encryption domains. Older copies are
+// removed afterwards. Before repository version 4, nothing is done.
+func (r *Repository) saveDomainConfig(ctx context.Context) error {
+	if !r.cfg.DomainsAllowed() {
+		return nil
+	}
+
+	var old []string
+	for name := range r.be.List(ctx, restic.DomainConfigFile) {
+		old = append(old, name)
+	}
+
+	id, err := r.SaveJSONUnpacked(ctx, restic.DomainConfigFile, r.cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range old {
+		if name == id.String() {
+			continue
+		}
+
+		if err = r.be.Remove(ctx, restic.Handle{Type: restic.DomainConfigFile, Name: name}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadDomainConfig loads the copy of the config saved for the keys of
+// encryption domains. If there is more than one copy (because a replacement
+// was interrupted), the one with the highest version is used.
+func (r *Repository) loadDomainConfig(ctx context.Context, item interface{}) error {
+	var (
+		buf     []byte
+		version uint
+	)
+
+	for id := range r.List(ctx, restic.DomainConfigFile) {
+		data, err := r.LoadAndDecrypt(ctx, restic.DomainConfigFile, id)
+		if err != nil {
+			return err
+		}
+
+		var cfg restic.Config
+		if err = json.Unmarshal(data, &cfg); err != nil {
+			return errors.Wrap(err, "Unmarshal")
+		}
+
+		if buf == nil || cfg.Version > version {
+			buf, version = data, cfg.Version
+		}
+	}
+
+	if buf == nil {
+		return errors.New("config for encryption domains not found")
+	}
+
+	return json.Unmarshal(buf, item)
+}
+
+// domainConfigLoader loads the copy of the config for encryption domains
+// instead of the config.
+type domainConfigLoader struct {
+	*Repository
+}
+
+func (l domainConfigLoader) LoadJSONUnpacked(ctx context.Context, t restic.FileType, id restic.ID, item interface{}) error {
+	if t == restic.ConfigFile {
+		return l.loadDomainConfig(ctx, item)
+	}
+
+	return l.Repository.LoadJSONUnpacked(ctx, t, id, item)
+}
+
+// recoverConfig restores the config from the update saved by an interrupted
+// SaveConfig, if the config is missing.
+func (r *Repository) recoverConfig(ctx context.Context) error {
+	if r.key == nil {
+		return nil
+	}
+
+	has, err := r.be.Test(ctx, restic.Handle{Type: restic.ConfigFile})
+	if err != nil || has {
+		return err
+	}
+
+	var ids restic.IDs
+	for name := range r.be.List(ctx, restic.ConfigUpdateFile) {
+		id, err := restic.ParseID(name)
+		if err != nil {
+			debug.Log("unable to parse %v as an ID", name)
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+	if len(ids) > 1 {
+		return errors.Errorf("config is missing and %d config updates were found", len(ids))
+	}
+
+	buf, err := r.LoadAndDecrypt(ctx, restic.ConfigUpdateFile, ids[0])
+	if err != nil {
+		return err
+	}
+
+	debug.Log("restoring config from update %v", ids[0].Str())
+	_, err = r.SaveUnpacked(ctx, restic.ConfigFile, buf)
+	return err
+}
+
 // PrefixLength returns the number of bytes required so that all prefixes of
 // all IDs of type t are unique.
 func (r *Repository) PrefixLength(t restic.FileType) (int, error) {
@@ -55,18 +240,40 @@ func (r *Repository) LoadAndDecrypt(ctx context.Context, t restic.FileType, id r
 	debug.Log("load %v with id %v", t, id.Str())
 
 	h := restic.Handle{Type: t, Name: id.String()}
-	buf, err := backend.LoadAll(ctx, r.be, h)
+	buf, ok := r.loadFromSnapshotManifest(t, id)
+	if !ok {
+		var err error
+		buf, err = backend.LoadAll(ctx, r.be, h)
+		if err != nil {
+			debug.Log("error loading %v: %v", h, err)
+			return nil, err
+		}
+
+		if t != restic.ConfigFile && !restic.Hash(buf).Equal(id) {
+			return nil, errors.Errorf("load %v: invalid data returned", h)
+		}
+
+		if t == restic.SnapshotFile && r.snapshots != nil {
+			r.snapshots.Add(id, buf)
+		}
+	}
+
+	key, err := r.fileKey(t)
 	if err != nil {
-		debug.Log("error loading %v: %v", h, err)
 		return nil, err
 	}
 
-	if t != restic.ConfigFile && !restic.Hash(buf).Equal(id) {
-		return nil, errors.Errorf("load %v: invalid data returned", h)
-	}
+	// decrypt, the MAC is checked before buf is modified
+	n, err := crypto.Decrypt(key, buf, buf)
+	if errors.Cause(err) == crypto.ErrUnauthenticated && r.cfg.DomainsAllowed() && t != restic.DomainConfigFile {
+		// files saved before the upgrade to version 4 are still encrypted
+		// with the master key
+		if r.key == nil {
+			return nil, errors.WithCode(errors.Errorf("load %v: not readable with the key of encryption domain %q", h, r.domain), errors.CodeNoKey)
+		}
 
-	// decrypt
-	n, err := r.decryptTo(buf, buf)
+		n, err = crypto.Decrypt(r.key, buf, buf)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -87,6 +294,13 @@ func (r *Repository) loadBlob(ctx context.Context, id restic.ID, t restic.BlobTy
 		return 0, err
 	}
 
+	bh := restic.BlobHandle{ID: id, Type: t}
+	if r.cache != nil {
+		if n, ok := r.loadCachedBlob(bh, blobs, plaintextBuf); ok {
+			return n, nil
+		}
+	}
+
 	var lastError error
 	for _, blob := range blobs {
 		debug.Log("id %v found: %v", id.Str(), blob)
@@ -118,17 +332,40 @@ func (r *Repository) loadBlob(ctx context.Context, id restic.ID, t restic.BlobTy
 			continue
 		}
 
+		if r.cache != nil {
+			if err = r.cache.Save(bh, plaintextBuf); err != nil {
+				debug.Log("unable to save blob %v in the cache: %v", bh, err)
+			}
+		}
+
+		key, err := r.DomainKey(blob.Domain)
+		if err != nil {
+			lastError = errors.Errorf("decrypting blob %v failed: %v", id, err)
+			continue
+		}
+
 		// decrypt
-		n, err = r.decryptTo(plaintextBuf, plaintextBuf)
+		n, err = crypto.Decrypt(key, plaintextBuf, plaintextBuf)
 		if err != nil {
 			lastError = errors.Errorf("decrypting blob %v failed: %v", id, err)
+			r.removeCachedBlob(bh)
 			continue
 		}
 		plaintextBuf = plaintextBuf[:n]
 
+		if blob.IsCompressed() {
+			plaintextBuf, err = decompressBlob(plaintextBuf, blob.UncompressedLength)
+			if err != nil {
+				lastError = errors.Errorf("decompressing blob %v failed: %v", id, err)
+				r.removeCachedBlob(bh)
+				continue
+			}
+		}
+
 		// check hash
 		if !restic.Hash(plaintextBuf).Equal(id) {
 			lastError = errors.Errorf("blob %v returned invalid hash", id)
+			r.removeCachedBlob(bh)
 			continue
 		}
 
@@ -142,6 +379,95 @@ func (r *Repository) loadBlob(ctx context.Context, id restic.ID, t restic.BlobTy
 	return 0, errors.Errorf("loading blob %v from %v packs failed", id.Str(), len(blobs))
 }
 
+// loadCachedBlob tries to load and decrypt the blob from the cache. Blobs
+// which can't be decrypted or have an invalid hash are removed from the cache.
+func (r *Repository) loadCachedBlob(h restic.BlobHandle, blobs []restic.PackedBlob, plaintextBuf []byte) (int, bool) {
+	n, ok := r.cache.Load(h, plaintextBuf[:cap(plaintextBuf)])
+	if !ok {
+		return 0, false
+	}
+	ciphertext := plaintextBuf[:n]
+
+	// the blob may be stored in several encryption domains, the MAC is
+	// checked before the ciphertext is decrypted in place
+	for _, blob := range blobs {
+		key, err := r.DomainKey(blob.Domain)
+		if err != nil {
+			continue
+		}
+
+		n, err = crypto.Decrypt(key, ciphertext, ciphertext)
+		if err != nil {
+			continue
+		}
+
+		plaintext := ciphertext[:n]
+		if blob.IsCompressed() {
+			plaintext, err = decompressBlob(plaintext, blob.UncompressedLength)
+			if err != nil {
+				break
+			}
+		}
+
+		if !restic.Hash(plaintext).Equal(h.ID) {
+			break
+		}
+
+		debug.Log("loaded blob %v from the cache", h)
+		return len(plaintext), true
+	}
+
+	debug.Log("removing invalid blob %v from the cache", h)
+	r.cache.Remove(h)
+	return 0, false
+}
+
+// removeCachedBlob removes the blob from the cache, if one is used.
+func (r *Repository) removeCachedBlob(h restic.BlobHandle) {
+	if r.cache != nil {
+		r.cache.Remove(h)
+	}
+}
+
+// loadFromSnapshotManifest returns the snapshot file with the ID from the
+// snapshot manifest, if one is used and contains the file.
+func (r *Repository) loadFromSnapshotManifest(t restic.FileType, id restic.ID) ([]byte, bool) {
+	if t != restic.SnapshotFile || r.snapshots == nil {
+		return nil, false
+	}
+
+	buf, ok := r.snapshots.Get(id)
+	if !ok {
+		return nil, false
+	}
+
+	if !restic.Hash(buf).Equal(id) {
+		debug.Log("snapshot %v in the manifest is damaged", id.Str())
+		return nil, false
+	}
+
+	return buf, true
+}
+
+// UseSnapshotManifest instructs the repository to keep the snapshot files it
+// loads or saves in the manifest and to load them from there when possible.
+// Snapshots which have been removed are dropped from the manifest when all
+// snapshot files are listed.
+func (r *Repository) UseSnapshotManifest(m *cache.SnapshotManifest) {
+	r.snapshots = m
+}
+
+// SnapshotManifest returns the snapshot manifest, or nil if none is used.
+func (r *Repository) SnapshotManifest() *cache.SnapshotManifest {
+	return r.snapshots
+}
+
+// UseCache instructs the repository to store all blobs loaded from the
+// backend in the cache and to load them from the cache when possible.
+func (r *Repository) UseCache(c *cache.Cache) {
+	r.cache = c
+}
+
 // LoadJSONUnpacked decrypts the data and afterwards calls json.Unmarshal on
 // the item.
 func (r *Repository) LoadJSONUnpacked(ctx context.Context, t restic.FileType, id restic.ID, item interface{}) (err error) {
@@ -159,7 +485,9 @@ func (r *Repository) LookupBlobSize(id restic.ID, tpe restic.BlobType) (uint, er
 }
 
 // SaveAndEncrypt encrypts data and stores it to the backend as type t. If data
-// is small enough, it will be packed together with other small blobs.
+// is small enough, it will be packed together with other small blobs. If the
+// repository version allows it, data is compressed before it is encrypted.
+// The ID is always the hash of the uncompressed data.
 func (r *Repository) SaveAndEncrypt(ctx context.Context, t restic.BlobType, data []byte, id *restic.ID) (restic.ID, error) {
 	if id == nil {
 		// compute plaintext hash
@@ -169,38 +497,66 @@ func (r *Repository) SaveAndEncrypt(ctx context.Context, t restic.BlobType, data
 
 	debug.Log("save id %v (%v, %d bytes)", id.Str(), t, len(data))
 
+	blob := restic.Blob{Type: t, ID: *id, Domain: r.domain}
+
+	compressed, err := r.compressBlob(t, data)
+	if err != nil {
+		return restic.ID{}, err
+	}
+	if compressed != nil {
+		defer freeBuf(compressed)
+		blob.UncompressedLength = uint(len(data))
+		data = compressed
+	}
+
 	// get buf from the pool
 	ciphertext := getBuf()
 	defer freeBuf(ciphertext)
 
+	key, err := r.DomainKey(r.domain)
+	if err != nil {
+		return restic.ID{}, err
+	}
+
 	// encrypt blob
-	ciphertext, err := r.Encrypt(ciphertext, data)
+	ciphertext, err = crypto.Encrypt(key, ciphertext, data)
+	if err != nil {
+		return restic.ID{}, err
+	}
+
+	err = r.saveCiphertext(blob, ciphertext)
 	if err != nil {
 		return restic.ID{}, err
 	}
 
+	return *id, nil
+}
+
+// saveCiphertext adds an encrypted blob to a packer. The type, ID, encryption
+// domain and uncompressed length are taken from blob.
+func (r *Repository) saveCiphertext(blob restic.Blob, ciphertext []byte) error {
 	// find suitable packer and add blob
 	packer, err := r.findPacker(uint(len(ciphertext)))
 	if err != nil {
-		return restic.ID{}, err
+		return err
 	}
 
 	// save ciphertext
-	_, err = packer.Add(t, *id, ciphertext)
+	_, err = packer.AddBlob(blob, ciphertext)
 	if err != nil {
-		return restic.ID{}, err
+		return err
 	}
 
 	// if the pack is not full enough and there are less than maxPackers
 	// packers, put back to the list
-	if packer.Size() < minPackSize && r.countPacker() < maxPackers {
+	if packer.Size() < MinPackSize && r.countPacker() < maxPackers {
 		debug.Log("pack is not full enough (%d bytes)", packer.Size())
 		r.insertPacker(packer)
-		return *id, nil
+		return nil
 	}
 
 	// else write the pack to the backend
-	return *id, r.savePacker(packer)
+	return r.savePacker(packer)
 }
 
 // SaveJSONUnpacked serialises item as JSON and encrypts and saves it in the
@@ -218,8 +574,13 @@ func (r *Repository) SaveJSONUnpacked(ctx context.Context, t restic.FileType, it
 // SaveUnpacked encrypts data and stores it in the backend. Returned is the
 // storage hash.
 func (r *Repository) SaveUnpacked(ctx context.Context, t restic.FileType, p []byte) (id restic.ID, err error) {
+	key, err := r.fileKey(t)
+	if err != nil {
+		return restic.ID{}, err
+	}
+
 	ciphertext := restic.NewBlobBuffer(len(p))
-	ciphertext, err = r.Encrypt(ciphertext, p)
+	ciphertext, err = crypto.Encrypt(key, ciphertext, p)
 	if err != nil {
 		return restic.ID{}, err
 	}
@@ -233,6 +594,10 @@ func (r *Repository) SaveUnpacked(ctx context.Context, t restic.FileType, p []by
 		return restic.ID{}, err
 	}
 
+	if t == restic.SnapshotFile && r.snapshots != nil {
+		r.snapshots.Add(id, ciphertext)
+	}
+
 	debug.Log("blob %v saved", h)
 	return id, nil
 }
@@ -267,6 +632,7 @@ func (r *Repository) Index() restic.Index {
 // SetIndex instructs the repository to use the given index.
 func (r *Repository) SetIndex(i restic.Index) {
 	r.idx = i.(*MasterIndex)
+	r.idx.SetDomain(r.domain, r.key != nil)
 }
 
 // SaveIndex saves an index in the repository.
@@ -319,6 +685,12 @@ func (r *Repository) LoadIndex(ctx context.Context) error {
 
 	worker := func(ctx context.Context, id restic.ID) error {
 		idx, err := LoadIndex(ctx, r, id)
+		if errors.Code(err) == errors.CodeNoKey {
+			// index files saved before the upgrade to repository version 4
+			// only list blobs which the key can't read anyway
+			debug.Log("skipping index %v: %v", id.Str(), err)
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -355,7 +727,7 @@ func LoadIndex(ctx context.Context, repo restic.Repository, id restic.ID) (*Inde
 		return idx, nil
 	}
 
-	if errors.Cause(err) == ErrOldIndexFormat {
+	if errors.Cause(err) == ErrOldIndexFormat && repo.Config().OldIndexAllowed() {
 		fmt.Fprintf(os.Stderr, "index %v has old format\n", id.Str())
 		return LoadIndexWithDecoder(ctx, repo, id, DecodeOldIndex)
 	}
@@ -372,15 +744,76 @@ func (r *Repository) SearchKey(ctx context.Context, password string, maxKeys int
 	}
 
 	r.key = key.master
-	r.packerManager.key = key.master
+	r.metaKey = key.metadata
 	r.keyName = key.Name()
-	r.cfg, err = restic.LoadConfig(ctx, r)
-	return err
+	r.domain = key.Domain
+	r.dataKey = key.dataKey
+	r.domainMasterData = key.DomainMasterData
+	r.keyMeta = key.KeyMetadata
+	r.idx.SetDomain(key.Domain, key.master != nil)
+
+	if r.key == nil {
+		// keys of encryption domains read the copy of the config
+		cfg, err := restic.LoadConfig(ctx, domainConfigLoader{r})
+		if err != nil {
+			return err
+		}
+
+		r.setConfig(cfg)
+		return nil
+	}
+
+	if err = r.recoverConfig(ctx); err != nil {
+		return err
+	}
+
+	cfg, err := restic.LoadConfig(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	r.setConfig(cfg)
+	return r.loadDomainKeys(ctx)
+}
+
+// loadDomainKeys decrypts the data keys of all encryption domains with the
+// master key. Key files which can't be loaded are skipped, the blobs of their
+// domain are reported by check.
+func (r *Repository) loadDomainKeys(ctx context.Context) error {
+	if !r.cfg.DomainsAllowed() {
+		return nil
+	}
+
+	master := r.key.WithCipher(crypto.DefaultCipher)
+	r.domainKeys = make(map[string]*crypto.Key)
+	for name := range r.be.List(ctx, restic.KeyFile) {
+		k, err := LoadKey(ctx, r, name)
+		if err != nil {
+			debug.Log("unable to load key %v: %v", name[:12], err)
+			continue
+		}
+
+		if k.HasMasterKey() {
+			continue
+		}
+
+		dataKey, err := decryptKey(master, k.DomainMasterData)
+		if err != nil {
+			debug.Log("unable to decrypt the data key of encryption domain %q in key %v: %v", k.Domain, name[:12], err)
+			continue
+		}
+
+		r.domainKeys[k.Domain] = dataKey.WithCipher(r.cfg.Cipher)
+	}
+
+	return nil
 }
 
 // Init creates a new master key with the supplied password, initializes and
-// saves the repository config.
-func (r *Repository) Init(ctx context.Context, password string) error {
+// saves the config for a repository with the given version. All data is
+// encrypted with cipher c, blobs are compressed with mode m if the version
+// allows it.
+func (r *Repository) Init(ctx context.Context, version uint, c crypto.Cipher, m compression.Mode, password string) error {
 	has, err := r.be.Test(ctx, restic.Handle{Type: restic.ConfigFile})
 	if err != nil {
 		return err
@@ -389,11 +822,27 @@ func (r *Repository) Init(ctx context.Context, password string) error {
 		return errors.New("repository master key and config already initialized")
 	}
 
-	cfg, err := restic.CreateConfig()
+	cfg, err := restic.CreateConfig(version)
 	if err != nil {
 		return err
 	}
 
+	if c != crypto.DefaultCipher {
+		cfg.Cipher = c
+	}
+
+	if err = cfg.CheckCipher(); err != nil {
+		return err
+	}
+
+	if m != compression.DefaultMode {
+		cfg.Compression = m
+	}
+
+	if err = cfg.CheckCompression(); err != nil {
+		return err
+	}
+
 	return r.init(ctx, password, cfg)
 }
 
@@ -406,38 +855,126 @@ func (r *Repository) init(ctx context.Context, password string, cfg restic.Confi
 	}
 
 	r.key = key.master
-	r.packerManager.key = key.master
 	r.keyName = key.Name()
-	r.cfg = cfg
+	r.setConfig(cfg)
 	_, err = r.SaveJSONUnpacked(ctx, restic.ConfigFile, cfg)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return r.saveDomainConfig(ctx)
 }
 
-// decrypt authenticates and decrypts ciphertext and stores the result in
-// plaintext.
-func (r *Repository) decryptTo(plaintext, ciphertext []byte) (int, error) {
-	if r.key == nil {
-		return 0, errors.New("key for repository not set")
+// setConfig sets the config and derives the metadata key for it when the
+// master key is available.
+func (r *Repository) setConfig(cfg restic.Config) {
+	r.cfg = cfg
+	if r.key != nil {
+		r.metaKey = r.key
+		if cfg.DomainsAllowed() {
+			r.metaKey = crypto.DeriveKey(r.key.WithCipher(crypto.DefaultCipher), "metadata")
+		}
 	}
 
-	return crypto.Decrypt(r.key, plaintext, ciphertext)
+	r.useCipher(cfg.Cipher)
+}
+
+// useCipher configures the keys to use the cipher c.
+func (r *Repository) useCipher(c crypto.Cipher) {
+	if r.key != nil {
+		r.key = r.key.WithCipher(c)
+	}
+	r.metaKey = r.metaKey.WithCipher(c)
+	r.packerManager.key = r.metaKey
+	if r.dataKey != nil {
+		r.dataKey = r.dataKey.WithCipher(c)
+	}
+	for domain, k := range r.domainKeys {
+		r.domainKeys[domain] = k.WithCipher(c)
+	}
 }
 
-// Encrypt encrypts and authenticates the plaintext and saves the result in
-// ciphertext.
+// fileKey returns the key for files of type t. The config is always
+// encrypted with the default cipher, so that older versions of restic can
+// read it and report that the repository version is not supported. The same
+// holds for config updates, which are read before the cipher is known, and
+// the copy of the config for encryption domains. All other files are
+// encrypted with the metadata key.
+func (r *Repository) fileKey(t restic.FileType) (*crypto.Key, error) {
+	switch t {
+	case restic.ConfigFile, restic.ConfigUpdateFile:
+		if r.key == nil {
+			return nil, errors.New("the config can only be accessed with the master key")
+		}
+		return r.key.WithCipher(crypto.DefaultCipher), nil
+	case restic.DomainConfigFile:
+		if r.metaKey == nil {
+			return nil, errors.New("key for repository not set")
+		}
+		return r.metaKey.WithCipher(crypto.DefaultCipher), nil
+	}
+
+	if r.metaKey == nil {
+		return nil, errors.New("key for repository not set")
+	}
+
+	return r.metaKey, nil
+}
+
+// Encrypt encrypts and authenticates the plaintext with the metadata key and
+// saves the result in ciphertext.
 func (r *Repository) Encrypt(ciphertext, plaintext []byte) ([]byte, error) {
-	if r.key == nil {
+	if r.metaKey == nil {
 		return nil, errors.New("key for repository not set")
 	}
 
-	return crypto.Encrypt(r.key, ciphertext, plaintext)
+	return crypto.Encrypt(r.metaKey, ciphertext, plaintext)
 }
 
-// Key returns the current master key.
+// Key returns the current master key, or nil if the key of an encryption
+// domain is used.
 func (r *Repository) Key() *crypto.Key {
 	return r.key
 }
 
+// DomainKey returns the key used to encrypt the blobs of the encryption
+// domain. Blobs of the default domain (the empty string) are encrypted with
+// the master key. With the master key, the keys of all domains are
+// available, otherwise only the key of the own domain.
+func (r *Repository) DomainKey(domain string) (*crypto.Key, error) {
+	if domain == r.domain && r.dataKey != nil {
+		return r.dataKey, nil
+	}
+
+	if r.key == nil {
+		if r.metaKey == nil {
+			return nil, errors.New("key for repository not set")
+		}
+		return nil, errors.Errorf("no key for encryption domain %q available", domain)
+	}
+
+	if domain == "" {
+		return r.key, nil
+	}
+
+	if k, ok := r.domainKeys[domain]; ok {
+		return k, nil
+	}
+
+	return nil, errors.Errorf("no key for encryption domain %q available", domain)
+}
+
+// Domain returns the encryption domain of the current key, which is empty for
+// the default domain.
+func (r *Repository) Domain() string {
+	return r.domain
+}
+
+// KeyMetadata returns the metadata of the current key.
+func (r *Repository) KeyMetadata() KeyMetadata {
+	return r.keyMeta
+}
+
 // KeyName returns the name of the current key in the backend.
 func (r *Repository) KeyName() string {
 	return r.keyName
@@ -448,6 +985,13 @@ func (r *Repository) List(ctx context.Context, t restic.FileType) <-chan restic.
 	out := make(chan restic.ID)
 	go func() {
 		defer close(out)
+
+		// all snapshots which are not listed have been removed
+		var seen restic.IDSet
+		if t == restic.SnapshotFile && r.snapshots != nil {
+			seen = restic.NewIDSet()
+		}
+
 		for strID := range r.be.List(ctx, t) {
 			if id, err := restic.ParseID(strID); err == nil {
 				select {
@@ -455,8 +999,16 @@ func (r *Repository) List(ctx context.Context, t restic.FileType) <-chan restic.
 				case <-ctx.Done():
 					return
 				}
+
+				if seen != nil {
+					seen.Insert(id)
+				}
 			}
 		}
+
+		if seen != nil && ctx.Err() == nil {
+			r.snapshots.Retain(seen)
+		}
 	}()
 	return out
 }
@@ -471,7 +1023,7 @@ func (r *Repository) ListPack(ctx context.Context, id restic.ID) ([]restic.Blob,
 		return nil, 0, err
 	}
 
-	blobs, err := pack.List(r.Key(), restic.ReaderAt(r.Backend(), h), blobInfo.Size)
+	blobs, err := r.PackBlobs(restic.ReaderAt(r.Backend(), h), blobInfo.Size)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -479,6 +1031,22 @@ func (r *Repository) ListPack(ctx context.Context, id restic.ID) ([]restic.Blob,
 	return blobs, blobInfo.Size, nil
 }
 
+// PackBlobs returns the list of blobs in the header of the pack file read
+// from rd. The header is encrypted with the metadata key, headers of packs
+// saved before the upgrade to repository version 4 with the master key.
+func (r *Repository) PackBlobs(rd io.ReaderAt, size int64) ([]restic.Blob, error) {
+	if r.metaKey == nil {
+		return nil, errors.New("key for repository not set")
+	}
+
+	blobs, err := pack.List(r.metaKey, rd, size)
+	if errors.Cause(err) == crypto.ErrUnauthenticated && r.key != nil && r.cfg.DomainsAllowed() {
+		return pack.List(r.key, rd, size)
+	}
+
+	return blobs, err
+}
+
 // Delete calls backend.Delete() if implemented, and returns an error
 // otherwise.
 func (r *Repository) Delete(ctx context.Context) error {
@@ -533,22 +1101,20 @@ func (r *Repository) SaveBlob(ctx context.Context, t restic.BlobType, buf []byte
 func (r *Repository) LoadTree(ctx context.Context, id restic.ID) (*restic.Tree, error) {
 	debug.Log("load tree %v", id.Str())
 
-	size, err := r.idx.LookupSize(id, restic.TreeBlob)
+	buf, err := r.loadTreeBlob(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	debug.Log("size is %d, create buffer", size)
-	buf := restic.NewBlobBuffer(int(size))
-
-	n, err := r.loadBlob(ctx, id, restic.TreeBlob, buf)
+	t := &restic.Tree{}
+	err = json.Unmarshal(buf, t)
 	if err != nil {
 		return nil, err
 	}
-	buf = buf[:n]
 
-	t := &restic.Tree{}
-	err = json.Unmarshal(buf, t)
+	err = restic.LoadContentLists(t, func(id restic.ID) ([]byte, error) {
+		return r.loadTreeBlob(ctx, id)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -556,10 +1122,38 @@ func (r *Repository) LoadTree(ctx context.Context, id restic.ID) (*restic.Tree,
 	return t, nil
 }
 
+// loadTreeBlob returns the plaintext of the tree blob id.
+func (r *Repository) loadTreeBlob(ctx context.Context, id restic.ID) ([]byte, error) {
+	size, err := r.idx.LookupSize(id, restic.TreeBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := restic.NewBlobBuffer(int(size))
+	n, err := r.loadBlob(ctx, id, restic.TreeBlob, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
 // SaveTree stores a tree into the repository and returns the ID. The ID is
 // checked against the index. The tree is only stored when the index does not
-// contain the ID.
+// contain the ID. The content of very large files is stored separately, see
+// restic.SaveContentLists.
 func (r *Repository) SaveTree(ctx context.Context, t *restic.Tree) (restic.ID, error) {
+	err := restic.SaveContentLists(r.cfg, t, func(id restic.ID, buf []byte) error {
+		if r.idx.Has(id, restic.TreeBlob) {
+			return nil
+		}
+		_, err := r.SaveBlob(ctx, restic.TreeBlob, buf, id)
+		return err
+	})
+	if err != nil {
+		return restic.ID{}, err
+	}
+
 	buf, err := json.Marshal(t)
 	if err != nil {
 		return restic.ID{}, errors.Wrap(err, "MarshalJSON")
@@ -12,6 +12,9 @@ import (
 
 	"restic"
 	"restic/archiver"
+	"restic/cache"
+	"restic/compression"
+	"restic/crypto"
 	"restic/repository"
 	. "restic/test"
 )
@@ -56,6 +59,124 @@ func TestSave(t *testing.T) {
 	}
 }
 
+func TestRepositoryCipher(t *testing.T) {
+	be, cleanup := repository.TestBackend(t)
+	defer cleanup()
+
+	repo := repository.New(be)
+	err := repo.Init(context.TODO(), 2, crypto.ChaCha20Poly1305, compression.DefaultMode, TestPassword)
+	Assert(t, err != nil, "no error for a cipher which is not supported by version 2")
+
+	OK(t, repo.Init(context.TODO(), 3, crypto.ChaCha20Poly1305, compression.DefaultMode, TestPassword))
+
+	data := Random(23, 5000)
+	id, err := repo.SaveBlob(context.TODO(), restic.DataBlob, data, restic.ID{})
+	OK(t, err)
+	OK(t, repo.Flush())
+	OK(t, repo.SaveIndex(context.TODO()))
+
+	repo = repository.New(be)
+	OK(t, repo.SearchKey(context.TODO(), TestPassword, 10))
+	Equals(t, crypto.ChaCha20Poly1305, repo.Config().Cipher)
+	Equals(t, crypto.ChaCha20Poly1305, repo.Key().Cipher)
+	OK(t, repo.LoadIndex(context.TODO()))
+
+	buf := restic.NewBlobBuffer(len(data))
+	n, err := repo.LoadBlob(context.TODO(), restic.DataBlob, id, buf)
+	OK(t, err)
+	Equals(t, data, buf[:n])
+}
+
+func TestRepositoryCompression(t *testing.T) {
+	be, cleanup := repository.TestBackend(t)
+	defer cleanup()
+
+	repo := repository.New(be)
+	err := repo.Init(context.TODO(), 5, crypto.DefaultCipher, compression.Max, TestPassword)
+	Assert(t, err != nil, "no error for compression which is not supported by version 5")
+
+	OK(t, repo.Init(context.TODO(), 6, crypto.DefaultCipher, compression.Max, TestPassword))
+
+	compressible := bytes.Repeat([]byte("compressible "), 1000)
+	random := Random(23, 5000)
+
+	var ids restic.IDs
+	for _, data := range [][]byte{compressible, random} {
+		id, err := repo.SaveBlob(context.TODO(), restic.DataBlob, data, restic.ID{})
+		OK(t, err)
+		Equals(t, restic.Hash(data), id)
+		ids = append(ids, id)
+	}
+	OK(t, repo.Flush())
+	OK(t, repo.SaveIndex(context.TODO()))
+
+	repo = repository.New(be)
+	OK(t, repo.SearchKey(context.TODO(), TestPassword, 10))
+	Equals(t, compression.Max, repo.Config().Compression)
+	OK(t, repo.LoadIndex(context.TODO()))
+
+	for i, data := range [][]byte{compressible, random} {
+		blobs, err := repo.Index().Lookup(ids[i], restic.DataBlob)
+		OK(t, err)
+		Equals(t, i == 0, blobs[0].IsCompressed())
+
+		size, err := repo.LookupBlobSize(ids[i], restic.DataBlob)
+		OK(t, err)
+		Equals(t, uint(len(data)), size)
+
+		buf := restic.NewBlobBuffer(int(size))
+		n, err := repo.LoadBlob(context.TODO(), restic.DataBlob, ids[i], buf)
+		OK(t, err)
+		Equals(t, data, buf[:n])
+	}
+}
+
+func TestSaveConfig(t *testing.T) {
+	be, cleanup := repository.TestBackend(t)
+	defer cleanup()
+
+	repo := repository.New(be)
+	OK(t, repo.Init(context.TODO(), 3, crypto.ChaCha20Poly1305, compression.DefaultMode, TestPassword))
+
+	cfg := repo.Config()
+	cfg.PruneSuggestion = &restic.PruneSuggestion{MaxUnusedPercent: 10}
+	OK(t, repo.SaveConfig(context.TODO(), cfg))
+
+	for range be.List(context.TODO(), restic.ConfigUpdateFile) {
+		t.Fatal("config update was not removed")
+	}
+
+	repo = repository.New(be)
+	OK(t, repo.SearchKey(context.TODO(), TestPassword, 10))
+	Equals(t, cfg, repo.Config())
+}
+
+func TestSaveConfigInterrupted(t *testing.T) {
+	be, cleanup := repository.TestBackend(t)
+	defer cleanup()
+
+	repo := repository.New(be)
+	OK(t, repo.Init(context.TODO(), 3, crypto.ChaCha20Poly1305, compression.DefaultMode, TestPassword))
+
+	// simulate a SaveConfig which was interrupted after the old config had
+	// been removed
+	cfg := repo.Config()
+	cfg.PruneSuggestion = &restic.PruneSuggestion{MaxUnusedBytes: 1 << 30}
+	_, err := repo.SaveJSONUnpacked(context.TODO(), restic.ConfigUpdateFile, cfg)
+	OK(t, err)
+	OK(t, be.Remove(context.TODO(), restic.Handle{Type: restic.ConfigFile}))
+
+	repo = repository.New(be)
+	OK(t, repo.SearchKey(context.TODO(), TestPassword, 10))
+	Equals(t, cfg, repo.Config())
+
+	cfg.PruneSuggestion = nil
+	OK(t, repo.SaveConfig(context.TODO(), cfg))
+	for range be.List(context.TODO(), restic.ConfigUpdateFile) {
+		t.Fatal("config update was not removed")
+	}
+}
+
 func TestSaveFrom(t *testing.T) {
 	repo, cleanup := repository.TestRepository(t)
 	defer cleanup()
@@ -255,6 +376,76 @@ func BenchmarkLoadAndDecrypt(b *testing.B) {
 	}
 }
 
+func TestLoadBlobCache(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	dir, cleanupDir := TempDir(t)
+	defer cleanupDir()
+
+	c, err := cache.New(dir, 1<<30)
+	OK(t, err)
+	repo.(*repository.Repository).UseCache(c)
+
+	length := 1000000
+	buf := restic.NewBlobBuffer(length)
+	_, err = io.ReadFull(rnd, buf)
+	OK(t, err)
+
+	id, err := repo.SaveBlob(context.TODO(), restic.DataBlob, buf, restic.ID{})
+	OK(t, err)
+	OK(t, repo.Flush())
+
+	loadBuf := make([]byte, restic.CiphertextLength(length))
+	n, err := repo.LoadBlob(context.TODO(), restic.DataBlob, id, loadBuf)
+	OK(t, err)
+	Assert(t, bytes.Equal(buf, loadBuf[:n]), "wrong data returned")
+	Assert(t, c.Has(restic.BlobHandle{ID: id, Type: restic.DataBlob}), "blob was not saved in the cache")
+
+	// remove the pack, so the blob can only be loaded from the cache
+	blobs, err := repo.Index().Lookup(id, restic.DataBlob)
+	OK(t, err)
+	for _, pb := range blobs {
+		OK(t, repo.Backend().Remove(context.TODO(), restic.Handle{Type: restic.DataFile, Name: pb.PackID.String()}))
+	}
+
+	n, err = repo.LoadBlob(context.TODO(), restic.DataBlob, id, loadBuf)
+	OK(t, err)
+	Assert(t, bytes.Equal(buf, loadBuf[:n]), "wrong data returned from the cache")
+}
+
+func TestLoadSnapshotManifest(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	dir, cleanupDir := TempDir(t)
+	defer cleanupDir()
+
+	m := cache.NewSnapshotManifest(filepath.Join(dir, "snapshots"))
+	repo.(*repository.Repository).UseSnapshotManifest(m)
+
+	sn := restic.Snapshot{Hostname: "foobar"}
+	id, err := repo.SaveJSONUnpacked(context.TODO(), restic.SnapshotFile, &sn)
+	OK(t, err)
+	Equals(t, 1, m.Len())
+
+	// remove the file, so the snapshot can only be loaded from the manifest
+	h := restic.Handle{Type: restic.SnapshotFile, Name: id.String()}
+	OK(t, repo.Backend().Remove(context.TODO(), h))
+
+	var sn2 restic.Snapshot
+	OK(t, repo.LoadJSONUnpacked(context.TODO(), restic.SnapshotFile, id, &sn2))
+	Equals(t, sn.Hostname, sn2.Hostname)
+
+	// listing the snapshots drops the removed one from the manifest
+	for range repo.List(context.TODO(), restic.SnapshotFile) {
+	}
+	Equals(t, 0, m.Len())
+
+	err = repo.LoadJSONUnpacked(context.TODO(), restic.SnapshotFile, id, &sn2)
+	Assert(t, err != nil, "removed snapshot loaded from the manifest")
+}
+
 func TestLoadJSONUnpacked(t *testing.T) {
 	repo, cleanup := repository.TestRepository(t)
 	defer cleanup()
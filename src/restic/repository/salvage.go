@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"context"
+	"io"
+	"restic"
+	"restic/debug"
+	"restic/fs"
+
+	"restic/errors"
+)
+
+// SalvagePack copies the intact blobs of the damaged pack packID to new packs.
+// The blobs are located with the index, as the pack header may be damaged as
+// well; only if the index does not list the pack, the header is used. Blobs
+// which cannot be read or decrypted or whose hash does not match their ID are
+// returned. Blobs of encryption domains for which no key is available can't be
+// verified and are copied as they are. The pack itself is not removed, the new
+// packs are saved with repo.Flush.
+func SalvagePack(ctx context.Context, repo *Repository, packID restic.ID) (damaged restic.BlobSet, err error) {
+	h := restic.Handle{Type: restic.DataFile, Name: packID.String()}
+
+	tempfile, err := fs.TempFile("", "restic-temp-salvage-")
+	if err != nil {
+		return nil, errors.Wrap(err, "TempFile")
+	}
+
+	defer func() {
+		_ = tempfile.Close()
+		_ = fs.RemoveIfExists(tempfile.Name())
+	}()
+
+	rd, err := repo.Backend().Load(ctx, h, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := io.Copy(tempfile, rd)
+	if err != nil {
+		_ = rd.Close()
+		return nil, errors.Wrap(err, "Copy")
+	}
+
+	if err = rd.Close(); err != nil {
+		return nil, errors.Wrap(err, "Close")
+	}
+
+	var blobs []restic.Blob
+	for _, pb := range repo.idx.ListPack(packID) {
+		blobs = append(blobs, pb.Blob)
+	}
+
+	if len(blobs) == 0 {
+		debug.Log("pack %v is not in the index, using the header", packID.Str())
+		blobs, err = repo.PackBlobs(tempfile, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	damaged = restic.NewBlobSet()
+	saved := make(map[domainBlob]bool)
+
+	var buf, plaintext []byte
+	for _, blob := range blobs {
+		h := restic.BlobHandle{ID: blob.ID, Type: blob.Type}
+		if saved[domainBlob{h, blob.Domain}] {
+			continue
+		}
+
+		if cap(buf) < int(blob.Length) {
+			buf = make([]byte, blob.Length)
+		}
+		buf = buf[:blob.Length]
+
+		if _, err = tempfile.ReadAt(buf, int64(blob.Offset)); err != nil {
+			debug.Log("  unable to read blob %v: %v", h, err)
+			damaged.Insert(h)
+			continue
+		}
+
+		key, err := repo.DomainKey(blob.Domain)
+		if err == nil {
+			plaintext, err = decryptBlob(key, blob, buf, plaintext)
+			if err != nil || !restic.Hash(plaintext).Equal(blob.ID) {
+				debug.Log("  blob %v is damaged: %v", h, err)
+				damaged.Insert(h)
+				continue
+			}
+		} else {
+			debug.Log("  unable to verify blob %v: %v", h, err)
+		}
+
+		if err = repo.saveCiphertext(blob, buf); err != nil {
+			return nil, err
+		}
+
+		saved[domainBlob{h, blob.Domain}] = true
+	}
+
+	// a blob may be stored more than once in the pack
+	for db := range saved {
+		damaged.Delete(db.BlobHandle)
+	}
+
+	debug.Log("salvaged %d of %d blobs of pack %v", len(saved), len(blobs), packID.Str())
+	return damaged, nil
+}
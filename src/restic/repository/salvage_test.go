@@ -0,0 +1,87 @@
+package repository_test
+
+import (
+	"bytes"
+	"context"
+	"restic"
+	"restic/backend"
+	"restic/repository"
+	"testing"
+)
+
+func TestSalvagePack(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	createRandomBlobs(t, repo, 30, 0.7)
+	saveIndex(t, repo)
+
+	// find a pack with more than one blob
+	var (
+		packID  restic.ID
+		entries []restic.Blob
+	)
+	for id := range listPacks(t, repo) {
+		list, _, err := repo.ListPack(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list) > 1 {
+			packID, entries = id, list
+			break
+		}
+	}
+
+	if entries == nil {
+		t.Skip("no pack with more than one blob found")
+	}
+
+	// damage the first blob
+	h := restic.Handle{Type: restic.DataFile, Name: packID.String()}
+	buf, err := backend.LoadAll(context.TODO(), repo.Backend(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[entries[0].Offset+entries[0].Length/2] ^= 0xff
+
+	if err = repo.Backend().Remove(context.TODO(), h); err != nil {
+		t.Fatal(err)
+	}
+	if err = repo.Backend().Save(context.TODO(), h, bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+
+	damaged, err := repository.SalvagePack(context.TODO(), repo.(*repository.Repository), packID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := restic.BlobHandle{ID: entries[0].ID, Type: entries[0].Type}
+	if !damaged.Equals(restic.NewBlobSet(first)) {
+		t.Fatalf("wrong damaged blobs, want %v, got %v", first, damaged)
+	}
+
+	if err = repo.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// without the damaged pack, only the damaged blob is missing
+	if err = repo.Backend().Remove(context.TODO(), h); err != nil {
+		t.Fatal(err)
+	}
+	saveIndex(t, repo)
+	rebuildIndex(t, repo)
+	reloadIndex(t, repo)
+
+	if repo.Index().Has(first.ID, first.Type) {
+		t.Errorf("damaged blob %v is still in the index", first.ID.Str())
+	}
+
+	for _, blob := range entries[1:] {
+		buf := make([]byte, blob.Length)
+		if _, err = repo.LoadBlob(context.TODO(), blob.Type, blob.ID, buf); err != nil {
+			t.Errorf("unable to load blob %v: %v", blob.ID.Str(), err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package restic
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"restic/debug"
+	"restic/errors"
+	"restic/fs"
+)
+
+// restoreJournalHeader is the first line of a restore journal, followed by
+// the ID of the snapshot.
+const restoreJournalHeader = "restic restore journal"
+
+// RestoreJournal records the files which have been restored completely, so
+// that an interrupted restore can skip them when it is started again. Each
+// file is written as one line with the quoted path within the snapshot.
+type RestoreJournal struct {
+	filename string
+	f        *os.File
+	w        *bufio.Writer
+	done     map[string]struct{}
+}
+
+// OpenRestoreJournal opens the journal in filename for the snapshot id. If
+// the file already contains a journal for the same snapshot, the files listed
+// in it are reported as done, otherwise a new journal is started.
+func OpenRestoreJournal(filename string, id ID) (*RestoreJournal, error) {
+	j := &RestoreJournal{
+		filename: filename,
+		done:     make(map[string]struct{}),
+	}
+
+	header := fmt.Sprintf("%s %s", restoreJournalHeader, id)
+
+	if err := j.load(header); err != nil {
+		return nil, err
+	}
+
+	// write the journal again, so that an incomplete last line from an
+	// interrupted run is removed
+	f, err := fs.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "OpenFile")
+	}
+
+	j.f = f
+	j.w = bufio.NewWriter(f)
+
+	if _, err = fmt.Fprintln(j.w, header); err != nil {
+		_ = f.Close()
+		return nil, errors.Wrap(err, "Write")
+	}
+
+	for item := range j.done {
+		if _, err = fmt.Fprintln(j.w, strconv.Quote(item)); err != nil {
+			_ = f.Close()
+			return nil, errors.Wrap(err, "Write")
+		}
+	}
+
+	if err = j.w.Flush(); err != nil {
+		_ = f.Close()
+		return nil, errors.Wrap(err, "Flush")
+	}
+
+	return j, nil
+}
+
+// load reads the entries of an existing journal with the given header.
+func (j *RestoreJournal) load(header string) error {
+	f, err := fs.Open(j.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Open")
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() || sc.Text() != header {
+		debug.Log("journal %v belongs to another snapshot, starting over", j.filename)
+		return nil
+	}
+
+	for sc.Scan() {
+		item, err := strconv.Unquote(strings.TrimSpace(sc.Text()))
+		if err != nil {
+			debug.Log("ignoring invalid line in journal %v: %q", j.filename, sc.Text())
+			continue
+		}
+
+		j.done[item] = struct{}{}
+	}
+
+	debug.Log("loaded %d entries from journal %v", len(j.done), j.filename)
+	return errors.Wrap(sc.Err(), "Scan")
+}
+
+// Done returns true if item was recorded as restored.
+func (j *RestoreJournal) Done(item string) bool {
+	_, ok := j.done[item]
+	return ok
+}
+
+// Len returns the number of files recorded in the journal.
+func (j *RestoreJournal) Len() int {
+	return len(j.done)
+}
+
+// Add records that item was restored completely. The entry is written to the
+// file immediately, so it is not lost when restic is interrupted.
+func (j *RestoreJournal) Add(item string) error {
+	if j.Done(item) {
+		return nil
+	}
+
+	j.done[item] = struct{}{}
+
+	if _, err := fmt.Fprintln(j.w, strconv.Quote(item)); err != nil {
+		return errors.Wrap(err, "Write")
+	}
+
+	return errors.Wrap(j.w.Flush(), "Flush")
+}
+
+// Close closes the journal file.
+func (j *RestoreJournal) Close() error {
+	return errors.Wrap(j.f.Close(), "Close")
+}
+
+// Remove closes and removes the journal file, it is used after the restore
+// finished successfully.
+func (j *RestoreJournal) Remove() error {
+	if err := j.Close(); err != nil {
+		return err
+	}
+
+	return errors.Wrap(fs.Remove(j.filename), "Remove")
+}
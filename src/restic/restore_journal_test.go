@@ -0,0 +1,55 @@
+package restic_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"restic"
+	. "restic/test"
+)
+
+func TestRestoreJournal(t *testing.T) {
+	dir, cleanup := TempDir(t)
+	defer cleanup()
+
+	filename := filepath.Join(dir, "journal")
+	id := restic.NewRandomID()
+
+	j, err := restic.OpenRestoreJournal(filename, id)
+	OK(t, err)
+	Equals(t, 0, j.Len())
+
+	OK(t, j.Add("/foo/bar"))
+	OK(t, j.Add("/foo/name with\nnewline"))
+	OK(t, j.Close())
+
+	// simulate a line which was written only partially
+	buf, err := ioutil.ReadFile(filename)
+	OK(t, err)
+	OK(t, ioutil.WriteFile(filename, append(buf, []byte(`"/foo/ba`)...), 0600))
+
+	j, err = restic.OpenRestoreJournal(filename, id)
+	OK(t, err)
+	Equals(t, 2, j.Len())
+	Assert(t, j.Done("/foo/bar"), "entry not found in journal")
+	Assert(t, j.Done("/foo/name with\nnewline"), "entry not found in journal")
+	Assert(t, !j.Done("/foo/ba"), "incomplete entry found in journal")
+
+	OK(t, j.Add("/baz"))
+	OK(t, j.Close())
+
+	j, err = restic.OpenRestoreJournal(filename, id)
+	OK(t, err)
+	Equals(t, 3, j.Len())
+	OK(t, j.Close())
+
+	// a journal for another snapshot is discarded
+	j, err = restic.OpenRestoreJournal(filename, restic.NewRandomID())
+	OK(t, err)
+	Equals(t, 0, j.Len())
+
+	OK(t, j.Remove())
+	_, err = ioutil.ReadFile(filename)
+	Assert(t, err != nil, "journal still exists after Remove()")
+}
@@ -0,0 +1,566 @@
+package restic
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"restic/compression"
+	"restic/crypto"
+	"restic/debug"
+	"restic/errors"
+	"restic/fs"
+	"restic/limits"
+)
+
+const (
+	// restorePlanMaxGap is the largest amount of unneeded data between two
+	// blobs in a pack which is downloaded to save a request.
+	restorePlanMaxGap = 1024 * 1024
+
+	// restorePlanMaxRange is the largest range (unless a single blob is
+	// larger) which is downloaded with a single request.
+	restorePlanMaxRange = 16 * 1024 * 1024
+
+	// restorePlanWorkers is the number of packs which are downloaded in
+	// parallel.
+	restorePlanWorkers = 4
+)
+
+// RestorePlan lists the requests which download the data for a restore. The
+// packs are sorted by ID and the blobs needed from each pack are coalesced
+// into as few ranged requests as possible.
+type RestorePlan struct {
+	Files     int          `json:"files"`
+	FileBytes uint64       `json:"file_bytes"`
+	Packs     []PackRanges `json:"packs"`
+
+	// Clones is the number of files with the same content as another file
+	// of the restore. They are not downloaded again but copied from the
+	// other file, as a reflink where the file system supports it.
+	Clones int `json:"clones,omitempty"`
+
+	// Missing are the blobs which are not in the index, the files which
+	// contain them are restored without the plan.
+	Missing IDs `json:"missing,omitempty"`
+}
+
+// PackRanges are the ranges which are downloaded from a pack.
+type PackRanges struct {
+	PackID ID          `json:"pack"`
+	Ranges []PackRange `json:"ranges"`
+}
+
+// PackRange is the part of a pack downloaded with a single request.
+type PackRange struct {
+	Offset uint         `json:"offset"`
+	Length uint         `json:"length"`
+	Blobs  []PackedBlob `json:"-"`
+}
+
+// Requests returns the number of requests needed to download the data.
+func (p *RestorePlan) Requests() (n int) {
+	for _, pack := range p.Packs {
+		n += len(pack.Ranges)
+	}
+	return n
+}
+
+// Bytes returns the number of bytes which are downloaded, including the data
+// between the blobs of a request.
+func (p *RestorePlan) Bytes() (n uint64) {
+	for _, pack := range p.Packs {
+		for _, r := range pack.Ranges {
+			n += uint64(r.Length)
+		}
+	}
+	return n
+}
+
+// BlobBytes returns the size of the blobs which are downloaded.
+func (p *RestorePlan) BlobBytes() (n uint64) {
+	for _, pack := range p.Packs {
+		for _, r := range pack.Ranges {
+			for _, blob := range r.Blobs {
+				n += uint64(blob.Length)
+			}
+		}
+	}
+	return n
+}
+
+// byOffset sorts blobs by their offset in the pack.
+type byOffset []PackedBlob
+
+func (s byOffset) Len() int           { return len(s) }
+func (s byOffset) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byOffset) Less(i, j int) bool { return s[i].Offset < s[j].Offset }
+
+// coalesceRanges joins the blobs (sorted by offset) into ranges. Blobs are
+// joined if the gap between them is at most maxGap and the range does not
+// grow larger than maxRange.
+func coalesceRanges(blobs []PackedBlob, maxGap, maxRange uint) []PackRange {
+	var ranges []PackRange
+	for _, blob := range blobs {
+		if len(ranges) > 0 {
+			r := &ranges[len(ranges)-1]
+			end := r.Offset + r.Length
+			if blob.Offset >= end && blob.Offset-end <= maxGap && blob.Offset+blob.Length-r.Offset <= maxRange {
+				r.Length = blob.Offset + blob.Length - r.Offset
+				r.Blobs = append(r.Blobs, blob)
+				continue
+			}
+		}
+
+		ranges = append(ranges, PackRange{Offset: blob.Offset, Length: blob.Length, Blobs: []PackedBlob{blob}})
+	}
+
+	return ranges
+}
+
+// newRestorePlan returns the plan for downloading the data blobs. For each
+// blob, the first copy which can be decrypted with the available keys is used.
+func newRestorePlan(repo Repository, blobs IDSet) *RestorePlan {
+	plan := &RestorePlan{}
+	packs := make(map[ID][]PackedBlob)
+
+	for id := range blobs {
+		list, err := repo.Index().Lookup(id, DataBlob)
+		if err != nil {
+			debug.Log("blob %v not found: %v", id.Str(), err)
+			plan.Missing = append(plan.Missing, id)
+			continue
+		}
+
+		found := false
+		for _, blob := range list {
+			if _, err := repo.DomainKey(blob.Domain); err != nil {
+				continue
+			}
+
+			packs[blob.PackID] = append(packs[blob.PackID], blob)
+			found = true
+			break
+		}
+
+		if !found {
+			plan.Missing = append(plan.Missing, id)
+		}
+	}
+
+	var ids IDs
+	for id := range packs {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+
+	for _, id := range ids {
+		list := packs[id]
+		sort.Sort(byOffset(list))
+		plan.Packs = append(plan.Packs, PackRanges{
+			PackID: id,
+			Ranges: coalesceRanges(list, restorePlanMaxGap, restorePlanMaxRange),
+		})
+	}
+
+	sort.Sort(plan.Missing)
+	return plan
+}
+
+// plannedFile is a file whose contents are written by the plan.
+type plannedFile struct {
+	path string
+	node *Node
+
+	// source is the index of a file with the same content, which is copied
+	// instead of writing the downloaded data, or -1.
+	source int
+}
+
+// blobTarget is a location in a planned file where a blob is written.
+type blobTarget struct {
+	file   int
+	offset int64
+}
+
+// restorePlanState holds the plan of a restore and the files it writes.
+type restorePlanState struct {
+	plan    *RestorePlan
+	files   []plannedFile
+	targets map[ID][]blobTarget
+
+	// contents maps the content of the files to the first file with it.
+	contents map[string]int
+
+	// noReflink is set when creating a reflink failed, the destination does
+	// not support them.
+	noReflink bool
+
+	m      sync.Mutex
+	failed map[int]struct{}
+}
+
+// Plan walks the snapshot and returns the plan for downloading the data of
+// the files which are restored to dst. RestoreTo then uses this plan.
+func (res *Restorer) Plan(ctx context.Context, dst string) (*RestorePlan, error) {
+	state := &restorePlanState{
+		targets:  make(map[ID][]blobTarget),
+		contents: make(map[string]int),
+		failed:   make(map[int]struct{}),
+	}
+
+	if res.trees == nil {
+		res.trees = make(map[ID]*Tree)
+	}
+
+	err := res.planTree(ctx, state, dst, string(filepath.Separator), *res.sn.Tree, NewHardlinkIndex())
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := NewIDSet()
+	for id := range state.targets {
+		blobs.Insert(id)
+	}
+	state.plan = newRestorePlan(res.repo, blobs)
+
+	// files with missing blobs are restored (and the errors reported)
+	// without the plan
+	missing := NewIDSet(state.plan.Missing...)
+	for i, f := range state.files {
+		for _, id := range f.node.Content {
+			if missing.Has(id) {
+				state.failed[i] = struct{}{}
+				break
+			}
+		}
+	}
+
+	for i, f := range state.files {
+		if _, ok := state.failed[i]; !ok {
+			state.plan.Files++
+			state.plan.FileBytes += f.node.Size
+			if f.source >= 0 {
+				state.plan.Clones++
+			}
+		}
+	}
+
+	res.plan, res.planDst = state, dst
+	return state.plan, nil
+}
+
+// planTree collects the files in the tree which are restored by restoreTo.
+// Errors are ignored here, they are reported when the tree is restored.
+func (res *Restorer) planTree(ctx context.Context, state *restorePlanState, dst, dir string, treeID ID, idx *HardlinkIndex) error {
+	tree, err := res.loadTree(ctx, treeID)
+	if err != nil {
+		debug.Log("unable to load tree %v: %v", treeID.Str(), err)
+		return nil
+	}
+
+	for _, node := range tree.Nodes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		item := filepath.Join(dir, node.Name)
+		dstPath := filepath.Join(dst, dir, node.Name)
+
+		if node.Type == "file" && res.SelectFilter(item, dstPath, node) {
+			res.planFile(state, item, dstPath, node, idx)
+		}
+
+		if node.Type == "dir" && node.Subtree != nil {
+			if err = res.planTree(ctx, state, dst, item, *node.Subtree, idx); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// planFile adds the file to the plan, unless it has been restored before or
+// is a hard link to a file restored earlier.
+func (res *Restorer) planFile(state *restorePlanState, item, dstPath string, node *Node, idx *HardlinkIndex) {
+	if node.Links > 1 {
+		if idx.Has(node.Inode, node.DeviceID) {
+			return
+		}
+		idx.Add(node.Inode, node.DeviceID, dstPath)
+	}
+
+	if res.Journal != nil && res.Journal.Done(item) && fileComplete(dstPath, node) {
+		return
+	}
+
+	file := len(state.files)
+	if node.Size > 0 {
+		key := node.Content.Key()
+		if source, ok := state.contents[key]; ok {
+			state.files = append(state.files, plannedFile{path: dstPath, node: node, source: source})
+			return
+		}
+		state.contents[key] = file
+	}
+
+	state.files = append(state.files, plannedFile{path: dstPath, node: node, source: -1})
+
+	var offset int64
+	for _, id := range node.Content {
+		size, err := res.repo.LookupBlobSize(id, DataBlob)
+		if err != nil {
+			// the blob is reported as missing by the plan
+			state.targets[id] = append(state.targets[id], blobTarget{file: file})
+			continue
+		}
+
+		state.targets[id] = append(state.targets[id], blobTarget{file: file, offset: offset})
+		offset += int64(size)
+	}
+}
+
+// fail records that the contents of the file could not be written by the
+// plan, so the file is restored without it.
+func (state *restorePlanState) fail(file int, err error) {
+	debug.Log("writing %v failed: %v", state.files[file].path, err)
+
+	state.m.Lock()
+	state.failed[file] = struct{}{}
+	state.m.Unlock()
+}
+
+// planned returns the paths of the files whose contents have been written.
+func (state *restorePlanState) planned() map[string]struct{} {
+	paths := make(map[string]struct{}, len(state.files))
+	for i, f := range state.files {
+		if _, ok := state.failed[i]; !ok {
+			paths[f.path] = struct{}{}
+		}
+	}
+	return paths
+}
+
+// executePlan creates the planned files and downloads their contents.
+func (res *Restorer) executePlan(ctx context.Context) error {
+	state := res.plan
+
+	for i, f := range state.files {
+		if _, ok := state.failed[i]; ok || f.source >= 0 {
+			continue
+		}
+
+		if err := createPlannedFile(f.path, f.node, res.FileWrite); err != nil {
+			state.fail(i, err)
+		}
+	}
+
+	ch := make(chan PackRanges)
+	var wg sync.WaitGroup
+	for i := 0; i < limits.Workers(restorePlanWorkers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 0, restorePlanMaxRange)
+			for pack := range ch {
+				for _, r := range pack.Ranges {
+					buf = res.restoreRange(ctx, state, pack.PackID, r, buf)
+				}
+			}
+		}()
+	}
+
+	for _, pack := range state.plan.Packs {
+		select {
+		case ch <- pack:
+		case <-ctx.Done():
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	state.cloneFiles(res.FileWrite.Sparse)
+	return nil
+}
+
+// cloneFiles copies the files which have the same content as another file
+// from it, after the downloaded data has been written. With sparse, all files
+// are copied as sparse files.
+func (state *restorePlanState) cloneFiles(sparse bool) {
+	for i, f := range state.files {
+		if f.source < 0 {
+			continue
+		}
+
+		if _, ok := state.failed[i]; ok {
+			continue
+		}
+
+		if _, ok := state.failed[f.source]; ok {
+			state.fail(i, errors.Errorf("writing %v failed", state.files[f.source].path))
+			continue
+		}
+
+		reflinked, err := cloneFile(state.files[f.source].path, f.path, !state.noReflink, sparse || f.node.Sparse)
+		if err != nil {
+			state.fail(i, err)
+			continue
+		}
+
+		if !reflinked && !state.noReflink {
+			debug.Log("creating reflinks is not supported for %v", f.path)
+			state.noReflink = true
+		}
+	}
+}
+
+// cloneFile creates the file dst (and the directories above it) with the
+// content of src. If useReflink is set, dst is created as a reflink to src
+// first, so that both files share the data on file systems like btrfs and
+// XFS. When this fails, the data is copied and false is returned. If sparse is
+// set, blocks of zeros are not written to dst.
+func cloneFile(src, dst string, useReflink, sparse bool) (reflinked bool, err error) {
+	if err := fs.MkdirAll(filepath.Dir(dst), 0700); err != nil && !os.IsExist(errors.Cause(err)) {
+		return false, errors.Wrap(err, "MkdirAll")
+	}
+
+	in, err := fs.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return false, errors.Wrap(err, "OpenFile")
+	}
+	defer in.Close()
+
+	out, err := fs.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return false, errors.Wrap(err, "OpenFile")
+	}
+
+	if useReflink {
+		if err = reflink(out, in); err == nil {
+			return true, errors.Wrap(out.Close(), "Close")
+		}
+		debug.Log("reflink %v to %v failed: %v", src, dst, err)
+	}
+
+	fi, err := in.Stat()
+	if err != nil {
+		_ = out.Close()
+		return false, errors.Wrap(err, "Stat")
+	}
+
+	w := &fileWriter{path: dst, f: out, sparse: sparse, size: fi.Size()}
+	if _, err = io.Copy(w, in); err != nil {
+		_ = out.Close()
+		return false, errors.Wrap(err, "Copy")
+	}
+
+	return false, w.Close()
+}
+
+// createPlannedFile creates the file at path (and the directories above it),
+// the contents are written later.
+func createPlannedFile(path string, node *Node, opts FileWriteOptions) error {
+	if err := fs.MkdirAll(filepath.Dir(path), 0700); err != nil && !os.IsExist(errors.Cause(err)) {
+		return errors.Wrap(err, "MkdirAll")
+	}
+
+	f, err := newFileWriter(path, int64(node.Size), FileWriteOptions{
+		Preallocate: opts.Preallocate,
+		Sparse:      opts.Sparse || node.Sparse,
+	})
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// restoreRange downloads the range of the pack and writes the blobs it
+// contains to the files. The buffer is reused, the possibly grown buffer is
+// returned.
+func (res *Restorer) restoreRange(ctx context.Context, state *restorePlanState, packID ID, r PackRange, buf []byte) []byte {
+	failAll := func(blobs []PackedBlob, err error) {
+		for _, blob := range blobs {
+			for _, t := range state.targets[blob.ID] {
+				state.fail(t.file, err)
+			}
+		}
+	}
+
+	if cap(buf) < int(r.Length) {
+		buf = make([]byte, r.Length)
+	}
+	buf = buf[:r.Length]
+
+	h := Handle{Type: DataFile, Name: packID.String()}
+	n, err := ReadAt(ctx, res.repo.Backend(), h, int64(r.Offset), buf)
+	if err == nil && n != len(buf) {
+		err = errors.Errorf("pack %v: wrong length returned, want %d, got %d", packID.Str(), len(buf), n)
+	}
+	if err != nil {
+		failAll(r.Blobs, err)
+		return buf
+	}
+
+	var decompressed []byte
+	for _, blob := range r.Blobs {
+		ciphertext := buf[blob.Offset-r.Offset : blob.Offset-r.Offset+blob.Length]
+
+		key, err := res.repo.DomainKey(blob.Domain)
+		if err != nil {
+			failAll([]PackedBlob{blob}, err)
+			continue
+		}
+
+		n, err := crypto.Decrypt(key, ciphertext, ciphertext)
+		plaintext := ciphertext[:n]
+		if err == nil && blob.IsCompressed() {
+			decompressed, err = compression.Decompress(decompressed, plaintext, blob.UncompressedLength)
+			plaintext = decompressed
+		}
+		if err == nil && !Hash(plaintext).Equal(blob.ID) {
+			err = errors.Errorf("blob %v returned invalid hash", blob.ID.Str())
+		}
+		if err != nil {
+			failAll([]PackedBlob{blob}, err)
+			continue
+		}
+
+		zero := isZero(plaintext)
+		for _, t := range state.targets[blob.ID] {
+			// the holes of sparse files have been created with the file
+			if zero && (res.FileWrite.Sparse || state.files[t.file].node.Sparse) {
+				continue
+			}
+
+			if err = writeAt(state.files[t.file].path, plaintext, t.offset); err != nil {
+				state.fail(t.file, err)
+			}
+		}
+	}
+
+	return buf
+}
+
+// writeAt writes data to the file at path at the given offset.
+func writeAt(path string, data []byte, offset int64) error {
+	f, err := fs.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "OpenFile")
+	}
+
+	if _, err = f.WriteAt(data, offset); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "WriteAt")
+	}
+
+	return errors.Wrap(f.Close(), "Close")
+}
@@ -0,0 +1,74 @@
+package restic
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	. "restic/test"
+)
+
+func TestCoalesceRanges(t *testing.T) {
+	blob := func(offset, length uint) PackedBlob {
+		return PackedBlob{Blob: Blob{Offset: offset, Length: length}}
+	}
+
+	blobs := []PackedBlob{
+		blob(0, 100),
+		blob(100, 50),
+		blob(160, 40),  // gap of 10 bytes
+		blob(300, 100), // gap of 100 bytes
+		blob(400, 500), // range would grow too large
+	}
+
+	want := []PackRange{
+		{Offset: 0, Length: 200, Blobs: blobs[:3]},
+		{Offset: 300, Length: 100, Blobs: blobs[3:4]},
+		{Offset: 400, Length: 500, Blobs: blobs[4:]},
+	}
+
+	ranges := coalesceRanges(blobs, 50, 500)
+	if !reflect.DeepEqual(want, ranges) {
+		t.Fatalf("wrong ranges returned, want:\n  %v\ngot:\n  %v", want, ranges)
+	}
+}
+
+func TestCloneFile(t *testing.T) {
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	data := Random(23, 3*1024*1024+17)
+	src := filepath.Join(tempdir, "src")
+	OK(t, ioutil.WriteFile(src, data, 0600))
+
+	for _, useReflink := range []bool{false, true} {
+		dst := filepath.Join(tempdir, "sub", "dst")
+		reflinked, err := cloneFile(src, dst, useReflink, false)
+		OK(t, err)
+		Assert(t, useReflink || !reflinked, "reflink was used although it was disabled")
+
+		buf, err := ioutil.ReadFile(dst)
+		OK(t, err)
+		Assert(t, bytes.Equal(data, buf), "wrong content for clone (reflink %v)", useReflink)
+	}
+}
+
+func TestCloneFileSparse(t *testing.T) {
+	tempdir, cleanup := TempDir(t)
+	defer cleanup()
+
+	data := make([]byte, 3*1024*1024)
+	copy(data[1024*1024:], Random(23, 4096))
+	src := filepath.Join(tempdir, "src")
+	OK(t, ioutil.WriteFile(src, data, 0600))
+
+	dst := filepath.Join(tempdir, "dst")
+	_, err := cloneFile(src, dst, false, true)
+	OK(t, err)
+
+	buf, err := ioutil.ReadFile(dst)
+	OK(t, err)
+	Assert(t, bytes.Equal(data, buf), "wrong content for sparse copy")
+}
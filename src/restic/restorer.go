@@ -18,6 +18,29 @@ type Restorer struct {
 
 	Error        func(dir string, node *Node, err error) error
 	SelectFilter func(item string, dstpath string, node *Node) bool
+
+	// MapSymlink, if set, is called with the target of each symlink before
+	// it is created and returns the target to use instead.
+	MapSymlink func(target string) string
+
+	// SkipExtendedAttributes disables restoring the extended attributes.
+	SkipExtendedAttributes bool
+
+	// FileWrite configures how the contents of files are written.
+	FileWrite FileWriteOptions
+
+	// Journal, if set, records the files which have been restored
+	// completely. Files already listed in it are skipped if they still have
+	// the right size.
+	Journal *RestoreJournal
+
+	// trees are the trees loaded while planning, which are used again when
+	// the snapshot is restored.
+	trees map[ID]*Tree
+
+	plan    *restorePlanState
+	planDst string
+	planned map[string]struct{}
 }
 
 var restorerAbortOnAllErrors = func(str string, node *Node, err error) error { return err }
@@ -39,8 +62,27 @@ func NewRestorer(repo Repository, id ID) (*Restorer, error) {
 	return r, nil
 }
 
+// loadTree returns the tree from the trees loaded while planning or from the
+// repository.
+func (res *Restorer) loadTree(ctx context.Context, id ID) (*Tree, error) {
+	if tree, ok := res.trees[id]; ok {
+		return tree, nil
+	}
+
+	tree, err := res.repo.LoadTree(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.trees != nil {
+		res.trees[id] = tree
+	}
+
+	return tree, nil
+}
+
 func (res *Restorer) restoreTo(ctx context.Context, dst string, dir string, treeID ID, idx *HardlinkIndex) error {
-	tree, err := res.repo.LoadTree(ctx, treeID)
+	tree, err := res.loadTree(ctx, treeID)
 	if err != nil {
 		return res.Error(dir, nil, err)
 	}
@@ -59,7 +101,11 @@ func (res *Restorer) restoreTo(ctx context.Context, dst string, dir string, tree
 
 		if node.Type == "dir" {
 			if node.Subtree == nil {
-				return errors.Errorf("Dir without subtree in tree %v", treeID.Str())
+				err = res.Error(filepath.Join(dir, node.Name), node, errors.Errorf("Dir without subtree in tree %v", treeID.Str()))
+				if err != nil {
+					return err
+				}
+				continue
 			}
 
 			subp := filepath.Join(dir, node.Name)
@@ -75,7 +121,23 @@ func (res *Restorer) restoreTo(ctx context.Context, dst string, dir string, tree
 				// Restore directory timestamp at the end. If we would do it earlier, restoring files within
 				// the directory would overwrite the timestamp of the directory they are in.
 				if err := node.RestoreTimestamps(filepath.Join(dst, dir, node.Name)); err != nil {
-					return err
+					merr := &MetadataError{}
+					merr.add(MetadataTimestamps, err)
+					err = res.Error(filepath.Join(dst, dir, node.Name), node, merr)
+					if err != nil {
+						return err
+					}
+				}
+
+				// Flags like immutable would prevent creating the directory's
+				// content, so they are set last.
+				if err := node.RestoreFlags(filepath.Join(dst, dir, node.Name)); err != nil {
+					merr := &MetadataError{}
+					merr.add(MetadataFlags, err)
+					err = res.Error(filepath.Join(dst, dir, node.Name), node, merr)
+					if err != nil {
+						return err
+					}
 				}
 			}
 		}
@@ -87,23 +149,61 @@ func (res *Restorer) restoreTo(ctx context.Context, dst string, dir string, tree
 func (res *Restorer) restoreNodeTo(ctx context.Context, node *Node, dir string, dst string, idx *HardlinkIndex) error {
 	debug.Log("node %v, dir %v, dst %v", node.Name, dir, dst)
 	dstPath := filepath.Join(dst, dir, node.Name)
+	item := filepath.Join(dir, node.Name)
 
-	err := node.CreateAt(ctx, dstPath, res.repo, idx)
-	if err != nil {
-		debug.Log("node.CreateAt(%s) error %v", dstPath, err)
+	if node.Type == "file" && res.Journal != nil && res.Journal.Done(item) && fileComplete(dstPath, node) {
+		debug.Log("%v has already been restored, skipping", item)
+		if node.Links > 1 {
+			idx.Add(node.Inode, node.DeviceID, dstPath)
+		}
+		return nil
+	}
+
+	if node.Type == "symlink" && res.MapSymlink != nil {
+		target := res.MapSymlink(node.LinkTarget)
+		if target != node.LinkTarget {
+			debug.Log("rewriting symlink target %v to %v", node.LinkTarget, target)
+			n := *node
+			n.LinkTarget = target
+			node = &n
+		}
 	}
 
-	// Did it fail because of ENOENT?
-	if err != nil && os.IsNotExist(errors.Cause(err)) {
-		debug.Log("create intermediate paths")
+	if res.SkipExtendedAttributes && len(node.ExtendedAttributes) > 0 {
+		n := *node
+		n.ExtendedAttributes = nil
+		node = &n
+	}
 
-		// Create parent directories and retry
-		err = fs.MkdirAll(filepath.Dir(dstPath), 0700)
-		if err == nil || os.IsExist(errors.Cause(err)) {
-			err = node.CreateAt(ctx, dstPath, res.repo, idx)
+	var err error
+	if _, ok := res.planned[dstPath]; ok && node.Type == "file" {
+		// the contents have been written by the plan already
+		err = node.restoreMetadata(dstPath)
+		if node.Links > 1 {
+			idx.Add(node.Inode, node.DeviceID, dstPath)
+		}
+	} else {
+		err = node.CreateAtWithOptions(ctx, dstPath, res.repo, idx, res.FileWrite)
+		if err != nil {
+			debug.Log("node.CreateAt(%s) error %v", dstPath, err)
+		}
+
+		// Did it fail because of ENOENT?
+		if err != nil && os.IsNotExist(errors.Cause(err)) {
+			debug.Log("create intermediate paths")
+
+			// Create parent directories and retry
+			err = fs.MkdirAll(filepath.Dir(dstPath), 0700)
+			if err == nil || os.IsExist(errors.Cause(err)) {
+				err = node.CreateAtWithOptions(ctx, dstPath, res.repo, idx, res.FileWrite)
+			}
 		}
 	}
 
+	if err == nil && node.Type == "file" && res.Journal != nil {
+		err = res.Journal.Add(item)
+	}
+
 	if err != nil {
 		debug.Log("error %v", err)
 		err = res.Error(dstPath, node, err)
@@ -117,9 +217,34 @@ func (res *Restorer) restoreNodeTo(ctx context.Context, node *Node, dir string,
 	return nil
 }
 
+// fileComplete returns true if path is a regular file with the size of node.
+func fileComplete(path string, node *Node) bool {
+	fi, err := fs.Lstat(path)
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode().IsRegular() && uint64(fi.Size()) == node.Size
+}
+
 // RestoreTo creates the directories and files in the snapshot below dst.
-// Before an item is created, res.Filter is called.
+// Before an item is created, res.Filter is called. The contents of the files
+// are downloaded first, in the order of the plan (see Plan). With direct I/O,
+// which needs sequential writes, the blobs are loaded file by file instead.
 func (res *Restorer) RestoreTo(ctx context.Context, dst string) error {
+	if !res.FileWrite.DirectIO {
+		if res.plan == nil || res.planDst != dst {
+			if _, err := res.Plan(ctx, dst); err != nil {
+				return err
+			}
+		}
+
+		if err := res.executePlan(ctx); err != nil {
+			return err
+		}
+		res.planned = res.plan.planned()
+	}
+
 	idx := NewHardlinkIndex()
 	return res.restoreTo(ctx, dst, string(filepath.Separator), *res.sn.Tree, idx)
 }
@@ -1,4 +1,5 @@
-package sftp
+// Package shell splits command strings into arguments like a shell does.
+package shell
 
 import (
 	"restic/errors"
@@ -40,8 +41,8 @@ func (s *shellSplitter) isSplitChar(c rune) bool {
 	return c == '\\' || unicode.IsSpace(c)
 }
 
-// SplitShellArgs returns the list of arguments from a shell command string.
-func SplitShellArgs(data string) (cmd string, args []string, err error) {
+// SplitArgs returns the list of arguments from a shell command string.
+func SplitArgs(data string) (cmd string, args []string, err error) {
 	s := &shellSplitter{}
 
 	// derived from strings.SplitFunc
@@ -1,4 +1,4 @@
-package sftp
+package shell
 
 import (
 	"reflect"
@@ -51,7 +51,7 @@ func TestShellSplitter(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run("", func(t *testing.T) {
-			cmd, args, err := SplitShellArgs(test.data)
+			cmd, args, err := SplitArgs(test.data)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -94,7 +94,7 @@ func TestShellSplitterInvalid(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run("", func(t *testing.T) {
-			cmd, args, err := SplitShellArgs(test.data)
+			cmd, args, err := SplitArgs(test.data)
 			if err == nil {
 				t.Fatalf("expected error not found: %v", test.err)
 			}
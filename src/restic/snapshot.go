@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"os/user"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"restic/errors"
+	"restic/limits"
 )
 
 // Snapshot is the state of a resource at one point in time.
@@ -24,6 +26,24 @@ type Snapshot struct {
 	Tags     []string  `json:"tags,omitempty"`
 	Original *ID       `json:"original,omitempty"`
 
+	// Selection lists the options besides the exclude patterns which
+	// selected the files saved in the snapshot, e.g. "one-file-system".
+	Selection []string `json:"selection,omitempty"`
+
+	// Protected snapshots are never removed by forget, so the data they
+	// reference is kept by prune.
+	Protected bool `json:"protected,omitempty"`
+
+	// Checkpoint is set for snapshots saved during a backup which has not
+	// finished yet, they only contain the files saved so far. Checkpoints are
+	// not listed by default and are not considered by the policies of forget.
+	Checkpoint bool `json:"checkpoint,omitempty"`
+
+	// Partial is set for snapshots saved by a backup which stopped at its time
+	// limit, they only contain the files saved so far. The next backup
+	// continues from a partial snapshot and reads all directories again.
+	Partial bool `json:"partial,omitempty"`
+
 	id *ID // plaintext ID, used during restore
 }
 
@@ -62,17 +82,79 @@ func LoadSnapshot(ctx context.Context, repo Repository, id ID) (*Snapshot, error
 	return sn, nil
 }
 
+// snapshotLoadWorkers is the number of snapshots which are loaded in
+// parallel.
+const snapshotLoadWorkers = 16
+
+// ForAllSnapshots lists and loads all snapshots in the repo in parallel and
+// calls fn for each of them as soon as it has been loaded, in arbitrary order.
+// fn is never called concurrently. When a snapshot cannot be loaded, fn is
+// called with the error. Snapshots which the key of an encryption domain
+// cannot read, because they were saved before the repository was upgraded to
+// version 4, are skipped. If fn returns an error, loading stops and the error
+// is returned.
+func ForAllSnapshots(ctx context.Context, repo Repository, fn func(ID, *Snapshot, error) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		id  ID
+		sn  *Snapshot
+		err error
+	}
+
+	ids := repo.List(ctx, SnapshotFile)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	for i := 0; i < limits.Workers(snapshotLoadWorkers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				sn, err := LoadSnapshot(ctx, repo, id)
+				if errors.Code(err) == errors.CodeNoKey {
+					continue
+				}
+
+				select {
+				case results <- result{id: id, sn: sn, err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for res := range results {
+		if err := fn(res.id, res.sn, res.err); err != nil {
+			return err
+		}
+	}
+
+	return ctx.Err()
+}
+
 // LoadAllSnapshots returns a list of all snapshots in the repo.
 func LoadAllSnapshots(ctx context.Context, repo Repository) (snapshots []*Snapshot, err error) {
-	for id := range repo.List(ctx, SnapshotFile) {
-		sn, err := LoadSnapshot(ctx, repo, id)
+	err = ForAllSnapshots(ctx, repo, func(id ID, sn *Snapshot, err error) error {
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		snapshots = append(snapshots, sn)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return
+
+	return snapshots, nil
 }
 
 func (sn Snapshot) String() string {
@@ -97,6 +179,23 @@ func (sn *Snapshot) fillUserInfo() error {
 	return err
 }
 
+// CheckpointTag is reserved and cannot be added to snapshots, so that a tag is
+// never mistaken for the Checkpoint field.
+const CheckpointTag = "checkpoint"
+
+// PartialTag is added to the tags of partial snapshots.
+const PartialTag = "partial"
+
+// CheckTags returns an error if tags contains a reserved tag.
+func CheckTags(tags []string) error {
+	for _, tag := range tags {
+		if tag == CheckpointTag {
+			return errors.Errorf("tag %q is reserved", tag)
+		}
+	}
+	return nil
+}
+
 // AddTags adds the given tags to the snapshots tags, preventing duplicates.
 // It returns true if any changes were made.
 func (sn *Snapshot) AddTags(addTags []string) (changed bool) {
@@ -183,16 +282,19 @@ func FindLatestSnapshot(ctx context.Context, repo Repository, targets []string,
 		found    bool
 	)
 
-	for snapshotID := range repo.List(ctx, SnapshotFile) {
-		snapshot, err := LoadSnapshot(ctx, repo, snapshotID)
+	err := ForAllSnapshots(ctx, repo, func(snapshotID ID, snapshot *Snapshot, err error) error {
 		if err != nil {
-			return ID{}, errors.Errorf("Error listing snapshot: %v", err)
+			return errors.Errorf("Error listing snapshot: %v", err)
 		}
 		if snapshot.Time.After(latest) && (hostname == "" || hostname == snapshot.Hostname) && snapshot.HasTags(tags) && snapshot.HasPaths(targets) {
 			latest = snapshot.Time
 			latestID = snapshotID
 			found = true
 		}
+		return nil
+	})
+	if err != nil {
+		return ID{}, err
 	}
 
 	if !found {
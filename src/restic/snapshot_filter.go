@@ -83,7 +83,8 @@ func always(d time.Time) int {
 }
 
 // ApplyPolicy returns the snapshots from list that are to be kept and removed
-// according to the policy p. list is sorted in the process.
+// according to the policy p. Protected snapshots are always kept. list is
+// sorted in the process.
 func ApplyPolicy(list Snapshots, p ExpirePolicy) (keep, remove Snapshots) {
 	sort.Sort(list)
 
@@ -111,7 +112,11 @@ func ApplyPolicy(list Snapshots, p ExpirePolicy) (keep, remove Snapshots) {
 	for _, cur := range list {
 		var keepSnap bool
 
-		// Tags are handled specially as they are not counted.
+		// Protected snapshots and tags are handled specially as they are
+		// not counted.
+		if cur.Protected {
+			keepSnap = true
+		}
 		if len(p.Tags) > 0 {
 			if cur.HasTags(p.Tags) {
 				keepSnap = true
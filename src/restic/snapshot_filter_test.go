@@ -223,3 +223,22 @@ func TestApplyPolicy(t *testing.T) {
 		}
 	}
 }
+
+func TestApplyPolicyProtected(t *testing.T) {
+	var list restic.Snapshots
+	for i := 0; i < 5; i++ {
+		list = append(list, &restic.Snapshot{
+			Time:      parseTimeUTC("2016-01-01 10:00:00").AddDate(0, 0, i),
+			Protected: i == 0,
+		})
+	}
+
+	keep, remove := restic.ApplyPolicy(list, restic.ExpirePolicy{Last: 2})
+	if len(keep) != 3 || len(remove) != 2 {
+		t.Fatalf("wrong number of snapshots kept (%d) and removed (%d)", len(keep), len(remove))
+	}
+
+	if !keep[2].Protected {
+		t.Errorf("protected snapshot has not been kept")
+	}
+}
@@ -1,9 +1,13 @@
 package restic_test
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"restic"
+	"restic/repository"
 	. "restic/test"
 )
 
@@ -13,3 +17,40 @@ func TestNewSnapshot(t *testing.T) {
 	_, err := restic.NewSnapshot(paths, nil, "foo")
 	OK(t, err)
 }
+
+func TestForAllSnapshots(t *testing.T) {
+	repo, cleanup := repository.TestRepository(t)
+	defer cleanup()
+
+	want := restic.NewIDSet()
+	for i := 0; i < 50; i++ {
+		sn, err := restic.NewSnapshot([]string{"/home/foobar"}, nil, "foo")
+		OK(t, err)
+		sn.Time = sn.Time.Add(time.Duration(i) * time.Second)
+
+		id, err := repo.SaveJSONUnpacked(context.TODO(), restic.SnapshotFile, sn)
+		OK(t, err)
+		want.Insert(id)
+	}
+
+	got := restic.NewIDSet()
+	err := restic.ForAllSnapshots(context.TODO(), repo, func(id restic.ID, sn *restic.Snapshot, err error) error {
+		OK(t, err)
+		Assert(t, sn.ID().Equal(id), "snapshot %v returned for ID %v", sn.ID().Str(), id.Str())
+		Assert(t, !got.Has(id), "snapshot %v returned twice", id.Str())
+		got.Insert(id)
+		return nil
+	})
+	OK(t, err)
+	Equals(t, want, got)
+
+	// an error returned by the callback stops loading
+	errStop := errors.New("stop")
+	calls := 0
+	err = restic.ForAllSnapshots(context.TODO(), repo, func(restic.ID, *restic.Snapshot, error) error {
+		calls++
+		return errStop
+	})
+	Equals(t, errStop, err)
+	Equals(t, 1, calls)
+}
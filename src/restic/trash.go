@@ -0,0 +1,132 @@
+package restic
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"time"
+
+	"restic/errors"
+)
+
+// TrashedSnapshot is a snapshot which has been removed by forget, but can be
+// restored until it expires. Until then, prune keeps the data referenced by
+// the snapshot.
+type TrashedSnapshot struct {
+	Time     time.Time `json:"time"`
+	Expires  time.Time `json:"expires"`
+	ID       ID        `json:"id"`
+	Snapshot *Snapshot `json:"snapshot"`
+
+	// Data is the (encrypted) content of the snapshot file, so that the
+	// snapshot can be restored with the same ID.
+	Data []byte `json:"data"`
+
+	id *ID
+}
+
+// TrashSnapshot moves the snapshot with the given id to the trash, where it
+// is kept for grace.
+func TrashSnapshot(ctx context.Context, repo Repository, id ID, grace time.Duration) (*TrashedSnapshot, error) {
+	sn, err := LoadSnapshot(ctx, repo, id)
+	if err != nil {
+		return nil, err
+	}
+
+	h := Handle{Type: SnapshotFile, Name: id.String()}
+	rd, err := repo.Backend().Load(ctx, h, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(rd)
+	if e := rd.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadAll")
+	}
+
+	now := time.Now()
+	t := &TrashedSnapshot{
+		Time:     now,
+		Expires:  now.Add(grace),
+		ID:       id,
+		Snapshot: sn,
+		Data:     data,
+	}
+
+	trashID, err := repo.SaveJSONUnpacked(ctx, TrashFile, t)
+	if err != nil {
+		return nil, err
+	}
+	t.id = &trashID
+
+	if err = repo.Backend().Remove(ctx, h); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// LoadTrashedSnapshot loads the trashed snapshot with the id and returns it.
+func LoadTrashedSnapshot(ctx context.Context, repo Repository, id ID) (*TrashedSnapshot, error) {
+	t := &TrashedSnapshot{id: &id}
+	err := repo.LoadJSONUnpacked(ctx, TrashFile, id, t)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Snapshot == nil {
+		return nil, errors.Errorf("trashed snapshot %v is empty", id.Str())
+	}
+	t.Snapshot.id = &t.ID
+
+	return t, nil
+}
+
+// LoadAllTrashedSnapshots returns a list of all trashed snapshots in the
+// repo.
+func LoadAllTrashedSnapshots(ctx context.Context, repo Repository) (list []*TrashedSnapshot, err error) {
+	for id := range repo.List(ctx, TrashFile) {
+		t, err := LoadTrashedSnapshot(ctx, repo, id)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, t)
+	}
+	return list, nil
+}
+
+// Expired returns true if the snapshot cannot be restored any more at now.
+func (t TrashedSnapshot) Expired(now time.Time) bool {
+	return !now.Before(t.Expires)
+}
+
+// Restore moves the snapshot back from the trash, it keeps its original ID.
+func (t *TrashedSnapshot) Restore(ctx context.Context, repo Repository) error {
+	if t.id == nil {
+		return errors.New("trashed snapshot has no ID")
+	}
+
+	if !Hash(t.Data).Equal(t.ID) {
+		return errors.Errorf("content of trashed snapshot %v does not match its ID", t.ID.Str())
+	}
+
+	h := Handle{Type: SnapshotFile, Name: t.ID.String()}
+	if err := repo.Backend().Save(ctx, h, bytes.NewReader(t.Data)); err != nil {
+		return err
+	}
+
+	return repo.Backend().Remove(ctx, Handle{Type: TrashFile, Name: t.id.String()})
+}
+
+// Purge removes the snapshot from the trash for good.
+func (t *TrashedSnapshot) Purge(ctx context.Context, repo Repository) error {
+	if t.id == nil {
+		return errors.New("trashed snapshot has no ID")
+	}
+
+	return repo.Backend().Remove(ctx, Handle{Type: TrashFile, Name: t.id.String()})
+}
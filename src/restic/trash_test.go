@@ -0,0 +1,18 @@
+package restic_test
+
+import (
+	"testing"
+	"time"
+
+	"restic"
+	. "restic/test"
+)
+
+func TestTrashedSnapshotExpired(t *testing.T) {
+	now := time.Now()
+	ts := restic.TrashedSnapshot{Time: now, Expires: now.Add(time.Hour)}
+
+	Assert(t, !ts.Expired(now), "snapshot has expired right after it was trashed")
+	Assert(t, !ts.Expired(now.Add(time.Minute)), "snapshot has expired before the grace period passed")
+	Assert(t, ts.Expired(now.Add(time.Hour)), "snapshot has not expired after the grace period passed")
+}
@@ -0,0 +1,202 @@
+package walk
+
+import (
+	"container/list"
+	"context"
+	"restic"
+	"sync"
+
+	"restic/debug"
+	"restic/limits"
+)
+
+const (
+	prefetchWorkers = 8
+	prefetchQueue   = 256
+)
+
+// Prefetcher loads trees in the background and keeps them in memory, so that
+// they are available without waiting for the backend when they are requested
+// later. It implements TreeLoader.
+type Prefetcher struct {
+	repo     TreeLoader
+	maxTrees int
+
+	queue chan restic.ID
+
+	m       sync.Mutex
+	entries map[restic.ID]*prefetchEntry
+	lru     *list.List
+}
+
+// prefetchEntry is a tree which is loaded or about to be loaded. done is
+// closed when loading has finished.
+type prefetchEntry struct {
+	id      restic.ID
+	started bool
+	done    chan struct{}
+	tree    *restic.Tree
+	err     error
+	elem    *list.Element
+}
+
+// NewPrefetcher returns a prefetcher which loads trees from repo and keeps at
+// most maxTrees loaded trees in memory. The background workers are stopped
+// when ctx is cancelled.
+func NewPrefetcher(ctx context.Context, repo TreeLoader, maxTrees int) *Prefetcher {
+	p := &Prefetcher{
+		repo:     repo,
+		maxTrees: limits.CachedTrees(maxTrees),
+		queue:    make(chan restic.ID, prefetchQueue),
+		entries:  make(map[restic.ID]*prefetchEntry),
+		lru:      list.New(),
+	}
+
+	for i := 0; i < limits.Workers(prefetchWorkers); i++ {
+		go p.worker(ctx)
+	}
+
+	return p
+}
+
+func (p *Prefetcher) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-p.queue:
+			p.m.Lock()
+			e, ok := p.entries[id]
+			if !ok || e.started {
+				// the tree has been requested or evicted in the meantime
+				p.m.Unlock()
+				continue
+			}
+			e.started = true
+			p.m.Unlock()
+
+			debug.Log("prefetching tree %v", id.Str())
+			p.load(ctx, e)
+		}
+	}
+}
+
+// load loads the tree for e and records the result.
+func (p *Prefetcher) load(ctx context.Context, e *prefetchEntry) {
+	tree, err := p.repo.LoadTree(ctx, e.id)
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	e.tree, e.err = tree, err
+	close(e.done)
+
+	if err != nil {
+		// errors are not cached, the next request tries again
+		p.remove(e)
+		return
+	}
+
+	p.evict()
+}
+
+// remove removes e from the prefetcher. The caller must hold the lock.
+func (p *Prefetcher) remove(e *prefetchEntry) {
+	if p.entries[e.id] != e {
+		return
+	}
+
+	delete(p.entries, e.id)
+	if e.elem != nil {
+		p.lru.Remove(e.elem)
+		e.elem = nil
+	}
+}
+
+// evict removes the least recently used loaded trees until at most maxTrees
+// are left. The caller must hold the lock.
+func (p *Prefetcher) evict() {
+	for elem := p.lru.Back(); elem != nil && p.lru.Len() > p.maxTrees; {
+		prev := elem.Prev()
+
+		e := elem.Value.(*prefetchEntry)
+		select {
+		case <-e.done:
+			p.remove(e)
+		default:
+			// trees which are being loaded are kept
+		}
+
+		elem = prev
+	}
+}
+
+// Prefetch queues the trees for loading in the background. Trees which are
+// already loaded or queued are ignored, and so are all trees when the queue
+// is full.
+func (p *Prefetcher) Prefetch(ids ...restic.ID) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for _, id := range ids {
+		if _, ok := p.entries[id]; ok {
+			continue
+		}
+
+		select {
+		case p.queue <- id:
+		default:
+			debug.Log("prefetch queue is full, ignoring the remaining trees")
+			return
+		}
+
+		e := &prefetchEntry{id: id, done: make(chan struct{})}
+		e.elem = p.lru.PushFront(e)
+		p.entries[id] = e
+	}
+}
+
+// PrefetchSubtrees queues the subtrees of all directories in tree for
+// loading in the background.
+func (p *Prefetcher) PrefetchSubtrees(tree *restic.Tree) {
+	var ids []restic.ID
+	for _, node := range tree.Nodes {
+		if node.Type == "dir" && node.Subtree != nil {
+			ids = append(ids, *node.Subtree)
+		}
+	}
+
+	p.Prefetch(ids...)
+}
+
+// LoadTree returns the tree with the given id. If it has been prefetched, it
+// is returned from memory, if it is currently loaded in the background the
+// call waits until loading has finished. Otherwise, the tree is loaded
+// directly.
+func (p *Prefetcher) LoadTree(ctx context.Context, id restic.ID) (*restic.Tree, error) {
+	p.m.Lock()
+	e, ok := p.entries[id]
+	if !ok {
+		e = &prefetchEntry{id: id, done: make(chan struct{})}
+		e.elem = p.lru.PushFront(e)
+		p.entries[id] = e
+	} else {
+		p.lru.MoveToFront(e.elem)
+	}
+
+	load := !e.started
+	e.started = true
+	p.m.Unlock()
+
+	if load {
+		p.load(ctx, e)
+	}
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return e.tree, e.err
+}
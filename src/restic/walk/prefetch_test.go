@@ -0,0 +1,113 @@
+package walk_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"restic"
+	. "restic/test"
+	"restic/walk"
+)
+
+// countingLoader returns the trees from a map and counts the number of loads
+// for each tree.
+type countingLoader struct {
+	trees map[restic.ID]*restic.Tree
+
+	m     sync.Mutex
+	loads map[restic.ID]int
+}
+
+func (l *countingLoader) LoadTree(ctx context.Context, id restic.ID) (*restic.Tree, error) {
+	l.m.Lock()
+	l.loads[id]++
+	l.m.Unlock()
+
+	tree, ok := l.trees[id]
+	if !ok {
+		return nil, errors.New("tree not found")
+	}
+	return tree, nil
+}
+
+func (l *countingLoader) count(id restic.ID) int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.loads[id]
+}
+
+func TestPrefetcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	loader := &countingLoader{
+		trees: make(map[restic.ID]*restic.Tree),
+		loads: make(map[restic.ID]int),
+	}
+
+	root := restic.NewTree()
+	var ids restic.IDs
+	for i := 0; i < 5; i++ {
+		id := restic.NewRandomID()
+		loader.trees[id] = restic.NewTree()
+		ids = append(ids, id)
+
+		OK(t, root.Insert(&restic.Node{Name: id.String(), Type: "dir", Subtree: &id}))
+	}
+
+	p := walk.NewPrefetcher(ctx, loader, 100)
+	p.PrefetchSubtrees(root)
+
+	for _, id := range ids {
+		tree, err := p.LoadTree(ctx, id)
+		OK(t, err)
+		Assert(t, tree == loader.trees[id], "wrong tree returned for %v", id.Str())
+
+		// requesting the tree again does not load it from the repo
+		_, err = p.LoadTree(ctx, id)
+		OK(t, err)
+		Equals(t, 1, loader.count(id))
+	}
+
+	// errors are not cached
+	missing := restic.NewRandomID()
+	for i := 1; i <= 2; i++ {
+		_, err := p.LoadTree(ctx, missing)
+		Assert(t, err != nil, "no error returned for missing tree")
+		Equals(t, i, loader.count(missing))
+	}
+}
+
+func TestPrefetcherEvict(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	loader := &countingLoader{
+		trees: make(map[restic.ID]*restic.Tree),
+		loads: make(map[restic.ID]int),
+	}
+
+	var ids restic.IDs
+	for i := 0; i < 3; i++ {
+		id := restic.NewRandomID()
+		loader.trees[id] = restic.NewTree()
+		ids = append(ids, id)
+	}
+
+	p := walk.NewPrefetcher(ctx, loader, 2)
+	for _, id := range ids {
+		_, err := p.LoadTree(ctx, id)
+		OK(t, err)
+	}
+
+	// the least recently used tree has been evicted
+	_, err := p.LoadTree(ctx, ids[2])
+	OK(t, err)
+	Equals(t, 1, loader.count(ids[2]))
+
+	_, err = p.LoadTree(ctx, ids[0])
+	OK(t, err)
+	Equals(t, 2, loader.count(ids[0]))
+}
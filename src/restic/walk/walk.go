@@ -9,6 +9,7 @@ import (
 	"sync"
 
 	"restic/debug"
+	"restic/limits"
 )
 
 // TreeJob is a job sent from the tree walker.
@@ -181,7 +182,7 @@ func Tree(ctx context.Context, repo TreeLoader, id restic.ID, jobCh chan<- TreeJ
 	ch := make(chan loadTreeJob)
 
 	var wg sync.WaitGroup
-	for i := 0; i < loadTreeWorkers; i++ {
+	for i := 0; i < limits.Workers(loadTreeWorkers); i++ {
 		wg.Add(1)
 		go loadTreeWorker(ctx, &wg, ch, load)
 	}